@@ -0,0 +1,137 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// Progress milestones of an agent pod, in the order they are reached.
+const (
+	ProgressCreated   = "created"
+	ProgressScheduled = "scheduled"
+	ProgressPulling   = "pulling"
+	ProgressStarted   = "started"
+	ProgressReady     = "ready"
+)
+
+const defaultStreamTimeout = 5 * time.Minute
+
+var streamPollInterval = 2 * time.Second
+
+// Callers which accept server-sent events get live progress of the agent pod instead of a single
+// JSON response. Azure DevOps never asks for it, so its contract is unchanged.
+func wantsEventStream(req *http.Request) bool {
+	return strings.Contains(req.Header.Get("Accept"), "text/event-stream")
+}
+
+// Answers with an event stream, before the agent pod is created.
+func startEventStream(resp http.ResponseWriter) {
+	resp.Header().Set("Content-Type", "text/event-stream")
+	resp.Header().Set("Cache-Control", "no-cache")
+	resp.WriteHeader(http.StatusCreated)
+}
+
+// Streams the progress of the agent pod created at started until the pod is ready, fails or the
+// stream times out. The pod is looked up in the namespace and cluster of the response, which differ
+// from the ones of the provider for fallback namespaces, pools with a namespace of their own and
+// remote clusters. The last event always carries the AgentProvisionResponse.
+func streamAgentProgress(resp http.ResponseWriter, agentRequest AgentRequest, response AgentProvisionResponse, started time.Time) AgentProvisionResponse {
+	if !response.Accepted {
+		writeEvent(resp, "result", response)
+		return response
+	}
+
+	cs, err := clusterClientSet(response.Cluster)
+	if err != nil {
+		log.Println("Lost track of agent pod while streaming progress", err)
+		writeEvent(resp, "result", response)
+		return response
+	}
+	podClient := cs.clientset.CoreV1().Pods(response.Namespace)
+	reported := map[string]bool{}
+	deadline := time.Now().Add(getStreamTimeout())
+
+	for {
+		pods, err := podClient.List(metav1.ListOptions{LabelSelector: agentIdLabel + "=" + agentRequest.AgentId})
+		if err != nil || len(pods.Items) == 0 {
+			log.Println("Lost track of agent pod while streaming progress", err)
+			break
+		}
+
+		pod := &pods.Items[0]
+		for _, milestone := range podProgress(pod) {
+			if !reported[milestone] {
+				reported[milestone] = true
+				remaining := started.Add(time.Duration(response.EstimatedWaitSeconds) * time.Second).Sub(time.Now())
+				writeEvent(resp, "progress", map[string]interface{}{"Stage": milestone, "Pod": pod.GetName(), "EstimatedWaitSeconds": toSeconds(remaining)})
+			}
+		}
+
+		if reported[ProgressReady] || pod.Status.Phase == v1.PodFailed || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(streamPollInterval)
+	}
+
+	writeEvent(resp, "result", response)
+	return response
+}
+
+// Returns the milestones the pod has reached so far.
+func podProgress(pod *v1.Pod) []string {
+	progress := []string{ProgressCreated}
+
+	if !isPodConditionTrue(pod, v1.PodScheduled) {
+		return progress
+	}
+	progress = append(progress, ProgressScheduled)
+
+	started := false
+	for _, status := range pod.Status.ContainerStatuses {
+		if status.State.Running != nil || status.State.Terminated != nil {
+			started = true
+		}
+	}
+	if !started {
+		return append(progress, ProgressPulling)
+	}
+	progress = append(progress, ProgressPulling, ProgressStarted)
+
+	if isPodConditionTrue(pod, v1.PodReady) {
+		progress = append(progress, ProgressReady)
+	}
+	return progress
+}
+
+func isPodConditionTrue(pod *v1.Pod, conditionType v1.PodConditionType) bool {
+	for _, condition := range pod.Status.Conditions {
+		if condition.Type == conditionType {
+			return condition.Status == v1.ConditionTrue
+		}
+	}
+	return false
+}
+
+func writeEvent(resp http.ResponseWriter, event string, data interface{}) {
+	jsonData, _ := json.Marshal(data)
+	fmt.Fprintf(resp, "event: %s\ndata: %s\n\n", event, jsonData)
+	if flusher, ok := resp.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func getStreamTimeout() time.Duration {
+	if seconds, err := strconv.Atoi(os.Getenv("ACQUIRE_STREAM_TIMEOUT_SECONDS")); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	return defaultStreamTimeout
+}
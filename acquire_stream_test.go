@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestPodProgressShouldFollowPodStatus(t *testing.T) {
+	pod := &v1.Pod{}
+	if progress := podProgress(pod); len(progress) != 1 || progress[0] != ProgressCreated {
+		t.Errorf("New pod must only be created. Got %v", progress)
+	}
+
+	pod.Status.Conditions = []v1.PodCondition{{Type: v1.PodScheduled, Status: v1.ConditionTrue}}
+	if progress := podProgress(pod); progress[len(progress)-1] != ProgressPulling {
+		t.Errorf("Scheduled pod must be pulling. Got %v", progress)
+	}
+
+	pod.Status.ContainerStatuses = []v1.ContainerStatus{{State: v1.ContainerState{Running: &v1.ContainerStateRunning{}}}}
+	pod.Status.Conditions = append(pod.Status.Conditions, v1.PodCondition{Type: v1.PodReady, Status: v1.ConditionTrue})
+	if progress := podProgress(pod); len(progress) != 5 || progress[4] != ProgressReady {
+		t.Errorf("Running pod must be ready. Got %v", progress)
+	}
+}
+
+func TestAcquireHandlerShouldStreamProgressWhenRequested(t *testing.T) {
+	SetupCustomResource()
+	streamPollInterval = 0
+	defer func() { streamPollInterval = 2 * time.Second }()
+
+	var jsonStr = []byte(`{"AgentId":"1"}`)
+	req, _ := http.NewRequest("POST", "/acquire", bytes.NewBuffer(jsonStr))
+	req.Header.Add("Content-Type", "application/json")
+	req.Header.Add("Accept", "text/event-stream")
+	req.Header.Add("X-Azure-Signature", "4f6a97c5aa13477ed775dd20cdd7cf44477e310ba683545144d5112e77d88be967a43791da0696ded702a32ca0c190ab831dcd9204521b9a9ebe413066699ef9")
+
+	os.Setenv("ACQUIRE_STREAM_TIMEOUT_SECONDS", "1")
+	defer os.Unsetenv("ACQUIRE_STREAM_TIMEOUT_SECONDS")
+	resp := httptest.NewRecorder()
+	http.HandlerFunc(AcquireAgentHandler).ServeHTTP(resp, req)
+
+	body := resp.Body.String()
+	if !strings.Contains(body, "event: progress") || !strings.Contains(body, "event: result") {
+		t.Errorf("Expected progress and result events. Got %s", body)
+	}
+}
+
+type slotRecorder struct {
+	*httptest.ResponseRecorder
+	inUse []int
+}
+
+func (r *slotRecorder) Write(data []byte) (int, error) {
+	podCreationThrottle.mu.Lock()
+	r.inUse = append(r.inUse, podCreationThrottle.inUse)
+	podCreationThrottle.mu.Unlock()
+	return r.ResponseRecorder.Write(data)
+}
+
+func TestAcquireHandlerShouldReleaseTheCreationSlotBeforeStreaming(t *testing.T) {
+	SetupCustomResource()
+	streamPollInterval = 0
+	defer func() { streamPollInterval = 2 * time.Second }()
+
+	var jsonStr = []byte(`{"AgentId":"1"}`)
+	req, _ := http.NewRequest("POST", "/acquire", bytes.NewBuffer(jsonStr))
+	req.Header.Add("Content-Type", "application/json")
+	req.Header.Add("Accept", "text/event-stream")
+	req.Header.Add("X-Azure-Signature", "4f6a97c5aa13477ed775dd20cdd7cf44477e310ba683545144d5112e77d88be967a43791da0696ded702a32ca0c190ab831dcd9204521b9a9ebe413066699ef9")
+
+	os.Setenv("ACQUIRE_STREAM_TIMEOUT_SECONDS", "1")
+	defer os.Unsetenv("ACQUIRE_STREAM_TIMEOUT_SECONDS")
+	resp := &slotRecorder{ResponseRecorder: httptest.NewRecorder()}
+	http.HandlerFunc(AcquireAgentHandler).ServeHTTP(resp, req)
+
+	if len(resp.inUse) == 0 {
+		t.Fatalf("Expected events. Got %s", resp.Body.String())
+	}
+	for _, inUse := range resp.inUse {
+		if inUse != 0 {
+			t.Errorf("Expected no creation slot held while streaming. Got %d in use", inUse)
+		}
+	}
+}
+
+func TestStreamAgentProgressShouldFollowThePodInTheNamespaceOfTheResponse(t *testing.T) {
+	SetupCustomResource()
+	streamPollInterval = 0
+	defer func() { streamPollInterval = 2 * time.Second }()
+
+	pod := &v1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "agent-stream", Namespace: "builds", Labels: GenerateLabelsForPod("stream")}}
+	pod.Status.Phase = v1.PodFailed
+	CreateClientSet().clientset.CoreV1().Pods("builds").Create(pod)
+	defer CreateClientSet().clientset.CoreV1().Pods("builds").Delete("agent-stream", &metav1.DeleteOptions{})
+
+	resp := httptest.NewRecorder()
+	response := AgentProvisionResponse{Accepted: true, ResponseType: "Success", Namespace: "builds"}
+	streamAgentProgress(resp, AgentRequest{AgentId: "stream"}, response, time.Now())
+
+	if body := resp.Body.String(); !strings.Contains(body, "agent-stream") {
+		t.Errorf("Expected the progress of the pod in namespace builds. Got %s", body)
+	}
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	v1alpha1 "github.com/microsoft/poolprovider-for-k8s/pkg/apis/dev/v1alpha1"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// With EXTERNAL_AGENTS "true", agent pods created by other tooling join the agents of the provider
+// when they are labelled "poolprovider/adopt": "true" and carry the name of one of the pools in
+// the AgentPool label. The leader adopts them every ADOPTION_INTERVAL_SECONDS, 30 by default: the
+// pod gets an AgentId label, its own or "external-<pod name>", and a state record, so releases,
+// the MaxAgents and budget of the pool and the reconciliation treat it like any other agent pod.
+// Adopted pods which ran to completion are deleted along with their state. Pods naming no pool
+// are left alone.
+const (
+	adoptLabel            = "poolprovider/adopt"
+	adoptedAnnotation     = "poolprovider/adopted-at"
+	externalAgentIdPrefix = "external-"
+	adoptionAdopt         = "adopt"
+	adoptionCollect       = "collect"
+	maxLabelValueLength   = 63
+)
+
+var adoptionInterval = 30 * time.Second
+
+func RunAdoptionController(namespace string) {
+	if !strings.EqualFold(os.Getenv("EXTERNAL_AGENTS"), "true") {
+		return
+	}
+
+	interval := time.Duration(getEnvInt("ADOPTION_INTERVAL_SECONDS", int(adoptionInterval/time.Second))) * time.Second
+	for {
+		if IsLeader() {
+			if err := adoptExternalPods(namespace, time.Now().UTC()); err != nil {
+				log.Println("Adoption of external agent pods failed", err)
+			}
+		}
+		time.Sleep(interval)
+	}
+}
+
+func adoptExternalPods(namespace string, now time.Time) error {
+	crdobject, _, err := fetchAzurePipelinesPool(namespace)
+	if err != nil {
+		return err
+	}
+
+	cs := CreateClientSet()
+	pods, err := cs.clientset.CoreV1().Pods(namespace).List(metav1.ListOptions{LabelSelector: adoptLabel + "=true"})
+	if err != nil {
+		return err
+	}
+	for i := range pods.Items {
+		pod := &pods.Items[i]
+		switch adoptionAction(crdobject, pod) {
+		case adoptionAdopt:
+			adoptPod(cs, pod, namespace, now)
+		case adoptionCollect:
+			agentId := pod.Labels[agentIdLabel]
+			log.Println("Collecting completed external agent pod " + pod.GetName() + " of agent " + agentId)
+			RecordReleasedPodCost(pod)
+			deleteAgentResources(agentId, namespace, "")
+			ForgetAcquireRequest(agentId)
+		}
+	}
+	return nil
+}
+
+// Returns whether the pod is to be adopted, collected or left alone.
+func adoptionAction(crdobject *v1alpha1.AzurePipelinesPool, pod *v1.Pod) string {
+	if pod.GetDeletionTimestamp() != nil {
+		return ""
+	}
+	if isAdoptedPod(pod) {
+		if pod.Status.Phase == v1.PodSucceeded || pod.Status.Phase == v1.PodFailed {
+			return adoptionCollect
+		}
+		return ""
+	}
+
+	// FetchAgentPool falls back to the first pool for unknown names
+	poolName := pod.Labels[agentPoolLabel]
+	if pool := v1alpha1.FetchAgentPool(crdobject, poolName); pool == nil || pool.PoolName != poolName {
+		return ""
+	}
+	return adoptionAdopt
+}
+
+func isAdoptedPod(pod *v1.Pod) bool {
+	_, adopted := pod.GetAnnotations()[adoptedAnnotation]
+	return adopted
+}
+
+func externalAgentId(pod *v1.Pod) string {
+	if agentId := pod.Labels[agentIdLabel]; agentId != "" {
+		return agentId
+	}
+	agentId := externalAgentIdPrefix + pod.GetName()
+	if len(agentId) > maxLabelValueLength {
+		agentId = agentId[:maxLabelValueLength]
+	}
+	return strings.TrimRight(agentId, "-.")
+}
+
+func adoptPod(cs *k8s, pod *v1.Pod, namespace string, now time.Time) {
+	agentId := externalAgentId(pod)
+	pod.Labels[agentIdLabel] = agentId
+	if pod.Annotations == nil {
+		pod.Annotations = map[string]string{}
+	}
+	pod.Annotations[adoptedAnnotation] = now.Format(time.RFC3339)
+
+	if _, err := cs.clientset.CoreV1().Pods(namespace).Update(pod); err != nil {
+		log.Println("Failed to adopt external agent pod "+pod.GetName(), err)
+		return
+	}
+	StoreAcquireResult(agentId, AgentProvisionResponse{Accepted: true, ResponseType: "Success"})
+	log.Println("Adopted external agent pod " + pod.GetName() + " as agent " + agentId + " of pool " + pod.Labels[agentPoolLabel])
+}
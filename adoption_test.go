@@ -0,0 +1,59 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	v1alpha1 "github.com/microsoft/poolprovider-for-k8s/pkg/apis/dev/v1alpha1"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func externalPod(name string, pool string, annotations map[string]string, phase v1.PodPhase) *v1.Pod {
+	return &v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        name,
+			Labels:      map[string]string{adoptLabel: "true", agentPoolLabel: pool},
+			Annotations: annotations,
+		},
+		Status: v1.PodStatus{Phase: phase},
+	}
+}
+
+func TestAdoptionActionShouldAdoptPodsOfKnownPoolsOnly(t *testing.T) {
+	crdobject := &v1alpha1.AzurePipelinesPool{Spec: v1alpha1.AzurePipelinesPoolSpec{
+		AgentPools: []v1alpha1.AgentPoolSpec{{PoolName: "linux"}, {PoolName: "windows"}},
+	}}
+
+	if action := adoptionAction(crdobject, externalPod("agent-1", "windows", nil, v1.PodRunning)); action != adoptionAdopt {
+		t.Errorf("Expected the pod to be adopted. Got %q", action)
+	}
+	if action := adoptionAction(crdobject, externalPod("agent-2", "gpu", nil, v1.PodRunning)); action != "" {
+		t.Errorf("Expected a pod of an unknown pool to be left alone. Got %q", action)
+	}
+
+	adopted := map[string]string{adoptedAnnotation: "2026-01-01T00:00:00Z"}
+	if action := adoptionAction(crdobject, externalPod("agent-3", "linux", adopted, v1.PodRunning)); action != "" {
+		t.Errorf("Expected a running adopted pod to be left alone. Got %q", action)
+	}
+	if action := adoptionAction(crdobject, externalPod("agent-4", "linux", adopted, v1.PodSucceeded)); action != adoptionCollect {
+		t.Errorf("Expected a completed adopted pod to be collected. Got %q", action)
+	}
+}
+
+func TestExternalAgentIdShouldBeAValidLabelValue(t *testing.T) {
+	pod := externalPod("agent-1", "linux", nil, v1.PodRunning)
+	if agentId := externalAgentId(pod); agentId != "external-agent-1" {
+		t.Errorf("Unexpected agent id %s", agentId)
+	}
+
+	pod.Name = strings.Repeat("a", 54) + "-" + strings.Repeat("b", 10)
+	if agentId := externalAgentId(pod); len(agentId) > maxLabelValueLength || strings.HasSuffix(agentId, "-") {
+		t.Errorf("Expected a valid label value. Got %s", agentId)
+	}
+
+	pod.Labels[agentIdLabel] = "42"
+	if agentId := externalAgentId(pod); agentId != "42" {
+		t.Errorf("Expected the agent id of the pod. Got %s", agentId)
+	}
+}
@@ -3,6 +3,18 @@
 set -e
 
 AGENT_FOLDER="agent"
+
+# Standby pods of a warm pool start before their agent secret exists, wait until it is mounted
+while [ ! -s /azurepipelines/agent/.agent ]; do
+  sleep 2
+done
+
+# Prove the pod identity to the pool provider, the work routing metadata is only handed to attested agents
+if [ -n "$AZP_ATTEST_URL" ] && [ -s "$AZP_IDENTITY_TOKEN" ]; then
+  curl -fsS -X POST -H "Authorization: Bearer $(cat $AZP_IDENTITY_TOKEN)" "$AZP_ATTEST_URL" -o /azp/routing.json \
+    || echo "Agent attestation failed"
+fi
+
 AZP_AGENT_VERSION="$(cat /azurepipelines/agent/.agentVersion)"
 AGENTVERSION="$(curl -s "https://api.github.com/repos/microsoft/azure-pipelines-agent/releases/latest" | jq -r .tag_name[1:])"
 
@@ -48,6 +60,27 @@ echo "Mounting the .agent and .credentials files from a different source"
 ln -fs /azurepipelines/agent/.agent /azp/$AGENT_FOLDER/.agent
 ln -fs /azurepipelines/agent/.credentials /azp/$AGENT_FOLDER/.credentials
 
+# In diagnostic mode the diagnostic logs of the agent go to the container log as well
+if [ -n "$AZP_AGENT_DIAGNOSTICS" ]; then
+  echo "Running Azure Pipelines agent in diagnostic mode $AZP_AGENT_DIAGNOSTICS..."
+  mkdir -p _diag
+  # The agent starts new log files as it goes, follow each one once it appears
+  (cd _diag && while true; do
+    for log in *.log; do
+      if [ -e "$log" ] && [ ! -e ".$log.followed" ]; then
+        touch ".$log.followed"
+        tail -n +1 -F "$log" &
+      fi
+    done
+    sleep 2
+  done) &
+fi
+
+# Agents of ephemeral pools run exactly one job, the provider deletes the pod once they exited
+if [ "$AZP_AGENT_DIAGNOSTICS" = "once" ] || [ "$AZP_AGENT_ONCE" = "true" ]; then
+  exec ./bin/Agent.Listener run --once
+fi
+
 echo "Running Azure Pipelines agent..."
 
 # `exec` the node runtime so it's aware of TERM and INT signals
@@ -25,7 +25,13 @@ try
   Copy-Item \vsts\agent\.credentials -Destination \azp\agent\.credentials
   Write-Host "Running Azure Pipelines agent..." -ForegroundColor Cyan
 
-  .\run.cmd
+  # In diagnostic mode "once" the agent exits after its job, the diagnostic logs are printed below.
+  # Agents of ephemeral pools always exit after their job.
+  if ($Env:AZP_AGENT_DIAGNOSTICS -eq "once" -or $Env:AZP_AGENT_ONCE -eq "true") {
+    .\run.cmd --once
+  } else {
+    .\run.cmd
+  }
 }
 catch
 {
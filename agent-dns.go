@@ -0,0 +1,91 @@
+package main
+
+import (
+	"log"
+	"regexp"
+	"strings"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const agentDnsEnvironmentVariable = "AGENT_DNS_NAME"
+
+var invalidServiceNameCharacters = regexp.MustCompile("[^a-z0-9-]")
+
+// Name of the headless service published for the agent. Service names have to be valid DNS labels.
+func agentServiceName(agentId string) string {
+	name := "agent-" + invalidServiceNameCharacters.ReplaceAllString(strings.ToLower(agentId), "-")
+	if len(name) > 63 {
+		name = name[:63]
+	}
+	return strings.TrimRight(name, "-")
+}
+
+func GetAgentDnsName(agentId string, namespace string) string {
+	return agentServiceName(agentId) + "." + namespace + ".svc.cluster.local"
+}
+
+// Tells the agent under which DNS name other pods can reach it.
+func addAgentDnsEnvironmentVariable(pod *v1.Pod, agentId string, namespace string) {
+	for i := range pod.Spec.Containers {
+		pod.Spec.Containers[i].Env = append(pod.Spec.Containers[i].Env, v1.EnvVar{
+			Name:  agentDnsEnvironmentVariable,
+			Value: GetAgentDnsName(agentId, namespace),
+		})
+	}
+}
+
+// Creates a headless service selecting only the agent pod. The pod owns the service, so it is
+// garbage collected with the pod even if the release request never arrives.
+func createAgentService(cs *k8s, pod *v1.Pod, agentId string, namespace string) error {
+	return createOwnedAgentService(cs, podOwnerReference(pod), agentId, namespace)
+}
+
+// Creates the headless service of the agent, deleted with its owner, the agent pod or Job.
+func createOwnedAgentService(cs *k8s, owner metav1.OwnerReference, agentId string, namespace string) error {
+	service := &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:            agentServiceName(agentId),
+			Namespace:       namespace,
+			Labels:          GenerateLabelsForPod(agentId),
+			OwnerReferences: []metav1.OwnerReference{owner},
+		},
+		Spec: v1.ServiceSpec{
+			ClusterIP:                v1.ClusterIPNone,
+			Selector:                 GenerateLabelsForPod(agentId),
+			PublishNotReadyAddresses: true,
+		},
+	}
+
+	_, err := cs.clientset.CoreV1().Services(namespace).Create(service)
+	if err == nil {
+		log.Println("Published agent DNS name " + GetAgentDnsName(agentId, namespace))
+	}
+	return err
+}
+
+func podOwnerReference(pod *v1.Pod) metav1.OwnerReference {
+	falseVar := false
+	return metav1.OwnerReference{
+		APIVersion: "v1",
+		Kind:       "Pod",
+		Name:       pod.GetName(),
+		UID:        pod.GetUID(),
+		Controller: &falseVar,
+	}
+}
+
+func deleteAgentServices(cs *k8s, agentId string, namespace string) {
+	serviceClient := cs.clientset.CoreV1().Services(namespace)
+	services, err := serviceClient.List(metav1.ListOptions{LabelSelector: agentIdLabel + "=" + agentId})
+	if err != nil {
+		return
+	}
+
+	for _, service := range services.Items {
+		if err := serviceClient.Delete(service.GetName(), &metav1.DeleteOptions{}); err != nil {
+			log.Println("Failed to delete agent service "+service.GetName(), err)
+		}
+	}
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"time"
+
+	v1alpha1 "github.com/microsoft/poolprovider-for-k8s/pkg/apis/dev/v1alpha1"
+	batchv1 "k8s.io/api/batch/v1"
+	v1 "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// Agent pools with a job setting run every agent as a Kubernetes Job instead of a bare pod. The
+// Job and its pod carry the labels of an agent pod, so status, reconciliation and MaxAgents find
+// the pod like any other, and the pod restarts never. Releasing the agent deletes the Job with its
+// pod; a Job whose agent exited on its own is deleted by Kubernetes TTLSecondsAfterFinished after
+// it finished. The leader records the outcome of finished Jobs in the storage every
+// AGENT_JOB_INTERVAL_SECONDS, so the release of an agent whose Job is already gone still cleans up
+// its secret. Records of agents never released are removed after AGENT_JOB_RETENTION_HOURS, 48 by
+// default.
+const (
+	agentJobKeyPrefix           = "agent-job:"
+	defaultAgentJobRetention    = 48 * time.Hour
+	defaultAgentJobTTLSeconds   = 300
+	defaultAgentJobBackoffLimit = 0
+	AgentJobOutcomeSucceeded    = "succeeded"
+	AgentJobOutcomeFailed       = "failed"
+	jobOwnerKind                = "Job"
+)
+
+var agentJobInterval = 30 * time.Second
+
+type AgentJobRecord struct {
+	AgentId    string
+	Pool       string
+	Job        string
+	Namespace  string
+	Outcome    string
+	Reason     string `json:",omitempty"`
+	FinishedAt time.Time
+}
+
+func isAgentJobPool(pool *v1alpha1.AgentPoolSpec) bool {
+	return pool != nil && pool.Job != nil
+}
+
+// Returns the Job running the agent pod. The pod never restarts, failed agents are retried by the
+// Job up to its backoff limit.
+func newAgentJob(pod *v1.Pod, spec *v1alpha1.AgentJobSpec) *batchv1.Job {
+	ttl, backoffLimit := int32(defaultAgentJobTTLSeconds), int32(defaultAgentJobBackoffLimit)
+	if spec.TTLSecondsAfterFinished != nil {
+		ttl = *spec.TTLSecondsAfterFinished
+	}
+	if spec.BackoffLimit != nil {
+		backoffLimit = *spec.BackoffLimit
+	}
+
+	podSpec := pod.Spec.DeepCopy()
+	podSpec.RestartPolicy = v1.RestartPolicyNever
+	return &batchv1.Job{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:            pod.GetName(),
+			GenerateName:    pod.GetGenerateName(),
+			Namespace:       pod.GetNamespace(),
+			Labels:          pod.GetLabels(),
+			Annotations:     pod.GetAnnotations(),
+			OwnerReferences: pod.GetOwnerReferences(),
+		},
+		Spec: batchv1.JobSpec{
+			TTLSecondsAfterFinished: &ttl,
+			BackoffLimit:            &backoffLimit,
+			Template: v1.PodTemplateSpec{
+				ObjectMeta: metav1.ObjectMeta{Labels: pod.GetLabels(), Annotations: pod.GetAnnotations()},
+				Spec:       *podSpec,
+			},
+		},
+	}
+}
+
+// Creates the agent pod, or the Job running it for pools with a job setting. Returns the name of the
+// created object and the owner reference for the objects which live as long as the agent.
+func createAgentWorkload(cs *k8s, pod *v1.Pod, pool *v1alpha1.AgentPoolSpec, namespace string) (string, metav1.OwnerReference, error) {
+	if isAgentJobPool(pool) {
+		job, err := cs.clientset.BatchV1().Jobs(namespace).Create(newAgentJob(pod, pool.Job))
+		if err != nil {
+			return "", metav1.OwnerReference{}, err
+		}
+		return job.GetName(), jobOwnerReference(job), nil
+	}
+
+	created, err := cs.clientset.CoreV1().Pods(namespace).Create(pod)
+	if err != nil {
+		return "", metav1.OwnerReference{}, err
+	}
+	return created.GetName(), podOwnerReference(created), nil
+}
+
+func jobOwnerReference(job *batchv1.Job) metav1.OwnerReference {
+	falseVar := false
+	return metav1.OwnerReference{
+		APIVersion: "batch/v1",
+		Kind:       jobOwnerKind,
+		Name:       job.GetName(),
+		UID:        job.GetUID(),
+		Controller: &falseVar,
+	}
+}
+
+// Returns the name of the Job running the pod, or an empty string for bare pods.
+func agentJobOf(pod *v1.Pod) string {
+	for _, owner := range pod.GetOwnerReferences() {
+		if owner.Kind == jobOwnerKind {
+			return owner.Name
+		}
+	}
+	return ""
+}
+
+// Deletes the agent pod, or the Job running it together with its pods.
+func deleteAgentWorkload(cs *k8s, pod *v1.Pod, namespace string) error {
+	job := agentJobOf(pod)
+	if job == "" {
+		return cs.clientset.CoreV1().Pods(namespace).Delete(pod.GetName(), &metav1.DeleteOptions{})
+	}
+
+	propagation := metav1.DeletePropagationBackground
+	err := cs.clientset.BatchV1().Jobs(namespace).Delete(job, &metav1.DeleteOptions{PropagationPolicy: &propagation})
+	if err != nil && !k8serrors.IsNotFound(err) {
+		return err
+	}
+	return nil
+}
+
+// Returns the outcome of a finished Job, or an empty string while it runs.
+func agentJobOutcome(job *batchv1.Job) (string, string) {
+	for _, condition := range job.Status.Conditions {
+		if condition.Status != v1.ConditionTrue {
+			continue
+		}
+		switch condition.Type {
+		case batchv1.JobComplete:
+			return AgentJobOutcomeSucceeded, ""
+		case batchv1.JobFailed:
+			return AgentJobOutcomeFailed, condition.Reason
+		}
+	}
+	return "", ""
+}
+
+func RunAgentJobTracker(namespace string) {
+	interval := time.Duration(getEnvInt("AGENT_JOB_INTERVAL_SECONDS", int(agentJobInterval/time.Second))) * time.Second
+	for {
+		if IsLeader() {
+			for _, ns := range agentNamespaces(namespace) {
+				if err := trackAgentJobs(ns, time.Now().UTC()); err != nil {
+					log.Println("Tracking the agent jobs in namespace "+ns+" failed", err)
+				}
+			}
+		}
+		time.Sleep(interval)
+	}
+}
+
+// Records the outcome of the finished agent Jobs of the namespace which have not been recorded yet.
+func trackAgentJobs(namespace string, now time.Time) error {
+	cs := CreateClientSet()
+	jobs, err := cs.clientset.BatchV1().Jobs(namespace).List(metav1.ListOptions{LabelSelector: agentIdLabel})
+	if err != nil {
+		return err
+	}
+
+	store := GetStorage()
+	for i := range jobs.Items {
+		job := &jobs.Items[i]
+		outcome, reason := agentJobOutcome(job)
+		if outcome == "" {
+			continue
+		}
+		record := AgentJobRecord{
+			AgentId:    job.GetLabels()[agentIdLabel],
+			Pool:       job.GetLabels()[agentPoolLabel],
+			Job:        job.GetName(),
+			Namespace:  namespace,
+			Outcome:    outcome,
+			Reason:     reason,
+			FinishedAt: now,
+		}
+		if job.Status.CompletionTime != nil {
+			record.FinishedAt = job.Status.CompletionTime.Time.UTC()
+		}
+		data, _ := json.Marshal(record)
+		set, err := store.SetIfAbsent(agentJobKeyPrefix+record.AgentId, string(data))
+		if err != nil {
+			return err
+		}
+		if set {
+			log.Println("Agent job " + record.Job + " of agent " + record.AgentId + " " + outcome)
+		}
+	}
+	return nil
+}
+
+func getAgentJobRecord(agentId string) (AgentJobRecord, bool) {
+	var record AgentJobRecord
+	value, err := GetStorage().Get(agentJobKeyPrefix + agentId)
+	if err != nil || json.Unmarshal([]byte(value), &record) != nil {
+		return record, false
+	}
+	return record, true
+}
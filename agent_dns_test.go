@@ -0,0 +1,40 @@
+package main
+
+import (
+	"testing"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestAgentServiceNameShouldBeValidDnsLabel(t *testing.T) {
+	if name := agentServiceName("Agent_42"); name != "agent-agent-42" {
+		t.Errorf("Unexpected service name %s", name)
+	}
+	if dnsName := GetAgentDnsName("42", testnamespace); dnsName != "agent-42.azuredevops.svc.cluster.local" {
+		t.Errorf("Unexpected DNS name %s", dnsName)
+	}
+}
+
+func TestReleaseMustDeleteAgentService(t *testing.T) {
+	var agentrequest AgentRequest
+	agentrequest.AgentId = "1"
+	SetupCustomResource()
+
+	testPod := CreatePod(agentrequest, testnamespace)
+	if testPod.Accepted != true {
+		t.Errorf("Pod creation failed")
+	}
+
+	cs := CreateClientSet()
+	pods, _ := cs.clientset.CoreV1().Pods(testnamespace).List(metav1.ListOptions{LabelSelector: agentIdLabel + "=" + agentrequest.AgentId})
+	if err := createAgentService(cs, &pods.Items[0], agentrequest.AgentId, testnamespace); err != nil {
+		t.Fatalf("create service failed: (%v)", err)
+	}
+
+	DeletePodWithAgentId(agentrequest.AgentId, testnamespace)
+
+	services, _ := cs.clientset.CoreV1().Services(testnamespace).List(metav1.ListOptions{LabelSelector: agentIdLabel + "=" + agentrequest.AgentId})
+	if services == nil || len(services.Items) != 0 {
+		t.Errorf("Agent service not deleted on release")
+	}
+}
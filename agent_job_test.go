@@ -0,0 +1,50 @@
+package main
+
+import (
+	"testing"
+
+	v1alpha1 "github.com/microsoft/poolprovider-for-k8s/pkg/apis/dev/v1alpha1"
+	batchv1 "k8s.io/api/batch/v1"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestNewAgentJobShouldRunThePodOnce(t *testing.T) {
+	pod := v1alpha1.NewAgentPod(&v1.PodSpec{Containers: []v1.Container{{Name: "vsts-agent", Image: "agent"}}}, GenerateLabelsForPod("7"))
+	ttl := int32(60)
+
+	job := newAgentJob(pod, &v1alpha1.AgentJobSpec{TTLSecondsAfterFinished: &ttl})
+	if job.GetLabels()[agentIdLabel] != "7" || job.Spec.Template.GetLabels()[agentIdLabel] != "7" {
+		t.Errorf("Expected the agent labels on the job and its pod. Got %v, %v", job.GetLabels(), job.Spec.Template.GetLabels())
+	}
+	if *job.Spec.TTLSecondsAfterFinished != 60 || *job.Spec.BackoffLimit != defaultAgentJobBackoffLimit {
+		t.Errorf("Expected TTL 60 and the default backoff limit. Got %d, %d", *job.Spec.TTLSecondsAfterFinished, *job.Spec.BackoffLimit)
+	}
+	if job.Spec.Template.Spec.RestartPolicy != v1.RestartPolicyNever || pod.Spec.RestartPolicy == v1.RestartPolicyNever {
+		t.Errorf("Expected the job pod to never restart and the agent pod to be left untouched")
+	}
+}
+
+func TestAgentJobOutcomeShouldReadTheFinishedCondition(t *testing.T) {
+	job := &batchv1.Job{}
+	if outcome, _ := agentJobOutcome(job); outcome != "" {
+		t.Errorf("Expected no outcome for a running job. Got %s", outcome)
+	}
+
+	job.Status.Conditions = []batchv1.JobCondition{{Type: batchv1.JobFailed, Status: v1.ConditionTrue, Reason: "BackoffLimitExceeded"}}
+	if outcome, reason := agentJobOutcome(job); outcome != AgentJobOutcomeFailed || reason != "BackoffLimitExceeded" {
+		t.Errorf("Expected the failed outcome. Got %s (%s)", outcome, reason)
+	}
+}
+
+func TestAgentJobOfShouldFindTheOwningJob(t *testing.T) {
+	pod := &v1.Pod{ObjectMeta: metav1.ObjectMeta{OwnerReferences: []metav1.OwnerReference{{Kind: "Pod", Name: "webserver"}}}}
+	if job := agentJobOf(pod); job != "" {
+		t.Errorf("Expected a bare pod. Got job %s", job)
+	}
+
+	pod.OwnerReferences = append(pod.OwnerReferences, jobOwnerReference(&batchv1.Job{ObjectMeta: metav1.ObjectMeta{Name: "azure-pipelines-agent-x"}}))
+	if job := agentJobOf(pod); job != "azure-pipelines-agent-x" {
+		t.Errorf("Expected the owning job. Got %s", job)
+	}
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Every agent pool has its own budget of Kubernetes API operations, so one pool creating and
+// deleting pods by the hundred, e.g. for a huge matrix build, cannot starve the others. Each pod
+// creation or deletion of a pool, by a request or by the warm pool, takes a token from the bucket of
+// the pool, which holds POOL_API_BUDGET_PER_MINUTE tokens and is refilled at that rate. Pools get
+// their own budget in POOL_API_BUDGETS as "pool=perMinute,pool2=perMinute". A budget of 0, the
+// default, is no budget. Requests wait up to 30 seconds for a token; the warm pool does not wait
+// and adds or removes the remaining standby pods in its next round.
+const (
+	apiOperationCreate = "create"
+	apiOperationDelete = "delete"
+)
+
+var errApiBudgetExhausted = errors.New(ApiBudgetExhaustedError)
+
+type tokenBucket struct {
+	perMinute int
+	tokens    float64
+	updated   time.Time
+}
+
+type poolApiBudget struct {
+	mu        sync.Mutex
+	perMinute int
+	pools     map[string]int
+	buckets   map[string]*tokenBucket
+}
+
+var apiBudget = newPoolApiBudget(getEnvInt("POOL_API_BUDGET_PER_MINUTE", 0), parsePoolApiBudgets(os.Getenv("POOL_API_BUDGETS")))
+
+func newPoolApiBudget(perMinute int, pools map[string]int) *poolApiBudget {
+	return &poolApiBudget{perMinute: perMinute, pools: pools, buckets: map[string]*tokenBucket{}}
+}
+
+func parsePoolApiBudgets(value string) map[string]int {
+	pools := map[string]int{}
+	for _, entry := range strings.Split(value, ",") {
+		parts := strings.SplitN(strings.TrimSpace(entry), "=", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		if perMinute, err := strconv.Atoi(parts[1]); err == nil {
+			pools[parts[0]] = perMinute
+		}
+	}
+	return pools
+}
+
+func (b *poolApiBudget) budgetOf(pool string) int {
+	if perMinute, ok := b.pools[pool]; ok {
+		return perMinute
+	}
+	return b.perMinute
+}
+
+// Takes a token of the pool and returns how long to wait until it is due. When that is longer than
+// maxWait, the token is not taken and false is returned.
+func (b *poolApiBudget) take(pool string, maxWait time.Duration, now time.Time) (time.Duration, bool) {
+	perMinute := b.budgetOf(pool)
+	if perMinute <= 0 {
+		return 0, true
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	bucket, ok := b.buckets[pool]
+	if !ok || bucket.perMinute != perMinute {
+		bucket = &tokenBucket{perMinute: perMinute, tokens: float64(perMinute), updated: now}
+		b.buckets[pool] = bucket
+	}
+	perSecond := float64(perMinute) / 60
+	bucket.tokens += now.Sub(bucket.updated).Seconds() * perSecond
+	if bucket.tokens > float64(perMinute) {
+		bucket.tokens = float64(perMinute)
+	}
+	bucket.updated = now
+
+	// Tokens taken ahead of time leave the bucket below zero, later requests wait for them too
+	bucket.tokens--
+	if bucket.tokens >= 0 {
+		return 0, true
+	}
+	wait := time.Duration(-bucket.tokens / perSecond * float64(time.Second))
+	if wait > maxWait {
+		bucket.tokens++
+		return wait, false
+	}
+	return wait, true
+}
+
+// Waits for a token of the API budget of the pool for the operation, up to maxWait.
+func waitForApiBudget(pool string, operation string, maxWait time.Duration) error {
+	wait, ok := apiBudget.take(pool, maxWait, time.Now())
+	if !ok {
+		poolApiThrottled.WithLabelValues(pool, operation, "rejected").Inc()
+		return errApiBudgetExhausted
+	}
+	if wait > 0 {
+		poolApiThrottled.WithLabelValues(pool, operation, "delayed").Inc()
+		time.Sleep(wait)
+	}
+	return nil
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestApiBudgetShouldRefillOverTheMinute(t *testing.T) {
+	budget := newPoolApiBudget(60, nil)
+	now := time.Date(2026, 10, 15, 12, 0, 0, 0, time.UTC)
+	for i := 0; i < 60; i++ {
+		if wait, ok := budget.take("linux", 0, now); !ok || wait != 0 {
+			t.Fatalf("Expected token %d of the minute right away. Got %v %v", i, wait, ok)
+		}
+	}
+	if _, ok := budget.take("linux", 0, now); ok {
+		t.Errorf("Expected no token left without waiting")
+	}
+	if wait, ok := budget.take("linux", 5*time.Second, now); !ok || wait != time.Second {
+		t.Errorf("Expected the next token due in a second. Got %v %v", wait, ok)
+	}
+	if wait, ok := budget.take("linux", 5*time.Second, now.Add(3*time.Second)); !ok || wait != 0 {
+		t.Errorf("Expected the bucket refilled after 3 seconds. Got %v %v", wait, ok)
+	}
+}
+
+func TestApiBudgetShouldBeKeptPerPool(t *testing.T) {
+	budget := newPoolApiBudget(1, parsePoolApiBudgets("matrix=2, unlimited=0"))
+	now := time.Date(2026, 10, 15, 12, 0, 0, 0, time.UTC)
+	budget.take("matrix", 0, now)
+	budget.take("matrix", 0, now)
+	if _, ok := budget.take("matrix", 0, now); ok {
+		t.Errorf("Expected the noisy pool out of tokens")
+	}
+	if _, ok := budget.take("linux", 0, now); !ok {
+		t.Errorf("Expected the other pools to keep their own budget")
+	}
+	for i := 0; i < 100; i++ {
+		if _, ok := budget.take("unlimited", 0, now); !ok {
+			t.Fatalf("Expected a pool without budget never throttled")
+		}
+	}
+}
@@ -0,0 +1,359 @@
+package main
+
+import (
+	"hash/fnv"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+)
+
+// Agents download the same toolchains and artifacts for every job. With ARTIFACT_CACHE_DIR, a
+// directory on a persistent volume or an object storage mounted through a CSI driver, the
+// webserver serves GET /artifacts/<upstream>/<path> from that directory and only fetches what is
+// missing or older than ARTIFACT_CACHE_MAX_AGE_SECONDS, 24 hours by default, from the upstream.
+// ARTIFACT_CACHE_UPSTREAMS names the upstreams which may be fetched from, comma separated, e.g.
+// "node=https://nodejs.org/dist,go=https://go.dev/dl", so the cache is no open proxy. Agent pods
+// find the cache through AZP_ARTIFACT_CACHE_URL. POST /admin/artifacts/purge, signed like the
+// other admin requests, removes the artifact named by upstream and path, all artifacts of the
+// upstream when only upstream is set, or everything.
+const (
+	artifactRoute                = "/artifacts/"
+	artifactCacheUrlEnvVariable  = "AZP_ARTIFACT_CACHE_URL"
+	defaultArtifactCacheMaxAge   = 24 * time.Hour
+	artifactFetchTimeout         = 10 * time.Minute
+	artifactCacheLockStripes     = 64
+	artifactCacheHeader          = "X-Cache"
+	ArtifactCacheHit             = "HIT"
+	ArtifactCacheMiss            = "MISS"
+	ArtifactCacheRevalidated     = "REVALIDATED"
+	ArtifactCacheStale           = "STALE"
+	artifactTemporaryFilePattern = ".download-*"
+)
+
+type artifactCache struct {
+	dir       string
+	upstreams map[string]*url.URL
+	maxAge    time.Duration
+	client    *http.Client
+	// Concurrent misses of one artifact wait for the first download instead of fetching it again.
+	// Hits are served without a lock.
+	locks [artifactCacheLockStripes]sync.Mutex
+}
+
+type ArtifactPurgeResponse struct {
+	Purged int
+}
+
+var artifactCacheFromEnvironment = struct {
+	sync.Once
+	cache *artifactCache
+}{}
+
+func newArtifactCacheFromEnvironment() *artifactCache {
+	artifactCacheFromEnvironment.Do(func() {
+		artifactCacheFromEnvironment.cache = newArtifactCache(os.Getenv("ARTIFACT_CACHE_DIR"), os.Getenv("ARTIFACT_CACHE_UPSTREAMS"),
+			time.Duration(getEnvInt("ARTIFACT_CACHE_MAX_AGE_SECONDS", int(defaultArtifactCacheMaxAge/time.Second)))*time.Second)
+	})
+	return artifactCacheFromEnvironment.cache
+}
+
+func newArtifactCache(dir string, upstreams string, maxAge time.Duration) *artifactCache {
+	if dir == "" {
+		return nil
+	}
+
+	cache := &artifactCache{
+		dir:       dir,
+		upstreams: map[string]*url.URL{},
+		maxAge:    maxAge,
+		client:    &http.Client{Transport: outboundTransport, Timeout: artifactFetchTimeout},
+	}
+	for _, upstream := range strings.Split(upstreams, ",") {
+		parts := strings.SplitN(strings.TrimSpace(upstream), "=", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		target, err := url.Parse(parts[1])
+		if err != nil || target.Scheme == "" || target.Host == "" || strings.ContainsAny(parts[0], "/.") {
+			log.Println("Ignoring invalid artifact cache upstream " + upstream)
+			continue
+		}
+		cache.upstreams[parts[0]] = target
+	}
+	if len(cache.upstreams) == 0 {
+		log.Println("Artifact cache disabled, ARTIFACT_CACHE_UPSTREAMS names no valid upstream")
+		return nil
+	}
+	return cache
+}
+
+// Returns the upstream name and the cleaned path of the artifact in the request path, ok is false
+// when the path names no artifact.
+func parseArtifactPath(requestPath string) (string, string, bool) {
+	parts := strings.SplitN(strings.TrimPrefix(requestPath, artifactRoute), "/", 2)
+	if len(parts) != 2 {
+		return "", "", false
+	}
+	artifact := strings.TrimPrefix(path.Clean("/"+parts[1]), "/")
+	if parts[0] == "" || artifact == "" || strings.HasPrefix(path.Base(artifact), ".") {
+		return "", "", false
+	}
+	return parts[0], artifact, true
+}
+
+func (c *artifactCache) file(upstream string, artifact string) string {
+	return filepath.Join(c.dir, upstream, filepath.FromSlash(artifact))
+}
+
+func (c *artifactCache) lock(key string) *sync.Mutex {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return &c.locks[h.Sum32()%artifactCacheLockStripes]
+}
+
+// Returns the cached artifact, fetching it from the upstream first when it is missing or stale.
+// The result tells how the artifact was served. A stale copy is served when the upstream fails.
+func (c *artifactCache) open(upstream string, artifact string, now time.Time) (*os.File, string, int, error) {
+	file := c.file(upstream, artifact)
+	if f, ok := c.openFresh(file, now); ok {
+		return f, ArtifactCacheHit, http.StatusOK, nil
+	}
+
+	lock := c.lock(upstream + "/" + artifact)
+	lock.Lock()
+	defer lock.Unlock()
+	// A concurrent request may have fetched it meanwhile
+	if f, ok := c.openFresh(file, now); ok {
+		return f, ArtifactCacheHit, http.StatusOK, nil
+	}
+
+	info, err := os.Stat(file)
+	cached := err == nil && info.Mode().IsRegular()
+
+	var modifiedSince time.Time
+	if cached {
+		modifiedSince = info.ModTime()
+	}
+	result, status, err := c.fetch(upstream, artifact, file, modifiedSince, now)
+	if err != nil {
+		if !cached {
+			return nil, "", status, err
+		}
+		log.Println("Serving stale artifact "+upstream+"/"+artifact, err)
+		result = ArtifactCacheStale
+	}
+	f, err := os.Open(file)
+	return f, result, http.StatusOK, err
+}
+
+func (c *artifactCache) openFresh(file string, now time.Time) (*os.File, bool) {
+	info, err := os.Stat(file)
+	if err != nil || !info.Mode().IsRegular() || now.Sub(info.ModTime()) >= c.maxAge {
+		return nil, false
+	}
+	f, err := os.Open(file)
+	return f, err == nil
+}
+
+// Downloads the artifact into the cache. Downloads are written next to the artifact and renamed,
+// so requests never see a partial artifact.
+func (c *artifactCache) fetch(upstream string, artifact string, file string, modifiedSince time.Time, now time.Time) (string, int, error) {
+	target := *c.upstreams[upstream]
+	target.Path = strings.TrimSuffix(target.Path, "/") + "/" + artifact
+	req, err := http.NewRequest(http.MethodGet, target.String(), nil)
+	if err != nil {
+		return "", http.StatusBadGateway, err
+	}
+	if !modifiedSince.IsZero() {
+		req.Header.Set("If-Modified-Since", modifiedSince.UTC().Format(http.TimeFormat))
+	}
+
+	upstreamResp, err := c.client.Do(req)
+	if err != nil {
+		return "", http.StatusBadGateway, err
+	}
+	defer upstreamResp.Body.Close()
+
+	switch upstreamResp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotModified:
+		if err := os.Chtimes(file, now, now); err != nil {
+			return "", http.StatusInternalServerError, err
+		}
+		return ArtifactCacheRevalidated, http.StatusOK, nil
+	case http.StatusNotFound:
+		return "", http.StatusNotFound, &artifactUpstreamError{upstream: upstream, status: upstreamResp.StatusCode}
+	default:
+		return "", http.StatusBadGateway, &artifactUpstreamError{upstream: upstream, status: upstreamResp.StatusCode}
+	}
+
+	if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+		return "", http.StatusInternalServerError, err
+	}
+	download, err := ioutil.TempFile(filepath.Dir(file), artifactTemporaryFilePattern)
+	if err != nil {
+		return "", http.StatusInternalServerError, err
+	}
+	_, err = io.Copy(download, upstreamResp.Body)
+	if closeErr := download.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(download.Name(), file)
+	}
+	if err != nil {
+		os.Remove(download.Name())
+		return "", http.StatusBadGateway, err
+	}
+	return ArtifactCacheMiss, http.StatusOK, nil
+}
+
+type artifactUpstreamError struct {
+	upstream string
+	status   int
+}
+
+func (e *artifactUpstreamError) Error() string {
+	return "Artifact upstream " + e.upstream + " responded with status " + strconv.Itoa(e.status)
+}
+
+// Removes the cached artifacts and returns how many were removed.
+func (c *artifactCache) purge(upstream string, artifact string) (int, error) {
+	root := c.dir
+	if upstream != "" {
+		root = filepath.Join(c.dir, upstream)
+		if artifact != "" {
+			root = c.file(upstream, artifact)
+		}
+	}
+
+	purged := 0
+	err := filepath.Walk(root, func(file string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if info.Mode().IsRegular() {
+			if err := os.Remove(file); err != nil {
+				return err
+			}
+			purged++
+		}
+		return nil
+	})
+	return purged, err
+}
+
+// Serves the cached artifacts to the agents.
+func ArtifactCacheHandler(cache *artifactCache) http.HandlerFunc {
+	return func(resp http.ResponseWriter, req *http.Request) {
+		if cache == nil {
+			writeJsonResponse(resp, http.StatusNotFound, GetError(UnknownRouteError))
+			return
+		}
+		upstream, artifact, ok := parseArtifactPath(req.URL.Path)
+		if !ok || cache.upstreams[upstream] == nil {
+			writeJsonResponse(resp, http.StatusNotFound, GetError(UnknownArtifactError))
+			return
+		}
+
+		now := time.Now()
+		f, result, status, err := cache.open(upstream, artifact, now)
+		if err != nil {
+			artifactCacheRequests.WithLabelValues(upstream, "error").Inc()
+			log.Println("Failed to serve artifact "+upstream+"/"+artifact, err)
+			writeJsonResponse(resp, status, GetError(err.Error()))
+			return
+		}
+		defer f.Close()
+		artifactCacheRequests.WithLabelValues(upstream, strings.ToLower(result)).Inc()
+
+		info, err := f.Stat()
+		if err != nil {
+			writeJsonResponse(resp, http.StatusInternalServerError, GetError(err.Error()))
+			return
+		}
+		maxAge := cache.maxAge - now.Sub(info.ModTime())
+		if maxAge < 0 {
+			maxAge = 0
+		}
+		resp.Header().Set(artifactCacheHeader, result)
+		resp.Header().Set("Cache-Control", "public, max-age="+strconv.Itoa(int(maxAge/time.Second)))
+		resp.Header().Set("ETag", "\""+strconv.FormatInt(info.Size(), 16)+"-"+strconv.FormatInt(info.ModTime().UnixNano(), 16)+"\"")
+		http.ServeContent(resp, req, path.Base(artifact), info.ModTime(), f)
+	}
+}
+
+// Purges cached artifacts, see artifactCache.purge.
+func ArtifactPurgeHandler(cache *artifactCache) http.HandlerFunc {
+	return func(resp http.ResponseWriter, req *http.Request) {
+		if cache == nil {
+			writeJsonResponse(resp, http.StatusNotFound, GetError(UnknownRouteError))
+			return
+		}
+		if req.Method != http.MethodPost {
+			writeJsonResponse(resp, http.StatusMethodNotAllowed, GetError(InvalidRequestError))
+			return
+		}
+		if !isRequestHmacValid(req) {
+			writeJsonResponse(resp, http.StatusForbidden, GetError(NoValidSignatureError))
+			return
+		}
+
+		upstream, artifact := req.URL.Query().Get("upstream"), req.URL.Query().Get("path")
+		if upstream != "" && cache.upstreams[upstream] == nil {
+			writeJsonResponse(resp, http.StatusNotFound, GetError(UnknownArtifactError))
+			return
+		}
+		if artifact != "" {
+			var ok bool
+			if _, artifact, ok = parseArtifactPath(artifactRoute + upstream + "/" + artifact); !ok || upstream == "" {
+				writeJsonResponse(resp, http.StatusNotFound, GetError(UnknownArtifactError))
+				return
+			}
+		}
+
+		purged, err := cache.purge(upstream, artifact)
+		if err != nil {
+			writeJsonResponse(resp, http.StatusInternalServerError, GetError(err.Error()))
+			return
+		}
+		RecordAuditEntry(AuditEntry{
+			Category:  AuditCategoryConfig,
+			Principal: adminPrincipal(req),
+			Action:    "purge-artifacts",
+			Target:    "artifacts/" + strings.TrimSuffix(upstream+"/"+artifact, "/"),
+		})
+		writeJsonResponse(resp, http.StatusOK, ArtifactPurgeResponse{Purged: purged})
+	}
+}
+
+// The agent reaches the cache through the service the operator creates for the webserver.
+func artifactCacheUrl(namespace string) string {
+	if url := os.Getenv("ARTIFACT_CACHE_URL"); url != "" {
+		return url
+	}
+	return "http://azure-pipelines-pool." + namespace + ".svc.cluster.local" + artifactRoute
+}
+
+// Tells the agent where the artifact cache is, when it is enabled.
+func addArtifactCacheEnvironmentVariable(pod *v1.Pod, namespace string) {
+	if pod == nil || len(pod.Spec.Containers) == 0 || newArtifactCacheFromEnvironment() == nil {
+		return
+	}
+	container := &pod.Spec.Containers[0]
+	container.Env = append(container.Env, v1.EnvVar{Name: artifactCacheUrlEnvVariable, Value: artifactCacheUrl(namespace)})
+}
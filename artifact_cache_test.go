@@ -0,0 +1,129 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+)
+
+func newTestArtifactCache(t *testing.T, upstream *httptest.Server) (*artifactCache, string) {
+	dir, err := ioutil.TempDir("", "artifacts")
+	if err != nil {
+		t.Fatalf("Failed to create the cache directory: %v", err)
+	}
+	return newArtifactCache(dir, "node="+upstream.URL+"/dist", time.Hour), dir
+}
+
+func TestParseArtifactPathShouldRejectTraversal(t *testing.T) {
+	if upstream, artifact, ok := parseArtifactPath("/artifacts/node/v18/../../../etc/passwd"); !ok || upstream != "node" || artifact != "etc/passwd" {
+		t.Errorf("Expected the path to be cleaned below the upstream. Got %s %s %v", upstream, artifact, ok)
+	}
+	for _, path := range []string{"/artifacts/node", "/artifacts/node/", "/artifacts//v18/node.tar.gz", "/artifacts/node/v18/.download-1"} {
+		if _, _, ok := parseArtifactPath(path); ok {
+			t.Errorf("Expected %s to name no artifact", path)
+		}
+	}
+}
+
+func TestArtifactCacheShouldFetchMissesOnce(t *testing.T) {
+	fetches := 0
+	upstream := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		fetches++
+		if req.URL.Path != "/dist/v18/node.tar.gz" {
+			resp.WriteHeader(http.StatusNotFound)
+			return
+		}
+		resp.Write([]byte("toolchain"))
+	}))
+	defer upstream.Close()
+	cache, dir := newTestArtifactCache(t, upstream)
+	defer os.RemoveAll(dir)
+
+	results := []string{}
+	for i := 0; i < 2; i++ {
+		resp := httptest.NewRecorder()
+		ArtifactCacheHandler(cache)(resp, httptest.NewRequest("GET", "/artifacts/node/v18/node.tar.gz", nil))
+		if resp.Code != http.StatusOK || resp.Body.String() != "toolchain" || resp.Header().Get("Cache-Control") == "" {
+			t.Fatalf("Expected the artifact with cache headers. Got %d %s %v", resp.Code, resp.Body.String(), resp.Header())
+		}
+		results = append(results, resp.Header().Get(artifactCacheHeader))
+	}
+	if fetches != 1 || results[0] != ArtifactCacheMiss || results[1] != ArtifactCacheHit {
+		t.Errorf("Expected one fetch and a hit. Got %d fetches, %v", fetches, results)
+	}
+
+	resp := httptest.NewRecorder()
+	ArtifactCacheHandler(cache)(resp, httptest.NewRequest("GET", "/artifacts/node/v19/node.tar.gz", nil))
+	if resp.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 for an artifact missing upstream. Got %d", resp.Code)
+	}
+	resp = httptest.NewRecorder()
+	ArtifactCacheHandler(cache)(resp, httptest.NewRequest("GET", "/artifacts/go/go1.21.tar.gz", nil))
+	if resp.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 for an unknown upstream. Got %d", resp.Code)
+	}
+}
+
+func TestArtifactCacheShouldServeStaleArtifactsWhenUpstreamFails(t *testing.T) {
+	status := http.StatusOK
+	upstream := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		resp.WriteHeader(status)
+		resp.Write([]byte("toolchain"))
+	}))
+	defer upstream.Close()
+	cache, dir := newTestArtifactCache(t, upstream)
+	defer os.RemoveAll(dir)
+
+	now := time.Now()
+	f, _, _, err := cache.open("node", "node.tar.gz", now)
+	if err != nil {
+		t.Fatalf("Expected the artifact to be fetched: %v", err)
+	}
+	f.Close()
+
+	status = http.StatusNotModified
+	f, result, _, err := cache.open("node", "node.tar.gz", now.Add(2*time.Hour))
+	if err != nil || result != ArtifactCacheRevalidated {
+		t.Errorf("Expected the stale artifact to be revalidated. Got %s (%v)", result, err)
+	} else {
+		f.Close()
+	}
+
+	status = http.StatusServiceUnavailable
+	f, result, _, err = cache.open("node", "node.tar.gz", now.Add(4*time.Hour))
+	if err != nil || result != ArtifactCacheStale {
+		t.Errorf("Expected the stale artifact while the upstream fails. Got %s (%v)", result, err)
+	} else {
+		f.Close()
+	}
+}
+
+func TestArtifactCachePurgeShouldRemoveArtifactsOfUpstream(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		resp.Write([]byte("toolchain"))
+	}))
+	defer upstream.Close()
+	cache, dir := newTestArtifactCache(t, upstream)
+	defer os.RemoveAll(dir)
+
+	for _, artifact := range []string{"v18/node.tar.gz", "v18/node.zip", "v20/node.tar.gz"} {
+		f, _, _, err := cache.open("node", artifact, time.Now())
+		if err != nil {
+			t.Fatalf("Expected %s to be fetched: %v", artifact, err)
+		}
+		f.Close()
+	}
+
+	if purged, err := cache.purge("node", "v18/node.zip"); purged != 1 || err != nil {
+		t.Errorf("Expected one artifact to be purged. Got %d (%v)", purged, err)
+	}
+	if purged, err := cache.purge("node", ""); purged != 2 || err != nil {
+		t.Errorf("Expected the remaining artifacts of the upstream to be purged. Got %d (%v)", purged, err)
+	}
+	if purged, err := cache.purge("node", "v18/node.zip"); purged != 0 || err != nil {
+		t.Errorf("Expected nothing to purge. Got %d (%v)", purged, err)
+	}
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+
+	authenticationv1 "k8s.io/api/authentication/v1"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// Every agent pod gets a service account token bound to the pool provider audience and to the pod
+// itself. The agent presents it to /attest on startup; the token review tells which pod sent it.
+const (
+	identityTokenVolume          = "agent-identity"
+	identityTokenMountPath       = "/var/run/secrets/poolprovider"
+	identityTokenFile            = "token"
+	identityTokenEnvVariable     = "AZP_IDENTITY_TOKEN"
+	attestUrlEnvVariable         = "AZP_ATTEST_URL"
+	defaultAttestationAudience   = "poolprovider"
+	identityTokenLifetimeSeconds = int64(3600)
+
+	podNameExtra = "authentication.kubernetes.io/pod-name"
+	podUidExtra  = "authentication.kubernetes.io/pod-uid"
+)
+
+// Work routing metadata only handed out to attested agents
+type AttestationResponse struct {
+	AgentId    string
+	AgentPool  string
+	Namespace  string
+	JobContext *JobContext `json:",omitempty"`
+}
+
+type podIdentity struct {
+	Namespace string
+	Name      string
+	UID       string
+}
+
+func attestationAudience() string {
+	if audience := os.Getenv("ATTESTATION_AUDIENCE"); audience != "" {
+		return audience
+	}
+	return defaultAttestationAudience
+}
+
+// The agent reaches the webserver through the service the operator creates for it.
+func attestUrl(namespace string) string {
+	if url := os.Getenv("ATTEST_URL"); url != "" {
+		return url
+	}
+	return "http://azure-pipelines-pool." + namespace + ".svc.cluster.local/attest"
+}
+
+// Mounts the projected identity token into the agent container and tells the agent where to
+// send it.
+func addIdentityToken(pod *v1.Pod, namespace string) {
+	if pod == nil || len(pod.Spec.Containers) == 0 {
+		return
+	}
+
+	expiration := identityTokenLifetimeSeconds
+	pod.Spec.Volumes = append(pod.Spec.Volumes, v1.Volume{
+		Name: identityTokenVolume,
+		VolumeSource: v1.VolumeSource{Projected: &v1.ProjectedVolumeSource{
+			Sources: []v1.VolumeProjection{{ServiceAccountToken: &v1.ServiceAccountTokenProjection{
+				Audience:          attestationAudience(),
+				ExpirationSeconds: &expiration,
+				Path:              identityTokenFile,
+			}}},
+		}},
+	})
+
+	container := &pod.Spec.Containers[0]
+	container.VolumeMounts = append(container.VolumeMounts, v1.VolumeMount{
+		Name:      identityTokenVolume,
+		MountPath: identityTokenMountPath,
+		ReadOnly:  true,
+	})
+	container.Env = append(container.Env,
+		v1.EnvVar{Name: identityTokenEnvVariable, Value: identityTokenMountPath + "/" + identityTokenFile},
+		v1.EnvVar{Name: attestUrlEnvVariable, Value: attestUrl(namespace)})
+}
+
+// Verifies the identity token of the calling agent pod and returns its work routing metadata.
+func AttestAgentHandler(resp http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		writeJsonResponse(resp, http.StatusMethodNotAllowed, GetError(InvalidRequestError))
+		return
+	}
+
+	token := bearerToken(req)
+	if token == "" {
+		attestations.WithLabelValues("missing_token").Inc()
+		writeJsonResponse(resp, http.StatusUnauthorized, GetError(AttestationFailedError))
+		return
+	}
+
+	cs := CreateClientSet()
+	response, err := attestAgent(cs, token)
+	if err != nil {
+		log.Println("Agent attestation failed", err)
+		attestations.WithLabelValues("rejected").Inc()
+		writeJsonResponse(resp, http.StatusForbidden, GetError(AttestationFailedError))
+		return
+	}
+
+	log.Println("Agent " + response.AgentId + " attested")
+	attestations.WithLabelValues("attested").Inc()
+	writeJsonResponse(resp, http.StatusOK, response)
+}
+
+func bearerToken(req *http.Request) string {
+	header := req.Header.Get("Authorization")
+	if !strings.HasPrefix(header, "Bearer ") {
+		return ""
+	}
+	return strings.TrimSpace(strings.TrimPrefix(header, "Bearer "))
+}
+
+func attestAgent(cs *k8s, token string) (AttestationResponse, error) {
+	var response AttestationResponse
+
+	review, err := cs.clientset.AuthenticationV1().TokenReviews().Create(&authenticationv1.TokenReview{
+		Spec: authenticationv1.TokenReviewSpec{Token: token, Audiences: []string{attestationAudience()}},
+	})
+	if err != nil {
+		return response, err
+	}
+
+	identity, err := podIdentityFromReview(review.Status)
+	if err != nil {
+		return response, err
+	}
+
+	// The pod name in the token could belong to a deleted pod, only the UID ties it to this one
+	pod, err := cs.clientset.CoreV1().Pods(identity.Namespace).Get(identity.Name, metav1.GetOptions{})
+	if err != nil {
+		return response, err
+	}
+	if string(pod.GetUID()) != identity.UID {
+		return response, errors.New("Token was issued to another pod named " + identity.Name)
+	}
+
+	agentId := pod.GetLabels()[agentIdLabel]
+	if agentId == "" {
+		return response, errors.New("Pod " + identity.Name + " is not an agent pod")
+	}
+
+	response.AgentId = agentId
+	response.AgentPool = pod.GetLabels()[agentPoolLabel]
+	response.Namespace = identity.Namespace
+	response.JobContext = readJobContext(cs, pod)
+	return response, nil
+}
+
+// Reads the pod the token was issued to from the review. Only tokens bound to a pod are accepted,
+// a plain service account token could be replayed by any pod using the service account.
+func podIdentityFromReview(status authenticationv1.TokenReviewStatus) (podIdentity, error) {
+	var identity podIdentity
+
+	if !status.Authenticated {
+		if status.Error != "" {
+			return identity, errors.New(status.Error)
+		}
+		return identity, errors.New("Token not authenticated")
+	}
+
+	audienceFound := false
+	for _, audience := range status.Audiences {
+		if audience == attestationAudience() {
+			audienceFound = true
+		}
+	}
+	if !audienceFound {
+		return identity, errors.New("Token not issued for audience " + attestationAudience())
+	}
+
+	// Service account user names look like system:serviceaccount:<namespace>:<name>
+	parts := strings.Split(status.User.Username, ":")
+	if len(parts) != 4 || parts[0] != "system" || parts[1] != "serviceaccount" {
+		return identity, errors.New("Token does not belong to a service account")
+	}
+
+	identity.Namespace = parts[2]
+	if names := status.User.Extra[podNameExtra]; len(names) == 1 {
+		identity.Name = names[0]
+	}
+	if uids := status.User.Extra[podUidExtra]; len(uids) == 1 {
+		identity.UID = uids[0]
+	}
+	if identity.Name == "" || identity.UID == "" {
+		return identity, errors.New("Token is not bound to a pod")
+	}
+	return identity, nil
+}
+
+func readJobContext(cs *k8s, pod *v1.Pod) *JobContext {
+	for _, volume := range pod.Spec.Volumes {
+		if volume.Name != agentCredsVolume || volume.Secret == nil {
+			continue
+		}
+
+		secret, err := cs.clientset.CoreV1().Secrets(pod.GetNamespace()).Get(volume.Secret.SecretName, metav1.GetOptions{})
+		if err != nil {
+			log.Println("Failed to read the agent secret of pod "+pod.GetName(), err)
+			return nil
+		}
+
+		var context JobContext
+		if err := json.Unmarshal(secret.Data[jobContextFile], &context); err != nil {
+			return nil
+		}
+		return &context
+	}
+	return nil
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	authenticationv1 "k8s.io/api/authentication/v1"
+	v1 "k8s.io/api/core/v1"
+)
+
+func boundTokenReview() authenticationv1.TokenReviewStatus {
+	return authenticationv1.TokenReviewStatus{
+		Authenticated: true,
+		Audiences:     []string{defaultAttestationAudience},
+		User: authenticationv1.UserInfo{
+			Username: "system:serviceaccount:azuredevops:default",
+			Extra: map[string]authenticationv1.ExtraValue{
+				podNameExtra: {"agent-pod"},
+				podUidExtra:  {"uid-1"},
+			},
+		},
+	}
+}
+
+func TestPodIdentityFromReviewShouldReadBoundPod(t *testing.T) {
+	identity, err := podIdentityFromReview(boundTokenReview())
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if identity.Namespace != "azuredevops" || identity.Name != "agent-pod" || identity.UID != "uid-1" {
+		t.Errorf("Unexpected identity %v", identity)
+	}
+}
+
+func TestPodIdentityFromReviewShouldRejectUnboundTokens(t *testing.T) {
+	unbound := boundTokenReview()
+	unbound.User.Extra = nil
+	if _, err := podIdentityFromReview(unbound); err == nil {
+		t.Errorf("Expected tokens not bound to a pod to be rejected")
+	}
+
+	otherAudience := boundTokenReview()
+	otherAudience.Audiences = []string{"https://kubernetes.default.svc"}
+	if _, err := podIdentityFromReview(otherAudience); err == nil {
+		t.Errorf("Expected tokens of another audience to be rejected")
+	}
+
+	unauthenticated := boundTokenReview()
+	unauthenticated.Authenticated = false
+	if _, err := podIdentityFromReview(unauthenticated); err == nil {
+		t.Errorf("Expected unauthenticated tokens to be rejected")
+	}
+}
+
+func TestAddIdentityTokenShouldMountProjectedToken(t *testing.T) {
+	pod := &v1.Pod{Spec: v1.PodSpec{Containers: []v1.Container{{Name: "agent"}}}}
+	addIdentityToken(pod, "azuredevops")
+
+	if len(pod.Spec.Volumes) != 1 || pod.Spec.Volumes[0].Projected == nil {
+		t.Fatalf("Expected a projected volume. Got %v", pod.Spec.Volumes)
+	}
+	projection := pod.Spec.Volumes[0].Projected.Sources[0].ServiceAccountToken
+	if projection == nil || projection.Audience != defaultAttestationAudience {
+		t.Errorf("Expected a token for the pool provider audience. Got %v", projection)
+	}
+
+	env := pod.Spec.Containers[0].Env
+	if len(env) != 2 || env[1].Value != "http://azure-pipelines-pool.azuredevops.svc.cluster.local/attest" {
+		t.Errorf("Unexpected environment %v", env)
+	}
+}
+
+func TestAttestWithoutTokenShouldBeUnauthorized(t *testing.T) {
+	req := httptest.NewRequest("POST", "/attest", nil)
+	rr := httptest.NewRecorder()
+	AttestAgentHandler(rr, req)
+
+	if rr.Code != http.StatusUnauthorized {
+		t.Errorf("Expected 401. Got %v", rr.Code)
+	}
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+	"time"
+
+	v1alpha1 "github.com/microsoft/poolprovider-for-k8s/pkg/apis/dev/v1alpha1"
+)
+
+// Audit entries are kept in the storage under "audit:<category>:<id>". Configuration changes made
+// through the admin endpoints and through the custom resource are recorded in the config category.
+const (
+	auditKeyPrefix        = "audit:"
+	AuditCategoryConfig   = "config"
+	configAuditStateKey   = "auditstate:config"
+	unknownAuditPrincipal = "unknown"
+	adminPrincipalHeader  = "X-Admin-Principal"
+)
+
+var configAuditInterval = 30 * time.Second
+
+type FieldChange struct {
+	Field string
+	Old   string `json:",omitempty"`
+	New   string `json:",omitempty"`
+}
+
+type AuditEntry struct {
+	Id        string
+	Timestamp time.Time
+	Category  string
+	Principal string
+	Action    string
+	Target    string
+	Reason    string        `json:",omitempty"`
+	Changes   []FieldChange `json:",omitempty"`
+}
+
+type configAuditState struct {
+	Generation int64
+	Spec       v1alpha1.AzurePipelinesPoolSpec
+}
+
+// Stores the entry. Entries with the same id are only stored once, so replicas recording the same
+// change do not duplicate it.
+func RecordAuditEntry(entry AuditEntry) error {
+	if entry.Timestamp.IsZero() {
+		entry.Timestamp = time.Now().UTC()
+	}
+	if entry.Id == "" {
+		entry.Id = strconv.FormatInt(entry.Timestamp.UnixNano(), 10)
+	}
+	if entry.Principal == "" {
+		entry.Principal = unknownAuditPrincipal
+	}
+
+	data, _ := json.Marshal(entry)
+	_, err := GetStorage().SetIfAbsent(auditKeyPrefix+entry.Category+":"+entry.Id, string(data))
+	return err
+}
+
+// Records the difference between the old and new value of a configuration object. Nothing is
+// recorded when they are equal.
+func RecordConfigChange(principal string, action string, target string, old interface{}, new interface{}) error {
+	changes := diffValues(old, new)
+	if len(changes) == 0 {
+		return nil
+	}
+	return RecordAuditEntry(AuditEntry{Category: AuditCategoryConfig, Principal: principal, Action: action, Target: target, Changes: changes})
+}
+
+// Returns the entries of the category, oldest first.
+func ListAuditEntries(category string) ([]AuditEntry, error) {
+	values, err := GetStorage().List(auditKeyPrefix + category + ":")
+	if err != nil {
+		return nil, err
+	}
+
+	entries := []AuditEntry{}
+	for _, value := range values {
+		var entry AuditEntry
+		if json.Unmarshal([]byte(value), &entry) == nil {
+			entries = append(entries, entry)
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Timestamp.Before(entries[j].Timestamp) })
+	return entries, nil
+}
+
+// Compares the JSON form of both values field by field. Nested fields are named by their path,
+// e.g. "agentPools[0].warmPoolSize".
+func diffValues(old interface{}, new interface{}) []FieldChange {
+	oldFields := map[string]string{}
+	newFields := map[string]string{}
+	flattenJson("", toJsonValue(old), oldFields)
+	flattenJson("", toJsonValue(new), newFields)
+
+	var changes []FieldChange
+	for field, value := range oldFields {
+		if newValue, ok := newFields[field]; !ok || newValue != value {
+			changes = append(changes, FieldChange{Field: field, Old: value, New: newFields[field]})
+		}
+	}
+	for field, value := range newFields {
+		if _, ok := oldFields[field]; !ok {
+			changes = append(changes, FieldChange{Field: field, New: value})
+		}
+	}
+	sort.Slice(changes, func(i, j int) bool { return changes[i].Field < changes[j].Field })
+	return changes
+}
+
+func toJsonValue(value interface{}) interface{} {
+	if value == nil || (reflect.ValueOf(value).Kind() == reflect.Ptr && reflect.ValueOf(value).IsNil()) {
+		return nil
+	}
+	data, _ := json.Marshal(value)
+	var result interface{}
+	json.Unmarshal(data, &result)
+	return result
+}
+
+func flattenJson(path string, value interface{}, fields map[string]string) {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for key, child := range v {
+			if path == "" {
+				flattenJson(key, child, fields)
+			} else {
+				flattenJson(path+"."+key, child, fields)
+			}
+		}
+	case []interface{}:
+		for i, child := range v {
+			flattenJson(fmt.Sprintf("%s[%d]", path, i), child, fields)
+		}
+	case nil:
+	default:
+		data, _ := json.Marshal(v)
+		fields[path] = string(data)
+	}
+}
+
+// Records changes of the pool settings made to the custom resource. The generation of the resource
+// identifies the change and its last field manager, e.g. kubectl, is recorded as the principal. Only
+// the leader records them, so a change is recorded once.
+func RunConfigAuditor(namespace string) {
+	for {
+		if IsLeader() {
+			if err := auditCustomResource(namespace); err != nil {
+				log.Println("Failed to audit the pool configuration", err)
+			}
+		}
+		time.Sleep(configAuditInterval)
+	}
+}
+
+func auditCustomResource(namespace string) error {
+	crdobject, _, err := fetchAzurePipelinesPool(namespace)
+	if err != nil {
+		return err
+	}
+
+	var last configAuditState
+	value, err := GetStorage().Get(configAuditStateKey)
+	if err == nil {
+		json.Unmarshal([]byte(value), &last)
+	}
+	if last.Generation == crdobject.Generation && err == nil {
+		return nil
+	}
+
+	// The first time the resource is seen, there is no previous state to compare against
+	if err == nil {
+		entry := AuditEntry{
+			Id:        strconv.FormatInt(crdobject.Generation, 10),
+			Category:  AuditCategoryConfig,
+			Principal: lastFieldManager(crdobject),
+			Action:    "update",
+			Target:    "azurepipelinespool/" + crdobject.GetName(),
+			Changes:   diffValues(last.Spec, crdobject.Spec),
+		}
+		if len(entry.Changes) > 0 {
+			if err := RecordAuditEntry(entry); err != nil {
+				return err
+			}
+		}
+	}
+
+	data, _ := json.Marshal(configAuditState{Generation: crdobject.Generation, Spec: crdobject.Spec})
+	return GetStorage().Set(configAuditStateKey, string(data))
+}
+
+func lastFieldManager(crdobject *v1alpha1.AzurePipelinesPool) string {
+	principal := unknownAuditPrincipal
+	var latest time.Time
+	for _, field := range crdobject.ManagedFields {
+		if field.Time != nil && !field.Time.Time.Before(latest) {
+			latest = field.Time.Time
+			principal = field.Manager
+		}
+	}
+	return principal
+}
+
+// Admin requests are signed with the shared secret, which does not identify the caller, so the
+// caller names itself in the X-Admin-Principal header.
+func adminPrincipal(req *http.Request) string {
+	if principal := req.Header.Get(adminPrincipalHeader); principal != "" {
+		return principal
+	}
+	return unknownAuditPrincipal
+}
+
+// Returns the recorded configuration changes, oldest first.
+func AuditConfigHandler(resp http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		writeJsonResponse(resp, http.StatusMethodNotAllowed, GetError(InvalidRequestError))
+		return
+	}
+	if !isRequestHmacValid(req) {
+		writeJsonResponse(resp, http.StatusForbidden, GetError(NoValidSignatureError))
+		return
+	}
+
+	entries, err := ListAuditEntries(AuditCategoryConfig)
+	if err != nil {
+		writeJsonResponse(resp, http.StatusInternalServerError, GetError(err.Error()))
+		return
+	}
+	writeJsonResponse(resp, http.StatusOK, entries)
+}
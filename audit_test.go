@@ -0,0 +1,39 @@
+package main
+
+import (
+	"testing"
+
+	v1alpha1 "github.com/microsoft/poolprovider-for-k8s/pkg/apis/dev/v1alpha1"
+)
+
+func TestDiffValuesShouldReportChangedFields(t *testing.T) {
+	old := v1alpha1.AzurePipelinesPoolSpec{AgentPools: []v1alpha1.AgentPoolSpec{{PoolName: "linux", WarmPoolSize: 1}}}
+	new := v1alpha1.AzurePipelinesPoolSpec{AgentPools: []v1alpha1.AgentPoolSpec{{PoolName: "linux", WarmPoolSize: 3}}}
+
+	changes := diffValues(old, new)
+	if len(changes) != 1 {
+		t.Fatalf("Expected one change. Got %v", changes)
+	}
+	if changes[0].Field != "agentPools[0].warmPoolSize" || changes[0].Old != "1" || changes[0].New != "3" {
+		t.Errorf("Unexpected change %v", changes[0])
+	}
+
+	if changes := diffValues(old, old); len(changes) != 0 {
+		t.Errorf("Expected no changes. Got %v", changes)
+	}
+}
+
+func TestRecordConfigChangeShouldBeListed(t *testing.T) {
+	SetupCustomResource()
+
+	RecordConfigChange("alice", "update", "pool/linux", map[string]int{"size": 1}, map[string]int{"size": 2})
+	RecordConfigChange("alice", "update", "pool/linux", map[string]int{"size": 2}, map[string]int{"size": 2})
+
+	entries, err := ListAuditEntries(AuditCategoryConfig)
+	if err != nil || len(entries) != 1 {
+		t.Fatalf("Expected one audit entry. Got %d (%v)", len(entries), err)
+	}
+	if entries[0].Principal != "alice" || entries[0].Changes[0].Field != "size" {
+		t.Errorf("Unexpected audit entry %v", entries[0])
+	}
+}
@@ -0,0 +1,287 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+
+	"github.com/ghodss/yaml"
+	v1alpha1 "github.com/microsoft/poolprovider-for-k8s/pkg/apis/dev/v1alpha1"
+	v1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	rbacv1 "k8s.io/api/rbac/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// The bootstrap subcommand, "main bootstrap" in the webserver image, creates the objects the
+// provider needs before it is installed, rendered from the configuration the webserver runs with
+// instead of hand-written YAML: the namespace of the webserver (POD_NAMESPACE), FALLBACK_NAMESPACE
+// and the namespaces of the isolated agent pools, the service account of the webserver
+// (SERVICE_ACCOUNT, "default" by default), a Role in each of the namespaces and a ClusterRole with
+// exactly the permissions the permissions check expects, bound to the service account, and the
+// network policies of the NamespaceTemplate. The pool namespaces are only known when the pool
+// configuration can be read. Existing objects are updated. With --dry-run the manifests are
+// printed instead.
+const bootstrapObjectName = "azure-pipelines-pool"
+
+type bootstrapManifests struct {
+	Namespaces         []v1.Namespace
+	ServiceAccount     v1.ServiceAccount
+	Roles              []rbacv1.Role
+	RoleBindings       []rbacv1.RoleBinding
+	ClusterRole        rbacv1.ClusterRole
+	ClusterRoleBinding rbacv1.ClusterRoleBinding
+	NetworkPolicies    []networkingv1.NetworkPolicy
+}
+
+// Runs the bootstrap subcommand and returns the exit code.
+func RunBootstrap(args []string, out io.Writer) int {
+	flags := flag.NewFlagSet("bootstrap", flag.ContinueOnError)
+	dryRun := flags.Bool("dry-run", false, "print the manifests instead of applying them")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+
+	namespace := os.Getenv("POD_NAMESPACE")
+	if namespace == "" {
+		log.Println("Bootstrap needs POD_NAMESPACE, the namespace the webserver runs in")
+		return 2
+	}
+	crdobject, _, err := fetchAzurePipelinesPool(namespace)
+	if err != nil {
+		log.Println("Could not read the pool configuration, the namespaces of isolated agent pools are left out", err)
+		crdobject = nil
+	}
+	manifests := renderBootstrapManifests(namespace, serviceAccountName(), crdobject)
+
+	if *dryRun {
+		err = writeBootstrapManifests(out, manifests)
+	} else {
+		err = applyBootstrapManifests(CreateClientSet(), manifests)
+	}
+	if err != nil {
+		log.Println("Bootstrap failed", err)
+		return 1
+	}
+	return 0
+}
+
+func serviceAccountName() string {
+	if name := os.Getenv("SERVICE_ACCOUNT"); name != "" {
+		return name
+	}
+	return "default"
+}
+
+func renderBootstrapManifests(namespace string, serviceAccount string, crdobject *v1alpha1.AzurePipelinesPool) bootstrapManifests {
+	labels := map[string]string{"app": bootstrapObjectName}
+	manifests := bootstrapManifests{
+		ServiceAccount: v1.ServiceAccount{
+			TypeMeta:   metav1.TypeMeta{APIVersion: "v1", Kind: "ServiceAccount"},
+			ObjectMeta: metav1.ObjectMeta{Name: serviceAccount, Namespace: namespace},
+		},
+		ClusterRole: rbacv1.ClusterRole{
+			TypeMeta:   metav1.TypeMeta{APIVersion: rbacv1.SchemeGroupVersion.String(), Kind: "ClusterRole"},
+			ObjectMeta: metav1.ObjectMeta{Name: bootstrapObjectName, Labels: labels},
+		},
+		ClusterRoleBinding: rbacv1.ClusterRoleBinding{
+			TypeMeta:   metav1.TypeMeta{APIVersion: rbacv1.SchemeGroupVersion.String(), Kind: "ClusterRoleBinding"},
+			ObjectMeta: metav1.ObjectMeta{Name: bootstrapObjectName + "-" + namespace, Labels: labels},
+			Subjects:   []rbacv1.Subject{{Kind: rbacv1.ServiceAccountKind, Name: serviceAccount, Namespace: namespace}},
+			RoleRef:    rbacv1.RoleRef{APIGroup: rbacv1.GroupName, Kind: "ClusterRole", Name: bootstrapObjectName},
+		},
+	}
+
+	// The namespaces the agent pods run in, with the labels and network policy of the isolated pools
+	namespaceLabels := map[string]map[string]string{}
+	namespaces := agentNamespaces(namespace)
+	if crdobject != nil {
+		for i := range crdobject.Spec.AgentPools {
+			pool := &crdobject.Spec.AgentPools[i]
+			ns := poolNamespace(crdobject, pool, namespace)
+			if ns == namespace {
+				continue
+			}
+			template := crdobject.Spec.NamespaceTemplate
+			if template == nil {
+				template = &v1alpha1.NamespaceTemplate{}
+			}
+			if _, ok := namespaceLabels[ns]; !ok {
+				namespaces = appendUnique(namespaces, ns)
+				if template.NetworkPolicy != nil {
+					manifests.NetworkPolicies = append(manifests.NetworkPolicies, networkingv1.NetworkPolicy{
+						TypeMeta:   metav1.TypeMeta{APIVersion: networkingv1.SchemeGroupVersion.String(), Kind: "NetworkPolicy"},
+						ObjectMeta: metav1.ObjectMeta{Name: poolNamespaceObjectName, Namespace: ns},
+						Spec:       *template.NetworkPolicy,
+					})
+				}
+			}
+			namespaceLabels[ns] = poolNamespaceLabels(template, pool)
+		}
+	}
+
+	checks := permissionChecks(namespaces)
+	for _, rule := range missingRules(checks) {
+		policy := rbacv1.PolicyRule{APIGroups: rule.ApiGroups, Resources: rule.Resources, Verbs: rule.Verbs}
+		if rule.Scope == clusterScope {
+			manifests.ClusterRole.Rules = append(manifests.ClusterRole.Rules, policy)
+			continue
+		}
+		i := len(manifests.Roles) - 1
+		if i < 0 || manifests.Roles[i].Namespace != rule.Scope {
+			manifests.Roles = append(manifests.Roles, rbacv1.Role{
+				TypeMeta:   metav1.TypeMeta{APIVersion: rbacv1.SchemeGroupVersion.String(), Kind: "Role"},
+				ObjectMeta: metav1.ObjectMeta{Name: bootstrapObjectName, Namespace: rule.Scope, Labels: labels},
+			})
+			manifests.RoleBindings = append(manifests.RoleBindings, rbacv1.RoleBinding{
+				TypeMeta:   metav1.TypeMeta{APIVersion: rbacv1.SchemeGroupVersion.String(), Kind: "RoleBinding"},
+				ObjectMeta: metav1.ObjectMeta{Name: bootstrapObjectName, Namespace: rule.Scope, Labels: labels},
+				Subjects:   []rbacv1.Subject{{Kind: rbacv1.ServiceAccountKind, Name: serviceAccount, Namespace: namespace}},
+				RoleRef:    rbacv1.RoleRef{APIGroup: rbacv1.GroupName, Kind: "Role", Name: bootstrapObjectName},
+			})
+			i++
+		}
+		manifests.Roles[i].Rules = append(manifests.Roles[i].Rules, policy)
+	}
+
+	for _, ns := range namespaces {
+		manifests.Namespaces = append(manifests.Namespaces, v1.Namespace{
+			TypeMeta:   metav1.TypeMeta{APIVersion: "v1", Kind: "Namespace"},
+			ObjectMeta: metav1.ObjectMeta{Name: ns, Labels: namespaceLabels[ns]},
+		})
+	}
+	return manifests
+}
+
+// Returns the objects in the order they are applied in.
+func (m bootstrapManifests) objects() []interface{} {
+	objects := []interface{}{}
+	for i := range m.Namespaces {
+		objects = append(objects, &m.Namespaces[i])
+	}
+	objects = append(objects, &m.ServiceAccount)
+	for i := range m.Roles {
+		objects = append(objects, &m.Roles[i], &m.RoleBindings[i])
+	}
+	objects = append(objects, &m.ClusterRole, &m.ClusterRoleBinding)
+	for i := range m.NetworkPolicies {
+		objects = append(objects, &m.NetworkPolicies[i])
+	}
+	return objects
+}
+
+// Prints the manifests as one YAML stream, which kubectl apply -f takes as is.
+func writeBootstrapManifests(out io.Writer, manifests bootstrapManifests) error {
+	for i, object := range manifests.objects() {
+		data, err := yaml.Marshal(object)
+		if err != nil {
+			return err
+		}
+		if i > 0 {
+			fmt.Fprintln(out, "---")
+		}
+		if _, err := out.Write(data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func applyBootstrapManifests(cs *k8s, manifests bootstrapManifests) error {
+	if cs.clientset == nil {
+		return errors.New("No Kubernetes client, the webserver needs to run in the cluster or with DEBUG_LOCAL")
+	}
+	for _, object := range manifests.objects() {
+		var err error
+		var kind, name string
+		switch o := object.(type) {
+		case *v1.Namespace:
+			kind, name, err = "namespace", o.Name, applyNamespaceLabels(cs, o.Name, o.Labels)
+		case *v1.ServiceAccount:
+			kind, name = "service account", o.Namespace+"/"+o.Name
+			_, err = cs.clientset.CoreV1().ServiceAccounts(o.Namespace).Create(o)
+			if k8serrors.IsAlreadyExists(err) {
+				err = nil
+			}
+		case *rbacv1.Role:
+			kind, name, err = "role", o.Namespace+"/"+o.Name, applyRole(cs, o)
+		case *rbacv1.RoleBinding:
+			kind, name, err = "role binding", o.Namespace+"/"+o.Name, applyRoleBinding(cs, o)
+		case *rbacv1.ClusterRole:
+			kind, name, err = "cluster role", o.Name, applyClusterRole(cs, o)
+		case *rbacv1.ClusterRoleBinding:
+			kind, name, err = "cluster role binding", o.Name, applyClusterRoleBinding(cs, o)
+		case *networkingv1.NetworkPolicy:
+			kind, name, err = "network policy", o.Namespace+"/"+o.Name, applyNetworkPolicy(cs, o.Namespace, o.Spec)
+		}
+		if err != nil {
+			return fmt.Errorf("%s %s: %v", kind, name, err)
+		}
+		log.Println("Applied " + kind + " " + name)
+	}
+	return nil
+}
+
+func applyRole(cs *k8s, role *rbacv1.Role) error {
+	roles := cs.clientset.RbacV1().Roles(role.Namespace)
+	_, err := roles.Create(role)
+	if !k8serrors.IsAlreadyExists(err) {
+		return err
+	}
+	existing, err := roles.Get(role.Name, metav1.GetOptions{})
+	if err != nil {
+		return err
+	}
+	existing.Rules = role.Rules
+	_, err = roles.Update(existing)
+	return err
+}
+
+func applyRoleBinding(cs *k8s, binding *rbacv1.RoleBinding) error {
+	bindings := cs.clientset.RbacV1().RoleBindings(binding.Namespace)
+	_, err := bindings.Create(binding)
+	if !k8serrors.IsAlreadyExists(err) {
+		return err
+	}
+	existing, err := bindings.Get(binding.Name, metav1.GetOptions{})
+	if err != nil {
+		return err
+	}
+	existing.Subjects = binding.Subjects
+	_, err = bindings.Update(existing)
+	return err
+}
+
+func applyClusterRole(cs *k8s, role *rbacv1.ClusterRole) error {
+	roles := cs.clientset.RbacV1().ClusterRoles()
+	_, err := roles.Create(role)
+	if !k8serrors.IsAlreadyExists(err) {
+		return err
+	}
+	existing, err := roles.Get(role.Name, metav1.GetOptions{})
+	if err != nil {
+		return err
+	}
+	existing.Rules = role.Rules
+	_, err = roles.Update(existing)
+	return err
+}
+
+func applyClusterRoleBinding(cs *k8s, binding *rbacv1.ClusterRoleBinding) error {
+	bindings := cs.clientset.RbacV1().ClusterRoleBindings()
+	_, err := bindings.Create(binding)
+	if !k8serrors.IsAlreadyExists(err) {
+		return err
+	}
+	existing, err := bindings.Get(binding.Name, metav1.GetOptions{})
+	if err != nil {
+		return err
+	}
+	existing.Subjects = binding.Subjects
+	_, err = bindings.Update(existing)
+	return err
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/ghodss/yaml"
+	v1alpha1 "github.com/microsoft/poolprovider-for-k8s/pkg/apis/dev/v1alpha1"
+	networkingv1 "k8s.io/api/networking/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestRenderBootstrapManifestsShouldGrantTheCheckedPermissions(t *testing.T) {
+	os.Setenv("STORAGE_BACKEND", "memory")
+	defer os.Unsetenv("STORAGE_BACKEND")
+	crdobject := &v1alpha1.AzurePipelinesPool{Spec: v1alpha1.AzurePipelinesPoolSpec{
+		NamespaceTemplate: &v1alpha1.NamespaceTemplate{NamePrefix: "ado-pool-", Labels: map[string]string{"team": "build"}, NetworkPolicy: &networkingv1.NetworkPolicySpec{}},
+		AgentPools: []v1alpha1.AgentPoolSpec{
+			{PoolName: "shared"},
+			{PoolName: "isolated", AzureDevOpsPoolId: 12},
+		},
+	}}
+
+	manifests := renderBootstrapManifests("azuredevops", "webserver", crdobject)
+
+	if len(manifests.Namespaces) != 2 || manifests.Namespaces[1].Name != "ado-pool-12" || manifests.Namespaces[1].Labels["team"] != "build" || manifests.Namespaces[1].Labels[agentPoolLabel] != "isolated" {
+		t.Errorf("Expected the webserver and the isolated pool namespace. Got %+v", manifests.Namespaces)
+	}
+	if len(manifests.Roles) != 2 || len(manifests.RoleBindings) != 2 {
+		t.Errorf("Expected a role in both namespaces. Got %+v", manifests.Roles)
+	}
+	for _, binding := range manifests.RoleBindings {
+		if binding.Subjects[0].Name != "webserver" || binding.Subjects[0].Namespace != "azuredevops" {
+			t.Errorf("Expected the role in %s bound to the webserver. Got %+v", binding.Namespace, binding.Subjects)
+		}
+	}
+	if len(manifests.NetworkPolicies) != 1 || manifests.NetworkPolicies[0].Namespace != "ado-pool-12" {
+		t.Errorf("Expected the network policy of the pool namespace. Got %+v", manifests.NetworkPolicies)
+	}
+
+	// Every permission the provider checks for is granted
+	granted := map[string]bool{}
+	for _, role := range manifests.Roles {
+		for _, rule := range role.Rules {
+			for _, verb := range rule.Verbs {
+				granted[role.Namespace+"|"+rule.APIGroups[0]+"|"+rule.Resources[0]+"|"+verb] = true
+			}
+		}
+	}
+	for _, rule := range manifests.ClusterRole.Rules {
+		for _, verb := range rule.Verbs {
+			granted[clusterScope+"|"+rule.APIGroups[0]+"|"+rule.Resources[0]+"|"+verb] = true
+		}
+	}
+	for _, check := range permissionChecks([]string{"azuredevops", "ado-pool-12"}) {
+		if !granted[check.Scope+"|"+check.Group+"|"+check.Resource+"|"+check.Verb] {
+			t.Errorf("Expected %+v granted", check)
+		}
+	}
+}
+
+func TestWriteBootstrapManifestsShouldPrintOneDocumentPerObject(t *testing.T) {
+	os.Setenv("STORAGE_BACKEND", "memory")
+	defer os.Unsetenv("STORAGE_BACKEND")
+	manifests := renderBootstrapManifests("azuredevops", "default", nil)
+
+	var out bytes.Buffer
+	if err := writeBootstrapManifests(&out, manifests); err != nil {
+		t.Fatalf("Expected the manifests printed. Got %v", err)
+	}
+	documents := strings.Split(out.String(), "---\n")
+	objects := manifests.objects()
+	if len(documents) != len(objects) {
+		t.Fatalf("Expected %d documents. Got %d", len(objects), len(documents))
+	}
+	var first, last metav1.TypeMeta
+	yaml.Unmarshal([]byte(documents[0]), &first)
+	yaml.Unmarshal([]byte(documents[len(documents)-1]), &last)
+	if first.Kind != "Namespace" || last.Kind != "ClusterRoleBinding" || last.APIVersion != "rbac.authorization.k8s.io/v1" {
+		t.Errorf("Expected the namespace first and the cluster role binding last. Got %+v %+v", first, last)
+	}
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+
+	v1alpha1 "github.com/microsoft/poolprovider-for-k8s/pkg/apis/dev/v1alpha1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// A frozen pool has "frozen:<pool>" set to the month it was frozen in, so it thaws by itself when
+// the month changes. "budget:<month>:<pool>" makes sure the exceeded notification goes out once.
+const (
+	BudgetActionWarn    = "warn"
+	BudgetActionEnforce = "enforce"
+	frozenKeyPrefix     = "frozen:"
+	budgetKeyPrefix     = "budget:"
+)
+
+var budgetCheckInterval = 5 * time.Minute
+
+// Checks the pool budgets every BUDGET_CHECK_INTERVAL_SECONDS on the leader, or on the replica
+// owning the pool when the pools are sharded.
+func RunBudgetMonitor(namespace string) {
+	interval := time.Duration(getEnvInt("BUDGET_CHECK_INTERVAL_SECONDS", int(budgetCheckInterval/time.Second))) * time.Second
+	lastMonth := ""
+	for {
+		if IsLeader() || isShardingEnabled() {
+			now := time.Now().UTC()
+			if month := now.Format(costMonth); month != lastMonth && IsLeader() {
+				pruneCostEntries(now)
+				lastMonth = month
+			}
+			if err := CheckBudgets(namespace, now); err != nil {
+				log.Println("Budget check failed", err)
+			}
+		}
+		time.Sleep(interval)
+	}
+}
+
+func CheckBudgets(namespace string, now time.Time) error {
+	crdobject, _, err := fetchAzurePipelinesPool(namespace)
+	if err != nil {
+		return err
+	}
+
+	podClient := CreateClientSet().clientset.CoreV1().Pods(namespace)
+	for i := range crdobject.Spec.AgentPools {
+		pool := &crdobject.Spec.AgentPools[i]
+		if !ownsPool(pool.PoolName) {
+			continue
+		}
+		if pool.MonthlyBudget <= 0 {
+			if isPoolFrozen(pool.PoolName, now) {
+				thawPool(pool.PoolName, "The budget of the pool was removed")
+			}
+			continue
+		}
+
+		pods, err := podClient.List(metav1.ListOptions{LabelSelector: agentPoolLabel + "=" + pool.PoolName})
+		if err != nil {
+			return err
+		}
+		cost, err := monthToDateCost(pool.PoolName, pods.Items, now)
+		if err != nil {
+			return err
+		}
+		poolMonthCost.WithLabelValues(pool.PoolName).Set(cost)
+
+		applyBudget(pool, cost, now)
+	}
+	return nil
+}
+
+// Freezes or thaws the pool for its month to date cost, and notifies the first time the budget is
+// exceeded in a month.
+func applyBudget(pool *v1alpha1.AgentPoolSpec, cost float64, now time.Time) {
+	month := now.UTC().Format(costMonth)
+	exceeded := cost >= float64(pool.MonthlyBudget)
+	enforce := pool.BudgetAction == BudgetActionEnforce
+	frozen := isPoolFrozen(pool.PoolName, now)
+
+	message := fmt.Sprintf("Agent pool %s used %.2f of its monthly budget of %d", pool.PoolName, cost, pool.MonthlyBudget)
+	if exceeded {
+		if first, _ := GetStorage().SetIfAbsent(budgetKeyPrefix+month+":"+pool.PoolName, strconv.FormatFloat(cost, 'f', 2, 64)); first {
+			if enforce {
+				message += ", new agents are rejected until the next month"
+			}
+			Notify(Notification{Event: "BudgetExceeded", Pool: pool.PoolName, Message: message})
+		}
+	}
+
+	if exceeded && enforce && !frozen {
+		if err := GetStorage().Set(frozenKeyPrefix+pool.PoolName, month); err != nil {
+			log.Println("Failed to freeze pool "+pool.PoolName, err)
+			return
+		}
+		log.Println("Agent pool " + pool.PoolName + " frozen")
+	} else if frozen && !(exceeded && enforce) {
+		thawPool(pool.PoolName, message)
+	}
+}
+
+func thawPool(poolName string, reason string) {
+	if err := GetStorage().Delete(frozenKeyPrefix + poolName); err != nil {
+		log.Println("Failed to thaw pool "+poolName, err)
+		return
+	}
+	Notify(Notification{Event: "PoolThawed", Pool: poolName, Message: reason})
+}
+
+// A pool frozen in an earlier month is no longer frozen.
+func isPoolFrozen(poolName string, now time.Time) bool {
+	month, err := GetStorage().Get(frozenKeyPrefix + poolName)
+	return err == nil && month == now.UTC().Format(costMonth)
+}
+
+func frozenPoolError(poolName string) error {
+	return errors.New("Agent pool " + poolName + " is frozen, its monthly budget is used up")
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	v1alpha1 "github.com/microsoft/poolprovider-for-k8s/pkg/apis/dev/v1alpha1"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestPodCostShouldUseRequestsFromMonthStart(t *testing.T) {
+	now := time.Date(2020, 3, 1, 2, 0, 0, 0, time.UTC)
+	pod := &v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{CreationTimestamp: metav1.Time{Time: now.Add(-10 * time.Hour)}},
+		Spec: v1.PodSpec{Containers: []v1.Container{{Resources: v1.ResourceRequirements{Requests: v1.ResourceList{
+			v1.ResourceCPU:    resource.MustParse("500m"),
+			v1.ResourceMemory: resource.MustParse("2Gi"),
+		}}}}},
+	}
+
+	// Only the two hours of March count: 2h * (0.5 * 1.0 + 2 * 0.25)
+	cost := podCost(pod, costRates{CpuHour: 1, MemoryHour: 0.25}, startOfMonth(now), now)
+	if cost < 1.99 || cost > 2.01 {
+		t.Errorf("Expected a cost of 2. Got %v", cost)
+	}
+}
+
+func TestApplyBudgetShouldFreezeEnforcedPools(t *testing.T) {
+	SetupCustomResource()
+	now := time.Now()
+	pool := &v1alpha1.AgentPoolSpec{PoolName: "linux", MonthlyBudget: 100, BudgetAction: BudgetActionEnforce}
+
+	applyBudget(pool, 50, now)
+	if isPoolFrozen("linux", now) {
+		t.Errorf("Pool under its budget must not be frozen")
+	}
+
+	applyBudget(pool, 120, now)
+	if !isPoolFrozen("linux", now) {
+		t.Errorf("Expected the pool over its budget to be frozen")
+	}
+	if isPoolFrozen("linux", now.AddDate(0, 1, 0)) {
+		t.Errorf("Expected the pool to thaw in the next month")
+	}
+
+	pool.BudgetAction = BudgetActionWarn
+	applyBudget(pool, 120, now)
+	if isPoolFrozen("linux", now) {
+		t.Errorf("Expected a warn-only pool to be thawed")
+	}
+}
+
+func TestCostRatesShouldComeFromEnvironment(t *testing.T) {
+	os.Setenv("COST_PER_CPU_HOUR", "0.04")
+	defer os.Unsetenv("COST_PER_CPU_HOUR")
+
+	if rates := costRatesFromEnvironment(); rates.CpuHour != 0.04 || rates.MemoryHour != 0 {
+		t.Errorf("Unexpected rates %v", rates)
+	}
+}
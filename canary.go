@@ -0,0 +1,223 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	v1alpha1 "github.com/microsoft/poolprovider-for-k8s/pkg/apis/dev/v1alpha1"
+	v1 "k8s.io/api/core/v1"
+)
+
+// The canary runs a synthetic job through every agent pool every CANARY_INTERVAL_SECONDS, 0 and
+// off by default, so a broken pool is found before a real job runs into it. The job takes the path
+// of an acquire request: it is checked for satisfiability, claimed, waits for a creation slot and
+// gets its pod from CreatePod, where the agent container runs a trivial script instead of the
+// agent. Once the script exited, the agent is released like Azure DevOps releases it. The outcome
+// and end to end latency of the last run of each pool are kept under "canary:<pool>" in the
+// storage, shown on GET /admin/canary and counted in the poolprovider_canary_* metrics. A run
+// which fails, or does not finish within CANARY_TIMEOUT_SECONDS (300), sends a "canary-failed"
+// notification. Each pool is run by the replica owning it. Records of pools which were removed are
+// dropped after CANARY_RETENTION_HOURS, 720 by default.
+const (
+	canaryKeyPrefix        = "canary:"
+	canaryAgentPrefix      = "canary-"
+	defaultCanaryTimeout   = 5 * time.Minute
+	defaultCanaryRetention = 30 * 24 * time.Hour
+
+	CanaryResultSucceeded = "succeeded"
+	CanaryResultFailed    = "failed"
+)
+
+var canaryPollInterval = 2 * time.Second
+
+type CanaryRecord struct {
+	Pool    string
+	AgentId string
+	Result  string
+	// Stage the run failed in and why
+	Stage      string `json:",omitempty"`
+	Reason     string `json:",omitempty"`
+	Seconds    float64
+	FinishedAt time.Time
+}
+
+func RunCanary(namespace string) {
+	interval := time.Duration(getEnvInt("CANARY_INTERVAL_SECONDS", 0)) * time.Second
+	if interval <= 0 {
+		return
+	}
+	timeout := time.Duration(getEnvInt("CANARY_TIMEOUT_SECONDS", int(defaultCanaryTimeout/time.Second))) * time.Second
+	for {
+		if crdobject, _, err := fetchAzurePipelinesPool(namespace); err != nil {
+			log.Println("Canary could not read the agent pools", err)
+		} else {
+			for i := range crdobject.Spec.AgentPools {
+				if ownsPool(crdobject.Spec.AgentPools[i].PoolName) {
+					recordCanaryRun(runCanaryJob(&crdobject.Spec.AgentPools[i], namespace, timeout))
+				}
+			}
+		}
+		time.Sleep(interval)
+	}
+}
+
+// Runs one synthetic job in the pool and returns its outcome.
+func runCanaryJob(pool *v1alpha1.AgentPoolSpec, namespace string, timeout time.Duration) CanaryRecord {
+	b := make([]byte, 4)
+	rand.Read(b)
+	agentRequest := AgentRequest{AgentId: canaryAgentPrefix + hex.EncodeToString(b), AgentSpec: pool.PoolName, Canary: true}
+	agentRequest.RequestId = agentRequest.AgentId
+	started := time.Now()
+	record := CanaryRecord{Pool: pool.PoolName, AgentId: agentRequest.AgentId, Result: CanaryResultSucceeded}
+	fail := func(stage string, err error) CanaryRecord {
+		record.Result, record.Stage, record.Reason = CanaryResultFailed, stage, err.Error()
+		record.Seconds, record.FinishedAt = time.Since(started).Seconds(), time.Now().UTC()
+		return record
+	}
+
+	if err := validateSatisfiability(agentRequest, namespace); err != nil {
+		return fail("satisfiability", err)
+	}
+	ClaimAcquireRequest(agentRequest.AgentId)
+	defer ForgetAcquireRequest(agentRequest.AgentId)
+	if !podCreationThrottle.Acquire(throttleWaitTimeout) {
+		return fail("creation-queue", errors.New(ServerBusyError))
+	}
+	response := CreatePod(agentRequest, namespace)
+	podCreationThrottle.Release()
+	CompleteJournal(agentRequest.AgentId)
+	if !response.Accepted {
+		return fail("acquire", errors.New(response.ErrorMessage))
+	}
+	defer releaseCanaryAgent(agentRequest.AgentId, namespace)
+
+	if err := waitForCanaryJob(agentRequest.AgentId, namespace, started.Add(timeout)); err != nil {
+		return fail("job", err)
+	}
+	record.Seconds, record.FinishedAt = time.Since(started).Seconds(), time.Now().UTC()
+	return record
+}
+
+// Replaces the agent with a script which exits right away, so the canary needs no Azure DevOps.
+func runCanaryScript(pod *v1.Pod) {
+	if len(pod.Spec.Containers) == 0 {
+		return
+	}
+	container := &pod.Spec.Containers[0]
+	if isWindowsPod(pod) {
+		container.Command = []string{"cmd", "/c", "echo canary"}
+	} else {
+		container.Command = []string{"sh", "-c", "echo canary"}
+	}
+	container.Args = nil
+	container.ReadinessProbe, container.LivenessProbe = nil, nil
+	pod.Spec.RestartPolicy = v1.RestartPolicyNever
+}
+
+// Waits until the script of the canary agent exited, failing when it exited with an error.
+func waitForCanaryJob(agentId string, namespace string, deadline time.Time) error {
+	for {
+		cs, _, err := agentClientSet(agentId)
+		if err != nil {
+			return err
+		}
+		var pod *v1.Pod
+		for _, ns := range agentNamespaces(namespace) {
+			if pod = findAgentPod(cs, agentId, ns); pod != nil {
+				break
+			}
+		}
+		if done, err := canaryJobOutcome(agentId, pod); done {
+			return err
+		}
+		if time.Now().After(deadline) {
+			state := "no pod"
+			if pod != nil {
+				state, _ = podStartupState(pod)
+			}
+			return errors.New("The canary job did not finish in time, its pod is " + state)
+		}
+		time.Sleep(canaryPollInterval)
+	}
+}
+
+// Returns whether the canary job finished and its error. Ephemeral and Job pools may have removed
+// the pod already, their recorded outcome tells then.
+func canaryJobOutcome(agentId string, pod *v1.Pod) (bool, error) {
+	if pod == nil {
+		if job, ok := getAgentJobRecord(agentId); ok {
+			if job.Outcome != AgentJobOutcomeSucceeded {
+				return true, errors.New("The canary job " + job.Outcome + " " + job.Reason)
+			}
+			return true, nil
+		}
+		return false, nil
+	}
+	if state, reason := podStartupState(pod); state == StartupStateFailed && pod.Status.Phase != v1.PodSucceeded {
+		return true, errors.New(reason)
+	}
+	if event, exitCode := ephemeralEvent(pod); event == ephemeralEventExited {
+		if exitCode != 0 {
+			return true, errors.New("The canary script exited with code " + strconv.Itoa(int(exitCode)))
+		}
+		return true, nil
+	}
+	return false, nil
+}
+
+func releaseCanaryAgent(agentId string, namespace string) {
+	logger := newFieldLogger().with(agentIdField, agentId)
+	for _, ns := range agentNamespaces(namespace) {
+		if response := deleteAgentPod(logger, agentId, ns); response.Status == "success" {
+			return
+		}
+	}
+	logger.Warn("Could not release the canary agent " + agentId)
+}
+
+func recordCanaryRun(record CanaryRecord) {
+	canaryRuns.WithLabelValues(record.Pool, record.Result).Inc()
+	canarySeconds.WithLabelValues(record.Pool).Observe(record.Seconds)
+	data, _ := json.Marshal(record)
+	if err := GetStorage().Set(canaryKeyPrefix+record.Pool, string(data)); err != nil {
+		log.Println("Failed to store the canary run of pool "+record.Pool, err)
+	}
+
+	if record.Result == CanaryResultFailed {
+		Notify(Notification{Event: "canary-failed", Pool: record.Pool, Message: "Canary job " + record.AgentId + " failed in " + record.Stage + ": " + record.Reason})
+		return
+	}
+	log.Println("Canary job " + record.AgentId + " of pool " + record.Pool + " succeeded in " + strconv.FormatFloat(record.Seconds, 'f', 1, 64) + " seconds")
+}
+
+// Returns the last canary run of every pool.
+func getCanaryRecords() []CanaryRecord {
+	records := []CanaryRecord{}
+	entries, err := GetStorage().List(canaryKeyPrefix)
+	if err != nil {
+		log.Println("Failed to list the canary runs", err)
+		return records
+	}
+	for _, value := range entries {
+		var record CanaryRecord
+		if json.Unmarshal([]byte(value), &record) == nil {
+			records = append(records, record)
+		}
+	}
+	sort.Slice(records, func(i, j int) bool { return records[i].Pool < records[j].Pool })
+	return records
+}
+
+func CanaryHandler(resp http.ResponseWriter, req *http.Request) {
+	if !isReadRequestValid(resp, req) {
+		return
+	}
+	writeJsonResponse(resp, http.StatusOK, getCanaryRecords())
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"testing"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+)
+
+func canaryPod(agentState v1.ContainerState) *v1.Pod {
+	return &v1.Pod{
+		Spec: v1.PodSpec{Containers: []v1.Container{{Name: "vsts-agent"}}},
+		Status: v1.PodStatus{Phase: v1.PodRunning, ContainerStatuses: []v1.ContainerStatus{
+			{Name: "vsts-agent", State: agentState},
+		}},
+	}
+}
+
+func TestRunCanaryScriptShouldReplaceTheAgent(t *testing.T) {
+	pod := &v1.Pod{Spec: v1.PodSpec{Containers: []v1.Container{{Name: "vsts-agent", Args: []string{"--once"}}}}}
+	runCanaryScript(pod)
+	container := pod.Spec.Containers[0]
+	if container.Command[0] != "sh" || container.Args != nil || pod.Spec.RestartPolicy != v1.RestartPolicyNever {
+		t.Errorf("Expected a shell script run once. Got %v %v %s", container.Command, container.Args, pod.Spec.RestartPolicy)
+	}
+
+	windows := &v1.Pod{Spec: v1.PodSpec{NodeSelector: map[string]string{osLabel: "windows"}, Containers: []v1.Container{{Name: "vsts-agent"}}}}
+	runCanaryScript(windows)
+	if windows.Spec.Containers[0].Command[0] != "cmd" {
+		t.Errorf("Expected a cmd script on Windows. Got %v", windows.Spec.Containers[0].Command)
+	}
+}
+
+func TestCanaryJobOutcomeShouldFollowTheScript(t *testing.T) {
+	os.Setenv("STORAGE_BACKEND", "memory")
+	defer os.Unsetenv("STORAGE_BACKEND")
+
+	if done, _ := canaryJobOutcome("canary-1", canaryPod(v1.ContainerState{Running: &v1.ContainerStateRunning{}})); done {
+		t.Errorf("Expected a running script not done")
+	}
+	if done, err := canaryJobOutcome("canary-1", canaryPod(v1.ContainerState{Terminated: &v1.ContainerStateTerminated{}})); !done || err != nil {
+		t.Errorf("Expected the script succeeded. Got %v %v", done, err)
+	}
+	if done, err := canaryJobOutcome("canary-1", canaryPod(v1.ContainerState{Terminated: &v1.ContainerStateTerminated{ExitCode: 127}})); !done || err == nil {
+		t.Errorf("Expected the script failed. Got %v %v", done, err)
+	}
+	if done, err := canaryJobOutcome("canary-1", canaryPod(v1.ContainerState{Waiting: &v1.ContainerStateWaiting{Reason: "ImagePullBackOff"}})); !done || err == nil {
+		t.Errorf("Expected the job failed when the image cannot be pulled. Got %v %v", done, err)
+	}
+
+	// The pod of an ephemeral or Job pool is gone once the script exited
+	if done, _ := canaryJobOutcome("canary-1", nil); done {
+		t.Errorf("Expected a job without pod or outcome not done")
+	}
+	data, _ := json.Marshal(AgentJobRecord{AgentId: "canary-1", Outcome: AgentJobOutcomeSucceeded})
+	GetStorage().Set(agentJobKeyPrefix+"canary-1", string(data))
+	defer GetStorage().Delete(agentJobKeyPrefix + "canary-1")
+	if done, err := canaryJobOutcome("canary-1", nil); !done || err != nil {
+		t.Errorf("Expected the recorded outcome used. Got %v %v", done, err)
+	}
+}
+
+func TestRecordCanaryRunShouldKeepTheLastRunOfEachPool(t *testing.T) {
+	os.Setenv("STORAGE_BACKEND", "memory")
+	defer os.Unsetenv("STORAGE_BACKEND")
+	defer GetStorage().Delete(canaryKeyPrefix + "linux")
+	defer GetStorage().Delete(canaryKeyPrefix + "windows")
+	now := time.Date(2026, 10, 15, 12, 0, 0, 0, time.UTC)
+
+	recordCanaryRun(CanaryRecord{Pool: "windows", AgentId: "canary-1", Result: CanaryResultSucceeded, Seconds: 40, FinishedAt: now})
+	recordCanaryRun(CanaryRecord{Pool: "linux", AgentId: "canary-2", Result: CanaryResultSucceeded, Seconds: 12, FinishedAt: now})
+	recordCanaryRun(CanaryRecord{Pool: "linux", AgentId: "canary-3", Result: CanaryResultFailed, Stage: "job", Reason: "ErrImagePull", FinishedAt: now})
+
+	records := getCanaryRecords()
+	if len(records) != 2 || records[0].Pool != "linux" || records[0].AgentId != "canary-3" || records[0].Result != CanaryResultFailed || records[1].Seconds != 40 {
+		t.Errorf("Expected the last run of both pools. Got %+v", records)
+	}
+}
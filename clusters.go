@@ -0,0 +1,154 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"log"
+	"os"
+	"sync"
+
+	v1alpha1 "github.com/microsoft/poolprovider-for-k8s/pkg/apis/dev/v1alpha1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/clientcmd"
+)
+
+// The cluster registry lets one webserver run the agents of some pools in other clusters. The JSON
+// file CLUSTER_REGISTRY_FILE names lists the clusters, each with the kubeconfig file to reach it
+// or inCluster for the cluster of the webserver:
+//
+//	[{"name": "westeurope", "kubeconfig": "/etc/clusters/westeurope"}, {"name": "home", "inCluster": true}]
+//
+// The Cluster of an agent pool names the cluster its agent pods, secrets and services are created
+// in, pools without one use the cluster of the webserver. The cluster of an agent is kept under
+// "agent-cluster:<agentId>" in the storage until it is released, so every replica releases it
+// there. Warm pools only run in the cluster of the webserver.
+const agentClusterKeyPrefix = "agent-cluster:"
+
+type ClusterConfig struct {
+	Name       string `json:"name"`
+	Kubeconfig string `json:"kubeconfig,omitempty"`
+	InCluster  bool   `json:"inCluster,omitempty"`
+}
+
+var clusterRegistry = struct {
+	once     sync.Once
+	clusters map[string]ClusterConfig
+
+	lock       sync.Mutex
+	clientsets map[string]*k8s
+}{clientsets: map[string]*k8s{}}
+
+func loadClusterRegistry(file string) map[string]ClusterConfig {
+	clusters := map[string]ClusterConfig{}
+	if file == "" {
+		return clusters
+	}
+
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		log.Println("Failed to read cluster registry "+file, err)
+		return clusters
+	}
+	var configs []ClusterConfig
+	if err := json.Unmarshal(data, &configs); err != nil {
+		log.Println("Failed to parse cluster registry "+file, err)
+		return clusters
+	}
+	for _, cluster := range configs {
+		if cluster.Name == "" || cluster.InCluster == (cluster.Kubeconfig != "") {
+			log.Println("Ignoring cluster " + cluster.Name + ", it needs a name and either a kubeconfig or inCluster")
+			continue
+		}
+		if _, ok := clusters[cluster.Name]; ok {
+			log.Println("Ignoring duplicate cluster " + cluster.Name)
+			continue
+		}
+		clusters[cluster.Name] = cluster
+	}
+	return clusters
+}
+
+func getClusterRegistry() map[string]ClusterConfig {
+	clusterRegistry.once.Do(func() {
+		clusterRegistry.clusters = loadClusterRegistry(os.Getenv("CLUSTER_REGISTRY_FILE"))
+	})
+	return clusterRegistry.clusters
+}
+
+// Returns the cluster the agent pods of the pool run in, empty for the cluster of the webserver.
+func poolCluster(pool *v1alpha1.AgentPoolSpec) string {
+	if pool == nil {
+		return ""
+	}
+	return pool.Cluster
+}
+
+// Returns the client set of the registered cluster, the one of the webserver's cluster for an empty
+// name. Client sets are created once per cluster.
+func clusterClientSet(name string) (*k8s, error) {
+	if name == "" {
+		return CreateClientSet(), nil
+	}
+	cluster, ok := getClusterRegistry()[name]
+	if !ok {
+		return nil, errors.New(UnknownClusterError + " Cluster: " + name)
+	}
+
+	clusterRegistry.lock.Lock()
+	defer clusterRegistry.lock.Unlock()
+	if cs, ok := clusterRegistry.clientsets[name]; ok {
+		return cs, nil
+	}
+
+	var cs *k8s
+	if v1alpha1.IsTestingEnv() {
+		cs = &k8s{clientset: fake.NewSimpleClientset()}
+	} else {
+		clientset, err := newClusterClientSet(cluster)
+		if err != nil {
+			return nil, err
+		}
+		cs = &k8s{clientset: clientset}
+	}
+	clusterRegistry.clientsets[name] = cs
+	return cs, nil
+}
+
+func newClusterClientSet(cluster ClusterConfig) (*kubernetes.Clientset, error) {
+	if cluster.InCluster {
+		return getInClusterClientSet()
+	}
+	config, err := clientcmd.BuildConfigFromFlags("", cluster.Kubeconfig)
+	if err != nil {
+		return nil, err
+	}
+	return kubernetes.NewForConfig(config)
+}
+
+func recordAgentCluster(agentId string, cluster string) {
+	if cluster == "" {
+		return
+	}
+	if err := GetStorage().Set(agentClusterKeyPrefix+agentId, cluster); err != nil {
+		log.Println("Failed to record the cluster of agent "+agentId, err)
+	}
+}
+
+// Returns the client set of the cluster the agent runs in and the name of the cluster, empty for
+// the cluster of the webserver.
+func agentClientSet(agentId string) (*k8s, string, error) {
+	cluster, err := GetStorage().Get(agentClusterKeyPrefix + agentId)
+	if err != nil || cluster == "" {
+		return CreateClientSet(), "", nil
+	}
+	cs, err := clusterClientSet(cluster)
+	return cs, cluster, err
+}
+
+func forgetAgentCluster(agentId string, cluster string) {
+	if cluster != "" {
+		GetStorage().Delete(agentClusterKeyPrefix + agentId)
+	}
+}
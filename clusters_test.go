@@ -0,0 +1,58 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestLoadClusterRegistryShouldSkipInvalidClusters(t *testing.T) {
+	file, _ := ioutil.TempFile("", "clusters")
+	defer os.Remove(file.Name())
+	file.WriteString(`[
+		{"name": "westeurope", "kubeconfig": "/etc/clusters/westeurope"},
+		{"name": "home", "inCluster": true},
+		{"name": "both", "kubeconfig": "/etc/clusters/both", "inCluster": true},
+		{"kubeconfig": "/etc/clusters/unnamed"},
+		{"name": "westeurope", "inCluster": true}
+	]`)
+	file.Close()
+
+	clusters := loadClusterRegistry(file.Name())
+	if len(clusters) != 2 {
+		t.Fatalf("Expected 2 clusters. Got %v", clusters)
+	}
+	if clusters["westeurope"].Kubeconfig != "/etc/clusters/westeurope" || !clusters["home"].InCluster {
+		t.Errorf("Unexpected clusters %v", clusters)
+	}
+
+	if clusters := loadClusterRegistry("/nonexistent/clusters.json"); len(clusters) != 0 {
+		t.Errorf("Expected no clusters for a missing file. Got %v", clusters)
+	}
+}
+
+func TestClusterClientSetShouldRejectUnknownClusters(t *testing.T) {
+	if _, err := clusterClientSet("eastus"); err == nil || !strings.HasPrefix(err.Error(), UnknownClusterError) {
+		t.Errorf("Expected the unknown cluster rejected. Got %v", err)
+	}
+}
+
+func TestAgentClusterShouldBeForgottenOnRelease(t *testing.T) {
+	os.Setenv("STORAGE_BACKEND", "memory")
+	defer os.Unsetenv("STORAGE_BACKEND")
+
+	recordAgentCluster("agent-remote", "westeurope")
+	if cluster, _ := GetStorage().Get(agentClusterKeyPrefix + "agent-remote"); cluster != "westeurope" {
+		t.Errorf("Expected the cluster of the agent recorded. Got %q", cluster)
+	}
+	forgetAgentCluster("agent-remote", "westeurope")
+	if cluster, _ := GetStorage().Get(agentClusterKeyPrefix + "agent-remote"); cluster != "" {
+		t.Errorf("Expected the cluster of the agent forgotten. Got %q", cluster)
+	}
+
+	recordAgentCluster("agent-home", "")
+	if entries, _ := GetStorage().List(agentClusterKeyPrefix); len(entries) != 0 {
+		t.Errorf("Expected no record for agents in the cluster of the webserver. Got %v", entries)
+	}
+}
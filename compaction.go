@@ -0,0 +1,217 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"strings"
+	"time"
+)
+
+// Every storage entry is a ConfigMap, so entries nobody deletes pile up in the namespace of busy
+// installs. The leader removes the ones past their retention every STORAGE_COMPACTION_INTERVAL_SECONDS:
+// acquire results after DEDUPE_RETENTION_HOURS, finished Jobs of agents never released after
+// AGENT_JOB_RETENTION_HOURS, ephemeral and startup records after EPHEMERAL_RETENTION_HOURS and
+// STARTUP_RETENTION_HOURS, canary records of removed pools after CANARY_RETENTION_HOURS, node
+// records of runs after the run affinity timeout, budget markers of past months, and audit entries
+// after AUDIT_RETENTION_DAYS. Expired audit entries are written to the log before they are removed, so
+// log collection keeps them.
+var (
+	storageCompactionInterval = time.Hour
+	defaultDedupeRetention    = 48 * time.Hour
+	defaultAuditRetention     = 90 * 24 * time.Hour
+)
+
+type retentionPolicy struct {
+	prefix    string
+	retention time.Duration
+	archive   bool
+	// Returns when the entry was last written, false when that cannot be told
+	timestamp func(key string, value string) (time.Time, bool)
+}
+
+func RunStorageCompaction() {
+	interval := time.Duration(getEnvInt("STORAGE_COMPACTION_INTERVAL_SECONDS", int(storageCompactionInterval/time.Second))) * time.Second
+	for {
+		if IsLeader() {
+			CompactStorage(retentionPolicies(), time.Now().UTC())
+		}
+		time.Sleep(interval)
+	}
+}
+
+func retentionPolicies() []retentionPolicy {
+	return []retentionPolicy{
+		{
+			prefix:    dedupeKeyPrefix,
+			retention: retentionSetting("DEDUPE_RETENTION_HOURS", defaultDedupeRetention, time.Hour),
+			timestamp: func(key string, value string) (time.Time, bool) {
+				var record DedupeRecord
+				return record.ClaimedAt, json.Unmarshal([]byte(value), &record) == nil
+			},
+		},
+		{
+			prefix:    agentJobKeyPrefix,
+			retention: retentionSetting("AGENT_JOB_RETENTION_HOURS", defaultAgentJobRetention, time.Hour),
+			timestamp: func(key string, value string) (time.Time, bool) {
+				var record AgentJobRecord
+				return record.FinishedAt, json.Unmarshal([]byte(value), &record) == nil
+			},
+		},
+		{
+			prefix:    ephemeralKeyPrefix,
+			retention: retentionSetting("EPHEMERAL_RETENTION_HOURS", defaultEphemeralRetention, time.Hour),
+			timestamp: func(key string, value string) (time.Time, bool) {
+				var record EphemeralAgentRecord
+				return record.UpdatedAt, json.Unmarshal([]byte(value), &record) == nil
+			},
+		},
+		{
+			// Pools which were removed
+			prefix:    canaryKeyPrefix,
+			retention: retentionSetting("CANARY_RETENTION_HOURS", defaultCanaryRetention, time.Hour),
+			timestamp: func(key string, value string) (time.Time, bool) {
+				var record CanaryRecord
+				return record.FinishedAt, json.Unmarshal([]byte(value), &record) == nil
+			},
+		},
+		{
+			prefix:    usageKeyPrefix,
+			retention: retentionSetting("RIGHTSIZING_RETENTION_DAYS", defaultRightsizingRetention, 24*time.Hour),
+			timestamp: func(key string, value string) (time.Time, bool) {
+				var sample UsageSample
+				return sample.SampledAt, json.Unmarshal([]byte(value), &sample) == nil
+			},
+		},
+		{
+			prefix:    startupKeyPrefix,
+			retention: retentionSetting("STARTUP_RETENTION_HOURS", defaultStartupRetention, time.Hour),
+			timestamp: func(key string, value string) (time.Time, bool) {
+				var record AgentStartupRecord
+				return record.UpdatedAt, json.Unmarshal([]byte(value), &record) == nil
+			},
+		},
+		{
+			prefix:    operationKeyPrefix,
+			retention: retentionSetting("OPERATION_RETENTION_HOURS", defaultOperationRetention, time.Hour),
+			timestamp: func(key string, value string) (time.Time, bool) {
+				var operation Operation
+				return operation.UpdatedAt, json.Unmarshal([]byte(value), &operation) == nil
+			},
+		},
+		{
+			// Requests of operations which were never finished
+			prefix:    operationRequestKeyPrefix,
+			retention: retentionSetting("OPERATION_RETENTION_HOURS", defaultOperationRetention, time.Hour),
+			timestamp: func(key string, value string) (time.Time, bool) {
+				var request OperationRequest
+				return request.QueuedAt, json.Unmarshal([]byte(value), &request) == nil
+			},
+		},
+		{
+			prefix:    operationLeaseKeyPrefix,
+			retention: retentionSetting("OPERATION_RETENTION_HOURS", defaultOperationRetention, time.Hour),
+			timestamp: func(key string, value string) (time.Time, bool) {
+				var lease OperationLease
+				return lease.ExpiresAt, json.Unmarshal([]byte(value), &lease) == nil
+			},
+		},
+		{
+			prefix:    runAffinityKeyPrefix,
+			retention: runAffinityTimeout,
+			timestamp: func(key string, value string) (time.Time, bool) {
+				var affinity runAffinity
+				return affinity.UpdatedAt, json.Unmarshal([]byte(value), &affinity) == nil
+			},
+		},
+		{
+			// "budget:<month>:<pool>" is only needed during its month
+			prefix:    budgetKeyPrefix,
+			retention: 0,
+			timestamp: func(key string, value string) (time.Time, bool) {
+				month, err := time.Parse(costMonth, strings.SplitN(strings.TrimPrefix(key, budgetKeyPrefix), ":", 2)[0])
+				return month.AddDate(0, 1, 0), err == nil
+			},
+		},
+		{
+			prefix:    failoverKeyPrefix,
+			retention: retentionSetting("FAILOVER_RETENTION_DAYS", defaultFailoverRetention, 24*time.Hour),
+			timestamp: func(key string, value string) (time.Time, bool) {
+				var record FailoverRecord
+				return record.Timestamp, json.Unmarshal([]byte(value), &record) == nil
+			},
+		},
+		{
+			prefix:    payloadKeyPrefix,
+			retention: retentionSetting("PAYLOAD_RETENTION_HOURS", defaultPayloadRetention, time.Hour),
+			timestamp: func(key string, value string) (time.Time, bool) {
+				var capture PayloadCapture
+				return capture.CapturedAt, json.Unmarshal([]byte(value), &capture) == nil
+			},
+		},
+		{
+			prefix:    explainKeyPrefix,
+			retention: retentionSetting("EXPLAIN_RETENTION_HOURS", defaultExplainRetention, time.Hour),
+			timestamp: func(key string, value string) (time.Time, bool) {
+				var explanation ProvisioningExplanation
+				return explanation.UpdatedAt, json.Unmarshal([]byte(value), &explanation) == nil
+			},
+		},
+		{
+			// Replicas which left the shard
+			prefix:    shardKeyPrefix,
+			retention: shardHeartbeatTimeout,
+			timestamp: func(key string, value string) (time.Time, bool) {
+				renewed, err := time.Parse(time.RFC3339, value)
+				return renewed, err == nil
+			},
+		},
+		{
+			prefix:    auditKeyPrefix,
+			retention: retentionSetting("AUDIT_RETENTION_DAYS", defaultAuditRetention, 24*time.Hour),
+			archive:   true,
+			timestamp: func(key string, value string) (time.Time, bool) {
+				var entry AuditEntry
+				return entry.Timestamp, json.Unmarshal([]byte(value), &entry) == nil
+			},
+		},
+	}
+}
+
+// Returns the retention set in the variable, in units of unit, or the default retention.
+func retentionSetting(name string, defaultRetention time.Duration, unit time.Duration) time.Duration {
+	return time.Duration(getEnvInt(name, int(defaultRetention/unit))) * unit
+}
+
+// Removes the entries past their retention and returns how many were removed. Entries whose age
+// cannot be told are kept.
+func CompactStorage(policies []retentionPolicy, now time.Time) int {
+	store := GetStorage()
+	removed := 0
+	for _, policy := range policies {
+		entries, err := store.List(policy.prefix)
+		if err != nil {
+			log.Println("Failed to list storage entries "+policy.prefix, err)
+			continue
+		}
+
+		for key, value := range entries {
+			written, ok := policy.timestamp(key, value)
+			if !ok || written.IsZero() || now.Sub(written) < policy.retention {
+				continue
+			}
+			if policy.archive {
+				log.Println("Archiving " + key + " " + value)
+			}
+			if err := store.Delete(key); err != nil {
+				log.Println("Failed to remove storage entry "+key, err)
+				continue
+			}
+			storageEntriesCompacted.WithLabelValues(strings.TrimSuffix(policy.prefix, ":")).Inc()
+			removed++
+		}
+	}
+	if removed > 0 {
+		log.Println("Storage compaction removed", removed, "entries")
+	}
+	return removed
+}
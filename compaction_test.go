@@ -0,0 +1,62 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestCompactStorageShouldRemoveExpiredEntries(t *testing.T) {
+	SetupCustomResource()
+	now := time.Date(2020, 3, 10, 0, 0, 0, 0, time.UTC)
+
+	old, _ := json.Marshal(DedupeRecord{ClaimedAt: now.Add(-72 * time.Hour)})
+	recent, _ := json.Marshal(DedupeRecord{ClaimedAt: now.Add(-time.Hour)})
+	GetStorage().Set(dedupeKeyPrefix+"compact-old", string(old))
+	GetStorage().Set(dedupeKeyPrefix+"compact-recent", string(recent))
+	GetStorage().Set(budgetKeyPrefix+"2020-02:linux", "120.00")
+	GetStorage().Set(budgetKeyPrefix+"2020-03:linux", "120.00")
+
+	removed := CompactStorage(retentionPolicies(), now)
+
+	if removed != 2 {
+		t.Errorf("Expected 2 entries to be removed. Got %d", removed)
+	}
+	if _, err := GetStorage().Get(dedupeKeyPrefix + "compact-recent"); err != nil {
+		t.Errorf("Expected the recent dedupe record to be kept")
+	}
+	if _, err := GetStorage().Get(budgetKeyPrefix + "2020-03:linux"); err != nil {
+		t.Errorf("Expected the budget marker of the current month to be kept")
+	}
+}
+
+func TestRetentionPoliciesShouldTellTheAgeOfBudgetMarkers(t *testing.T) {
+	for _, policy := range retentionPolicies() {
+		if policy.prefix != budgetKeyPrefix {
+			continue
+		}
+		if expires, ok := policy.timestamp(budgetKeyPrefix+"2020-02:linux", ""); !ok || !expires.Equal(time.Date(2020, 3, 1, 0, 0, 0, 0, time.UTC)) {
+			t.Errorf("Expected the marker to expire with February. Got %v", expires)
+		}
+		if _, ok := policy.timestamp(budgetKeyPrefix+"invalid", ""); ok {
+			t.Errorf("Expected an invalid key to be kept")
+		}
+	}
+}
+
+func TestRetentionPoliciesShouldKeepEachBucketForItsOwnRetention(t *testing.T) {
+	os.Setenv("AGENT_JOB_RETENTION_HOURS", "6")
+	defer os.Unsetenv("AGENT_JOB_RETENTION_HOURS")
+
+	retention := map[string]time.Duration{}
+	for _, policy := range retentionPolicies() {
+		retention[policy.prefix] = policy.retention
+	}
+	if retention[agentJobKeyPrefix] != 6*time.Hour || retention[dedupeKeyPrefix] != defaultDedupeRetention {
+		t.Errorf("Expected only the agent Jobs to take AGENT_JOB_RETENTION_HOURS. Got %v and %v", retention[agentJobKeyPrefix], retention[dedupeKeyPrefix])
+	}
+	if retention[canaryKeyPrefix] != defaultCanaryRetention || retention[ephemeralKeyPrefix] != defaultEphemeralRetention || retention[startupKeyPrefix] != defaultStartupRetention {
+		t.Errorf("Expected the defaults of the canary, ephemeral and startup records. Got %v", retention)
+	}
+}
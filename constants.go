@@ -1,9 +1,41 @@
 package main
 
 const (
-	NoAgentIdError        = "No AgentId sent in request body."
-	NoValidSignatureError = "Endpoint can only be invoked with AzureDevOps with the correct Shared Signature."
-	InvalidRequestError   = "Invalid request Method."
+	NoAgentIdError           = "No AgentId sent in request body."
+	NoValidSignatureError    = "Endpoint can only be invoked with AzureDevOps with the correct Shared Signature."
+	NoSignatureError         = "Endpoint can only be invoked with a signature in the X-Azure-Signature header."
+	InvalidRequestError      = "Invalid request Method."
+	AcquireInProgressError   = "The acquire request for this agent is still being handled."
+	ServerBusyError          = "Too many agents are being created, retry later."
+	AcquireCanceledError     = "The acquire request was canceled while waiting to be handled."
+	RateLimitExceededError   = "Rate limit exceeded, retry after the time in the Retry-After header."
+	NotLeaderError           = "This replica is not the leader."
+	AttestationFailedError   = "Agent identity could not be attested."
+	UnknownRouteError        = "No handler for the requested path."
+	UnsupportedEncodingError = "The Content-Encoding of the request is not supported."
+	UnsupportedMediaError    = "The Content-Type of the request has to be application/json."
+	RequestTooLargeError     = "The request body is too large."
+	InvalidRequestBodyError  = "The request body could not be decompressed."
+	UnknownPayloadError      = "No payload capture with the requested id."
+	UnknownQuarantineError   = "No quarantine for the requested pool and image."
+	UnknownExplanationError  = "No explanation for the requested job."
+	UnknownArtifactError     = "No artifact upstream for the requested path."
+	UnknownCallerError       = "No payload transforms for the caller named in the request."
+	UnknownFieldsError       = "The request has fields the provider does not know:"
+	SnapshotRestoreError     = "Snapshots can only be restored into a test environment."
+	NoStorageMigrationError  = "No storage migration is configured."
+	StorageMigrationError    = "The storage backends differ, backfill the target before the cutover."
+	UnknownDevTemplateError  = "No template for the requested pool in the dev template directory."
+	UnknownKillSwitchError   = "No kill switch is engaged for the requested pool."
+	KillSwitchReasonError    = "Engaging or releasing the kill switch needs a reason."
+	UnknownClusterError      = "The cluster is not in the cluster registry."
+	UnknownOperationError    = "No operation with the requested id."
+	ApiBudgetExhaustedError  = "The Kubernetes API budget of the agent pool is used up, retry later."
+	UnsupportedOSError       = "The agent pool has no pod template for the requested OS:"
+	UnknownPoolError         = "No agent pool with the requested name or id."
+	InvalidPageError         = "The limit or continue parameter of the request is not valid."
+	DeployRoleError          = "The cluster role of the deploy access is not in DEPLOY_CLUSTER_ROLES:"
+	UnknownRoutingPoolError  = "The routing rule matching the job names an agent pool which is not configured:"
 )
 
 type ErrorMessage struct {
@@ -23,12 +23,35 @@ type AgentRequest struct {
 	IsPublic                bool
 	AgentConfiguration      AgentConfigurationData
 	AgentSpec               string
+	SourceBranch            string
+	Demands                 []string
+	JobId                   string
+	Definition              string
+	Repository              string
+	// RunId is the pipeline run the job belongs to, stages of one run prefer the same node
+	RunId string
+	// OS the agent has to run, "linux" or "windows". When empty the OS of the agent pool is used.
+	OS string
+	// Trace context of the provisioning span, taken from the request headers
+	TraceParent string `json:"-"`
+	TraceState  string `json:"-"`
+	// Id of the acquire request, put on the log lines of its provisioning
+	RequestId string `json:"-"`
+	// Canary runs a trivial script instead of the agent, set for the synthetic jobs of the canary
+	Canary bool `json:"-"`
 }
 
 type AgentProvisionResponse struct {
 	Accepted     bool
 	ResponseType string
 	ErrorMessage string
+	Warnings     []string `json:",omitempty"`
+	// Estimated time until the agent is ready and the position in the creation queue, for display
+	QueuePosition        int `json:",omitempty"`
+	EstimatedWaitSeconds int `json:",omitempty"`
+	// Where the agent pod runs, the cluster is empty for the cluster of the provider
+	Namespace string `json:",omitempty"`
+	Cluster   string `json:",omitempty"`
 }
 
 type ReleaseAgentRequest struct {
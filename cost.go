@@ -0,0 +1,112 @@
+package main
+
+import (
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+)
+
+// Agent pod costs are estimated from the resource requests of their containers and the rates in
+// COST_PER_CPU_HOUR and COST_PER_GB_HOUR. When a pod is released its cost is written to the
+// storage under "cost:<month>:<pool>:<pod uid>"; pods still running are added when a pool's
+// month to date cost is computed.
+const (
+	costKeyPrefix = "cost:"
+	costMonth     = "2006-01"
+)
+
+type costRates struct {
+	CpuHour    float64
+	MemoryHour float64
+}
+
+func costRatesFromEnvironment() costRates {
+	return costRates{CpuHour: getEnvFloat("COST_PER_CPU_HOUR"), MemoryHour: getEnvFloat("COST_PER_GB_HOUR")}
+}
+
+func getEnvFloat(name string) float64 {
+	value, _ := strconv.ParseFloat(os.Getenv(name), 64)
+	return value
+}
+
+// Estimates the cost of the pod from its start, or the start of the month, until the given time.
+func podCost(pod *v1.Pod, rates costRates, monthStart time.Time, until time.Time) float64 {
+	start := pod.GetCreationTimestamp().Time
+	if start.Before(monthStart) {
+		start = monthStart
+	}
+	if !until.After(start) {
+		return 0
+	}
+
+	var cpu, memoryGB float64
+	for _, container := range pod.Spec.Containers {
+		cpu += float64(container.Resources.Requests.Cpu().MilliValue()) / 1000
+		memoryGB += float64(container.Resources.Requests.Memory().Value()) / (1 << 30)
+	}
+	return until.Sub(start).Hours() * (cpu*rates.CpuHour + memoryGB*rates.MemoryHour)
+}
+
+func startOfMonth(now time.Time) time.Time {
+	now = now.UTC()
+	return time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+}
+
+func costKey(month string, poolName string) string {
+	return costKeyPrefix + month + ":" + poolName + ":"
+}
+
+// Writes the cost of a released agent pod. Failures are only logged, releasing must not fail.
+func RecordReleasedPodCost(pod *v1.Pod) {
+	poolName := pod.GetLabels()[agentPoolLabel]
+	if poolName == "" {
+		return
+	}
+
+	now := time.Now().UTC()
+	cost := podCost(pod, costRatesFromEnvironment(), startOfMonth(now), now)
+	key := costKey(now.Format(costMonth), poolName) + string(pod.GetUID())
+	if _, err := GetStorage().SetIfAbsent(key, strconv.FormatFloat(cost, 'f', -1, 64)); err != nil {
+		log.Println("Failed to record the cost of pod "+pod.GetName(), err)
+	}
+}
+
+// Returns the estimated cost of the pool in the current month: the released pods plus the given
+// running pods of the pool.
+func monthToDateCost(poolName string, running []v1.Pod, now time.Time) (float64, error) {
+	entries, err := GetStorage().List(costKey(now.UTC().Format(costMonth), poolName))
+	if err != nil {
+		return 0, err
+	}
+
+	total := 0.0
+	for _, value := range entries {
+		cost, _ := strconv.ParseFloat(value, 64)
+		total += cost
+	}
+
+	rates := costRatesFromEnvironment()
+	for i := range running {
+		total += podCost(&running[i], rates, startOfMonth(now), now)
+	}
+	return total, nil
+}
+
+// Removes the cost entries of earlier months.
+func pruneCostEntries(now time.Time) {
+	entries, err := GetStorage().List(costKeyPrefix)
+	if err != nil {
+		return
+	}
+
+	current := costKeyPrefix + now.UTC().Format(costMonth) + ":"
+	for key := range entries {
+		if !strings.HasPrefix(key, current) {
+			GetStorage().Delete(key)
+		}
+	}
+}
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	v1alpha1 "github.com/microsoft/poolprovider-for-k8s/pkg/apis/dev/v1alpha1"
+)
+
+// Pod creations hold a slot of the throttle while they run. The number of slots shrinks when the
+// webserver comes under memory or goroutine pressure and grows back one at a time once the pressure
+// is gone, so a burst of acquire requests is slowed down instead of getting the webserver OOM killed.
+const (
+	defaultMaxConcurrentCreations = 20
+	defaultMaxGoroutines          = 1000
+	memoryPressureRatio           = 0.8
+)
+
+var (
+	throttleSampleInterval = 5 * time.Second
+	throttleWaitTimeout    = 30 * time.Second
+)
+
+var (
+	errCreationTimeout  = errors.New(ServerBusyError)
+	errCreationCanceled = errors.New(AcquireCanceledError)
+)
+
+// Requests waiting for a slot are queued. A freed slot is handed to the waiting request of the pool
+// with the highest QueuePriority, the earliest among equal priorities, while the lock is held, so a
+// slot never goes to a request which gave up in the meantime. Requests leave the queue when they time
+// out, when their caller hangs up or when their agent is released before they got a slot.
+type throttleWaiter struct {
+	id       string
+	priority int
+	result   chan bool
+}
+
+type creationThrottle struct {
+	mu      sync.Mutex
+	limit   int
+	max     int
+	inUse   int
+	waiters []*throttleWaiter
+}
+
+var podCreationThrottle = newCreationThrottle(getEnvInt("MAX_CONCURRENT_CREATIONS", defaultMaxConcurrentCreations))
+
+func newCreationThrottle(max int) *creationThrottle {
+	return &creationThrottle{limit: max, max: max}
+}
+
+// Waits for a free slot and reports whether one was taken before the timeout.
+func (t *creationThrottle) Acquire(timeout time.Duration) bool {
+	return t.AcquireQueued("", 0, timeout, nil) == nil
+}
+
+// Takes a free slot without waiting, unless other requests are already waiting for one.
+func (t *creationThrottle) TryAcquire() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.inUse < t.limit && len(t.waiters) == 0 {
+		t.inUse++
+		return true
+	}
+	return false
+}
+
+// Waits in the queue for a slot until the timeout or until done is closed. The id is the agent
+// the request is for, Cancel takes the request out of the queue by it.
+func (t *creationThrottle) AcquireQueued(id string, priority int, timeout time.Duration, done <-chan struct{}) error {
+	if t.TryAcquire() {
+		return nil
+	}
+
+	t.mu.Lock()
+	waiter := &throttleWaiter{id: id, priority: priority, result: make(chan bool, 1)}
+	t.waiters = append(t.waiters, waiter)
+	t.dispatch()
+	t.mu.Unlock()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case granted := <-waiter.result:
+		if !granted {
+			return errCreationCanceled
+		}
+		return nil
+	case <-timer.C:
+		return t.abandon(waiter, errCreationTimeout)
+	case <-done:
+		return t.abandon(waiter, errCreationCanceled)
+	}
+}
+
+// Takes the request of the agent out of the queue and reports whether it was waiting.
+func (t *creationThrottle) Cancel(id string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, waiter := range t.waiters {
+		if id != "" && waiter.id == id {
+			t.remove(waiter)
+			waiter.result <- false
+			return true
+		}
+	}
+	return false
+}
+
+// Takes a waiter which gave up out of the queue. A slot it was granted meanwhile goes to the next.
+func (t *creationThrottle) abandon(waiter *throttleWaiter, err error) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if !t.remove(waiter) && <-waiter.result {
+		t.inUse--
+		t.dispatch()
+	}
+	return err
+}
+
+// Hands the free slots to the waiting requests, the lock has to be held.
+func (t *creationThrottle) dispatch() {
+	for t.inUse < t.limit && len(t.waiters) > 0 {
+		next := t.waiters[0]
+		for _, waiter := range t.waiters[1:] {
+			if waiter.priority > next.priority {
+				next = waiter
+			}
+		}
+		t.remove(next)
+		t.inUse++
+		next.result <- true
+	}
+}
+
+func (t *creationThrottle) remove(waiter *throttleWaiter) bool {
+	for i := range t.waiters {
+		if t.waiters[i] == waiter {
+			t.waiters = append(t.waiters[:i], t.waiters[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the number of requests waiting for a slot and the current limit.
+func (t *creationThrottle) QueueState() (int, int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return len(t.waiters), t.limit
+}
+
+func (t *creationThrottle) Release() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.inUse > 0 {
+		t.inUse--
+	}
+	t.dispatch()
+}
+
+func (t *creationThrottle) adjust(underPressure bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	limit := nextCreationLimit(t.limit, t.max, underPressure)
+	if limit != t.limit {
+		log.Println("Changing pod creation concurrency from", t.limit, "to", limit)
+		t.limit = limit
+		t.dispatch()
+	}
+	creationConcurrencyLimit.Set(float64(t.limit))
+}
+
+// Halves the limit under pressure and otherwise recovers by one, staying between 1 and max.
+func nextCreationLimit(current int, max int, underPressure bool) int {
+	if underPressure {
+		current = current / 2
+	} else {
+		current++
+	}
+
+	if current < 1 {
+		return 1
+	} else if current > max {
+		return max
+	}
+	return current
+}
+
+// Takes a slot for the acquire request, queueing it with the priority of its pool when none is free.
+// Returns the queue position and limit the request found, for the estimate of its wait.
+func acquireCreationSlot(req *http.Request, agentRequest AgentRequest) (int, int, error) {
+	position, limit := podCreationThrottle.QueueState()
+	if podCreationThrottle.TryAcquire() {
+		return position, limit, nil
+	}
+	priority := queuePriority(agentRequest, podnamespace)
+	return position, limit, podCreationThrottle.AcquireQueued(agentRequest.AgentId, priority, throttleWaitTimeout, req.Context().Done())
+}
+
+// Returns the queue priority of the pool of the request, 0 when the pool is not known.
+func queuePriority(agentRequest AgentRequest, namespace string) int {
+	crdobject, _, err := fetchAzurePipelinesPool(namespace)
+	if err != nil {
+		return 0
+	}
+	pool := v1alpha1.FetchAgentPool(crdobject, ResolveAgentPoolName(crdobject, agentRequest))
+	if pool == nil {
+		return 0
+	}
+	return int(pool.QueuePriority)
+}
+
+func isUnderPressure(heapBytes uint64, memoryLimit uint64, goroutines int, maxGoroutines int) bool {
+	if memoryLimit > 0 && float64(heapBytes) >= float64(memoryLimit)*memoryPressureRatio {
+		return true
+	}
+	return goroutines >= maxGoroutines
+}
+
+// Samples the memory and goroutines of the webserver and adjusts the creation throttle.
+func RunPressureMonitor() {
+	memoryLimit := getMemoryLimit()
+	maxGoroutines := getEnvInt("MAX_GOROUTINES", defaultMaxGoroutines)
+
+	for {
+		var stats runtime.MemStats
+		runtime.ReadMemStats(&stats)
+		podCreationThrottle.adjust(isUnderPressure(stats.HeapAlloc, memoryLimit, runtime.NumGoroutine(), maxGoroutines))
+		time.Sleep(throttleSampleInterval)
+	}
+}
+
+// Uses MEMORY_LIMIT_BYTES when set, otherwise the memory limit of the container's cgroup.
+func getMemoryLimit() uint64 {
+	if limit, err := strconv.ParseUint(os.Getenv("MEMORY_LIMIT_BYTES"), 10, 64); err == nil {
+		return limit
+	}
+
+	for _, path := range []string{"/sys/fs/cgroup/memory.max", "/sys/fs/cgroup/memory/memory.limit_in_bytes"} {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			continue
+		}
+		// Unlimited cgroups report "max" or a huge number
+		if limit, err := strconv.ParseUint(strings.TrimSpace(string(data)), 10, 64); err == nil && limit < 1<<62 {
+			return limit
+		}
+	}
+	return 0
+}
+
+func getEnvInt(name string, defaultValue int) int {
+	if value, err := strconv.Atoi(os.Getenv(name)); err == nil && value > 0 {
+		return value
+	}
+	return defaultValue
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestNextCreationLimitShouldBackOffAndRecover(t *testing.T) {
+	if limit := nextCreationLimit(20, 20, true); limit != 10 {
+		t.Errorf("Expected limit to be halved. Got %d", limit)
+	}
+	if limit := nextCreationLimit(1, 20, true); limit != 1 {
+		t.Errorf("Limit must not drop below 1. Got %d", limit)
+	}
+	if limit := nextCreationLimit(10, 20, false); limit != 11 {
+		t.Errorf("Expected limit to recover by one. Got %d", limit)
+	}
+	if limit := nextCreationLimit(20, 20, false); limit != 20 {
+		t.Errorf("Limit must not exceed the maximum. Got %d", limit)
+	}
+}
+
+func TestIsUnderPressure(t *testing.T) {
+	if !isUnderPressure(90, 100, 10, 1000) {
+		t.Errorf("Heap above 80 percent of the limit must be pressure")
+	}
+	if isUnderPressure(90, 0, 10, 1000) {
+		t.Errorf("Memory must be ignored without a limit")
+	}
+	if !isUnderPressure(10, 100, 1000, 1000) {
+		t.Errorf("Too many goroutines must be pressure")
+	}
+}
+
+func TestCreationThrottleShouldRejectWhenFull(t *testing.T) {
+	throttle := newCreationThrottle(1)
+	if !throttle.Acquire(0) {
+		t.Fatalf("Expected a free slot")
+	}
+	if throttle.Acquire(0) {
+		t.Errorf("Expected the throttle to be full")
+	}
+	throttle.Release()
+	if !throttle.Acquire(0) {
+		t.Errorf("Expected the released slot to be free again")
+	}
+}
+
+func TestCreationThrottleShouldDispatchHighestPriorityFirst(t *testing.T) {
+	throttle := newCreationThrottle(1)
+	throttle.Acquire(0)
+
+	granted := make(chan string, 2)
+	for i, waiter := range []struct {
+		id       string
+		priority int
+	}{{"low", 0}, {"high", 10}} {
+		go func(id string, priority int) {
+			if throttle.AcquireQueued(id, priority, time.Minute, nil) == nil {
+				granted <- id
+			}
+		}(waiter.id, waiter.priority)
+		waitForQueue(t, throttle, i+1)
+	}
+
+	throttle.Release()
+	if id := <-granted; id != "high" {
+		t.Errorf("Expected the request with the higher priority to get the slot. Got %s", id)
+	}
+	throttle.Release()
+	if id := <-granted; id != "low" {
+		t.Errorf("Expected the remaining request to get the next slot. Got %s", id)
+	}
+}
+
+func TestCreationThrottleShouldPromoteNextWhenQueuedRequestIsCanceled(t *testing.T) {
+	throttle := newCreationThrottle(1)
+	throttle.Acquire(0)
+
+	results := make(chan error, 1)
+	go func() { results <- throttle.AcquireQueued("released", 0, time.Minute, nil) }()
+	waitForQueue(t, throttle, 1)
+	done := make(chan struct{})
+	hungUp := make(chan error, 1)
+	go func() { hungUp <- throttle.AcquireQueued("hung-up", 0, time.Minute, done) }()
+	waitForQueue(t, throttle, 2)
+
+	if !throttle.Cancel("released") {
+		t.Fatalf("Expected the queued request to be canceled")
+	}
+	if err := <-results; err != errCreationCanceled {
+		t.Errorf("Expected the canceled request to be answered. Got %v", err)
+	}
+	close(done)
+	if err := <-hungUp; err != errCreationCanceled {
+		t.Errorf("Expected the request whose caller hung up to leave the queue. Got %v", err)
+	}
+
+	throttle.Release()
+	if !throttle.TryAcquire() {
+		t.Errorf("Expected the slot to be free for new requests")
+	}
+}
+
+func waitForQueue(t *testing.T, throttle *creationThrottle, waiting int) {
+	for i := 0; i < 100; i++ {
+		if queued, _ := throttle.QueueState(); queued == waiting {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("Expected %d requests in the queue", waiting)
+}
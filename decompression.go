@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"errors"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Azure DevOps and some proxies in between compress the callback bodies. Bodies with a
+// Content-Encoding listed in REQUEST_ENCODINGS, "gzip,deflate" by default, are decompressed before
+// the handlers read them, so the signature is checked against the JSON payload. Other encodings are
+// rejected with 415. The decompressed body may be at most MAX_REQUEST_BODY_BYTES, 1 MiB by default,
+// which keeps small payloads inflating to gigabytes from exhausting the memory of the webserver.
+// The same limit applies to the bodies of all requests as they arrive, on every endpoint but the
+// ones which take larger bodies and have a limit of their own, like the snapshot restore.
+const (
+	contentEncodingHeader = "Content-Encoding"
+	encodingGzip          = "gzip"
+	encodingDeflate       = "deflate"
+	encodingIdentity      = "identity"
+	defaultMaxRequestBody = 1 << 20
+)
+
+type requestDecompressor struct {
+	encodings map[string]bool
+	maxBytes  int64
+}
+
+var requestDecompression = newRequestDecompressorFromEnvironment()
+
+func newRequestDecompressorFromEnvironment() *requestDecompressor {
+	encodings, ok := os.LookupEnv("REQUEST_ENCODINGS")
+	if !ok {
+		encodings = encodingGzip + "," + encodingDeflate
+	}
+	return newRequestDecompressor(encodings, int64(getEnvInt("MAX_REQUEST_BODY_BYTES", defaultMaxRequestBody)))
+}
+
+func newRequestDecompressor(encodings string, maxBytes int64) *requestDecompressor {
+	accepted := map[string]bool{}
+	for _, encoding := range strings.Split(encodings, ",") {
+		if encoding = strings.ToLower(strings.TrimSpace(encoding)); encoding != "" {
+			accepted[encoding] = true
+		}
+	}
+	return &requestDecompressor{encodings: accepted, maxBytes: maxBytes}
+}
+
+// Wraps a handler so it gets the decompressed body of the request, without the Content-Encoding.
+func withDecompression(decompressor *requestDecompressor, handler http.HandlerFunc) http.HandlerFunc {
+	return func(resp http.ResponseWriter, req *http.Request) {
+		encoding := strings.ToLower(strings.TrimSpace(req.Header.Get(contentEncodingHeader)))
+		if encoding == "" || encoding == encodingIdentity || req.Body == nil {
+			handler(resp, req)
+			return
+		}
+		if !decompressor.encodings[encoding] {
+			log.Println("Rejecting request with unsupported Content-Encoding " + encoding)
+			writeJsonResponse(resp, http.StatusUnsupportedMediaType, GetError(UnsupportedEncodingError))
+			return
+		}
+
+		body, err := decompressor.decompress(encoding, req.Body)
+		req.Body.Close()
+		if errors.Is(err, errRequestTooLarge) {
+			log.Println("Rejecting request whose body exceeds " + strconv.FormatInt(decompressor.maxBytes, 10) + " bytes decompressed")
+			writeJsonResponse(resp, http.StatusRequestEntityTooLarge, GetError(RequestTooLargeError))
+			return
+		}
+		if err != nil {
+			log.Println("Failed to decompress "+encoding+" request body", err)
+			writeJsonResponse(resp, http.StatusBadRequest, GetError(InvalidRequestBodyError))
+			return
+		}
+
+		req.Body = ioutil.NopCloser(bytes.NewReader(body))
+		req.ContentLength = int64(len(body))
+		req.Header.Del(contentEncodingHeader)
+		handler(resp, req)
+	}
+}
+
+var errRequestTooLarge = errors.New(RequestTooLargeError)
+
+func (d *requestDecompressor) decompress(encoding string, body io.Reader) ([]byte, error) {
+	var reader io.ReadCloser
+	var err error
+	switch encoding {
+	case encodingGzip:
+		reader, err = gzip.NewReader(body)
+	case encodingDeflate:
+		reader, err = zlib.NewReader(body)
+	default:
+		return nil, errors.New("unsupported encoding " + encoding)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	// One byte more than allowed tells a body of exactly the limit from a longer one
+	data, err := ioutil.ReadAll(io.LimitReader(reader, d.maxBytes+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) > d.maxBytes {
+		return nil, errRequestTooLarge
+	}
+	return data, nil
+}
+
+// Caps the body of every request, compressed or not, at maxBytes, or at the limit of its path in
+// routeLimits. Requests announcing a longer body are rejected before it is read; other bodies are
+// read up to the limit through http.MaxBytesReader, so the handlers, which read the whole body,
+// never get more than that.
+func withBodyLimit(defaultMaxBytes int64, routeLimits map[string]int64, handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		maxBytes := defaultMaxBytes
+		if limit, ok := routeLimits[req.URL.Path]; ok {
+			maxBytes = limit
+		}
+		if req.Body == nil || req.Body == http.NoBody || maxBytes <= 0 {
+			handler.ServeHTTP(resp, req)
+			return
+		}
+		if req.ContentLength > maxBytes {
+			log.Println("Rejecting request to " + req.URL.Path + " whose body of " + strconv.FormatInt(req.ContentLength, 10) + " bytes exceeds " + strconv.FormatInt(maxBytes, 10))
+			writeJsonResponse(resp, http.StatusRequestEntityTooLarge, GetError(RequestTooLargeError))
+			return
+		}
+
+		body, err := ioutil.ReadAll(http.MaxBytesReader(resp, req.Body, maxBytes))
+		req.Body.Close()
+		// The reader only fails with a full body when the client sent more
+		if err != nil && int64(len(body)) == maxBytes {
+			log.Println("Rejecting request to " + req.URL.Path + " whose body exceeds " + strconv.FormatInt(maxBytes, 10) + " bytes")
+			writeJsonResponse(resp, http.StatusRequestEntityTooLarge, GetError(RequestTooLargeError))
+			return
+		}
+		if err != nil {
+			log.Println("Failed to read the body of the request to "+req.URL.Path, err)
+			writeJsonResponse(resp, http.StatusBadRequest, GetError(InvalidRequestBodyError))
+			return
+		}
+		req.Body = ioutil.NopCloser(bytes.NewReader(body))
+		handler.ServeHTTP(resp, req)
+	})
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func compressedRequest(encoding string, body string) *http.Request {
+	var buffer bytes.Buffer
+	if encoding == encodingGzip {
+		writer := gzip.NewWriter(&buffer)
+		writer.Write([]byte(body))
+		writer.Close()
+	} else {
+		writer := zlib.NewWriter(&buffer)
+		writer.Write([]byte(body))
+		writer.Close()
+	}
+	req, _ := http.NewRequest("POST", "/acquire", &buffer)
+	req.Header.Set(contentEncodingHeader, encoding)
+	return req
+}
+
+func echoBodyHandler(resp http.ResponseWriter, req *http.Request) {
+	body, _ := ioutil.ReadAll(req.Body)
+	resp.Header().Set("X-Encoding", req.Header.Get(contentEncodingHeader))
+	resp.Write(body)
+}
+
+func TestDecompressionShouldInflateAcceptedEncodings(t *testing.T) {
+	handler := withDecompression(newRequestDecompressor("gzip,deflate", 1024), echoBodyHandler)
+
+	for _, encoding := range []string{encodingGzip, encodingDeflate} {
+		resp := httptest.NewRecorder()
+		handler(resp, compressedRequest(encoding, `{"AgentId":"1"}`))
+
+		if resp.Code != http.StatusOK || resp.Body.String() != `{"AgentId":"1"}` {
+			t.Errorf("Expected the %s body to be decompressed. Got %d %s", encoding, resp.Code, resp.Body.String())
+		}
+		if resp.Header().Get("X-Encoding") != "" {
+			t.Errorf("Expected the Content-Encoding to be removed. Got %s", resp.Header().Get("X-Encoding"))
+		}
+	}
+}
+
+func TestDecompressionShouldPassUncompressedBodies(t *testing.T) {
+	handler := withDecompression(newRequestDecompressor("", 4), echoBodyHandler)
+	req, _ := http.NewRequest("POST", "/acquire", strings.NewReader(`{"AgentId":"1"}`))
+	resp := httptest.NewRecorder()
+
+	handler(resp, req)
+
+	if resp.Code != http.StatusOK || resp.Body.String() != `{"AgentId":"1"}` {
+		t.Errorf("Expected the body to be passed on. Got %d %s", resp.Code, resp.Body.String())
+	}
+}
+
+func TestDecompressionShouldRejectEncodingsNotAccepted(t *testing.T) {
+	handler := withDecompression(newRequestDecompressor("gzip", 1024), echoBodyHandler)
+	resp := httptest.NewRecorder()
+
+	handler(resp, compressedRequest(encodingDeflate, `{"AgentId":"1"}`))
+
+	if resp.Code != http.StatusUnsupportedMediaType {
+		t.Errorf("Expected 415 for deflate. Got %d", resp.Code)
+	}
+}
+
+func TestDecompressionShouldRejectBodiesOverTheLimit(t *testing.T) {
+	handler := withDecompression(newRequestDecompressor("gzip", 16), echoBodyHandler)
+
+	resp := httptest.NewRecorder()
+	handler(resp, compressedRequest(encodingGzip, strings.Repeat("a", 17)))
+	if resp.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("Expected 413 over the limit. Got %d", resp.Code)
+	}
+
+	resp = httptest.NewRecorder()
+	handler(resp, compressedRequest(encodingGzip, strings.Repeat("a", 16)))
+	if resp.Code != http.StatusOK {
+		t.Errorf("Expected a body of exactly the limit to pass. Got %d", resp.Code)
+	}
+}
+
+func TestDecompressionShouldRejectCorruptBodies(t *testing.T) {
+	handler := withDecompression(newRequestDecompressor("gzip", 1024), echoBodyHandler)
+	req, _ := http.NewRequest("POST", "/acquire", strings.NewReader("not gzip"))
+	req.Header.Set(contentEncodingHeader, encodingGzip)
+	resp := httptest.NewRecorder()
+
+	handler(resp, req)
+
+	if resp.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for a corrupt body. Got %d", resp.Code)
+	}
+}
+
+func TestBodyLimitShouldRejectBodiesOverTheLimit(t *testing.T) {
+	var received string
+	handler := withBodyLimit(8, nil, http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		body, _ := ioutil.ReadAll(req.Body)
+		received = string(body)
+	}))
+
+	resp := httptest.NewRecorder()
+	handler.ServeHTTP(resp, httptest.NewRequest("POST", "/payload", strings.NewReader("12345678")))
+	if resp.Code != http.StatusOK || received != "12345678" {
+		t.Errorf("Expected a body of exactly the limit passed on. Got %d %q", resp.Code, received)
+	}
+
+	resp = httptest.NewRecorder()
+	handler.ServeHTTP(resp, httptest.NewRequest("POST", "/payload", strings.NewReader("123456789")))
+	if resp.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("Expected 413 for a body over the limit. Got %d", resp.Code)
+	}
+
+	// Without a Content-Length the body is only found too large while it is read
+	req := httptest.NewRequest("POST", "/acquire", ioutil.NopCloser(strings.NewReader("123456789")))
+	req.ContentLength = -1
+	resp = httptest.NewRecorder()
+	handler.ServeHTTP(resp, req)
+	if resp.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("Expected 413 for a streamed body over the limit. Got %d", resp.Code)
+	}
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/microsoft/poolprovider-for-k8s/pkg/storage"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// Azure DevOps retries an acquire callback when it does not get an answer in time, and with several
+// webserver replicas the retry can land on a different pod. The first replica to claim the request
+// creates the agent; the others wait for its result and return the same response. Retries which get
+// past the claim, because the storage failed or the claim was dropped, find the agent pod on the
+// API server: agent pods are named after the agent id, so the API server refuses a second one, and
+// an agent which has a pod already is answered with success without creating another. Only
+// accepted responses are kept; a failed request drops its claim so that the retry is handled anew,
+// and a claim left without response by a replica which crashed is taken over once it is stale.
+const (
+	dedupeKeyPrefix   = "dedupe:"
+	agentPodPrefix    = "azure-pipelines-agent-"
+	maxAgentPodLength = 63
+)
+
+var agentPodNameFormat = regexp.MustCompile(`^[a-z0-9]([-a-z0-9]*[a-z0-9])?$`)
+
+var (
+	dedupeWaitTimeout  = 30 * time.Second
+	dedupePollInterval = time.Second
+	dedupeStaleClaim   = 5 * time.Minute
+)
+
+type DedupeRecord struct {
+	Owner     string
+	Response  *AgentProvisionResponse `json:",omitempty"`
+	ClaimedAt time.Time
+}
+
+// Claims the acquire request of the given agent for this replica. If another replica already
+// claimed it, waits for the canonical response and returns it along with duplicate set to true.
+// The response is nil when the other replica did not finish in time. A claim dropped while waiting,
+// because the other replica failed the request, is claimed again, and a stale one is swapped for
+// this replica's claim, so that only one of the waiting replicas takes it over.
+func ClaimAcquireRequest(agentId string) (response *AgentProvisionResponse, duplicate bool) {
+	store := GetStorage()
+	hostname, _ := os.Hostname()
+	data, _ := json.Marshal(DedupeRecord{Owner: hostname, ClaimedAt: time.Now().UTC()})
+
+	claimed, err := store.SetIfAbsent(dedupeKeyPrefix+agentId, string(data))
+	if err != nil {
+		// Without the storage there is nothing to dedupe against, handle the request here
+		log.Println("Failed to claim acquire request for agent "+agentId, err)
+		return nil, false
+	}
+	if claimed {
+		return nil, false
+	}
+
+	log.Println("Acquire request for agent " + agentId + " is already handled, waiting for its result")
+	deadline := time.Now().Add(dedupeWaitTimeout)
+	for {
+		value, err := store.Get(dedupeKeyPrefix + agentId)
+		if errors.Is(err, storage.ErrNotFound) {
+			if claimed, err := store.SetIfAbsent(dedupeKeyPrefix+agentId, string(data)); err != nil || claimed {
+				return nil, false
+			}
+			continue
+		} else if err != nil {
+			log.Println("Failed to read acquire result for agent "+agentId, err)
+			return nil, true
+		}
+
+		var record DedupeRecord
+		if json.Unmarshal([]byte(value), &record) == nil && record.Response != nil {
+			return record.Response, true
+		}
+		if record.Response == nil && time.Since(record.ClaimedAt) > dedupeStaleClaim {
+			swapped, err := store.CompareAndSwap(dedupeKeyPrefix+agentId, value, string(data))
+			if err != nil {
+				log.Println("Failed to claim acquire request for agent "+agentId, err)
+				return nil, false
+			}
+			if swapped {
+				log.Println("Took over the stale claim of " + record.Owner + " on the acquire request for agent " + agentId)
+				return nil, false
+			}
+			continue
+		}
+
+		if time.Now().After(deadline) {
+			return nil, true
+		}
+		time.Sleep(dedupePollInterval)
+	}
+}
+
+// Stores the response of a claimed acquire request so that duplicates can return it. A failed
+// response is not replayed to the retries, the claim is dropped instead.
+func StoreAcquireResult(agentId string, response AgentProvisionResponse) {
+	if !response.Accepted {
+		ForgetAcquireRequest(agentId)
+		return
+	}
+	hostname, _ := os.Hostname()
+	data, _ := json.Marshal(DedupeRecord{Owner: hostname, Response: &response, ClaimedAt: time.Now().UTC()})
+	if err := GetStorage().Set(dedupeKeyPrefix+agentId, string(data)); err != nil {
+		log.Println("Failed to store acquire result for agent "+agentId, err)
+	}
+}
+
+// Drops the dedupe record once the agent is released.
+func ForgetAcquireRequest(agentId string) {
+	if err := GetStorage().Delete(dedupeKeyPrefix + agentId); err != nil {
+		log.Println("Failed to remove dedupe record for agent "+agentId, err)
+	}
+}
+
+// Returns the name of the agent pod of the agent, or an empty string when the agent id cannot be
+// part of a name and the pod name is generated.
+func agentPodName(agentId string) string {
+	name := agentPodPrefix + strings.ToLower(agentId)
+	if len(name) > maxAgentPodLength || !agentPodNameFormat.MatchString(name) {
+		return ""
+	}
+	return name
+}
+
+// Returns the pod of the agent in the namespace, or nil when it has none.
+func findAgentPod(cs *k8s, agentId string, namespace string) *v1.Pod {
+	pods, err := cs.clientset.CoreV1().Pods(namespace).List(metav1.ListOptions{LabelSelector: agentIdLabel + "=" + agentId})
+	if err != nil || pods == nil || len(pods.Items) == 0 {
+		return nil
+	}
+	return &pods.Items[0]
+}
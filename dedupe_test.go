@@ -0,0 +1,149 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestClaimAcquireRequestShouldReturnCanonicalResult(t *testing.T) {
+	SetupCustomResource()
+
+	if _, duplicate := ClaimAcquireRequest("1"); duplicate {
+		t.Fatalf("First claim must not be a duplicate")
+	}
+
+	StoreAcquireResult("1", AgentProvisionResponse{Accepted: true, ResponseType: "Success"})
+
+	response, duplicate := ClaimAcquireRequest("1")
+	if !duplicate || response == nil || !response.Accepted {
+		t.Errorf("Expected the stored response for the duplicate. Got %v %v", response, duplicate)
+	}
+}
+
+func TestClaimAcquireRequestShouldGiveUpWhenOwnerDoesNotFinish(t *testing.T) {
+	SetupCustomResource()
+	dedupeWaitTimeout, dedupePollInterval = 0, 0
+	defer func() { dedupeWaitTimeout, dedupePollInterval = 30*time.Second, time.Second }()
+
+	ClaimAcquireRequest("1")
+	response, duplicate := ClaimAcquireRequest("1")
+	if !duplicate || response != nil {
+		t.Errorf("Expected a duplicate without response. Got %v %v", response, duplicate)
+	}
+
+	ForgetAcquireRequest("1")
+	if _, duplicate := ClaimAcquireRequest("1"); duplicate {
+		t.Errorf("Request must be claimable again after the agent is released")
+	}
+}
+
+func TestAgentPodNameShouldDeriveFromTheAgentId(t *testing.T) {
+	if name := agentPodName("1234"); name != "azure-pipelines-agent-1234" {
+		t.Errorf("Expected the agent id in the pod name. Got %s", name)
+	}
+	if name := agentPodName("Agent_1"); name != "" {
+		t.Errorf("Expected a generated name for ids which are no valid name. Got %s", name)
+	}
+	if name := agentPodName(strings.Repeat("1", 50)); name != "" {
+		t.Errorf("Expected a generated name for long ids. Got %s", name)
+	}
+}
+
+func TestCreatePodShouldNotDuplicateTheAgentPod(t *testing.T) {
+	var agentrequest AgentRequest
+	agentrequest.AgentId = "1"
+	SetupCustomResource()
+
+	if response := CreatePod(agentrequest, testnamespace); !response.Accepted {
+		t.Fatalf("Pod creation failed")
+	}
+	if response := CreatePod(agentrequest, testnamespace); !response.Accepted {
+		t.Errorf("Expected the retry to be accepted")
+	}
+
+	cs := CreateClientSet()
+	secrets, _ := cs.clientset.CoreV1().Secrets(testnamespace).List(metav1.ListOptions{LabelSelector: agentIdLabel + "=" + agentrequest.AgentId})
+	if secrets == nil || len(secrets.Items) != 1 {
+		t.Errorf("Expected one agent secret")
+	}
+}
+
+func TestStoreAcquireResultShouldDropTheClaimOfAFailedRequest(t *testing.T) {
+	os.Setenv("STORAGE_BACKEND", "memory")
+	defer os.Unsetenv("STORAGE_BACKEND")
+	defer ForgetAcquireRequest("3")
+
+	ClaimAcquireRequest("3")
+	StoreAcquireResult("3", AgentProvisionResponse{ResponseType: "fail", ErrorMessage: KillSwitchReasonError})
+	if _, duplicate := ClaimAcquireRequest("3"); duplicate {
+		t.Errorf("Expected the retry of a failed request handled anew")
+	}
+}
+
+func TestClaimAcquireRequestShouldTakeOverAStaleClaim(t *testing.T) {
+	os.Setenv("STORAGE_BACKEND", "memory")
+	defer os.Unsetenv("STORAGE_BACKEND")
+	defer ForgetAcquireRequest("4")
+
+	data, _ := json.Marshal(DedupeRecord{Owner: "webserver-crashed", ClaimedAt: time.Now().UTC().Add(-dedupeStaleClaim - time.Minute)})
+	GetStorage().Set(dedupeKeyPrefix+"4", string(data))
+	if response, duplicate := ClaimAcquireRequest("4"); duplicate || response != nil {
+		t.Errorf("Expected the stale claim taken over. Got %v %v", response, duplicate)
+	}
+	value, _ := GetStorage().Get(dedupeKeyPrefix + "4")
+	var record DedupeRecord
+	if json.Unmarshal([]byte(value), &record); record.Owner == "webserver-crashed" {
+		t.Errorf("Expected the claim owned by this replica. Got %+v", record)
+	}
+}
+
+func TestClaimAcquireRequestShouldLetOneReplicaTakeOverAStaleClaim(t *testing.T) {
+	os.Setenv("STORAGE_BACKEND", "memory")
+	defer os.Unsetenv("STORAGE_BACKEND")
+	defer ForgetAcquireRequest("5")
+	dedupeWaitTimeout, dedupePollInterval = 0, 0
+	defer func() { dedupeWaitTimeout, dedupePollInterval = 30*time.Second, time.Second }()
+
+	data, _ := json.Marshal(DedupeRecord{Owner: "webserver-crashed", ClaimedAt: time.Now().UTC().Add(-dedupeStaleClaim - time.Minute)})
+	GetStorage().Set(dedupeKeyPrefix+"5", string(data))
+
+	var handled int32
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, duplicate := ClaimAcquireRequest("5"); !duplicate {
+				atomic.AddInt32(&handled, 1)
+			}
+		}()
+	}
+	wg.Wait()
+	if handled != 1 {
+		t.Errorf("Expected exactly one replica to take over the stale claim. Got %d", handled)
+	}
+}
+
+func TestClaimAcquireRequestShouldClaimARequestForgottenWhileWaiting(t *testing.T) {
+	os.Setenv("STORAGE_BACKEND", "memory")
+	defer os.Unsetenv("STORAGE_BACKEND")
+	defer ForgetAcquireRequest("6")
+	dedupePollInterval = 10 * time.Millisecond
+	defer func() { dedupePollInterval = time.Second }()
+
+	ClaimAcquireRequest("6")
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		StoreAcquireResult("6", AgentProvisionResponse{ResponseType: "fail", ErrorMessage: KillSwitchReasonError})
+	}()
+	if response, duplicate := ClaimAcquireRequest("6"); duplicate || response != nil {
+		t.Errorf("Expected the retry to claim the request the owner failed. Got %v %v", response, duplicate)
+	}
+}
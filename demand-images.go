@@ -0,0 +1,15 @@
+package main
+
+import (
+	"log"
+
+	v1 "k8s.io/api/core/v1"
+)
+
+// Replaces the image of the agent container, which is the first container of the pod.
+func applyDemandImage(pod *v1.Pod, image string) {
+	if pod != nil && image != "" && len(pod.Spec.Containers) > 0 {
+		log.Println("Using image " + image + " for the job demands")
+		pod.Spec.Containers[0].Image = image
+	}
+}
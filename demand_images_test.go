@@ -0,0 +1,73 @@
+package main
+
+import (
+	"testing"
+
+	v1alpha1 "github.com/microsoft/poolprovider-for-k8s/pkg/apis/dev/v1alpha1"
+)
+
+func TestResolveDemandImageShouldPickHighestPriority(t *testing.T) {
+	pool := &v1alpha1.AgentPoolSpec{
+		ImageRules: []v1alpha1.ImageRule{
+			{Demands: []string{"node=18"}, Image: "agent-node18"},
+			{Demands: []string{"jdk=17"}, Image: "agent-jdk17"},
+			{Demands: []string{"node=18", "jdk=17"}, Image: "agent-full", Priority: 10},
+		},
+	}
+
+	if image := v1alpha1.ResolveDemandImage(pool, []string{"node -equals 18"}); image != "agent-node18" {
+		t.Errorf("Expected agent-node18. Got %s", image)
+	}
+	if image := v1alpha1.ResolveDemandImage(pool, []string{"node=18", "JDK=17", "docker"}); image != "agent-full" {
+		t.Errorf("Expected agent-full. Got %s", image)
+	}
+	if image := v1alpha1.ResolveDemandImage(pool, []string{"node=16"}); image != "" {
+		t.Errorf("Expected no image. Got %s", image)
+	}
+}
+
+func TestResolveDemandImageShouldMatchBareDemandsOnName(t *testing.T) {
+	pool := &v1alpha1.AgentPoolSpec{ImageRules: []v1alpha1.ImageRule{{Demands: []string{"docker"}, Image: "agent-docker"}}}
+
+	if image := v1alpha1.ResolveDemandImage(pool, []string{"docker -equals 19.03"}); image != "agent-docker" {
+		t.Errorf("Expected agent-docker. Got %s", image)
+	}
+}
+
+func TestUnmatchedDemandsShouldListDemandsThePoolDoesNotOffer(t *testing.T) {
+	pool := &v1alpha1.AgentPoolSpec{
+		Capabilities: []string{"docker"},
+		ImageRules:   []v1alpha1.ImageRule{{Demands: []string{"node=18"}, Image: "agent-node18"}},
+	}
+
+	unmatched := v1alpha1.UnmatchedDemands(pool, []string{"docker -equals 19.03", "node=18", "node=16", "jdk", "Agent.Version -gtVersion 2.163.1", "poolprovider.diagnostics"})
+	if len(unmatched) != 2 || unmatched[0] != "node=16" || unmatched[1] != "jdk" {
+		t.Errorf("Expected node=16 and jdk. Got %v", unmatched)
+	}
+}
+
+func TestUnmatchedDemandsShouldAcceptEverythingWithoutDeclaredCapabilities(t *testing.T) {
+	if unmatched := v1alpha1.UnmatchedDemands(&v1alpha1.AgentPoolSpec{}, []string{"jdk"}); unmatched != nil {
+		t.Errorf("Expected no unmatched demands. Got %v", unmatched)
+	}
+}
+
+func TestDiagnosticsModeShouldPreferTheDemandOverThePool(t *testing.T) {
+	pool := &v1alpha1.AgentPoolSpec{Diagnostics: true}
+
+	if mode := v1alpha1.DiagnosticsMode(pool, nil); mode != v1alpha1.DiagnosticsOnce {
+		t.Errorf("Expected the pool to run every job once. Got %q", mode)
+	}
+	if mode := v1alpha1.DiagnosticsMode(pool, []string{"poolprovider.diagnostics -equals continuous"}); mode != v1alpha1.DiagnosticsContinuous {
+		t.Errorf("Expected the demand to keep the agent listening. Got %q", mode)
+	}
+	if mode := v1alpha1.DiagnosticsMode(pool, []string{"poolprovider.diagnostics=false"}); mode != "" {
+		t.Errorf("Expected the demand to turn diagnostics off. Got %q", mode)
+	}
+	if mode := v1alpha1.DiagnosticsMode(&v1alpha1.AgentPoolSpec{}, []string{"Poolprovider.Diagnostics"}); mode != v1alpha1.DiagnosticsOnce {
+		t.Errorf("Expected a bare demand to run the job once. Got %q", mode)
+	}
+	if mode := v1alpha1.DiagnosticsMode(&v1alpha1.AgentPoolSpec{}, []string{"docker"}); mode != "" {
+		t.Errorf("Expected no diagnostics. Got %q", mode)
+	}
+}
@@ -0,0 +1,322 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ghodss/yaml"
+	v1alpha1 "github.com/microsoft/poolprovider-for-k8s/pkg/apis/dev/v1alpha1"
+)
+
+// DEV_MODE=true runs the webserver for template development on a workstation. It uses the fake
+// Kubernetes client unless DEBUG_LOCAL points it at the cluster of the kubeconfig, and watches
+// DEV_TEMPLATE_DIR for agent pool templates, written like an entry of the agentPools list of the
+// custom resource, one per .yaml, .yml or .json file. Whenever a file changes the agent pod it
+// renders for DEV_DEMANDS is printed as a diff against the previous rendering, colored unless
+// NO_COLOR is set. GET /dev/templates lists the loaded templates and GET /dev/rendered?pool=<pool>
+// returns the rendered and validated agent pod. The /dev endpoints are only served in dev mode and
+// are not signed.
+const (
+	defaultDevTemplateDir = "dev-templates"
+	devDiffContext        = 3
+	ansiRed               = "\x1b[31m"
+	ansiGreen             = "\x1b[32m"
+	ansiCyan              = "\x1b[36m"
+	ansiReset             = "\x1b[0m"
+)
+
+var devReloadInterval = time.Second
+
+type DevTemplate struct {
+	Pool   string
+	File   string
+	Valid  bool
+	Errors []string `json:",omitempty"`
+}
+
+type devTemplate struct {
+	file     string
+	checksum [sha256.Size]byte
+	pool     v1alpha1.AgentPoolSpec
+	rendered TemplateTestResponse
+	manifest string
+	err      error
+}
+
+var devTemplates = struct {
+	sync.Mutex
+	templates map[string]*devTemplate
+}{templates: map[string]*devTemplate{}}
+
+var devOutput io.Writer = os.Stderr
+
+func isDevMode() bool {
+	return os.Getenv("DEV_MODE") == "true"
+}
+
+// Switches the Kubernetes clients to the fake ones, unless the cluster of the kubeconfig is used.
+func configureDevMode() {
+	if os.Getenv("DEBUG_LOCAL") == "" {
+		os.Setenv("IS_TESTENVIRONMENT", "true")
+	}
+	log.Println("Running in dev mode, watching the templates in " + devTemplateDir())
+}
+
+func devTemplateDir() string {
+	if dir := os.Getenv("DEV_TEMPLATE_DIR"); dir != "" {
+		return dir
+	}
+	return defaultDevTemplateDir
+}
+
+func devDemands() []string {
+	demands := []string{}
+	for _, demand := range strings.Split(os.Getenv("DEV_DEMANDS"), ",") {
+		if demand = strings.TrimSpace(demand); demand != "" {
+			demands = append(demands, demand)
+		}
+	}
+	return demands
+}
+
+func RunDevTemplateWatcher() {
+	for {
+		reloadDevTemplates(devTemplateDir(), devDemands(), devOutput, os.Getenv("NO_COLOR") == "")
+		time.Sleep(devReloadInterval)
+	}
+}
+
+// Renders the templates of the directory which changed since the last call and prints the diff of
+// their agent pods.
+func reloadDevTemplates(dir string, demands []string, out io.Writer, color bool) {
+	files, err := filepath.Glob(filepath.Join(dir, "*"))
+	if err != nil {
+		log.Println("Listing the templates in "+dir+" failed", err)
+		return
+	}
+
+	devTemplates.Lock()
+	defer devTemplates.Unlock()
+
+	seen := map[string]bool{}
+	for _, file := range files {
+		switch strings.ToLower(filepath.Ext(file)) {
+		case ".yaml", ".yml", ".json":
+		default:
+			continue
+		}
+		seen[file] = true
+
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			log.Println("Reading the template "+file+" failed", err)
+			continue
+		}
+		previous := devTemplates.templates[file]
+		checksum := sha256.Sum256(data)
+		if previous != nil && previous.checksum == checksum {
+			continue
+		}
+
+		template := loadDevTemplate(file, data, demands)
+		template.checksum = checksum
+		devTemplates.templates[file] = template
+		oldManifest := ""
+		if previous != nil {
+			oldManifest = previous.manifest
+		}
+		printDevTemplateChange(out, "changed", template, oldManifest, color)
+	}
+
+	for file, template := range devTemplates.templates {
+		if !seen[file] {
+			delete(devTemplates.templates, file)
+			printDevTemplateChange(out, "removed", &devTemplate{file: file, pool: template.pool}, template.manifest, color)
+		}
+	}
+}
+
+// Parses and renders a template file. Templates without a pool name are named after their file.
+func loadDevTemplate(file string, data []byte, demands []string) *devTemplate {
+	template := &devTemplate{file: file}
+	jsonData, err := yaml.YAMLToJSON(data)
+	if err == nil {
+		err = json.Unmarshal(jsonData, &template.pool)
+	}
+	if err != nil {
+		template.err = err
+		return template
+	}
+	if template.pool.PoolName == "" {
+		template.pool.PoolName = strings.TrimSuffix(filepath.Base(file), filepath.Ext(file))
+	}
+
+	template.rendered = testTemplate(TemplateTestRequest{Template: template.pool, Demands: demands})
+	if template.rendered.Manifest != nil {
+		manifest, err := yaml.Marshal(template.rendered.Manifest)
+		if err != nil {
+			template.err = err
+			return template
+		}
+		template.manifest = string(manifest)
+	}
+	return template
+}
+
+func printDevTemplateChange(out io.Writer, event string, template *devTemplate, oldManifest string, color bool) {
+	var buffer bytes.Buffer
+	fmt.Fprintf(&buffer, "Template %s (pool %s) %s\n", template.file, template.pool.PoolName, event)
+	if template.err != nil {
+		fmt.Fprintf(&buffer, "  %v\n", template.err)
+	}
+	for _, message := range template.rendered.Errors {
+		fmt.Fprintf(&buffer, "  error: %s\n", message)
+	}
+	for _, violation := range template.rendered.Violations {
+		fmt.Fprintf(&buffer, "  lint %s: %s\n", violation.Action, violation.Message)
+	}
+	buffer.WriteString(formatLineDiff(diffLines(oldManifest, template.manifest), devDiffContext, color))
+	out.Write(buffer.Bytes())
+}
+
+type diffLine struct {
+	// ' ' for unchanged, '-' for removed and '+' for added lines
+	op   byte
+	text string
+}
+
+// Returns the line diff of two texts, from their longest common subsequence. The rendered pod
+// specs are a few hundred lines at most.
+func diffLines(before string, after string) []diffLine {
+	a, b := splitLines(before), splitLines(after)
+	common := make([][]int, len(a)+1)
+	for i := range common {
+		common[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				common[i][j] = common[i+1][j+1] + 1
+			} else if common[i+1][j] >= common[i][j+1] {
+				common[i][j] = common[i+1][j]
+			} else {
+				common[i][j] = common[i][j+1]
+			}
+		}
+	}
+
+	lines := []diffLine{}
+	i, j := 0, 0
+	for i < len(a) || j < len(b) {
+		switch {
+		case i < len(a) && j < len(b) && a[i] == b[j]:
+			lines = append(lines, diffLine{' ', a[i]})
+			i++
+			j++
+		case i < len(a) && (j == len(b) || common[i+1][j] >= common[i][j+1]):
+			lines = append(lines, diffLine{'-', a[i]})
+			i++
+		default:
+			lines = append(lines, diffLine{'+', b[j]})
+			j++
+		}
+	}
+	return lines
+}
+
+func splitLines(text string) []string {
+	if text == "" {
+		return nil
+	}
+	return strings.Split(strings.TrimSuffix(text, "\n"), "\n")
+}
+
+// Formats the changed lines with the given number of unchanged lines around them. Skipped lines
+// are marked with "...".
+func formatLineDiff(lines []diffLine, context int, color bool) string {
+	show := make([]bool, len(lines))
+	for i, line := range lines {
+		if line.op == ' ' {
+			continue
+		}
+		for k := i - context; k <= i+context; k++ {
+			if k >= 0 && k < len(lines) {
+				show[k] = true
+			}
+		}
+	}
+
+	var buffer bytes.Buffer
+	skipped := false
+	for i, line := range lines {
+		if !show[i] {
+			skipped = true
+			continue
+		}
+		if skipped {
+			buffer.WriteString(colorize("...", ansiCyan, color) + "\n")
+		}
+		skipped = false
+		text := string(line.op) + " " + line.text
+		switch line.op {
+		case '+':
+			text = colorize(text, ansiGreen, color)
+		case '-':
+			text = colorize(text, ansiRed, color)
+		}
+		buffer.WriteString(text + "\n")
+	}
+	return buffer.String()
+}
+
+func colorize(text string, code string, color bool) string {
+	if !color {
+		return text
+	}
+	return code + text + ansiReset
+}
+
+// Lists the templates loaded from DEV_TEMPLATE_DIR.
+func DevTemplatesHandler(resp http.ResponseWriter, req *http.Request) {
+	devTemplates.Lock()
+	templates := []DevTemplate{}
+	for _, template := range devTemplates.templates {
+		listed := DevTemplate{Pool: template.pool.PoolName, File: template.file, Valid: template.err == nil && template.rendered.Valid}
+		if template.err != nil {
+			listed.Errors = append(listed.Errors, template.err.Error())
+		}
+		listed.Errors = append(listed.Errors, template.rendered.Errors...)
+		templates = append(templates, listed)
+	}
+	devTemplates.Unlock()
+
+	sort.Slice(templates, func(i, j int) bool { return templates[i].Pool < templates[j].Pool })
+	writeJsonResponse(resp, http.StatusOK, templates)
+}
+
+// Returns the agent pod the template of the pool renders with its validation.
+func DevRenderedHandler(resp http.ResponseWriter, req *http.Request) {
+	pool := req.URL.Query().Get("pool")
+
+	devTemplates.Lock()
+	defer devTemplates.Unlock()
+	for _, template := range devTemplates.templates {
+		if template.pool.PoolName == pool && template.err == nil {
+			writeJsonResponse(resp, http.StatusOK, template.rendered)
+			return
+		}
+	}
+	writeJsonResponse(resp, http.StatusNotFound, GetError(UnknownDevTemplateError))
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestDiffLinesShouldMarkChangedLines(t *testing.T) {
+	lines := diffLines("a\nb\nc\n", "a\nx\nc\nd\n")
+
+	var ops []string
+	for _, line := range lines {
+		ops = append(ops, string(line.op)+line.text)
+	}
+	if strings.Join(ops, ",") != " a,-b,+x, c,+d" {
+		t.Errorf("Unexpected diff %v", ops)
+	}
+}
+
+func TestFormatLineDiffShouldKeepContextOnly(t *testing.T) {
+	before := "1\n2\n3\n4\n5\n6\n7\n8\n9\n10\n"
+	after := "1\n2\n3\n4\n5\n6\n7\n8\n9\nten\n"
+
+	diff := formatLineDiff(diffLines(before, after), 1, false)
+	if diff != "...\n  9\n- 10\n+ ten\n" {
+		t.Errorf("Unexpected diff %q", diff)
+	}
+	if colored := formatLineDiff(diffLines("a\n", "b\n"), 1, true); !strings.Contains(colored, ansiRed+"- a"+ansiReset) ||
+		!strings.Contains(colored, ansiGreen+"+ b"+ansiReset) {
+		t.Errorf("Expected colored lines. Got %q", colored)
+	}
+}
+
+func TestReloadDevTemplatesShouldPrintDiffOnChange(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "dev-templates")
+	defer os.RemoveAll(dir)
+	defer func() { devTemplates.templates = map[string]*devTemplate{} }()
+
+	file := filepath.Join(dir, "linux.yaml")
+	ioutil.WriteFile(file, []byte(`{"spec": {"containers": [{"name": "vsts-agent", "image": "prebansa/myagent:v5.16"}]}}`), 0644)
+	var out bytes.Buffer
+	reloadDevTemplates(dir, nil, &out, false)
+	if !strings.Contains(out.String(), "(pool linux) changed") || !hasDiffLine(out.String(), "+", "myagent:v5.16") {
+		t.Errorf("Expected the first rendering printed. Got %s", out.String())
+	}
+
+	out.Reset()
+	reloadDevTemplates(dir, nil, &out, false)
+	if out.Len() != 0 {
+		t.Errorf("Expected nothing printed for an unchanged template. Got %s", out.String())
+	}
+
+	ioutil.WriteFile(file, []byte(`{"spec": {"containers": [{"name": "vsts-agent", "image": "prebansa/myagent:v5.17"}]}}`), 0644)
+	reloadDevTemplates(dir, nil, &out, false)
+	if !hasDiffLine(out.String(), "-", "myagent:v5.16") || !hasDiffLine(out.String(), "+", "myagent:v5.17") {
+		t.Errorf("Expected the image change printed. Got %s", out.String())
+	}
+
+	os.Remove(file)
+	out.Reset()
+	reloadDevTemplates(dir, nil, &out, false)
+	if !strings.Contains(out.String(), "(pool linux) removed") || len(devTemplates.templates) != 0 {
+		t.Errorf("Expected the template removed. Got %s", out.String())
+	}
+}
+
+func hasDiffLine(diff string, op string, text string) bool {
+	for _, line := range strings.Split(diff, "\n") {
+		if strings.HasPrefix(line, op+" ") && strings.Contains(line, text) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"net/http"
+	"os"
+	"runtime/pprof"
+	"strings"
+	"sync"
+	"time"
+)
+
+// GET /admin/diagnostics returns a tar.gz bundle for support tickets. Its files are ranked by how
+// often they explain a problem: the last errors returned to Azure DevOps, the pool states, the
+// effective configuration with masked secrets, the number of storage entries per kind, the recent
+// log lines and a dump of all goroutines. The webserver keeps the last DIAGNOSTICS_LOG_LINES log
+// lines, 1000 by default, and the last 50 errors in memory for it.
+const (
+	defaultDiagnosticsLogLines = 1000
+	maxRecentErrors            = 50
+)
+
+type ErrorRecord struct {
+	Timestamp time.Time
+	Message   string
+}
+
+// ringBuffer keeps the last entries written to it.
+type ringBuffer struct {
+	sync.Mutex
+	entries []interface{}
+	next    int
+	full    bool
+}
+
+func newRingBuffer(size int) *ringBuffer {
+	return &ringBuffer{entries: make([]interface{}, size)}
+}
+
+func (r *ringBuffer) add(entry interface{}) {
+	r.Lock()
+	defer r.Unlock()
+	r.entries[r.next] = entry
+	r.next = (r.next + 1) % len(r.entries)
+	if r.next == 0 {
+		r.full = true
+	}
+}
+
+// Returns the entries, oldest first.
+func (r *ringBuffer) snapshot() []interface{} {
+	r.Lock()
+	defer r.Unlock()
+	if !r.full {
+		return append([]interface{}{}, r.entries[:r.next]...)
+	}
+	return append(append([]interface{}{}, r.entries[r.next:]...), r.entries[:r.next]...)
+}
+
+// Every call of the log package writes one entry.
+func (r *ringBuffer) Write(p []byte) (int, error) {
+	r.add(string(p))
+	return len(p), nil
+}
+
+var (
+	recentLogs   = newRingBuffer(diagnosticsLogLines())
+	recentErrors = newRingBuffer(maxRecentErrors)
+)
+
+func diagnosticsLogLines() int {
+	if lines := getEnvInt("DIAGNOSTICS_LOG_LINES", defaultDiagnosticsLogLines); lines > 0 {
+		return lines
+	}
+	return defaultDiagnosticsLogLines
+}
+
+func recordRecentError(err error) {
+	recentErrors.add(ErrorRecord{Timestamp: time.Now().UTC(), Message: err.Error()})
+}
+
+type bundleFile struct {
+	name    string
+	content []byte
+}
+
+func DiagnosticsBundleHandler(resp http.ResponseWriter, req *http.Request) {
+	if !isReadRequestValid(resp, req) {
+		return
+	}
+
+	now := time.Now().UTC()
+	data, err := writeBundle(collectDiagnostics(), now)
+	if err != nil {
+		writeJsonResponse(resp, http.StatusInternalServerError, GetError(err.Error()))
+		return
+	}
+	resp.Header().Set("Content-Type", "application/gzip")
+	resp.Header().Set("Content-Disposition", "attachment; filename=poolprovider-diagnostics-"+now.Format("20060102-150405")+".tar.gz")
+	resp.WriteHeader(http.StatusOK)
+	resp.Write(data)
+}
+
+// Collects the files of the bundle, most telling first. A part which cannot be collected holds
+// the error instead.
+func collectDiagnostics() []bundleFile {
+	hostname, _ := os.Hostname()
+	files := []bundleFile{}
+
+	files = append(files, jsonBundleFile("errors.json", recentErrors.snapshot()))
+
+	var pools interface{}
+	if crdobject, _, err := fetchAzurePipelinesPool(podnamespace); err != nil {
+		pools = GetError(err.Error())
+	} else if snapshot, err := collectPoolState(crdobject, podnamespace); err != nil {
+		pools = GetError(err.Error())
+	} else {
+		pools = snapshot
+	}
+	files = append(files, jsonBundleFile("pools.json", pools))
+
+	files = append(files, jsonBundleFile("config.json", EffectiveConfig{
+		Instance: hostname,
+		IsLeader: IsLeader(),
+		Settings: effectiveSettings(configSettings()),
+	}))
+
+	var storage interface{}
+	if entries, err := GetStorage().List(""); err != nil {
+		storage = GetError(err.Error())
+	} else {
+		storage = countStorageEntries(entries)
+	}
+	files = append(files, jsonBundleFile("storage.json", storage))
+
+	var logs bytes.Buffer
+	for _, line := range recentLogs.snapshot() {
+		logs.WriteString(line.(string))
+	}
+	files = append(files, bundleFile{name: "logs.txt", content: logs.Bytes()})
+
+	var goroutines bytes.Buffer
+	pprof.Lookup("goroutine").WriteTo(&goroutines, 2)
+	files = append(files, bundleFile{name: "goroutines.txt", content: goroutines.Bytes()})
+
+	return files
+}
+
+func jsonBundleFile(name string, value interface{}) bundleFile {
+	data, _ := json.MarshalIndent(value, "", "  ")
+	return bundleFile{name: name, content: data}
+}
+
+// Counts the storage entries by the part of their key before the first ':', e.g. "dedupe".
+func countStorageEntries(entries map[string]string) map[string]int {
+	counts := map[string]int{}
+	for key := range entries {
+		counts[strings.SplitN(key, ":", 2)[0]]++
+	}
+	return counts
+}
+
+func writeBundle(files []bundleFile, now time.Time) ([]byte, error) {
+	var buffer bytes.Buffer
+	compressed := gzip.NewWriter(&buffer)
+	archive := tar.NewWriter(compressed)
+
+	index := []string{}
+	for _, file := range files {
+		index = append(index, file.name)
+	}
+	readme := bundleFile{name: "README.txt", content: []byte(
+		"Generated " + now.Format(time.RFC3339) + ", files by relevance:\n" + strings.Join(index, "\n") + "\n")}
+
+	for _, file := range append([]bundleFile{readme}, files...) {
+		header := &tar.Header{Name: "poolprovider-diagnostics/" + file.name, Mode: 0644, Size: int64(len(file.content)), ModTime: now}
+		if err := archive.WriteHeader(header); err != nil {
+			return nil, err
+		}
+		if _, err := archive.Write(file.content); err != nil {
+			return nil, err
+		}
+	}
+	if err := archive.Close(); err != nil {
+		return nil, err
+	}
+	if err := compressed.Close(); err != nil {
+		return nil, err
+	}
+	return buffer.Bytes(), nil
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io"
+	"testing"
+	"time"
+)
+
+func TestRingBufferShouldKeepTheLastEntriesInOrder(t *testing.T) {
+	ring := newRingBuffer(3)
+	if entries := ring.snapshot(); len(entries) != 0 {
+		t.Errorf("Expected no entries. Got %v", entries)
+	}
+
+	for _, line := range []string{"a\n", "b\n", "c\n", "d\n"} {
+		ring.Write([]byte(line))
+	}
+	entries := ring.snapshot()
+	if len(entries) != 3 || entries[0] != "b\n" || entries[2] != "d\n" {
+		t.Errorf("Expected b, c and d. Got %v", entries)
+	}
+}
+
+func TestRecordRecentErrorShouldKeepTheLastErrors(t *testing.T) {
+	for i := 0; i < maxRecentErrors+5; i++ {
+		recordRecentError(errors.New("failure"))
+	}
+	recordRecentError(errors.New("last"))
+
+	entries := recentErrors.snapshot()
+	if len(entries) != maxRecentErrors {
+		t.Errorf("Expected %d errors. Got %d", maxRecentErrors, len(entries))
+	}
+	if last := entries[len(entries)-1].(ErrorRecord); last.Message != "last" {
+		t.Errorf("Expected the last error last. Got %s", last.Message)
+	}
+}
+
+func TestCountStorageEntriesShouldGroupByPrefix(t *testing.T) {
+	counts := countStorageEntries(map[string]string{"dedupe:a": "", "dedupe:b": "", "journal:a": "", "plain": ""})
+	if counts["dedupe"] != 2 || counts["journal"] != 1 || counts["plain"] != 1 {
+		t.Errorf("Unexpected counts %v", counts)
+	}
+}
+
+func TestWriteBundleShouldListTheFilesInOrder(t *testing.T) {
+	data, err := writeBundle([]bundleFile{{name: "errors.json", content: []byte("[]")}, {name: "logs.txt"}}, time.Now())
+	if err != nil {
+		t.Fatalf("Expected a bundle. Got %v", err)
+	}
+
+	compressed, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("Expected a gzip stream. Got %v", err)
+	}
+	archive := tar.NewReader(compressed)
+	names := []string{}
+	for {
+		header, err := archive.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("Expected a tar archive. Got %v", err)
+		}
+		names = append(names, header.Name)
+	}
+	if len(names) != 3 || names[0] != "poolprovider-diagnostics/README.txt" || names[1] != "poolprovider-diagnostics/errors.json" {
+		t.Errorf("Unexpected files %v", names)
+	}
+}
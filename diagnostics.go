@@ -0,0 +1,27 @@
+package main
+
+import (
+	"log"
+
+	v1 "k8s.io/api/core/v1"
+)
+
+// Agents in diagnostic mode trace their HTTP traffic, VSTS_AGENT_HTTPTRACE, and the start script
+// of the agent image writes their diagnostic logs to the container log. AZP_AGENT_DIAGNOSTICS holds
+// the mode: "once" exits the agent after the job, "continuous" keeps it listening.
+const (
+	diagnosticsEnvVariable = "AZP_AGENT_DIAGNOSTICS"
+	httpTraceEnvVariable   = "VSTS_AGENT_HTTPTRACE"
+)
+
+func addDiagnosticsEnvironmentVariables(pod *v1.Pod, mode string) {
+	if pod == nil || mode == "" || len(pod.Spec.Containers) == 0 {
+		return
+	}
+
+	log.Println("Running the agent in diagnostic mode " + mode)
+	container := &pod.Spec.Containers[0]
+	container.Env = append(container.Env,
+		v1.EnvVar{Name: diagnosticsEnvVariable, Value: mode},
+		v1.EnvVar{Name: httpTraceEnvVariable, Value: "true"})
+}
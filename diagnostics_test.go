@@ -0,0 +1,27 @@
+package main
+
+import (
+	"testing"
+
+	v1 "k8s.io/api/core/v1"
+)
+
+func TestAddDiagnosticsEnvironmentVariablesShouldSetTheModeAndHttpTrace(t *testing.T) {
+	pod := &v1.Pod{Spec: v1.PodSpec{Containers: []v1.Container{{Name: "vsts-agent"}, {Name: "sidecar"}}}}
+
+	addDiagnosticsEnvironmentVariables(pod, "continuous")
+
+	env := pod.Spec.Containers[0].Env
+	if len(env) != 2 || env[0].Name != diagnosticsEnvVariable || env[0].Value != "continuous" || env[1].Name != httpTraceEnvVariable {
+		t.Errorf("Expected the diagnostic mode and HTTP tracing on the agent container. Got %+v", env)
+	}
+	if len(pod.Spec.Containers[1].Env) != 0 {
+		t.Errorf("Expected the sidecar to be left alone. Got %+v", pod.Spec.Containers[1].Env)
+	}
+
+	pod = &v1.Pod{Spec: v1.PodSpec{Containers: []v1.Container{{Name: "vsts-agent"}}}}
+	addDiagnosticsEnvironmentVariables(pod, "")
+	if len(pod.Spec.Containers[0].Env) != 0 {
+		t.Errorf("Expected no variables without diagnostics. Got %+v", pod.Spec.Containers[0].Env)
+	}
+}
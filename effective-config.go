@@ -0,0 +1,227 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/microsoft/poolprovider-for-k8s/pkg/azuredevops"
+)
+
+// The webserver is configured through environment variables only, the pool settings come from the
+// custom resource. /admin/config/effective lists every variable with the value this instance
+// actually uses, resolved the way the code resolves it, and whether that value comes from the
+// environment or is the default. Secrets and the credentials of urls are masked.
+const (
+	ConfigSourceEnvironment = "env"
+	ConfigSourceDefault     = "default"
+	maskedConfigValue       = "****"
+)
+
+type ConfigSetting struct {
+	Name   string
+	Value  string
+	Source string
+}
+
+type EffectiveConfig struct {
+	Instance string
+	IsLeader bool
+	Settings []ConfigSetting
+}
+
+type configSetting struct {
+	name   string
+	value  string
+	secret bool
+}
+
+func configSettings() []configSetting {
+	devops := azuredevops.ConfigFromEnvironment()
+	rates := costRatesFromEnvironment()
+	retention := map[string]time.Duration{}
+	for _, policy := range retentionPolicies() {
+		retention[policy.prefix] = policy.retention
+	}
+
+	encodings := []string{}
+	for encoding := range requestDecompression.encodings {
+		encodings = append(encodings, encoding)
+	}
+	sort.Strings(encodings)
+
+	syncPrefer := "provider"
+	if os.Getenv("POOL_SYNC_PREFER") == poolSyncPreferAzureDevOps {
+		syncPrefer = poolSyncPreferAzureDevOps
+	}
+
+	return []configSetting{
+		{name: "ACQUIRE_STREAM_TIMEOUT_SECONDS", value: formatSeconds(getStreamTimeout())},
+		{name: "ADOPTION_INTERVAL_SECONDS", value: strconv.Itoa(getEnvInt("ADOPTION_INTERVAL_SECONDS", int(adoptionInterval/time.Second)))},
+		{name: "AGENT_JOB_INTERVAL_SECONDS", value: strconv.Itoa(getEnvInt("AGENT_JOB_INTERVAL_SECONDS", int(agentJobInterval/time.Second)))},
+		{name: "AGENT_JOB_RETENTION_HOURS", value: strconv.Itoa(int(retention[agentJobKeyPrefix] / time.Hour))},
+		{name: "ARTIFACT_CACHE_DIR", value: os.Getenv("ARTIFACT_CACHE_DIR")},
+		{name: "ARTIFACT_CACHE_MAX_AGE_SECONDS", value: strconv.Itoa(getEnvInt("ARTIFACT_CACHE_MAX_AGE_SECONDS", int(defaultArtifactCacheMaxAge/time.Second)))},
+		{name: "ARTIFACT_CACHE_UPSTREAMS", value: os.Getenv("ARTIFACT_CACHE_UPSTREAMS")},
+		{name: "ARTIFACT_CACHE_URL", value: artifactCacheUrl(podnamespace)},
+		{name: "ASYNC_QUEUE_SIZE", value: strconv.Itoa(getEnvInt("ASYNC_QUEUE_SIZE", defaultAsyncQueueSize))},
+		{name: "ASYNC_WORKERS", value: strconv.Itoa(getEnvInt("ASYNC_WORKERS", defaultAsyncWorkers))},
+		{name: "ATTESTATION_AUDIENCE", value: attestationAudience()},
+		{name: "ATTEST_URL", value: attestUrl(podnamespace)},
+		{name: "AUDIT_RETENTION_DAYS", value: strconv.Itoa(int(retention[auditKeyPrefix] / (24 * time.Hour)))},
+		{name: "AZURE_CLIENT_ID", value: os.Getenv("AZURE_CLIENT_ID")},
+		{name: "AZURE_DEVOPS_API_VERSION", value: devops.ApiVersion},
+		{name: "AZURE_DEVOPS_BREAKER_COOLDOWN_SECONDS", value: formatSeconds(devops.BreakerCooldown)},
+		{name: "AZURE_DEVOPS_BREAKER_THRESHOLD", value: strconv.Itoa(devops.BreakerThreshold)},
+		{name: "AZURE_DEVOPS_COLLECTION", value: devops.Collection},
+		{name: "AZURE_DEVOPS_PASSWORD", secret: true, value: devops.Password},
+		{name: "AZURE_DEVOPS_PAT", secret: true, value: devops.Token},
+		{name: "AZURE_DEVOPS_RETRIES", value: strconv.Itoa(devops.Retries)},
+		{name: "AZURE_DEVOPS_TIMEOUT_SECONDS", value: formatSeconds(devops.Timeout)},
+		{name: "AZURE_DEVOPS_URL", value: devops.ServerUrl},
+		{name: "AZURE_DEVOPS_USERNAME", value: devops.Username},
+		{name: "BUDGET_CHECK_INTERVAL_SECONDS", value: strconv.Itoa(getEnvInt("BUDGET_CHECK_INTERVAL_SECONDS", int(budgetCheckInterval/time.Second)))},
+		{name: "CANARY_INTERVAL_SECONDS", value: strconv.Itoa(getEnvInt("CANARY_INTERVAL_SECONDS", 0))},
+		{name: "CANARY_RETENTION_HOURS", value: strconv.Itoa(int(retention[canaryKeyPrefix] / time.Hour))},
+		{name: "CANARY_TIMEOUT_SECONDS", value: strconv.Itoa(getEnvInt("CANARY_TIMEOUT_SECONDS", int(defaultCanaryTimeout/time.Second)))},
+		{name: "CLUSTER_REGISTRY_FILE", value: os.Getenv("CLUSTER_REGISTRY_FILE")},
+		{name: "COST_PER_CPU_HOUR", value: strconv.FormatFloat(rates.CpuHour, 'f', -1, 64)},
+		{name: "COST_PER_GB_HOUR", value: strconv.FormatFloat(rates.MemoryHour, 'f', -1, 64)},
+		{name: "DEBUG_LOCAL", value: os.Getenv("DEBUG_LOCAL")},
+		{name: "DEDUPE_RETENTION_HOURS", value: strconv.Itoa(int(retention[dedupeKeyPrefix] / time.Hour))},
+		{name: "DEFAULT_LANGUAGE", value: configuredDefaultLanguage()},
+		{name: "DEPLOY_CLUSTER_ROLES", value: strings.Join(deployClusterRoles(), ",")},
+		{name: "DEV_DEMANDS", value: strings.Join(devDemands(), ",")},
+		{name: "DEV_MODE", value: strconv.FormatBool(isDevMode())},
+		{name: "DEV_TEMPLATE_DIR", value: devTemplateDir()},
+		{name: "DIAGNOSTICS_LOG_LINES", value: strconv.Itoa(len(recentLogs.entries))},
+		{name: "EPHEMERAL_INTERVAL_SECONDS", value: strconv.Itoa(getEnvInt("EPHEMERAL_INTERVAL_SECONDS", int(ephemeralInterval/time.Second)))},
+		{name: "EPHEMERAL_RETENTION_HOURS", value: strconv.Itoa(int(retention[ephemeralKeyPrefix] / time.Hour))},
+		{name: "EXPLAIN_RETENTION_HOURS", value: strconv.Itoa(int(retention[explainKeyPrefix] / time.Hour))},
+		{name: "EXTERNAL_AGENTS", value: os.Getenv("EXTERNAL_AGENTS")},
+		{name: "FAILOVER_RETENTION_DAYS", value: strconv.Itoa(int(retention[failoverKeyPrefix] / (24 * time.Hour)))},
+		{name: "FALLBACK_MODE", value: os.Getenv("FALLBACK_MODE")},
+		{name: "FALLBACK_NAMESPACE", value: fallbackNamespace()},
+		{name: "FALLBACK_PATHS", value: os.Getenv("FALLBACK_PATHS")},
+		{name: "FALLBACK_URL", value: os.Getenv("FALLBACK_URL")},
+		{name: "JOURNAL_STALE_SECONDS", value: strconv.Itoa(getEnvInt("JOURNAL_STALE_SECONDS", int(defaultJournalStaleAge/time.Second)))},
+		{name: "LOG_FORMAT", value: configuredLogFormat()},
+		{name: "LOG_LEVEL", value: configuredLogLevel()},
+		{name: "MAX_CONCURRENT_CREATIONS", value: strconv.Itoa(podCreationThrottle.max)},
+		{name: "MAX_GOROUTINES", value: strconv.Itoa(getEnvInt("MAX_GOROUTINES", defaultMaxGoroutines))},
+		{name: "MAX_REQUEST_BODY_BYTES", value: strconv.FormatInt(requestDecompression.maxBytes, 10)},
+		{name: "MAX_SNAPSHOT_BODY_BYTES", value: strconv.FormatInt(maxSnapshotBody(), 10)},
+		{name: "MEMORY_LIMIT_BYTES", value: strconv.FormatUint(getMemoryLimit(), 10)},
+		{name: "MESSAGE_CATALOG_DIR", value: os.Getenv("MESSAGE_CATALOG_DIR")},
+		{name: "MIRROR_SAMPLE_PERCENT", value: strconv.Itoa(getEnvInt("MIRROR_SAMPLE_PERCENT", defaultMirrorSamplePercent))},
+		{name: "MIRROR_URL", value: os.Getenv("MIRROR_URL")},
+		{name: "NOTIFY_WEBHOOK_URL", secret: true, value: os.Getenv("NOTIFY_WEBHOOK_URL")},
+		{name: "OPERATION_QUEUE_BACKEND", value: os.Getenv("OPERATION_QUEUE_BACKEND")},
+		{name: "OPERATION_RETENTION_HOURS", value: strconv.Itoa(int(retention[operationKeyPrefix] / time.Hour))},
+		{name: "OUTBOUND_CA_FILE", value: os.Getenv("OUTBOUND_CA_FILE")},
+		{name: "OUTBOUND_IDLE_CONN_TIMEOUT_SECONDS", value: strconv.Itoa(getEnvInt("OUTBOUND_IDLE_CONN_TIMEOUT_SECONDS", int(defaultOutboundIdleConnTimeout/time.Second)))},
+		{name: "OUTBOUND_MAX_IDLE_CONNS", value: strconv.Itoa(getEnvInt("OUTBOUND_MAX_IDLE_CONNS", defaultOutboundMaxIdleConns))},
+		{name: "OUTBOUND_MAX_IDLE_CONNS_PER_HOST", value: strconv.Itoa(getEnvInt("OUTBOUND_MAX_IDLE_CONNS_PER_HOST", defaultOutboundMaxIdleConnsPerHost))},
+		{name: "PAYLOAD_INSPECTOR", value: strconv.FormatBool(newPayloadInspectorFromEnvironment() != nil)},
+		{name: "PAYLOAD_MAX_BODY_BYTES", value: strconv.Itoa(getEnvInt("PAYLOAD_MAX_BODY_BYTES", defaultPayloadBodyMax))},
+		{name: "PAYLOAD_MAX_HEADER_BYTES", value: strconv.Itoa(getEnvInt("PAYLOAD_MAX_HEADER_BYTES", defaultPayloadHeaderMax))},
+		{name: "PAYLOAD_RETENTION_HOURS", value: strconv.Itoa(int(retention[payloadKeyPrefix] / time.Hour))},
+		{name: "PAYLOAD_TRANSFORMS_FILE", value: os.Getenv("PAYLOAD_TRANSFORMS_FILE")},
+		{name: "POD_NAMESPACE", value: podnamespace},
+		{name: "POOL_API_BUDGETS", value: os.Getenv("POOL_API_BUDGETS")},
+		{name: "POOL_API_BUDGET_PER_MINUTE", value: strconv.Itoa(apiBudget.perMinute)},
+		{name: "POOL_SHARDING", value: strconv.FormatBool(isShardingEnabled())},
+		{name: "POOL_STATE_INTERVAL_SECONDS", value: strconv.Itoa(getEnvInt("POOL_STATE_INTERVAL_SECONDS", int(poolStateInterval/time.Second)))},
+		{name: "POOL_SYNC_INTERVAL_SECONDS", value: os.Getenv("POOL_SYNC_INTERVAL_SECONDS")},
+		{name: "POOL_SYNC_PREFER", value: syncPrefer},
+		{name: "QUARANTINE_THRESHOLD", value: strconv.Itoa(quarantineThreshold())},
+		{name: "QUEUE_POLL_INTERVAL_SECONDS", value: os.Getenv("QUEUE_POLL_INTERVAL_SECONDS")},
+		{name: "RATE_LIMIT_CLIENT", value: strconv.Itoa(clientRateLimiter.defaults.Hard)},
+		{name: "RATE_LIMIT_CLIENT_HEADER", value: os.Getenv("RATE_LIMIT_CLIENT_HEADER")},
+		{name: "RATE_LIMIT_HARD", value: strconv.Itoa(requestRateLimiter.defaults.Hard)},
+		{name: "RATE_LIMIT_SOFT", value: strconv.Itoa(requestRateLimiter.defaults.Soft)},
+		{name: "RATE_LIMIT_TENANTS", value: os.Getenv("RATE_LIMIT_TENANTS")},
+		{name: "RATE_LIMIT_WINDOW_SECONDS", value: formatSeconds(requestRateLimiter.window)},
+		{name: "RECONCILE_GRACE_SECONDS", value: strconv.Itoa(getEnvInt("RECONCILE_GRACE_SECONDS", defaultReconcileGrace))},
+		{name: "RECONCILE_INTERVAL_SECONDS", value: os.Getenv("RECONCILE_INTERVAL_SECONDS")},
+		{name: "REGISTRY_CREDENTIAL_HELPER_URL", value: os.Getenv("REGISTRY_CREDENTIAL_HELPER_URL")},
+		{name: "REQUEST_ENCODINGS", value: strings.Join(encodings, ",")},
+		{name: "RIGHTSIZING_AUTO_APPLY", value: strconv.FormatBool(isRightsizingAutoApplied())},
+		{name: "RIGHTSIZING_HEADROOM_PERCENT", value: strconv.Itoa(getEnvInt("RIGHTSIZING_HEADROOM_PERCENT", defaultRightsizingHeadroom))},
+		{name: "RIGHTSIZING_INTERVAL_SECONDS", value: strconv.Itoa(getEnvInt("RIGHTSIZING_INTERVAL_SECONDS", int(rightsizingInterval/time.Second)))},
+		{name: "RIGHTSIZING_MIN_SAMPLES", value: strconv.Itoa(getEnvInt("RIGHTSIZING_MIN_SAMPLES", defaultRightsizingSamples))},
+		{name: "RIGHTSIZING_RETENTION_DAYS", value: strconv.Itoa(int(retention[usageKeyPrefix] / (24 * time.Hour)))},
+		{name: "SERVICE_BUS_CONNECTION_STRING", secret: true, value: os.Getenv("SERVICE_BUS_CONNECTION_STRING")},
+		{name: "SERVICE_BUS_QUEUE", value: serviceBusQueueName()},
+		{name: "SHUTDOWN_INTAKE_SECONDS", value: strconv.Itoa(getEnvInt("SHUTDOWN_INTAKE_SECONDS", int(defaultShutdownIntake/time.Second)))},
+		{name: "SHUTDOWN_OPERATIONS_SECONDS", value: strconv.Itoa(getEnvInt("SHUTDOWN_OPERATIONS_SECONDS", int(defaultShutdownOperations/time.Second)))},
+		{name: "SHUTDOWN_TIMEOUT_SECONDS", value: strconv.Itoa(getEnvInt("SHUTDOWN_TIMEOUT_SECONDS", int(defaultShutdownTimeout/time.Second)))},
+		{name: "STARTUP_RETENTION_HOURS", value: strconv.Itoa(int(retention[startupKeyPrefix] / time.Hour))},
+		{name: "STARTUP_TIMEOUT_SECONDS", value: strconv.Itoa(getEnvInt("STARTUP_TIMEOUT_SECONDS", int(defaultStartupTimeout/time.Second)))},
+		{name: "STARTUP_WATCH_INTERVAL_SECONDS", value: strconv.Itoa(getEnvInt("STARTUP_WATCH_INTERVAL_SECONDS", int(startupWatchInterval/time.Second)))},
+		{name: "STORAGE_BACKEND", value: os.Getenv("STORAGE_BACKEND")},
+		{name: "STORAGE_COMPACTION_INTERVAL_SECONDS", value: strconv.Itoa(getEnvInt("STORAGE_COMPACTION_INTERVAL_SECONDS", int(storageCompactionInterval/time.Second)))},
+		{name: "STORAGE_MIGRATION_TARGET", value: storageMigrationTarget()},
+		{name: "STORAGE_TTL_SECONDS", value: os.Getenv("STORAGE_TTL_SECONDS")},
+		{name: "STRICT_PAYLOAD_SCHEMA", value: strconv.FormatBool(isStrictPayloadSchema())},
+		{name: "TLS_CERT_FILE", value: os.Getenv("TLS_CERT_FILE")},
+		{name: "TLS_CLIENT_CA_FILE", value: os.Getenv("TLS_CLIENT_CA_FILE")},
+		{name: "TLS_KEY_FILE", value: os.Getenv("TLS_KEY_FILE")},
+		{name: "VSTS_SECRET", secret: true, value: os.Getenv("VSTS_SECRET")},
+		{name: "VSTS_SECRET_PREVIOUS", secret: true, value: os.Getenv("VSTS_SECRET_PREVIOUS")},
+		{name: "WARM_POOL_BACKOFF_MAX_SECONDS", value: strconv.Itoa(getEnvInt("WARM_POOL_BACKOFF_MAX_SECONDS", int(defaultWarmPoolBackoffMax/time.Second)))},
+	}
+}
+
+func formatSeconds(duration time.Duration) string {
+	return strconv.FormatInt(int64(duration/time.Second), 10)
+}
+
+// Resolves the settings. A setting comes from the environment when its variable is set, even if
+// the value could not be used and the default applies.
+func effectiveSettings(settings []configSetting) []ConfigSetting {
+	resolved := []ConfigSetting{}
+	for _, setting := range settings {
+		source := ConfigSourceDefault
+		if value, ok := os.LookupEnv(setting.name); ok && value != "" {
+			source = ConfigSourceEnvironment
+		}
+		resolved = append(resolved, ConfigSetting{Name: setting.name, Value: maskConfigValue(setting.value, setting.secret), Source: source})
+	}
+	return resolved
+}
+
+// Masks secrets entirely and the password of urls, e.g. one in MIRROR_URL.
+func maskConfigValue(value string, secret bool) string {
+	if value == "" {
+		return value
+	}
+	if secret {
+		return maskedConfigValue
+	}
+	if parsed, err := url.Parse(value); err == nil && parsed.User != nil {
+		if _, hasPassword := parsed.User.Password(); hasPassword {
+			parsed.User = url.UserPassword(parsed.User.Username(), maskedConfigValue)
+			return strings.Replace(parsed.String(), url.QueryEscape(maskedConfigValue), maskedConfigValue, 1)
+		}
+	}
+	return value
+}
+
+// Returns the configuration this instance runs with.
+func EffectiveConfigHandler(resp http.ResponseWriter, req *http.Request) {
+	if !isReadRequestValid(resp, req) {
+		return
+	}
+
+	hostname, _ := os.Hostname()
+	writeJsonResponse(resp, http.StatusOK, EffectiveConfig{
+		Instance: hostname,
+		IsLeader: IsLeader(),
+		Settings: effectiveSettings(configSettings()),
+	})
+}
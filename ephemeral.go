@@ -0,0 +1,256 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"strconv"
+	"time"
+
+	v1alpha1 "github.com/microsoft/poolprovider-for-k8s/pkg/apis/dev/v1alpha1"
+	v1 "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// Agents of ephemeral pools run exactly one job: AZP_AGENT_ONCE makes the start script of the agent
+// image run the agent with --once, and the pod never restarts. The leader follows every agent of an
+// ephemeral pool through a small state machine, kept under "ephemeral:<agentId>" in the storage so
+// a new leader picks up where the old one stopped:
+//
+//	pending --started--> running --exited--> exited --deleted--> deleted --replenished--> (done)
+//	pending --exited--> exited
+//
+// When the agent container has exited, the outcome is recorded like the one of an agent Job, so the
+// release of the agent still cleans up its secret, and the pod is deleted. The warm pools are then
+// reconciled at once instead of on the next round of the warm pool controller. The agents are
+// checked every EPHEMERAL_INTERVAL_SECONDS. Records are kept for EPHEMERAL_RETENTION_HOURS, 24 by
+// default.
+const (
+	ephemeralKeyPrefix        = "ephemeral:"
+	ephemeralEnvVariable      = "AZP_AGENT_ONCE"
+	defaultEphemeralRetention = 24 * time.Hour
+
+	EphemeralStatePending     = "pending"
+	EphemeralStateRunning     = "running"
+	EphemeralStateExited      = "exited"
+	EphemeralStateDeleted     = "deleted"
+	EphemeralStateReplenished = "replenished"
+
+	ephemeralEventStarted     = "started"
+	ephemeralEventExited      = "exited"
+	ephemeralEventDeleted     = "deleted"
+	ephemeralEventReplenished = "replenished"
+)
+
+var ephemeralInterval = 5 * time.Second
+
+var ephemeralTransitions = map[string]map[string]string{
+	EphemeralStatePending: {ephemeralEventStarted: EphemeralStateRunning, ephemeralEventExited: EphemeralStateExited},
+	EphemeralStateRunning: {ephemeralEventExited: EphemeralStateExited},
+	EphemeralStateExited:  {ephemeralEventDeleted: EphemeralStateDeleted},
+	EphemeralStateDeleted: {ephemeralEventReplenished: EphemeralStateReplenished},
+}
+
+type EphemeralAgentRecord struct {
+	AgentId   string
+	Pool      string
+	Pod       string
+	Namespace string
+	State     string
+	ExitCode  int32 `json:",omitempty"`
+	UpdatedAt time.Time
+}
+
+// Returns the state the event leads to, false when the event does not apply to the state.
+func nextEphemeralState(state string, event string) (string, bool) {
+	next, ok := ephemeralTransitions[state][event]
+	return next, ok
+}
+
+// Moves the record to the state the event leads to. Events which do not apply are ignored.
+func (record *EphemeralAgentRecord) apply(event string, now time.Time) bool {
+	next, ok := nextEphemeralState(record.State, event)
+	if !ok {
+		return false
+	}
+	record.State, record.UpdatedAt = next, now
+	return true
+}
+
+func isEphemeralPool(pool *v1alpha1.AgentPoolSpec) bool {
+	return pool != nil && pool.Ephemeral
+}
+
+// Makes the agent of an ephemeral pool exit after its job, and keeps the pod from restarting it.
+func addEphemeralEnvironmentVariable(pod *v1.Pod, pool *v1alpha1.AgentPoolSpec) {
+	if !isEphemeralPool(pool) || len(pod.Spec.Containers) == 0 {
+		return
+	}
+	container := &pod.Spec.Containers[0]
+	container.Env = append(container.Env, v1.EnvVar{Name: ephemeralEnvVariable, Value: "true"})
+	pod.Spec.RestartPolicy = v1.RestartPolicyNever
+}
+
+// Returns the event the agent container of the pod shows, with its exit code once it exited. Other
+// containers of the pod, e.g. service containers, may keep running after the agent exited.
+func ephemeralEvent(pod *v1.Pod) (string, int32) {
+	if len(pod.Spec.Containers) > 0 {
+		for _, status := range pod.Status.ContainerStatuses {
+			if status.Name != pod.Spec.Containers[0].Name {
+				continue
+			}
+			if status.State.Terminated != nil {
+				return ephemeralEventExited, status.State.Terminated.ExitCode
+			}
+			if status.State.Running != nil {
+				return ephemeralEventStarted, 0
+			}
+		}
+	}
+	switch pod.Status.Phase {
+	case v1.PodSucceeded:
+		return ephemeralEventExited, 0
+	case v1.PodFailed:
+		return ephemeralEventExited, 1
+	}
+	return "", 0
+}
+
+func saveEphemeralAgent(record EphemeralAgentRecord) {
+	data, _ := json.Marshal(record)
+	if err := GetStorage().Set(ephemeralKeyPrefix+record.AgentId, string(data)); err != nil {
+		log.Println("Failed to store the state of ephemeral agent "+record.AgentId, err)
+	}
+}
+
+func getEphemeralAgent(agentId string) (EphemeralAgentRecord, bool) {
+	var record EphemeralAgentRecord
+	value, err := GetStorage().Get(ephemeralKeyPrefix + agentId)
+	if err != nil || json.Unmarshal([]byte(value), &record) != nil {
+		return record, false
+	}
+	return record, true
+}
+
+func forgetEphemeralAgent(agentId string) {
+	GetStorage().Delete(ephemeralKeyPrefix + agentId)
+}
+
+func RunEphemeralAgentController(namespace string) {
+	interval := time.Duration(getEnvInt("EPHEMERAL_INTERVAL_SECONDS", int(ephemeralInterval/time.Second))) * time.Second
+	for {
+		if IsLeader() {
+			if err := reconcileEphemeralAgents(namespace, time.Now().UTC()); err != nil {
+				log.Println("Reconciling the ephemeral agents failed", err)
+			}
+		}
+		time.Sleep(interval)
+	}
+}
+
+func reconcileEphemeralAgents(namespace string, now time.Time) error {
+	crdobject, _, err := fetchAzurePipelinesPool(namespace)
+	if err != nil {
+		return err
+	}
+	ephemeral := map[string]bool{}
+	for i := range crdobject.Spec.AgentPools {
+		if isEphemeralPool(&crdobject.Spec.AgentPools[i]) {
+			ephemeral[crdobject.Spec.AgentPools[i].PoolName] = true
+		}
+	}
+
+	cs := CreateClientSet()
+	if len(ephemeral) > 0 {
+		for _, ns := range agentNamespaces(namespace) {
+			pods, err := cs.clientset.CoreV1().Pods(ns).List(metav1.ListOptions{LabelSelector: agentIdLabel})
+			if err != nil {
+				return err
+			}
+			for i := range pods.Items {
+				// Pods being deleted have been dealt with already
+				if ephemeral[pods.Items[i].Labels[agentPoolLabel]] && pods.Items[i].DeletionTimestamp == nil {
+					observeEphemeralAgent(&pods.Items[i], ns, now)
+				}
+			}
+		}
+	}
+
+	// Also the agents observed by a previous leader, whose pods may be gone already
+	entries, err := GetStorage().List(ephemeralKeyPrefix)
+	if err != nil {
+		return err
+	}
+	var deleted []EphemeralAgentRecord
+	for _, value := range entries {
+		var record EphemeralAgentRecord
+		if json.Unmarshal([]byte(value), &record) != nil {
+			continue
+		}
+		if record.State == EphemeralStateExited {
+			if err := finishEphemeralAgent(cs, &record, now); err != nil {
+				log.Println("Failed to delete the pod of ephemeral agent "+record.AgentId, err)
+				continue
+			}
+		}
+		if record.State == EphemeralStateDeleted {
+			deleted = append(deleted, record)
+		}
+	}
+	if len(deleted) == 0 {
+		return nil
+	}
+
+	if err := ReconcileWarmPools(namespace); err != nil {
+		return err
+	}
+	for _, record := range deleted {
+		record.apply(ephemeralEventReplenished, now)
+		forgetEphemeralAgent(record.AgentId)
+	}
+	return nil
+}
+
+// Moves the record of the agent of the pod along what its agent container shows.
+func observeEphemeralAgent(pod *v1.Pod, namespace string, now time.Time) {
+	agentId := pod.Labels[agentIdLabel]
+	record, ok := getEphemeralAgent(agentId)
+	if !ok {
+		record = EphemeralAgentRecord{AgentId: agentId, Pool: pod.Labels[agentPoolLabel], Pod: pod.GetName(), Namespace: namespace, State: EphemeralStatePending, UpdatedAt: now}
+	}
+	event, exitCode := ephemeralEvent(pod)
+	if record.apply(event, now) || !ok {
+		record.ExitCode = exitCode
+		saveEphemeralAgent(record)
+	}
+}
+
+// Records the outcome of the agent which exited and deletes its pod.
+func finishEphemeralAgent(cs *k8s, record *EphemeralAgentRecord, now time.Time) error {
+	outcome := AgentJobRecord{AgentId: record.AgentId, Pool: record.Pool, Job: record.Pod, Namespace: record.Namespace, Outcome: AgentJobOutcomeSucceeded, FinishedAt: record.UpdatedAt}
+	if record.ExitCode != 0 {
+		outcome.Outcome, outcome.Reason = AgentJobOutcomeFailed, "Exit code "+strconv.Itoa(int(record.ExitCode))
+	}
+	data, _ := json.Marshal(outcome)
+	if _, err := GetStorage().SetIfAbsent(agentJobKeyPrefix+record.AgentId, string(data)); err != nil {
+		return err
+	}
+
+	podClient := cs.clientset.CoreV1().Pods(record.Namespace)
+	pod, err := podClient.Get(record.Pod, metav1.GetOptions{})
+	if err == nil {
+		if err := deleteAgentWorkload(cs, pod, record.Namespace); err != nil && !k8serrors.IsNotFound(err) {
+			return err
+		}
+		agentPodsDeleted.WithLabelValues("ephemeral").Inc()
+		RecordReleasedPodCost(pod)
+		recordRunAffinity(pod)
+	} else if !k8serrors.IsNotFound(err) {
+		return err
+	}
+
+	log.Println("Ephemeral agent " + record.AgentId + " of pool " + record.Pool + " " + outcome.Outcome + ", deleted pod " + record.Pod)
+	record.apply(ephemeralEventDeleted, now)
+	saveEphemeralAgent(*record)
+	return nil
+}
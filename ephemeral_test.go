@@ -0,0 +1,98 @@
+package main
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	v1alpha1 "github.com/microsoft/poolprovider-for-k8s/pkg/apis/dev/v1alpha1"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func ephemeralPod(agentState v1.ContainerState) *v1.Pod {
+	return &v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "agent-once", Labels: map[string]string{agentIdLabel: "once-1", agentPoolLabel: "linux"}},
+		Spec:       v1.PodSpec{Containers: []v1.Container{{Name: "vsts-agent"}, {Name: "postgres"}}},
+		Status: v1.PodStatus{Phase: v1.PodRunning, ContainerStatuses: []v1.ContainerStatus{
+			{Name: "postgres", State: v1.ContainerState{Running: &v1.ContainerStateRunning{}}},
+			{Name: "vsts-agent", State: agentState},
+		}},
+	}
+}
+
+func TestEphemeralStateMachineShouldRunThroughOneJob(t *testing.T) {
+	state := EphemeralStatePending
+	for _, event := range []string{ephemeralEventStarted, ephemeralEventExited, ephemeralEventDeleted, ephemeralEventReplenished} {
+		next, ok := nextEphemeralState(state, event)
+		if !ok {
+			t.Fatalf("Expected %s to apply in state %s", event, state)
+		}
+		state = next
+	}
+	if state != EphemeralStateReplenished {
+		t.Errorf("Expected the agent replenished. Got %s", state)
+	}
+
+	if next, ok := nextEphemeralState(EphemeralStatePending, ephemeralEventExited); !ok || next != EphemeralStateExited {
+		t.Errorf("Expected an agent which exited before it was seen running to be exited. Got %s", next)
+	}
+	invalid := [][2]string{
+		{EphemeralStatePending, ephemeralEventDeleted},
+		{EphemeralStateRunning, ephemeralEventStarted},
+		{EphemeralStateExited, ephemeralEventStarted},
+		{EphemeralStateDeleted, ephemeralEventExited},
+		{EphemeralStateReplenished, ephemeralEventStarted},
+	}
+	for _, transition := range invalid {
+		if next, ok := nextEphemeralState(transition[0], transition[1]); ok {
+			t.Errorf("Expected %s not to apply in state %s. Got %s", transition[1], transition[0], next)
+		}
+	}
+}
+
+func TestEphemeralEventShouldFollowTheAgentContainer(t *testing.T) {
+	if event, _ := ephemeralEvent(ephemeralPod(v1.ContainerState{Waiting: &v1.ContainerStateWaiting{}})); event != "" {
+		t.Errorf("Expected no event while the agent is waiting. Got %s", event)
+	}
+	if event, _ := ephemeralEvent(ephemeralPod(v1.ContainerState{Running: &v1.ContainerStateRunning{}})); event != ephemeralEventStarted {
+		t.Errorf("Expected the agent started. Got %s", event)
+	}
+	// The service container keeps the pod running after the agent exited
+	event, exitCode := ephemeralEvent(ephemeralPod(v1.ContainerState{Terminated: &v1.ContainerStateTerminated{ExitCode: 2}}))
+	if event != ephemeralEventExited || exitCode != 2 {
+		t.Errorf("Expected the agent exited with code 2. Got %s %d", event, exitCode)
+	}
+}
+
+func TestAddEphemeralEnvironmentVariableShouldRunTheAgentOnce(t *testing.T) {
+	pod := ephemeralPod(v1.ContainerState{})
+	addEphemeralEnvironmentVariable(pod, &v1alpha1.AgentPoolSpec{PoolName: "linux"})
+	if len(pod.Spec.Containers[0].Env) != 0 {
+		t.Errorf("Expected the agents of other pools unchanged. Got %v", pod.Spec.Containers[0].Env)
+	}
+
+	addEphemeralEnvironmentVariable(pod, &v1alpha1.AgentPoolSpec{PoolName: "linux", Ephemeral: true})
+	env := pod.Spec.Containers[0].Env
+	if len(env) != 1 || env[0].Name != ephemeralEnvVariable || env[0].Value != "true" || pod.Spec.RestartPolicy != v1.RestartPolicyNever {
+		t.Errorf("Expected the agent to run once and never restart. Got %v %s", env, pod.Spec.RestartPolicy)
+	}
+}
+
+func TestObserveEphemeralAgentShouldRecordTheExit(t *testing.T) {
+	os.Setenv("STORAGE_BACKEND", "memory")
+	defer os.Unsetenv("STORAGE_BACKEND")
+	defer forgetEphemeralAgent("once-1")
+	now := time.Date(2026, 10, 15, 12, 0, 0, 0, time.UTC)
+
+	observeEphemeralAgent(ephemeralPod(v1.ContainerState{Running: &v1.ContainerStateRunning{}}), "azuredevops", now)
+	if record, _ := getEphemeralAgent("once-1"); record.State != EphemeralStateRunning || record.Pod != "agent-once" || record.Pool != "linux" {
+		t.Errorf("Expected the agent running. Got %+v", record)
+	}
+
+	observeEphemeralAgent(ephemeralPod(v1.ContainerState{Terminated: &v1.ContainerStateTerminated{ExitCode: 3}}), "azuredevops", now.Add(time.Minute))
+	record, _ := getEphemeralAgent("once-1")
+	if record.State != EphemeralStateExited || record.ExitCode != 3 || !record.UpdatedAt.Equal(now.Add(time.Minute)) {
+		t.Errorf("Expected the exit recorded. Got %+v", record)
+	}
+}
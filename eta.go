@@ -0,0 +1,118 @@
+package main
+
+import (
+	"math"
+	"sync"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// Wait estimates are based on moving averages of how long pod creations take and how long agent
+// pods of each pool take from creation to ready. New samples weigh a fifth, so the estimates follow
+// changes of the cluster within a few samples.
+const (
+	latencySmoothing       = 0.2
+	defaultStartupLatency  = 60 * time.Second
+	defaultCreationLatency = 2 * time.Second
+	maxObservedPods        = 10000
+)
+
+var latencyStats = struct {
+	sync.Mutex
+	creation time.Duration
+	startup  map[string]time.Duration
+	observed map[types.UID]bool
+}{startup: map[string]time.Duration{}, observed: map[types.UID]bool{}}
+
+func smooth(average time.Duration, sample time.Duration) time.Duration {
+	if average == 0 {
+		return sample
+	}
+	return time.Duration(float64(average)*(1-latencySmoothing) + float64(sample)*latencySmoothing)
+}
+
+func recordCreationLatency(duration time.Duration) {
+	latencyStats.Lock()
+	defer latencyStats.Unlock()
+	latencyStats.creation = smooth(latencyStats.creation, duration)
+}
+
+func recordStartupLatency(poolName string, duration time.Duration) {
+	latencyStats.Lock()
+	defer latencyStats.Unlock()
+	latencyStats.startup[poolName] = smooth(latencyStats.startup[poolName], duration)
+}
+
+// Takes the startup latency and the startup phases of every ready agent pod which was not seen
+// before. Pods which are not ready yet are taken once they are.
+func observeStartupLatencies(poolName string, pods []v1.Pod) {
+	for i := range pods {
+		pod := &pods[i]
+		latency, ok := podStartupLatency(pod)
+		if !ok {
+			continue
+		}
+
+		latencyStats.Lock()
+		seen := latencyStats.observed[pod.UID]
+		if !seen {
+			if len(latencyStats.observed) >= maxObservedPods {
+				latencyStats.observed = map[types.UID]bool{}
+			}
+			latencyStats.observed[pod.UID] = true
+		}
+		latencyStats.Unlock()
+
+		if !seen {
+			recordStartupLatency(poolName, latency)
+			observeStartupPhases(poolName, pod)
+		}
+	}
+}
+
+// Returns how long the pod took from creation until it became ready.
+func podStartupLatency(pod *v1.Pod) (time.Duration, bool) {
+	for _, condition := range pod.Status.Conditions {
+		if condition.Type == v1.PodReady && condition.Status == v1.ConditionTrue && !pod.CreationTimestamp.IsZero() {
+			return condition.LastTransitionTime.Sub(pod.CreationTimestamp.Time), true
+		}
+	}
+	return 0, false
+}
+
+func startupLatency(poolName string) time.Duration {
+	latencyStats.Lock()
+	defer latencyStats.Unlock()
+	if latency, ok := latencyStats.startup[poolName]; ok {
+		return latency
+	}
+	return defaultStartupLatency
+}
+
+func creationLatency() time.Duration {
+	latencyStats.Lock()
+	defer latencyStats.Unlock()
+	if latencyStats.creation == 0 {
+		return defaultCreationLatency
+	}
+	return latencyStats.creation
+}
+
+// Estimates how long a request at the given position of the creation queue waits for a ready
+// agent: the creations ahead of it run limit at a time, then its own pod has to start.
+func estimateWait(poolName string, queuePosition int, limit int) time.Duration {
+	if limit < 1 {
+		limit = 1
+	}
+	rounds := math.Ceil(float64(queuePosition+1) / float64(limit))
+	return time.Duration(rounds)*creationLatency() + startupLatency(poolName)
+}
+
+func toSeconds(duration time.Duration) int {
+	if duration < 0 {
+		return 0
+	}
+	return int(math.Ceil(duration.Seconds()))
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestEstimateWaitShouldAccountForQueuePosition(t *testing.T) {
+	recordStartupLatency("eta-pool", 30*time.Second)
+
+	if wait := estimateWait("eta-pool", 0, 2); wait != creationLatency()+30*time.Second {
+		t.Errorf("Expected one creation and the startup latency. Got %v", wait)
+	}
+	if wait := estimateWait("eta-pool", 3, 2); wait != 2*creationLatency()+30*time.Second {
+		t.Errorf("Expected two rounds of creations. Got %v", wait)
+	}
+	if wait := estimateWait("unknown-pool", 0, 1); wait != creationLatency()+defaultStartupLatency {
+		t.Errorf("Expected the default startup latency. Got %v", wait)
+	}
+}
+
+func TestObserveStartupLatenciesShouldCountPodsOnce(t *testing.T) {
+	os.Setenv("IS_TESTENVIRONMENT", "true")
+	created := time.Now().Add(-time.Minute)
+	pod := v1.Pod{ObjectMeta: metav1.ObjectMeta{UID: "eta-1", CreationTimestamp: metav1.Time{Time: created}}}
+	pod.Status.Conditions = []v1.PodCondition{{Type: v1.PodReady, Status: v1.ConditionTrue, LastTransitionTime: metav1.Time{Time: created.Add(20 * time.Second)}}}
+
+	observeStartupLatencies("observed-pool", []v1.Pod{pod})
+	recordStartupLatency("observed-pool", 20*time.Second)
+	observeStartupLatencies("observed-pool", []v1.Pod{pod})
+
+	if latency := startupLatency("observed-pool"); latency != 20*time.Second {
+		t.Errorf("Expected 20s. Got %v", latency)
+	}
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	v1alpha1 "github.com/microsoft/poolprovider-for-k8s/pkg/apis/dev/v1alpha1"
+	"github.com/microsoft/poolprovider-for-k8s/pkg/storage"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// The decisions taken for the acquire requests of a job are kept under "explain:<job id>": the pool
+// it was routed to and why, failovers, budget and quarantine checks, the warm pool, the image picked
+// for its demands and the scheduling hints of its pod. Every acquire request, e.g. a retry after a
+// failed pod creation, is another attempt. GET /explain/<job id> returns them together with the
+// node the agent pod of each attempt runs on, to answer why a job landed on a node with an image.
+// Explanations are kept for EXPLAIN_RETENTION_HOURS, 24 by default.
+const (
+	explainKeyPrefix        = "explain:"
+	explainRoute            = "/explain/"
+	defaultExplainRetention = 24 * time.Hour
+	maxExplainAttempts      = 10
+	DecisionPassed          = "passed"
+	DecisionRejected        = "rejected"
+	DecisionSkipped         = "skipped"
+)
+
+var jobIdFormat = regexp.MustCompile(`^[A-Za-z0-9-]{1,64}$`)
+
+type ProvisioningDecision struct {
+	Step    string
+	Outcome string
+	Reason  string `json:",omitempty"`
+}
+
+type ProvisioningAttempt struct {
+	AgentId   string
+	StartedAt time.Time
+	Decisions []ProvisioningDecision
+	// The node the agent pod runs on, looked up when the explanation is read
+	NodeName string `json:",omitempty"`
+}
+
+type ProvisioningExplanation struct {
+	JobId     string
+	UpdatedAt time.Time
+	Attempts  []ProvisioningAttempt
+}
+
+// The decisions of one acquire request, saved when the request is done. Requests without a valid
+// job id are not explained, all its methods are no-ops on a nil trace.
+type provisioningTrace struct {
+	jobId   string
+	attempt ProvisioningAttempt
+}
+
+func newProvisioningTrace(agentRequest AgentRequest) *provisioningTrace {
+	if !jobIdFormat.MatchString(agentRequest.JobId) {
+		return nil
+	}
+	return &provisioningTrace{
+		jobId:   agentRequest.JobId,
+		attempt: ProvisioningAttempt{AgentId: agentRequest.AgentId, StartedAt: time.Now().UTC(), Decisions: []ProvisioningDecision{}},
+	}
+}
+
+func (t *provisioningTrace) decide(step string, outcome string, reason string) {
+	if t == nil {
+		return
+	}
+	t.attempt.Decisions = append(t.attempt.Decisions, ProvisioningDecision{Step: step, Outcome: outcome, Reason: reason})
+}
+
+// Adds the attempt to the explanation of the job, keeping the last maxExplainAttempts.
+func (t *provisioningTrace) save() {
+	if t == nil {
+		return
+	}
+
+	store := GetStorage()
+	var explanation ProvisioningExplanation
+	if value, err := store.Get(explainKeyPrefix + t.jobId); err == nil {
+		json.Unmarshal([]byte(value), &explanation)
+	}
+	explanation.JobId = t.jobId
+	explanation.UpdatedAt = time.Now().UTC()
+	explanation.Attempts = append(explanation.Attempts, t.attempt)
+	if len(explanation.Attempts) > maxExplainAttempts {
+		explanation.Attempts = explanation.Attempts[len(explanation.Attempts)-maxExplainAttempts:]
+	}
+
+	data, _ := json.Marshal(explanation)
+	if err := store.Set(explainKeyPrefix+t.jobId, string(data)); err != nil {
+		log.Println("Failed to store the explanation of job "+t.jobId, err)
+	}
+}
+
+// Records an acquire request rejected before its pod was created.
+func explainRejection(agentRequest AgentRequest, step string, reason string) {
+	trace := newProvisioningTrace(agentRequest)
+	trace.decide(step, DecisionRejected, reason)
+	trace.save()
+}
+
+func explainRouting(trace *provisioningTrace, crdobject *v1alpha1.AzurePipelinesPool, agentRequest AgentRequest, poolName string, pool *v1alpha1.AgentPoolSpec) {
+	if pool == nil {
+		trace.decide("pool", DecisionRejected, "No agent pool is configured")
+		return
+	}
+	reason := "Pool named by the AgentSpec of the request"
+	if rule := matchingRoutingRule(crdobject, agentRequest); rule != nil {
+		reason = describeRoutedJob(rule, agentRequest) + " matches the routing rule " + describeRoutingRule(rule)
+	}
+	if poolName != pool.PoolName {
+		reason = "No agent pool " + poolName + ", the first pool is used"
+	}
+	trace.decide("pool", pool.PoolName, reason)
+}
+
+func explainImage(trace *provisioningTrace, demandImage string, demands []string) {
+	if demandImage == "" {
+		trace.decide("image", "default", "No image rule of the pool matches the demands")
+		return
+	}
+	trace.decide("image", demandImage, "Image rule matching the demands "+strings.Join(demands, ", "))
+}
+
+// Returns the explanation of the job.
+func ExplainHandler(resp http.ResponseWriter, req *http.Request) {
+	if !isReadRequestValid(resp, req) {
+		return
+	}
+
+	jobId := strings.TrimPrefix(req.URL.Path, explainRoute)
+	if !jobIdFormat.MatchString(jobId) {
+		writeJsonResponse(resp, http.StatusNotFound, GetError(UnknownExplanationError))
+		return
+	}
+	value, err := GetStorage().Get(explainKeyPrefix + jobId)
+	if errors.Is(err, storage.ErrNotFound) {
+		writeJsonResponse(resp, http.StatusNotFound, GetError(UnknownExplanationError))
+		return
+	} else if err != nil {
+		writeJsonResponse(resp, http.StatusInternalServerError, GetError(err.Error()))
+		return
+	}
+
+	var explanation ProvisioningExplanation
+	if err := json.Unmarshal([]byte(value), &explanation); err != nil {
+		writeJsonResponse(resp, http.StatusInternalServerError, GetError(err.Error()))
+		return
+	}
+	for i := range explanation.Attempts {
+		explanation.Attempts[i].NodeName = agentNodeName(explanation.Attempts[i].AgentId)
+	}
+	writeJsonResponse(resp, http.StatusOK, explanation)
+}
+
+// Returns the node the agent pod runs on, or an empty string when it is gone or not scheduled yet.
+func agentNodeName(agentId string) string {
+	cs := CreateClientSet()
+	for _, namespace := range permissionNamespaces() {
+		pods, err := cs.clientset.CoreV1().Pods(namespace).List(metav1.ListOptions{LabelSelector: agentIdLabel + "=" + agentId})
+		if err == nil && len(pods.Items) > 0 {
+			return pods.Items[0].Spec.NodeName
+		}
+	}
+	return ""
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"testing"
+
+	v1alpha1 "github.com/microsoft/poolprovider-for-k8s/pkg/apis/dev/v1alpha1"
+)
+
+func TestProvisioningTraceShouldAddAttemptsOfRetries(t *testing.T) {
+	os.Setenv("STORAGE_BACKEND", "memory")
+	defer os.Unsetenv("STORAGE_BACKEND")
+
+	first := newProvisioningTrace(AgentRequest{AgentId: "1", JobId: "3f2504e0-4f89-11d3-9a0c-0305e82c3301"})
+	first.decide("pod", DecisionRejected, "node pressure")
+	first.save()
+	explainRejection(AgentRequest{AgentId: "2", JobId: "3f2504e0-4f89-11d3-9a0c-0305e82c3301"}, "creation-queue", ServerBusyError)
+
+	value, err := GetStorage().Get(explainKeyPrefix + "3f2504e0-4f89-11d3-9a0c-0305e82c3301")
+	var explanation ProvisioningExplanation
+	json.Unmarshal([]byte(value), &explanation)
+	if err != nil || len(explanation.Attempts) != 2 {
+		t.Fatalf("Expected both attempts of the job. Got %+v (%v)", explanation, err)
+	}
+	if explanation.Attempts[1].AgentId != "2" || explanation.Attempts[1].Decisions[0].Step != "creation-queue" {
+		t.Errorf("Expected the retry as the second attempt. Got %+v", explanation.Attempts[1])
+	}
+}
+
+func TestProvisioningTraceShouldIgnoreRequestsWithoutJobId(t *testing.T) {
+	if trace := newProvisioningTrace(AgentRequest{AgentId: "1", JobId: "../config"}); trace != nil {
+		t.Errorf("Expected no trace for an invalid job id")
+	}
+	var trace *provisioningTrace
+	trace.decide("pool", "linux", "")
+	trace.save()
+}
+
+func TestExplainRoutingShouldNameTheMatchingRule(t *testing.T) {
+	crdobject := &v1alpha1.AzurePipelinesPool{Spec: v1alpha1.AzurePipelinesPoolSpec{
+		AgentPools:   []v1alpha1.AgentPoolSpec{{PoolName: "linux"}, {PoolName: "canary"}},
+		RoutingRules: []v1alpha1.RoutingRule{{Branch: "feature/*", PoolName: "canary"}},
+	}}
+	trace := &provisioningTrace{jobId: "1"}
+
+	explainRouting(trace, crdobject, AgentRequest{SourceBranch: "refs/heads/feature/x"}, "canary", &crdobject.Spec.AgentPools[1])
+	explainRouting(trace, crdobject, AgentRequest{AgentSpec: "windows"}, "windows", &crdobject.Spec.AgentPools[0])
+
+	decisions := trace.attempt.Decisions
+	if len(decisions) != 2 || decisions[0].Outcome != "canary" || decisions[0].Reason != "Source branch refs/heads/feature/x matches the routing rule feature/*" {
+		t.Errorf("Expected the routing rule as the reason. Got %+v", decisions)
+	}
+	if len(decisions) == 2 && decisions[1].Reason != "No agent pool windows, the first pool is used" {
+		t.Errorf("Expected the fallback to the first pool to be explained. Got %+v", decisions[1])
+	}
+}
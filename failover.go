@@ -0,0 +1,134 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"strconv"
+	"time"
+
+	v1alpha1 "github.com/microsoft/poolprovider-for-k8s/pkg/apis/dev/v1alpha1"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// A pool which cannot take a job hands it to the first of its fallback pools which can. A pool
+// cannot take jobs while it is frozen by its budget, has MaxAgents agent pods, or has an agent pod
+// the scheduler could not place for unschedulableGrace. Every failover is counted in a metric and
+// kept under "failover:<time>:<agent>" for FAILOVER_RETENTION_DAYS, 30 by default, so the pool
+// state can report recent failovers. When no pool can take the job it stays with its own pool.
+const (
+	failoverKeyPrefix         = "failover:"
+	defaultFailoverRetention  = 30 * 24 * time.Hour
+	failoverReasonFrozen      = "budget used up"
+	failoverReasonCapacity    = "at capacity"
+	failoverReasonUnscheduled = "agent pods unschedulable"
+)
+
+var unschedulableGrace = 2 * time.Minute
+
+type FailoverRecord struct {
+	AgentId      string
+	Pool         string
+	FallbackPool string
+	Reason       string
+	Timestamp    time.Time
+}
+
+// Returns the pool the job is provisioned in and, when that is a fallback pool, why the pool of
+// the job could not take it.
+func selectAvailablePool(crdobject *v1alpha1.AzurePipelinesPool, pool *v1alpha1.AgentPoolSpec, namespace string) (*v1alpha1.AgentPoolSpec, string) {
+	if pool == nil || len(pool.FallbackPools) == 0 {
+		return pool, ""
+	}
+
+	now := time.Now()
+	reason := poolUnavailability(pool, listPoolPods(pool, poolNamespace(crdobject, pool, namespace)), isPoolFrozen(pool.PoolName, now), now)
+	if reason == "" {
+		return pool, ""
+	}
+
+	for _, name := range pool.FallbackPools {
+		// FetchAgentPool falls back to the first pool for unknown names
+		fallback := v1alpha1.FetchAgentPool(crdobject, name)
+		if fallback == nil || fallback.PoolName != name || name == pool.PoolName {
+			log.Println("Skipping unknown fallback pool " + name + " of pool " + pool.PoolName)
+			continue
+		}
+		if poolUnavailability(fallback, listPoolPods(fallback, poolNamespace(crdobject, fallback, namespace)), isPoolFrozen(fallback.PoolName, now), now) == "" {
+			return fallback, reason
+		}
+	}
+	log.Println("No fallback pool of " + pool.PoolName + " can take the job, pool is " + reason)
+	return pool, ""
+}
+
+// Lists the agent pods of the pool in the cluster the pool runs in. Pods which cannot be listed are
+// taken as none, the pool is then only judged by its budget.
+func listPoolPods(pool *v1alpha1.AgentPoolSpec, namespace string) []v1.Pod {
+	cs, err := clusterClientSet(poolCluster(pool))
+	if err != nil {
+		log.Println("Failed to list the agent pods of pool "+pool.PoolName, err)
+		return nil
+	}
+	pods, err := cs.clientset.CoreV1().Pods(namespace).List(metav1.ListOptions{LabelSelector: agentPoolLabel + "=" + pool.PoolName})
+	if err != nil {
+		log.Println("Failed to list the agent pods of pool "+pool.PoolName, err)
+		return nil
+	}
+	return pods.Items
+}
+
+// Returns why the pool cannot take a job, or an empty string when it can.
+func poolUnavailability(pool *v1alpha1.AgentPoolSpec, pods []v1.Pod, frozen bool, now time.Time) string {
+	if frozen {
+		return failoverReasonFrozen
+	}
+
+	active := 0
+	for i := range pods {
+		pod := &pods[i]
+		if pod.Status.Phase == v1.PodSucceeded || pod.Status.Phase == v1.PodFailed || pod.GetDeletionTimestamp() != nil {
+			continue
+		}
+		active++
+		for _, condition := range pod.Status.Conditions {
+			if condition.Type == v1.PodScheduled && condition.Status == v1.ConditionFalse &&
+				condition.Reason == v1.PodReasonUnschedulable && now.Sub(condition.LastTransitionTime.Time) >= unschedulableGrace {
+				return failoverReasonUnscheduled
+			}
+		}
+	}
+	if pool.MaxAgents > 0 && active >= int(pool.MaxAgents) {
+		return failoverReasonCapacity
+	}
+	return ""
+}
+
+func recordFailover(agentId string, pool string, fallbackPool string, reason string) {
+	log.Println("Agent " + agentId + " of pool " + pool + " provisioned in fallback pool " + fallbackPool + ", pool is " + reason)
+	poolFailovers.WithLabelValues(pool, fallbackPool).Inc()
+
+	record := FailoverRecord{AgentId: agentId, Pool: pool, FallbackPool: fallbackPool, Reason: reason, Timestamp: time.Now().UTC()}
+	data, _ := json.Marshal(record)
+	key := failoverKeyPrefix + strconv.FormatInt(record.Timestamp.UnixNano(), 10) + ":" + agentId
+	if err := GetStorage().Set(key, string(data)); err != nil {
+		log.Println("Failed to record the failover of agent "+agentId, err)
+	}
+}
+
+// Counts the recorded failovers away from each pool.
+func countFailovers() map[string]int {
+	counts := map[string]int{}
+	values, err := GetStorage().List(failoverKeyPrefix)
+	if err != nil {
+		log.Println("Failed to read the failover records", err)
+		return counts
+	}
+	for _, value := range values {
+		var record FailoverRecord
+		if json.Unmarshal([]byte(value), &record) == nil {
+			counts[record.Pool]++
+		}
+	}
+	return counts
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	v1alpha1 "github.com/microsoft/poolprovider-for-k8s/pkg/apis/dev/v1alpha1"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func agentPodInPhase(phase v1.PodPhase) v1.Pod {
+	return v1.Pod{Status: v1.PodStatus{Phase: phase}}
+}
+
+func TestPoolUnavailabilityShouldCountActiveAgentsAgainstMaxAgents(t *testing.T) {
+	pool := &v1alpha1.AgentPoolSpec{PoolName: "linux", MaxAgents: 2}
+	now := time.Now()
+
+	pods := []v1.Pod{agentPodInPhase(v1.PodRunning), agentPodInPhase(v1.PodSucceeded)}
+	if reason := poolUnavailability(pool, pods, false, now); reason != "" {
+		t.Errorf("Expected finished pods not to count. Got %q", reason)
+	}
+
+	pods = append(pods, agentPodInPhase(v1.PodPending))
+	if reason := poolUnavailability(pool, pods, false, now); reason != failoverReasonCapacity {
+		t.Errorf("Expected the pool to be at capacity. Got %q", reason)
+	}
+}
+
+func TestPoolUnavailabilityShouldReportFrozenPools(t *testing.T) {
+	if reason := poolUnavailability(&v1alpha1.AgentPoolSpec{PoolName: "linux"}, nil, true, time.Now()); reason != failoverReasonFrozen {
+		t.Errorf("Expected a frozen pool to be unavailable. Got %q", reason)
+	}
+}
+
+func TestPoolUnavailabilityShouldReportPodsUnschedulablePastTheGrace(t *testing.T) {
+	now := time.Now()
+	unschedulable := func(since time.Time) v1.Pod {
+		pod := agentPodInPhase(v1.PodPending)
+		pod.Status.Conditions = []v1.PodCondition{{
+			Type:               v1.PodScheduled,
+			Status:             v1.ConditionFalse,
+			Reason:             v1.PodReasonUnschedulable,
+			LastTransitionTime: metav1.NewTime(since),
+		}}
+		return pod
+	}
+	pool := &v1alpha1.AgentPoolSpec{PoolName: "gpu"}
+
+	if reason := poolUnavailability(pool, []v1.Pod{unschedulable(now.Add(-30 * time.Second))}, false, now); reason != "" {
+		t.Errorf("Expected a pod just waiting for the scheduler to be fine. Got %q", reason)
+	}
+	if reason := poolUnavailability(pool, []v1.Pod{unschedulable(now.Add(-10 * time.Minute))}, false, now); reason != failoverReasonUnscheduled {
+		t.Errorf("Expected the pool to be unavailable. Got %q", reason)
+	}
+}
+
+func TestSelectAvailablePoolShouldCountTheAgentPodsInTheClusterOfThePool(t *testing.T) {
+	SetupCustomResource()
+	if getClusterRegistry() == nil {
+		clusterRegistry.clusters = map[string]ClusterConfig{}
+	}
+	clusterRegistry.clusters["westus"] = ClusterConfig{Name: "westus", InCluster: true}
+	defer delete(clusterRegistry.clusters, "westus")
+	defer delete(clusterRegistry.clientsets, "westus")
+	remote, _ := clusterClientSet("westus")
+
+	crdobject := &v1alpha1.AzurePipelinesPool{Spec: v1alpha1.AzurePipelinesPoolSpec{AgentPools: []v1alpha1.AgentPoolSpec{
+		{PoolName: "remote", Cluster: "westus", MaxAgents: 1, FallbackPools: []string{"local"}},
+		{PoolName: "local"},
+	}}}
+	pod := agentPodInPhase(v1.PodRunning)
+	pod.ObjectMeta = metav1.ObjectMeta{Name: "agent-remote", Namespace: testnamespace, Labels: map[string]string{agentPoolLabel: "remote"}}
+	remote.clientset.CoreV1().Pods(testnamespace).Create(&pod)
+
+	selected, reason := selectAvailablePool(crdobject, &crdobject.Spec.AgentPools[0], testnamespace)
+	if selected.PoolName != "local" || reason != failoverReasonCapacity {
+		t.Errorf("Expected the remote pool at capacity with its pod in cluster westus. Got %s %q", selected.PoolName, reason)
+	}
+}
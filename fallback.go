@@ -0,0 +1,93 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+)
+
+// Requests for paths the provider does not serve can be handed to another internal service, when
+// the provider shares a hostname with it. FALLBACK_URL is the service, FALLBACK_PATHS the comma
+// separated paths which may be forwarded together with the paths below them, and FALLBACK_MODE
+// either "proxy" (default) or "redirect". Paths outside the allow-list get a 404; "/docs" allows
+// "/docs/index.html" but not "/docs-internal", and paths are cleaned of "." and ".." first.
+const (
+	FallbackModeProxy    = "proxy"
+	FallbackModeRedirect = "redirect"
+)
+
+type fallbackRoute struct {
+	target   *url.URL
+	mode     string
+	prefixes []string
+	proxy    *httputil.ReverseProxy
+}
+
+func newFallbackRouteFromEnvironment() *fallbackRoute {
+	return newFallbackRoute(os.Getenv("FALLBACK_URL"), os.Getenv("FALLBACK_MODE"), os.Getenv("FALLBACK_PATHS"))
+}
+
+func newFallbackRoute(target string, mode string, paths string) *fallbackRoute {
+	if target == "" {
+		return nil
+	}
+	targetUrl, err := url.Parse(target)
+	if err != nil || targetUrl.Scheme == "" || targetUrl.Host == "" {
+		log.Println("Ignoring invalid FALLBACK_URL " + target)
+		return nil
+	}
+	mode = strings.ToLower(strings.TrimSpace(mode))
+	if mode == "" {
+		mode = FallbackModeProxy
+	}
+	if mode != FallbackModeProxy && mode != FallbackModeRedirect {
+		log.Println("Ignoring FALLBACK_URL, FALLBACK_MODE " + mode + " is neither " + FallbackModeProxy + " nor " + FallbackModeRedirect)
+		return nil
+	}
+
+	route := &fallbackRoute{target: targetUrl, mode: mode}
+	for _, prefix := range strings.Split(paths, ",") {
+		if prefix = strings.TrimSpace(prefix); prefix != "" {
+			route.prefixes = append(route.prefixes, prefix)
+		}
+	}
+	if mode == FallbackModeProxy {
+		route.proxy = httputil.NewSingleHostReverseProxy(targetUrl)
+		route.proxy.Transport = outboundTransport
+	}
+	return route
+}
+
+func (f *fallbackRoute) allows(requestPath string) bool {
+	requestPath = path.Clean("/" + requestPath)
+	for _, prefix := range f.prefixes {
+		prefix = strings.TrimSuffix(prefix, "/")
+		if requestPath == prefix || strings.HasPrefix(requestPath, prefix+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// Serves every path without a handler of its own.
+func fallbackHandler(route *fallbackRoute) http.HandlerFunc {
+	return func(resp http.ResponseWriter, req *http.Request) {
+		if route == nil || !route.allows(req.URL.Path) {
+			writeJsonResponse(resp, http.StatusNotFound, GetError(UnknownRouteError))
+			return
+		}
+
+		if route.mode == FallbackModeRedirect {
+			location := *route.target
+			location.Path = strings.TrimSuffix(location.Path, "/") + req.URL.Path
+			location.RawQuery = req.URL.RawQuery
+			http.Redirect(resp, req, location.String(), http.StatusTemporaryRedirect)
+			return
+		}
+		route.proxy.ServeHTTP(resp, req)
+	}
+}
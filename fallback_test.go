@@ -0,0 +1,82 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestFallbackShouldProxyAllowedPaths(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("backend " + r.URL.Path))
+	}))
+	defer backend.Close()
+
+	handler := fallbackHandler(newFallbackRoute(backend.URL, "", "/docs, /status-page"))
+
+	resp := httptest.NewRecorder()
+	handler(resp, httptest.NewRequest("GET", "/docs/index.html", nil))
+	if resp.Code != http.StatusOK || resp.Body.String() != "backend /docs/index.html" {
+		t.Errorf("Expected the request to be proxied. Got %d %s", resp.Code, resp.Body.String())
+	}
+
+	resp = httptest.NewRecorder()
+	handler(resp, httptest.NewRequest("GET", "/internal", nil))
+	if resp.Code != http.StatusNotFound {
+		t.Errorf("Expected paths outside the allow-list to be rejected. Got %d", resp.Code)
+	}
+}
+
+func TestFallbackShouldOnlyAllowThePathsBelowTheAllowedOnes(t *testing.T) {
+	route := newFallbackRoute("http://docs.internal", "", "/docs, /status-page/")
+
+	for path, allowed := range map[string]bool{
+		"/docs":                true,
+		"/docs/index.html":     true,
+		"/status-page":         true,
+		"/status-page/today":   true,
+		"/docs-internal":       false,
+		"/docsadmin/users":     false,
+		"/docs/../admin":       false,
+		"/status-page-private": false,
+	} {
+		if route.allows(path) != allowed {
+			t.Errorf("Expected %s allowed to be %v", path, allowed)
+		}
+	}
+}
+
+func TestFallbackShouldRedirectInRedirectMode(t *testing.T) {
+	handler := fallbackHandler(newFallbackRoute("https://portal.contoso.com/base", FallbackModeRedirect, "/"))
+
+	resp := httptest.NewRecorder()
+	handler(resp, httptest.NewRequest("GET", "/help?topic=pools", nil))
+	if resp.Code != http.StatusTemporaryRedirect || resp.Header().Get("Location") != "https://portal.contoso.com/base/help?topic=pools" {
+		t.Errorf("Unexpected redirect %d %s", resp.Code, resp.Header().Get("Location"))
+	}
+}
+
+func TestFallbackShouldReturnNotFoundWithoutTarget(t *testing.T) {
+	resp := httptest.NewRecorder()
+	fallbackHandler(newFallbackRoute("", "", "/"))(resp, httptest.NewRequest("GET", "/anything", nil))
+
+	if resp.Code != http.StatusNotFound {
+		t.Errorf("Expected 404. Got %d", resp.Code)
+	}
+}
+
+func TestFallbackShouldIgnoreAnUnknownMode(t *testing.T) {
+	if route := newFallbackRoute("https://portal.contoso.com", "Redirect", "/"); route == nil || route.mode != FallbackModeRedirect {
+		t.Errorf("Expected the mode matched regardless of case. Got %+v", route)
+	}
+	route := newFallbackRoute("https://portal.contoso.com", "prxy", "/")
+	if route != nil {
+		t.Fatalf("Expected no fallback for an unknown mode. Got %+v", route)
+	}
+
+	resp := httptest.NewRecorder()
+	fallbackHandler(route)(resp, httptest.NewRequest("GET", "/anything", nil))
+	if resp.Code != http.StatusNotFound {
+		t.Errorf("Expected 404. Got %d", resp.Code)
+	}
+}
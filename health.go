@@ -0,0 +1,118 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"sync/atomic"
+
+	authorizationv1 "k8s.io/api/authorization/v1"
+)
+
+// GET /healthz tells the liveness probe that the process serves requests and checks nothing else,
+// so a failing dependency does not get the webserver restarted. GET /readyz tells the readiness
+// probe whether the replica can handle an acquire: the storage answers, the Kubernetes API answers
+// and the service account may create pods in the namespace of the provider. It answers 503 with the
+// failed checks while one of them fails, and from the start of the drain on shutdown, so no new
+// requests are routed to a replica which is going away. Probes are not signed, and neither
+// endpoint returns more than the names of the checks and their errors.
+const (
+	HealthStatusOk          = "ok"
+	HealthStatusUnavailable = "unavailable"
+	healthKeyPrefix         = "health:"
+)
+
+type HealthCheck struct {
+	Name  string
+	Ok    bool
+	Error string `json:",omitempty"`
+}
+
+type HealthReport struct {
+	Status string
+	Checks []HealthCheck `json:",omitempty"`
+}
+
+type healthCheck struct {
+	name  string
+	check func() error
+}
+
+var serverDraining int32
+
+func setDraining() {
+	atomic.StoreInt32(&serverDraining, 1)
+}
+
+func isDraining() bool {
+	return atomic.LoadInt32(&serverDraining) == 1
+}
+
+func readinessChecks() []healthCheck {
+	return []healthCheck{
+		{name: "storage", check: checkStorageReachable},
+		{name: "kubernetes", check: checkKubernetesReachable},
+		{name: "pod-create-permission", check: func() error { return checkPodCreatePermission(podnamespace) }},
+	}
+}
+
+func checkStorageReachable() error {
+	_, err := GetStorage().List(healthKeyPrefix)
+	return err
+}
+
+func checkKubernetesReachable() error {
+	_, err := CreateClientSet().clientset.Discovery().ServerVersion()
+	return err
+}
+
+func checkPodCreatePermission(namespace string) error {
+	review, err := CreateClientSet().clientset.AuthorizationV1().SelfSubjectAccessReviews().Create(&authorizationv1.SelfSubjectAccessReview{
+		Spec: authorizationv1.SelfSubjectAccessReviewSpec{ResourceAttributes: &authorizationv1.ResourceAttributes{
+			Namespace: namespace,
+			Verb:      "create",
+			Resource:  "pods",
+		}},
+	})
+	if err != nil {
+		return err
+	}
+	if !review.Status.Allowed {
+		return errors.New("the service account may not create pods in namespace " + namespace)
+	}
+	return nil
+}
+
+// Runs every check, also after one failed, so the report names all failing dependencies.
+func runHealthChecks(checks []healthCheck) HealthReport {
+	report := HealthReport{Status: HealthStatusOk}
+	for _, check := range checks {
+		result := HealthCheck{Name: check.name, Ok: true}
+		if err := check.check(); err != nil {
+			result.Ok, result.Error = false, err.Error()
+			report.Status = HealthStatusUnavailable
+		}
+		report.Checks = append(report.Checks, result)
+	}
+	return report
+}
+
+func LivenessHandler(resp http.ResponseWriter, req *http.Request) {
+	writeJsonResponse(resp, http.StatusOK, HealthReport{Status: HealthStatusOk})
+}
+
+func ReadinessHandler(resp http.ResponseWriter, req *http.Request) {
+	if isDraining() {
+		writeJsonResponse(resp, http.StatusServiceUnavailable, HealthReport{
+			Status: HealthStatusUnavailable,
+			Checks: []HealthCheck{{Name: "shutdown", Error: "the webserver is draining its requests"}},
+		})
+		return
+	}
+
+	report := runHealthChecks(readinessChecks())
+	status := http.StatusOK
+	if report.Status != HealthStatusOk {
+		status = http.StatusServiceUnavailable
+	}
+	writeJsonResponse(resp, status, report)
+}
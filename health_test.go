@@ -0,0 +1,45 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+)
+
+func TestRunHealthChecksShouldReportEveryFailure(t *testing.T) {
+	report := runHealthChecks([]healthCheck{
+		{name: "storage", check: func() error { return errors.New("configmaps is forbidden") }},
+		{name: "kubernetes", check: func() error { return nil }},
+		{name: "pod-create-permission", check: func() error { return errors.New("denied") }},
+	})
+
+	if report.Status != HealthStatusUnavailable || len(report.Checks) != 3 {
+		t.Errorf("Expected all checks reported as unavailable. Got %v", report)
+	}
+	if report.Checks[0].Ok || report.Checks[0].Error != "configmaps is forbidden" || !report.Checks[1].Ok || report.Checks[2].Ok {
+		t.Errorf("Unexpected checks %v", report.Checks)
+	}
+
+	if report := runHealthChecks([]healthCheck{{name: "storage", check: func() error { return nil }}}); report.Status != HealthStatusOk {
+		t.Errorf("Expected ok. Got %v", report)
+	}
+}
+
+func TestReadinessHandlerShouldFailWhileDraining(t *testing.T) {
+	setDraining()
+	defer atomic.StoreInt32(&serverDraining, 0)
+
+	resp := httptest.NewRecorder()
+	ReadinessHandler(resp, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	if resp.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected 503 while draining. Got %d", resp.Code)
+	}
+
+	resp = httptest.NewRecorder()
+	LivenessHandler(resp, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+	if resp.Code != http.StatusOK {
+		t.Errorf("Expected the liveness probe to pass while draining. Got %d", resp.Code)
+	}
+}
@@ -22,21 +22,31 @@ func ComputeHash(message string) string {
 	return hashedMessage
 }
 
+// While VSTS_SECRET is rotated, signatures made with the secret in VSTS_SECRET_PREVIOUS are accepted
+// as well, until Azure DevOps signs with the new secret. Signatures are always made with VSTS_SECRET.
 func ValidateHash(message, inputHmac string) bool {
 	hashAlgorithm := GetHashAlgorithm()
 	if(hashAlgorithm == nil) {
 		return false;
 	}
 
-	hashAlgorithm.Write([]byte(message))
-	expectedMAC := hashAlgorithm.Sum(nil)
-
-	//return hmac.Equal(inputHMACbytearr, expectedMAC)
 	inputHMacArr, err := hex.DecodeString(inputHmac)
 	if err != nil {
-		log.Fatal(err)
+		log.Println("Signature is not hex encoded", err)
+		return false
+	}
+
+	for _, secret := range []string{os.Getenv("VSTS_SECRET"), os.Getenv("VSTS_SECRET_PREVIOUS")} {
+		if secret == "" {
+			continue
+		}
+		mac := hmac.New(sha512.New, []byte(secret))
+		mac.Write([]byte(message))
+		if hmac.Equal(inputHMacArr, mac.Sum(nil)) {
+			return true
+		}
 	}
-	return hmac.Equal(inputHMacArr, expectedMAC)
+	return false
 }
 
 func GetHashAlgorithm() hash.Hash {
@@ -40,4 +40,30 @@ func TestValidateHashShouldReturnFalseIfSecretIsNotSet(t *testing.T) {
 	if (check == true){
 		t.Errorf("Hmac validation failed")
 	}
+}
+
+func TestValidateHashShouldAcceptPreviousSecretDuringRotation(t *testing.T) {
+	defer os.Setenv("VSTS_SECRET", "sharedsecret1234")
+	defer os.Unsetenv("VSTS_SECRET_PREVIOUS")
+
+	os.Setenv("VSTS_SECRET", "sharedsecret-old")
+	str := ComputeHash("teststring")
+
+	os.Setenv("VSTS_SECRET", "sharedsecret-new")
+	os.Setenv("VSTS_SECRET_PREVIOUS", "sharedsecret-old")
+	if !ValidateHash("teststring", str) {
+		t.Errorf("Expected the signature of the previous secret to be accepted")
+	}
+
+	os.Unsetenv("VSTS_SECRET_PREVIOUS")
+	if ValidateHash("teststring", str) {
+		t.Errorf("Expected the signature of the previous secret to be rejected after the rotation")
+	}
+}
+
+func TestValidateHashShouldRejectSignaturesWhichAreNotHex(t *testing.T) {
+	os.Setenv("VSTS_SECRET", "sharedsecret1234")
+	if ValidateHash("teststring", "not-a-signature") {
+		t.Errorf("Expected a malformed signature to be rejected")
+	}
 }
\ No newline at end of file
@@ -84,6 +84,18 @@ func TestAcquireHandlerShouldFailIfHmacNotValid(t *testing.T) {
 	}
 }
 
+func TestAcquireHandlerShouldAskForSignature(t *testing.T) {
+	req, _ := http.NewRequest("POST", "/acquire", bytes.NewBuffer([]byte(`{"AgentId":"12"}`)))
+	req.Header.Add("Content-Type", "application/json")
+
+	resp := httptest.NewRecorder()
+	http.HandlerFunc(AcquireAgentHandler).ServeHTTP(resp, req)
+
+	if resp.Code != http.StatusUnauthorized || resp.Header().Get("WWW-Authenticate") != signatureScheme {
+		t.Errorf("Expected 401 for an unsigned request. Got %d", resp.Code)
+	}
+}
+
 func TestReleaseHandlerShouldBeSuccessful(t *testing.T) {
 	SetupCustomResource()
 	var agentrequest AgentRequest
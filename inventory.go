@@ -0,0 +1,250 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	v1alpha1 "github.com/microsoft/poolprovider-for-k8s/pkg/apis/dev/v1alpha1"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// GET /pools/<pool>/agents lists the agents the provider manages for a pool, by name or by
+// AzureDevOpsPoolId: the live agent pods of the pool in every agent namespace, merged with what the
+// storage knows about them, the job they were acquired for and how far they got since their pod was
+// created. Agents whose pod is gone but which were not released yet, e.g. of Job pools, are listed
+// from the storage alone. The provider gets no heartbeats from the agents, LastHeartbeat is the last
+// time it saw the agent change. Like GET /pools the list is paged, with limit, 100 by default, and
+// the continue token of the previous page.
+const (
+	poolsRoute      = "/pools/"
+	agentsRouteTail = "/agents"
+	defaultPageSize = 100
+	maxPageSize     = 1000
+)
+
+type AgentInventory struct {
+	AgentId    string
+	Namespace  string `json:",omitempty"`
+	PodName    string `json:",omitempty"`
+	Phase      string `json:",omitempty"`
+	Ready      bool
+	AgeSeconds int    `json:",omitempty"`
+	JobId      string `json:",omitempty"`
+	// State of the startup watch, or the outcome of a Job or ephemeral agent which exited
+	State         string     `json:",omitempty"`
+	LastHeartbeat *time.Time `json:",omitempty"`
+}
+
+type AgentInventoryPage struct {
+	Pool     string
+	Agents   []AgentInventory
+	Continue string `json:",omitempty"`
+}
+
+// Returns the bounds of the page of a list of total items the request asks for, and the continue
+// token of the next page.
+func requestedPage(req *http.Request, total int) (int, int, string, error) {
+	limit := defaultPageSize
+	if value := req.URL.Query().Get("limit"); value != "" {
+		var err error
+		if limit, err = strconv.Atoi(value); err != nil || limit <= 0 {
+			return 0, 0, "", errors.New(InvalidPageError)
+		}
+	}
+	if limit > maxPageSize {
+		limit = maxPageSize
+	}
+	start := 0
+	if value := req.URL.Query().Get("continue"); value != "" {
+		var err error
+		if start, err = strconv.Atoi(value); err != nil || start < 0 || start > total {
+			return 0, 0, "", errors.New(InvalidPageError)
+		}
+	}
+
+	end := start + limit
+	if end >= total {
+		return start, total, "", nil
+	}
+	return start, end, strconv.Itoa(end), nil
+}
+
+// Returns the pool named in the path, or whose AzureDevOpsPoolId the path holds.
+func findInventoryPool(crdobject *v1alpha1.AzurePipelinesPool, name string) *v1alpha1.AgentPoolSpec {
+	for i := range crdobject.Spec.AgentPools {
+		if crdobject.Spec.AgentPools[i].PoolName == name {
+			return &crdobject.Spec.AgentPools[i]
+		}
+	}
+	if id, err := strconv.Atoi(name); err == nil && id != 0 {
+		for i := range crdobject.Spec.AgentPools {
+			if int(crdobject.Spec.AgentPools[i].AzureDevOpsPoolId) == id {
+				return &crdobject.Spec.AgentPools[i]
+			}
+		}
+	}
+	return nil
+}
+
+func PoolAgentsHandler(resp http.ResponseWriter, req *http.Request) {
+	if !isReadRequestValid(resp, req) {
+		return
+	}
+	name := strings.TrimPrefix(req.URL.Path, poolsRoute)
+	if !strings.HasSuffix(name, agentsRouteTail) {
+		writeJsonResponse(resp, http.StatusNotFound, GetError(UnknownRouteError))
+		return
+	}
+	name = strings.TrimSuffix(name, agentsRouteTail)
+
+	crdobject, _, err := fetchAzurePipelinesPool(podnamespace)
+	if err != nil {
+		writeJsonResponse(resp, http.StatusInternalServerError, GetError(err.Error()))
+		return
+	}
+	pool := findInventoryPool(crdobject, name)
+	if pool == nil {
+		writeJsonResponse(resp, http.StatusNotFound, GetError(UnknownPoolError))
+		return
+	}
+
+	agents, err := collectAgentInventory(CreateClientSet(), pool.PoolName, podnamespace, time.Now().UTC())
+	if err != nil {
+		writeJsonResponse(resp, http.StatusInternalServerError, GetError(err.Error()))
+		return
+	}
+	start, end, next, err := requestedPage(req, len(agents))
+	if err != nil {
+		writeJsonResponse(resp, http.StatusBadRequest, GetError(err.Error()))
+		return
+	}
+	writeJsonResponse(resp, http.StatusOK, AgentInventoryPage{Pool: pool.PoolName, Agents: agents[start:end], Continue: next})
+}
+
+// Returns the agents of the pool, sorted by agent id.
+func collectAgentInventory(cs *k8s, poolName string, namespace string, now time.Time) ([]AgentInventory, error) {
+	agents := map[string]*AgentInventory{}
+	for _, ns := range agentNamespaces(namespace) {
+		pods, err := cs.clientset.CoreV1().Pods(ns).List(metav1.ListOptions{LabelSelector: agentPoolLabel + "=" + poolName})
+		if err != nil {
+			return nil, err
+		}
+		for i := range pods.Items {
+			pod := &pods.Items[i]
+			agentId := pod.Labels[agentIdLabel]
+			if agentId == "" {
+				continue
+			}
+			agent := &AgentInventory{AgentId: agentId, Namespace: ns, PodName: pod.GetName(), Phase: string(pod.Status.Phase), Ready: isPodConditionTrue(pod, v1.PodReady)}
+			if !pod.CreationTimestamp.IsZero() {
+				agent.AgeSeconds = toSeconds(now.Sub(pod.CreationTimestamp.Time))
+			}
+			for _, condition := range pod.Status.Conditions {
+				agent.heartbeat(condition.LastTransitionTime.Time)
+			}
+			agents[agentId] = agent
+		}
+	}
+
+	// What the storage knows about the agents, also of the ones whose pod is gone
+	if err := mergeStoredAgents(agents, startupKeyPrefix, poolName, func(value string, agent *AgentInventory) (string, bool) {
+		var record AgentStartupRecord
+		if json.Unmarshal([]byte(value), &record) != nil {
+			return "", false
+		}
+		agent.State = record.State
+		agent.heartbeat(record.UpdatedAt)
+		return record.Pool, true
+	}); err != nil {
+		return nil, err
+	}
+	if err := mergeStoredAgents(agents, ephemeralKeyPrefix, poolName, func(value string, agent *AgentInventory) (string, bool) {
+		var record EphemeralAgentRecord
+		if json.Unmarshal([]byte(value), &record) != nil {
+			return "", false
+		}
+		agent.State = record.State
+		agent.heartbeat(record.UpdatedAt)
+		return record.Pool, true
+	}); err != nil {
+		return nil, err
+	}
+	if err := mergeStoredAgents(agents, agentJobKeyPrefix, poolName, func(value string, agent *AgentInventory) (string, bool) {
+		var record AgentJobRecord
+		if json.Unmarshal([]byte(value), &record) != nil {
+			return "", false
+		}
+		agent.State, agent.JobId = record.Outcome, record.Job
+		agent.heartbeat(record.FinishedAt)
+		return record.Pool, true
+	}); err != nil {
+		return nil, err
+	}
+	jobs, err := agentJobIds()
+	if err != nil {
+		return nil, err
+	}
+
+	inventory := make([]AgentInventory, 0, len(agents))
+	for agentId, agent := range agents {
+		if agent.JobId == "" {
+			agent.JobId = jobs[agentId]
+		}
+		inventory = append(inventory, *agent)
+	}
+	sort.Slice(inventory, func(i, j int) bool { return inventory[i].AgentId < inventory[j].AgentId })
+	return inventory, nil
+}
+
+func (agent *AgentInventory) heartbeat(at time.Time) {
+	if at.IsZero() || (agent.LastHeartbeat != nil && !at.After(*agent.LastHeartbeat)) {
+		return
+	}
+	at = at.UTC()
+	agent.LastHeartbeat = &at
+}
+
+// Merges the records under the prefix into the agents. apply decodes the record into the agent and
+// returns the pool of the record, records of other pools are left out.
+func mergeStoredAgents(agents map[string]*AgentInventory, prefix string, poolName string, apply func(value string, agent *AgentInventory) (string, bool)) error {
+	entries, err := GetStorage().List(prefix)
+	if err != nil {
+		return err
+	}
+	for key, value := range entries {
+		agentId := strings.TrimPrefix(key, prefix)
+		agent, ok := agents[agentId]
+		if !ok {
+			agent = &AgentInventory{AgentId: agentId}
+		}
+		if pool, decoded := apply(value, agent); decoded && pool == poolName {
+			agents[agentId] = agent
+		}
+	}
+	return nil
+}
+
+// Returns the job each agent was acquired for, from the explanations of the jobs.
+func agentJobIds() (map[string]string, error) {
+	entries, err := GetStorage().List(explainKeyPrefix)
+	if err != nil {
+		return nil, err
+	}
+	jobs := map[string]string{}
+	for _, value := range entries {
+		var explanation ProvisioningExplanation
+		if json.Unmarshal([]byte(value), &explanation) != nil {
+			continue
+		}
+		for _, attempt := range explanation.Attempts {
+			jobs[attempt.AgentId] = explanation.JobId
+		}
+	}
+	return jobs, nil
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestRequestedPageShouldFollowTheContinueToken(t *testing.T) {
+	start, end, next, err := requestedPage(httptest.NewRequest("GET", "/pools?limit=2", nil), 5)
+	if err != nil || start != 0 || end != 2 || next != "2" {
+		t.Errorf("Expected the first two items. Got %d %d %q %v", start, end, next, err)
+	}
+	start, end, next, err = requestedPage(httptest.NewRequest("GET", "/pools?limit=2&continue=4", nil), 5)
+	if err != nil || start != 4 || end != 5 || next != "" {
+		t.Errorf("Expected the last page. Got %d %d %q %v", start, end, next, err)
+	}
+	if _, _, _, err = requestedPage(httptest.NewRequest("GET", "/pools?continue=6", nil), 5); err == nil {
+		t.Errorf("Expected a token past the end rejected")
+	}
+	if _, end, _, _ = requestedPage(httptest.NewRequest("GET", "/pools?limit=5000", nil), 2000); end != maxPageSize {
+		t.Errorf("Expected the limit capped. Got %d", end)
+	}
+}
+
+func TestCollectAgentInventoryShouldMergePodsWithTheStorage(t *testing.T) {
+	os.Setenv("STORAGE_BACKEND", "memory")
+	defer os.Unsetenv("STORAGE_BACKEND")
+	now := time.Date(2026, 10, 15, 12, 0, 0, 0, time.UTC)
+	pod := &v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "agent-a", Namespace: "azuredevops", CreationTimestamp: metav1.NewTime(now.Add(-time.Minute)),
+			Labels: map[string]string{agentIdLabel: "inventory-1", agentPoolLabel: "linux"}},
+		Status: v1.PodStatus{Phase: v1.PodRunning, Conditions: []v1.PodCondition{{Type: v1.PodReady, Status: v1.ConditionTrue, LastTransitionTime: metav1.NewTime(now.Add(-30 * time.Second))}}},
+	}
+	cs := &k8s{clientset: fake.NewSimpleClientset(pod)}
+
+	startup, _ := json.Marshal(AgentStartupRecord{AgentId: "inventory-1", Pool: "linux", State: StartupStateReady, UpdatedAt: now.Add(-40 * time.Second)})
+	job, _ := json.Marshal(AgentJobRecord{AgentId: "inventory-2", Pool: "linux", Job: "inventory-job-2", Outcome: AgentJobOutcomeSucceeded, FinishedAt: now.Add(-10 * time.Second)})
+	other, _ := json.Marshal(AgentJobRecord{AgentId: "inventory-3", Pool: "windows", Outcome: AgentJobOutcomeSucceeded})
+	explanation, _ := json.Marshal(ProvisioningExplanation{JobId: "inventory-job-1", Attempts: []ProvisioningAttempt{{AgentId: "inventory-1"}}})
+	entries := map[string]string{startupKeyPrefix + "inventory-1": string(startup), agentJobKeyPrefix + "inventory-2": string(job), agentJobKeyPrefix + "inventory-3": string(other), explainKeyPrefix + "inventory-job-1": string(explanation)}
+	for key, value := range entries {
+		GetStorage().Set(key, value)
+		defer GetStorage().Delete(key)
+	}
+
+	agents, err := collectAgentInventory(cs, "linux", "azuredevops", now)
+	if err != nil || len(agents) != 2 {
+		t.Fatalf("Expected the agents of the pool. Got %+v %v", agents, err)
+	}
+	first := agents[0]
+	if first.PodName != "agent-a" || !first.Ready || first.AgeSeconds != 60 || first.JobId != "inventory-job-1" || first.State != StartupStateReady || !first.LastHeartbeat.Equal(now.Add(-30*time.Second)) {
+		t.Errorf("Expected the pod merged with its startup and job. Got %+v", first)
+	}
+	if second := agents[1]; second.PodName != "" || second.JobId != "inventory-job-2" || second.State != AgentJobOutcomeSucceeded {
+		t.Errorf("Expected the agent without pod from the storage. Got %+v", second)
+	}
+}
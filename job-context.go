@@ -0,0 +1,69 @@
+package main
+
+import (
+	"encoding/json"
+
+	v1 "k8s.io/api/core/v1"
+)
+
+// The job context is written to the agent secret next to the agent settings, so build scripts can
+// read it from the mounted secret. AZP_JOB_CONTEXT holds the path of the file.
+const (
+	jobContextFile        = "job-context.json"
+	jobContextEnvVariable = "AZP_JOB_CONTEXT"
+	agentCredsVolume      = "agent-creds"
+)
+
+// JobContext is the part of the acquire request which is safe to hand to the build. Tokens,
+// credentials and agent settings are left out.
+type JobContext struct {
+	AgentId      string
+	AgentPool    string
+	JobId        string   `json:",omitempty"`
+	Definition   string   `json:",omitempty"`
+	Repository   string   `json:",omitempty"`
+	RunId        string   `json:",omitempty"`
+	SourceBranch string   `json:",omitempty"`
+	Demands      []string `json:",omitempty"`
+	IsScheduled  bool
+	IsPublic     bool
+	TraceParent  string `json:",omitempty"`
+	TraceState   string `json:",omitempty"`
+}
+
+func newJobContext(request AgentRequest) JobContext {
+	return JobContext{
+		AgentId:      request.AgentId,
+		AgentPool:    request.AgentPool,
+		JobId:        request.JobId,
+		Definition:   request.Definition,
+		Repository:   request.Repository,
+		RunId:        request.RunId,
+		SourceBranch: request.SourceBranch,
+		Demands:      request.Demands,
+		IsScheduled:  request.IsScheduled,
+		IsPublic:     request.IsPublic,
+		TraceParent:  request.TraceParent,
+		TraceState:   request.TraceState,
+	}
+}
+
+func marshalJobContext(request AgentRequest) []byte {
+	data, _ := json.MarshalIndent(newJobContext(request), "", "  ")
+	return data
+}
+
+// Points AZP_JOB_CONTEXT of the agent container at the job context file in the mounted secret.
+func addJobContextEnvironmentVariable(pod *v1.Pod) {
+	if pod == nil || len(pod.Spec.Containers) == 0 {
+		return
+	}
+
+	container := &pod.Spec.Containers[0]
+	for _, mount := range container.VolumeMounts {
+		if mount.Name == agentCredsVolume {
+			container.Env = append(container.Env, v1.EnvVar{Name: jobContextEnvVariable, Value: mount.MountPath + "/" + jobContextFile})
+			return
+		}
+	}
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	v1 "k8s.io/api/core/v1"
+)
+
+func TestJobContextShouldLeaveOutCredentials(t *testing.T) {
+	var request AgentRequest
+	request.AgentId = "1"
+	request.JobId = "42"
+	request.Repository = "contoso/app"
+	request.AuthenticationToken = "secret-token"
+	request.AgentConfiguration.AgentCredentials.Data = map[string]string{"token": "secret-credential"}
+
+	data := marshalJobContext(request)
+	if strings.Contains(string(data), "secret-") {
+		t.Errorf("Job context must not contain credentials. Got %s", data)
+	}
+
+	var context JobContext
+	json.Unmarshal(data, &context)
+	if context.JobId != "42" || context.Repository != "contoso/app" {
+		t.Errorf("Unexpected job context %v", context)
+	}
+}
+
+func TestJobContextEnvironmentVariableShouldFollowMountPath(t *testing.T) {
+	pod := &v1.Pod{Spec: v1.PodSpec{Containers: []v1.Container{{
+		VolumeMounts: []v1.VolumeMount{{Name: agentCredsVolume, MountPath: "/azurepipelines/agent"}},
+	}}}}
+
+	addJobContextEnvironmentVariable(pod)
+	env := pod.Spec.Containers[0].Env
+	if len(env) != 1 || env[0].Value != "/azurepipelines/agent/"+jobContextFile {
+		t.Errorf("Unexpected environment %v", env)
+	}
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"os"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// Steps an acquire request goes through. Every step is written to the journal before moving on,
+// so that after a crash the recovery knows how far each in-flight request got. The entry is
+// removed once the response has been sent to Azure DevOps and its result stored for the retries.
+const (
+	JournalStepValidated    = "validated"
+	JournalStepPodRequested = "podrequested"
+	JournalStepPodCreated   = "podcreated"
+	JournalStepCallbackSent = "callbacksent"
+)
+
+// Every replica journals the acquire requests it handles. At startup a replica recovers its own
+// entries, left behind when it crashed. The entries of replicas which went away for good are
+// recovered by the leader once they were not updated for JOURNAL_STALE_SECONDS, so no replica rolls
+// back an acquire another replica is still handling.
+const (
+	journalKeyPrefix       = "journal:"
+	defaultJournalStaleAge = 10 * time.Minute
+)
+
+var journalRecoveryInterval = time.Minute
+
+type JournalEntry struct {
+	AgentId   string
+	AgentPool string
+	Namespace string
+	Step      string
+	PodName   string
+	// The replica handling the request
+	Replica   string
+	UpdatedAt time.Time
+	// The cluster the agent is created in, empty for the cluster of the webserver
+	Cluster string `json:",omitempty"`
+}
+
+// Records the step reached by the acquire request of the given agent. Failing to write the journal
+// must not fail the request itself, so errors are only logged.
+func RecordJournalStep(agentRequest AgentRequest, namespace string, cluster string, step string, podName string) {
+	replica, _ := os.Hostname()
+	entry := JournalEntry{
+		AgentId:   agentRequest.AgentId,
+		AgentPool: agentRequest.AgentPool,
+		Namespace: namespace,
+		Cluster:   cluster,
+		Step:      step,
+		PodName:   podName,
+		Replica:   replica,
+		UpdatedAt: time.Now().UTC(),
+	}
+
+	data, _ := json.Marshal(entry)
+	if err := GetStorage().Set(journalKeyPrefix+entry.AgentId, string(data)); err != nil {
+		log.Println("Failed to write journal step "+step+" for agent "+entry.AgentId, err)
+	}
+}
+
+// Removes the journal entry once the request has been answered.
+func CompleteJournal(agentId string) {
+	if err := GetStorage().Delete(journalKeyPrefix + agentId); err != nil {
+		log.Println("Failed to complete journal for agent "+agentId, err)
+	}
+}
+
+// Goes over the acquire requests this replica had in flight when it stopped. Requests which got as
+// far as creating the pod are resumed: the agent registers itself with Azure DevOps, so only the
+// result has to be stored and the journal completed. Requests whose response was sent already only
+// miss the completion of the journal. Requests which stopped earlier are compensated by removing
+// whatever was partially created for the agent.
+func RecoverInFlightAcquisitions() []JournalEntry {
+	replica, _ := os.Hostname()
+	return recoverJournal(func(entry JournalEntry) bool { return entry.Replica == replica })
+}
+
+// Recovers the journal entries of other replicas every minute on the leader, once they are stale.
+func RunJournalRecovery() {
+	staleAge := time.Duration(getEnvInt("JOURNAL_STALE_SECONDS", int(defaultJournalStaleAge/time.Second))) * time.Second
+	for {
+		if IsLeader() {
+			recoverStaleAcquisitions(time.Now().UTC().Add(-staleAge))
+		}
+		time.Sleep(journalRecoveryInterval)
+	}
+}
+
+// Recovers the acquire requests whose journal entry was last updated before the cutoff, whichever
+// replica handled them.
+func recoverStaleAcquisitions(cutoff time.Time) []JournalEntry {
+	return recoverJournal(func(entry JournalEntry) bool { return entry.UpdatedAt.Before(cutoff) })
+}
+
+func recoverJournal(shouldRecover func(entry JournalEntry) bool) []JournalEntry {
+	entries, err := GetStorage().List(journalKeyPrefix)
+	if err != nil {
+		log.Println("Failed to read the acquire journal", err)
+		return nil
+	}
+
+	var recovered []JournalEntry
+	for key, value := range entries {
+		var entry JournalEntry
+		if err := json.Unmarshal([]byte(value), &entry); err != nil || entry.AgentId == "" {
+			log.Println("Dropping unreadable journal entry " + key)
+			GetStorage().Delete(key)
+			continue
+		}
+		if !shouldRecover(entry) {
+			continue
+		}
+
+		// The claim of the request is answered or dropped, so the retries of Azure DevOps do not
+		// wait for a response which never comes
+		switch entry.Step {
+		case JournalStepCallbackSent:
+			log.Println("Completing acquire request for agent " + entry.AgentId + ", its response was sent")
+		case JournalStepPodCreated:
+			log.Println("Resuming acquire request for agent " + entry.AgentId + " at step " + entry.Step)
+			StoreAcquireResult(entry.AgentId, AgentProvisionResponse{Accepted: true, ResponseType: "Success"})
+		default:
+			log.Println("Compensating acquire request for agent " + entry.AgentId + " of replica " + entry.Replica + " stopped at step " + entry.Step)
+			deleteAgentResources(entry.AgentId, entry.Namespace, entry.Cluster)
+			ForgetAcquireRequest(entry.AgentId)
+		}
+
+		CompleteJournal(entry.AgentId)
+		recovered = append(recovered, entry)
+	}
+	return recovered
+}
+
+// Deletes any agent Jobs, pods and secrets labelled with the agentId in the cluster of the agent,
+// ignoring the ones which are already gone. Jobs are deleted in the foreground, so their pods are
+// gone before the Job.
+func deleteAgentResources(agentId string, namespace string, cluster string) {
+	cs, err := clusterClientSet(cluster)
+	if err != nil {
+		log.Println("Failed to remove the resources of agent "+agentId+" in cluster "+cluster, err)
+		return
+	}
+	revokeRegistryCredentials(cs, agentId, namespace)
+	deleteKubeconfig(cs, agentId, namespace)
+	selector := metav1.ListOptions{LabelSelector: agentIdLabel + "=" + agentId}
+
+	if jobs, err := cs.clientset.BatchV1().Jobs(namespace).List(selector); err == nil {
+		propagation := metav1.DeletePropagationForeground
+		for _, job := range jobs.Items {
+			if cs.clientset.BatchV1().Jobs(namespace).Delete(job.GetName(), &metav1.DeleteOptions{PropagationPolicy: &propagation}) == nil {
+				agentPodsDeleted.WithLabelValues("cleanup").Inc()
+			}
+		}
+	}
+
+	if pods, err := cs.clientset.CoreV1().Pods(namespace).List(selector); err == nil {
+		for _, pod := range pods.Items {
+			if cs.clientset.CoreV1().Pods(namespace).Delete(pod.GetName(), &metav1.DeleteOptions{}) == nil {
+				agentPodsDeleted.WithLabelValues("cleanup").Inc()
+			}
+		}
+	}
+
+	if secrets, err := cs.clientset.CoreV1().Secrets(namespace).List(selector); err == nil {
+		for _, secret := range secrets.Items {
+			cs.clientset.CoreV1().Secrets(namespace).Delete(secret.GetName(), &metav1.DeleteOptions{})
+		}
+	}
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"testing"
+	"time"
+
+	batchv1 "k8s.io/api/batch/v1"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestCreatePodMustRecordJournalSteps(t *testing.T) {
+	var agentrequest AgentRequest
+	agentrequest.AgentId = "1"
+	SetupCustomResource()
+
+	testPod := CreatePod(agentrequest, testnamespace)
+	if testPod.Accepted != true {
+		t.Errorf("Pod creation failed")
+	}
+
+	entries, _ := GetStorage().List(journalKeyPrefix)
+	if len(entries) != 1 {
+		t.Errorf("Expected one journal entry. Got %d", len(entries))
+	}
+
+	CompleteJournal(agentrequest.AgentId)
+	entries, _ = GetStorage().List(journalKeyPrefix)
+	if len(entries) != 0 {
+		t.Errorf("Journal entry not removed after completion")
+	}
+}
+
+func TestRecoverShouldCompensateRequestsWithoutPod(t *testing.T) {
+	var agentrequest AgentRequest
+	agentrequest.AgentId = "1"
+	SetupCustomResource()
+
+	cs := CreateClientSet()
+	createSecret(cs, agentrequest, nil)
+	RecordJournalStep(agentrequest, testnamespace, "", JournalStepPodRequested, "")
+
+	recovered := RecoverInFlightAcquisitions()
+	if len(recovered) != 1 || recovered[0].Step != JournalStepPodRequested {
+		t.Errorf("Expected the interrupted request to be recovered")
+	}
+
+	secrets, _ := cs.clientset.CoreV1().Secrets(testnamespace).List(metav1.ListOptions{LabelSelector: agentIdLabel + "=" + agentrequest.AgentId})
+	if secrets == nil || len(secrets.Items) != 0 {
+		t.Errorf("Secret of the interrupted request was not removed")
+	}
+}
+
+func TestRecoverShouldResumeRequestsWithPod(t *testing.T) {
+	var agentrequest AgentRequest
+	agentrequest.AgentId = "1"
+	SetupCustomResource()
+
+	testPod := CreatePod(agentrequest, testnamespace)
+	if testPod.Accepted != true {
+		t.Errorf("Pod creation failed")
+	}
+
+	RecoverInFlightAcquisitions()
+
+	cs := CreateClientSet()
+	pods, _ := cs.clientset.CoreV1().Pods(testnamespace).List(metav1.ListOptions{LabelSelector: agentIdLabel + "=" + agentrequest.AgentId})
+	if pods == nil || len(pods.Items) == 0 {
+		t.Errorf("Pod of the resumed request must be kept")
+	}
+
+	entries, _ := GetStorage().List(journalKeyPrefix)
+	if len(entries) != 0 {
+		t.Errorf("Journal entry not removed after recovery")
+	}
+}
+
+func TestRecoverShouldLeaveRequestsOfOtherReplicasUntilStale(t *testing.T) {
+	os.Setenv("STORAGE_BACKEND", "memory")
+	defer os.Unsetenv("STORAGE_BACKEND")
+	defer CompleteJournal("2")
+	entry, _ := json.Marshal(JournalEntry{AgentId: "2", Namespace: testnamespace, Step: JournalStepPodCreated, Replica: "webserver-other", UpdatedAt: time.Now().UTC().Add(-time.Minute)})
+	GetStorage().Set(journalKeyPrefix+"2", string(entry))
+
+	if recovered := RecoverInFlightAcquisitions(); len(recovered) != 0 {
+		t.Errorf("Expected the request of the other replica left alone. Got %+v", recovered)
+	}
+	if recovered := recoverStaleAcquisitions(time.Now().UTC().Add(-defaultJournalStaleAge)); len(recovered) != 0 {
+		t.Errorf("Expected the request of the other replica left alone while it is updated. Got %+v", recovered)
+	}
+	if recovered := recoverStaleAcquisitions(time.Now().UTC()); len(recovered) != 1 || recovered[0].Replica != "webserver-other" {
+		t.Errorf("Expected the stale request recovered. Got %+v", recovered)
+	}
+}
+
+func TestRecoverShouldRemoveTheAgentJobInTheClusterOfTheAgent(t *testing.T) {
+	os.Setenv("STORAGE_BACKEND", "memory")
+	defer os.Unsetenv("STORAGE_BACKEND")
+	SetupCustomResource()
+	if getClusterRegistry() == nil {
+		clusterRegistry.clusters = map[string]ClusterConfig{}
+	}
+	clusterRegistry.clusters["westus"] = ClusterConfig{Name: "westus", InCluster: true}
+	defer delete(clusterRegistry.clusters, "westus")
+	defer delete(clusterRegistry.clientsets, "westus")
+	remote, _ := clusterClientSet("westus")
+
+	labels := GenerateLabelsForPod("journal-job")
+	remote.clientset.BatchV1().Jobs(testnamespace).Create(&batchv1.Job{ObjectMeta: metav1.ObjectMeta{Name: "agent-job", Namespace: testnamespace, Labels: labels}})
+	remote.clientset.CoreV1().Secrets(testnamespace).Create(&v1.Secret{ObjectMeta: metav1.ObjectMeta{Name: "agent-secret", Namespace: testnamespace, Labels: labels}})
+	RecordJournalStep(AgentRequest{AgentId: "journal-job"}, testnamespace, "westus", JournalStepPodRequested, "")
+
+	if recovered := RecoverInFlightAcquisitions(); len(recovered) != 1 || recovered[0].Cluster != "westus" {
+		t.Errorf("Expected the request in cluster westus recovered. Got %+v", recovered)
+	}
+	if jobs, _ := remote.clientset.BatchV1().Jobs(testnamespace).List(metav1.ListOptions{}); len(jobs.Items) != 0 {
+		t.Errorf("Expected the agent Job removed. Got %v", jobs.Items)
+	}
+	if secrets, _ := remote.clientset.CoreV1().Secrets(testnamespace).List(metav1.ListOptions{}); len(secrets.Items) != 0 {
+		t.Errorf("Expected the agent secret removed. Got %v", secrets.Items)
+	}
+}
+
+func TestRecoverShouldOnlyCompleteRequestsWhoseResponseWasSent(t *testing.T) {
+	os.Setenv("STORAGE_BACKEND", "memory")
+	defer os.Unsetenv("STORAGE_BACKEND")
+	SetupCustomResource()
+
+	cs := CreateClientSet()
+	labels := GenerateLabelsForPod("journal-sent")
+	cs.clientset.CoreV1().Pods(testnamespace).Create(&v1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "agent-sent", Namespace: testnamespace, Labels: labels}})
+	RecordJournalStep(AgentRequest{AgentId: "journal-sent"}, testnamespace, "", JournalStepCallbackSent, "")
+
+	if recovered := RecoverInFlightAcquisitions(); len(recovered) != 1 || recovered[0].Step != JournalStepCallbackSent {
+		t.Errorf("Expected the request recovered. Got %+v", recovered)
+	}
+	if _, err := cs.clientset.CoreV1().Pods(testnamespace).Get("agent-sent", metav1.GetOptions{}); err != nil {
+		t.Errorf("Expected the agent pod kept. Got %v", err)
+	}
+	if entries, _ := GetStorage().List(journalKeyPrefix); len(entries) != 0 {
+		t.Errorf("Expected the journal completed. Got %v", entries)
+	}
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// The kill switch stops provisioning at once, e.g. while a build image is suspected to be
+// compromised. POST /admin/killswitch?action=engage&reason=<reason> stops it for all pools, with
+// &pool=<pool> for one pool. Acquire requests are then rejected, standby pods are neither claimed
+// nor created, and with &deleteIdle=true the standby pods, which no job has claimed yet, are
+// deleted. The switch is kept in the storage under "killswitch:<pool>", or "killswitch:*" for all
+// pools, so it outlives restarts, and never expires. Provisioning resumes only with
+// action=release and a reason. Both are recorded in the audit log. GET lists the engaged switches.
+const (
+	killSwitchKeyPrefix = "killswitch:"
+	killSwitchAllPools  = "*"
+	killSwitchEngage    = "engage"
+	killSwitchRelease   = "release"
+)
+
+type KillSwitchRecord struct {
+	// Pool is empty when provisioning is stopped for all pools
+	Pool      string `json:",omitempty"`
+	Reason    string
+	Principal string
+	Since     time.Time
+	// Standby pods deleted when the switch was engaged
+	DeletedIdle int `json:",omitempty"`
+}
+
+func killSwitchKey(poolName string) string {
+	if poolName == "" {
+		return killSwitchKeyPrefix + killSwitchAllPools
+	}
+	return killSwitchKeyPrefix + poolName
+}
+
+func getKillSwitch(poolName string) (KillSwitchRecord, bool) {
+	var record KillSwitchRecord
+	value, err := GetStorage().Get(killSwitchKey(poolName))
+	if err != nil || value == "" || json.Unmarshal([]byte(value), &record) != nil {
+		return record, false
+	}
+	return record, true
+}
+
+// Returns the switch which stops the provisioning of the pool, the one for all pools first.
+func engagedKillSwitch(poolName string) (KillSwitchRecord, bool) {
+	if record, ok := getKillSwitch(""); ok {
+		return record, true
+	}
+	if poolName == "" {
+		return KillSwitchRecord{}, false
+	}
+	return getKillSwitch(poolName)
+}
+
+func killSwitchError(record KillSwitchRecord) error {
+	scope := "all agent pools"
+	if record.Pool != "" {
+		scope = "agent pool " + record.Pool
+	}
+	return errors.New("Provisioning is stopped for " + scope + " by the kill switch: " + record.Reason)
+}
+
+func listKillSwitches() ([]KillSwitchRecord, error) {
+	values, err := GetStorage().List(killSwitchKeyPrefix)
+	if err != nil {
+		return nil, err
+	}
+	records := []KillSwitchRecord{}
+	for _, value := range values {
+		var record KillSwitchRecord
+		if json.Unmarshal([]byte(value), &record) == nil {
+			records = append(records, record)
+		}
+	}
+	sort.Slice(records, func(i, j int) bool { return records[i].Since.Before(records[j].Since) })
+	return records, nil
+}
+
+// Deletes the standby pods of the pool, or of all pools, and returns how many were deleted.
+func deleteIdleAgents(cs *k8s, poolName string, namespace string) (int, error) {
+	selector := standbyLabel
+	if poolName != "" {
+		selector = standbyLabel + "=" + poolName
+	}
+	podClient := cs.clientset.CoreV1().Pods(namespace)
+	pods, err := podClient.List(metav1.ListOptions{LabelSelector: selector})
+	if err != nil {
+		return 0, err
+	}
+	deleted := 0
+	for _, pod := range pods.Items {
+		if err := podClient.Delete(pod.GetName(), &metav1.DeleteOptions{}); err != nil {
+			log.Println("Failed to delete standby pod "+pod.GetName(), err)
+			continue
+		}
+		deleted++
+	}
+	return deleted, nil
+}
+
+// Lists the engaged kill switches on GET, engages or releases one on POST.
+func KillSwitchHandler(resp http.ResponseWriter, req *http.Request) {
+	if req.Method == http.MethodGet {
+		if !isReadRequestValid(resp, req) {
+			return
+		}
+		records, err := listKillSwitches()
+		if err != nil {
+			writeJsonResponse(resp, http.StatusInternalServerError, GetError(err.Error()))
+			return
+		}
+		writeJsonResponse(resp, http.StatusOK, records)
+		return
+	}
+
+	if req.Method != http.MethodPost {
+		writeJsonResponse(resp, http.StatusMethodNotAllowed, GetError(InvalidRequestError))
+		return
+	}
+	if !isRequestHmacValid(req) {
+		writeJsonResponse(resp, http.StatusForbidden, GetError(NoValidSignatureError))
+		return
+	}
+
+	query := req.URL.Query()
+	action, poolName, reason := query.Get("action"), query.Get("pool"), query.Get("reason")
+	if (action != killSwitchEngage && action != killSwitchRelease) || poolName == killSwitchAllPools {
+		writeJsonResponse(resp, http.StatusBadRequest, GetError(InvalidRequestError))
+		return
+	}
+	if reason == "" {
+		writeJsonResponse(resp, http.StatusBadRequest, GetError(KillSwitchReasonError))
+		return
+	}
+
+	principal := adminPrincipal(req)
+	target := "pool/" + poolName
+	if poolName == "" {
+		target = "pools"
+	}
+	store := GetStorage()
+	record := KillSwitchRecord{Pool: poolName, Reason: reason, Principal: principal, Since: time.Now().UTC()}
+
+	if action == killSwitchEngage {
+		data, _ := json.Marshal(record)
+		if err := store.Set(killSwitchKey(poolName), string(data)); err != nil {
+			writeJsonResponse(resp, http.StatusInternalServerError, GetError(err.Error()))
+			return
+		}
+		// Only after the switch is set, so the warm pool controller does not replace them
+		if query.Get("deleteIdle") == "true" {
+			deleted, err := deleteIdleAgents(CreateClientSet(), poolName, podnamespace)
+			if err != nil {
+				log.Println("Failed to delete the standby pods of "+target, err)
+			}
+			record.DeletedIdle = deleted
+			data, _ = json.Marshal(record)
+			store.Set(killSwitchKey(poolName), string(data))
+		}
+		log.Println(killSwitchError(record).Error() + ", engaged by " + principal)
+		Notify(Notification{Event: "KillSwitchEngaged", Pool: poolName, Message: killSwitchError(record).Error() +
+			", engaged by " + principal + ", " + strconv.Itoa(record.DeletedIdle) + " standby pods deleted"})
+	} else {
+		engaged, ok := getKillSwitch(poolName)
+		if !ok {
+			writeJsonResponse(resp, http.StatusNotFound, GetError(UnknownKillSwitchError))
+			return
+		}
+		if err := store.Delete(killSwitchKey(poolName)); err != nil {
+			writeJsonResponse(resp, http.StatusInternalServerError, GetError(err.Error()))
+			return
+		}
+		log.Println("Kill switch of " + target + " released by " + principal + ": " + reason)
+		Notify(Notification{Event: "KillSwitchReleased", Pool: poolName, Message: "Kill switch of " + target + " released by " +
+			principal + " after " + strconv.Itoa(int(time.Since(engaged.Since).Minutes())) + " minutes: " + reason})
+	}
+
+	RecordAuditEntry(AuditEntry{
+		Category:  AuditCategoryConfig,
+		Principal: principal,
+		Action:    "killswitch-" + action,
+		Target:    target,
+		Reason:    reason,
+	})
+	writeJsonResponse(resp, http.StatusOK, record)
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+)
+
+func postKillSwitch(query string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("POST", "/admin/killswitch?"+query, nil)
+	req.Header.Add("X-Azure-Signature", ComputeHash(""))
+	req.Header.Add(adminPrincipalHeader, "oncall@contoso.com")
+	resp := httptest.NewRecorder()
+	KillSwitchHandler(resp, req)
+	return resp
+}
+
+func TestKillSwitchShouldStopProvisioningUntilReleased(t *testing.T) {
+	os.Setenv("VSTS_SECRET", "sharedsecret1234")
+	os.Setenv("STORAGE_BACKEND", "memory")
+	defer os.Unsetenv("STORAGE_BACKEND")
+
+	if resp := postKillSwitch("action=engage&pool=linux&reason=compromised+image"); resp.Code != http.StatusOK {
+		t.Fatalf("Expected the kill switch engaged. Got %d %s", resp.Code, resp.Body.String())
+	}
+	if record, stopped := engagedKillSwitch("linux"); !stopped || record.Reason != "compromised image" || record.Principal != "oncall@contoso.com" {
+		t.Errorf("Expected pool linux stopped. Got %v %v", record, stopped)
+	}
+	if _, stopped := engagedKillSwitch("windows"); stopped {
+		t.Errorf("Expected other pools to keep provisioning")
+	}
+
+	if resp := postKillSwitch("action=release&pool=linux"); resp.Code != http.StatusBadRequest {
+		t.Errorf("Expected a release without reason rejected. Got %d", resp.Code)
+	}
+	if resp := postKillSwitch("action=release&pool=linux&reason=image+rebuilt"); resp.Code != http.StatusOK {
+		t.Errorf("Expected the kill switch released. Got %d %s", resp.Code, resp.Body.String())
+	}
+	if _, stopped := engagedKillSwitch("linux"); stopped {
+		t.Errorf("Expected pool linux to provision again")
+	}
+	if resp := postKillSwitch("action=release&pool=linux&reason=again"); resp.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 for a released kill switch. Got %d", resp.Code)
+	}
+
+	entries, _ := ListAuditEntries(AuditCategoryConfig)
+	released := false
+	for _, entry := range entries {
+		released = released || (entry.Action == "killswitch-release" && entry.Reason == "image rebuilt" && entry.Target == "pool/linux")
+	}
+	if !released {
+		t.Errorf("Expected the release in the audit log. Got %v", entries)
+	}
+}
+
+func TestKillSwitchForAllPoolsShouldStopEveryPool(t *testing.T) {
+	os.Setenv("VSTS_SECRET", "sharedsecret1234")
+	os.Setenv("STORAGE_BACKEND", "memory")
+	defer os.Unsetenv("STORAGE_BACKEND")
+	defer GetStorage().Delete(killSwitchKey(""))
+
+	postKillSwitch("action=engage&reason=incident")
+	record, stopped := engagedKillSwitch("windows")
+	if !stopped || record.Pool != "" {
+		t.Errorf("Expected all pools stopped. Got %v %v", record, stopped)
+	}
+	if err := killSwitchError(record).Error(); err != "Provisioning is stopped for all agent pools by the kill switch: incident" {
+		t.Errorf("Unexpected error %s", err)
+	}
+}
@@ -0,0 +1,256 @@
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/ghodss/yaml"
+	v1alpha1 "github.com/microsoft/poolprovider-for-k8s/pkg/apis/dev/v1alpha1"
+	authenticationv1 "k8s.io/api/authentication/v1"
+	v1 "k8s.io/api/core/v1"
+	rbacv1 "k8s.io/api/rbac/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// Jobs of pools with deploy access get a kubeconfig for the deploy namespace instead of cluster
+// credentials. The pool has a service account, "poolprovider-deploy-<pool>", bound to the deploy
+// role in that namespace only. Every job gets a token of it bound to the secret the kubeconfig is
+// stored in, "<agent secret>-kubeconfig", so deleting the secret on release invalidates the token.
+// The agent container finds the kubeconfig through KUBECONFIG. The webserver may only bind the
+// cluster roles in DEPLOY_CLUSTER_ROLES, which has to match deployAccess.clusterRoles of the chart.
+const (
+	deployServiceAccountPrefix = "poolprovider-deploy-"
+	defaultDeployClusterRole   = "edit"
+	defaultDeployTokenSeconds  = 3600
+	kubeconfigSecretTail       = "-kubeconfig"
+	kubeconfigVolume           = "deploy-kubeconfig"
+	kubeconfigMountPath        = "/var/run/secrets/kubeconfig"
+	kubeconfigFile             = "config"
+	kubeconfigEnvVariable      = "KUBECONFIG"
+	kubeconfigAgentLabel       = "KubeconfigFor"
+	inClusterApiServer         = "https://kubernetes.default.svc"
+	serviceAccountCaFile       = "/var/run/secrets/kubernetes.io/serviceaccount/ca.crt"
+)
+
+type kubeconfig struct {
+	ApiVersion     string              `json:"apiVersion"`
+	Kind           string              `json:"kind"`
+	Clusters       []kubeconfigCluster `json:"clusters"`
+	Users          []kubeconfigUser    `json:"users"`
+	Contexts       []kubeconfigContext `json:"contexts"`
+	CurrentContext string              `json:"current-context"`
+}
+
+type kubeconfigCluster struct {
+	Name    string `json:"name"`
+	Cluster struct {
+		Server                   string `json:"server"`
+		CertificateAuthorityData string `json:"certificate-authority-data,omitempty"`
+	} `json:"cluster"`
+}
+
+type kubeconfigUser struct {
+	Name string `json:"name"`
+	User struct {
+		Token string `json:"token"`
+	} `json:"user"`
+}
+
+type kubeconfigContext struct {
+	Name    string `json:"name"`
+	Context struct {
+		Cluster   string `json:"cluster"`
+		User      string `json:"user"`
+		Namespace string `json:"namespace"`
+	} `json:"context"`
+}
+
+func deployServiceAccountName(poolName string) string {
+	return deployServiceAccountPrefix + poolName
+}
+
+// Cluster roles pools may ask for in their deploy access, "edit" by default
+func deployClusterRoles() []string {
+	roles := []string{}
+	for _, role := range strings.Split(os.Getenv("DEPLOY_CLUSTER_ROLES"), ",") {
+		if role = strings.TrimSpace(role); role != "" {
+			roles = append(roles, role)
+		}
+	}
+	if len(roles) == 0 {
+		roles = append(roles, defaultDeployClusterRole)
+	}
+	return roles
+}
+
+func deployClusterRole(pool *v1alpha1.AgentPoolSpec) (string, error) {
+	role := pool.DeployAccess.ClusterRole
+	if role == "" {
+		role = defaultDeployClusterRole
+	}
+	for _, allowed := range deployClusterRoles() {
+		if role == allowed {
+			return role, nil
+		}
+	}
+	return "", errors.New(DeployRoleError + " " + role)
+}
+
+func kubeconfigSecretName(agentSecretName string) string {
+	return agentSecretName + kubeconfigSecretTail
+}
+
+func buildKubeconfig(server string, caData []byte, namespace string, token string) ([]byte, error) {
+	var cluster kubeconfigCluster
+	cluster.Name = "cluster"
+	cluster.Cluster.Server = server
+	if len(caData) > 0 {
+		cluster.Cluster.CertificateAuthorityData = base64.StdEncoding.EncodeToString(caData)
+	}
+
+	var user kubeconfigUser
+	user.Name = "agent"
+	user.User.Token = token
+
+	var context kubeconfigContext
+	context.Name = "deploy"
+	context.Context.Cluster = cluster.Name
+	context.Context.User = user.Name
+	context.Context.Namespace = namespace
+
+	return yaml.Marshal(kubeconfig{
+		ApiVersion:     "v1",
+		Kind:           "Config",
+		Clusters:       []kubeconfigCluster{cluster},
+		Users:          []kubeconfigUser{user},
+		Contexts:       []kubeconfigContext{context},
+		CurrentContext: context.Name,
+	})
+}
+
+// Mounts the kubeconfig of the job into the agent container. The secret is optional, so standby
+// pods start before their job is known.
+func addKubeconfigVolume(pod *v1.Pod, pool *v1alpha1.AgentPoolSpec, agentSecretName string) {
+	if pod == nil || pool == nil || pool.DeployAccess == nil || len(pod.Spec.Containers) == 0 {
+		return
+	}
+
+	optional := true
+	pod.Spec.Volumes = append(pod.Spec.Volumes, v1.Volume{
+		Name: kubeconfigVolume,
+		VolumeSource: v1.VolumeSource{Secret: &v1.SecretVolumeSource{
+			SecretName: kubeconfigSecretName(agentSecretName),
+			Optional:   &optional,
+		}},
+	})
+
+	container := &pod.Spec.Containers[0]
+	container.VolumeMounts = append(container.VolumeMounts, v1.VolumeMount{Name: kubeconfigVolume, MountPath: kubeconfigMountPath, ReadOnly: true})
+	container.Env = append(container.Env, v1.EnvVar{Name: kubeconfigEnvVariable, Value: kubeconfigMountPath + "/" + kubeconfigFile})
+}
+
+// Creates the service account of the pool and binds it to the deploy role, unless they exist.
+func ensureDeployAccess(cs *k8s, pool *v1alpha1.AgentPoolSpec, namespace string) error {
+	role, err := deployClusterRole(pool)
+	if err != nil {
+		return err
+	}
+
+	name := deployServiceAccountName(pool.PoolName)
+	_, err = cs.clientset.CoreV1().ServiceAccounts(namespace).Create(&v1.ServiceAccount{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: namespace},
+	})
+	if err != nil && !k8serrors.IsAlreadyExists(err) {
+		return err
+	}
+
+	_, err = cs.clientset.RbacV1().RoleBindings(pool.DeployAccess.Namespace).Create(&rbacv1.RoleBinding{
+		ObjectMeta: metav1.ObjectMeta{Name: name + "-" + namespace, Namespace: pool.DeployAccess.Namespace},
+		Subjects:   []rbacv1.Subject{{Kind: rbacv1.ServiceAccountKind, Name: name, Namespace: namespace}},
+		RoleRef:    rbacv1.RoleRef{APIGroup: rbacv1.GroupName, Kind: "ClusterRole", Name: role},
+	})
+	if err != nil && !k8serrors.IsAlreadyExists(err) {
+		return err
+	}
+	return nil
+}
+
+// Issues the token of the job and stores its kubeconfig. A job without it can still run, so
+// failures are returned as warnings.
+func provisionKubeconfig(cs *k8s, agentId string, pool *v1alpha1.AgentPoolSpec, agentSecretName string, owner *v1.Pod, namespace string) []string {
+	if pool == nil || pool.DeployAccess == nil {
+		return nil
+	}
+	if err := createKubeconfig(cs, agentId, pool, agentSecretName, owner, namespace); err != nil {
+		log.Println("Failed to provide the kubeconfig of agent "+agentId, err)
+		return []string{"Deploy kubeconfig not provided: " + err.Error()}
+	}
+	return nil
+}
+
+func createKubeconfig(cs *k8s, agentId string, pool *v1alpha1.AgentPoolSpec, agentSecretName string, owner *v1.Pod, namespace string) error {
+	if pool.DeployAccess.Namespace == "" {
+		return errors.New("No deploy namespace set for pool " + pool.PoolName)
+	}
+	if err := ensureDeployAccess(cs, pool, namespace); err != nil {
+		return err
+	}
+
+	// The token is bound to the secret, which has to exist first
+	secretClient := cs.clientset.CoreV1().Secrets(namespace)
+	secret := &v1.Secret{ObjectMeta: metav1.ObjectMeta{
+		Name:      kubeconfigSecretName(agentSecretName),
+		Namespace: namespace,
+		Labels:    map[string]string{kubeconfigAgentLabel: agentId},
+	}}
+	if owner != nil {
+		AddOwnerRefToObject(secret, AsOwner(owner))
+	}
+	secret, err := secretClient.Create(secret)
+	if err != nil {
+		return err
+	}
+
+	expiration := pool.DeployAccess.ExpirationSeconds
+	if expiration <= 0 {
+		expiration = defaultDeployTokenSeconds
+	}
+	token, err := cs.clientset.CoreV1().ServiceAccounts(namespace).CreateToken(deployServiceAccountName(pool.PoolName), &authenticationv1.TokenRequest{
+		Spec: authenticationv1.TokenRequestSpec{
+			ExpirationSeconds: &expiration,
+			BoundObjectRef:    &authenticationv1.BoundObjectReference{Kind: "Secret", APIVersion: "v1", Name: secret.GetName(), UID: secret.GetUID()},
+		},
+	})
+	if err == nil {
+		caData, _ := ioutil.ReadFile(serviceAccountCaFile)
+		secret.Data = map[string][]byte{}
+		secret.Data[kubeconfigFile], err = buildKubeconfig(inClusterApiServer, caData, pool.DeployAccess.Namespace, token.Status.Token)
+	}
+	if err == nil {
+		_, err = secretClient.Update(secret)
+	}
+	if err != nil {
+		secretClient.Delete(secret.GetName(), &metav1.DeleteOptions{})
+	}
+	return err
+}
+
+// Deletes the kubeconfig of the agent, which invalidates its token.
+func deleteKubeconfig(cs *k8s, agentId string, namespace string) {
+	secretClient := cs.clientset.CoreV1().Secrets(namespace)
+	secrets, err := secretClient.List(metav1.ListOptions{LabelSelector: kubeconfigAgentLabel + "=" + agentId})
+	if err != nil {
+		log.Println("Failed to list the kubeconfig of agent "+agentId, err)
+		return
+	}
+	for _, secret := range secrets.Items {
+		if err := secretClient.Delete(secret.GetName(), &metav1.DeleteOptions{}); err != nil {
+			log.Println("Failed to delete kubeconfig "+secret.GetName(), err)
+		}
+	}
+}
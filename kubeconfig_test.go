@@ -0,0 +1,93 @@
+package main
+
+import (
+	"encoding/base64"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/ghodss/yaml"
+	v1alpha1 "github.com/microsoft/poolprovider-for-k8s/pkg/apis/dev/v1alpha1"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestBuildKubeconfigShouldTargetTheDeployNamespace(t *testing.T) {
+	data, err := buildKubeconfig(inClusterApiServer, []byte("ca"), "staging", "job-token")
+	if err != nil {
+		t.Fatalf("Expected a kubeconfig. Got %v", err)
+	}
+
+	var config kubeconfig
+	if err := yaml.Unmarshal(data, &config); err != nil {
+		t.Fatalf("Expected valid yaml. Got %v", err)
+	}
+	if len(config.Contexts) != 1 || config.CurrentContext != config.Contexts[0].Name || config.Contexts[0].Context.Namespace != "staging" {
+		t.Errorf("Expected the current context to use the deploy namespace. Got %s", data)
+	}
+	if len(config.Users) != 1 || config.Users[0].User.Token != "job-token" {
+		t.Errorf("Expected the job token. Got %s", data)
+	}
+	if len(config.Clusters) != 1 || config.Clusters[0].Cluster.Server != inClusterApiServer ||
+		config.Clusters[0].Cluster.CertificateAuthorityData != base64.StdEncoding.EncodeToString([]byte("ca")) {
+		t.Errorf("Expected the in-cluster API server and its CA. Got %s", data)
+	}
+}
+
+func TestBuildKubeconfigShouldLeaveOutAMissingCa(t *testing.T) {
+	data, _ := buildKubeconfig(inClusterApiServer, nil, "staging", "job-token")
+
+	if strings.Contains(string(data), "certificate-authority-data") {
+		t.Errorf("Expected no CA data. Got %s", data)
+	}
+}
+
+func TestAddKubeconfigVolumeShouldMountTheKubeconfig(t *testing.T) {
+	pool := &v1alpha1.AgentPoolSpec{DeployAccess: &v1alpha1.DeployAccessSpec{Namespace: "staging"}}
+	pod := &v1.Pod{Spec: v1.PodSpec{Containers: []v1.Container{{Name: "vsts-agent"}}}}
+
+	addKubeconfigVolume(pod, pool, "agent-secret")
+
+	if len(pod.Spec.Volumes) != 1 || pod.Spec.Volumes[0].Secret.SecretName != "agent-secret-kubeconfig" || !*pod.Spec.Volumes[0].Secret.Optional {
+		t.Errorf("Expected an optional kubeconfig secret volume. Got %+v", pod.Spec.Volumes)
+	}
+	container := pod.Spec.Containers[0]
+	if len(container.Env) != 1 || container.Env[0].Name != kubeconfigEnvVariable || container.Env[0].Value != "/var/run/secrets/kubeconfig/config" {
+		t.Errorf("Expected KUBECONFIG to point at the mounted file. Got %+v", container.Env)
+	}
+}
+
+func TestAddKubeconfigVolumeShouldSkipPoolsWithoutDeployAccess(t *testing.T) {
+	pod := &v1.Pod{Spec: v1.PodSpec{Containers: []v1.Container{{Name: "vsts-agent"}}}}
+
+	addKubeconfigVolume(pod, &v1alpha1.AgentPoolSpec{}, "agent-secret")
+
+	if len(pod.Spec.Volumes) != 0 || len(pod.Spec.Containers[0].Env) != 0 {
+		t.Errorf("Expected the pod to be unchanged. Got %+v", pod.Spec)
+	}
+}
+
+func TestEnsureDeployAccessShouldRejectRolesOutsideTheAllowList(t *testing.T) {
+	SetupCustomResource()
+	cs := CreateClientSet()
+	pool := &v1alpha1.AgentPoolSpec{PoolName: "deploy", DeployAccess: &v1alpha1.DeployAccessSpec{Namespace: "apps", ClusterRole: "cluster-admin"}}
+
+	if err := ensureDeployAccess(cs, pool, podnamespace); err == nil || !strings.HasPrefix(err.Error(), DeployRoleError) {
+		t.Errorf("Expected cluster-admin to be rejected. Got %v", err)
+	}
+	if _, err := cs.clientset.RbacV1().RoleBindings("apps").Get(deployServiceAccountName("deploy")+"-"+podnamespace, metav1.GetOptions{}); err == nil {
+		t.Errorf("Expected no role binding for a rejected role")
+	}
+
+	pool.DeployAccess.ClusterRole = ""
+	if err := ensureDeployAccess(cs, pool, podnamespace); err != nil {
+		t.Errorf("Expected the default role to be allowed. Got %v", err)
+	}
+
+	os.Setenv("DEPLOY_CLUSTER_ROLES", "edit, view")
+	defer os.Unsetenv("DEPLOY_CLUSTER_ROLES")
+	pool.DeployAccess.ClusterRole = "view"
+	if _, err := deployClusterRole(pool); err != nil {
+		t.Errorf("Expected view to be allowed by DEPLOY_CLUSTER_ROLES. Got %v", err)
+	}
+}
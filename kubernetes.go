@@ -6,11 +6,14 @@ import (
 	"io/ioutil"
 
 	"log"
+	"strings"
+	"time"
 
 	v1alpha1 "github.com/microsoft/poolprovider-for-k8s/pkg/apis/dev/v1alpha1"
 
 	"github.com/ghodss/yaml"
 	v1 "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 
 	"k8s.io/client-go/kubernetes"
@@ -27,7 +30,10 @@ type k8s struct {
 	clientset kubernetes.Interface
 }
 
-const agentIdLabel = "AgentId"
+const (
+	agentIdLabel   = "AgentId"
+	agentPoolLabel = "AgentPool"
+)
 
 // Creates a Pod with the default image specification. The pod is labelled with the agentId passed to it.
 func CreatePod(agentRequest AgentRequest, podnamespace string) AgentProvisionResponse {
@@ -39,54 +45,279 @@ func CreatePod(agentRequest AgentRequest, podnamespace string) AgentProvisionRes
 	var crdclient *v1alpha1.AzurePipelinesPoolV1Alpha1Client
 
 	crdclient, _ = v1alpha1.NewClient(config)
+	logger := agentRequestLogger(agentRequest)
 
 	crdobject, err := crdclient.AzurePipelinesPool(podnamespace).Get("azurepipelinespool-operator")
 	if err != nil {
-		log.Println("Error fetching crdobject AzurePipelinesPool", err)
+		logger.Error("Error fetching crdobject AzurePipelinesPool", err)
 	} else {
-		log.Println("Crdobject AzurePipelinesPool fetched successfully \n", crdobject)
+		logger.Debug("Crdobject AzurePipelinesPool fetched successfully \n", crdobject)
+	}
+
+	var response AgentProvisionResponse
+	trace := newProvisioningTrace(agentRequest)
+	defer trace.save()
+
+	cs := CreateClientSet()
+	agentNamespace, err := resolveAgentNamespace(cs, podnamespace)
+	if err != nil {
+		trace.decide("namespace", DecisionRejected, err.Error())
+		return getFailureResponse(response, err)
+	}
+
+	poolName := ResolveAgentPoolName(crdobject, agentRequest)
+	agentPool := v1alpha1.FetchAgentPool(crdobject, poolName)
+	if err := validateRoutedPool(crdobject, agentRequest, agentPool); err != nil {
+		log.Println(err)
+		trace.decide("pool", DecisionRejected, err.Error())
+		return getFailureResponse(response, err)
+	}
+	explainRouting(trace, crdobject, agentRequest, poolName, agentPool)
+	if selected, reason := selectAvailablePool(crdobject, agentPool, agentNamespace); selected != agentPool {
+		recordFailover(agentRequest.AgentId, agentPool.PoolName, selected.PoolName, reason)
+		trace.decide("failover", selected.PoolName, "Pool "+agentPool.PoolName+" is "+reason)
+		response.Warnings = append(response.Warnings, "Provisioned in fallback pool "+selected.PoolName+", pool "+agentPool.PoolName+" is "+reason)
+		agentPool, poolName = selected, selected.PoolName
+	}
+	if record, stopped := engagedKillSwitch(poolName); stopped {
+		trace.decide("kill-switch", DecisionRejected, killSwitchError(record).Error())
+		return getFailureResponse(response, killSwitchError(record))
+	}
+	trace.decide("kill-switch", DecisionPassed, "")
+	agentOS, ok := v1alpha1.ResolveAgentOS(agentPool, agentRequest.OS)
+	if !ok {
+		trace.decide("os", DecisionRejected, unsupportedOSError(agentOS).Error())
+		return getFailureResponse(response, unsupportedOSError(agentOS))
+	}
+	trace.decide("os", agentOS, "")
+	cluster := poolCluster(agentPool)
+	if cluster != "" {
+		remote, err := clusterClientSet(cluster)
+		if err == nil {
+			agentNamespace, err = resolveAgentNamespace(remote, podnamespace)
+		}
+		if err != nil {
+			trace.decide("cluster", DecisionRejected, err.Error())
+			return getFailureResponse(response, err)
+		}
+		cs = remote
+		trace.decide("cluster", cluster, "Agent pool "+poolName+" runs in cluster "+cluster)
+		logger = logger.with(clusterField, cluster)
+	}
+	if isolated := poolNamespace(crdobject, agentPool, agentNamespace); isolated != agentNamespace {
+		if err := ensurePoolNamespace(cs, crdobject.Spec.NamespaceTemplate, agentPool, isolated); err != nil {
+			logger.Error("Failed to provision namespace "+isolated+" of agent pool "+agentPool.PoolName, err)
+			trace.decide("pool-namespace", DecisionRejected, err.Error())
+			return getFailureResponse(response, err)
+		}
+		trace.decide("pool-namespace", isolated, "Agent pool "+agentPool.PoolName+" runs in a namespace of its own")
+		agentNamespace = isolated
+	}
+	// Remote clusters grant the access of their credentials themselves
+	if cluster == "" && agentNamespace != podnamespace {
+		if err := ensureNamespaceAccess(cs, agentNamespace, podnamespace); err != nil {
+			logger.Error("Failed to bind the access to namespace "+agentNamespace, err)
+			trace.decide("namespace-access", DecisionRejected, err.Error())
+			return getFailureResponse(response, err)
+		}
+	}
+
+	// A retry of a request whose agent pod was created already
+	if existing := findAgentPod(cs, agentRequest.AgentId, agentNamespace); existing != nil {
+		logger.Info("Agent pod " + existing.GetName() + " already exists, not creating another one")
+		trace.decide("pod", existing.GetName(), "The agent has a pod in namespace "+agentNamespace+" already")
+		return duplicateAgentResponse(response, poolName, agentNamespace, cluster)
 	}
 
 	labels := GenerateLabelsForPod(agentRequest.AgentId)
+	if agentPool != nil {
+		labels[agentPoolLabel] = agentPool.PoolName
+	}
+	if isValidRunId(agentRequest.RunId) {
+		labels[runIdLabel] = agentRequest.RunId
+	}
 
-	log.Println("Add an agent Pod using CRD")
+	if agentPool != nil && isPoolFrozen(agentPool.PoolName, time.Now()) {
+		trace.decide("budget", DecisionRejected, frozenPoolError(agentPool.PoolName).Error())
+		return getFailureResponse(response, frozenPoolError(agentPool.PoolName))
+	}
+	trace.decide("budget", DecisionPassed, "")
+	if err := waitForApiBudget(poolName, apiOperationCreate, throttleWaitTimeout); err != nil {
+		logger.Warn("Agent pool "+poolName+" used up its Kubernetes API budget", err)
+		trace.decide("api-budget", DecisionRejected, err.Error())
+		return getFailureResponse(response, err)
+	}
+	trace.decide("api-budget", DecisionPassed, "")
 
-	pod = crdclient.AzurePipelinesPool(podnamespace).AddNewPodForCR(crdobject, labels)
+	demandImage := v1alpha1.ResolveDemandImage(agentPool, agentRequest.Demands)
+	diagnostics := v1alpha1.DiagnosticsMode(agentPool, agentRequest.Demands)
+	explainImage(trace, demandImage, agentRequest.Demands)
 
-	log.Println("Agent pod spec fetched ", pod)
+	logger = logger.with(poolField, poolName)
+	logger.Info("Add an agent Pod using CRD for agent pool", poolName)
 
-	cs := CreateClientSet()
+	pod = crdclient.AzurePipelinesPool(podnamespace).AddNewPodForOS(crdobject, poolName, agentOS, labels)
+	applyDemandImage(pod, demandImage)
+	if agentPool != nil {
+		if record, quarantined := getQuarantine(agentPool.PoolName, agentImage(pod)); quarantined {
+			trace.decide("quarantine", DecisionRejected, quarantineError(record).Error())
+			return getFailureResponse(response, quarantineError(record))
+		}
+		trace.decide("quarantine", DecisionPassed, "")
+	}
+	addDiagnosticsEnvironmentVariables(pod, diagnostics)
+	addEphemeralEnvironmentVariable(pod, agentPool)
+	if agentRequest.Canary {
+		runCanaryScript(pod)
+	}
+	if node := preferredNodeForRun(agentRequest.RunId, agentNamespace); node != "" {
+		addRunNodeAffinity(pod, node)
+		trace.decide("run-affinity", node, "Preferred node of run "+agentRequest.RunId)
+	}
+	v1alpha1.AddSharedTools(pod, agentPool)
+	v1alpha1.AddMeshAnnotations(pod, agentPool)
+	v1alpha1.AddServiceContainers(pod, agentRequest.Demands)
+	annotateDefinition(pod, agentRequest.Definition)
+	if agentPool != nil && isRightsizingAutoApplied() {
+		if recommendation, ok := findRightsizingRecommendation(agentPool.PoolName, agentRequest.Definition); ok && applyRightsizing(pod, recommendation) {
+			trace.decide("rightsizing", pod.Annotations[rightsizedAnnotation], "Definition "+agentRequest.Definition+" used less than its requests")
+		}
+	}
 
-	log.Println("Starting pod creation")
-	var response AgentProvisionResponse
+	logger.Debug("Agent pod spec fetched ", pod)
 
-	podClient := cs.clientset.CoreV1().Pods(podnamespace)
-	webserverpod, webserverpoderr := podClient.List(metav1.ListOptions{LabelSelector: "app=azurepipelinespool-operator"})
+	violations := LintPod(pod, crdobject.Spec.PodLintRules)
+	if len(violations) > 0 {
+		response.Warnings = FormatViolations(violations)
+		logger.Warn("Agent pod lint violations ", response.Warnings)
+	}
+	if IsBlockingViolation(violations) {
+		trace.decide("pod-lint", DecisionRejected, strings.Join(response.Warnings, "; "))
+		return getFailureResponse(response, errors.New("Agent pod rejected by pod lint rules"))
+	}
+
+	// Hand out a standby pod of the warm pool when one is ready, once the pod of the request passed
+	// the quarantine and the pod lint rules. Standby pods run the default image of the pool on the
+	// OS and in the diagnostic mode of the pool, so they are not used when the request asks for
+	// another OS, the demands for another image or mode, or for service containers, nor for the
+	// canary.
+	if agentPool != nil && isWarmPoolEnabled(agentPool) && demandImage == "" && diagnostics == v1alpha1.DiagnosticsMode(agentPool, nil) &&
+		agentOS == v1alpha1.PoolOS(agentPool) && !v1alpha1.HasServiceDemands(agentRequest.Demands) && agentNamespace == podnamespace && cluster == "" && !agentRequest.Canary {
+		if claimed, ok := acquireStandbyPod(agentRequest, podnamespace, agentPool); ok {
+			trace.decide("warm-pool", "claimed", "A standby pod of the pool was ready")
+			claimed.Warnings = append(response.Warnings, claimed.Warnings...)
+			return claimed
+		}
+		trace.decide("warm-pool", DecisionSkipped, "No standby pod of the pool was ready")
+	}
 
-	if webserverpoderr == nil && webserverpod.Items != nil {
-		AddOwnerRefToObject(pod, AsOwner(&webserverpod.Items[0]))
-		log.Println("Webserver pod added as owner reference to agent pod ")
+	if err := constrainWindowsBuild(cs, pod, agentPool); err != nil {
+		trace.decide("windows-build", DecisionRejected, err.Error())
+		return getFailureResponse(response, err)
+	}
+	if build := pod.Spec.NodeSelector[windowsBuildLabel]; build != "" {
+		trace.decide("windows-build", build, "Nodes with the OS build of the agent image")
+	}
 
-		log.Println("Creating the agent secret")
+	logger.Debug("Starting pod creation")
 
-		sec = createSecret(cs, agentRequest, &webserverpod.Items[0])
+	podClient := cs.clientset.CoreV1().Pods(podnamespace)
+	webserverpod, webserverpoderr := podClient.List(metav1.ListOptions{LabelSelector: "app=azurepipelinespool-operator"})
+
+	// Owner references cannot point into another namespace
+	var owner *v1.Pod
+	if webserverpoderr == nil && len(webserverpod.Items) > 0 && agentNamespace == podnamespace {
+		owner = &webserverpod.Items[0]
+		AddOwnerRefToObject(pod, AsOwner(owner))
+		logger.Debug("Webserver pod added as owner reference to agent pod ")
 	} else {
-		log.Println("Web Server Pod not found")
+		logger.Debug("Web Server Pod not found")
+	}
+
+	logger.Debug("Creating the agent secret")
+	sec, err = createNamedSecret(cs, agentRequest, owner, "", agentNamespace)
+	if err != nil {
+		logger.Error("Failed to create the agent secret", err)
+		trace.decide("secret", DecisionRejected, err.Error())
+		return getFailureResponse(response, err)
 	}
 
 	// Mount the secrets as a volume
 	pod.Spec.Volumes = append(pod.Spec.Volumes, *getSecretVolume(sec.Name))
-	log.Println("Secrets mounted as volume")
+	addRegistryCredentialsVolume(pod, agentPool, sec.Name)
+	response.Warnings = append(response.Warnings, provisionRegistryCredentials(cs, agentRequest.AgentId, agentPool, sec.Name, owner, agentNamespace)...)
+	addKubeconfigVolume(pod, agentPool, sec.Name)
+	response.Warnings = append(response.Warnings, provisionKubeconfig(cs, agentRequest.AgentId, agentPool, sec.Name, owner, agentNamespace)...)
+	addJobContextEnvironmentVariable(pod)
+	addIdentityToken(pod, podnamespace)
+	addArtifactCacheEnvironmentVariable(pod, podnamespace)
+	addTraceContextEnvironmentVariables(pod, agentRequest.TraceParent, agentRequest.TraceState)
+	logger.Debug("Secrets mounted as volume")
+
+	publishDns := agentPool != nil && agentPool.PublishDNS
+	if publishDns {
+		addAgentDnsEnvironmentVariable(pod, agentRequest.AgentId, agentNamespace)
+	}
 
-	_, err2 := podClient.Create(pod)
+	if name := agentPodName(agentRequest.AgentId); name != "" && pod.GetName() == "" {
+		pod.Name, pod.GenerateName = name, ""
+	}
+	stampProvenance(pod, agentRequest.AgentId, newPodProvenance(crdobject, agentPool, &agentRequest))
+
+	RecordJournalStep(agentRequest, agentNamespace, cluster, JournalStepPodRequested, "")
+
+	createdName, agentOwner, err2 := createAgentWorkload(cs, pod, agentPool, agentNamespace)
+	if k8serrors.IsAlreadyExists(err2) {
+		// Another replica created the agent pod in the meantime, its secret is the one mounted
+		cs.clientset.CoreV1().Secrets(agentNamespace).Delete(sec.Name, &metav1.DeleteOptions{})
+		logger.Info("Agent pod " + pod.GetName() + " was created by another request")
+		trace.decide("pod", pod.GetName(), "Created by another request for the agent")
+		return duplicateAgentResponse(response, poolName, agentNamespace, cluster)
+	}
 	if err2 != nil {
-		return getFailureResponse(response, err)
+		// The credentials of an agent which never starts are not kept
+		cs.clientset.CoreV1().Secrets(agentNamespace).Delete(sec.Name, &metav1.DeleteOptions{})
+		trace.decide("pod", DecisionRejected, err2.Error())
+		agentPodsCreated.WithLabelValues(poolName, "failure").Inc()
+		if agentPool != nil {
+			recordProvisioningAttempt(agentPool.PoolName, agentImage(pod), podCreationFailure(err2), time.Now().UTC())
+		}
+		logger.Error("Failed to create the agent pod", err2)
+		return getFailureResponse(response, err2)
 	}
 
-	log.Println("Pod creation done")
+	recordAgentCluster(agentRequest.AgentId, cluster)
+	logger = logger.with(podField, createdName)
+	logger.Info("Pod creation done")
+	trace.decide("pod", createdName, "Created in namespace "+agentNamespace)
+	agentPodsCreated.WithLabelValues(poolName, "success").Inc()
+	RecordJournalStep(agentRequest, agentNamespace, cluster, JournalStepPodCreated, createdName)
+	// The script of the canary exits at once, its agent never comes online
+	if !agentRequest.Canary {
+		watchAgentStartup(agentRequest.AgentId, poolName, createdName, agentNamespace)
+	}
+
+	if publishDns {
+		if err := createOwnedAgentService(cs, agentOwner, agentRequest.AgentId, agentNamespace); err != nil {
+			logger.Warn("Failed to publish agent DNS name", err)
+			response.Warnings = append(response.Warnings, "Agent DNS name not published: "+err.Error())
+		}
+	}
+
+	response.Namespace, response.Cluster = agentNamespace, cluster
+	response.Accepted = true
+	response.ResponseType = "Success"
+	response.EstimatedWaitSeconds = toSeconds(startupLatency(poolName))
+	return response
+}
 
+// Answers a request for an agent which has a pod already like the request which created it.
+func duplicateAgentResponse(response AgentProvisionResponse, poolName string, namespace string, cluster string) AgentProvisionResponse {
+	agentPodsCreated.WithLabelValues(poolName, "duplicate").Inc()
+	response.Namespace, response.Cluster = namespace, cluster
 	response.Accepted = true
 	response.ResponseType = "Success"
+	response.EstimatedWaitSeconds = toSeconds(startupLatency(poolName))
 	return response
 }
 
@@ -122,8 +353,18 @@ func GetBuildKitPod(key string, podnamespace string) PodResponse {
 }
 
 func DeletePodWithAgentId(agentId string, podnamespace string) PodResponse {
-	cs := CreateClientSet()
+	return deleteAgentPod(newFieldLogger().with(agentIdField, agentId), agentId, podnamespace)
+}
+
+func deleteAgentPod(logger fieldLogger, agentId string, podnamespace string) PodResponse {
 	var response PodResponse
+	cs, cluster, err := agentClientSet(agentId)
+	if err != nil {
+		return getFailure(response, err)
+	}
+	if cluster != "" {
+		logger = logger.with(clusterField, cluster)
+	}
 
 	podClient := cs.clientset.CoreV1().Pods(podnamespace)
 
@@ -131,30 +372,70 @@ func DeletePodWithAgentId(agentId string, podnamespace string) PodResponse {
 
 	// Get the secret with this agentId
 	secrets, _ := secretClient.List(metav1.ListOptions{LabelSelector: agentIdLabel + "=" + agentId})
-	if secrets == nil || len(secrets.Items) == 0 {
-		return getFailure(response, errors.New("Could not find secret with AgentId "+agentId))
-	}
+	hasSecret := secrets != nil && len(secrets.Items) > 0
 
 	// Get the pod with this agentId
 	pods, _ := podClient.List(metav1.ListOptions{LabelSelector: agentIdLabel + "=" + agentId})
-	if pods == nil || len(pods.Items) == 0 {
+	hasPod := pods != nil && len(pods.Items) > 0
+
+	// Adopted external agent pods come without a secret of the provider
+	if !hasSecret && !(hasPod && isAdoptedPod(&pods.Items[0])) {
+		return getFailure(response, errors.New("Could not find secret with AgentId "+agentId))
+	}
+	// The Job of an agent which exited is deleted with its pod after the TTL of the pool
+	job, jobFinished := getAgentJobRecord(agentId)
+	jobFinished = jobFinished && job.Namespace == podnamespace
+	if !hasPod && !jobFinished {
 		return getFailure(response, errors.New("Could not find running pod with AgentId "+agentId))
 	}
 
-	secreterr := secretClient.Delete(secrets.Items[0].GetName(), &metav1.DeleteOptions{})
-	if secreterr != nil {
-		return getFailure(response, secreterr)
+	var pod *v1.Pod
+	message := "Deleted job record of " + job.Job
+	poolName := job.Pool
+	logger = logger.with(podField, job.Job)
+	if hasPod {
+		pod = &pods.Items[0]
+		message = "Deleted " + pod.GetName()
+		poolName = pod.Labels[agentPoolLabel]
+		logger = logger.with(podField, pod.GetName())
+	}
+	logger = logger.with(poolField, poolName)
+	if err := waitForApiBudget(poolName, apiOperationDelete, throttleWaitTimeout); err != nil {
+		logger.Warn("Agent pool "+poolName+" used up its Kubernetes API budget", err)
+		return getFailure(response, err)
+	}
+	if hasSecret {
+		secreterr := secretClient.Delete(secrets.Items[0].GetName(), &metav1.DeleteOptions{})
+		if secreterr != nil {
+			return getFailure(response, secreterr)
+		}
+		logger.Debug("Delete agent secret done")
+		message += " and secret " + secrets.Items[0].GetName()
 	}
-	log.Println("Delete agent secret done")
 
-	poderr := podClient.Delete(pods.Items[0].GetName(), &metav1.DeleteOptions{})
-	if poderr != nil {
-		return getFailure(response, poderr)
+	if pod != nil {
+		poderr := deleteAgentWorkload(cs, pod, podnamespace)
+		if poderr != nil {
+			return getFailure(response, poderr)
+		}
+		logger.Info("Delete agent pod done")
+		agentPodsDeleted.WithLabelValues("release").Inc()
+		RecordReleasedPodCost(pod)
+		recordRunAffinity(pod)
+	}
+	if jobFinished {
+		GetStorage().Delete(agentJobKeyPrefix + agentId)
 	}
-	log.Println("Delete agent pod done")
+	forgetAgentCluster(agentId, cluster)
+	forgetEphemeralAgent(agentId)
+	forgetAgentStartup(agentId)
+
+	deleteAgentServices(cs, agentId, podnamespace)
+	revokeRegistryCredentials(cs, agentId, podnamespace)
+	deleteKubeconfig(cs, agentId, podnamespace)
 
 	response.Status = "success"
-	response.Message = "Deleted " + pods.Items[0].GetName() + " and secret " + secrets.Items[0].GetName()
+	response.Message = message
 	return response
 }
 
@@ -170,7 +451,22 @@ func getAgentSecret() *v1.Secret {
 }
 
 func createSecret(cs *k8s, request AgentRequest, m *v1.Pod) *v1.Secret {
+	secret, err := createNamedSecret(cs, request, m, "", podnamespace)
+	if err != nil {
+		log.Println(err)
+	}
+	return secret
+}
+
+// Creates the agent secret with the given name in the given namespace. When the name is empty it is generated.
+// The secret holds the registration settings and credentials of the agent, which reach the agent
+// pod only through the secret volume, never through its environment.
+func createNamedSecret(cs *k8s, request AgentRequest, m *v1.Pod, name string, namespace string) (*v1.Secret, error) {
 	secret := getAgentSecret()
+	if name != "" {
+		secret.ObjectMeta.GenerateName = ""
+		secret.ObjectMeta.Name = name
+	}
 
 	log.Println("Parsing secret data from agent request")
 	agentSettings, _ := json.Marshal(request.AgentConfiguration.AgentSettings)
@@ -187,38 +483,39 @@ func createSecret(cs *k8s, request AgentRequest, m *v1.Pod) *v1.Secret {
 	secret.Data[".credentials"] = ([]byte(string(agentCredentials)))
 	secret.Data[".url"] = ([]byte(request.AgentConfiguration.AgentDownloadUrls["linux-x64"]))
 	secret.Data[".agentVersion"] = ([]byte(request.AgentConfiguration.AgentVersion))
-	secret.ObjectMeta.SetNamespace(podnamespace)
+	secret.Data[jobContextFile] = marshalJobContext(request)
+	secret.ObjectMeta.SetNamespace(namespace)
 	log.Println("Secret to be created in namespace: " + secret.ObjectMeta.GetNamespace())
 
 	if m != nil {
 		AddOwnerRefToObject(secret, AsOwner(m))
 		log.Println("WebServer pod added as Owner reference to secret")
 	}
-	secretClient := cs.clientset.CoreV1().Secrets(podnamespace)
+	secretClient := cs.clientset.CoreV1().Secrets(namespace)
 	secret2, err := secretClient.Create(secret)
-
 	if err != nil {
-		log.Println(err)
-		secret2.Name = "newname"
+		return nil, err
 	}
 	log.Println("Secret creation done")
-	return secret2
+	return secret2, nil
 }
 
 func getSecretVolume(secretName string) *v1.Volume {
 	return &v1.Volume{
-		Name:         "agent-creds",
+		Name:         agentCredsVolume,
 		VolumeSource: v1.VolumeSource{Secret: &v1.SecretVolumeSource{SecretName: secretName}},
 	}
 }
 
 func getFailure(response PodResponse, err error) PodResponse {
+	recordRecentError(err)
 	response.Status = "fail"
 	response.Message = err.Error()
 	return response
 }
 
 func getFailureResponse(response AgentProvisionResponse, err error) AgentProvisionResponse {
+	recordRecentError(err)
 	response.ResponseType = "fail"
 	response.ErrorMessage = err.Error()
 	return response
@@ -49,7 +49,7 @@ func TestCreateSecret(t *testing.T) {
 
 	testSecret := createSecret(cs, agentrequest, nil)
 
-	if testSecret.Name == "newname" {
+	if testSecret == nil {
 		t.Errorf("Secret creation failed")
 	}
 
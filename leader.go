@@ -0,0 +1,218 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/leaderelection"
+	"k8s.io/client-go/tools/leaderelection/resourcelock"
+)
+
+// Webserver replicas elect a leader through a Lease in their namespace. All replicas serve the HTTP
+// requests; the background loops only do their work on the leader, or, with POOL_SHARDING, on the
+// replica owning the pool, so two replicas never create the same standby pods.
+const (
+	leaderLeaseName      = "poolprovider-webserver"
+	leaseDuration        = 15 * time.Second
+	leaseRenewDeadline   = 10 * time.Second
+	leaseRetryPeriod     = 2 * time.Second
+	defaultDrillBound    = 60 * time.Second
+	drillPollingInterval = 500 * time.Millisecond
+)
+
+var leaderState = struct {
+	sync.Mutex
+	identity       string
+	leader         string
+	isLeader       bool
+	cancel         context.CancelFunc
+	standDownUntil time.Time
+	// Ends the stand down early
+	rejoin chan struct{}
+}{rejoin: make(chan struct{}, 1)}
+
+type FailoverDrillResult struct {
+	PreviousLeader  string
+	NewLeader       string
+	FailoverSeconds float64
+	BoundSeconds    float64
+	Succeeded       bool
+}
+
+func IsLeader() bool {
+	leaderState.Lock()
+	defer leaderState.Unlock()
+	return leaderState.isLeader
+}
+
+func currentLeader() string {
+	leaderState.Lock()
+	defer leaderState.Unlock()
+	return leaderState.leader
+}
+
+// Takes part in the leader election until the process exits. When the leadership is lost or given
+// up, the replica joins the election again, unless it is standing down for a failover drill.
+func RunLeaderElection(namespace string) {
+	identity, _ := os.Hostname()
+	leaderState.Lock()
+	leaderState.identity = identity
+	leaderState.Unlock()
+
+	lock := &resourcelock.LeaseLock{
+		LeaseMeta:  metav1.ObjectMeta{Name: leaderLeaseName, Namespace: namespace},
+		Client:     CreateClientSet().clientset.CoordinationV1(),
+		LockConfig: resourcelock.ResourceLockConfig{Identity: identity},
+	}
+
+	for {
+		waitForStandDown()
+
+		ctx, cancel := context.WithCancel(context.Background())
+		leaderState.Lock()
+		leaderState.cancel = cancel
+		leaderState.Unlock()
+
+		leaderelection.RunOrDie(ctx, leaderelection.LeaderElectionConfig{
+			Lock:            lock,
+			LeaseDuration:   leaseDuration,
+			RenewDeadline:   leaseRenewDeadline,
+			RetryPeriod:     leaseRetryPeriod,
+			ReleaseOnCancel: true,
+			Callbacks: leaderelection.LeaderCallbacks{
+				OnStartedLeading: func(ctx context.Context) {
+					log.Println("Became the leader of the webserver replicas")
+					setLeadership(true)
+				},
+				OnStoppedLeading: func() {
+					log.Println("Stopped leading the webserver replicas")
+					setLeadership(false)
+				},
+				OnNewLeader: func(leader string) {
+					leaderState.Lock()
+					leaderState.leader = leader
+					leaderState.Unlock()
+				},
+			},
+		})
+		cancel()
+	}
+}
+
+func setLeadership(isLeader bool) {
+	leaderState.Lock()
+	defer leaderState.Unlock()
+	leaderState.isLeader = isLeader
+	if isLeader {
+		leaderState.leader = leaderState.identity
+	}
+}
+
+// Returns once the replica is not standing down anymore, at the end of the stand down or when it is
+// told to rejoin the election.
+func waitForStandDown() {
+	for {
+		leaderState.Lock()
+		wait := time.Until(leaderState.standDownUntil)
+		leaderState.Unlock()
+		if wait <= 0 {
+			return
+		}
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-leaderState.rejoin:
+			timer.Stop()
+		}
+	}
+}
+
+// Ends the stand down, the replica joins the election again right away.
+func rejoinElection() {
+	leaderState.Lock()
+	leaderState.standDownUntil = time.Time{}
+	leaderState.Unlock()
+	select {
+	case leaderState.rejoin <- struct{}{}:
+	default:
+	}
+}
+
+// Gives up the lease and stays out of the election for the given time.
+func standDown(duration time.Duration) {
+	leaderState.Lock()
+	defer leaderState.Unlock()
+	leaderState.standDownUntil = time.Now().Add(duration)
+	if leaderState.cancel != nil {
+		leaderState.cancel()
+	}
+}
+
+// Releases the lease on the leader and measures how long it takes another replica to take over.
+// The bound defaults to a minute and can be set with ?timeout=<seconds>.
+func FailoverDrillHandler(resp http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		writeJsonResponse(resp, http.StatusMethodNotAllowed, GetError(InvalidRequestError))
+		return
+	}
+	if !isRequestHmacValid(req) {
+		writeJsonResponse(resp, http.StatusForbidden, GetError(NoValidSignatureError))
+		return
+	}
+	if !IsLeader() {
+		writeJsonResponse(resp, http.StatusConflict, GetError(NotLeaderError+" Current leader: "+currentLeader()))
+		return
+	}
+
+	bound := defaultDrillBound
+	if seconds, err := strconv.Atoi(req.URL.Query().Get("timeout")); err == nil && seconds > 0 {
+		bound = time.Duration(seconds) * time.Second
+	}
+
+	result := runFailoverDrill(bound)
+	RecordConfigChange(adminPrincipal(req), "failover-drill", "lease/"+leaderLeaseName,
+		map[string]string{"holder": result.PreviousLeader}, map[string]string{"holder": result.NewLeader})
+	if result.Succeeded {
+		writeJsonResponse(resp, http.StatusOK, result)
+	} else {
+		writeJsonResponse(resp, http.StatusGatewayTimeout, result)
+	}
+}
+
+func runFailoverDrill(bound time.Duration) FailoverDrillResult {
+	leaderState.Lock()
+	identity := leaderState.identity
+	leaderState.Unlock()
+
+	log.Println("Starting failover drill, releasing the lease")
+	result := FailoverDrillResult{PreviousLeader: identity, BoundSeconds: bound.Seconds()}
+	start := time.Now()
+	standDown(bound)
+
+	leaseClient := CreateClientSet().clientset.CoordinationV1().Leases(podnamespace)
+	for time.Since(start) < bound {
+		lease, err := leaseClient.Get(leaderLeaseName, metav1.GetOptions{})
+		if err == nil && lease.Spec.HolderIdentity != nil && *lease.Spec.HolderIdentity != "" && *lease.Spec.HolderIdentity != identity {
+			result.NewLeader = *lease.Spec.HolderIdentity
+			result.FailoverSeconds = time.Since(start).Seconds()
+			result.Succeeded = true
+			log.Println("Failover drill succeeded, "+result.NewLeader+" took over after", result.FailoverSeconds, "seconds")
+			break
+		}
+		time.Sleep(drillPollingInterval)
+	}
+
+	if !result.Succeeded {
+		// Nobody took over, rejoin the election right away
+		log.Println("Failover drill failed, no replica took over within", bound)
+		rejoinElection()
+	}
+	return result
+}
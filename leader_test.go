@@ -0,0 +1,54 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestFailoverDrillShouldOnlyRunOnLeader(t *testing.T) {
+	SetupCustomResource()
+	setLeadership(false)
+
+	var jsonStr = []byte(`{"AgentId":"1"}`)
+	req, _ := http.NewRequest("POST", "/admin/failover-drill", bytes.NewBuffer(jsonStr))
+	req.Header.Add("X-Azure-Signature", "4f6a97c5aa13477ed775dd20cdd7cf44477e310ba683545144d5112e77d88be967a43791da0696ded702a32ca0c190ab831dcd9204521b9a9ebe413066699ef9")
+
+	resp := httptest.NewRecorder()
+	http.HandlerFunc(FailoverDrillHandler).ServeHTTP(resp, req)
+
+	if resp.Code != http.StatusConflict {
+		t.Errorf("Status code differs. Expected %d. Got %d", http.StatusConflict, resp.Code)
+	}
+}
+
+func TestFailoverDrillShouldFailWhenNobodyTakesOver(t *testing.T) {
+	SetupCustomResource()
+	setLeadership(true)
+	defer setLeadership(false)
+
+	result := runFailoverDrill(10 * time.Millisecond)
+	if result.Succeeded || result.NewLeader != "" {
+		t.Errorf("Expected the drill to fail without another replica. Got %v", result)
+	}
+}
+
+func TestFailedFailoverDrillShouldEndTheStandDownEarly(t *testing.T) {
+	SetupCustomResource()
+	standDown(time.Minute)
+
+	rejoined := make(chan struct{})
+	go func() {
+		waitForStandDown()
+		close(rejoined)
+	}()
+
+	runFailoverDrill(10 * time.Millisecond)
+	select {
+	case <-rejoined:
+	case <-time.After(5 * time.Second):
+		t.Errorf("Expected the replica to rejoin the election once the drill failed")
+	}
+}
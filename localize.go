@@ -0,0 +1,143 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// The fixed messages of API responses can be translated for operators. MESSAGE_CATALOG_DIR holds a
+// catalog per language, "<language>.json", mapping the English messages to their translation, e.g.
+// "de.json" with {"Invalid request Method.": "Ungültige Anfragemethode."}. The language is
+// negotiated from the Accept-Language header of the request, DEFAULT_LANGUAGE is used otherwise.
+// English needs no catalog, messages missing in a catalog stay English.
+const (
+	defaultLanguage       = "en"
+	contentLanguageHeader = "Content-Language"
+	acceptLanguageHeader  = "Accept-Language"
+)
+
+var messageCatalogs = struct {
+	sync.Once
+	catalogs map[string]map[string]string
+}{}
+
+func loadMessageCatalogs(dir string) map[string]map[string]string {
+	catalogs := map[string]map[string]string{}
+	if dir == "" {
+		return catalogs
+	}
+
+	files, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		log.Println("Failed to list message catalogs", err)
+		return catalogs
+	}
+	for _, file := range files {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			log.Println("Failed to read message catalog "+file, err)
+			continue
+		}
+		var catalog map[string]string
+		if err := json.Unmarshal(data, &catalog); err != nil {
+			log.Println("Ignoring invalid message catalog "+file, err)
+			continue
+		}
+		catalogs[strings.ToLower(strings.TrimSuffix(filepath.Base(file), ".json"))] = catalog
+	}
+	return catalogs
+}
+
+func getMessageCatalogs() map[string]map[string]string {
+	messageCatalogs.Do(func() {
+		messageCatalogs.catalogs = loadMessageCatalogs(os.Getenv("MESSAGE_CATALOG_DIR"))
+	})
+	return messageCatalogs.catalogs
+}
+
+func configuredDefaultLanguage() string {
+	if language := strings.ToLower(os.Getenv("DEFAULT_LANGUAGE")); language != "" {
+		return language
+	}
+	return defaultLanguage
+}
+
+// Picks the first language of the Accept-Language header there is a catalog for, e.g. "de" for
+// "de-CH, fr;q=0.8". Quality values are not weighed, clients list their preferred language first.
+func negotiateLanguage(acceptLanguage string, catalogs map[string]map[string]string) string {
+	for _, part := range strings.Split(acceptLanguage, ",") {
+		tag := strings.ToLower(strings.TrimSpace(strings.SplitN(part, ";", 2)[0]))
+		for tag != "" {
+			if _, ok := catalogs[tag]; ok || tag == defaultLanguage {
+				return tag
+			}
+			i := strings.LastIndex(tag, "-")
+			if i < 0 {
+				break
+			}
+			tag = tag[:i]
+		}
+	}
+	return configuredDefaultLanguage()
+}
+
+// Translates the message. A message which starts with a catalog message, e.g. one with details
+// appended, gets the longest such part translated.
+func localize(language string, message string, catalogs map[string]map[string]string) string {
+	catalog := catalogs[language]
+	if translated, ok := catalog[message]; ok {
+		return translated
+	}
+	longest := ""
+	for original := range catalog {
+		if original != "" && strings.HasPrefix(message, original) && len(original) > len(longest) {
+			longest = original
+		}
+	}
+	if longest == "" {
+		return message
+	}
+	return catalog[longest] + message[len(longest):]
+}
+
+// Sets the language of the response, which writeJsonResponse translates the messages to.
+func withLocalization(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		resp.Header().Set(contentLanguageHeader, negotiateLanguage(req.Header.Get(acceptLanguageHeader), getMessageCatalogs()))
+		handler.ServeHTTP(resp, req)
+	})
+}
+
+// Translates the messages of the response bodies which carry one for people to read.
+func localizeResponse(resp http.ResponseWriter, body interface{}) interface{} {
+	language := resp.Header().Get(contentLanguageHeader)
+	if language == "" {
+		language = configuredDefaultLanguage()
+	}
+	catalogs := getMessageCatalogs()
+	if _, ok := catalogs[language]; !ok {
+		return body
+	}
+
+	switch response := body.(type) {
+	case ErrorMessage:
+		response.Error = localize(language, response.Error, catalogs)
+		return response
+	case AgentProvisionResponse:
+		response.ErrorMessage = localize(language, response.ErrorMessage, catalogs)
+		return response
+	case *AgentProvisionResponse:
+		if response != nil {
+			localized := *response
+			localized.ErrorMessage = localize(language, localized.ErrorMessage, catalogs)
+			return localized
+		}
+	}
+	return body
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoadMessageCatalogsShouldReadOneCatalogPerLanguage(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "catalogs")
+	defer os.RemoveAll(dir)
+	ioutil.WriteFile(filepath.Join(dir, "de.json"), []byte(`{"Invalid request Method.": "Ungültige Anfragemethode."}`), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "fr.json"), []byte(`not json`), 0644)
+
+	catalogs := loadMessageCatalogs(dir)
+
+	if len(catalogs) != 1 || catalogs["de"][InvalidRequestError] != "Ungültige Anfragemethode." {
+		t.Errorf("Expected the German catalog only. Got %v", catalogs)
+	}
+}
+
+func TestNegotiateLanguageShouldFallBackToBaseLanguage(t *testing.T) {
+	catalogs := map[string]map[string]string{"de": {}, "ja": {}}
+
+	if language := negotiateLanguage("de-CH, fr;q=0.8", catalogs); language != "de" {
+		t.Errorf("Expected de. Got %s", language)
+	}
+	if language := negotiateLanguage("fr, ja;q=0.5", catalogs); language != "ja" {
+		t.Errorf("Expected ja. Got %s", language)
+	}
+	if language := negotiateLanguage("fr", catalogs); language != defaultLanguage {
+		t.Errorf("Expected the default language. Got %s", language)
+	}
+}
+
+func TestLocalizeShouldTranslateKnownPrefixes(t *testing.T) {
+	catalogs := map[string]map[string]string{"de": {NotLeaderError: "Dieses Replikat ist nicht der Leader."}}
+
+	if message := localize("de", NotLeaderError+" Current leader: pod-1", catalogs); message != "Dieses Replikat ist nicht der Leader. Current leader: pod-1" {
+		t.Errorf("Unexpected message %s", message)
+	}
+	if message := localize("de", ServerBusyError, catalogs); message != ServerBusyError {
+		t.Errorf("Expected untranslated messages to stay English. Got %s", message)
+	}
+}
+
+func TestLocalizeResponseShouldUseTheResponseLanguage(t *testing.T) {
+	messageCatalogs.Do(func() {})
+	messageCatalogs.catalogs = map[string]map[string]string{"de": {ServerBusyError: "Zu viele Agenten werden erstellt."}}
+	defer func() { messageCatalogs.catalogs = nil }()
+
+	resp := httptest.NewRecorder()
+	resp.Header().Set(contentLanguageHeader, "de")
+
+	localized := localizeResponse(resp, AgentProvisionResponse{ResponseType: "fail", ErrorMessage: ServerBusyError}).(AgentProvisionResponse)
+	if localized.ErrorMessage != "Zu viele Agenten werden erstellt." {
+		t.Errorf("Unexpected message %s", localized.ErrorMessage)
+	}
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Log lines are plain text unless LOG_FORMAT is "json", which writes every line as a JSON object
+// with time, level and msg, and the fields of the provisioning flow it belongs to: requestId,
+// agentId, pool and pod. LOG_LEVEL, "info" by default, drops the lines below debug, info, warn or
+// error; lines written through the log package are info. Every HTTP request gets an id, taken from
+// a valid X-Request-Id header or generated, which is returned in X-Request-Id and put on the log
+// lines of the acquire or release it carries.
+const (
+	requestIdHeader = "X-Request-Id"
+	LogFormatJson   = "json"
+	LogFormatText   = "text"
+	LogLevelDebug   = "debug"
+	LogLevelInfo    = "info"
+	LogLevelWarn    = "warn"
+	LogLevelError   = "error"
+	requestIdField  = "requestId"
+	agentIdField    = "agentId"
+	poolField       = "pool"
+	podField        = "pod"
+	clusterField    = "cluster"
+	textTimeFormat  = "2006/01/02 15:04:05"
+)
+
+var logLevelOrder = map[string]int{LogLevelDebug: 0, LogLevelInfo: 1, LogLevelWarn: 2, LogLevelError: 3}
+
+var requestIdFormat = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+
+type requestIdKey struct{}
+
+// Writes the log lines of the log package and of the field loggers in the configured format.
+type logSink struct {
+	sync.Mutex
+	out   io.Writer
+	json  bool
+	level int
+}
+
+var logOutput = &logSink{out: os.Stderr, level: logLevelOrder[LogLevelInfo]}
+
+func configuredLogFormat() string {
+	if strings.EqualFold(os.Getenv("LOG_FORMAT"), LogFormatJson) {
+		return LogFormatJson
+	}
+	return LogFormatText
+}
+
+func configuredLogLevel() string {
+	level := strings.ToLower(os.Getenv("LOG_LEVEL"))
+	if _, ok := logLevelOrder[level]; ok {
+		return level
+	}
+	return LogLevelInfo
+}
+
+// Sends the output of the log package through the sink.
+func configureLogging(out io.Writer) {
+	asJson := configuredLogFormat() == LogFormatJson
+	logOutput.Lock()
+	logOutput.out, logOutput.json, logOutput.level = out, asJson, logLevelOrder[configuredLogLevel()]
+	logOutput.Unlock()
+	if asJson {
+		log.SetFlags(0)
+	}
+	log.SetOutput(logOutput)
+}
+
+// Every call of the log package writes one info line.
+func (s *logSink) Write(p []byte) (int, error) {
+	s.Lock()
+	asJson := s.json
+	s.Unlock()
+	if !asJson {
+		return s.write(LogLevelInfo, p)
+	}
+	s.emit(time.Now(), LogLevelInfo, strings.TrimSuffix(string(p), "\n"), nil)
+	return len(p), nil
+}
+
+func (s *logSink) write(level string, p []byte) (int, error) {
+	s.Lock()
+	defer s.Unlock()
+	if logLevelOrder[level] < s.level {
+		return len(p), nil
+	}
+	return s.out.Write(p)
+}
+
+func (s *logSink) emit(now time.Time, level string, message string, fields []logField) {
+	s.Lock()
+	asJson := s.json
+	s.Unlock()
+	s.write(level, formatLogLine(asJson, now, level, message, fields))
+}
+
+func formatLogLine(asJson bool, now time.Time, level string, message string, fields []logField) []byte {
+	if !asJson {
+		line := now.Format(textTimeFormat) + " " + message
+		if level != LogLevelInfo {
+			line += " level=" + level
+		}
+		for _, field := range fields {
+			line += " " + field.key + "=" + field.value
+		}
+		return []byte(line + "\n")
+	}
+
+	entry := map[string]string{"time": now.UTC().Format(time.RFC3339Nano), "level": level, "msg": message}
+	for _, field := range fields {
+		entry[field.key] = field.value
+	}
+	data, _ := json.Marshal(entry)
+	return append(data, '\n')
+}
+
+type logField struct {
+	key   string
+	value string
+}
+
+// Logs lines carrying the fields of one provisioning flow. Fields without a value are left out.
+type fieldLogger struct {
+	fields []logField
+}
+
+func newFieldLogger() fieldLogger {
+	return fieldLogger{}
+}
+
+// Returns a logger with the request id and agent id of the acquire request.
+func agentRequestLogger(agentRequest AgentRequest) fieldLogger {
+	return newFieldLogger().with(requestIdField, agentRequest.RequestId).with(agentIdField, agentRequest.AgentId)
+}
+
+func (l fieldLogger) with(key string, value string) fieldLogger {
+	if value == "" {
+		return l
+	}
+	fields := make([]logField, 0, len(l.fields)+1)
+	for _, field := range l.fields {
+		if field.key != key {
+			fields = append(fields, field)
+		}
+	}
+	return fieldLogger{fields: append(fields, logField{key: key, value: value})}
+}
+
+func (l fieldLogger) log(level string, v []interface{}) {
+	logOutput.emit(time.Now(), level, strings.TrimSuffix(fmt.Sprintln(v...), "\n"), l.fields)
+}
+
+func (l fieldLogger) Debug(v ...interface{}) { l.log(LogLevelDebug, v) }
+func (l fieldLogger) Info(v ...interface{})  { l.log(LogLevelInfo, v) }
+func (l fieldLogger) Warn(v ...interface{})  { l.log(LogLevelWarn, v) }
+func (l fieldLogger) Error(v ...interface{}) { l.log(LogLevelError, v) }
+
+// Gives every request an id and returns it in the response.
+func withRequestId(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		id := req.Header.Get(requestIdHeader)
+		if !requestIdFormat.MatchString(id) {
+			id = randomHex(16)
+		}
+		resp.Header().Set(requestIdHeader, id)
+		handler.ServeHTTP(resp, req.WithContext(context.WithValue(req.Context(), requestIdKey{}, id)))
+	})
+}
+
+// Returns the id of the request, empty when it did not pass withRequestId.
+func requestId(req *http.Request) string {
+	id, _ := req.Context().Value(requestIdKey{}).(string)
+	return id
+}
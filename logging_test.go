@@ -0,0 +1,63 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFormatLogLineShouldWriteFieldsAsJson(t *testing.T) {
+	logger := agentRequestLogger(AgentRequest{AgentId: "7", RequestId: "abc"}).with(poolField, "linux").with(podField, "")
+
+	var entry map[string]string
+	line := formatLogLine(true, time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC), LogLevelWarn, "Pod creation done", logger.fields)
+	if err := json.Unmarshal(line, &entry); err != nil {
+		t.Fatalf("Expected a JSON line. Got %s (%v)", line, err)
+	}
+	if entry["level"] != LogLevelWarn || entry["msg"] != "Pod creation done" || entry[requestIdField] != "abc" || entry[agentIdField] != "7" || entry[poolField] != "linux" {
+		t.Errorf("Unexpected log entry %v", entry)
+	}
+	if _, ok := entry[podField]; ok {
+		t.Errorf("Expected fields without a value to be left out. Got %v", entry)
+	}
+}
+
+func TestLogSinkShouldDropLinesBelowLevel(t *testing.T) {
+	var out bytes.Buffer
+	sink := &logSink{out: &out, json: true, level: logLevelOrder[LogLevelWarn]}
+
+	sink.emit(time.Now(), LogLevelDebug, "debug", nil)
+	sink.Write([]byte("from the log package\n"))
+	sink.emit(time.Now(), LogLevelError, "error", nil)
+
+	if lines := strings.Split(strings.TrimSpace(out.String()), "\n"); len(lines) != 1 || !strings.Contains(lines[0], `"msg":"error"`) {
+		t.Errorf("Expected only the error line. Got %v", lines)
+	}
+}
+
+func TestWithRequestIdShouldKeepValidIds(t *testing.T) {
+	var seen string
+	handler := withRequestId(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		seen = requestId(req)
+	}))
+
+	resp := httptest.NewRecorder()
+	req := httptest.NewRequest("POST", "/acquire", nil)
+	req.Header.Set(requestIdHeader, "relay-42")
+	handler.ServeHTTP(resp, req)
+	if seen != "relay-42" || resp.Header().Get(requestIdHeader) != "relay-42" {
+		t.Errorf("Expected the id of the caller. Got %s, header %s", seen, resp.Header().Get(requestIdHeader))
+	}
+
+	resp = httptest.NewRecorder()
+	req = httptest.NewRequest("POST", "/acquire", nil)
+	req.Header.Set(requestIdHeader, "bad id\n")
+	handler.ServeHTTP(resp, req)
+	if len(seen) != 32 || resp.Header().Get(requestIdHeader) != seen {
+		t.Errorf("Expected a generated id. Got %s, header %s", seen, resp.Header().Get(requestIdHeader))
+	}
+}
@@ -3,50 +3,234 @@ package main
 import (
 	"bytes"
 	"encoding/json"
+	"io"
 	"io/ioutil"
 	"log"
 	"net/http"
 	"os"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
 var podnamespace = "azuredevops"
 
+// Azure DevOps signs the request body with HMAC-SHA512 and the shared secret VSTS_SECRET
+const (
+	signatureHeader = "X-Azure-Signature"
+	signatureScheme = "HMAC-SHA512"
+)
+
 func main() {
 
+	// Write the log lines in the configured format and keep the recent ones for the diagnostics bundle
+	configureLogging(io.MultiWriter(os.Stderr, recentLogs))
+
+	// Create the namespaces and RBAC objects the provider needs instead of serving
+	if len(os.Args) > 1 && os.Args[1] == "bootstrap" {
+		os.Exit(RunBootstrap(os.Args[2:], os.Stdout))
+	}
+
 	// Define HTTP endpoints
 	s := http.NewServeMux()
 
 	podnamespace = os.Getenv("POD_NAMESPACE")
 
-	s.HandleFunc("/acquire", func(w http.ResponseWriter, r *http.Request) { AcquireAgentHandler(w, r) })
-	s.HandleFunc("/release", func(w http.ResponseWriter, r *http.Request) { ReleaseAgentHandler(w, r) })
+	// Develop pool templates on a workstation against the fake Kubernetes client
+	if isDevMode() {
+		configureDevMode()
+		go RunDevTemplateWatcher()
+		s.HandleFunc("/dev/templates", withMethods([]string{http.MethodGet}, DevTemplatesHandler))
+		s.HandleFunc("/dev/rendered", withMethods([]string{http.MethodGet}, DevRenderedHandler))
+	}
+
+	// Finish or roll back acquire requests interrupted by a previous crash
+	RecoverInFlightAcquisitions()
+	RecoverOperations()
+
+	// Report RBAC permissions the provider is missing before an acquire runs into them
+	go RunPermissionsCheck()
+
+	// Elect a leader among the webserver replicas
+	go RunLeaderElection(podnamespace)
+
+	// Roll back acquire requests left behind by replicas which are gone
+	go RunJournalRecovery()
+
+	// Share the per-pool background work with the other replicas when the pools are sharded
+	go RunShardMembership()
+
+	// Keep standby agent pods ready, scaled by the Azure DevOps queue when polling is enabled
+	go RunWarmPoolController(podnamespace)
+	go RunQueuePoller(podnamespace)
+
+	// Slow down pod creations when the webserver runs low on memory
+	go RunPressureMonitor()
+
+	// Publish the pool state for kubectl and GitOps tooling
+	go RunPoolStateExporter(podnamespace)
+
+	// Record changes of the pool settings for change management
+	go RunConfigAuditor(podnamespace)
+
+	// Replace long-lived agent pods during the configured recycle window
+	go RunRecycleScheduler(podnamespace)
+
+	// Freeze pools which used up their monthly budget
+	go RunBudgetMonitor(podnamespace)
+
+	// Remove storage entries past their retention
+	go RunStorageCompaction()
+
+	// Keep the pool metadata in sync with the Azure DevOps pools
+	go RunPoolSync(podnamespace)
+
+	// Take over agent pods created by other tooling
+	go RunAdoptionController(podnamespace)
 
-	// Start HTTP Server with request logging
-	log.Fatal(http.ListenAndServe(":8080", s))
+	// Clean up the drift between the provider state, the agent pods and the Azure DevOps agents
+	go RunReconciler(podnamespace)
+
+	// Record the outcome of agent Jobs which finished
+	go RunAgentJobTracker(podnamespace)
+
+	// Delete the pods of ephemeral agents which ran their job and replenish the warm pools
+	go RunEphemeralAgentController(podnamespace)
+
+	// Follow the created agent pods until their agent is online
+	go RunAgentStartupWatch(podnamespace)
+
+	// Run a synthetic job through every agent pool to find broken pools before real jobs do
+	go RunCanary(podnamespace)
+
+	// Create the agent pods of acquire requests answered asynchronously
+	go RunOperationWorkers(podnamespace)
+
+	// Sample the usage of the agent pods for the right-sizing recommendations
+	go RunRightsizingCollector(podnamespace)
+
+	get, post, getOrPost := []string{http.MethodGet}, []string{http.MethodPost}, []string{http.MethodGet, http.MethodPost}
+	s.HandleFunc("/acquire", withMethods(post, withShutdownIntake(withDecompression(requestDecompression, withMirroring(inboundMirror, withRateLimit(requestRateLimiter, AcquireAgentHandler))))))
+	s.HandleFunc("/release", withMethods(post, withDecompression(requestDecompression, withMirroring(inboundMirror, withRateLimit(requestRateLimiter, ReleaseAgentHandler)))))
+	s.HandleFunc("/attest", withMethods(post, AttestAgentHandler))
+	s.HandleFunc("/status", withMethods(get, AgentStatusHandler))
+	s.HandleFunc("/pools", withMethods(get, PoolsHandler))
+	s.HandleFunc(poolsRoute, withMethods(get, PoolAgentsHandler))
+	s.HandleFunc("/stats", withMethods(get, StatsHandler))
+	s.HandleFunc("/stats/rightsizing", withMethods(get, RightsizingHandler))
+	s.HandleFunc(explainRoute, withMethods(get, ExplainHandler))
+	s.HandleFunc(operationsRoute, withMethods(get, OperationHandler))
+	s.HandleFunc("/payload", PayloadHandler(newPayloadInspectorFromEnvironment()))
+	s.HandleFunc(artifactRoute, withMethods([]string{http.MethodGet, http.MethodHead}, ArtifactCacheHandler(newArtifactCacheFromEnvironment())))
+	s.HandleFunc("/metrics", withMethods(get, promhttp.Handler().ServeHTTP))
+	s.HandleFunc("/healthz", withMethods(get, LivenessHandler))
+	s.HandleFunc("/readyz", withMethods(get, ReadinessHandler))
+	s.HandleFunc("/admin/failover-drill", withMethods(post, FailoverDrillHandler))
+	s.HandleFunc("/admin/audit/config", withMethods(get, AuditConfigHandler))
+	s.HandleFunc("/admin/templates/test", withMethods(post, TemplateTestHandler))
+	s.HandleFunc("/admin/reconcile", withMethods(get, ReconcileHandler))
+	s.HandleFunc("/admin/config/effective", withMethods(get, EffectiveConfigHandler))
+	s.HandleFunc("/admin/quarantine", withMethods(getOrPost, QuarantineHandler))
+	s.HandleFunc("/admin/killswitch", withMethods(getOrPost, KillSwitchHandler))
+	s.HandleFunc("/admin/permissions", withMethods(get, PermissionsHandler))
+	s.HandleFunc("/admin/canary", withMethods(get, CanaryHandler))
+	s.HandleFunc("/admin/compatibility", withMethods(get, CompatibilityHandler))
+	s.HandleFunc("/admin/diagnostics", withMethods(get, DiagnosticsBundleHandler))
+	s.HandleFunc("/admin/snapshot", withMethods(getOrPost, SnapshotHandler))
+	s.HandleFunc("/admin/storage/migration", withMethods(getOrPost, StorageMigrationHandler))
+	s.HandleFunc("/admin/verify-pod", withMethods(get, VerifyPodHandler))
+	s.HandleFunc("/admin/artifacts/purge", withMethods(post, ArtifactPurgeHandler(newArtifactCacheFromEnvironment())))
+
+	// Everything else goes to the fallback service, if configured
+	s.HandleFunc("/", fallbackHandler(newFallbackRouteFromEnvironment()))
+
+	tlsConfig, err := serverTLSConfig(os.Getenv("TLS_CERT_FILE"), os.Getenv("TLS_KEY_FILE"), os.Getenv("TLS_CLIENT_CA_FILE"))
+	if err != nil {
+		newFieldLogger().Error("Invalid TLS configuration", err)
+		os.Exit(1)
+	}
+
+	// Start HTTP Server with request logging, per client rate limits and body limits, drain it on SIGTERM
+	serveUntilTerminated(&http.Server{Addr: ":8080", Handler: withRequestId(withLocalization(withClientRateLimit(clientRateLimiter, os.Getenv("RATE_LIMIT_CLIENT_HEADER"), withBodyLimit(requestDecompression.maxBytes, map[string]int64{"/admin/snapshot": maxSnapshotBody()}, withRequestMetrics(s))))), TLSConfig: tlsConfig})
 }
 
 func AcquireAgentHandler(resp http.ResponseWriter, req *http.Request) {
 	// HTTP method should be POST and the HMAC header should be valid
 	if req.Method == http.MethodPost {
-		log.Println("Recieved agent acquire request ....")
+		logger := newFieldLogger().with(requestIdField, requestId(req))
+		logger.Info("Recieved agent acquire request ....")
 		if isRequestHmacValid(req) {
-			log.Println("Hmac Validated for acquire request")
+			logger.Debug("Hmac Validated for acquire request")
 			var agentRequest AgentRequest
 
 			requestBody, err := ioutil.ReadAll(req.Body)
-			json.Unmarshal(requestBody, &agentRequest)
+			if err == nil {
+				requestBody, err = transformAcquirePayload(req.Header.Get(callerHeader), requestBody, getPayloadTransforms())
+			}
+			if err == nil {
+				err = decodePayload("acquire", requestBody, &agentRequest)
+			}
+			agentRequest.TraceParent, agentRequest.TraceState = traceContextFromRequest(req)
+			agentRequest.RequestId = requestId(req)
+			resp.Header().Set(traceParentHeader, agentRequest.TraceParent)
+			logger = agentRequestLogger(agentRequest)
 
 			if err != nil {
 				writeJsonResponse(resp, http.StatusBadRequest, err.Error())
 			} else if agentRequest.AgentId == "" {
 				writeJsonResponse(resp, http.StatusBadRequest, GetError(NoAgentIdError))
+			} else if err := validateSatisfiability(agentRequest, podnamespace); err != nil {
+				logger.Warn("Rejecting agent request "+agentRequest.AgentId, err)
+				explainRejection(agentRequest, "satisfiability", err.Error())
+				writeJsonResponse(resp, http.StatusBadRequest, AgentProvisionResponse{ResponseType: "fail", ErrorMessage: err.Error()})
+			} else if existing, duplicate := ClaimAcquireRequest(agentRequest.AgentId); duplicate {
+				if existing != nil {
+					writeJsonResponse(resp, http.StatusCreated, existing)
+				} else {
+					writeJsonResponse(resp, http.StatusConflict, GetError(AcquireInProgressError))
+				}
+			} else if wantsAsyncResponse(req) {
+				acceptAsyncAcquire(resp, logger, agentRequest)
+			} else if position, limit, err := acquireCreationSlot(req, agentRequest); err == errCreationCanceled {
+				logger.Info("Acquire request of agent " + agentRequest.AgentId + " canceled while queued")
+				explainRejection(agentRequest, "creation-queue", AcquireCanceledError)
+				ForgetAcquireRequest(agentRequest.AgentId)
+				writeJsonResponse(resp, http.StatusConflict, AgentProvisionResponse{ResponseType: "fail", ErrorMessage: AcquireCanceledError})
+			} else if err != nil {
+				// Drop the claim so that the retry from Azure DevOps is handled
+				logger.Warn("Rejecting agent request "+agentRequest.AgentId+", the creation queue is full", err)
+				ForgetAcquireRequest(agentRequest.AgentId)
+				explainRejection(agentRequest, "creation-queue", ServerBusyError)
+				writeJsonResponse(resp, http.StatusServiceUnavailable, AgentProvisionResponse{
+					ResponseType:         "fail",
+					ErrorMessage:         ServerBusyError,
+					QueuePosition:        position + 1,
+					EstimatedWaitSeconds: toSeconds(estimateWait(agentRequest.AgentSpec, position, limit)),
+				})
 			} else {
-				log.Println("Calling create pod")
-				var pods = CreatePod(agentRequest, podnamespace)
-				writeJsonResponse(resp, http.StatusCreated, pods)
+				RecordJournalStep(agentRequest, podnamespace, "", JournalStepValidated, "")
+				stream := wantsEventStream(req)
+				if stream {
+					startEventStream(resp)
+				}
+				logger.Debug("Calling create pod")
+				started := time.Now()
+				pods := CreatePod(agentRequest, podnamespace)
+				// The slot limits the calls creating the agent, not the wait for it to come up
+				podCreationThrottle.Release()
+				recordCreationLatency(time.Since(started))
+				if stream {
+					pods = streamAgentProgress(resp, agentRequest, pods, started)
+				} else {
+					provisioningSeconds.Observe(time.Since(started).Seconds())
+					writeJsonResponse(resp, http.StatusCreated, pods)
+				}
+				RecordJournalStep(agentRequest, pods.Namespace, pods.Cluster, JournalStepCallbackSent, "")
+				StoreAcquireResult(agentRequest.AgentId, pods)
+				CompleteJournal(agentRequest.AgentId)
 			}
 		} else {
-			writeJsonResponse(resp, http.StatusForbidden, GetError(NoValidSignatureError))
+			writeSignatureError(resp, req)
 		}
 	} else {
 		writeJsonResponse(resp, http.StatusMethodNotAllowed, GetError(InvalidRequestError))
@@ -56,22 +240,37 @@ func AcquireAgentHandler(resp http.ResponseWriter, req *http.Request) {
 func ReleaseAgentHandler(resp http.ResponseWriter, req *http.Request) {
 
 	if req.Method == http.MethodPost {
-		log.Println("Recieved release agent request ....")
+		logger := newFieldLogger().with(requestIdField, requestId(req))
+		logger.Info("Recieved release agent request ....")
 		if isRequestHmacValid(req) {
-			log.Println("Hmac Validated for release request")
+			logger.Debug("Hmac Validated for release request")
 			var agentRequest ReleaseAgentRequest
 			requestBody, _ := ioutil.ReadAll(req.Body)
-			json.Unmarshal(requestBody, &agentRequest)
+			err := decodePayload("release", requestBody, &agentRequest)
+			logger = logger.with(agentIdField, agentRequest.AgentId)
 
-			if agentRequest.AgentId == "" {
+			if err != nil {
+				writeJsonResponse(resp, http.StatusBadRequest, GetError(err.Error()))
+			} else if agentRequest.AgentId == "" {
 				writeJsonResponse(resp, http.StatusBadRequest, GetError(NoAgentIdError))
 			} else {
-				log.Println("Calling delete pod")
-				var pods = DeletePodWithAgentId(agentRequest.AgentId, podnamespace)
+				if podCreationThrottle.Cancel(agentRequest.AgentId) {
+					logger.Info("Canceled the queued acquire request of agent " + agentRequest.AgentId)
+				}
+				logger.Debug("Calling delete pod")
+				var pods PodResponse
+				// The agent may have been created in the fallback namespace, while the namespace was
+				// terminating, or in the namespace of its pool
+				for _, namespace := range agentNamespaces(podnamespace) {
+					if pods = deleteAgentPod(logger, agentRequest.AgentId, namespace); pods.Status == "success" {
+						break
+					}
+				}
+				ForgetAcquireRequest(agentRequest.AgentId)
 				writeJsonResponse(resp, http.StatusCreated, pods)
 			}
 		} else {
-			writeJsonResponse(resp, http.StatusForbidden, GetError(NoValidSignatureError))
+			writeSignatureError(resp, req)
 		}
 	} else {
 		writeJsonResponse(resp, http.StatusMethodNotAllowed, GetError(InvalidRequestError))
@@ -98,15 +297,25 @@ func GetBuildPodHandler(resp http.ResponseWriter, req *http.Request) {
 }
 
 func writeJsonResponse(resp http.ResponseWriter, httpStatus int, podResponse interface{}) {
-	jsonData, _ := json.Marshal(podResponse)
+	jsonData, _ := json.Marshal(localizeResponse(resp, podResponse))
 	resp.Header().Set("Content-Type", "application/json")
 	resp.WriteHeader(httpStatus)
 	resp.Write(jsonData)
 }
 
+// Unsigned requests to the provisioning endpoints are answered with 401 so callers can tell them from
+// requests whose signature is wrong, which get 403.
+func writeSignatureError(resp http.ResponseWriter, req *http.Request) {
+	if req.Header.Get(signatureHeader) == "" {
+		resp.Header().Set("WWW-Authenticate", signatureScheme)
+		writeJsonResponse(resp, http.StatusUnauthorized, GetError(NoSignatureError))
+		return
+	}
+	writeJsonResponse(resp, http.StatusForbidden, GetError(NoValidSignatureError))
+}
+
 func isRequestHmacValid(req *http.Request) bool {
-	azureDevOpsHeader := "X-Azure-Signature"
-	headerVal := req.Header.Get(azureDevOpsHeader)
+	headerVal := req.Header.Get(signatureHeader)
 	requestBody, _ := ioutil.ReadAll(req.Body)
 
 	// Set the body again
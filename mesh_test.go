@@ -0,0 +1,51 @@
+package main
+
+import (
+	"testing"
+
+	v1alpha1 "github.com/microsoft/poolprovider-for-k8s/pkg/apis/dev/v1alpha1"
+	v1 "k8s.io/api/core/v1"
+)
+
+func TestMeshAnnotationsShouldControlInjectionForIstioAndLinkerd(t *testing.T) {
+	pool := &v1alpha1.AgentPoolSpec{
+		PoolName: "linux",
+		PoolSpec: &v1.PodSpec{Containers: []v1.Container{{Name: "agent", Image: "agent"}}},
+		Mesh:     &v1alpha1.MeshSpec{Injection: v1alpha1.MeshInjectionEnabled, ExcludeOutboundPorts: []int32{443, 8443}},
+	}
+
+	annotations := v1alpha1.RenderAgentPod(pool, nil).GetAnnotations()
+
+	expected := map[string]string{
+		"sidecar.istio.io/inject":                       "true",
+		"linkerd.io/inject":                             "enabled",
+		"traffic.sidecar.istio.io/excludeOutboundPorts": "443,8443",
+		"config.linkerd.io/skip-outbound-ports":         "443,8443",
+	}
+	if len(annotations) != len(expected) {
+		t.Errorf("Expected %d annotations. Got %v", len(expected), annotations)
+	}
+	for name, value := range expected {
+		if annotations[name] != value {
+			t.Errorf("Expected %s to be %s. Got %q", name, value, annotations[name])
+		}
+	}
+}
+
+func TestMeshAnnotationsShouldDisableInjection(t *testing.T) {
+	pod := &v1.Pod{}
+	v1alpha1.AddMeshAnnotations(pod, &v1alpha1.AgentPoolSpec{Mesh: &v1alpha1.MeshSpec{Injection: v1alpha1.MeshInjectionDisabled}})
+
+	if pod.Annotations["sidecar.istio.io/inject"] != "false" || pod.Annotations["linkerd.io/inject"] != "disabled" {
+		t.Errorf("Expected injection to be disabled. Got %v", pod.Annotations)
+	}
+}
+
+func TestMeshAnnotationsShouldLeavePodsOfPoolsWithoutMesh(t *testing.T) {
+	pod := &v1.Pod{}
+	v1alpha1.AddMeshAnnotations(pod, &v1alpha1.AgentPoolSpec{})
+
+	if pod.Annotations != nil {
+		t.Errorf("Expected no annotations. Got %v", pod.Annotations)
+	}
+}
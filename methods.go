@@ -0,0 +1,45 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+)
+
+// Every route declares the methods it serves. Other methods are answered with 405 before the
+// handler runs and OPTIONS with 204, both with an Allow header listing the methods. Request bodies
+// have to be JSON, "application/json" or a "+json" type, other content types are answered with
+// 415. The payload inspector and the fallback service take any request and are not wrapped.
+func withMethods(methods []string, handler http.HandlerFunc) http.HandlerFunc {
+	allow := strings.Join(append(append([]string{}, methods...), http.MethodOptions), ", ")
+	return func(resp http.ResponseWriter, req *http.Request) {
+		if req.Method == http.MethodOptions {
+			resp.Header().Set("Allow", allow)
+			resp.WriteHeader(http.StatusNoContent)
+			return
+		}
+		if !containsMethod(methods, req.Method) {
+			resp.Header().Set("Allow", allow)
+			writeJsonResponse(resp, http.StatusMethodNotAllowed, GetError(InvalidRequestError))
+			return
+		}
+		if hasRequestBody(req) && !isJsonContentType(req.Header.Get("Content-Type")) {
+			writeJsonResponse(resp, http.StatusUnsupportedMediaType, GetError(UnsupportedMediaError))
+			return
+		}
+		handler(resp, req)
+	}
+}
+
+func containsMethod(methods []string, method string) bool {
+	for _, allowed := range methods {
+		if allowed == method {
+			return true
+		}
+	}
+	return false
+}
+
+// The length of chunked bodies is not known up front, they are taken as non-empty.
+func hasRequestBody(req *http.Request) bool {
+	return req.Body != nil && req.Body != http.NoBody && req.ContentLength != 0
+}
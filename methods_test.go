@@ -0,0 +1,59 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func methodsTestHandler() http.HandlerFunc {
+	return withMethods([]string{http.MethodGet, http.MethodPost}, func(resp http.ResponseWriter, req *http.Request) {
+		resp.WriteHeader(http.StatusOK)
+	})
+}
+
+func TestWithMethodsShouldAnswerOptionsAndRejectOtherMethods(t *testing.T) {
+	recorder := httptest.NewRecorder()
+	methodsTestHandler()(recorder, httptest.NewRequest(http.MethodOptions, "/admin/quarantine", nil))
+	if recorder.Code != http.StatusNoContent || recorder.Header().Get("Allow") != "GET, POST, OPTIONS" {
+		t.Errorf("Expected 204 with the allowed methods. Got %d %q", recorder.Code, recorder.Header().Get("Allow"))
+	}
+
+	recorder = httptest.NewRecorder()
+	methodsTestHandler()(recorder, httptest.NewRequest(http.MethodDelete, "/admin/quarantine", nil))
+	if recorder.Code != http.StatusMethodNotAllowed || recorder.Header().Get("Allow") == "" {
+		t.Errorf("Expected 405 with the allowed methods. Got %d", recorder.Code)
+	}
+
+	recorder = httptest.NewRecorder()
+	methodsTestHandler()(recorder, httptest.NewRequest(http.MethodGet, "/admin/quarantine", nil))
+	if recorder.Code != http.StatusOK {
+		t.Errorf("Expected the handler to run. Got %d", recorder.Code)
+	}
+}
+
+func TestWithMethodsShouldOnlyAcceptJsonBodies(t *testing.T) {
+	for contentType, status := range map[string]int{
+		"application/json":                  http.StatusOK,
+		"application/json; charset=utf-8":   http.StatusOK,
+		"application/merge-patch+json":      http.StatusOK,
+		"text/plain":                        http.StatusUnsupportedMediaType,
+		"application/x-www-form-urlencoded": http.StatusUnsupportedMediaType,
+		"":                                  http.StatusUnsupportedMediaType,
+	} {
+		req := httptest.NewRequest(http.MethodPost, "/acquire", strings.NewReader(`{"AgentId": "1"}`))
+		req.Header.Set("Content-Type", contentType)
+		recorder := httptest.NewRecorder()
+		methodsTestHandler()(recorder, req)
+		if recorder.Code != status {
+			t.Errorf("Expected %d for %q. Got %d", status, contentType, recorder.Code)
+		}
+	}
+
+	recorder := httptest.NewRecorder()
+	methodsTestHandler()(recorder, httptest.NewRequest(http.MethodPost, "/admin/quarantine?pool=a&image=b", nil))
+	if recorder.Code != http.StatusOK {
+		t.Errorf("Expected requests without a body to pass. Got %d", recorder.Code)
+	}
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	podLintViolations = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "poolprovider_pod_lint_violations_total",
+		Help: "Number of pod lint rule violations found on agent pods, by rule and action.",
+	}, []string{"rule", "action"})
+
+	creationConcurrencyLimit = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "poolprovider_creation_concurrency_limit",
+		Help: "Number of agent pod creations allowed to run at the same time.",
+	})
+
+	rateLimitExceeded = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "poolprovider_rate_limit_exceeded_total",
+		Help: "Number of requests over the soft or hard rate limit, by tenant.",
+	}, []string{"tenant", "kind"})
+
+	poolApiThrottled = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "poolprovider_pool_api_throttled_total",
+		Help: "Number of pod creations and deletions delayed or rejected by the Kubernetes API budget of their pool.",
+	}, []string{"pool", "operation", "result"})
+
+	clientRateLimitExceeded = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "poolprovider_client_rate_limit_exceeded_total",
+		Help: "Number of requests rejected over the per client rate limit.",
+	})
+
+	canaryRuns = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "poolprovider_canary_runs_total",
+		Help: "Number of synthetic canary jobs, by pool and result.",
+	}, []string{"pool", "result"})
+
+	canarySeconds = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "poolprovider_canary_seconds",
+		Help:    "Time synthetic canary jobs take from acquire until their agent exited, by pool.",
+		Buckets: prometheus.ExponentialBuckets(1, 2, 10),
+	}, []string{"pool"})
+
+	attestations = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "poolprovider_agent_attestations_total",
+		Help: "Number of agent attestation requests, by result.",
+	}, []string{"result"})
+
+	poolMonthCost = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "poolprovider_pool_month_cost",
+		Help: "Estimated cost of the agent pods of the pool in the current month.",
+	}, []string{"pool"})
+
+	agentsRecycled = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "poolprovider_agents_recycled_total",
+		Help: "Number of agent pods replaced by the recycle window.",
+	})
+
+	mirroredRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "poolprovider_mirrored_requests_total",
+		Help: "Number of inbound requests copied to the secondary provider, by result.",
+	}, []string{"result"})
+
+	storageEntriesCompacted = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "poolprovider_storage_entries_compacted_total",
+		Help: "Number of storage entries removed past their retention, by bucket.",
+	}, []string{"bucket"})
+
+	poolFailovers = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "poolprovider_pool_failovers_total",
+		Help: "Number of agents provisioned in a fallback pool, by pool and fallback pool.",
+	}, []string{"pool", "fallback"})
+
+	agentStartupPhaseSeconds = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "poolprovider_agent_startup_phase_seconds",
+		Help:    "Time agent pods spend in each phase from creation until the agent is ready, by pool and phase.",
+		Buckets: prometheus.ExponentialBuckets(0.5, 2, 12),
+	}, []string{"pool", "phase"})
+
+	outboundRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "poolprovider_outbound_requests_total",
+		Help: "Number of outbound HTTP requests, by host and status code or error.",
+	}, []string{"host", "code"})
+
+	outboundRequestSeconds = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "poolprovider_outbound_request_seconds",
+		Help:    "Time outbound HTTP requests take until the response headers arrive, by host.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"host"})
+
+	outboundConnections = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "poolprovider_outbound_connections_total",
+		Help: "Number of connections taken for outbound HTTP requests, by host and whether a pooled connection was reused.",
+	}, []string{"host", "reused"})
+
+	agentPodsCreated = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "poolprovider_agent_pods_created_total",
+		Help: "Number of agent pod creations, by pool and result: success, failure or duplicate.",
+	}, []string{"pool", "result"})
+
+	agentPodsDeleted = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "poolprovider_agent_pods_deleted_total",
+		Help: "Number of agent pods deleted, by reason.",
+	}, []string{"reason"})
+
+	provisioningSeconds = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "poolprovider_provisioning_seconds",
+		Help:    "Time acquire requests take from validation until the agent pod is created.",
+		Buckets: prometheus.ExponentialBuckets(0.25, 2, 10),
+	})
+
+	poolActiveAgents = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "poolprovider_pool_active_agents",
+		Help: "Number of agent pods of the pool.",
+	}, []string{"pool"})
+
+	poolStandbyPods = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "poolprovider_pool_standby_pods",
+		Help: "Number of standby pods of the warm pool of the pool.",
+	}, []string{"pool"})
+
+	storageErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "poolprovider_storage_errors_total",
+		Help: "Number of failed storage operations, by operation.",
+	}, []string{"operation"})
+
+	httpRequestSeconds = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "poolprovider_http_request_seconds",
+		Help:    "Time the webserver takes to handle requests, by route, method and status code.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"handler", "method", "code"})
+
+	reconcileDiscrepancies = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "poolprovider_reconcile_discrepancies",
+		Help: "Number of discrepancies found by the last background reconciliation, by kind.",
+	}, []string{"kind"})
+
+	reconcileRemediations = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "poolprovider_reconcile_remediations_total",
+		Help: "Number of remediations applied by the background reconciliation, by action and result.",
+	}, []string{"action", "result"})
+
+	warmPoolBackoffSeconds = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "poolprovider_warm_pool_backoff_seconds",
+		Help: "Pause of the warm pool replenishment of the pool after failed standby pods, 0 when not backing off.",
+	}, []string{"pool"})
+
+	artifactCacheRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "poolprovider_artifact_cache_requests_total",
+		Help: "Number of artifact downloads served by the artifact cache, by upstream and result.",
+	}, []string{"upstream", "result"})
+
+	warmPoolTargetPods = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "poolprovider_warm_pool_target_pods",
+		Help: "Number of standby pods the warm pool of the pool is scaled to.",
+	}, []string{"pool"})
+
+	storageMigrationErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "poolprovider_storage_migration_errors_total",
+		Help: "Number of writes which could not be mirrored to the other backend of a storage migration, by operation.",
+	}, []string{"operation"})
+)
+
+func init() {
+	prometheus.MustRegister(podLintViolations, creationConcurrencyLimit, rateLimitExceeded, clientRateLimitExceeded, poolApiThrottled, attestations, agentsRecycled, mirroredRequests, poolMonthCost, agentStartupPhaseSeconds, storageEntriesCompacted, poolFailovers,
+		outboundRequests, outboundRequestSeconds, outboundConnections, agentPodsCreated, agentPodsDeleted, provisioningSeconds, poolActiveAgents, poolStandbyPods,
+		storageErrors, httpRequestSeconds, reconcileDiscrepancies, reconcileRemediations, warmPoolBackoffSeconds,
+		artifactCacheRequests, warmPoolTargetPods, storageMigrationErrors, canaryRuns, canarySeconds)
+}
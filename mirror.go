@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// Mirroring sends a copy of the inbound Azure DevOps callbacks to a secondary provider, e.g. a new
+// version under test, without waiting for it. The answer of the secondary is discarded. Mirroring
+// is on when MIRROR_URL is set; MIRROR_SAMPLE_PERCENT picks the share of requests copied. The
+// secondary gets the original signature, so it has to share the secret of this provider.
+const (
+	mirroredHeader             = "X-Poolprovider-Mirrored"
+	mirrorTimeout              = 10 * time.Second
+	maxMirrorsPending          = 64
+	defaultMirrorSamplePercent = 100
+)
+
+type requestMirror struct {
+	url     string
+	percent int
+	client  *http.Client
+	// Bounds the copies in flight, so a slow secondary cannot pile up goroutines
+	pending chan struct{}
+	sample  func() int
+}
+
+var inboundMirror = newRequestMirrorFromEnvironment()
+
+func newRequestMirrorFromEnvironment() *requestMirror {
+	return newRequestMirror(os.Getenv("MIRROR_URL"), getEnvInt("MIRROR_SAMPLE_PERCENT", defaultMirrorSamplePercent))
+}
+
+func newRequestMirror(url string, percent int) *requestMirror {
+	if url == "" || percent <= 0 {
+		return nil
+	}
+	if percent > 100 {
+		percent = 100
+	}
+	return &requestMirror{
+		url:     strings.TrimSuffix(url, "/"),
+		percent: percent,
+		client:  newOutboundClient(mirrorTimeout),
+		pending: make(chan struct{}, maxMirrorsPending),
+		sample:  func() int { return rand.Intn(100) },
+	}
+}
+
+// Wraps a handler so a sample of its requests is copied to the secondary provider. Requests which
+// are copies themselves are not mirrored again.
+func withMirroring(mirror *requestMirror, handler http.HandlerFunc) http.HandlerFunc {
+	if mirror == nil {
+		return handler
+	}
+	return func(resp http.ResponseWriter, req *http.Request) {
+		if req.Header.Get(mirroredHeader) == "" && mirror.sample() < mirror.percent {
+			mirror.forward(req)
+		}
+		handler(resp, req)
+	}
+}
+
+// Starts sending the copy and returns. The body is put back for the handler.
+func (m *requestMirror) forward(req *http.Request) {
+	var requestBody []byte
+	if req.Body != nil {
+		requestBody, _ = ioutil.ReadAll(req.Body)
+		req.Body = ioutil.NopCloser(bytes.NewBuffer(requestBody))
+	}
+
+	mirrored, err := http.NewRequest(req.Method, m.url+req.URL.RequestURI(), bytes.NewReader(requestBody))
+	if err != nil {
+		log.Println("Failed to build mirrored request", err)
+		return
+	}
+	mirrored.Header = req.Header.Clone()
+	mirrored.Header.Set(mirroredHeader, "true")
+
+	select {
+	case m.pending <- struct{}{}:
+	default:
+		mirroredRequests.WithLabelValues("dropped").Inc()
+		return
+	}
+
+	go func() {
+		defer func() { <-m.pending }()
+
+		resp, err := m.client.Do(mirrored)
+		if err != nil {
+			log.Println("Mirrored request to "+m.url+" failed", err)
+			mirroredRequests.WithLabelValues("failed").Inc()
+			return
+		}
+		ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		mirroredRequests.WithLabelValues("sent").Inc()
+	}()
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestMirroringShouldCopyRequestToSecondary(t *testing.T) {
+	received := make(chan *http.Request, 1)
+	bodies := make(chan string, 1)
+	secondary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		bodies <- string(body)
+		received <- r
+	}))
+	defer secondary.Close()
+
+	mirror := newRequestMirror(secondary.URL, 100)
+	handlerBody := ""
+	handler := withMirroring(mirror, func(resp http.ResponseWriter, req *http.Request) {
+		body, _ := ioutil.ReadAll(req.Body)
+		handlerBody = string(body)
+	})
+
+	req := httptest.NewRequest("POST", "/acquire", bytes.NewBufferString(`{"AgentId":"1"}`))
+	req.Header.Set("X-Azure-Signature", "signature")
+	handler(httptest.NewRecorder(), req)
+
+	if handlerBody != `{"AgentId":"1"}` {
+		t.Errorf("Expected the handler to get the body. Got %q", handlerBody)
+	}
+
+	select {
+	case r := <-received:
+		if r.URL.Path != "/acquire" || r.Header.Get("X-Azure-Signature") != "signature" || r.Header.Get(mirroredHeader) == "" {
+			t.Errorf("Unexpected mirrored request %v %v", r.URL, r.Header)
+		}
+		if body := <-bodies; body != `{"AgentId":"1"}` {
+			t.Errorf("Unexpected mirrored body %q", body)
+		}
+	case <-time.After(5 * time.Second):
+		t.Errorf("Expected the request to be mirrored")
+	}
+}
+
+func TestMirroringShouldSkipUnsampledAndMirroredRequests(t *testing.T) {
+	calls := make(chan struct{}, 2)
+	secondary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls <- struct{}{}
+	}))
+	defer secondary.Close()
+
+	mirror := newRequestMirror(secondary.URL, 10)
+	mirror.sample = func() int { return 50 }
+	handler := withMirroring(mirror, func(resp http.ResponseWriter, req *http.Request) {})
+	handler(httptest.NewRecorder(), httptest.NewRequest("POST", "/release", nil))
+
+	mirror.sample = func() int { return 0 }
+	req := httptest.NewRequest("POST", "/release", nil)
+	req.Header.Set(mirroredHeader, "true")
+	handler(httptest.NewRecorder(), req)
+
+	select {
+	case <-calls:
+		t.Errorf("Expected no request to be mirrored")
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestMirroringShouldBeOffWithoutUrl(t *testing.T) {
+	if newRequestMirror("", 100) != nil || newRequestMirror("http://secondary", 0) != nil {
+		t.Errorf("Expected mirroring to be off")
+	}
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"os"
+	"sync"
+
+	v1 "k8s.io/api/core/v1"
+	rbacv1 "k8s.io/api/rbac/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// The webserver may manage agent pods, their secrets, services and jobs in its own namespace only.
+// Other namespaces it creates agents in, the fallback namespace and the namespaces of isolated
+// pools, get a RoleBinding of the ClusterRole "poolprovider-pool-namespace-access" of the chart to
+// the service account of the webserver before the first agent is created in them.
+const (
+	namespaceAccessRole     = "poolprovider-pool-namespace-access"
+	webserverServiceAccount = "default"
+)
+
+// The namespaces this replica bound the access to, to skip binding it for every agent
+var boundNamespaces = struct {
+	sync.Mutex
+	namespaces map[string]bool
+}{namespaces: map[string]bool{}}
+
+// Returns the namespace FALLBACK_NAMESPACE names, used for agent pods while the namespace of the
+// webserver is terminating. Empty when no fallback is configured.
+func fallbackNamespace() string {
+	return os.Getenv("FALLBACK_NAMESPACE")
+}
+
+// Returns the namespace the agent pod should be created in. Creating objects in a terminating
+// namespace fails with an error that does not tell why, so the phase is checked first. When the
+// namespace cannot be read, e.g. because the webserver may not get namespaces, it is used as is.
+func resolveAgentNamespace(cs *k8s, namespace string) (string, error) {
+	if !isNamespaceTerminating(cs, namespace) {
+		return namespace, nil
+	}
+
+	fallback := fallbackNamespace()
+	if fallback == "" || fallback == namespace {
+		return "", errors.New("Namespace " + namespace + " is terminating, no agent pods can be created in it")
+	}
+	if isNamespaceTerminating(cs, fallback) {
+		return "", errors.New("Namespace " + namespace + " and fallback namespace " + fallback + " are terminating")
+	}
+
+	log.Println("Namespace " + namespace + " is terminating, creating the agent in " + fallback)
+	return fallback, nil
+}
+
+func isNamespaceTerminating(cs *k8s, namespace string) bool {
+	ns, err := cs.clientset.CoreV1().Namespaces().Get(namespace, metav1.GetOptions{})
+	if err != nil {
+		log.Println("Could not read namespace "+namespace, err)
+		return false
+	}
+	return ns.Status.Phase == v1.NamespaceTerminating || ns.ObjectMeta.DeletionTimestamp != nil
+}
+
+// Returns the namespaces agent pods may run in: the given namespace, the fallback namespace and the
+// namespaces provisioned for agent pools.
+func agentNamespaces(namespace string) []string {
+	namespaces := []string{namespace}
+	if fallback := fallbackNamespace(); fallback != "" && fallback != namespace {
+		namespaces = append(namespaces, fallback)
+	}
+	for _, ns := range provisionedPoolNamespaces() {
+		if ns != namespace && ns != fallbackNamespace() {
+			namespaces = append(namespaces, ns)
+		}
+	}
+	return namespaces
+}
+
+// Binds the access of the webserver running in webserverNamespace to the namespace.
+func ensureNamespaceAccess(cs *k8s, namespace string, webserverNamespace string) error {
+	boundNamespaces.Lock()
+	defer boundNamespaces.Unlock()
+	if boundNamespaces.namespaces[namespace] {
+		return nil
+	}
+
+	_, err := cs.clientset.RbacV1().RoleBindings(namespace).Create(&rbacv1.RoleBinding{
+		ObjectMeta: metav1.ObjectMeta{Name: namespaceAccessRole + "-" + webserverNamespace, Namespace: namespace},
+		Subjects:   []rbacv1.Subject{{Kind: rbacv1.ServiceAccountKind, Name: webserverServiceAccount, Namespace: webserverNamespace}},
+		RoleRef:    rbacv1.RoleRef{APIGroup: rbacv1.GroupName, Kind: "ClusterRole", Name: namespaceAccessRole},
+	})
+	if err != nil && !k8serrors.IsAlreadyExists(err) {
+		return err
+	}
+	boundNamespaces.namespaces[namespace] = true
+	return nil
+}
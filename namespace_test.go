@@ -0,0 +1,70 @@
+package main
+
+import (
+	"os"
+	"testing"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func createTestNamespace(name string, phase v1.NamespacePhase) {
+	cs := CreateClientSet()
+	ns := &v1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: name}}
+	ns.Status.Phase = phase
+	cs.clientset.CoreV1().Namespaces().Create(ns)
+}
+
+func TestResolveAgentNamespaceShouldRejectTerminatingNamespace(t *testing.T) {
+	SetupCustomResource()
+	createTestNamespace(testnamespace, v1.NamespaceTerminating)
+
+	if _, err := resolveAgentNamespace(CreateClientSet(), testnamespace); err == nil {
+		t.Errorf("Expected an error for a terminating namespace")
+	}
+
+	var agentrequest AgentRequest
+	agentrequest.AgentId = "1"
+	if response := CreatePod(agentrequest, testnamespace); response.Accepted {
+		t.Errorf("Pod must not be created in a terminating namespace")
+	}
+}
+
+func TestResolveAgentNamespaceShouldUseFallback(t *testing.T) {
+	SetupCustomResource()
+	createTestNamespace(testnamespace, v1.NamespaceTerminating)
+	createTestNamespace("azuredevops-fallback", v1.NamespaceActive)
+	os.Setenv("FALLBACK_NAMESPACE", "azuredevops-fallback")
+	defer os.Unsetenv("FALLBACK_NAMESPACE")
+
+	namespace, err := resolveAgentNamespace(CreateClientSet(), testnamespace)
+	if err != nil || namespace != "azuredevops-fallback" {
+		t.Errorf("Expected the fallback namespace. Got %s (%v)", namespace, err)
+	}
+}
+
+func TestResolveAgentNamespaceShouldKeepActiveNamespace(t *testing.T) {
+	SetupCustomResource()
+
+	namespace, err := resolveAgentNamespace(CreateClientSet(), testnamespace)
+	if err != nil || namespace != testnamespace {
+		t.Errorf("Expected %s. Got %s (%v)", testnamespace, namespace, err)
+	}
+}
+
+func TestEnsureNamespaceAccessShouldBindTheWebserverInTheNamespace(t *testing.T) {
+	SetupCustomResource()
+	cs := CreateClientSet()
+	defer delete(boundNamespaces.namespaces, "ado-pool-7")
+
+	if err := ensureNamespaceAccess(cs, "ado-pool-7", "azuredevops"); err != nil {
+		t.Fatalf("Expected the access bound. Got %v", err)
+	}
+	binding, err := cs.clientset.RbacV1().RoleBindings("ado-pool-7").Get(namespaceAccessRole+"-azuredevops", metav1.GetOptions{})
+	if err != nil || binding.RoleRef.Name != namespaceAccessRole || binding.Subjects[0].Namespace != "azuredevops" {
+		t.Errorf("Expected the webserver bound to the access role. Got %+v (%v)", binding, err)
+	}
+	if err := ensureNamespaceAccess(cs, "ado-pool-7", "azuredevops"); err != nil {
+		t.Errorf("Expected the access bound once. Got %v", err)
+	}
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"os"
+	"time"
+)
+
+// Notifications about events operators have to act on are posted as JSON to NOTIFY_WEBHOOK_URL,
+// e.g. a chat or paging webhook. Without a webhook they are only logged.
+const notifyTimeout = 10 * time.Second
+
+type Notification struct {
+	Event     string
+	Pool      string `json:",omitempty"`
+	Message   string
+	Timestamp time.Time
+}
+
+var notifyClient = newOutboundClient(notifyTimeout)
+
+// Sends the notification in the background.
+func Notify(notification Notification) {
+	if notification.Timestamp.IsZero() {
+		notification.Timestamp = time.Now().UTC()
+	}
+	log.Println("Notification " + notification.Event + ": " + notification.Message)
+
+	url := os.Getenv("NOTIFY_WEBHOOK_URL")
+	if url == "" {
+		return
+	}
+
+	data, _ := json.Marshal(notification)
+	go func() {
+		resp, err := notifyClient.Post(url, "application/json", bytes.NewReader(data))
+		if err != nil {
+			log.Println("Failed to send notification "+notification.Event, err)
+			return
+		}
+		resp.Body.Close()
+		if resp.StatusCode >= 300 {
+			log.Println("Notification webhook answered " + resp.Status)
+		}
+	}()
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/microsoft/poolprovider-for-k8s/pkg/servicebus"
+)
+
+// The workers take the queued operations from the storage unless OPERATION_QUEUE_BACKEND is
+// "servicebus", for installations which operate Azure Service Bus already. The id of every queued
+// operation is then sent to the queue SERVICE_BUS_QUEUE (poolprovider-operations) of the namespace
+// in SERVICE_BUS_CONNECTION_STRING, and a worker receives it with peek-lock: the lock on the message
+// takes the place of the operation lease, Service Bus delivers the message again when the worker
+// does not complete it in time, and dead-letters it after the MaxDeliveryCount of the queue. The
+// operations, their requests and credentials are kept in the storage either way, so that any
+// replica answers the poll.
+const (
+	operationQueueBackendServiceBus = "servicebus"
+	defaultServiceBusQueue          = "poolprovider-operations"
+	serviceBusReceiveTimeout        = 5 * time.Second
+)
+
+type operationQueue interface {
+	// Hands the stored operation to the workers.
+	push(id string) error
+	// Takes the next operation for this replica and returns its id and lease.
+	next(now time.Time) (string, string, bool)
+	// Extends the lease and returns it, or reports that the lease was lost to another replica.
+	renew(id string, lease string) (string, bool)
+	// Drops the operation from the queue, it is finished.
+	done(id string, lease string)
+	// Gives the operation back to the queue, for the workers of any replica to take.
+	handBack(id string, lease string)
+}
+
+var serviceBusOperations = struct {
+	sync.Once
+	queue *serviceBusOperationQueue
+}{}
+
+func getOperationQueue() operationQueue {
+	if !strings.EqualFold(os.Getenv("OPERATION_QUEUE_BACKEND"), operationQueueBackendServiceBus) {
+		return storageOperationQueue{}
+	}
+	serviceBusOperations.Do(func() {
+		config, err := servicebus.ParseConnectionString(os.Getenv("SERVICE_BUS_CONNECTION_STRING"), serviceBusQueueName())
+		if err != nil {
+			// The calls fail with ErrNotConfigured, so acquire requests are rejected as busy
+			log.Println("Failed to read SERVICE_BUS_CONNECTION_STRING", err)
+		}
+		serviceBusOperations.queue = &serviceBusOperationQueue{client: servicebus.NewClient(config)}
+	})
+	return serviceBusOperations.queue
+}
+
+func serviceBusQueueName() string {
+	if queue := os.Getenv("SERVICE_BUS_QUEUE"); queue != "" {
+		return queue
+	}
+	return defaultServiceBusQueue
+}
+
+// The operations are the queue, the workers lease the oldest unfinished one in the storage.
+type storageOperationQueue struct{}
+
+func (storageOperationQueue) push(id string) error {
+	select {
+	case operationQueued <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+func (storageOperationQueue) next(now time.Time) (string, string, bool) {
+	operations, err := listUnfinishedOperations()
+	if err != nil {
+		log.Println("Failed to read the async operations", err)
+		return "", "", false
+	}
+	for _, operation := range operations {
+		if lease, ok := leaseOperation(operation.Id, now); ok {
+			return operation.Id, lease, true
+		}
+	}
+	return "", "", false
+}
+
+func (storageOperationQueue) renew(id string, lease string) (string, bool) {
+	return renewOperationLease(id, lease)
+}
+
+func (storageOperationQueue) done(id string, lease string) {
+	releaseOperationLease(id)
+}
+
+func (storageOperationQueue) handBack(id string, lease string) {
+	releaseOperationLease(id)
+}
+
+// The lease of an operation is the lock url of its message.
+type serviceBusOperationQueue struct {
+	client *servicebus.Client
+}
+
+func (q *serviceBusOperationQueue) push(id string) error {
+	return q.client.Send(id)
+}
+
+func (q *serviceBusOperationQueue) next(now time.Time) (string, string, bool) {
+	message, ok, err := q.client.Receive(serviceBusReceiveTimeout)
+	if err != nil {
+		log.Println("Failed to receive an operation from Service Bus", err)
+		return "", "", false
+	}
+	if !ok {
+		return "", "", false
+	}
+	if !operationIdFormat.MatchString(message.Body) {
+		log.Println("Dropping Service Bus message " + message.LockUrl + ", it names no operation")
+		q.done("", message.LockUrl)
+		return "", "", false
+	}
+	if message.DeliveryCount > 1 {
+		log.Println("Taking over operation "+message.Body+", delivered", message.DeliveryCount, "times")
+	}
+	return message.Body, message.LockUrl, true
+}
+
+func (q *serviceBusOperationQueue) renew(id string, lease string) (string, bool) {
+	err := q.client.RenewLock(servicebus.Message{LockUrl: lease})
+	if errors.Is(err, servicebus.ErrLockLost) {
+		log.Println("Lost the lock on operation " + id + ", Service Bus delivers it again")
+		return lease, false
+	} else if err != nil {
+		log.Println("Failed to renew the lock on operation "+id, err)
+	}
+	return lease, true
+}
+
+func (q *serviceBusOperationQueue) done(id string, lease string) {
+	if err := q.client.Complete(servicebus.Message{LockUrl: lease}); err != nil {
+		log.Println("Failed to complete the Service Bus message of operation "+id, err)
+	}
+}
+
+// Without the lock, e.g. for an operation of a previous process, the message is delivered again
+// once its lock expired.
+func (q *serviceBusOperationQueue) handBack(id string, lease string) {
+	if lease == "" {
+		return
+	}
+	if err := q.client.Abandon(servicebus.Message{LockUrl: lease}); err != nil {
+		log.Println("Failed to hand back the Service Bus message of operation "+id, err)
+	}
+}
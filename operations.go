@@ -0,0 +1,528 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/microsoft/poolprovider-for-k8s/pkg/storage"
+	v1 "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// Callers which send "Prefer: respond-async" get 202 Accepted with an operation as soon as the
+// acquire request is validated, instead of waiting for the pod creation, and poll
+// GET /operations/<id> for its status and the AgentProvisionResponse. Azure DevOps never asks for
+// it, so its contract is unchanged. Operations are kept under "operation:<id>" in the storage, so
+// any replica answers the poll, for OPERATION_RETENTION_HOURS (24) after their last update. The
+// queue is the storage as well: the request is kept under "operation-request:<id>" until the
+// operation finished, its credentials in the Secret "poolprovider-operation-<id>", as the storage
+// entries are plain ConfigMaps and part of the state snapshot. The ASYNC_WORKERS workers (4 by
+// default) of every replica take the oldest queued operations, up to ASYNC_QUEUE_SIZE (100) of
+// which may wait. A worker holds a lease on its operation under "operation-lease:<id>" and renews
+// it while it runs; an operation whose lease expired, because its replica crashed or was
+// rescheduled, is taken over by the next free worker. The operations can be handed to the workers
+// through a message broker instead, see operation-queue.go.
+const (
+	operationKeyPrefix         = "operation:"
+	operationRequestKeyPrefix  = "operation-request:"
+	operationLeaseKeyPrefix    = "operation-lease:"
+	operationSecretPrefix      = "poolprovider-operation-"
+	operationSecretLabel       = "poolprovider/operation"
+	operationsRoute            = "/operations/"
+	defaultAsyncWorkers        = 4
+	defaultAsyncQueueSize      = 100
+	defaultOperationRetention  = 24 * time.Hour
+	OperationStatusQueued      = "queued"
+	OperationStatusRunning     = "running"
+	OperationStatusSucceeded   = "succeeded"
+	OperationStatusFailed      = "failed"
+	OperationStatusCanceled    = "canceled"
+	operationInterruptedReason = "The request of the operation was lost before the operation ran"
+)
+
+// Async operations wait this long for a pod creation slot, there is no caller to time out
+var operationSlotTimeout = 10 * time.Minute
+
+var (
+	operationLease        = 30 * time.Second
+	operationPollInterval = time.Second
+)
+
+// Number of operations the workers of this replica are processing
+var runningOperations int32
+
+// Wakes an idle worker when this replica queued an operation
+var operationQueued = make(chan struct{}, 1)
+
+var operationIdFormat = regexp.MustCompile(`^[0-9a-f]{32}$`)
+
+type Operation struct {
+	Id      string
+	AgentId string
+	Status  string
+	// The replica processing the operation
+	Owner     string
+	CreatedAt time.Time
+	UpdatedAt time.Time
+	Response  *AgentProvisionResponse `json:",omitempty"`
+	// The agent pod, looked up when a succeeded operation is polled
+	Pod *AgentStatus `json:",omitempty"`
+}
+
+type OperationLease struct {
+	Owner     string
+	ExpiresAt time.Time
+}
+
+// The acquire request of a queued operation, with the fields which are not part of its JSON
+type OperationRequest struct {
+	Request     AgentRequest
+	RequestId   string `json:",omitempty"`
+	TraceParent string `json:",omitempty"`
+	TraceState  string `json:",omitempty"`
+	QueuedAt    time.Time
+}
+
+type queuedOperation struct {
+	id      string
+	request AgentRequest
+	lease   string
+}
+
+func wantsAsyncResponse(req *http.Request) bool {
+	return strings.Contains(req.Header.Get("Prefer"), "respond-async")
+}
+
+func newOperationId() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func saveOperation(operation Operation) {
+	operation.UpdatedAt = time.Now().UTC()
+	data, _ := json.Marshal(operation)
+	if err := GetStorage().Set(operationKeyPrefix+operation.Id, string(data)); err != nil {
+		log.Println("Failed to store operation "+operation.Id+" of agent "+operation.AgentId, err)
+	}
+}
+
+func getOperation(id string) (Operation, error) {
+	var operation Operation
+	value, err := GetStorage().Get(operationKeyPrefix + id)
+	if err != nil {
+		return operation, err
+	}
+	err = json.Unmarshal([]byte(value), &operation)
+	return operation, err
+}
+
+func getOperationRequest(id string) (AgentRequest, error) {
+	var stored OperationRequest
+	value, err := GetStorage().Get(operationRequestKeyPrefix + id)
+	if err != nil {
+		return stored.Request, err
+	}
+	if err := json.Unmarshal([]byte(value), &stored); err != nil {
+		return stored.Request, err
+	}
+	stored.Request.RequestId, stored.Request.TraceParent, stored.Request.TraceState = stored.RequestId, stored.TraceParent, stored.TraceState
+	err = readOperationCredentials(id, &stored.Request)
+	return stored.Request, err
+}
+
+// Keeps the credentials of the request in the Secret of the operation.
+func storeOperationCredentials(id string, agentRequest AgentRequest) error {
+	credentials, _ := json.Marshal(agentRequest.AgentConfiguration.AgentCredentials)
+	secret := &v1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      operationSecretPrefix + id,
+			Namespace: podnamespace,
+			Labels:    map[string]string{operationSecretLabel: id},
+		},
+		Data: map[string][]byte{
+			".token":       []byte(agentRequest.AuthenticationToken),
+			".credentials": credentials,
+		},
+	}
+	_, err := CreateClientSet().clientset.CoreV1().Secrets(podnamespace).Create(secret)
+	return err
+}
+
+func readOperationCredentials(id string, agentRequest *AgentRequest) error {
+	secret, err := CreateClientSet().clientset.CoreV1().Secrets(podnamespace).Get(operationSecretPrefix+id, metav1.GetOptions{})
+	if err != nil {
+		return err
+	}
+	agentRequest.AuthenticationToken = string(secret.Data[".token"])
+	return json.Unmarshal(secret.Data[".credentials"], &agentRequest.AgentConfiguration.AgentCredentials)
+}
+
+func deleteOperationCredentials(id string) {
+	err := CreateClientSet().clientset.CoreV1().Secrets(podnamespace).Delete(operationSecretPrefix+id, &metav1.DeleteOptions{})
+	if err != nil && !k8serrors.IsNotFound(err) {
+		log.Println("Failed to delete the credentials of operation "+id, err)
+	}
+}
+
+// Returns the request without the credentials of the agent, which are not put into the storage.
+func withoutCredentials(agentRequest AgentRequest) AgentRequest {
+	agentRequest.AuthenticationToken = ""
+	agentRequest.AgentConfiguration.AgentCredentials = AgentCredentials{}
+	return agentRequest
+}
+
+// Returns the queued and running operations, the oldest first.
+func listUnfinishedOperations() ([]Operation, error) {
+	entries, err := GetStorage().List(operationKeyPrefix)
+	if err != nil {
+		return nil, err
+	}
+	var operations []Operation
+	for _, value := range entries {
+		var operation Operation
+		if json.Unmarshal([]byte(value), &operation) != nil {
+			continue
+		}
+		if operation.Status == OperationStatusQueued || operation.Status == OperationStatusRunning {
+			operations = append(operations, operation)
+		}
+	}
+	sort.Slice(operations, func(i, j int) bool { return operations[i].CreatedAt.Before(operations[j].CreatedAt) })
+	return operations, nil
+}
+
+// Queues the acquire request for the workers. Fails without waiting when the queue is full.
+func enqueueOperation(agentRequest AgentRequest) (Operation, error) {
+	operations, err := listUnfinishedOperations()
+	if err != nil {
+		return Operation{}, err
+	}
+	queued := 0
+	for _, operation := range operations {
+		if operation.Status == OperationStatusQueued {
+			queued++
+		}
+	}
+	if queued >= getEnvInt("ASYNC_QUEUE_SIZE", defaultAsyncQueueSize) {
+		return Operation{}, errCreationTimeout
+	}
+
+	now := time.Now().UTC()
+	operation := Operation{Id: newOperationId(), AgentId: agentRequest.AgentId, Status: OperationStatusQueued, CreatedAt: now}
+	if err := storeOperationCredentials(operation.Id, agentRequest); err != nil {
+		return operation, err
+	}
+	data, _ := json.Marshal(OperationRequest{Request: withoutCredentials(agentRequest), RequestId: agentRequest.RequestId, TraceParent: agentRequest.TraceParent, TraceState: agentRequest.TraceState, QueuedAt: now})
+	if err := GetStorage().Set(operationRequestKeyPrefix+operation.Id, string(data)); err != nil {
+		deleteOperationCredentials(operation.Id)
+		return operation, err
+	}
+	saveOperation(operation)
+	if err := getOperationQueue().push(operation.Id); err != nil {
+		GetStorage().Delete(operationKeyPrefix + operation.Id)
+		GetStorage().Delete(operationRequestKeyPrefix + operation.Id)
+		deleteOperationCredentials(operation.Id)
+		return operation, err
+	}
+	return operation, nil
+}
+
+// Answers the acquire request with its queued operation, or with 503 when the queue is full.
+func acceptAsyncAcquire(resp http.ResponseWriter, logger fieldLogger, agentRequest AgentRequest) {
+	operation, err := enqueueOperation(agentRequest)
+	if err != nil {
+		// Drop the claim so that the retry from Azure DevOps is handled
+		logger.Warn("Rejecting agent request "+agentRequest.AgentId+", the operation queue is full", err)
+		ForgetAcquireRequest(agentRequest.AgentId)
+		explainRejection(agentRequest, "operation-queue", ServerBusyError)
+		writeJsonResponse(resp, http.StatusServiceUnavailable, AgentProvisionResponse{ResponseType: "fail", ErrorMessage: ServerBusyError})
+		return
+	}
+	logger.Info("Queued operation " + operation.Id + " for agent " + agentRequest.AgentId)
+	resp.Header().Set("Location", operationsRoute+operation.Id)
+	writeJsonResponse(resp, http.StatusAccepted, operation)
+}
+
+// Takes the lease on the operation for this replica, taking over an expired lease of another one,
+// and returns the stored lease. The takeover swaps the expired lease it read, so of the replicas
+// racing for it only one wins.
+func leaseOperation(id string, now time.Time) (string, bool) {
+	store := GetStorage()
+	hostname, _ := os.Hostname()
+	data, _ := json.Marshal(OperationLease{Owner: hostname, ExpiresAt: now.Add(operationLease)})
+	if claimed, err := store.SetIfAbsent(operationLeaseKeyPrefix+id, string(data)); err != nil || claimed {
+		return string(data), err == nil
+	}
+
+	var lease OperationLease
+	value, err := store.Get(operationLeaseKeyPrefix + id)
+	if err != nil || json.Unmarshal([]byte(value), &lease) != nil || lease.ExpiresAt.After(now) {
+		return "", false
+	}
+	if swapped, err := store.CompareAndSwap(operationLeaseKeyPrefix+id, value, string(data)); err != nil || !swapped {
+		return "", false
+	}
+	log.Println("Took over operation " + id + ", the lease of " + lease.Owner + " expired")
+	return string(data), true
+}
+
+// Extends the held lease and returns it. Another replica may have taken the lease over when a
+// renewal came too late; the lease is lost then.
+func renewOperationLease(id string, held string) (string, bool) {
+	hostname, _ := os.Hostname()
+	data, _ := json.Marshal(OperationLease{Owner: hostname, ExpiresAt: time.Now().UTC().Add(operationLease)})
+	swapped, err := GetStorage().CompareAndSwap(operationLeaseKeyPrefix+id, held, string(data))
+	if err != nil {
+		log.Println("Failed to renew the lease on operation "+id, err)
+		return held, true
+	}
+	if !swapped {
+		log.Println("Lost the lease on operation " + id + " to another replica")
+		return held, false
+	}
+	return string(data), true
+}
+
+func releaseOperationLease(id string) {
+	if err := GetStorage().Delete(operationLeaseKeyPrefix + id); err != nil && !errors.Is(err, storage.ErrNotFound) {
+		log.Println("Failed to release the lease on operation "+id, err)
+	}
+}
+
+// Takes the next operation of the queue, queued or left behind by a replica which lost its lease,
+// and returns it with its request.
+func claimNextOperation(now time.Time) (queuedOperation, bool) {
+	queue := getOperationQueue()
+	seen := map[string]bool{}
+	for {
+		id, lease, ok := queue.next(now)
+		if !ok {
+			return queuedOperation{}, false
+		}
+		// An operation the storage keeps handing out could not be dropped, leave it to a later claim
+		if seen[id] {
+			queue.handBack(id, lease)
+			return queuedOperation{}, false
+		}
+		seen[id] = true
+
+		// The operation may have finished since it was queued
+		operation, err := getOperation(id)
+		if err != nil && !errors.Is(err, storage.ErrNotFound) {
+			log.Println("Failed to read operation "+id, err)
+			queue.handBack(id, lease)
+			return queuedOperation{}, false
+		}
+		if err != nil || (operation.Status != OperationStatusQueued && operation.Status != OperationStatusRunning) {
+			queue.done(id, lease)
+			continue
+		}
+		request, err := getOperationRequest(id)
+		if err != nil {
+			log.Println("Failing operation "+id+" of agent "+operation.AgentId+", its request is gone", err)
+			ForgetAcquireRequest(operation.AgentId)
+			finishOperation(operation, OperationStatusFailed, AgentProvisionResponse{ResponseType: "fail", ErrorMessage: operationInterruptedReason})
+			queue.done(id, lease)
+			continue
+		}
+		return queuedOperation{id: id, request: request, lease: lease}, true
+	}
+}
+
+// Starts the workers processing the queued operations. Once the webserver shuts down, the workers
+// take no more operations, they are left to the other replicas.
+func RunOperationWorkers(namespace string) {
+	for i := 0; i < getEnvInt("ASYNC_WORKERS", defaultAsyncWorkers); i++ {
+		go func() {
+			for {
+				if !isDraining() {
+					if queued, ok := claimNextOperation(time.Now().UTC()); ok {
+						runOperation(queued, namespace)
+						continue
+					}
+				}
+				select {
+				case <-operationQueued:
+				case <-time.After(operationPollInterval):
+				}
+			}
+		}()
+	}
+}
+
+// Processes the leased operation, renewing the lease until it finished.
+func runOperation(queued queuedOperation, namespace string) {
+	queue := getOperationQueue()
+	atomic.AddInt32(&runningOperations, 1)
+	defer atomic.AddInt32(&runningOperations, -1)
+	done := make(chan struct{})
+	renewed := make(chan bool, 1)
+	go func() {
+		lease, held := queued.lease, true
+		for held {
+			select {
+			case <-done:
+				renewed <- true
+				return
+			case <-time.After(operationLease / 3):
+				lease, held = queue.renew(queued.id, lease)
+			}
+		}
+		renewed <- false
+	}()
+	processOperation(queued, namespace)
+	close(done)
+	// A lease lost to another replica is its lease now
+	if <-renewed {
+		queue.done(queued.id, queued.lease)
+	}
+}
+
+// Waits until the workers finished the operations they are processing or the context is done.
+func waitForOperations(ctx context.Context) error {
+	for atomic.LoadInt32(&runningOperations) > 0 {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+	return nil
+}
+
+func processOperation(queued queuedOperation, namespace string) {
+	operation, err := getOperation(queued.id)
+	if err != nil {
+		log.Println("Dropping operation "+queued.id+" of agent "+queued.request.AgentId, err)
+		return
+	}
+	agentRequest := queued.request
+	logger := agentRequestLogger(agentRequest)
+
+	// Releasing the agent drops its dedupe claim, on whichever replica the release arrives
+	if _, err := GetStorage().Get(dedupeKeyPrefix + agentRequest.AgentId); errors.Is(err, storage.ErrNotFound) {
+		logger.Info("Agent " + agentRequest.AgentId + " was released before its operation " + operation.Id + " ran")
+		finishOperation(operation, OperationStatusCanceled, AgentProvisionResponse{ResponseType: "fail", ErrorMessage: AcquireCanceledError})
+		return
+	}
+
+	operation.Status = OperationStatusRunning
+	operation.Owner, _ = os.Hostname()
+	saveOperation(operation)
+
+	priority := queuePriority(agentRequest, namespace)
+	if err := podCreationThrottle.AcquireQueued(agentRequest.AgentId, priority, operationSlotTimeout, nil); err != nil {
+		status := OperationStatusFailed
+		if err == errCreationCanceled {
+			status = OperationStatusCanceled
+		}
+		logger.Warn("Operation "+operation.Id+" of agent "+agentRequest.AgentId+" got no creation slot", err)
+		explainRejection(agentRequest, "creation-queue", err.Error())
+		ForgetAcquireRequest(agentRequest.AgentId)
+		finishOperation(operation, status, AgentProvisionResponse{ResponseType: "fail", ErrorMessage: err.Error()})
+		return
+	}
+
+	RecordJournalStep(agentRequest, namespace, "", JournalStepValidated, "")
+	started := time.Now()
+	response := CreatePod(agentRequest, namespace)
+	podCreationThrottle.Release()
+	recordCreationLatency(time.Since(started))
+	provisioningSeconds.Observe(time.Since(started).Seconds())
+
+	// The result of the operation is the response of an asynchronous request
+	status := OperationStatusSucceeded
+	if !response.Accepted {
+		status = OperationStatusFailed
+	}
+	finishOperation(operation, status, response)
+	RecordJournalStep(agentRequest, response.Namespace, response.Cluster, JournalStepCallbackSent, "")
+	StoreAcquireResult(agentRequest.AgentId, response)
+	CompleteJournal(agentRequest.AgentId)
+}
+
+// Records the outcome of the operation. Its request and the agent's credentials are not needed
+// anymore.
+func finishOperation(operation Operation, status string, response AgentProvisionResponse) {
+	operation.Status = status
+	operation.Response = &response
+	saveOperation(operation)
+	GetStorage().Delete(operationRequestKeyPrefix + operation.Id)
+	deleteOperationCredentials(operation.Id)
+}
+
+// Hands back the operations this replica was processing when it stopped, so they are taken over
+// without waiting for their lease to expire.
+func RecoverOperations() {
+	if _, err := handBackOperations(context.Background()); err != nil {
+		log.Println("Failed to read the async operations", err)
+	}
+}
+
+// Queues the running operations of this replica again and releases their leases, so the workers of
+// any replica take them over, and returns how many. Their requests stay in the storage.
+func handBackOperations(ctx context.Context) (int, error) {
+	operations, err := listUnfinishedOperations()
+	if err != nil {
+		return 0, err
+	}
+	hostname, _ := os.Hostname()
+	handedBack := 0
+	for _, operation := range operations {
+		if ctx.Err() != nil {
+			return handedBack, ctx.Err()
+		}
+		if operation.Status != OperationStatusRunning || operation.Owner != hostname {
+			continue
+		}
+		log.Println("Handing back operation " + operation.Id + " of agent " + operation.AgentId + ", it was interrupted")
+		operation.Status = OperationStatusQueued
+		saveOperation(operation)
+		getOperationQueue().handBack(operation.Id, "")
+		handedBack++
+	}
+	return handedBack, nil
+}
+
+// Returns the operation of the id in the path, with the agent pod once it succeeded.
+func OperationHandler(resp http.ResponseWriter, req *http.Request) {
+	if !isReadRequestValid(resp, req) {
+		return
+	}
+
+	id := strings.TrimPrefix(req.URL.Path, operationsRoute)
+	if !operationIdFormat.MatchString(id) {
+		writeJsonResponse(resp, http.StatusNotFound, GetError(UnknownOperationError))
+		return
+	}
+	operation, err := getOperation(id)
+	if errors.Is(err, storage.ErrNotFound) {
+		writeJsonResponse(resp, http.StatusNotFound, GetError(UnknownOperationError))
+		return
+	} else if err != nil {
+		writeJsonResponse(resp, http.StatusInternalServerError, GetError(err.Error()))
+		return
+	}
+
+	if operation.Status == OperationStatusSucceeded {
+		if cs, _, err := agentClientSet(operation.AgentId); err == nil {
+			if status, err := getAgentStatus(cs, operation.AgentId, podnamespace); err == nil {
+				operation.Pod = &status
+			}
+		}
+	}
+	writeJsonResponse(resp, http.StatusOK, operation)
+}
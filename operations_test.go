@@ -0,0 +1,312 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/microsoft/poolprovider-for-k8s/pkg/servicebus"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func getOperationResponse(path string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodGet, path, nil)
+	req.Header.Add("X-Azure-Signature", ComputeHash(""))
+	resp := httptest.NewRecorder()
+	OperationHandler(resp, req)
+	return resp
+}
+
+// Removes the operations the test left in the shared memory storage.
+func clearOperations() {
+	for _, prefix := range []string{operationKeyPrefix, operationRequestKeyPrefix, operationLeaseKeyPrefix} {
+		entries, _ := GetStorage().List(prefix)
+		for key := range entries {
+			GetStorage().Delete(key)
+		}
+	}
+}
+
+func TestQueuedOperationShouldBePolledById(t *testing.T) {
+	SetupCustomResource()
+	os.Setenv("VSTS_SECRET", "sharedsecret1234")
+	os.Setenv("STORAGE_BACKEND", "memory")
+	defer os.Unsetenv("STORAGE_BACKEND")
+	defer clearOperations()
+
+	operation, err := enqueueOperation(AgentRequest{AgentId: "async-1", RequestId: "request-1"})
+	if err != nil {
+		t.Fatalf("Expected the operation queued. Got %v", err)
+	}
+	queued, ok := claimNextOperation(time.Now().UTC())
+	if !ok || queued.id != operation.Id || queued.request.AgentId != "async-1" || queued.request.RequestId != "request-1" {
+		t.Errorf("Expected the request queued with its operation. Got %v", queued)
+	}
+
+	resp := getOperationResponse(operationsRoute + operation.Id)
+	var polled Operation
+	json.Unmarshal(resp.Body.Bytes(), &polled)
+	if resp.Code != http.StatusOK || polled.Status != OperationStatusQueued || polled.AgentId != "async-1" {
+		t.Errorf("Expected the queued operation. Got %d %s", resp.Code, resp.Body.String())
+	}
+
+	if resp := getOperationResponse(operationsRoute + newOperationId()); resp.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 for an unknown operation. Got %d", resp.Code)
+	}
+	if resp := getOperationResponse(operationsRoute + "../dedupe:async-1"); resp.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 for an invalid operation id. Got %d", resp.Code)
+	}
+}
+
+func TestOperationShouldBeCanceledWhenTheAgentWasReleased(t *testing.T) {
+	SetupCustomResource()
+	os.Setenv("STORAGE_BACKEND", "memory")
+	defer os.Unsetenv("STORAGE_BACKEND")
+	defer clearOperations()
+
+	operation, _ := enqueueOperation(AgentRequest{AgentId: "async-released"})
+	queued, _ := claimNextOperation(time.Now().UTC())
+	processOperation(queued, "azuredevops")
+
+	processed, _ := getOperation(operation.Id)
+	if processed.Status != OperationStatusCanceled || processed.Response == nil || processed.Response.ErrorMessage != AcquireCanceledError {
+		t.Errorf("Expected the operation canceled. Got %+v", processed)
+	}
+	if _, err := getOperationRequest(operation.Id); err == nil {
+		t.Errorf("Expected the request of the finished operation removed")
+	}
+}
+
+func TestEnqueueOperationShouldFailWhenTheQueueIsFull(t *testing.T) {
+	SetupCustomResource()
+	os.Setenv("STORAGE_BACKEND", "memory")
+	os.Setenv("ASYNC_QUEUE_SIZE", "3")
+	defer os.Unsetenv("STORAGE_BACKEND")
+	defer os.Unsetenv("ASYNC_QUEUE_SIZE")
+	defer clearOperations()
+
+	for i := 0; i < 3; i++ {
+		if _, err := enqueueOperation(AgentRequest{AgentId: "async-full"}); err != nil {
+			t.Fatalf("Expected operation %d queued. Got %v", i, err)
+		}
+	}
+	if _, err := enqueueOperation(AgentRequest{AgentId: "async-full"}); err != errCreationTimeout {
+		t.Errorf("Expected the operation rejected. Got %v", err)
+	}
+	if operations, _ := listUnfinishedOperations(); len(operations) != 3 {
+		t.Errorf("Expected the rejected operation not to be kept. Got %d operations", len(operations))
+	}
+}
+
+func TestClaimNextOperationShouldTakeOverExpiredLeases(t *testing.T) {
+	SetupCustomResource()
+	os.Setenv("STORAGE_BACKEND", "memory")
+	defer os.Unsetenv("STORAGE_BACKEND")
+	defer clearOperations()
+	now := time.Now().UTC()
+
+	operation, _ := enqueueOperation(AgentRequest{AgentId: "async-leased"})
+	operation.Status, operation.Owner = OperationStatusRunning, "webserver-rescheduled"
+	saveOperation(operation)
+	lease, _ := json.Marshal(OperationLease{Owner: "webserver-rescheduled", ExpiresAt: now.Add(time.Minute)})
+	GetStorage().Set(operationLeaseKeyPrefix+operation.Id, string(lease))
+
+	if queued, ok := claimNextOperation(now); ok {
+		t.Errorf("Expected the operation of the other replica left alone while its lease is valid. Got %v", queued)
+	}
+	if queued, ok := claimNextOperation(now.Add(2 * time.Minute)); !ok || queued.id != operation.Id {
+		t.Errorf("Expected the operation taken over once the lease expired. Got %v %v", queued, ok)
+	}
+	if _, ok := claimNextOperation(now.Add(2 * time.Minute)); ok {
+		t.Errorf("Expected the operation leased once")
+	}
+}
+
+func TestLeaseOperationShouldLetOneReplicaTakeOverAnExpiredLease(t *testing.T) {
+	os.Setenv("STORAGE_BACKEND", "memory")
+	defer os.Unsetenv("STORAGE_BACKEND")
+	defer GetStorage().Delete(operationLeaseKeyPrefix + "race")
+	now := time.Now().UTC()
+
+	expired, _ := json.Marshal(OperationLease{Owner: "webserver-rescheduled", ExpiresAt: now.Add(-time.Minute)})
+	GetStorage().Set(operationLeaseKeyPrefix+"race", string(expired))
+
+	var won int32
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, ok := leaseOperation("race", now); ok {
+				atomic.AddInt32(&won, 1)
+			}
+		}()
+	}
+	wg.Wait()
+	if won != 1 {
+		t.Errorf("Expected exactly one takeover of the expired lease. Got %d", won)
+	}
+}
+
+func TestRenewOperationLeaseShouldNotOverwriteATakeover(t *testing.T) {
+	os.Setenv("STORAGE_BACKEND", "memory")
+	defer os.Unsetenv("STORAGE_BACKEND")
+	defer GetStorage().Delete(operationLeaseKeyPrefix + "renewed")
+	now := time.Now().UTC()
+
+	held, _ := leaseOperation("renewed", now)
+	if renewed, ok := renewOperationLease("renewed", held); !ok || renewed == held {
+		t.Errorf("Expected the held lease renewed. Got %v", ok)
+	}
+
+	takeover, _ := json.Marshal(OperationLease{Owner: "other-replica", ExpiresAt: now.Add(time.Minute)})
+	GetStorage().Set(operationLeaseKeyPrefix+"renewed", string(takeover))
+	if _, ok := renewOperationLease("renewed", held); ok {
+		t.Errorf("Expected the lease lost after the takeover")
+	}
+	if value, _ := GetStorage().Get(operationLeaseKeyPrefix + "renewed"); value != string(takeover) {
+		t.Errorf("Expected the lease of the other replica kept. Got %s", value)
+	}
+}
+
+func TestRecoverOperationsShouldHandBackInterruptedOperations(t *testing.T) {
+	SetupCustomResource()
+	os.Setenv("STORAGE_BACKEND", "memory")
+	defer os.Unsetenv("STORAGE_BACKEND")
+	defer clearOperations()
+	hostname, _ := os.Hostname()
+
+	running, _ := enqueueOperation(AgentRequest{AgentId: "async-running"})
+	running.Status, running.Owner = OperationStatusRunning, hostname
+	saveOperation(running)
+	leaseOperation(running.Id, time.Now().UTC())
+	other := Operation{Id: newOperationId(), AgentId: "async-other", Status: OperationStatusRunning, Owner: "other-replica"}
+	saveOperation(other)
+	lease, _ := json.Marshal(OperationLease{Owner: "other-replica", ExpiresAt: time.Now().UTC().Add(time.Minute)})
+	GetStorage().Set(operationLeaseKeyPrefix+other.Id, string(lease))
+
+	RecoverOperations()
+
+	if recovered, _ := getOperation(running.Id); recovered.Status != OperationStatusQueued {
+		t.Errorf("Expected the interrupted operation queued again. Got %+v", recovered)
+	}
+	if queued, ok := claimNextOperation(time.Now().UTC()); !ok || queued.id != running.Id {
+		t.Errorf("Expected the handed back operation claimable. Got %v %v", queued, ok)
+	}
+	if untouched, _ := getOperation(other.Id); untouched.Status != OperationStatusRunning {
+		t.Errorf("Expected the operations of other replicas left alone. Got %+v", untouched)
+	}
+}
+
+func TestEnqueueOperationShouldKeepTheCredentialsOutOfTheStorage(t *testing.T) {
+	SetupCustomResource()
+	os.Setenv("STORAGE_BACKEND", "memory")
+	defer os.Unsetenv("STORAGE_BACKEND")
+	defer clearOperations()
+
+	agentRequest := AgentRequest{AgentId: "async-credentials", AuthenticationToken: "job-token"}
+	agentRequest.AgentConfiguration.AgentCredentials = AgentCredentials{Scheme: "OAuth", Data: map[string]string{"accessToken": "agent-token"}}
+	operation, err := enqueueOperation(agentRequest)
+	if err != nil {
+		t.Fatalf("Expected the operation queued. Got %v", err)
+	}
+
+	entries, _ := GetStorage().List("")
+	for key, value := range entries {
+		if strings.Contains(value, "job-token") || strings.Contains(value, "agent-token") {
+			t.Errorf("Expected no credentials in the storage. Got %s in %s", value, key)
+		}
+	}
+	queued, ok := claimNextOperation(time.Now().UTC())
+	if !ok || queued.request.AuthenticationToken != "job-token" || queued.request.AgentConfiguration.AgentCredentials.Data["accessToken"] != "agent-token" {
+		t.Errorf("Expected the credentials read back with the request. Got %+v", queued.request)
+	}
+
+	finishOperation(operation, OperationStatusFailed, AgentProvisionResponse{})
+	if _, err := CreateClientSet().clientset.CoreV1().Secrets(podnamespace).Get(operationSecretPrefix+operation.Id, metav1.GetOptions{}); err == nil {
+		t.Errorf("Expected the credentials of the finished operation deleted")
+	}
+}
+
+// A Service Bus queue for the operation tests. Received messages stay locked until they are
+// completed or abandoned.
+type fakeServiceBus struct {
+	mu        sync.Mutex
+	messages  []string
+	locked    map[string]string
+	completed []string
+}
+
+func (f *fakeServiceBus) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	switch {
+	case r.Method == http.MethodPost && r.URL.Path == "/operations/messages":
+		body, _ := ioutil.ReadAll(r.Body)
+		f.messages = append(f.messages, string(body))
+		w.WriteHeader(http.StatusCreated)
+	case r.Method == http.MethodPost && r.URL.Path == "/operations/messages/head":
+		if len(f.messages) == 0 {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		body := f.messages[0]
+		f.messages = f.messages[1:]
+		lock := "lock-" + strconv.Itoa(len(f.locked)+len(f.completed))
+		f.locked[lock] = body
+		w.Header().Set("BrokerProperties", `{"DeliveryCount":1,"LockToken":"`+lock+`","MessageId":"`+lock+`"}`)
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte(body))
+	case r.Method == http.MethodDelete && strings.HasPrefix(r.URL.Path, "/operations/messages/"):
+		lock := path.Base(r.URL.Path)
+		f.completed = append(f.completed, f.locked[lock])
+		delete(f.locked, lock)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func TestOperationsShouldBeQueuedInServiceBus(t *testing.T) {
+	SetupCustomResource()
+	os.Setenv("STORAGE_BACKEND", "memory")
+	os.Setenv("OPERATION_QUEUE_BACKEND", "servicebus")
+	defer os.Unsetenv("STORAGE_BACKEND")
+	defer os.Unsetenv("OPERATION_QUEUE_BACKEND")
+	defer clearOperations()
+
+	bus := &fakeServiceBus{locked: map[string]string{}}
+	server := httptest.NewServer(bus)
+	defer server.Close()
+	serviceBusOperations.Do(func() {})
+	serviceBusOperations.queue = &serviceBusOperationQueue{client: servicebus.NewClient(servicebus.Config{Endpoint: server.URL, KeyName: "send", Key: "c2VjcmV0", Queue: "operations"})}
+	defer func() { serviceBusOperations.queue = nil }()
+
+	canceled, _ := enqueueOperation(AgentRequest{AgentId: "async-bus-canceled"})
+	operation, err := enqueueOperation(AgentRequest{AgentId: "async-bus"})
+	if err != nil || len(bus.messages) != 2 || bus.messages[1] != operation.Id {
+		t.Fatalf("Expected the operation sent to Service Bus. Got %v %v", bus.messages, err)
+	}
+	finishOperation(canceled, OperationStatusCanceled, AgentProvisionResponse{})
+
+	queued, ok := claimNextOperation(time.Now().UTC())
+	if !ok || queued.id != operation.Id || queued.request.AgentId != "async-bus" || !strings.Contains(queued.lease, "/operations/messages/") {
+		t.Fatalf("Expected the operation received with its lock. Got %+v %v", queued, ok)
+	}
+	if len(bus.completed) != 1 || bus.completed[0] != canceled.Id {
+		t.Errorf("Expected the message of the finished operation completed. Got %v", bus.completed)
+	}
+
+	getOperationQueue().done(queued.id, queued.lease)
+	if len(bus.completed) != 2 || len(bus.locked) != 0 {
+		t.Errorf("Expected the message completed with the operation. Got %v", bus.completed)
+	}
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/microsoft/poolprovider-for-k8s/pkg/azuredevops"
+)
+
+// Every outbound call of the provider, to Azure DevOps, webhooks, registries, the mirror and the
+// fallback service, goes through one transport, so connections are pooled and kept alive across
+// callers. Each caller keeps its own timeout. OUTBOUND_MAX_IDLE_CONNS, 100 by default, and
+// OUTBOUND_MAX_IDLE_CONNS_PER_HOST, 16 by default, bound the idle connections, which are closed
+// after OUTBOUND_IDLE_CONN_TIMEOUT_SECONDS, 90 by default. HTTPS_PROXY, HTTP_PROXY and NO_PROXY
+// select the proxy; the metadata endpoint of the managed identity has to be in NO_PROXY when a
+// proxy is set. The certificates in the PEM file OUTBOUND_CA_FILE are trusted besides the system
+// ones, e.g. for an on-premises Azure DevOps Server with an internal CA.
+const (
+	defaultOutboundMaxIdleConns        = 100
+	defaultOutboundMaxIdleConnsPerHost = 16
+	defaultOutboundIdleConnTimeout     = 90 * time.Second
+	outboundDialTimeout                = 10 * time.Second
+	outboundKeepAlive                  = 30 * time.Second
+	outboundTLSHandshakeTimeout        = 10 * time.Second
+)
+
+var outboundTransport = &instrumentedTransport{next: newOutboundTransportFromEnvironment()}
+
+func newOutboundTransportFromEnvironment() *http.Transport {
+	return newOutboundTransport(
+		getEnvInt("OUTBOUND_MAX_IDLE_CONNS", defaultOutboundMaxIdleConns),
+		getEnvInt("OUTBOUND_MAX_IDLE_CONNS_PER_HOST", defaultOutboundMaxIdleConnsPerHost),
+		time.Duration(getEnvInt("OUTBOUND_IDLE_CONN_TIMEOUT_SECONDS", int(defaultOutboundIdleConnTimeout/time.Second)))*time.Second,
+		os.Getenv("OUTBOUND_CA_FILE"))
+}
+
+func newOutboundTransport(maxIdle int, maxIdlePerHost int, idleTimeout time.Duration, caFile string) *http.Transport {
+	dialer := &net.Dialer{Timeout: outboundDialTimeout, KeepAlive: outboundKeepAlive}
+	return &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		DialContext:           dialer.DialContext,
+		MaxIdleConns:          maxIdle,
+		MaxIdleConnsPerHost:   maxIdlePerHost,
+		IdleConnTimeout:       idleTimeout,
+		TLSHandshakeTimeout:   outboundTLSHandshakeTimeout,
+		ExpectContinueTimeout: time.Second,
+		TLSClientConfig:       outboundTLSConfig(caFile),
+	}
+}
+
+// Falls back to the system certificates when the CA file cannot be used.
+func outboundTLSConfig(caFile string) *tls.Config {
+	if caFile == "" {
+		return nil
+	}
+	pem, err := ioutil.ReadFile(caFile)
+	if err != nil {
+		log.Println("Failed to read OUTBOUND_CA_FILE "+caFile, err)
+		return nil
+	}
+	roots, err := x509.SystemCertPool()
+	if err != nil || roots == nil {
+		roots = x509.NewCertPool()
+	}
+	if !roots.AppendCertsFromPEM(pem) {
+		log.Println("No certificates found in OUTBOUND_CA_FILE " + caFile)
+		return nil
+	}
+	return &tls.Config{RootCAs: roots}
+}
+
+// Returns a client on the shared transport.
+func newOutboundClient(timeout time.Duration) *http.Client {
+	return &http.Client{Timeout: timeout, Transport: outboundTransport}
+}
+
+func newAzureDevOpsClient(config azuredevops.Config) *azuredevops.Client {
+	config.Transport = outboundTransport
+	return azuredevops.NewClient(config)
+}
+
+// instrumentedTransport counts the outbound requests and connections by host, and whether a
+// pooled connection was reused.
+type instrumentedTransport struct {
+	next http.RoundTripper
+}
+
+func (t *instrumentedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	host := req.URL.Host
+	trace := &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			outboundConnections.WithLabelValues(host, strconv.FormatBool(info.Reused)).Inc()
+		},
+	}
+	req = req.WithContext(httptrace.WithClientTrace(req.Context(), trace))
+
+	started := time.Now()
+	resp, err := t.next.RoundTrip(req)
+	outboundRequestSeconds.WithLabelValues(host).Observe(time.Since(started).Seconds())
+
+	code := "error"
+	if err == nil {
+		code = strconv.Itoa(resp.StatusCode)
+	}
+	outboundRequests.WithLabelValues(host, code).Inc()
+	return resp, err
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestOutboundTransportShouldTrustTheCustomCA(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		resp.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	caFile, _ := ioutil.TempFile("", "outbound-ca")
+	defer os.Remove(caFile.Name())
+	pem.Encode(caFile, &pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+	caFile.Close()
+
+	client := &http.Client{Timeout: 5 * time.Second, Transport: &instrumentedTransport{next: newOutboundTransport(10, 2, time.Minute, caFile.Name())}}
+	resp, err := client.Get(server.URL)
+	if err != nil {
+		t.Fatalf("Expected the server certificate to be trusted. Got %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		t.Errorf("Expected 204. Got %d", resp.StatusCode)
+	}
+
+	untrusted := &http.Client{Timeout: 5 * time.Second, Transport: newOutboundTransport(10, 2, time.Minute, "")}
+	if _, err := untrusted.Get(server.URL); err == nil {
+		t.Errorf("Expected the server certificate not to be trusted without the CA file")
+	}
+}
+
+func TestOutboundTLSConfigShouldIgnoreFilesWithoutCertificates(t *testing.T) {
+	caFile, _ := ioutil.TempFile("", "outbound-ca")
+	defer os.Remove(caFile.Name())
+	caFile.WriteString("not a certificate")
+	caFile.Close()
+
+	if config := outboundTLSConfig(caFile.Name()); config != nil {
+		t.Errorf("Expected the system certificates to be used")
+	}
+	if config := outboundTLSConfig("/does/not/exist"); config != nil {
+		t.Errorf("Expected the system certificates to be used")
+	}
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Schedulers other than Azure DevOps may send acquire requests in their own JSON. They name
+// themselves in the X-Poolprovider-Caller header and PAYLOAD_TRANSFORMS_FILE maps, per caller, the
+// fields of the acquire request to paths in their payload, e.g.
+// {"nightly": {"AgentId": "$.job.agentId", "AgentPool": "pool", "Demands": "job.requirements"}}.
+// A path is a dotted list of keys with optional array indexes, e.g. "jobs[0].id". Fields without a
+// mapping are taken from the top level of the payload as sent. Requests are transformed after
+// their signature is checked against the payload as sent; requests without the header are passed
+// on unchanged.
+const callerHeader = "X-Poolprovider-Caller"
+
+var payloadTransforms = struct {
+	sync.Once
+	transforms map[string]map[string]string
+}{}
+
+func loadPayloadTransforms(file string) map[string]map[string]string {
+	transforms := map[string]map[string]string{}
+	if file == "" {
+		return transforms
+	}
+
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		log.Println("Failed to read payload transforms "+file, err)
+		return transforms
+	}
+	if err := json.Unmarshal(data, &transforms); err != nil {
+		log.Println("Failed to parse payload transforms "+file, err)
+		return map[string]map[string]string{}
+	}
+	for caller, mappings := range transforms {
+		for field, path := range mappings {
+			if _, err := parseTransformPath(path); err != nil {
+				log.Println("Ignoring payload transforms of caller "+caller+", invalid path for "+field, err)
+				delete(transforms, caller)
+				break
+			}
+		}
+	}
+	return transforms
+}
+
+func getPayloadTransforms() map[string]map[string]string {
+	payloadTransforms.Do(func() {
+		payloadTransforms.transforms = loadPayloadTransforms(os.Getenv("PAYLOAD_TRANSFORMS_FILE"))
+	})
+	return payloadTransforms.transforms
+}
+
+// Returns the body in the acquire model of the provider, unchanged for requests without a caller.
+func transformAcquirePayload(caller string, body []byte, transforms map[string]map[string]string) ([]byte, error) {
+	if caller == "" {
+		return body, nil
+	}
+	mappings, ok := transforms[caller]
+	if !ok {
+		return nil, errors.New(UnknownCallerError)
+	}
+
+	var payload interface{}
+	if err := json.Unmarshal(body, &payload); err != nil {
+		return nil, err
+	}
+	transformed := map[string]interface{}{}
+	if fields, ok := payload.(map[string]interface{}); ok {
+		for key, value := range fields {
+			transformed[key] = value
+		}
+	}
+	for field, path := range mappings {
+		steps, _ := parseTransformPath(path)
+		if value, found := lookupTransformPath(payload, steps); found {
+			transformed[field] = value
+		} else {
+			delete(transformed, field)
+		}
+	}
+	return json.Marshal(transformed)
+}
+
+// A step is a key of an object, or an index of an array when key is empty.
+type transformStep struct {
+	key   string
+	index int
+}
+
+// Parses paths like "$.job.demands[0]", the leading "$." is optional.
+func parseTransformPath(path string) ([]transformStep, error) {
+	path = strings.TrimPrefix(strings.TrimPrefix(path, "$"), ".")
+	if path == "" {
+		return nil, errors.New("empty path")
+	}
+
+	steps := []transformStep{}
+	for _, part := range strings.Split(path, ".") {
+		key := part
+		indexes := ""
+		if i := strings.Index(part, "["); i >= 0 {
+			key, indexes = part[:i], part[i:]
+		}
+		if key != "" {
+			steps = append(steps, transformStep{key: key})
+		} else if indexes == "" {
+			return nil, errors.New("empty key in path " + path)
+		}
+		for indexes != "" {
+			end := strings.Index(indexes, "]")
+			if !strings.HasPrefix(indexes, "[") || end < 0 {
+				return nil, errors.New("invalid index in path " + path)
+			}
+			index, err := strconv.Atoi(indexes[1:end])
+			if err != nil || index < 0 {
+				return nil, errors.New("invalid index in path " + path)
+			}
+			steps = append(steps, transformStep{index: index})
+			indexes = indexes[end+1:]
+		}
+	}
+	return steps, nil
+}
+
+func lookupTransformPath(value interface{}, steps []transformStep) (interface{}, bool) {
+	for _, step := range steps {
+		if step.key != "" {
+			fields, ok := value.(map[string]interface{})
+			if !ok {
+				return nil, false
+			}
+			if value, ok = fields[step.key]; !ok {
+				return nil, false
+			}
+		} else {
+			items, ok := value.([]interface{})
+			if !ok || step.index >= len(items) {
+				return nil, false
+			}
+			value = items[step.index]
+		}
+	}
+	return value, true
+}
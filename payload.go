@@ -0,0 +1,186 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"log"
+	"mime"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/microsoft/poolprovider-for-k8s/pkg/storage"
+)
+
+// The /payload route echoes the request it receives in a structured form for protocol debugging. It
+// is only served when PAYLOAD_INSPECTOR is "true". Header values are echoed until
+// PAYLOAD_MAX_HEADER_BYTES, 8 KiB by default, and the body until PAYLOAD_MAX_BODY_BYTES, 64 KiB by
+// default, so a request with oversized headers or body cannot blow up the response. Credentials in
+// headers are masked. With ?store=true a request carrying a valid signature is kept under
+// "payload:<id>" for PAYLOAD_RETENTION_HOURS, 24 by default, and can be fetched with GET ?id=<id>.
+const (
+	payloadKeyPrefix         = "payload:"
+	defaultPayloadHeaderMax  = 8 << 10
+	defaultPayloadBodyMax    = 64 << 10
+	defaultPayloadRetention  = 24 * time.Hour
+	maskedPayloadHeaderValue = "********"
+)
+
+var maskedPayloadHeaders = map[string]bool{
+	"Authorization":       true,
+	"Cookie":              true,
+	"Proxy-Authorization": true,
+	"X-Azure-Signature":   true,
+}
+
+type PayloadCapture struct {
+	Id                  string `json:",omitempty"`
+	Method              string
+	Path                string
+	Query               string `json:",omitempty"`
+	Headers             map[string][]string
+	HeadersTruncated    bool   `json:",omitempty"`
+	OmittedHeaders      int    `json:",omitempty"`
+	DeclaredContentType string `json:",omitempty"`
+	DetectedContentType string `json:",omitempty"`
+	BodySize            int64
+	BodyTruncated       bool            `json:",omitempty"`
+	Body                string          `json:",omitempty"`
+	JsonBody            json.RawMessage `json:",omitempty"`
+	SignatureValid      bool
+	CapturedAt          time.Time
+}
+
+type payloadInspector struct {
+	maxHeaderBytes int
+	maxBodyBytes   int
+}
+
+func newPayloadInspectorFromEnvironment() *payloadInspector {
+	if !strings.EqualFold(os.Getenv("PAYLOAD_INSPECTOR"), "true") {
+		return nil
+	}
+	return &payloadInspector{
+		maxHeaderBytes: getEnvInt("PAYLOAD_MAX_HEADER_BYTES", defaultPayloadHeaderMax),
+		maxBodyBytes:   getEnvInt("PAYLOAD_MAX_BODY_BYTES", defaultPayloadBodyMax),
+	}
+}
+
+func PayloadHandler(inspector *payloadInspector) http.HandlerFunc {
+	return func(resp http.ResponseWriter, req *http.Request) {
+		if inspector == nil {
+			writeJsonResponse(resp, http.StatusNotFound, GetError(UnknownRouteError))
+			return
+		}
+
+		if id := req.URL.Query().Get("id"); id != "" {
+			if !isReadRequestValid(resp, req) {
+				return
+			}
+			value, err := GetStorage().Get(payloadKeyPrefix + id)
+			if errors.Is(err, storage.ErrNotFound) || (err == nil && value == "") {
+				writeJsonResponse(resp, http.StatusNotFound, GetError(UnknownPayloadError))
+				return
+			} else if err != nil {
+				writeJsonResponse(resp, http.StatusInternalServerError, GetError(err.Error()))
+				return
+			}
+			resp.Header().Set("Content-Type", "application/json")
+			resp.WriteHeader(http.StatusOK)
+			resp.Write([]byte(value))
+			return
+		}
+
+		capture := inspector.capture(req, time.Now().UTC())
+		if req.URL.Query().Get("store") == "true" {
+			if !capture.SignatureValid {
+				writeJsonResponse(resp, http.StatusForbidden, GetError(NoValidSignatureError))
+				return
+			}
+			capture.Id = strconv.FormatInt(capture.CapturedAt.UnixNano(), 36)
+			data, _ := json.Marshal(capture)
+			if err := GetStorage().Set(payloadKeyPrefix+capture.Id, string(data)); err != nil {
+				log.Println("Failed to store the payload capture", err)
+				capture.Id = ""
+			}
+		}
+		writeJsonResponse(resp, http.StatusOK, capture)
+	}
+}
+
+// Reads the request into a capture. The body beyond the limit is drained, but not kept, so its size
+// is still reported.
+func (p *payloadInspector) capture(req *http.Request, now time.Time) PayloadCapture {
+	capture := PayloadCapture{
+		Method:              req.Method,
+		Path:                req.URL.Path,
+		Query:               req.URL.RawQuery,
+		DeclaredContentType: req.Header.Get("Content-Type"),
+		CapturedAt:          now,
+	}
+	capture.Headers, capture.OmittedHeaders = p.limitHeaders(req.Header)
+	capture.HeadersTruncated = capture.OmittedHeaders > 0
+
+	var body []byte
+	if req.Body != nil {
+		body, _ = ioutil.ReadAll(io.LimitReader(req.Body, int64(p.maxBodyBytes)))
+		rest, _ := io.Copy(ioutil.Discard, req.Body)
+		capture.BodySize = int64(len(body)) + rest
+		capture.BodyTruncated = rest > 0
+		req.Body = ioutil.NopCloser(bytes.NewReader(body))
+	}
+	if len(body) > 0 {
+		capture.DetectedContentType = http.DetectContentType(body)
+	}
+	// The signature is computed over the whole body, a truncated body cannot be verified
+	capture.SignatureValid = !capture.BodyTruncated && isRequestHmacValid(req)
+
+	var indented bytes.Buffer
+	if !capture.BodyTruncated && isJsonContentType(capture.DeclaredContentType) && json.Indent(&indented, body, "", "  ") == nil {
+		capture.JsonBody = indented.Bytes()
+	} else {
+		capture.Body = string(body)
+	}
+	return capture
+}
+
+// Keeps headers in name order until their values add up to the limit, and returns how many
+// headers were left out.
+func (p *payloadInspector) limitHeaders(header http.Header) (map[string][]string, int) {
+	names := make([]string, 0, len(header))
+	for name := range header {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	limited := map[string][]string{}
+	size, omitted := 0, 0
+	for _, name := range names {
+		values := header[name]
+		if maskedPayloadHeaders[http.CanonicalHeaderKey(name)] {
+			values = []string{maskedPayloadHeaderValue}
+		}
+		valuesSize := len(name)
+		for _, value := range values {
+			valuesSize += len(value)
+		}
+		if size+valuesSize > p.maxHeaderBytes {
+			omitted++
+			continue
+		}
+		size += valuesSize
+		limited[name] = values
+	}
+	return limited, omitted
+}
+
+func isJsonContentType(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	return err == nil && (mediaType == "application/json" || strings.HasSuffix(mediaType, "+json"))
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPayloadCaptureShouldPrettyPrintJsonBodies(t *testing.T) {
+	inspector := &payloadInspector{maxHeaderBytes: 1024, maxBodyBytes: 1024}
+	req, _ := http.NewRequest("POST", "/payload?x=1", strings.NewReader(`{"AgentId":"1"}`))
+	req.Header.Set("Content-Type", "application/json; charset=utf-8")
+
+	capture := inspector.capture(req, time.Now())
+
+	if string(capture.JsonBody) != "{\n  \"AgentId\": \"1\"\n}" || capture.Body != "" {
+		t.Errorf("Expected the JSON body to be indented. Got %q %q", capture.JsonBody, capture.Body)
+	}
+	if capture.DetectedContentType != "text/plain; charset=utf-8" || capture.BodySize != 15 || capture.Query != "x=1" {
+		t.Errorf("Unexpected capture %+v", capture)
+	}
+}
+
+func TestPayloadCaptureShouldTruncateLargeBodies(t *testing.T) {
+	inspector := &payloadInspector{maxHeaderBytes: 1024, maxBodyBytes: 4}
+	req, _ := http.NewRequest("POST", "/payload", strings.NewReader(`{"AgentId":"1"}`))
+	req.Header.Set("Content-Type", "application/json")
+
+	capture := inspector.capture(req, time.Now())
+
+	if !capture.BodyTruncated || capture.BodySize != 15 || capture.Body != `{"Ag` || capture.JsonBody != nil {
+		t.Errorf("Expected the body to be truncated. Got %+v", capture)
+	}
+	if capture.SignatureValid {
+		t.Errorf("Expected a truncated body not to be verified")
+	}
+}
+
+func TestPayloadLimitHeadersShouldMaskCredentialsAndOmitOverflow(t *testing.T) {
+	inspector := &payloadInspector{maxHeaderBytes: 40, maxBodyBytes: 1024}
+	header := http.Header{}
+	header.Set("Authorization", "Bearer secret")
+	header.Set("Accept", "*/*")
+	header.Set("X-Large", strings.Repeat("a", 100))
+
+	limited, omitted := inspector.limitHeaders(header)
+
+	if limited["Authorization"][0] != maskedPayloadHeaderValue {
+		t.Errorf("Expected the authorization to be masked. Got %v", limited["Authorization"])
+	}
+	if _, ok := limited["X-Large"]; ok || omitted != 1 || limited["Accept"][0] != "*/*" {
+		t.Errorf("Expected only the oversized header to be omitted. Got %v, %d omitted", limited, omitted)
+	}
+}
+
+func TestPayloadHandlerShouldNotServeWhenDisabled(t *testing.T) {
+	resp := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "/payload", strings.NewReader("{}"))
+
+	PayloadHandler(nil)(resp, req)
+
+	if resp.Code != http.StatusNotFound {
+		t.Errorf("Expected 404. Got %d", resp.Code)
+	}
+}
+
+func TestPayloadHandlerShouldNotStoreUnsignedRequests(t *testing.T) {
+	resp := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "/payload?store=true", strings.NewReader("{}"))
+
+	PayloadHandler(&payloadInspector{maxHeaderBytes: 1024, maxBodyBytes: 1024})(resp, req)
+
+	if resp.Code != http.StatusForbidden {
+		t.Errorf("Expected 403. Got %d", resp.Code)
+	}
+}
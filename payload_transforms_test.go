@@ -0,0 +1,68 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestTransformAcquirePayloadShouldMapTheCallerFields(t *testing.T) {
+	transforms := map[string]map[string]string{"nightly": {
+		"AgentId":   "$.job.agentId",
+		"AgentPool": "pool",
+		"Demands":   "job.requirements",
+		"JobId":     "job.steps[1].id",
+	}}
+	body := []byte(`{"pool": "linux", "AccountId": "account", "job": {"agentId": "42", "requirements": ["docker"], "steps": [{"id": "a"}, {"id": "b"}]}}`)
+
+	transformed, err := transformAcquirePayload("nightly", body, transforms)
+	if err != nil {
+		t.Fatalf("Expected a transformed payload. Got %v", err)
+	}
+	var agentRequest AgentRequest
+	json.Unmarshal(transformed, &agentRequest)
+	if agentRequest.AgentId != "42" || agentRequest.AgentPool != "linux" || agentRequest.JobId != "b" {
+		t.Errorf("Unexpected request %+v", agentRequest)
+	}
+	if len(agentRequest.Demands) != 1 || agentRequest.Demands[0] != "docker" {
+		t.Errorf("Expected the demands. Got %v", agentRequest.Demands)
+	}
+	if agentRequest.AccountId != "account" {
+		t.Errorf("Expected unmapped fields to be kept. Got %s", agentRequest.AccountId)
+	}
+}
+
+func TestTransformAcquirePayloadShouldPassAzureDevOpsAndRejectUnknownCallers(t *testing.T) {
+	body := []byte(`{"AgentId": "1"}`)
+	if transformed, err := transformAcquirePayload("", body, nil); err != nil || string(transformed) != string(body) {
+		t.Errorf("Expected the payload unchanged. Got %s %v", transformed, err)
+	}
+	if _, err := transformAcquirePayload("other", body, map[string]map[string]string{}); err == nil || err.Error() != UnknownCallerError {
+		t.Errorf("Expected %s. Got %v", UnknownCallerError, err)
+	}
+}
+
+func TestParseTransformPathShouldRejectInvalidPaths(t *testing.T) {
+	for _, path := range []string{"", "$", "a..b", "a[x]", "a[1", "a[-1]"} {
+		if _, err := parseTransformPath(path); err == nil {
+			t.Errorf("Expected %q to be rejected", path)
+		}
+	}
+	if steps, err := parseTransformPath("jobs[0][2].id"); err != nil || len(steps) != 4 {
+		t.Errorf("Expected four steps. Got %v %v", steps, err)
+	}
+}
+
+func TestLoadPayloadTransformsShouldDropCallersWithInvalidPaths(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "transforms")
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "transforms.json")
+	ioutil.WriteFile(file, []byte(`{"good": {"AgentId": "id"}, "bad": {"AgentId": "a[x]"}}`), 0644)
+
+	transforms := loadPayloadTransforms(file)
+	if _, ok := transforms["good"]; !ok || len(transforms) != 1 {
+		t.Errorf("Expected only the valid caller. Got %v", transforms)
+	}
+}
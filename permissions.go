@@ -0,0 +1,178 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	authorizationv1 "k8s.io/api/authorization/v1"
+)
+
+// The provider checks at startup, and on GET /admin/permissions, whether its service account may
+// make every call it needs, with one SelfSubjectAccessReview per verb and resource. Missing
+// permissions are reported as the RBAC rules to add, grouped by namespace and resource, along
+// with the features which fail without them, instead of surfacing later as Forbidden errors
+// during an acquire. Namespaced permissions are checked in the namespace of the provider and the
+// fallback namespace, if one is configured.
+const clusterScope = "cluster"
+
+type requiredPermission struct {
+	group         string
+	resource      string
+	verbs         []string
+	clusterScoped bool
+	feature       string
+}
+
+var requiredPermissions = []requiredPermission{
+	{resource: "pods", verbs: []string{"get", "list", "create", "update", "delete"}, feature: "agent pods"},
+	{resource: "secrets", verbs: []string{"get", "list", "create", "delete"}, feature: "agent secrets"},
+	{resource: "configmaps", verbs: []string{"get", "list", "create", "update", "delete"}, feature: "state storage"},
+	{resource: "services", verbs: []string{"list", "create", "delete"}, feature: "agent DNS names"},
+	{resource: "events", verbs: []string{"list"}, feature: "startup phase metrics"},
+	{resource: "serviceaccounts", verbs: []string{"create"}, feature: "deploy access"},
+	{resource: "serviceaccounts/token", verbs: []string{"create"}, feature: "deploy access"},
+	{group: "batch", resource: "jobs", verbs: []string{"list", "create", "delete"}, feature: "agent jobs"},
+	{group: "metrics.k8s.io", resource: "pods", verbs: []string{"list"}, feature: "right-sizing recommendations"},
+	{group: "coordination.k8s.io", resource: "leases", verbs: []string{"get", "create", "update"}, feature: "leader election"},
+	{group: "dev.azure.com", resource: "azurepipelinespools", verbs: []string{"get", "update"}, feature: "pool configuration"},
+	{resource: "nodes", verbs: []string{"list"}, clusterScoped: true, feature: "demand satisfiability and Windows builds"},
+	{resource: "namespaces", verbs: []string{"get"}, clusterScoped: true, feature: "agent namespace fallback"},
+	{resource: "namespaces", verbs: []string{"create", "update"}, clusterScoped: true, feature: "pool namespaces"},
+	{resource: "resourcequotas", verbs: []string{"get", "create", "update"}, clusterScoped: true, feature: "pool namespaces"},
+	{group: "networking.k8s.io", resource: "networkpolicies", verbs: []string{"get", "create", "update"}, clusterScoped: true, feature: "pool namespaces"},
+	{group: "authentication.k8s.io", resource: "tokenreviews", verbs: []string{"create"}, clusterScoped: true, feature: "agent attestation"},
+	{group: "rbac.authorization.k8s.io", resource: "rolebindings", verbs: []string{"create"}, clusterScoped: true, feature: "deploy access"},
+}
+
+type PermissionCheck struct {
+	Scope    string
+	Group    string
+	Resource string
+	Verb     string
+	Feature  string
+	Error    string `json:",omitempty"`
+}
+
+// RbacRule is a rule to add to a Role in Scope, or to a ClusterRole when Scope is "cluster".
+type RbacRule struct {
+	Scope     string
+	ApiGroups []string
+	Resources []string
+	Verbs     []string
+	Features  []string
+}
+
+type PermissionsReport struct {
+	CheckedAt time.Time
+	Checked   int
+	Missing   []PermissionCheck
+	// Checks whose review failed, so it is not known whether the permission is missing
+	Failed []PermissionCheck `json:",omitempty"`
+	Rules  []RbacRule        `json:",omitempty"`
+}
+
+func checkPermissions(namespaces []string) PermissionsReport {
+	report := PermissionsReport{CheckedAt: time.Now().UTC(), Missing: []PermissionCheck{}}
+	reviews := CreateClientSet().clientset.AuthorizationV1().SelfSubjectAccessReviews()
+
+	for _, check := range permissionChecks(namespaces) {
+		resource, subresource := check.Resource, ""
+		if parts := strings.SplitN(check.Resource, "/", 2); len(parts) == 2 {
+			resource, subresource = parts[0], parts[1]
+		}
+		namespace := check.Scope
+		if namespace == clusterScope {
+			namespace = ""
+		}
+
+		report.Checked++
+		review, err := reviews.Create(&authorizationv1.SelfSubjectAccessReview{
+			Spec: authorizationv1.SelfSubjectAccessReviewSpec{ResourceAttributes: &authorizationv1.ResourceAttributes{
+				Namespace:   namespace,
+				Verb:        check.Verb,
+				Group:       check.Group,
+				Resource:    resource,
+				Subresource: subresource,
+			}},
+		})
+		if err != nil {
+			check.Error = err.Error()
+			report.Failed = append(report.Failed, check)
+		} else if !review.Status.Allowed {
+			report.Missing = append(report.Missing, check)
+		}
+	}
+	report.Rules = missingRules(report.Missing)
+	return report
+}
+
+func permissionChecks(namespaces []string) []PermissionCheck {
+	checks := []PermissionCheck{}
+	for _, permission := range requiredPermissions {
+		scopes := namespaces
+		if permission.clusterScoped {
+			scopes = []string{clusterScope}
+		}
+		for _, scope := range scopes {
+			for _, verb := range permission.verbs {
+				checks = append(checks, PermissionCheck{Scope: scope, Group: permission.group, Resource: permission.resource, Verb: verb, Feature: permission.feature})
+			}
+		}
+	}
+	return checks
+}
+
+// Groups the missing permissions into one rule per scope, API group and resource.
+func missingRules(missing []PermissionCheck) []RbacRule {
+	rules := []RbacRule{}
+	index := map[string]int{}
+	for _, check := range missing {
+		key := check.Scope + "|" + check.Group + "|" + check.Resource
+		i, ok := index[key]
+		if !ok {
+			i = len(rules)
+			index[key] = i
+			rules = append(rules, RbacRule{Scope: check.Scope, ApiGroups: []string{check.Group}, Resources: []string{check.Resource}})
+		}
+		rules[i].Verbs = appendUnique(rules[i].Verbs, check.Verb)
+		rules[i].Features = appendUnique(rules[i].Features, check.Feature)
+	}
+	sort.SliceStable(rules, func(i, j int) bool { return rules[i].Scope < rules[j].Scope })
+	return rules
+}
+
+func appendUnique(values []string, value string) []string {
+	for _, existing := range values {
+		if existing == value {
+			return values
+		}
+	}
+	return append(values, value)
+}
+
+func permissionNamespaces() []string {
+	return agentNamespaces(podnamespace)
+}
+
+// Logs the missing permissions, the provider keeps running with the features that work.
+func RunPermissionsCheck() {
+	report := checkPermissions(permissionNamespaces())
+	for _, rule := range report.Rules {
+		log.Println("Missing RBAC permission in " + rule.Scope + ": " + strings.Join(rule.Verbs, ",") + " on " +
+			strings.Join(rule.Resources, ",") + " of API group \"" + strings.Join(rule.ApiGroups, ",") + "\", needed for " + strings.Join(rule.Features, ", "))
+	}
+	if len(report.Failed) > 0 {
+		log.Println("Could not check " + strconv.Itoa(len(report.Failed)) + " of the RBAC permissions: " + report.Failed[0].Error)
+	}
+}
+
+func PermissionsHandler(resp http.ResponseWriter, req *http.Request) {
+	if !isReadRequestValid(resp, req) {
+		return
+	}
+	writeJsonResponse(resp, http.StatusOK, checkPermissions(permissionNamespaces()))
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestPermissionChecksShouldCoverEveryNamespace(t *testing.T) {
+	checks := permissionChecks([]string{"azuredevops", "agents"})
+
+	namespaced, cluster := 0, 0
+	for _, check := range checks {
+		if check.Scope == clusterScope {
+			cluster++
+		} else if check.Resource == "pods" && check.Verb == "create" {
+			namespaced++
+		}
+	}
+	if namespaced != 2 {
+		t.Errorf("Expected pod creation to be checked in both namespaces. Got %d", namespaced)
+	}
+	if cluster != 12 {
+		t.Errorf("Expected 12 cluster scoped checks. Got %d", cluster)
+	}
+}
+
+func TestMissingRulesShouldGroupVerbsByScopeAndResource(t *testing.T) {
+	missing := []PermissionCheck{
+		{Scope: "azuredevops", Resource: "pods", Verb: "update", Feature: "agent pods"},
+		{Scope: clusterScope, Group: "authentication.k8s.io", Resource: "tokenreviews", Verb: "create", Feature: "agent attestation"},
+		{Scope: "azuredevops", Resource: "pods", Verb: "delete", Feature: "agent pods"},
+		{Scope: "azuredevops", Group: "coordination.k8s.io", Resource: "leases", Verb: "update", Feature: "leader election"},
+	}
+
+	rules := missingRules(missing)
+
+	if len(rules) != 3 {
+		t.Fatalf("Expected 3 rules. Got %+v", rules)
+	}
+	pods := rules[0]
+	if pods.Resources[0] != "pods" || len(pods.Verbs) != 2 || pods.Verbs[0] != "update" || pods.Verbs[1] != "delete" || len(pods.Features) != 1 {
+		t.Errorf("Expected one rule for both pod verbs. Got %+v", pods)
+	}
+	if rules[1].ApiGroups[0] != "coordination.k8s.io" || rules[2].Scope != clusterScope {
+		t.Errorf("Expected the namespaced rules first. Got %+v", rules)
+	}
+}
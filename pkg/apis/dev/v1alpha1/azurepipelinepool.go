@@ -22,7 +22,9 @@ type AzurePipelinesPoolV1Alpha1Client struct {
 
 type AzurePipelinesPoolInterface interface {
 	Get(name string) (*AzurePipelinesPool, error)
-	AddNewPodForCR(obj *AzurePipelinesPool, labels map[string]string) *v1.Pod
+	Update(obj *AzurePipelinesPool) (*AzurePipelinesPool, error)
+	AddNewPodForCR(obj *AzurePipelinesPool, poolName string, labels map[string]string) *v1.Pod
+	AddNewPodForOS(obj *AzurePipelinesPool, poolName string, os string, labels map[string]string) *v1.Pod
 }
 
 type AzurePipelinesPoolclient struct {
@@ -39,7 +41,21 @@ func (c *AzurePipelinesPoolclient) Get(name string) (*AzurePipelinesPool, error)
 	return result, err
 }
 
-func (c *AzurePipelinesPoolclient) AddNewPodForCR(obj *AzurePipelinesPool, labels map[string]string) *v1.Pod {
+func (c *AzurePipelinesPoolclient) Update(obj *AzurePipelinesPool) (*AzurePipelinesPool, error) {
+	result := &AzurePipelinesPool{}
+	err := c.client.Put().
+		Namespace(c.ns).Resource("azurepipelinespools").
+		Name(obj.Name).Body(obj).Do().Into(result)
+	return result, err
+}
+
+func (c *AzurePipelinesPoolclient) AddNewPodForCR(obj *AzurePipelinesPool, poolName string, labels map[string]string) *v1.Pod {
+	return c.AddNewPodForOS(obj, poolName, "", labels)
+}
+
+// AddNewPodForOS builds the agent pod from the pod template of the pool for the OS, the template
+// of the pool's own OS when os is empty.
+func (c *AzurePipelinesPoolclient) AddNewPodForOS(obj *AzurePipelinesPool, poolName string, os string, labels map[string]string) *v1.Pod {
 
 	var spec *v1.PodSpec
 	if IsTestingEnv() {
@@ -52,45 +68,78 @@ func (c *AzurePipelinesPoolclient) AddNewPodForCR(obj *AzurePipelinesPool, label
 			},
 		}
 	} else {
-		spec = FetchPodSpec(obj)
+		pool := FetchAgentPool(obj, poolName)
+		spec = PodSpecForOS(pool, os)
+		os = pinnedOS(pool, os)
+	}
+
+	dep := NewAgentPodForOS(spec, labels, os)
+	if dep != nil && IsTestingEnv() {
+		dep.Name = "TestAgentPod"
+	}
+	return dep
+}
+
+// NewAgentPod builds the agent pod from the pod spec of a pool. The spec is copied, so the pool
+// is left untouched.
+func NewAgentPod(poolSpec *v1.PodSpec, labels map[string]string) *v1.Pod {
+	return NewAgentPodForOS(poolSpec, labels, "")
+}
+
+// NewAgentPodForOS builds the agent pod like NewAgentPod, pinned to nodes of the OS when one is
+// given.
+func NewAgentPodForOS(poolSpec *v1.PodSpec, labels map[string]string, os string) *v1.Pod {
+	if poolSpec == nil {
+		return nil
 	}
+	spec := poolSpec.DeepCopy()
+	applyAgentOS(spec, os)
 
 	// append the RUNNING_ON environment variable
-	if spec != nil && len(spec.Containers) > 0 {
+	if len(spec.Containers) > 0 {
 		spec.Containers[0].Env = append(spec.Containers[0].Env, *GetRunningOnEnvironmentVariable())
 	}
 
 	// check if VolumeMounts is not present in the spec; then add the default one
-	if spec != nil && len(spec.Containers) > 0 && spec.Containers[0].VolumeMounts == nil {
+	if len(spec.Containers) > 0 && spec.Containers[0].VolumeMounts == nil {
 		spec.Containers[0].VolumeMounts = append(spec.Containers[0].VolumeMounts, *GetDefaultVolumeMount())
 	}
 
-	if spec != nil {
-		dep := &v1.Pod{
-			ObjectMeta: meta_v1.ObjectMeta{
-				Labels:       labels,
-				GenerateName: "azure-pipelines-agent-",
-			},
-			Spec: *spec,
-		}
-		if IsTestingEnv() {
-			dep.Name = "TestAgentPod"
-		}
-		return dep
+	return &v1.Pod{
+		ObjectMeta: meta_v1.ObjectMeta{
+			Labels:       labels,
+			GenerateName: "azure-pipelines-agent-",
+		},
+		Spec: *spec,
 	}
-	return nil
 }
 
-func FetchPodSpec(obj *AzurePipelinesPool) *v1.PodSpec {
+func FetchPodSpec(obj *AzurePipelinesPool, poolName string) *v1.PodSpec {
 
-	if obj.Spec.AgentPools != nil && len(obj.Spec.AgentPools) > 0 {
-		// currently as demands are not supported so creating agentpod from agentspec being passed at first index
-		return obj.Spec.AgentPools[0].PoolSpec
+	if pool := FetchAgentPool(obj, poolName); pool != nil {
+		return pool.PoolSpec
 	}
 
 	return nil
 }
 
+// FetchAgentPool returns the agent pool with the given name. When no pool matches, the pool
+// at the first index is used so that existing single pool configurations keep working.
+func FetchAgentPool(obj *AzurePipelinesPool, poolName string) *AgentPoolSpec {
+
+	if obj.Spec.AgentPools == nil || len(obj.Spec.AgentPools) == 0 {
+		return nil
+	}
+
+	for i := range obj.Spec.AgentPools {
+		if obj.Spec.AgentPools[i].PoolName == poolName {
+			return &obj.Spec.AgentPools[i]
+		}
+	}
+
+	return &obj.Spec.AgentPools[0]
+}
+
 func GetDefaultVolumeMount() *v1.VolumeMount {
 
 	return &v1.VolumeMount{
@@ -3,6 +3,7 @@ package v1alpha1
 import (
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
         corev1 "k8s.io/api/core/v1"
+        networkingv1 "k8s.io/api/networking/v1"
 )
 
 // EDIT THIS FILE!  THIS IS SCAFFOLDING FOR YOU TO OWN!
@@ -12,13 +13,183 @@ import (
 type AzurePipelinesPoolSpec struct {
 	ControllerName string `json:"controllerImage"`
         BuildkitReplicaCount int32 `json:"buildkitReplicas"`
+	// WebserverReplicas runs the webserver highly available, the replicas elect a leader for the background work
+	WebserverReplicaCount int32 `json:"webserverReplicas,omitempty"`
 	AgentPools []AgentPoolSpec `json:"agentPools"`
 	Initialized bool  `json:"initialized"`
+	RoutingRules []RoutingRule `json:"routingRules,omitempty"`
+	PodLintRules []PodLintRule `json:"podLintRules,omitempty"`
+	Recycle *RecycleWindow `json:"recycle,omitempty"`
+	NamespaceTemplate *NamespaceTemplate `json:"namespaceTemplate,omitempty"`
 }
 
 type AgentPoolSpec struct {
 	PoolName string      `json:"name"`
 	PoolSpec *corev1.PodSpec `json:"spec"`
+	// PublishDNS creates a headless service per agent pod so it can be reached by a stable DNS name
+	PublishDNS bool `json:"publishDns,omitempty"`
+	// WarmPoolSize is the number of standby agent pods kept running ahead of acquire requests.
+	// Scale hints from the Azure DevOps queue can raise it up to MaxWarmPoolSize.
+	WarmPoolSize    int32 `json:"warmPoolSize,omitempty"`
+	MaxWarmPoolSize int32 `json:"maxWarmPoolSize,omitempty"`
+	// ScaleDownCooldownSeconds keeps the standby pods added for queued jobs until the queue has been
+	// shorter for that long, 0 scales down at once.
+	ScaleDownCooldownSeconds int32 `json:"scaleDownCooldownSeconds,omitempty"`
+	// AzureDevOpsPoolId is the id of the matching agent pool in Azure DevOps, used to poll its queue
+	AzureDevOpsPoolId int32 `json:"azureDevOpsPoolId,omitempty"`
+	// ImageRules pick the agent image from the demands of the job, so one pool can serve several toolchains
+	ImageRules []ImageRule `json:"imageRules,omitempty"`
+	// Capabilities are the demands the default agent image satisfies, e.g. "docker" or "node=18".
+	// Pools with Capabilities or ImageRules reject jobs with demands neither of them offers.
+	Capabilities []string `json:"capabilities,omitempty"`
+	// Description, AutoProvision and AutoUpdate are kept in sync with the Azure DevOps pool
+	// AzureDevOpsPoolId, together with Capabilities, when the pool sync is enabled.
+	Description   string `json:"description,omitempty"`
+	AutoProvision *bool  `json:"autoProvision,omitempty"`
+	AutoUpdate    *bool  `json:"autoUpdate,omitempty"`
+	// WindowsBuild is the OS build of the Windows agent image, e.g. "10.0.17763". When empty it is
+	// derived from the image tag.
+	WindowsBuild string `json:"windowsBuild,omitempty"`
+	// SharedTools materializes the toolset of a heavy tools image once per node, so the agent pods
+	// of the pool can run a slim image which mounts the tools read-only.
+	SharedTools *SharedToolsSpec `json:"sharedTools,omitempty"`
+	// MonthlyBudget caps the estimated cost of the pool per month. When it is used up, BudgetAction
+	// "enforce" freezes the pool until the next month and "warn" only sends a notification.
+	MonthlyBudget int32  `json:"monthlyBudget,omitempty"`
+	BudgetAction  string `json:"budgetAction,omitempty"`
+	// RegistryCredentials are the container registries every job of the pool gets short-lived
+	// credentials for. They are mounted as docker config into the agent and removed on release.
+	RegistryCredentials []RegistryCredentialSpec `json:"registryCredentials,omitempty"`
+	// DeployAccess gives every job of the pool a kubeconfig for deploying to a namespace of this
+	// cluster, valid until the agent is released or the token expires.
+	DeployAccess *DeployAccessSpec `json:"deployAccess,omitempty"`
+	// Diagnostics runs the agents of the pool in diagnostic mode, with HTTP tracing and their
+	// diagnostic logs written to the container log. Single jobs ask for it with a demand.
+	Diagnostics bool `json:"diagnostics,omitempty"`
+	// MaxAgents caps the agent pods of the pool, 0 is no cap.
+	MaxAgents int32 `json:"maxAgents,omitempty"`
+	// FallbackPools take the jobs of the pool, in order, while it is frozen, at MaxAgents or its
+	// agent pods cannot be scheduled.
+	FallbackPools []string `json:"fallbackPools,omitempty"`
+	// Mesh controls the sidecar injection of a service mesh into the agent pods of the pool.
+	Mesh *MeshSpec `json:"mesh,omitempty"`
+	// QueuePriority orders the acquire requests waiting for a pod creation slot, requests of pools
+	// with a higher priority are dispatched first and requests of equal priority in arrival order.
+	QueuePriority int32 `json:"queuePriority,omitempty"`
+	// Namespace isolates the agent pods of the pool in a namespace of their own, created on demand
+	// from the NamespaceTemplate. When empty, the NamePrefix of the template and AzureDevOpsPoolId
+	// name it, otherwise the agent pods run in the namespace of the webserver.
+	Namespace string `json:"namespace,omitempty"`
+	// Job runs every agent of the pool as a Kubernetes Job instead of a bare pod, so the agent pod
+	// is cleaned up by Kubernetes once the agent exited after its job.
+	Job *AgentJobSpec `json:"job,omitempty"`
+	// Cluster names the cluster of the cluster registry the agent pods of the pool run in. When
+	// empty they run in the cluster of the webserver.
+	Cluster string `json:"cluster,omitempty"`
+	// Ephemeral runs every agent of the pool for exactly one job. The agent is started with --once
+	// and its pod is deleted as soon as the agent exited, which replenishes the warm pool at once.
+	Ephemeral bool `json:"ephemeral,omitempty"`
+	// OS is the OS of the agents of the pool, "linux" by default or "windows". Agent pods are pinned
+	// to nodes of their OS. WindowsSpec is the pod template of the Windows agents of a pool which
+	// serves both, the OS of the acquire request picks between it and Spec.
+	OS          string          `json:"os,omitempty"`
+	WindowsSpec *corev1.PodSpec `json:"windowsSpec,omitempty"`
+	// PrepullImages keeps the images of the pool pulled on every node the pool runs on, the images of
+	// WindowsSpec on its Windows nodes, updated whenever they change, so agent pods do not wait for
+	// the image pull. The pulling stops when it is turned off or the pool is removed.
+	PrepullImages bool `json:"prepullImages,omitempty"`
+}
+
+// AgentJobSpec configures the Jobs of the agents of a pool. Finished Jobs are deleted with their
+// pod after TTLSecondsAfterFinished, 300 by default. BackoffLimit retries agent pods which failed,
+// 0 by default, as the agent is registered for a single job.
+type AgentJobSpec struct {
+	TTLSecondsAfterFinished *int32 `json:"ttlSecondsAfterFinished,omitempty"`
+	BackoffLimit            *int32 `json:"backoffLimit,omitempty"`
+}
+
+// NamespaceTemplate is applied to the namespaces of the agent pools when they are provisioned.
+// The namespace gets Labels, and ResourceQuota and NetworkPolicy, when set, are created in it as
+// "azure-pipelines-pool". Pools with an AzureDevOpsPoolId but no Namespace get the namespace
+// NamePrefix followed by the pool id, e.g. "ado-pool-12", when NamePrefix is set.
+type NamespaceTemplate struct {
+	NamePrefix    string                          `json:"namePrefix,omitempty"`
+	Labels        map[string]string               `json:"labels,omitempty"`
+	ResourceQuota *corev1.ResourceQuotaSpec       `json:"resourceQuota,omitempty"`
+	NetworkPolicy *networkingv1.NetworkPolicySpec `json:"networkPolicy,omitempty"`
+}
+
+// MeshSpec sets Injection "enabled" or "disabled" for Istio and Linkerd, when empty the namespace
+// decides. Traffic on ExcludeOutboundPorts and ExcludeInboundPorts bypasses the sidecar, e.g. 443
+// so the proxy does not cut the long-polling connection of the agent to Azure DevOps.
+type MeshSpec struct {
+	Injection            string  `json:"injection,omitempty"`
+	ExcludeOutboundPorts []int32 `json:"excludeOutboundPorts,omitempty"`
+	ExcludeInboundPorts  []int32 `json:"excludeInboundPorts,omitempty"`
+}
+
+// DeployAccessSpec binds ClusterRole, "edit" by default, in Namespace to the service account the
+// kubeconfig tokens are issued for. ClusterRole has to be one of DEPLOY_CLUSTER_ROLES of the
+// webserver. Tokens expire after ExpirationSeconds, one hour by default.
+type DeployAccessSpec struct {
+	Namespace         string `json:"namespace"`
+	ClusterRole       string `json:"clusterRole,omitempty"`
+	ExpirationSeconds int64  `json:"expirationSeconds,omitempty"`
+}
+
+// RegistryCredentialSpec issues credentials for Server, e.g. "contoso.azurecr.io". Provider "acr"
+// exchanges the managed identity of the provider for an ACR refresh token, "helper" asks the
+// credential helper service at REGISTRY_CREDENTIAL_HELPER_URL, e.g. one issuing ECR tokens.
+type RegistryCredentialSpec struct {
+	Server   string `json:"server"`
+	Provider string `json:"provider"`
+}
+
+// SharedToolsSpec copies SourcePath of Image into a directory on every node the pool runs on. Agent
+// pods mount that directory read-only at MountPath.
+type SharedToolsSpec struct {
+	Image      string `json:"image"`
+	SourcePath string `json:"sourcePath"`
+	MountPath  string `json:"mountPath"`
+}
+
+// ImageRule uses Image for jobs whose demands include all of Demands. A demand is either a name,
+// e.g. "docker", or a name and value, e.g. "node=18". When several rules match, the one with the
+// highest Priority wins.
+type ImageRule struct {
+	Demands  []string `json:"demands"`
+	Image    string   `json:"image"`
+	Priority int32    `json:"priority,omitempty"`
+}
+
+// RoutingRule sends matching jobs to the named agent pool, e.g. a pool whose image has the SDKs of a
+// language preinstalled. A job matches when it matches every condition the rule sets. Branch and
+// Repository are either an exact name or a prefix ending in '*', e.g. "feature/*"; repositories
+// match case-insensitively. Languages match the language hinted by a demand of the job, e.g. "java"
+// for a job demanding maven.
+type RoutingRule struct {
+	Branch     string   `json:"branch,omitempty"`
+	Repository string   `json:"repository,omitempty"`
+	Languages  []string `json:"languages,omitempty"`
+	PoolName   string   `json:"pool"`
+}
+
+// RecycleWindow replaces agent pods older than MaxAgeHours, starting at every time matching the
+// cron Schedule ("minute hour day-of-month month day-of-week", in UTC). At most MaxParallel pods
+// are recycled at once. Pods running a job are left alone until they are released.
+type RecycleWindow struct {
+	Schedule    string `json:"schedule"`
+	MaxAgeHours int32  `json:"maxAgeHours"`
+	MaxParallel int32  `json:"maxParallel,omitempty"`
+}
+
+// PodLintRule is a policy check applied to every agent pod before it is created.
+// Rule is one of noLatestTag, resourcesSet, runAsNonRoot or requiredLabel (which uses Label).
+// Action is either "warn" or "block".
+type PodLintRule struct {
+	Rule   string `json:"rule"`
+	Action string `json:"action"`
+	Label  string `json:"label,omitempty"`
 }
 
 // +k8s:deepcopy-gen:interfaces=k8s.io/apimachinery/pkg/runtime.Object
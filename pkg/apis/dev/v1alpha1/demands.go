@@ -0,0 +1,179 @@
+package v1alpha1
+
+import (
+	"strings"
+
+	v1 "k8s.io/api/core/v1"
+)
+
+// ResolveDemandImage returns the image of the highest priority image rule of the pool whose
+// demands are all met by the job, or an empty string when no rule matches. On equal priority the
+// rule with more demands wins, then the first one.
+func ResolveDemandImage(pool *AgentPoolSpec, demands []string) string {
+	if pool == nil || len(pool.ImageRules) == 0 {
+		return ""
+	}
+
+	jobDemands := map[string]string{}
+	for _, demand := range demands {
+		name, value := parseDemand(demand)
+		jobDemands[name] = value
+	}
+
+	var best *ImageRule
+	for i := range pool.ImageRules {
+		rule := &pool.ImageRules[i]
+		if !matchDemands(rule.Demands, jobDemands) {
+			continue
+		}
+		if best == nil || rule.Priority > best.Priority ||
+			(rule.Priority == best.Priority && len(rule.Demands) > len(best.Demands)) {
+			best = rule
+		}
+	}
+
+	if best == nil {
+		return ""
+	}
+	return best.Image
+}
+
+func matchDemands(ruleDemands []string, jobDemands map[string]string) bool {
+	if len(ruleDemands) == 0 {
+		return false
+	}
+	for _, demand := range ruleDemands {
+		name, value := parseDemand(demand)
+		jobValue, ok := jobDemands[name]
+		if !ok || (value != "" && value != jobValue) {
+			return false
+		}
+	}
+	return true
+}
+
+// Demands starting with ProviderDemandPrefix are options for the provider, not for the agent.
+// DiagnosticsDemand runs the agent of the job in diagnostic mode, "poolprovider.diagnostics" or
+// "poolprovider.diagnostics=once" for a single job, "poolprovider.diagnostics=continuous" to keep
+// the agent listening afterwards so the pod can be inspected.
+const (
+	ProviderDemandPrefix  = "poolprovider."
+	DiagnosticsDemand     = ProviderDemandPrefix + "diagnostics"
+	DiagnosticsOnce       = "once"
+	DiagnosticsContinuous = "continuous"
+)
+
+// UnmatchedDemands returns the demands of the job which neither the capabilities nor the image
+// rules of the pool offer, and the service demands the catalog does not offer. Pools without
+// capabilities or image rules do not tell what their agents offer, all other demands are taken as
+// met for them. Agent.* demands are about the agent itself and provider demands are about the
+// provider, both are always met.
+func UnmatchedDemands(pool *AgentPoolSpec, demands []string) []string {
+	// Service demands are met by the catalog of services, whatever the pool offers
+	var unmatched []string
+	var agentDemands []string
+	for _, demand := range demands {
+		if _, _, isService, offered := serviceDemand(demand); !isService {
+			agentDemands = append(agentDemands, demand)
+		} else if !offered {
+			unmatched = append(unmatched, demand)
+		}
+	}
+	if pool == nil || (len(pool.Capabilities) == 0 && len(pool.ImageRules) == 0) {
+		return unmatched
+	}
+
+	offered := map[string][]string{}
+	offer := func(capabilities []string) {
+		for _, capability := range capabilities {
+			name, value := parseDemand(capability)
+			offered[name] = append(offered[name], value)
+		}
+	}
+	offer(pool.Capabilities)
+	for i := range pool.ImageRules {
+		offer(pool.ImageRules[i].Demands)
+	}
+
+	for _, demand := range agentDemands {
+		name, value := parseDemand(demand)
+		if name == "" || strings.HasPrefix(name, "agent.") || strings.HasPrefix(name, ProviderDemandPrefix) || offersValue(offered[name], value) {
+			continue
+		}
+		unmatched = append(unmatched, demand)
+	}
+	return unmatched
+}
+
+// DiagnosticsMode returns the diagnostic mode the agent of the job runs in, DiagnosticsOnce or
+// DiagnosticsContinuous, or an empty string when it runs normally. The demand of the job wins over
+// the Diagnostics setting of the pool, which runs every job in DiagnosticsOnce.
+func DiagnosticsMode(pool *AgentPoolSpec, demands []string) string {
+	for _, demand := range demands {
+		name, value := parseDemand(demand)
+		if name != DiagnosticsDemand {
+			continue
+		}
+		switch strings.ToLower(value) {
+		case "false":
+			return ""
+		case DiagnosticsContinuous:
+			return DiagnosticsContinuous
+		default:
+			return DiagnosticsOnce
+		}
+	}
+	if pool != nil && pool.Diagnostics {
+		return DiagnosticsOnce
+	}
+	return ""
+}
+
+// A capability without a value offers every value.
+func offersValue(values []string, value string) bool {
+	for _, offered := range values {
+		if offered == "" || value == "" || offered == value {
+			return true
+		}
+	}
+	return false
+}
+
+// Demands are either "name=value" or sent by Azure DevOps as "name -equals value"; a bare name only
+// asks for the capability to exist. Names are case insensitive like agent capabilities.
+// DemandName returns the lower case capability name the demand asks for.
+func DemandName(demand string) string {
+	name, _ := parseDemand(demand)
+	return name
+}
+
+func parseDemand(demand string) (string, string) {
+	var name, value string
+	if i := strings.Index(demand, " -equals "); i >= 0 {
+		name, value = demand[:i], demand[i+len(" -equals "):]
+	} else if i := strings.Index(demand, "="); i >= 0 {
+		name, value = demand[:i], demand[i+1:]
+	} else {
+		name = demand
+	}
+	return strings.ToLower(strings.TrimSpace(name)), strings.TrimSpace(value)
+}
+
+// RenderAgentPod returns the agent pod a job with the given demands gets from the pool, before the
+// agent secret is mounted. It is used to test pool templates.
+func RenderAgentPod(pool *AgentPoolSpec, demands []string) *v1.Pod {
+	return RenderAgentPodForOS(pool, demands, "")
+}
+
+// RenderAgentPodForOS returns the agent pod like RenderAgentPod, from the pod template of the pool
+// for the OS.
+func RenderAgentPodForOS(pool *AgentPoolSpec, demands []string, os string) *v1.Pod {
+	pod := NewAgentPodForOS(PodSpecForOS(pool, os), nil, pinnedOS(pool, os))
+	if image := ResolveDemandImage(pool, demands); pod != nil && image != "" && len(pod.Spec.Containers) > 0 {
+		pod.Spec.Containers[0].Image = image
+	}
+	AddSharedTools(pod, pool)
+	AddMeshAnnotations(pod, pool)
+	AddServiceContainers(pod, demands)
+	return pod
+}
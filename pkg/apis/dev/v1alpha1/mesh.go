@@ -0,0 +1,61 @@
+package v1alpha1
+
+import (
+	"strconv"
+	"strings"
+
+	v1 "k8s.io/api/core/v1"
+)
+
+const (
+	MeshInjectionEnabled  = "enabled"
+	MeshInjectionDisabled = "disabled"
+
+	istioInjectAnnotation          = "sidecar.istio.io/inject"
+	istioExcludeOutboundAnnotation = "traffic.sidecar.istio.io/excludeOutboundPorts"
+	istioExcludeInboundAnnotation  = "traffic.sidecar.istio.io/excludeInboundPorts"
+	linkerdInjectAnnotation        = "linkerd.io/inject"
+	linkerdSkipOutboundAnnotation  = "config.linkerd.io/skip-outbound-ports"
+	linkerdSkipInboundAnnotation   = "config.linkerd.io/skip-inbound-ports"
+)
+
+// AddMeshAnnotations stamps the sidecar injection annotations of Istio and Linkerd on the agent
+// pod, so the pool behaves the same whichever mesh watches its namespace.
+func AddMeshAnnotations(pod *v1.Pod, pool *AgentPoolSpec) {
+	if pod == nil || pool == nil || pool.Mesh == nil {
+		return
+	}
+
+	annotations := map[string]string{}
+	switch pool.Mesh.Injection {
+	case MeshInjectionEnabled:
+		annotations[istioInjectAnnotation] = "true"
+		annotations[linkerdInjectAnnotation] = MeshInjectionEnabled
+	case MeshInjectionDisabled:
+		annotations[istioInjectAnnotation] = "false"
+		annotations[linkerdInjectAnnotation] = MeshInjectionDisabled
+	}
+	if ports := joinPorts(pool.Mesh.ExcludeOutboundPorts); ports != "" {
+		annotations[istioExcludeOutboundAnnotation] = ports
+		annotations[linkerdSkipOutboundAnnotation] = ports
+	}
+	if ports := joinPorts(pool.Mesh.ExcludeInboundPorts); ports != "" {
+		annotations[istioExcludeInboundAnnotation] = ports
+		annotations[linkerdSkipInboundAnnotation] = ports
+	}
+
+	if len(annotations) > 0 && pod.ObjectMeta.Annotations == nil {
+		pod.ObjectMeta.Annotations = map[string]string{}
+	}
+	for name, value := range annotations {
+		pod.ObjectMeta.Annotations[name] = value
+	}
+}
+
+func joinPorts(ports []int32) string {
+	values := make([]string, 0, len(ports))
+	for _, port := range ports {
+		values = append(values, strconv.Itoa(int(port)))
+	}
+	return strings.Join(values, ",")
+}
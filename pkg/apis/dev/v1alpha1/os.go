@@ -0,0 +1,78 @@
+package v1alpha1
+
+import (
+	"strings"
+
+	v1 "k8s.io/api/core/v1"
+)
+
+const (
+	OSLinux   = "linux"
+	OSWindows = "windows"
+
+	osLabel                 = "kubernetes.io/os"
+	windowsCredentialsMount = "C:\\azurepipelines\\agent"
+)
+
+// PoolOS returns the OS the agents of the pool run when the request does not ask for one, Linux
+// unless the pool sets OS.
+func PoolOS(pool *AgentPoolSpec) string {
+	if pool != nil && strings.EqualFold(pool.OS, OSWindows) {
+		return OSWindows
+	}
+	return OSLinux
+}
+
+// ResolveAgentOS returns the OS the agent of a request for the pool runs. A pool serves the OS it
+// is set to, and Windows as well when it has a WindowsSpec. False is returned when the pool has no
+// pod template for the requested OS.
+func ResolveAgentOS(pool *AgentPoolSpec, requested string) (string, bool) {
+	requested = strings.ToLower(requested)
+	if requested == "" || requested == PoolOS(pool) {
+		return PoolOS(pool), true
+	}
+	if requested == OSWindows && pool != nil && pool.WindowsSpec != nil {
+		return OSWindows, true
+	}
+	return requested, false
+}
+
+// PodSpecForOS returns the pod template of the agents of the pool running the OS.
+func PodSpecForOS(pool *AgentPoolSpec, os string) *v1.PodSpec {
+	if pool == nil {
+		return nil
+	}
+	if os == OSWindows && pool.WindowsSpec != nil {
+		return pool.WindowsSpec
+	}
+	return pool.PoolSpec
+}
+
+// Returns the OS the agent pods of the pool are pinned to. Pools which set neither OS nor
+// WindowsSpec keep the node selector of their template.
+func pinnedOS(pool *AgentPoolSpec, os string) string {
+	if pool == nil || (pool.OS == "" && pool.WindowsSpec == nil) {
+		return ""
+	}
+	return os
+}
+
+// Pins the agent pod to nodes of its OS, so the Linux and Windows agents of a pool serving both do
+// not land on each other's nodes, and mounts the agent credentials where the agent of the OS
+// reads them.
+func applyAgentOS(spec *v1.PodSpec, os string) {
+	if os == "" {
+		return
+	}
+	if spec.NodeSelector == nil {
+		spec.NodeSelector = map[string]string{}
+	}
+	if spec.NodeSelector[osLabel] == "" {
+		spec.NodeSelector[osLabel] = os
+	}
+	if os == OSWindows && len(spec.Containers) > 0 && spec.Containers[0].VolumeMounts == nil {
+		mount := *GetDefaultVolumeMount()
+		mount.MountPath = windowsCredentialsMount
+		spec.Containers[0].VolumeMounts = []v1.VolumeMount{mount}
+	}
+}
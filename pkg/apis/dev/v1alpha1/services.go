@@ -0,0 +1,108 @@
+package v1alpha1
+
+import (
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+)
+
+// Demands starting with ServiceDemandPrefix ask for a service container next to the agent, like the
+// services of hosted CI, e.g. "service:postgres=15" for PostgreSQL 15. The value is the image tag,
+// without one the tag of the catalog is used. Services share the network of the agent, which
+// reaches them on localhost at the port in SERVICE_<NAME>_PORT. A readiness probe on that port
+// keeps the pod unready until the services accept connections.
+const (
+	ServiceDemandPrefix = "service:"
+	serviceContainerTag = "service-"
+)
+
+type serviceDefinition struct {
+	image      string
+	defaultTag string
+	port       int32
+	env        []v1.EnvVar
+}
+
+// The curated catalog of services. Credentials are left off, the services are reachable from the
+// agent pod only.
+var serviceCatalog = map[string]serviceDefinition{
+	"postgres": {image: "postgres", defaultTag: "16", port: 5432, env: []v1.EnvVar{{Name: "POSTGRES_HOST_AUTH_METHOD", Value: "trust"}}},
+	"mysql":    {image: "mysql", defaultTag: "8", port: 3306, env: []v1.EnvVar{{Name: "MYSQL_ALLOW_EMPTY_PASSWORD", Value: "yes"}}},
+	"redis":    {image: "redis", defaultTag: "7", port: 6379},
+	"mongo":    {image: "mongo", defaultTag: "7", port: 27017},
+	"rabbitmq": {image: "rabbitmq", defaultTag: "3", port: 5672},
+}
+
+var imageTagPattern = regexp.MustCompile(`^[A-Za-z0-9_][A-Za-z0-9_.-]{0,127}$`)
+
+// serviceDemand returns the service and tag a demand asks for, whether it is a service demand at
+// all and whether the catalog offers the service with a valid tag.
+func serviceDemand(demand string) (name string, tag string, isService bool, offered bool) {
+	name, tag = parseDemand(demand)
+	if !strings.HasPrefix(name, ServiceDemandPrefix) {
+		return "", "", false, false
+	}
+	name = strings.TrimPrefix(name, ServiceDemandPrefix)
+	definition, ok := serviceCatalog[name]
+	if !ok {
+		return name, tag, true, false
+	}
+	if tag == "" {
+		tag = definition.defaultTag
+	}
+	return name, tag, true, imageTagPattern.MatchString(tag)
+}
+
+// HasServiceDemands returns whether the job asks for a service container.
+func HasServiceDemands(demands []string) bool {
+	for _, demand := range demands {
+		if _, _, isService, _ := serviceDemand(demand); isService {
+			return true
+		}
+	}
+	return false
+}
+
+// AddServiceContainers adds a container for every service the job demands that the catalog offers,
+// in the order of their names. Jobs asking for other services are rejected by the satisfiability
+// check before their pod is created.
+func AddServiceContainers(pod *v1.Pod, demands []string) {
+	if pod == nil || len(pod.Spec.Containers) == 0 {
+		return
+	}
+
+	tags := map[string]string{}
+	for _, demand := range demands {
+		if name, tag, _, offered := serviceDemand(demand); offered {
+			tags[name] = tag
+		}
+	}
+	names := make([]string, 0, len(tags))
+	for name := range tags {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		definition := serviceCatalog[name]
+		pod.Spec.Containers = append(pod.Spec.Containers, v1.Container{
+			Name:  serviceContainerTag + name,
+			Image: definition.image + ":" + tags[name],
+			Ports: []v1.ContainerPort{{Name: name, ContainerPort: definition.port, Protocol: v1.ProtocolTCP}},
+			Env:   definition.env,
+			ReadinessProbe: &v1.Probe{
+				Handler:       v1.Handler{TCPSocket: &v1.TCPSocketAction{Port: intstr.FromInt(int(definition.port))}},
+				PeriodSeconds: 2,
+			},
+		})
+		agent := &pod.Spec.Containers[0]
+		agent.Env = append(agent.Env, v1.EnvVar{
+			Name:  "SERVICE_" + strings.ToUpper(name) + "_PORT",
+			Value: strconv.Itoa(int(definition.port)),
+		})
+	}
+}
@@ -0,0 +1,61 @@
+package v1alpha1
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+
+	v1 "k8s.io/api/core/v1"
+)
+
+const (
+	// SharedToolsRoot is the directory on the nodes below which the toolsets are materialized
+	SharedToolsRoot          = "/var/lib/poolprovider/tools"
+	sharedToolsVolume        = "shared-tools"
+	sharedToolsEnvVariable   = "AZP_TOOLS_DIR"
+	sharedToolsVersionLength = 12
+)
+
+// SharedToolsPoolPath is the directory on the node holding the toolsets of the pool.
+func SharedToolsPoolPath(poolName string) string {
+	return SharedToolsRoot + "/" + poolName
+}
+
+// SharedToolsVersion names the directory of the toolset of the given tools image. Every image gets
+// its own directory, so agents still running on the old toolset are not affected by an update.
+func SharedToolsVersion(image string) string {
+	sum := sha256.Sum256([]byte(image))
+	return hex.EncodeToString(sum[:])[:sharedToolsVersionLength]
+}
+
+// SharedToolsHostPath is the node directory of the toolset of the given tools image.
+func SharedToolsHostPath(poolName string, image string) string {
+	return SharedToolsPoolPath(poolName) + "/" + SharedToolsVersion(image)
+}
+
+// AddSharedTools mounts the toolset of the pool read-only into every container of the agent pod.
+// The node directory only appears once the toolset has been copied completely, until then the
+// kubelet keeps retrying the mount and the pod waits in ContainerCreating.
+func AddSharedTools(pod *v1.Pod, pool *AgentPoolSpec) {
+	if pod == nil || pool == nil || pool.SharedTools == nil {
+		return
+	}
+
+	hostPathType := v1.HostPathDirectory
+	pod.Spec.Volumes = append(pod.Spec.Volumes, v1.Volume{
+		Name: sharedToolsVolume,
+		VolumeSource: v1.VolumeSource{HostPath: &v1.HostPathVolumeSource{
+			Path: SharedToolsHostPath(pool.PoolName, pool.SharedTools.Image),
+			Type: &hostPathType,
+		}},
+	})
+
+	for i := range pod.Spec.Containers {
+		container := &pod.Spec.Containers[i]
+		container.VolumeMounts = append(container.VolumeMounts, v1.VolumeMount{
+			Name:      sharedToolsVolume,
+			MountPath: pool.SharedTools.MountPath,
+			ReadOnly:  true,
+		})
+		container.Env = append(container.Env, v1.EnvVar{Name: sharedToolsEnvVariable, Value: pool.SharedTools.MountPath})
+	}
+}
@@ -5,15 +5,121 @@
 package v1alpha1
 
 import (
+	v1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
 	runtime "k8s.io/apimachinery/pkg/runtime"
 )
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *AgentJobSpec) DeepCopyInto(out *AgentJobSpec) {
+	*out = *in
+	if in.TTLSecondsAfterFinished != nil {
+		in, out := &in.TTLSecondsAfterFinished, &out.TTLSecondsAfterFinished
+		*out = new(int32)
+		**out = **in
+	}
+	if in.BackoffLimit != nil {
+		in, out := &in.BackoffLimit, &out.BackoffLimit
+		*out = new(int32)
+		**out = **in
+	}
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new AgentJobSpec.
+func (in *AgentJobSpec) DeepCopy() *AgentJobSpec {
+	if in == nil {
+		return nil
+	}
+	out := new(AgentJobSpec)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *AgentPoolSpec) DeepCopyInto(out *AgentPoolSpec) {
+	*out = *in
+	if in.PoolSpec != nil {
+		in, out := &in.PoolSpec, &out.PoolSpec
+		*out = new(v1.PodSpec)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.ImageRules != nil {
+		in, out := &in.ImageRules, &out.ImageRules
+		*out = make([]ImageRule, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+	if in.Capabilities != nil {
+		in, out := &in.Capabilities, &out.Capabilities
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	if in.AutoProvision != nil {
+		in, out := &in.AutoProvision, &out.AutoProvision
+		*out = new(bool)
+		**out = **in
+	}
+	if in.AutoUpdate != nil {
+		in, out := &in.AutoUpdate, &out.AutoUpdate
+		*out = new(bool)
+		**out = **in
+	}
+	if in.SharedTools != nil {
+		in, out := &in.SharedTools, &out.SharedTools
+		*out = new(SharedToolsSpec)
+		**out = **in
+	}
+	if in.RegistryCredentials != nil {
+		in, out := &in.RegistryCredentials, &out.RegistryCredentials
+		*out = make([]RegistryCredentialSpec, len(*in))
+		copy(*out, *in)
+	}
+	if in.DeployAccess != nil {
+		in, out := &in.DeployAccess, &out.DeployAccess
+		*out = new(DeployAccessSpec)
+		**out = **in
+	}
+	if in.FallbackPools != nil {
+		in, out := &in.FallbackPools, &out.FallbackPools
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	if in.Mesh != nil {
+		in, out := &in.Mesh, &out.Mesh
+		*out = new(MeshSpec)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.Job != nil {
+		in, out := &in.Job, &out.Job
+		*out = new(AgentJobSpec)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.WindowsSpec != nil {
+		in, out := &in.WindowsSpec, &out.WindowsSpec
+		*out = new(v1.PodSpec)
+		(*in).DeepCopyInto(*out)
+	}
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new AgentPoolSpec.
+func (in *AgentPoolSpec) DeepCopy() *AgentPoolSpec {
+	if in == nil {
+		return nil
+	}
+	out := new(AgentPoolSpec)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *AzurePipelinesPool) DeepCopyInto(out *AzurePipelinesPool) {
 	*out = *in
 	out.TypeMeta = in.TypeMeta
 	in.ObjectMeta.DeepCopyInto(&out.ObjectMeta)
-	out.Spec = in.Spec
+	in.Spec.DeepCopyInto(&out.Spec)
 	return
 }
 
@@ -71,6 +177,35 @@ func (in *AzurePipelinesPoolList) DeepCopyObject() runtime.Object {
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *AzurePipelinesPoolSpec) DeepCopyInto(out *AzurePipelinesPoolSpec) {
 	*out = *in
+	if in.AgentPools != nil {
+		in, out := &in.AgentPools, &out.AgentPools
+		*out = make([]AgentPoolSpec, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+	if in.RoutingRules != nil {
+		in, out := &in.RoutingRules, &out.RoutingRules
+		*out = make([]RoutingRule, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+	if in.PodLintRules != nil {
+		in, out := &in.PodLintRules, &out.PodLintRules
+		*out = make([]PodLintRule, len(*in))
+		copy(*out, *in)
+	}
+	if in.Recycle != nil {
+		in, out := &in.Recycle, &out.Recycle
+		*out = new(RecycleWindow)
+		**out = **in
+	}
+	if in.NamespaceTemplate != nil {
+		in, out := &in.NamespaceTemplate, &out.NamespaceTemplate
+		*out = new(NamespaceTemplate)
+		(*in).DeepCopyInto(*out)
+	}
 	return
 }
 
@@ -82,4 +217,185 @@ func (in *AzurePipelinesPoolSpec) DeepCopy() *AzurePipelinesPoolSpec {
 	out := new(AzurePipelinesPoolSpec)
 	in.DeepCopyInto(out)
 	return out
-}
\ No newline at end of file
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *DeployAccessSpec) DeepCopyInto(out *DeployAccessSpec) {
+	*out = *in
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new DeployAccessSpec.
+func (in *DeployAccessSpec) DeepCopy() *DeployAccessSpec {
+	if in == nil {
+		return nil
+	}
+	out := new(DeployAccessSpec)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ImageRule) DeepCopyInto(out *ImageRule) {
+	*out = *in
+	if in.Demands != nil {
+		in, out := &in.Demands, &out.Demands
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ImageRule.
+func (in *ImageRule) DeepCopy() *ImageRule {
+	if in == nil {
+		return nil
+	}
+	out := new(ImageRule)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *MeshSpec) DeepCopyInto(out *MeshSpec) {
+	*out = *in
+	if in.ExcludeOutboundPorts != nil {
+		in, out := &in.ExcludeOutboundPorts, &out.ExcludeOutboundPorts
+		*out = make([]int32, len(*in))
+		copy(*out, *in)
+	}
+	if in.ExcludeInboundPorts != nil {
+		in, out := &in.ExcludeInboundPorts, &out.ExcludeInboundPorts
+		*out = make([]int32, len(*in))
+		copy(*out, *in)
+	}
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new MeshSpec.
+func (in *MeshSpec) DeepCopy() *MeshSpec {
+	if in == nil {
+		return nil
+	}
+	out := new(MeshSpec)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *NamespaceTemplate) DeepCopyInto(out *NamespaceTemplate) {
+	*out = *in
+	if in.Labels != nil {
+		in, out := &in.Labels, &out.Labels
+		*out = make(map[string]string, len(*in))
+		for key, val := range *in {
+			(*out)[key] = val
+		}
+	}
+	if in.ResourceQuota != nil {
+		in, out := &in.ResourceQuota, &out.ResourceQuota
+		*out = new(v1.ResourceQuotaSpec)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.NetworkPolicy != nil {
+		in, out := &in.NetworkPolicy, &out.NetworkPolicy
+		*out = new(networkingv1.NetworkPolicySpec)
+		(*in).DeepCopyInto(*out)
+	}
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new NamespaceTemplate.
+func (in *NamespaceTemplate) DeepCopy() *NamespaceTemplate {
+	if in == nil {
+		return nil
+	}
+	out := new(NamespaceTemplate)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *PodLintRule) DeepCopyInto(out *PodLintRule) {
+	*out = *in
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new PodLintRule.
+func (in *PodLintRule) DeepCopy() *PodLintRule {
+	if in == nil {
+		return nil
+	}
+	out := new(PodLintRule)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *RecycleWindow) DeepCopyInto(out *RecycleWindow) {
+	*out = *in
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new RecycleWindow.
+func (in *RecycleWindow) DeepCopy() *RecycleWindow {
+	if in == nil {
+		return nil
+	}
+	out := new(RecycleWindow)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *RegistryCredentialSpec) DeepCopyInto(out *RegistryCredentialSpec) {
+	*out = *in
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new RegistryCredentialSpec.
+func (in *RegistryCredentialSpec) DeepCopy() *RegistryCredentialSpec {
+	if in == nil {
+		return nil
+	}
+	out := new(RegistryCredentialSpec)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *RoutingRule) DeepCopyInto(out *RoutingRule) {
+	*out = *in
+	if in.Languages != nil {
+		in, out := &in.Languages, &out.Languages
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new RoutingRule.
+func (in *RoutingRule) DeepCopy() *RoutingRule {
+	if in == nil {
+		return nil
+	}
+	out := new(RoutingRule)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *SharedToolsSpec) DeepCopyInto(out *SharedToolsSpec) {
+	*out = *in
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new SharedToolsSpec.
+func (in *SharedToolsSpec) DeepCopy() *SharedToolsSpec {
+	if in == nil {
+		return nil
+	}
+	out := new(SharedToolsSpec)
+	in.DeepCopyInto(out)
+	return out
+}
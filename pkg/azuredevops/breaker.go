@@ -0,0 +1,154 @@
+package azuredevops
+
+import (
+	"errors"
+	"log"
+	"sync"
+	"time"
+)
+
+// ErrCircuitOpen is returned without calling Azure DevOps while the circuit breaker is open.
+var ErrCircuitOpen = errors.New("azuredevops: circuit breaker open")
+
+const (
+	defaultBreakerThreshold = 5
+	defaultBreakerCooldown  = 30 * time.Second
+	// Every call adds a fifth of a retry to the budget, so retries stay below 20% of the traffic
+	// once the initial budget is spent.
+	retryBudgetRatio = 0.2
+	retryBudgetMax   = 10
+	maxQueuedCalls   = 100
+)
+
+// circuitBreaker stops calls after Threshold consecutive failures. After the cooldown a single
+// trial call is let through; it closes the circuit again when it succeeds.
+type circuitBreaker struct {
+	mu        sync.Mutex
+	threshold int
+	cooldown  time.Duration
+	failures  int
+	openedAt  time.Time
+	trial     bool
+}
+
+func newCircuitBreaker(threshold int, cooldown time.Duration) *circuitBreaker {
+	if threshold <= 0 {
+		threshold = defaultBreakerThreshold
+	}
+	if cooldown <= 0 {
+		cooldown = defaultBreakerCooldown
+	}
+	return &circuitBreaker{threshold: threshold, cooldown: cooldown}
+}
+
+func (b *circuitBreaker) allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.failures < b.threshold {
+		return true
+	}
+	if b.trial || time.Since(b.openedAt) < b.cooldown {
+		return false
+	}
+	b.trial = true
+	return true
+}
+
+// Records the outcome of a call and reports whether the circuit closed because of it.
+func (b *circuitBreaker) record(success bool) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	wasOpen := b.failures >= b.threshold
+	b.trial = false
+	if success {
+		b.failures = 0
+		if wasOpen {
+			log.Println("Azure DevOps is reachable again, closing the circuit")
+		}
+		return wasOpen
+	}
+
+	b.failures++
+	if b.failures >= b.threshold {
+		if !wasOpen {
+			log.Println("Azure DevOps calls keep failing, opening the circuit for", b.cooldown)
+		}
+		b.openedAt = time.Now()
+	}
+	return false
+}
+
+func (b *circuitBreaker) isOpen() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.failures >= b.threshold
+}
+
+// retryBudget limits retries to a share of the calls made, so that retries cannot multiply the
+// load on Azure DevOps while it is struggling.
+type retryBudget struct {
+	mu     sync.Mutex
+	tokens float64
+}
+
+func newRetryBudget() *retryBudget {
+	return &retryBudget{tokens: retryBudgetMax}
+}
+
+func (r *retryBudget) deposit() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.tokens += retryBudgetRatio
+	if r.tokens > retryBudgetMax {
+		r.tokens = retryBudgetMax
+	}
+}
+
+func (r *retryBudget) withdraw() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.tokens < 1 {
+		return false
+	}
+	r.tokens--
+	return true
+}
+
+type queuedCall struct {
+	method string
+	path   string
+	body   interface{}
+}
+
+// callQueue holds calls which could not be delivered until Azure DevOps is reachable again. When
+// full, the oldest call is dropped.
+type callQueue struct {
+	mu    sync.Mutex
+	calls []queuedCall
+}
+
+func (q *callQueue) push(call queuedCall) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if len(q.calls) >= maxQueuedCalls {
+		log.Println("Azure DevOps call queue full, dropping", q.calls[0].method, q.calls[0].path)
+		q.calls = q.calls[1:]
+	}
+	q.calls = append(q.calls, call)
+}
+
+func (q *callQueue) drain() []queuedCall {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	calls := q.calls
+	q.calls = nil
+	return calls
+}
+
+func (q *callQueue) len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.calls)
+}
@@ -0,0 +1,72 @@
+package azuredevops
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestCircuitShouldOpenAfterConsecutiveFailures(t *testing.T) {
+	calls := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	client := NewClient(Config{ServerUrl: server.URL, Token: "pat", Timeout: time.Second, BreakerThreshold: 2, BreakerCooldown: time.Hour})
+	client.Get("distributedtask/pools", nil)
+	client.Get("distributedtask/pools", nil)
+
+	if err := client.Get("distributedtask/pools", nil); err != ErrCircuitOpen {
+		t.Errorf("Expected the circuit to be open. Got %v", err)
+	}
+	if calls != 2 {
+		t.Errorf("Expected no call while the circuit is open. Got %d calls", calls)
+	}
+}
+
+func TestCircuitShouldCloseAfterSuccessfulTrial(t *testing.T) {
+	breaker := newCircuitBreaker(1, time.Millisecond)
+	breaker.record(false)
+	if !breaker.isOpen() {
+		t.Fatalf("Expected the circuit to be open")
+	}
+
+	time.Sleep(2 * time.Millisecond)
+	if !breaker.allow() {
+		t.Fatalf("Expected a trial call after the cooldown")
+	}
+	if breaker.allow() {
+		t.Errorf("Only one trial call must be let through")
+	}
+	if !breaker.record(true) || breaker.isOpen() {
+		t.Errorf("Expected the circuit to close after a successful trial")
+	}
+}
+
+func TestRetryBudgetShouldLimitRetries(t *testing.T) {
+	budget := &retryBudget{}
+	if budget.withdraw() {
+		t.Errorf("Empty budget must not allow a retry")
+	}
+	for i := 0; i < 5; i++ {
+		budget.deposit()
+	}
+	if !budget.withdraw() {
+		t.Errorf("Five calls must earn one retry")
+	}
+}
+
+func TestSendOrQueueShouldQueueWhileCircuitIsOpen(t *testing.T) {
+	client := NewClient(Config{ServerUrl: "http://127.0.0.1:1", Token: "pat", Timeout: time.Second, BreakerThreshold: 1, BreakerCooldown: time.Hour})
+	client.breaker.record(false)
+
+	if err := client.SendOrQueue(http.MethodPost, "distributedtask/pools/1/jobrequests", map[string]string{}); err != nil {
+		t.Errorf("Expected the call to be queued. Got %v", err)
+	}
+	if client.QueuedCalls() != 1 {
+		t.Errorf("Expected one queued call. Got %d", client.QueuedCalls())
+	}
+}
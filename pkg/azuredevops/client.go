@@ -0,0 +1,165 @@
+package azuredevops
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// ErrNotConfigured is returned by calls made without a server url.
+var ErrNotConfigured = errors.New("azuredevops: no server url configured")
+
+type Client struct {
+	config     Config
+	httpClient *http.Client
+	breaker    *circuitBreaker
+	budget     *retryBudget
+	queue      *callQueue
+}
+
+func NewClient(config Config) *Client {
+	return &Client{
+		config:     config,
+		httpClient: &http.Client{Timeout: config.Timeout, Transport: config.Transport},
+		breaker:    newCircuitBreaker(config.BreakerThreshold, config.BreakerCooldown),
+		budget:     newRetryBudget(),
+		queue:      &callQueue{},
+	}
+}
+
+func (c *Client) Config() Config {
+	return c.config
+}
+
+// Get calls the REST api at the given path below _apis and decodes the JSON response into result.
+func (c *Client) Get(path string, result interface{}) error {
+	return c.Send(http.MethodGet, path, nil, result)
+}
+
+// Send calls the REST api at the given path below _apis. Failed calls are retried as long as the
+// retry budget allows, and a call rejected with 401 is repeated with the configured username and
+// password. While the circuit breaker is open the call fails with ErrCircuitOpen.
+func (c *Client) Send(method string, path string, body interface{}, result interface{}) error {
+	if !c.config.IsConfigured() {
+		return ErrNotConfigured
+	}
+	if !c.breaker.allow() {
+		return ErrCircuitOpen
+	}
+	c.budget.deposit()
+
+	var payload []byte
+	if body != nil {
+		payload, _ = json.Marshal(body)
+	}
+
+	var err error
+	var retry bool
+	for attempt := 0; attempt <= c.config.Retries; attempt++ {
+		if attempt > 0 {
+			if !c.budget.withdraw() {
+				log.Println("Retry budget exhausted, not retrying Azure DevOps call", method, path)
+				break
+			}
+			time.Sleep(time.Duration(attempt) * 500 * time.Millisecond)
+			log.Println("Retrying Azure DevOps call", method, path, "attempt", attempt)
+		}
+
+		retry, err = c.send(method, path, payload, result)
+		if err == nil || !retry {
+			break
+		}
+	}
+
+	// Client errors mean Azure DevOps is up, only transient failures count against the circuit
+	if c.breaker.record(err == nil || !retry) {
+		go c.flushQueue()
+	}
+	return err
+}
+
+// SendOrQueue sends a call whose result is not needed, like a notification. When Azure DevOps
+// cannot be reached the call is queued and sent again once the circuit closes.
+func (c *Client) SendOrQueue(method string, path string, body interface{}) error {
+	err := c.Send(method, path, body, nil)
+	if err == ErrCircuitOpen || (err != nil && c.breaker.isOpen()) {
+		log.Println("Queueing Azure DevOps call", method, path, "until the service is reachable")
+		c.queue.push(queuedCall{method: method, path: path, body: body})
+		return nil
+	}
+	return err
+}
+
+// QueuedCalls returns the number of calls waiting to be sent.
+func (c *Client) QueuedCalls() int {
+	return c.queue.len()
+}
+
+func (c *Client) flushQueue() {
+	for _, call := range c.queue.drain() {
+		if err := c.SendOrQueue(call.method, call.path, call.body); err != nil {
+			log.Println("Dropping queued Azure DevOps call", call.method, call.path, err)
+		}
+	}
+}
+
+func (c *Client) send(method string, path string, payload []byte, result interface{}) (bool, error) {
+	resp, err := c.do(method, path, payload, false)
+	if err == nil && resp.StatusCode == http.StatusUnauthorized && c.config.Username != "" {
+		resp.Body.Close()
+		log.Println("Azure DevOps rejected the token, falling back to basic authentication")
+		resp, err = c.do(method, path, payload, true)
+	}
+	if err != nil {
+		return true, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		message, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		err = fmt.Errorf("azuredevops: %s %s returned %d: %s", method, path, resp.StatusCode, strings.TrimSpace(string(message)))
+		return resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests, err
+	}
+
+	if result != nil {
+		return false, json.NewDecoder(resp.Body).Decode(result)
+	}
+	return false, nil
+}
+
+func (c *Client) do(method string, path string, payload []byte, useBasic bool) (*http.Response, error) {
+	req, err := http.NewRequest(method, c.apiUrl(path), bytes.NewReader(payload))
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Set("Accept", "application/json")
+	if payload != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	if useBasic || c.config.Token == "" {
+		if c.config.Username != "" {
+			req.SetBasicAuth(c.config.Username, c.config.Password)
+		}
+	} else {
+		req.SetBasicAuth("", c.config.Token)
+	}
+
+	return c.httpClient.Do(req)
+}
+
+func (c *Client) apiUrl(path string) string {
+	separator := "?"
+	if strings.Contains(path, "?") {
+		separator = "&"
+	}
+	return c.config.CollectionUrl() + "/_apis/" + strings.TrimPrefix(path, "/") + separator + "api-version=" + c.config.ApiVersion
+}
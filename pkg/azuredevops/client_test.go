@@ -0,0 +1,89 @@
+package azuredevops
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestCollectionUrlShouldAppendCollectionForOnPremisesServers(t *testing.T) {
+	config := Config{ServerUrl: "https://tfs.contoso.com/tfs", Collection: "DefaultCollection"}
+
+	if !config.IsOnPremises() {
+		t.Errorf("Server should be detected as on-premises")
+	}
+	if url := config.CollectionUrl(); url != "https://tfs.contoso.com/tfs/DefaultCollection" {
+		t.Errorf("Unexpected collection url %s", url)
+	}
+
+	config.ServerUrl = "https://tfs.contoso.com/tfs/DefaultCollection"
+	if url := config.CollectionUrl(); url != "https://tfs.contoso.com/tfs/DefaultCollection" {
+		t.Errorf("Collection must not be appended twice. Got %s", url)
+	}
+}
+
+func TestIsOnPremisesShouldBeFalseForHostedOrganizations(t *testing.T) {
+	for _, serverUrl := range []string{"https://dev.azure.com/contoso", "https://contoso.visualstudio.com"} {
+		if (Config{ServerUrl: serverUrl}).IsOnPremises() {
+			t.Errorf("%s should not be detected as on-premises", serverUrl)
+		}
+	}
+}
+
+func TestClientShouldFallBackToBasicAuthentication(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, _, _ := r.BasicAuth()
+		if user != "builder" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.Write([]byte(`{"count":3}`))
+	}))
+	defer server.Close()
+
+	client := NewClient(Config{ServerUrl: server.URL, Token: "pat", Username: "builder", Password: "secret", Timeout: time.Second})
+
+	var result struct{ Count int }
+	if err := client.Get("distributedtask/pools", &result); err != nil || result.Count != 3 {
+		t.Errorf("Expected basic authentication fallback to succeed. Got %v", err)
+	}
+}
+
+func TestClientShouldRetryServerErrors(t *testing.T) {
+	calls := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		if calls < 2 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte(`{}`))
+	}))
+	defer server.Close()
+
+	client := NewClient(Config{ServerUrl: server.URL, Token: "pat", Retries: 2, Timeout: time.Second})
+	if err := client.Get("distributedtask/pools", nil); err != nil {
+		t.Errorf("Expected call to succeed after retry. Got %v", err)
+	}
+	if calls != 2 {
+		t.Errorf("Expected 2 calls. Got %d", calls)
+	}
+}
+
+func TestClientShouldNotRetryClientErrors(t *testing.T) {
+	calls := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer server.Close()
+
+	client := NewClient(Config{ServerUrl: server.URL, Token: "pat", Retries: 2, Timeout: time.Second})
+	if err := client.Get("distributedtask/pools/1", nil); err == nil {
+		t.Errorf("Expected call to fail")
+	}
+	if calls != 1 {
+		t.Errorf("Expected a single call. Got %d", calls)
+	}
+}
@@ -0,0 +1,113 @@
+// Package azuredevops is a small REST client for the Azure DevOps services the provider calls,
+// working against both dev.azure.com organizations and on-premises Azure DevOps Server collections.
+package azuredevops
+
+import (
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	hostedApiVersion  = "5.1"
+	onPremApiVersion  = "4.1"
+	hostedTimeout     = 10 * time.Second
+	onPremTimeout     = 30 * time.Second
+	hostedRetries     = 2
+	onPremRetries     = 4
+	defaultCollection = "DefaultCollection"
+)
+
+type Config struct {
+	// ServerUrl is the organization url (https://dev.azure.com/org) or the base url of an
+	// on-premises server (https://tfs.contoso.com/tfs).
+	ServerUrl string
+	// Collection is appended to ServerUrl for on-premises servers.
+	Collection string
+	// Token is a personal access token, sent with basic authentication.
+	Token string
+	// Username and Password are used when the server rejects the token, e.g. on-premises
+	// servers which only have basic authentication enabled.
+	Username   string
+	Password   string
+	ApiVersion string
+	Timeout    time.Duration
+	Retries    int
+	// The circuit breaker opens after BreakerThreshold consecutive failures and lets a trial call
+	// through after BreakerCooldown.
+	BreakerThreshold int
+	BreakerCooldown  time.Duration
+	// Transport carries the calls, http.DefaultTransport when nil.
+	Transport http.RoundTripper
+}
+
+// Reads the client configuration from the environment. Timeouts, retries and the api-version
+// default to values suitable for the kind of server the url points to.
+func ConfigFromEnvironment() Config {
+	config := Config{
+		ServerUrl:  strings.TrimSuffix(os.Getenv("AZURE_DEVOPS_URL"), "/"),
+		Collection: strings.Trim(os.Getenv("AZURE_DEVOPS_COLLECTION"), "/"),
+		Token:      os.Getenv("AZURE_DEVOPS_PAT"),
+		Username:   os.Getenv("AZURE_DEVOPS_USERNAME"),
+		Password:   os.Getenv("AZURE_DEVOPS_PASSWORD"),
+		ApiVersion: os.Getenv("AZURE_DEVOPS_API_VERSION"),
+	}
+
+	if config.IsOnPremises() {
+		config.Timeout = onPremTimeout
+		config.Retries = onPremRetries
+		if config.ApiVersion == "" {
+			config.ApiVersion = onPremApiVersion
+		}
+		if config.Collection == "" {
+			config.Collection = defaultCollection
+		}
+	} else {
+		config.Timeout = hostedTimeout
+		config.Retries = hostedRetries
+		if config.ApiVersion == "" {
+			config.ApiVersion = hostedApiVersion
+		}
+	}
+
+	if seconds, err := strconv.Atoi(os.Getenv("AZURE_DEVOPS_TIMEOUT_SECONDS")); err == nil && seconds > 0 {
+		config.Timeout = time.Duration(seconds) * time.Second
+	}
+	if retries, err := strconv.Atoi(os.Getenv("AZURE_DEVOPS_RETRIES")); err == nil && retries >= 0 {
+		config.Retries = retries
+	}
+	if threshold, err := strconv.Atoi(os.Getenv("AZURE_DEVOPS_BREAKER_THRESHOLD")); err == nil && threshold > 0 {
+		config.BreakerThreshold = threshold
+	}
+	if seconds, err := strconv.Atoi(os.Getenv("AZURE_DEVOPS_BREAKER_COOLDOWN_SECONDS")); err == nil && seconds > 0 {
+		config.BreakerCooldown = time.Duration(seconds) * time.Second
+	}
+	return config
+}
+
+func (c Config) IsConfigured() bool {
+	return c.ServerUrl != ""
+}
+
+// Servers outside of dev.azure.com and *.visualstudio.com are treated as on-premises.
+func (c Config) IsOnPremises() bool {
+	serverUrl, err := url.Parse(c.ServerUrl)
+	if err != nil || serverUrl.Host == "" {
+		return false
+	}
+
+	host := strings.ToLower(serverUrl.Hostname())
+	return host != "dev.azure.com" && !strings.HasSuffix(host, ".visualstudio.com")
+}
+
+// Returns the url REST calls are made against, including the collection path for on-premises servers.
+func (c Config) CollectionUrl() string {
+	serverUrl := strings.TrimSuffix(c.ServerUrl, "/")
+	if c.Collection == "" || strings.HasSuffix(strings.ToLower(serverUrl), "/"+strings.ToLower(c.Collection)) {
+		return serverUrl
+	}
+	return serverUrl + "/" + c.Collection
+}
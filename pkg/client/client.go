@@ -0,0 +1,235 @@
+// Package client calls the pool provider endpoints, so tools do not have to sign and send the
+// requests themselves. Requests are signed with the shared secret of the provider (VSTS_SECRET).
+package client
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha512"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	signatureHeader   = "X-Azure-Signature"
+	defaultTimeout    = 30 * time.Second
+	defaultRetries    = 2
+	defaultRetryDelay = time.Second
+)
+
+// APIError is returned for responses with an error status code.
+type APIError struct {
+	StatusCode int
+	Message    string
+}
+
+func (e *APIError) Error() string {
+	return fmt.Sprintf("poolprovider: %d %s", e.StatusCode, e.Message)
+}
+
+type Client struct {
+	baseUrl    string
+	secret     string
+	httpClient *http.Client
+	retries    int
+	retryDelay time.Duration
+}
+
+type Option func(*Client)
+
+// WithHTTPClient replaces the default http client, e.g. to set up TLS.
+func WithHTTPClient(httpClient *http.Client) Option {
+	return func(c *Client) {
+		c.httpClient = httpClient
+	}
+}
+
+// WithRetries sets how often a failed call is repeated and the delay before the first retry. The
+// delay doubles with every retry, unless the provider sends a Retry-After header.
+func WithRetries(retries int, delay time.Duration) Option {
+	return func(c *Client) {
+		c.retries = retries
+		c.retryDelay = delay
+	}
+}
+
+// New returns a client for the provider at baseUrl, e.g. https://poolprovider.contoso.com.
+func New(baseUrl string, secret string, options ...Option) *Client {
+	c := &Client{
+		baseUrl:    strings.TrimSuffix(baseUrl, "/"),
+		secret:     secret,
+		httpClient: &http.Client{Timeout: defaultTimeout},
+		retries:    defaultRetries,
+		retryDelay: defaultRetryDelay,
+	}
+	for _, option := range options {
+		option(c)
+	}
+	return c
+}
+
+// Acquire asks the provider for an agent. Acquire requests are deduplicated by agent id, so
+// retrying them is safe.
+func (c *Client) Acquire(ctx context.Context, request AgentRequest) (*AgentProvisionResponse, error) {
+	var response AgentProvisionResponse
+	if err := c.do(ctx, http.MethodPost, "/acquire", request, &response); err != nil {
+		return nil, err
+	}
+	return &response, nil
+}
+
+// Release removes the agent pod and secret of the agent.
+func (c *Client) Release(ctx context.Context, request ReleaseAgentRequest) (*ReleaseResponse, error) {
+	var response ReleaseResponse
+	if err := c.do(ctx, http.MethodPost, "/release", request, &response); err != nil {
+		return nil, err
+	}
+	return &response, nil
+}
+
+// Status returns the state of the agent pod of the agent.
+func (c *Client) Status(ctx context.Context, agentId string) (*AgentStatus, error) {
+	var status AgentStatus
+	if err := c.do(ctx, http.MethodGet, "/status?agentId="+url.QueryEscape(agentId), nil, &status); err != nil {
+		return nil, err
+	}
+	return &status, nil
+}
+
+// Pools returns the state of every agent pool, reading all pages of GET /pools.
+func (c *Client) Pools(ctx context.Context) (*PoolStateSnapshot, error) {
+	var snapshot PoolStateSnapshot
+	for next := ""; ; {
+		var page PoolStateSnapshot
+		if err := c.do(ctx, http.MethodGet, "/pools?continue="+url.QueryEscape(next), nil, &page); err != nil {
+			return nil, err
+		}
+		snapshot.UpdatedAt = page.UpdatedAt
+		snapshot.Pools = append(snapshot.Pools, page.Pools...)
+		if next = page.Continue; next == "" {
+			return &snapshot, nil
+		}
+	}
+}
+
+// PoolAgents returns the agents of the pool, by name or Azure DevOps pool id, reading all pages.
+func (c *Client) PoolAgents(ctx context.Context, pool string) ([]AgentInventory, error) {
+	agents := []AgentInventory{}
+	for next := ""; ; {
+		var page AgentInventoryPage
+		if err := c.do(ctx, http.MethodGet, "/pools/"+url.PathEscape(pool)+"/agents?continue="+url.QueryEscape(next), nil, &page); err != nil {
+			return nil, err
+		}
+		agents = append(agents, page.Agents...)
+		if next = page.Continue; next == "" {
+			return agents, nil
+		}
+	}
+}
+
+// Stats returns the load of the provider replica which answered the call.
+func (c *Client) Stats(ctx context.Context) (*ProviderStats, error) {
+	var stats ProviderStats
+	if err := c.do(ctx, http.MethodGet, "/stats", nil, &stats); err != nil {
+		return nil, err
+	}
+	return &stats, nil
+}
+
+// Sends the request and decodes the response into result. Network errors, 429 and 5xx responses
+// are retried until the retries are used up or the context is done.
+func (c *Client) do(ctx context.Context, method string, path string, body interface{}, result interface{}) error {
+	var payload []byte
+	if body != nil {
+		var err error
+		if payload, err = json.Marshal(body); err != nil {
+			return err
+		}
+	}
+
+	delay := c.retryDelay
+	for attempt := 0; ; attempt++ {
+		wait, err := c.send(ctx, method, path, payload, result)
+		if err == nil || wait < 0 || attempt >= c.retries {
+			return err
+		}
+
+		if wait == 0 {
+			wait = delay
+			delay *= 2
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(wait):
+		}
+	}
+}
+
+// Makes a single call. The returned duration is negative when the call must not be retried, and
+// holds the Retry-After delay of the provider when it sent one.
+func (c *Client) send(ctx context.Context, method string, path string, payload []byte, result interface{}) (time.Duration, error) {
+	req, err := http.NewRequestWithContext(ctx, method, c.baseUrl+path, bytes.NewReader(payload))
+	if err != nil {
+		return -1, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(signatureHeader, sign(c.secret, payload))
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		if ctx.Err() != nil {
+			return -1, ctx.Err()
+		}
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	data, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode >= 400 {
+		apiErr := &APIError{StatusCode: resp.StatusCode, Message: errorMessage(data)}
+		if resp.StatusCode != http.StatusTooManyRequests && resp.StatusCode < 500 {
+			return -1, apiErr
+		}
+		seconds, _ := strconv.Atoi(resp.Header.Get("Retry-After"))
+		return time.Duration(seconds) * time.Second, apiErr
+	}
+
+	if result != nil && len(data) > 0 {
+		if err := json.Unmarshal(data, result); err != nil {
+			return -1, err
+		}
+	}
+	return -1, nil
+}
+
+func sign(secret string, payload []byte) string {
+	mac := hmac.New(sha512.New, []byte(secret))
+	mac.Write(payload)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// The provider answers errors with {"Error": "..."}, and failed provisioning with ErrorMessage
+func errorMessage(data []byte) string {
+	var body struct {
+		Error        string
+		ErrorMessage string
+	}
+	if json.Unmarshal(data, &body) == nil {
+		if body.Error != "" {
+			return body.Error
+		}
+		if body.ErrorMessage != "" {
+			return body.ErrorMessage
+		}
+	}
+	return strings.TrimSpace(string(data))
+}
@@ -0,0 +1,93 @@
+package client
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestAcquireShouldSignTheRequestBody(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		if r.URL.Path != "/acquire" || r.Header.Get(signatureHeader) != sign("secret", body) {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte(`{"Accepted":true,"ResponseType":"Success"}`))
+	}))
+	defer server.Close()
+
+	response, err := New(server.URL, "secret").Acquire(context.Background(), AgentRequest{AgentId: "1"})
+	if err != nil || !response.Accepted {
+		t.Errorf("Expected the agent to be accepted. Got %v, %v", response, err)
+	}
+}
+
+func TestCallsShouldRetryServerErrors(t *testing.T) {
+	calls := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		if calls < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte(`{"CreationConcurrencyLimit":4}`))
+	}))
+	defer server.Close()
+
+	stats, err := New(server.URL, "secret", WithRetries(2, time.Millisecond)).Stats(context.Background())
+	if err != nil || stats.CreationConcurrencyLimit != 4 || calls != 3 {
+		t.Errorf("Expected the third call to succeed. Got %v, %v after %d calls", stats, err, calls)
+	}
+}
+
+func TestCallsShouldNotRetryClientErrors(t *testing.T) {
+	calls := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte(`{"Error":"bad signature"}`))
+	}))
+	defer server.Close()
+
+	_, err := New(server.URL, "wrong", WithRetries(2, time.Millisecond)).Status(context.Background(), "1")
+	apiErr, ok := err.(*APIError)
+	if !ok || apiErr.StatusCode != http.StatusForbidden || apiErr.Message != "bad signature" || calls != 1 {
+		t.Errorf("Expected a single failed call. Got %v after %d calls", err, calls)
+	}
+}
+
+func TestCallsShouldStopWhenContextIsDone(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer server.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+
+	_, err := New(server.URL, "secret", WithRetries(10, time.Second)).Pools(ctx)
+	if err != context.DeadlineExceeded {
+		t.Errorf("Expected the deadline to end the retries. Got %v", err)
+	}
+}
+
+func TestPoolsShouldReadEveryPage(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("continue") == "" {
+			w.Write([]byte(`{"Pools":[{"Name":"a"}],"Continue":"1"}`))
+			return
+		}
+		w.Write([]byte(`{"Pools":[{"Name":"b"}]}`))
+	}))
+	defer server.Close()
+
+	snapshot, err := New(server.URL, "secret").Pools(context.Background())
+	if err != nil || len(snapshot.Pools) != 2 || snapshot.Pools[1].Name != "b" {
+		t.Errorf("Expected the pools of both pages. Got %v, %v", snapshot, err)
+	}
+}
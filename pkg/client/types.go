@@ -0,0 +1,106 @@
+package client
+
+import "time"
+
+// The types mirror the JSON contracts of the provider endpoints.
+
+type AgentConfigurationData struct {
+	AgentSettings     map[string]string
+	AgentCredentials  AgentCredentials
+	AgentVersion      string
+	AgentDownloadUrls map[string]string
+}
+
+type AgentCredentials struct {
+	Scheme string
+	Data   map[string]string
+}
+
+type AgentRequest struct {
+	AgentId                 string
+	AgentPool               string
+	AccountId               string
+	AuthenticationToken     string
+	FailRequestUrl          string
+	AppendRequestMessageUrl string
+	IsScheduled             bool
+	IsPublic                bool
+	AgentConfiguration      AgentConfigurationData
+	AgentSpec               string
+	SourceBranch            string
+	Demands                 []string
+	JobId                   string
+	Definition              string
+	Repository              string
+}
+
+type AgentProvisionResponse struct {
+	Accepted             bool
+	ResponseType         string
+	ErrorMessage         string
+	Warnings             []string
+	QueuePosition        int
+	EstimatedWaitSeconds int
+}
+
+type ReleaseAgentRequest struct {
+	AgentId   string
+	AccountId string
+	AgentPool string
+	AgentData string
+}
+
+type ReleaseResponse struct {
+	Status  string
+	Message string
+}
+
+type AgentStatus struct {
+	AgentId   string
+	Found     bool
+	Namespace string
+	PodName   string
+	Phase     string
+	Ready     bool
+}
+
+type PoolState struct {
+	Name                  string
+	WarmPoolTarget        int
+	StandbyPods           int
+	ActiveAgents          int
+	PendingJobs           int
+	StartupLatencySeconds int
+}
+
+type PoolStateSnapshot struct {
+	UpdatedAt time.Time
+	Pools     []PoolState
+	// Token of the next page of GET /pools, empty on the last page
+	Continue string `json:",omitempty"`
+}
+
+type AgentInventory struct {
+	AgentId       string
+	Namespace     string
+	PodName       string
+	Phase         string
+	Ready         bool
+	AgeSeconds    int
+	JobId         string
+	State         string
+	LastHeartbeat *time.Time
+}
+
+type AgentInventoryPage struct {
+	Pool     string
+	Agents   []AgentInventory
+	Continue string
+}
+
+type ProviderStats struct {
+	CreationsWaiting         int
+	CreationConcurrencyLimit int
+	CreationLatencySeconds   int
+	IsLeader                 bool
+}
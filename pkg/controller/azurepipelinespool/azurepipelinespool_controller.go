@@ -82,6 +82,14 @@ func add(mgr manager.Manager, r reconcile.Reconciler) error {
 		return err
 	}
 
+	err = c.Watch(&source.Kind{Type: &appsv1.DaemonSet{}}, &handler.EnqueueRequestForOwner{
+		IsController: true,
+		OwnerType:    &devv1alpha1.AzurePipelinesPool{},
+	})
+	if err != nil {
+		return err
+	}
+
 	return nil
 }
 
@@ -262,6 +270,36 @@ func (r *ReconcileAzurePipelinesPool) Reconcile(request reconcile.Request) (reco
 	}
 
 	reqLogger.Info("Skip reconcile: Buildkit Service already exists", "BuildkitService.Namespace", foundBuildkitService.Namespace, "BuildKitService.Name", foundBuildkitService.Name)
+
+	// Materialize the shared toolsets of the pools which run slim agent images
+	for i := range instance.Spec.AgentPools {
+		pool := &instance.Spec.AgentPools[i]
+		if pool.SharedTools == nil {
+			continue
+		}
+		if err := r.reconcileToolsDaemonSet(instance, pool); err != nil {
+			return reconcile.Result{}, err
+		}
+	}
+
+	// Keep the images of the pools which ask for it pulled on their nodes, and stop pulling the
+	// images of the others
+	prepulling := map[string]bool{}
+	for i := range instance.Spec.AgentPools {
+		pool := &instance.Spec.AgentPools[i]
+		if !pool.PrepullImages {
+			continue
+		}
+		for _, daemonSet := range prepullDaemonSets(instance, pool) {
+			prepulling[daemonSet.Name] = true
+			if err := r.reconcilePrepullDaemonSet(instance, daemonSet); err != nil {
+				return reconcile.Result{}, err
+			}
+		}
+	}
+	if err := r.prunePrepullDaemonSets(instance, prepulling); err != nil {
+		return reconcile.Result{}, err
+	}
 	return reconcile.Result{}, nil
 }
 
@@ -319,6 +357,12 @@ func AddnewDeploymentForCR(cr *devv1alpha1.AzurePipelinesPool) *appsv1.Deploymen
 		"app":  cr.Name,
 		"tier": "frontend",
 	}
+	optional := true
+	// One replica unless more are asked for, they elect a leader for the background work
+	var replicas *int32
+	if cr.Spec.WebserverReplicaCount > 0 {
+		replicas = &cr.Spec.WebserverReplicaCount
+	}
 	return &appsv1.Deployment{
 		ObjectMeta: metav1.ObjectMeta{
 			Name:      "azurepipelinepod",
@@ -326,6 +370,7 @@ func AddnewDeploymentForCR(cr *devv1alpha1.AzurePipelinesPool) *appsv1.Deploymen
 			Labels:    labels,
 		},
 		Spec: appsv1.DeploymentSpec{
+			Replicas: replicas,
 			Selector: &metav1.LabelSelector{
 				MatchLabels: labels,
 			},
@@ -353,6 +398,21 @@ func AddnewDeploymentForCR(cr *devv1alpha1.AzurePipelinesPool) *appsv1.Deploymen
 									Value: cr.Namespace,
 								},
 							},
+							// Optional settings of the webserver, e.g. the Azure DevOps server it talks to
+							EnvFrom: []corev1.EnvFromSource{
+								{
+									ConfigMapRef: &corev1.ConfigMapEnvSource{
+										LocalObjectReference: corev1.LocalObjectReference{Name: "poolprovider-config"},
+										Optional:             &optional,
+									},
+								},
+								{
+									SecretRef: &corev1.SecretEnvSource{
+										LocalObjectReference: corev1.LocalObjectReference{Name: "poolprovider-secrets"},
+										Optional:             &optional,
+									},
+								},
+							},
 							Ports: []corev1.ContainerPort{
 								{
 									ContainerPort: 8080,
@@ -0,0 +1,201 @@
+package azurepipelinespool
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"strconv"
+
+	devv1alpha1 "github.com/microsoft/poolprovider-for-k8s/pkg/apis/dev/v1alpha1"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+)
+
+const (
+	prepullRole = "image-prepull"
+	// Hash of the template the DaemonSet was built from
+	prepullTemplateAnnotation = "poolprovider/template-hash"
+
+	osLabel     = "kubernetes.io/os"
+	betaOsLabel = "beta.kubernetes.io/os"
+	// The pause image of the Linux DaemonSets has no Windows variant
+	windowsPauseImage = "mcr.microsoft.com/oss/kubernetes/pause:3.6"
+)
+
+// prepullDaemonSets returns the DaemonSets pulling the images of the pool onto its nodes, one for
+// the OS of the pool and, when the pool serves Windows agents as well, one for Windows.
+func prepullDaemonSets(cr *devv1alpha1.AzurePipelinesPool, pool *devv1alpha1.AgentPoolSpec) []*appsv1.DaemonSet {
+	daemonSets := []*appsv1.DaemonSet{AddnewPrepullDaemonSetForCR(cr, pool, devv1alpha1.PoolOS(pool))}
+	if pool.WindowsSpec != nil && devv1alpha1.PoolOS(pool) != devv1alpha1.OSWindows {
+		daemonSets = append(daemonSets, AddnewPrepullDaemonSetForCR(cr, pool, devv1alpha1.OSWindows))
+	}
+	return daemonSets
+}
+
+// reconcilePrepullDaemonSet creates the DaemonSet pulling the images of the pool onto its nodes, and
+// updates it when its template changes.
+func (r *ReconcileAzurePipelinesPool) reconcilePrepullDaemonSet(cr *devv1alpha1.AzurePipelinesPool, daemonSet *appsv1.DaemonSet) error {
+	if err := controllerutil.SetControllerReference(cr, daemonSet, r.Scheme); err != nil {
+		return err
+	}
+
+	found := &appsv1.DaemonSet{}
+	err := r.Client.Get(context.TODO(), types.NamespacedName{Name: daemonSet.Name, Namespace: daemonSet.Namespace}, found)
+	if err != nil && errors.IsNotFound(err) {
+		log.Info("Creating a new image prepull DaemonSet", "DaemonSet.Namespace", daemonSet.Namespace, "DaemonSet.Name", daemonSet.Name)
+		return r.Client.Create(context.TODO(), daemonSet)
+	} else if err != nil {
+		return err
+	}
+
+	// The template read back carries the defaults of the API server, the hash of the template it
+	// was built from tells whether it changed
+	if found.Annotations[prepullTemplateAnnotation] == daemonSet.Annotations[prepullTemplateAnnotation] {
+		return nil
+	}
+	log.Info("Updating the image prepull DaemonSet", "DaemonSet.Namespace", found.Namespace, "DaemonSet.Name", found.Name)
+	if found.Annotations == nil {
+		found.Annotations = map[string]string{}
+	}
+	found.Annotations[prepullTemplateAnnotation] = daemonSet.Annotations[prepullTemplateAnnotation]
+	found.Spec.Template = daemonSet.Spec.Template
+	return r.Client.Update(context.TODO(), found)
+}
+
+// prunePrepullDaemonSets deletes the image prepull DaemonSets of the CR which are not wanted any
+// more, of pools which stopped prepulling their images or were removed.
+func (r *ReconcileAzurePipelinesPool) prunePrepullDaemonSets(cr *devv1alpha1.AzurePipelinesPool, wanted map[string]bool) error {
+	daemonSets := &appsv1.DaemonSetList{}
+	err := r.Client.List(context.TODO(), daemonSets, client.InNamespace(cr.Namespace), client.MatchingLabels{"app": cr.Name, "role": prepullRole})
+	if err != nil {
+		return err
+	}
+	for i := range daemonSets.Items {
+		daemonSet := &daemonSets.Items[i]
+		if wanted[daemonSet.Name] {
+			continue
+		}
+		log.Info("Deleting the image prepull DaemonSet", "DaemonSet.Namespace", daemonSet.Namespace, "DaemonSet.Name", daemonSet.Name)
+		if err := r.Client.Delete(context.TODO(), daemonSet); err != nil && !errors.IsNotFound(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// poolImages returns the images the agent pods of the pool running the OS may run, the containers
+// of its template for the OS and the images its image rules pick, each once. Image rules apply to
+// the agents of the OS the pool is set to.
+func poolImages(pool *devv1alpha1.AgentPoolSpec, os string) []string {
+	var images []string
+	seen := map[string]bool{}
+	add := func(image string) {
+		if image != "" && !seen[image] {
+			seen[image] = true
+			images = append(images, image)
+		}
+	}
+	if spec := devv1alpha1.PodSpecForOS(pool, os); spec != nil {
+		for _, container := range spec.InitContainers {
+			add(container.Image)
+		}
+		for _, container := range spec.Containers {
+			add(container.Image)
+		}
+	}
+	if os == devv1alpha1.PoolOS(pool) {
+		for _, rule := range pool.ImageRules {
+			add(rule.Image)
+		}
+	}
+	return images
+}
+
+// AddnewPrepullDaemonSetForCR returns a DaemonSet which pulls the images of the agents of the pool
+// running the OS onto every node they can run on, so new agents do not wait for the image pull.
+// Every image runs as an init container which exits right away; the images need a shell, as the
+// agent images do.
+func AddnewPrepullDaemonSetForCR(cr *devv1alpha1.AzurePipelinesPool, pool *devv1alpha1.AgentPoolSpec, os string) *appsv1.DaemonSet {
+	labels := map[string]string{
+		"app":  cr.Name,
+		"role": prepullRole,
+		"pool": pool.PoolName,
+	}
+	name := "image-prepull-" + pool.PoolName
+	if os != devv1alpha1.PoolOS(pool) {
+		name += "-" + os
+	}
+	spec := devv1alpha1.PodSpecForOS(pool, os)
+
+	command, pause := []string{"sh", "-c", "exit 0"}, pauseImage
+	windows := os == devv1alpha1.OSWindows
+	if windows || (spec != nil && (spec.NodeSelector[osLabel] == "windows" || spec.NodeSelector[betaOsLabel] == "windows")) {
+		command, pause = []string{"cmd", "/c", "exit 0"}, windowsPauseImage
+	}
+
+	podSpec := corev1.PodSpec{
+		// Keeps the pod running, so the DaemonSet does not pull the images again
+		Containers: []corev1.Container{
+			{
+				Name:  "pause",
+				Image: pause,
+			},
+		},
+	}
+	for i, image := range poolImages(pool, os) {
+		podSpec.InitContainers = append(podSpec.InitContainers, corev1.Container{
+			Name:    "prepull-" + strconv.Itoa(i),
+			Image:   image,
+			Command: command,
+		})
+	}
+
+	// Run on the same nodes as the agents of the pool running the OS, which are pinned to the nodes
+	// of their OS when the pool sets OS or WindowsSpec
+	if spec != nil {
+		podSpec.NodeSelector = spec.NodeSelector
+		podSpec.Tolerations = spec.Tolerations
+		podSpec.Affinity = spec.Affinity
+		podSpec.ImagePullSecrets = spec.ImagePullSecrets
+	}
+	if (windows || pool.OS != "" || pool.WindowsSpec != nil) && podSpec.NodeSelector[osLabel] == "" {
+		nodeSelector := map[string]string{osLabel: os}
+		for key, value := range podSpec.NodeSelector {
+			nodeSelector[key] = value
+		}
+		podSpec.NodeSelector = nodeSelector
+	}
+
+	template := corev1.PodTemplateSpec{
+		ObjectMeta: metav1.ObjectMeta{
+			Labels: labels,
+		},
+		Spec: podSpec,
+	}
+	return &appsv1.DaemonSet{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        name,
+			Namespace:   cr.Namespace,
+			Labels:      labels,
+			Annotations: map[string]string{prepullTemplateAnnotation: templateHash(&template)},
+		},
+		Spec: appsv1.DaemonSetSpec{
+			Selector: &metav1.LabelSelector{
+				MatchLabels: labels,
+			},
+			Template: template,
+		},
+	}
+}
+
+func templateHash(template *corev1.PodTemplateSpec) string {
+	data, _ := json.Marshal(template)
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,84 @@
+package azurepipelinespool
+
+import (
+	"reflect"
+	"testing"
+
+	devv1alpha1 "github.com/microsoft/poolprovider-for-k8s/pkg/apis/dev/v1alpha1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func prepullPool() *devv1alpha1.AgentPoolSpec {
+	return &devv1alpha1.AgentPoolSpec{
+		PoolName:      "linux",
+		PrepullImages: true,
+		PoolSpec: &corev1.PodSpec{
+			InitContainers: []corev1.Container{{Name: "init", Image: "busybox"}},
+			Containers:     []corev1.Container{{Name: "agent", Image: "agent:linux"}},
+			NodeSelector:   map[string]string{"agentpool": "builds"},
+		},
+		WindowsSpec: &corev1.PodSpec{
+			Containers: []corev1.Container{{Name: "agent", Image: "agent:windows"}},
+		},
+		ImageRules: []devv1alpha1.ImageRule{
+			{Demands: []string{"node"}, Image: "agent:node"},
+			{Demands: []string{"java"}, Image: "agent:linux"},
+		},
+	}
+}
+
+func TestPoolImagesShouldListTheImagesOfTheOSOnce(t *testing.T) {
+	pool := prepullPool()
+
+	if images := poolImages(pool, devv1alpha1.OSLinux); !reflect.DeepEqual(images, []string{"busybox", "agent:linux", "agent:node"}) {
+		t.Errorf("Expected the images of the pod spec and the image rules. Got %v", images)
+	}
+	if images := poolImages(pool, devv1alpha1.OSWindows); !reflect.DeepEqual(images, []string{"agent:windows"}) {
+		t.Errorf("Expected the images of the Windows spec. Got %v", images)
+	}
+}
+
+func TestPrepullDaemonSetsShouldCoverTheWindowsSpec(t *testing.T) {
+	cr := &devv1alpha1.AzurePipelinesPool{ObjectMeta: metav1.ObjectMeta{Name: "pools", Namespace: "azuredevops"}}
+
+	daemonSets := prepullDaemonSets(cr, prepullPool())
+	if len(daemonSets) != 2 || daemonSets[0].Name != "image-prepull-linux" || daemonSets[1].Name != "image-prepull-linux-windows" {
+		t.Fatalf("Expected a DaemonSet for Linux and one for Windows. Got %v", daemonSets)
+	}
+
+	linux := daemonSets[0].Spec.Template.Spec
+	if linux.NodeSelector[osLabel] != devv1alpha1.OSLinux || linux.NodeSelector["agentpool"] != "builds" {
+		t.Errorf("Expected the Linux DaemonSet to run on the Linux nodes of the pool. Got %v", linux.NodeSelector)
+	}
+	if len(linux.InitContainers) != 3 || linux.Containers[0].Image != pauseImage || linux.InitContainers[0].Command[0] != "sh" {
+		t.Errorf("Expected the Linux DaemonSet to pull the Linux images. Got %v", linux)
+	}
+
+	windows := daemonSets[1].Spec.Template.Spec
+	if windows.NodeSelector[osLabel] != devv1alpha1.OSWindows {
+		t.Errorf("Expected the Windows DaemonSet to run on Windows nodes. Got %v", windows.NodeSelector)
+	}
+	if len(windows.InitContainers) != 1 || windows.Containers[0].Image != windowsPauseImage || windows.InitContainers[0].Command[0] != "cmd" {
+		t.Errorf("Expected the Windows DaemonSet to pull the Windows images. Got %v", windows)
+	}
+}
+
+func TestPrepullDaemonSetShouldChangeItsHashWithTheTemplate(t *testing.T) {
+	cr := &devv1alpha1.AzurePipelinesPool{ObjectMeta: metav1.ObjectMeta{Name: "pools", Namespace: "azuredevops"}}
+	pool := prepullPool()
+
+	before := AddnewPrepullDaemonSetForCR(cr, pool, devv1alpha1.OSLinux)
+	if again := AddnewPrepullDaemonSetForCR(cr, pool, devv1alpha1.OSLinux); again.Annotations[prepullTemplateAnnotation] != before.Annotations[prepullTemplateAnnotation] {
+		t.Errorf("Expected the same template to have the same hash")
+	}
+
+	pool.PoolSpec.Tolerations = []corev1.Toleration{{Key: "builds", Operator: corev1.TolerationOpExists}}
+	after := AddnewPrepullDaemonSetForCR(cr, pool, devv1alpha1.OSLinux)
+	if after.Annotations[prepullTemplateAnnotation] == before.Annotations[prepullTemplateAnnotation] {
+		t.Errorf("Expected the hash to change with the tolerations")
+	}
+	if !reflect.DeepEqual(after.Spec.Template.Spec.Tolerations, pool.PoolSpec.Tolerations) {
+		t.Errorf("Expected the tolerations of the pool. Got %v", after.Spec.Template.Spec.Tolerations)
+	}
+}
@@ -0,0 +1,125 @@
+package azurepipelinespool
+
+import (
+	"context"
+
+	devv1alpha1 "github.com/microsoft/poolprovider-for-k8s/pkg/apis/dev/v1alpha1"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+)
+
+const (
+	sharedToolsMount = "/tools"
+	pauseImage       = "k8s.gcr.io/pause:3.1"
+)
+
+// The copy goes to a temporary directory which is renamed when complete, so agent pods never see a
+// partial toolset. Nodes which already have the toolset of the image skip the copy.
+const materializeScript = `set -e
+target="$1"
+if [ -d "$target" ]; then exit 0; fi
+tmp="$(mktemp -d "$(dirname "$target")/.tmp-XXXXXX")"
+cp -a "$2"/. "$tmp"/
+mv "$tmp" "$target"
+`
+
+// reconcileToolsDaemonSet creates the DaemonSet materializing the toolset of the pool, and updates
+// it when the tools image changes.
+func (r *ReconcileAzurePipelinesPool) reconcileToolsDaemonSet(cr *devv1alpha1.AzurePipelinesPool, pool *devv1alpha1.AgentPoolSpec) error {
+	daemonSet := AddnewToolsDaemonSetForCR(cr, pool)
+	if err := controllerutil.SetControllerReference(cr, daemonSet, r.Scheme); err != nil {
+		return err
+	}
+
+	found := &appsv1.DaemonSet{}
+	err := r.Client.Get(context.TODO(), types.NamespacedName{Name: daemonSet.Name, Namespace: daemonSet.Namespace}, found)
+	if err != nil && errors.IsNotFound(err) {
+		log.Info("Creating a new shared tools DaemonSet", "DaemonSet.Namespace", daemonSet.Namespace, "DaemonSet.Name", daemonSet.Name)
+		return r.Client.Create(context.TODO(), daemonSet)
+	} else if err != nil {
+		return err
+	}
+
+	if toolsImage(&found.Spec.Template.Spec) == pool.SharedTools.Image {
+		return nil
+	}
+	log.Info("Updating the shared tools DaemonSet", "DaemonSet.Namespace", found.Namespace, "DaemonSet.Name", found.Name)
+	found.Spec.Template = daemonSet.Spec.Template
+	return r.Client.Update(context.TODO(), found)
+}
+
+func toolsImage(spec *corev1.PodSpec) string {
+	if len(spec.InitContainers) == 0 {
+		return ""
+	}
+	return spec.InitContainers[0].Image
+}
+
+// AddnewToolsDaemonSetForCR returns a DaemonSet which copies the toolset of the tools image onto
+// every node the agent pods of the pool can run on.
+func AddnewToolsDaemonSetForCR(cr *devv1alpha1.AzurePipelinesPool, pool *devv1alpha1.AgentPoolSpec) *appsv1.DaemonSet {
+	labels := map[string]string{
+		"app":  cr.Name,
+		"role": "shared-tools",
+		"pool": pool.PoolName,
+	}
+	hostPathType := corev1.HostPathDirectoryOrCreate
+	target := sharedToolsMount + "/" + devv1alpha1.SharedToolsVersion(pool.SharedTools.Image)
+
+	podSpec := corev1.PodSpec{
+		InitContainers: []corev1.Container{
+			{
+				Name:         "materialize",
+				Image:        pool.SharedTools.Image,
+				Command:      []string{"sh", "-c", materializeScript, "materialize", target, pool.SharedTools.SourcePath},
+				VolumeMounts: []corev1.VolumeMount{{Name: "shared-tools", MountPath: sharedToolsMount}},
+			},
+		},
+		// Keeps the pod running, so the DaemonSet does not restart the copy
+		Containers: []corev1.Container{
+			{
+				Name:  "pause",
+				Image: pauseImage,
+			},
+		},
+		Volumes: []corev1.Volume{
+			{
+				Name: "shared-tools",
+				VolumeSource: corev1.VolumeSource{HostPath: &corev1.HostPathVolumeSource{
+					Path: devv1alpha1.SharedToolsPoolPath(pool.PoolName),
+					Type: &hostPathType,
+				}},
+			},
+		},
+	}
+
+	// Run on the same nodes as the agents of the pool
+	if pool.PoolSpec != nil {
+		podSpec.NodeSelector = pool.PoolSpec.NodeSelector
+		podSpec.Tolerations = pool.PoolSpec.Tolerations
+		podSpec.Affinity = pool.PoolSpec.Affinity
+	}
+
+	return &appsv1.DaemonSet{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "shared-tools-" + pool.PoolName,
+			Namespace: cr.Namespace,
+			Labels:    labels,
+		},
+		Spec: appsv1.DaemonSetSpec{
+			Selector: &metav1.LabelSelector{
+				MatchLabels: labels,
+			},
+			Template: corev1.PodTemplateSpec{
+				ObjectMeta: metav1.ObjectMeta{
+					Labels: labels,
+				},
+				Spec: podSpec,
+			},
+		},
+	}
+}
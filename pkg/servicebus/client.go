@@ -0,0 +1,249 @@
+// Package servicebus is a small REST client for Azure Service Bus queues. Messages are received
+// with peek-lock, so that Service Bus delivers a message again when its receiver neither completes
+// nor abandons it before the lock expires, and moves it to the dead-letter queue of the queue after
+// its MaxDeliveryCount.
+package servicebus
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	// ErrNotConfigured is returned by calls made without an endpoint or queue.
+	ErrNotConfigured = errors.New("servicebus: no endpoint or queue configured")
+	// ErrLockLost is returned when the lock on a message expired, so that the message was or will
+	// be delivered to another receiver.
+	ErrLockLost = errors.New("servicebus: message lock lost")
+)
+
+const (
+	defaultTimeout = 10 * time.Second
+	tokenValidity  = time.Hour
+)
+
+type Config struct {
+	// Endpoint is the url of the namespace, https://<namespace>.servicebus.windows.net.
+	Endpoint string
+	// KeyName and Key are a shared access policy of the namespace or queue.
+	KeyName string
+	Key     string
+	Queue   string
+	Timeout time.Duration
+	// Transport carries the calls, http.DefaultTransport when nil.
+	Transport http.RoundTripper
+}
+
+// Parses a connection string as shown in the Azure portal,
+// "Endpoint=sb://<namespace>.servicebus.windows.net/;SharedAccessKeyName=<name>;SharedAccessKey=<key>".
+// The EntityPath of a connection string of a queue policy takes precedence over the given queue.
+func ParseConnectionString(connectionString string, queue string) (Config, error) {
+	config := Config{Queue: queue, Timeout: defaultTimeout}
+	for _, part := range strings.Split(connectionString, ";") {
+		separator := strings.Index(part, "=")
+		if separator < 0 {
+			continue
+		}
+		value := strings.TrimSpace(part[separator+1:])
+		switch strings.ToLower(strings.TrimSpace(part[:separator])) {
+		case "endpoint":
+			endpoint, err := url.Parse(value)
+			if err != nil || endpoint.Host == "" {
+				return Config{}, fmt.Errorf("servicebus: invalid endpoint %q", value)
+			}
+			config.Endpoint = "https://" + endpoint.Host
+		case "sharedaccesskeyname":
+			config.KeyName = value
+		case "sharedaccesskey":
+			config.Key = value
+		case "entitypath":
+			config.Queue = value
+		}
+	}
+	if config.Endpoint == "" || config.KeyName == "" || config.Key == "" {
+		return Config{}, errors.New("servicebus: the connection string needs an Endpoint, SharedAccessKeyName and SharedAccessKey")
+	}
+	return config, nil
+}
+
+func (c Config) IsConfigured() bool {
+	return c.Endpoint != "" && c.Queue != ""
+}
+
+// Message is a message received with peek-lock.
+type Message struct {
+	Body string
+	// DeliveryCount counts the deliveries of the message, including this one.
+	DeliveryCount int
+	// LockUrl identifies the lock on the message. Completing, abandoning and renewing the lock are
+	// calls against it.
+	LockUrl string
+}
+
+type brokerProperties struct {
+	DeliveryCount int
+	LockToken     string
+	MessageId     string
+}
+
+type Client struct {
+	config     Config
+	httpClient *http.Client
+}
+
+func NewClient(config Config) *Client {
+	if config.Timeout <= 0 {
+		config.Timeout = defaultTimeout
+	}
+	return &Client{config: config, httpClient: &http.Client{Transport: config.Transport}}
+}
+
+// Send queues a message with the body.
+func (c *Client) Send(body string) error {
+	if !c.config.IsConfigured() {
+		return ErrNotConfigured
+	}
+	resp, err := c.do(http.MethodPost, c.queueUrl()+"/messages", body, c.config.Timeout)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return c.check(resp, "send")
+}
+
+// Receive waits up to timeout for a message and locks it for this receiver. It reports false when
+// no message arrived in time.
+func (c *Client) Receive(timeout time.Duration) (Message, bool, error) {
+	if !c.config.IsConfigured() {
+		return Message{}, false, ErrNotConfigured
+	}
+	seconds := int(timeout / time.Second)
+	if seconds < 1 {
+		seconds = 1
+	}
+	resp, err := c.do(http.MethodPost, c.queueUrl()+"/messages/head?timeout="+strconv.Itoa(seconds), "", c.config.Timeout+timeout)
+	if err != nil {
+		return Message{}, false, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNoContent {
+		return Message{}, false, nil
+	}
+	if err := c.check(resp, "receive"); err != nil {
+		return Message{}, false, err
+	}
+
+	var properties brokerProperties
+	if err := json.Unmarshal([]byte(resp.Header.Get("BrokerProperties")), &properties); err != nil {
+		return Message{}, false, fmt.Errorf("servicebus: receive returned no broker properties: %v", err)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return Message{}, false, err
+	}
+	lockUrl := resp.Header.Get("Location")
+	if lockUrl == "" {
+		lockUrl = c.queueUrl() + "/messages/" + url.PathEscape(properties.MessageId) + "/" + url.PathEscape(properties.LockToken)
+	}
+	return Message{Body: string(body), DeliveryCount: properties.DeliveryCount, LockUrl: lockUrl}, true, nil
+}
+
+// Complete removes the locked message from the queue.
+func (c *Client) Complete(message Message) error {
+	return c.lockCall(http.MethodDelete, message, "complete")
+}
+
+// Abandon releases the lock, so that the message is delivered again right away.
+func (c *Client) Abandon(message Message) error {
+	return c.lockCall(http.MethodPut, message, "abandon")
+}
+
+// RenewLock extends the lock on the message by the lock duration of the queue.
+func (c *Client) RenewLock(message Message) error {
+	return c.lockCall(http.MethodPost, message, "renew lock")
+}
+
+func (c *Client) lockCall(method string, message Message, op string) error {
+	if !c.config.IsConfigured() {
+		return ErrNotConfigured
+	}
+	resp, err := c.do(method, message.LockUrl, "", c.config.Timeout)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusGone {
+		return ErrLockLost
+	}
+	return c.check(resp, op)
+}
+
+func (c *Client) do(method string, requestUrl string, body string, timeout time.Duration) (*http.Response, error) {
+	var reader io.Reader
+	if body != "" {
+		reader = strings.NewReader(body)
+	}
+	req, err := http.NewRequest(method, requestUrl, reader)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	req = req.WithContext(ctx)
+	req.Header.Set("Authorization", c.token(time.Now()))
+	if body != "" {
+		req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	}
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	resp.Body = &cancelingBody{ReadCloser: resp.Body, cancel: cancel}
+	return resp, nil
+}
+
+func (c *Client) check(resp *http.Response, op string) error {
+	if resp.StatusCode >= 300 {
+		message, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("servicebus: %s on queue %s returned %d: %s", op, c.config.Queue, resp.StatusCode, strings.TrimSpace(string(message)))
+	}
+	return nil
+}
+
+func (c *Client) queueUrl() string {
+	return strings.TrimSuffix(c.config.Endpoint, "/") + "/" + url.PathEscape(c.config.Queue)
+}
+
+// Returns a shared access signature token for the queue, valid for an hour.
+func (c *Client) token(now time.Time) string {
+	resource := url.QueryEscape(c.queueUrl())
+	expiry := strconv.FormatInt(now.Add(tokenValidity).Unix(), 10)
+	mac := hmac.New(sha256.New, []byte(c.config.Key))
+	mac.Write([]byte(resource + "\n" + expiry))
+	signature := base64.StdEncoding.EncodeToString(mac.Sum(nil))
+	return "SharedAccessSignature sr=" + resource + "&sig=" + url.QueryEscape(signature) + "&se=" + expiry + "&skn=" + url.QueryEscape(c.config.KeyName)
+}
+
+// Cancels the context of the request once its response body is closed.
+type cancelingBody struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (b *cancelingBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
+}
@@ -0,0 +1,122 @@
+package servicebus
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// A queue holding a single message, which is locked by the receive until it is completed or
+// abandoned.
+type fakeQueue struct {
+	mu     sync.Mutex
+	body   string
+	locked bool
+	calls  []string
+}
+
+func (q *fakeQueue) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.calls = append(q.calls, r.Method+" "+r.URL.Path)
+	if !strings.HasPrefix(r.Header.Get("Authorization"), "SharedAccessSignature sr=") {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	switch {
+	case r.Method == http.MethodPost && r.URL.Path == "/jobs/messages":
+		body, _ := ioutil.ReadAll(r.Body)
+		q.body = string(body)
+		w.WriteHeader(http.StatusCreated)
+	case r.Method == http.MethodPost && r.URL.Path == "/jobs/messages/head":
+		if q.body == "" || q.locked {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		q.locked = true
+		w.Header().Set("BrokerProperties", `{"DeliveryCount":1,"LockToken":"lock-1","MessageId":"message-1"}`)
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte(q.body))
+	case r.URL.Path == "/jobs/messages/message-1/lock-1":
+		if !q.locked {
+			w.WriteHeader(http.StatusGone)
+			return
+		}
+		switch r.Method {
+		case http.MethodDelete:
+			q.body, q.locked = "", false
+		case http.MethodPut:
+			q.locked = false
+		}
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func TestParseConnectionStringShouldReadTheNamespaceAndPolicy(t *testing.T) {
+	config, err := ParseConnectionString("Endpoint=sb://contoso.servicebus.windows.net/;SharedAccessKeyName=send;SharedAccessKey=c2VjcmV0", "jobs")
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if config.Endpoint != "https://contoso.servicebus.windows.net" || config.KeyName != "send" || config.Key != "c2VjcmV0" || config.Queue != "jobs" {
+		t.Errorf("Unexpected config %+v", config)
+	}
+
+	config, _ = ParseConnectionString("Endpoint=sb://contoso.servicebus.windows.net/;SharedAccessKeyName=send;SharedAccessKey=c2VjcmV0;EntityPath=builds", "jobs")
+	if config.Queue != "builds" {
+		t.Errorf("The EntityPath should name the queue. Got %s", config.Queue)
+	}
+
+	if _, err := ParseConnectionString("Endpoint=sb://contoso.servicebus.windows.net/", "jobs"); err == nil {
+		t.Errorf("A connection string without a policy should be rejected")
+	}
+}
+
+func TestClientShouldReceiveLockedMessagesUntilTheyAreCompleted(t *testing.T) {
+	queue := &fakeQueue{}
+	server := httptest.NewServer(queue)
+	defer server.Close()
+	client := NewClient(Config{Endpoint: server.URL, KeyName: "send", Key: "c2VjcmV0", Queue: "jobs"})
+
+	if err := client.Send("operation-1"); err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	message, ok, err := client.Receive(time.Second)
+	if err != nil || !ok || message.Body != "operation-1" || message.DeliveryCount != 1 {
+		t.Fatalf("Expected the sent message. Got %+v %v %v", message, ok, err)
+	}
+	if _, ok, _ := client.Receive(time.Second); ok {
+		t.Errorf("A locked message should not be received twice")
+	}
+	if err := client.RenewLock(message); err != nil {
+		t.Errorf("Unexpected error %v", err)
+	}
+
+	if err := client.Abandon(message); err != nil {
+		t.Errorf("Unexpected error %v", err)
+	}
+	if err := client.RenewLock(message); err != ErrLockLost {
+		t.Errorf("Expected the lock lost once the message was abandoned. Got %v", err)
+	}
+	message, ok, _ = client.Receive(time.Second)
+	if !ok {
+		t.Fatalf("Expected the abandoned message delivered again")
+	}
+	if err := client.Complete(message); err != nil {
+		t.Errorf("Unexpected error %v", err)
+	}
+	if _, ok, _ := client.Receive(time.Second); ok {
+		t.Errorf("A completed message should be removed from the queue")
+	}
+}
+
+func TestClientShouldNotCallWithoutAQueue(t *testing.T) {
+	client := NewClient(Config{})
+	if err := client.Send("operation-1"); err != ErrNotConfigured {
+		t.Errorf("Expected ErrNotConfigured. Got %v", err)
+	}
+}
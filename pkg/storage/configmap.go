@@ -0,0 +1,187 @@
+package storage
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"strings"
+
+	v1 "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+const (
+	configMapPrefix = "poolprovider-state-"
+	appLabel        = "app"
+	appLabelValue   = "poolprovider-state"
+	bucketLabel     = "bucket"
+	keyField        = "key"
+	valueField      = "value"
+	maxSetAttempts  = 3
+)
+
+// ConfigMapStorage keeps every key in its own ConfigMap in the provider namespace. It needs no
+// infrastructure besides the Kubernetes API the provider already talks to.
+type ConfigMapStorage struct {
+	clientset kubernetes.Interface
+	namespace string
+}
+
+func NewConfigMapStorage(clientset kubernetes.Interface, namespace string) *ConfigMapStorage {
+	return &ConfigMapStorage{clientset: clientset, namespace: namespace}
+}
+
+func (s *ConfigMapStorage) Get(key string) (string, error) {
+	configMap, err := s.clientset.CoreV1().ConfigMaps(s.namespace).Get(configMapName(key), metav1.GetOptions{})
+	if k8serrors.IsNotFound(err) {
+		return "", ErrNotFound
+	} else if err != nil {
+		return "", err
+	}
+	return configMap.Data[valueField], nil
+}
+
+// Retries writes which raced with another replica, the last write wins.
+func (s *ConfigMapStorage) Set(key string, value string) error {
+	var err error
+	for attempt := 0; attempt < maxSetAttempts; attempt++ {
+		if err = s.set(key, value); !errors.Is(err, ErrConflict) {
+			return err
+		}
+	}
+	return err
+}
+
+func (s *ConfigMapStorage) set(key string, value string) error {
+	configMapClient := s.clientset.CoreV1().ConfigMaps(s.namespace)
+
+	configMap, err := configMapClient.Get(configMapName(key), metav1.GetOptions{})
+	if k8serrors.IsNotFound(err) {
+		_, err = configMapClient.Create(newConfigMap(key, value, s.namespace))
+		return wrapError("create", key, err)
+	} else if err != nil {
+		return err
+	}
+
+	configMap.Data = map[string]string{keyField: key, valueField: value}
+	_, err = configMapClient.Update(configMap)
+	return wrapError("update", key, err)
+}
+
+// Creating an object is atomic in the Kubernetes API, so only one caller can win the race for a key.
+func (s *ConfigMapStorage) SetIfAbsent(key string, value string) (bool, error) {
+	_, err := s.clientset.CoreV1().ConfigMaps(s.namespace).Create(newConfigMap(key, value, s.namespace))
+	if k8serrors.IsAlreadyExists(err) {
+		return false, nil
+	} else if err != nil {
+		return false, wrapError("create", key, err)
+	}
+	return true, nil
+}
+
+// The update carries the resource version of the read, so the API refuses it when another replica
+// wrote the key in between.
+func (s *ConfigMapStorage) CompareAndSwap(key string, old string, new string) (bool, error) {
+	configMapClient := s.clientset.CoreV1().ConfigMaps(s.namespace)
+
+	configMap, err := configMapClient.Get(configMapName(key), metav1.GetOptions{})
+	if k8serrors.IsNotFound(err) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	if configMap.Data[valueField] != old {
+		return false, nil
+	}
+
+	configMap.Data = map[string]string{keyField: key, valueField: new}
+	_, err = configMapClient.Update(configMap)
+	if k8serrors.IsConflict(err) || k8serrors.IsNotFound(err) {
+		return false, nil
+	} else if err != nil {
+		return false, wrapError("update", key, err)
+	}
+	return true, nil
+}
+
+func (s *ConfigMapStorage) Delete(key string) error {
+	err := s.clientset.CoreV1().ConfigMaps(s.namespace).Delete(configMapName(key), &metav1.DeleteOptions{})
+	if err != nil && !k8serrors.IsNotFound(err) {
+		return err
+	}
+	return nil
+}
+
+func (s *ConfigMapStorage) List(prefix string) (map[string]string, error) {
+	selector := appLabel + "=" + appLabelValue
+	if bucket := bucketOf(prefix); bucket != "" {
+		selector = selector + "," + bucketLabel + "=" + bucket
+	}
+
+	configMaps, err := s.clientset.CoreV1().ConfigMaps(s.namespace).List(metav1.ListOptions{LabelSelector: selector})
+	if err != nil {
+		return nil, err
+	}
+
+	values := map[string]string{}
+	for _, configMap := range configMaps.Items {
+		if key := configMap.Data[keyField]; strings.HasPrefix(key, prefix) {
+			values[key] = configMap.Data[valueField]
+		}
+	}
+	return values, nil
+}
+
+func newConfigMap(key string, value string, namespace string) *v1.ConfigMap {
+	labels := map[string]string{appLabel: appLabelValue}
+	if bucket := bucketOf(key); bucket != "" {
+		labels[bucketLabel] = bucket
+	}
+
+	return &v1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      configMapName(key),
+			Namespace: namespace,
+			Labels:    labels,
+		},
+		Data: map[string]string{keyField: key, valueField: value},
+	}
+}
+
+// Maps the Kubernetes API errors callers act on to the errors of the package, others are returned
+// as they are. Creating a key another replica just created is a conflict as well.
+func wrapError(op string, key string, err error) error {
+	var kind error
+	switch {
+	case err == nil:
+		return nil
+	case k8serrors.IsConflict(err) || k8serrors.IsAlreadyExists(err):
+		kind = ErrConflict
+	case isQuotaExceeded(err):
+		kind = ErrQuotaExceeded
+	default:
+		return err
+	}
+	return &Error{Op: op, Key: key, Kind: kind, Err: err}
+}
+
+// A ResourceQuota rejects creations as Forbidden, the message names the exceeded quota.
+func isQuotaExceeded(err error) bool {
+	return k8serrors.IsForbidden(err) && strings.Contains(err.Error(), "exceeded quota")
+}
+
+// Keys can contain characters which are not allowed in object names, so the name is derived from a hash.
+func configMapName(key string) string {
+	hash := sha1.Sum([]byte(key))
+	return configMapPrefix + hex.EncodeToString(hash[:])[:20]
+}
+
+// Returns the bucket of a key, i.e. the text before the first ':'.
+func bucketOf(key string) string {
+	if i := strings.Index(key, ":"); i > 0 {
+		return key[:i]
+	}
+	return ""
+}
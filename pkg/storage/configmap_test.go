@@ -0,0 +1,119 @@
+package storage
+
+import (
+	"errors"
+	"testing"
+
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestConfigMapStorageSetAndGet(t *testing.T) {
+	s := NewConfigMapStorage(fake.NewSimpleClientset(), "azuredevops")
+
+	if err := s.Set("journal:1", "validated"); err != nil {
+		t.Fatalf("set failed: (%v)", err)
+	}
+	if err := s.Set("journal:1", "podcreated"); err != nil {
+		t.Fatalf("update failed: (%v)", err)
+	}
+
+	value, err := s.Get("journal:1")
+	if err != nil || value != "podcreated" {
+		t.Errorf("Expected podcreated. Got %s (%v)", value, err)
+	}
+}
+
+func TestConfigMapStorageGetShouldReturnNotFound(t *testing.T) {
+	s := NewConfigMapStorage(fake.NewSimpleClientset(), "azuredevops")
+
+	if _, err := s.Get("journal:1"); err != ErrNotFound {
+		t.Errorf("Expected ErrNotFound. Got %v", err)
+	}
+}
+
+func TestConfigMapStorageListShouldFilterByPrefix(t *testing.T) {
+	s := NewConfigMapStorage(fake.NewSimpleClientset(), "azuredevops")
+	s.Set("journal:1", "a")
+	s.Set("journal:2", "b")
+	s.Set("other:1", "c")
+
+	values, err := s.List("journal:")
+	if err != nil {
+		t.Fatalf("list failed: (%v)", err)
+	}
+	if len(values) != 2 || values["journal:1"] != "a" || values["journal:2"] != "b" {
+		t.Errorf("Unexpected list result %v", values)
+	}
+}
+
+func TestConfigMapStorageDelete(t *testing.T) {
+	s := NewConfigMapStorage(fake.NewSimpleClientset(), "azuredevops")
+	s.Set("journal:1", "a")
+
+	if err := s.Delete("journal:1"); err != nil {
+		t.Fatalf("delete failed: (%v)", err)
+	}
+	if _, err := s.Get("journal:1"); err != ErrNotFound {
+		t.Errorf("Expected key to be deleted")
+	}
+	if err := s.Delete("journal:1"); err != nil {
+		t.Errorf("Deleting a missing key should not fail: (%v)", err)
+	}
+}
+
+func TestConfigMapStorageSetIfAbsentShouldOnlySetOnce(t *testing.T) {
+	s := NewConfigMapStorage(fake.NewSimpleClientset(), "azuredevops")
+
+	if set, err := s.SetIfAbsent("dedupe:1", "a"); !set || err != nil {
+		t.Fatalf("Expected first claim to succeed. Got %v (%v)", set, err)
+	}
+	if set, err := s.SetIfAbsent("dedupe:1", "b"); set || err != nil {
+		t.Errorf("Expected second claim to fail. Got %v (%v)", set, err)
+	}
+	if value, _ := s.Get("dedupe:1"); value != "a" {
+		t.Errorf("Expected the first value to be kept. Got %s", value)
+	}
+}
+
+func TestConfigMapStorageCompareAndSwapShouldOnlySwapTheExpectedValue(t *testing.T) {
+	s := NewConfigMapStorage(fake.NewSimpleClientset(), "azuredevops")
+	s.Set("lease:1", "a")
+
+	if swapped, err := s.CompareAndSwap("lease:1", "b", "c"); swapped || err != nil {
+		t.Errorf("Expected no swap of another value. Got %v (%v)", swapped, err)
+	}
+	if swapped, err := s.CompareAndSwap("lease:1", "a", "c"); !swapped || err != nil {
+		t.Errorf("Expected the swap of the expected value. Got %v (%v)", swapped, err)
+	}
+	if swapped, err := s.CompareAndSwap("lease:2", "", "c"); swapped || err != nil {
+		t.Errorf("Expected no swap of a missing key. Got %v (%v)", swapped, err)
+	}
+	if value, _ := s.Get("lease:1"); value != "c" {
+		t.Errorf("Expected the swapped value. Got %s", value)
+	}
+}
+
+func TestWrapErrorShouldMapConflictsAndQuotas(t *testing.T) {
+	configMaps := schema.GroupResource{Resource: "configmaps"}
+
+	conflict := wrapError("update", "journal:1", k8serrors.NewConflict(configMaps, "state", errors.New("modified")))
+	if !errors.Is(conflict, ErrConflict) || !k8serrors.IsConflict(errors.Unwrap(conflict)) {
+		t.Errorf("Expected a conflict wrapping the API error. Got %v", conflict)
+	}
+
+	quota := wrapError("create", "journal:1", k8serrors.NewForbidden(configMaps, "state", errors.New("exceeded quota: state-quota")))
+	if !errors.Is(quota, ErrQuotaExceeded) {
+		t.Errorf("Expected a quota error. Got %v", quota)
+	}
+
+	forbidden := k8serrors.NewForbidden(configMaps, "state", errors.New("denied"))
+	if err := wrapError("create", "journal:1", forbidden); err != forbidden {
+		t.Errorf("Expected other errors to be returned unchanged. Got %v", err)
+	}
+	if err := wrapError("create", "journal:1", nil); err != nil {
+		t.Errorf("Expected no error. Got %v", err)
+	}
+}
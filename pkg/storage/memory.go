@@ -0,0 +1,100 @@
+package storage
+
+import (
+	"strings"
+	"sync"
+	"time"
+)
+
+// MemoryStorage keeps the entries in the memory of the process. They are lost on restart and are
+// not shared between replicas, so it suits single-replica deployments and tests. With a ttl above
+// zero, entries expire that long after they were last written.
+type MemoryStorage struct {
+	sync.Mutex
+	entries map[string]memoryEntry
+	ttl     time.Duration
+	now     func() time.Time
+}
+
+type memoryEntry struct {
+	value     string
+	expiresAt time.Time
+}
+
+func NewMemoryStorage(ttl time.Duration) *MemoryStorage {
+	return &MemoryStorage{entries: map[string]memoryEntry{}, ttl: ttl, now: time.Now}
+}
+
+func (s *MemoryStorage) Get(key string) (string, error) {
+	s.Lock()
+	defer s.Unlock()
+	entry, ok := s.lookup(key)
+	if !ok {
+		return "", ErrNotFound
+	}
+	return entry.value, nil
+}
+
+func (s *MemoryStorage) Set(key string, value string) error {
+	s.Lock()
+	defer s.Unlock()
+	s.entries[key] = s.newEntry(value)
+	return nil
+}
+
+func (s *MemoryStorage) SetIfAbsent(key string, value string) (bool, error) {
+	s.Lock()
+	defer s.Unlock()
+	if _, ok := s.lookup(key); ok {
+		return false, nil
+	}
+	s.entries[key] = s.newEntry(value)
+	return true, nil
+}
+
+func (s *MemoryStorage) CompareAndSwap(key string, old string, new string) (bool, error) {
+	s.Lock()
+	defer s.Unlock()
+	if entry, ok := s.lookup(key); !ok || entry.value != old {
+		return false, nil
+	}
+	s.entries[key] = s.newEntry(new)
+	return true, nil
+}
+
+func (s *MemoryStorage) Delete(key string) error {
+	s.Lock()
+	defer s.Unlock()
+	delete(s.entries, key)
+	return nil
+}
+
+func (s *MemoryStorage) List(prefix string) (map[string]string, error) {
+	s.Lock()
+	defer s.Unlock()
+	values := map[string]string{}
+	for key := range s.entries {
+		if entry, ok := s.lookup(key); ok && strings.HasPrefix(key, prefix) {
+			values[key] = entry.value
+		}
+	}
+	return values, nil
+}
+
+// Drops the entry when it expired, the lock has to be held.
+func (s *MemoryStorage) lookup(key string) (memoryEntry, bool) {
+	entry, ok := s.entries[key]
+	if ok && !entry.expiresAt.IsZero() && !s.now().Before(entry.expiresAt) {
+		delete(s.entries, key)
+		return memoryEntry{}, false
+	}
+	return entry, ok
+}
+
+func (s *MemoryStorage) newEntry(value string) memoryEntry {
+	entry := memoryEntry{value: value}
+	if s.ttl > 0 {
+		entry.expiresAt = s.now().Add(s.ttl)
+	}
+	return entry
+}
@@ -0,0 +1,72 @@
+package storage
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMemoryStorageSetGetAndDelete(t *testing.T) {
+	s := NewMemoryStorage(0)
+	s.Set("journal:1", "validated")
+	s.Set("journal:1", "podcreated")
+
+	if value, err := s.Get("journal:1"); err != nil || value != "podcreated" {
+		t.Errorf("Expected podcreated. Got %s (%v)", value, err)
+	}
+	s.Delete("journal:1")
+	if _, err := s.Get("journal:1"); err != ErrNotFound {
+		t.Errorf("Expected ErrNotFound. Got %v", err)
+	}
+}
+
+func TestMemoryStorageSetIfAbsentShouldOnlySetOnce(t *testing.T) {
+	s := NewMemoryStorage(0)
+
+	if set, err := s.SetIfAbsent("dedupe:1", "a"); !set || err != nil {
+		t.Fatalf("Expected first claim to succeed. Got %v (%v)", set, err)
+	}
+	if set, _ := s.SetIfAbsent("dedupe:1", "b"); set {
+		t.Errorf("Expected second claim to fail")
+	}
+	if values, _ := s.List("dedupe:"); len(values) != 1 || values["dedupe:1"] != "a" {
+		t.Errorf("Expected the first value to be kept. Got %v", values)
+	}
+}
+
+func TestMemoryStorageShouldExpireEntries(t *testing.T) {
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	s := NewMemoryStorage(time.Minute)
+	s.now = func() time.Time { return now }
+	s.Set("journal:1", "a")
+
+	now = now.Add(59 * time.Second)
+	if _, err := s.Get("journal:1"); err != nil {
+		t.Errorf("Expected the entry before its ttl. Got %v", err)
+	}
+
+	now = now.Add(time.Second)
+	if values, _ := s.List("journal:"); len(values) != 0 {
+		t.Errorf("Expected the entry to expire. Got %v", values)
+	}
+	if set, _ := s.SetIfAbsent("journal:1", "b"); !set {
+		t.Errorf("Expected an expired key to be claimable")
+	}
+}
+
+func TestMemoryStorageCompareAndSwapShouldOnlySwapTheExpectedValue(t *testing.T) {
+	s := NewMemoryStorage(0)
+	s.Set("lease:1", "a")
+
+	if swapped, err := s.CompareAndSwap("lease:1", "b", "c"); swapped || err != nil {
+		t.Errorf("Expected no swap of another value. Got %v (%v)", swapped, err)
+	}
+	if swapped, err := s.CompareAndSwap("lease:1", "a", "c"); !swapped || err != nil {
+		t.Errorf("Expected the swap of the expected value. Got %v (%v)", swapped, err)
+	}
+	if swapped, _ := s.CompareAndSwap("lease:2", "", "c"); swapped {
+		t.Errorf("Expected no swap of a missing key")
+	}
+	if value, _ := s.Get("lease:1"); value != "c" {
+		t.Errorf("Expected the swapped value. Got %s", value)
+	}
+}
@@ -0,0 +1,52 @@
+// Package storage persists the provider state outside of the webserver process, so that it
+// survives restarts and can be shared between replicas.
+package storage
+
+import (
+	"errors"
+)
+
+var (
+	// ErrNotFound is returned when the requested key is not present in the storage.
+	ErrNotFound = errors.New("storage: key not found")
+	// ErrConflict is returned when a key was changed concurrently and the write was not applied.
+	ErrConflict = errors.New("storage: conflicting write")
+	// ErrQuotaExceeded is returned when the backend refuses to store more entries.
+	ErrQuotaExceeded = errors.New("storage: quota exceeded")
+)
+
+// Error is returned for failed operations. It matches its Kind, one of the errors above, with
+// errors.Is and unwraps to the error of the backend, e.g. a Kubernetes API status.
+type Error struct {
+	Op   string
+	Key  string
+	Kind error
+	Err  error
+}
+
+func (e *Error) Error() string {
+	return e.Kind.Error() + ": " + e.Op + " " + e.Key + ": " + e.Err.Error()
+}
+
+func (e *Error) Is(target error) bool {
+	return target == e.Kind
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// Storage is a simple key value store. Keys are namespaced with a "<bucket>:" prefix,
+// e.g. "journal:<agentId>", so that related entries can be listed together.
+type Storage interface {
+	Get(key string) (string, error)
+	Set(key string, value string) error
+	// SetIfAbsent stores the value only if the key does not exist yet and reports whether it did.
+	// Replicas use it to claim work, so it has to be atomic.
+	SetIfAbsent(key string, value string) (bool, error)
+	// CompareAndSwap stores the new value only if the key still holds old and reports whether it
+	// did. Replicas use it to take over work from each other, so it has to be atomic as well.
+	CompareAndSwap(key string, old string, new string) (bool, error)
+	Delete(key string) error
+	List(prefix string) (map[string]string, error)
+}
@@ -0,0 +1,80 @@
+// Package templatetest helps testing agent pool templates. It renders the agent pod a pool template
+// produces for a set of demands and compares it with a golden file, so template changes show up as
+// diffs in code review:
+//
+//	pod := templatetest.Render(t, "testdata/linux-pool.yaml", "node=18")
+//	templatetest.AssertGolden(t, "testdata/linux-pool-node18.golden.json", pod)
+//
+// Run the tests with UPDATE_GOLDEN=1 to write the golden files from the current output.
+package templatetest
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/ghodss/yaml"
+	v1alpha1 "github.com/microsoft/poolprovider-for-k8s/pkg/apis/dev/v1alpha1"
+	v1 "k8s.io/api/core/v1"
+)
+
+// LoadTemplate reads an agent pool, as written in the agentPools list of the custom resource, from
+// a YAML or JSON file.
+func LoadTemplate(t testing.TB, path string) v1alpha1.AgentPoolSpec {
+	t.Helper()
+
+	var pool v1alpha1.AgentPoolSpec
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("reading template %s: %v", path, err)
+	}
+	jsonData, err := yaml.YAMLToJSON(data)
+	if err != nil {
+		t.Fatalf("parsing template %s: %v", path, err)
+	}
+	if err := json.Unmarshal(jsonData, &pool); err != nil {
+		t.Fatalf("parsing template %s: %v", path, err)
+	}
+	return pool
+}
+
+// Render returns the agent pod the template at path produces for a job with the given demands.
+func Render(t testing.TB, path string, demands ...string) *v1.Pod {
+	t.Helper()
+
+	pool := LoadTemplate(t, path)
+	pod := v1alpha1.RenderAgentPod(&pool, demands)
+	if pod == nil {
+		t.Fatalf("template %s has no pod spec", path)
+	}
+	return pod
+}
+
+// AssertGolden compares the JSON form of actual with the golden file, or writes the golden file
+// when UPDATE_GOLDEN is set.
+func AssertGolden(t testing.TB, goldenPath string, actual interface{}) {
+	t.Helper()
+
+	data, err := json.MarshalIndent(actual, "", "  ")
+	if err != nil {
+		t.Fatalf("marshalling %v: %v", actual, err)
+	}
+	data = append(data, '\n')
+
+	if os.Getenv("UPDATE_GOLDEN") != "" {
+		if err := ioutil.WriteFile(goldenPath, data, 0644); err != nil {
+			t.Fatalf("writing golden file %s: %v", goldenPath, err)
+		}
+		return
+	}
+
+	expected, err := ioutil.ReadFile(goldenPath)
+	if err != nil {
+		t.Fatalf("reading golden file %s: %v (run with UPDATE_GOLDEN=1 to create it)", goldenPath, err)
+	}
+	if !bytes.Equal(expected, data) {
+		t.Errorf("output differs from golden file %s\nexpected:\n%s\nactual:\n%s", goldenPath, expected, data)
+	}
+}
@@ -0,0 +1,10 @@
+package templatetest
+
+import (
+	"testing"
+)
+
+func TestRenderShouldMatchGoldenFiles(t *testing.T) {
+	AssertGolden(t, "testdata/linux-pool.golden.json", Render(t, "testdata/linux-pool.json"))
+	AssertGolden(t, "testdata/linux-pool-node18.golden.json", Render(t, "testdata/linux-pool.json", "node=18"))
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"strings"
+
+	v1alpha1 "github.com/microsoft/poolprovider-for-k8s/pkg/apis/dev/v1alpha1"
+	v1 "k8s.io/api/core/v1"
+)
+
+const (
+	LintRuleNoLatestTag   = "noLatestTag"
+	LintRuleResourcesSet  = "resourcesSet"
+	LintRuleRunAsNonRoot  = "runAsNonRoot"
+	LintRuleRequiredLabel = "requiredLabel"
+
+	LintActionWarn  = "warn"
+	LintActionBlock = "block"
+)
+
+type LintViolation struct {
+	Rule    string
+	Action  string
+	Message string
+}
+
+// Checks the agent pod against the lint rules of the custom resource and returns all violations.
+func LintPod(pod *v1.Pod, rules []v1alpha1.PodLintRule) []LintViolation {
+	violations := checkPodLintRules(pod, rules)
+	for _, violation := range violations {
+		podLintViolations.WithLabelValues(violation.Rule, violation.Action).Inc()
+	}
+	return violations
+}
+
+// Same as LintPod without counting the violations, for pods which are not going to be created.
+func checkPodLintRules(pod *v1.Pod, rules []v1alpha1.PodLintRule) []LintViolation {
+	var violations []LintViolation
+	if pod == nil {
+		return violations
+	}
+
+	for _, rule := range rules {
+		for _, message := range checkLintRule(pod, rule) {
+			violations = append(violations, LintViolation{Rule: rule.Rule, Action: rule.Action, Message: message})
+		}
+	}
+	return violations
+}
+
+// Returns true if any of the violations comes from a rule which blocks pod creation.
+func IsBlockingViolation(violations []LintViolation) bool {
+	for _, violation := range violations {
+		if violation.Action == LintActionBlock {
+			return true
+		}
+	}
+	return false
+}
+
+func FormatViolations(violations []LintViolation) []string {
+	var messages []string
+	for _, violation := range violations {
+		messages = append(messages, violation.Rule+" ("+violation.Action+"): "+violation.Message)
+	}
+	return messages
+}
+
+func checkLintRule(pod *v1.Pod, rule v1alpha1.PodLintRule) []string {
+	var messages []string
+
+	switch rule.Rule {
+	case LintRuleNoLatestTag:
+		for _, container := range pod.Spec.Containers {
+			if isLatestImage(container.Image) {
+				messages = append(messages, "container "+container.Name+" uses image "+container.Image+" without a pinned tag")
+			}
+		}
+	case LintRuleResourcesSet:
+		for _, container := range pod.Spec.Containers {
+			if len(container.Resources.Requests) == 0 || len(container.Resources.Limits) == 0 {
+				messages = append(messages, "container "+container.Name+" has no resource requests or limits")
+			}
+		}
+	case LintRuleRunAsNonRoot:
+		podNonRoot := pod.Spec.SecurityContext != nil && pod.Spec.SecurityContext.RunAsNonRoot != nil && *pod.Spec.SecurityContext.RunAsNonRoot
+		for _, container := range pod.Spec.Containers {
+			containerNonRoot := container.SecurityContext != nil && container.SecurityContext.RunAsNonRoot != nil && *container.SecurityContext.RunAsNonRoot
+			if !podNonRoot && !containerNonRoot {
+				messages = append(messages, "container "+container.Name+" may run as root")
+			}
+		}
+	case LintRuleRequiredLabel:
+		if _, ok := pod.GetLabels()[rule.Label]; !ok {
+			messages = append(messages, "pod is missing label "+rule.Label)
+		}
+	default:
+		messages = append(messages, "unknown lint rule "+rule.Rule)
+	}
+	return messages
+}
+
+// Images without a tag or digest resolve to latest.
+func isLatestImage(image string) bool {
+	if strings.Contains(image, "@") {
+		return false
+	}
+
+	name := image
+	if i := strings.LastIndex(image, "/"); i >= 0 {
+		name = image[i+1:]
+	}
+
+	i := strings.LastIndex(name, ":")
+	return i < 0 || name[i+1:] == "latest"
+}
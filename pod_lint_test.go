@@ -0,0 +1,64 @@
+package main
+
+import (
+	"testing"
+
+	v1alpha1 "github.com/microsoft/poolprovider-for-k8s/pkg/apis/dev/v1alpha1"
+	v1 "k8s.io/api/core/v1"
+)
+
+func getLintTestPod(image string) *v1.Pod {
+	pod := &v1.Pod{
+		Spec: v1.PodSpec{
+			Containers: []v1.Container{
+				{
+					Name:  "vsts-agent",
+					Image: image,
+				},
+			},
+		},
+	}
+	pod.SetLabels(GenerateLabelsForPod("1"))
+	return pod
+}
+
+func TestLintPodShouldReportLatestTag(t *testing.T) {
+	rules := []v1alpha1.PodLintRule{{Rule: LintRuleNoLatestTag, Action: LintActionBlock}}
+
+	if violations := LintPod(getLintTestPod("prebansa/myagent"), rules); len(violations) != 1 {
+		t.Errorf("Image without tag must be reported")
+	}
+	if violations := LintPod(getLintTestPod("prebansa/myagent:latest"), rules); !IsBlockingViolation(violations) {
+		t.Errorf("Image with latest tag must block pod creation")
+	}
+	if violations := LintPod(getLintTestPod("myregistry:5000/myagent:v5.16"), rules); len(violations) != 0 {
+		t.Errorf("Pinned image must not be reported")
+	}
+}
+
+func TestLintPodShouldOnlyWarnForWarnRules(t *testing.T) {
+	rules := []v1alpha1.PodLintRule{
+		{Rule: LintRuleResourcesSet, Action: LintActionWarn},
+		{Rule: LintRuleRunAsNonRoot, Action: LintActionWarn},
+	}
+
+	violations := LintPod(getLintTestPod("prebansa/myagent:v5.16"), rules)
+	if len(violations) != 2 {
+		t.Errorf("Expected 2 violations. Got %d", len(violations))
+	}
+	if IsBlockingViolation(violations) {
+		t.Errorf("Warn rules must not block pod creation")
+	}
+}
+
+func TestLintPodShouldCheckRequiredLabel(t *testing.T) {
+	rules := []v1alpha1.PodLintRule{
+		{Rule: LintRuleRequiredLabel, Action: LintActionBlock, Label: agentIdLabel},
+		{Rule: LintRuleRequiredLabel, Action: LintActionBlock, Label: "team"},
+	}
+
+	violations := LintPod(getLintTestPod("prebansa/myagent:v5.16"), rules)
+	if len(violations) != 1 || violations[0].Message != "pod is missing label team" {
+		t.Errorf("Expected only the missing team label to be reported")
+	}
+}
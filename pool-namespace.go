@@ -0,0 +1,173 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	v1alpha1 "github.com/microsoft/poolprovider-for-k8s/pkg/apis/dev/v1alpha1"
+	v1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// Agent pools with a namespace of their own run their agent pods there instead of the namespace of
+// the webserver, so the jobs of one pool cannot see or starve the jobs of another. The namespace is
+// created with the first agent of the pool and gets the labels, the resource quota and the network
+// policy of the NamespaceTemplate of the pool configuration. The template is applied again when it
+// changes, the objects are never deleted. Provisioned namespaces are kept under
+// "pool-namespace:<namespace>" in the storage, so every replica releases and reports the agents in
+// them. Isolated pools have no warm pool, standby pods only run in the webserver namespace.
+const (
+	poolNamespaceKeyPrefix  = "pool-namespace:"
+	poolNamespaceObjectName = "azure-pipelines-pool"
+)
+
+// The template applied to each namespace by this replica, to skip applying it for every agent
+var appliedNamespaceTemplates = struct {
+	sync.Mutex
+	templates map[string]string
+}{templates: map[string]string{}}
+
+// Returns the namespace the agent pods of the pool run in, the given namespace when the pool is not
+// isolated.
+func poolNamespace(crdobject *v1alpha1.AzurePipelinesPool, pool *v1alpha1.AgentPoolSpec, namespace string) string {
+	if pool == nil {
+		return namespace
+	}
+	if pool.Namespace != "" {
+		return pool.Namespace
+	}
+	if crdobject != nil && crdobject.Spec.NamespaceTemplate != nil && crdobject.Spec.NamespaceTemplate.NamePrefix != "" && pool.AzureDevOpsPoolId != 0 {
+		return crdobject.Spec.NamespaceTemplate.NamePrefix + strconv.Itoa(int(pool.AzureDevOpsPoolId))
+	}
+	return namespace
+}
+
+// Creates the namespace of the pool unless it exists and applies the template to it.
+func ensurePoolNamespace(cs *k8s, template *v1alpha1.NamespaceTemplate, pool *v1alpha1.AgentPoolSpec, namespace string) error {
+	if template == nil {
+		template = &v1alpha1.NamespaceTemplate{}
+	}
+	data, _ := json.Marshal(template)
+	fingerprint := pool.PoolName + "\n" + string(data)
+
+	appliedNamespaceTemplates.Lock()
+	defer appliedNamespaceTemplates.Unlock()
+	if appliedNamespaceTemplates.templates[namespace] == fingerprint {
+		return nil
+	}
+
+	if err := applyNamespaceLabels(cs, namespace, poolNamespaceLabels(template, pool)); err != nil {
+		return err
+	}
+	if template.ResourceQuota != nil {
+		if err := applyResourceQuota(cs, namespace, *template.ResourceQuota); err != nil {
+			return err
+		}
+	}
+	if template.NetworkPolicy != nil {
+		if err := applyNetworkPolicy(cs, namespace, *template.NetworkPolicy); err != nil {
+			return err
+		}
+	}
+
+	if err := GetStorage().Set(poolNamespaceKeyPrefix+namespace, pool.PoolName); err != nil {
+		return err
+	}
+	appliedNamespaceTemplates.templates[namespace] = fingerprint
+	log.Println("Provisioned namespace " + namespace + " of agent pool " + pool.PoolName)
+	return nil
+}
+
+func poolNamespaceLabels(template *v1alpha1.NamespaceTemplate, pool *v1alpha1.AgentPoolSpec) map[string]string {
+	labels := map[string]string{}
+	for key, value := range template.Labels {
+		labels[key] = value
+	}
+	labels[agentPoolLabel] = pool.PoolName
+	return labels
+}
+
+// Creates the namespace with the labels, or adds the labels to the existing namespace.
+func applyNamespaceLabels(cs *k8s, namespace string, labels map[string]string) error {
+	namespaces := cs.clientset.CoreV1().Namespaces()
+	existing, err := namespaces.Get(namespace, metav1.GetOptions{})
+	if k8serrors.IsNotFound(err) {
+		_, err = namespaces.Create(&v1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: namespace, Labels: labels}})
+		if err != nil && !k8serrors.IsAlreadyExists(err) {
+			return err
+		}
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	if existing.Status.Phase == v1.NamespaceTerminating || existing.ObjectMeta.DeletionTimestamp != nil {
+		return errors.New("Namespace " + namespace + " is terminating, no agent pods can be created in it")
+	}
+	changed := false
+	if existing.Labels == nil {
+		existing.Labels = map[string]string{}
+	}
+	for key, value := range labels {
+		if existing.Labels[key] != value {
+			existing.Labels[key] = value
+			changed = true
+		}
+	}
+	if changed {
+		_, err = namespaces.Update(existing)
+	}
+	return err
+}
+
+func applyResourceQuota(cs *k8s, namespace string, spec v1.ResourceQuotaSpec) error {
+	quotas := cs.clientset.CoreV1().ResourceQuotas(namespace)
+	_, err := quotas.Create(&v1.ResourceQuota{ObjectMeta: metav1.ObjectMeta{Name: poolNamespaceObjectName, Namespace: namespace}, Spec: spec})
+	if !k8serrors.IsAlreadyExists(err) {
+		return err
+	}
+	existing, err := quotas.Get(poolNamespaceObjectName, metav1.GetOptions{})
+	if err != nil {
+		return err
+	}
+	existing.Spec = spec
+	_, err = quotas.Update(existing)
+	return err
+}
+
+func applyNetworkPolicy(cs *k8s, namespace string, spec networkingv1.NetworkPolicySpec) error {
+	policies := cs.clientset.NetworkingV1().NetworkPolicies(namespace)
+	_, err := policies.Create(&networkingv1.NetworkPolicy{ObjectMeta: metav1.ObjectMeta{Name: poolNamespaceObjectName, Namespace: namespace}, Spec: spec})
+	if !k8serrors.IsAlreadyExists(err) {
+		return err
+	}
+	existing, err := policies.Get(poolNamespaceObjectName, metav1.GetOptions{})
+	if err != nil {
+		return err
+	}
+	existing.Spec = spec
+	_, err = policies.Update(existing)
+	return err
+}
+
+// Returns the namespaces provisioned for agent pools, sorted.
+func provisionedPoolNamespaces() []string {
+	entries, err := GetStorage().List(poolNamespaceKeyPrefix)
+	if err != nil {
+		log.Println("Failed to list the namespaces of the agent pools", err)
+		return nil
+	}
+	namespaces := []string{}
+	for key := range entries {
+		namespaces = append(namespaces, strings.TrimPrefix(key, poolNamespaceKeyPrefix))
+	}
+	sort.Strings(namespaces)
+	return namespaces
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"time"
+
+	v1alpha1 "github.com/microsoft/poolprovider-for-k8s/pkg/apis/dev/v1alpha1"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// The pool state is published to a ConfigMap so it can be inspected with kubectl or picked up by
+// GitOps tooling. The ConfigMap is only written by the webserver; edits are overwritten.
+const (
+	poolStateConfigMap = "poolprovider-pool-state"
+	poolStateKey       = "pools.json"
+)
+
+var poolStateInterval = time.Minute
+
+type PoolState struct {
+	Name           string
+	WarmPoolTarget int
+	StandbyPods    int
+	ActiveAgents   int
+	PendingJobs    int
+	// Moving average of the time agent pods of the pool take to become ready
+	StartupLatencySeconds int
+	// Jobs of the pool provisioned in a fallback pool within the failover retention
+	Failovers int `json:",omitempty"`
+}
+
+type PoolStateSnapshot struct {
+	UpdatedAt time.Time
+	Pools     []PoolState
+	// Token of the next page of GET /pools, empty on the last page
+	Continue string `json:",omitempty"`
+}
+
+// The leader publishes the pool state every POOL_STATE_INTERVAL_SECONDS until the process exits.
+func RunPoolStateExporter(namespace string) {
+	interval := time.Duration(getEnvInt("POOL_STATE_INTERVAL_SECONDS", int(poolStateInterval/time.Second))) * time.Second
+	for {
+		if IsLeader() {
+			if err := ExportPoolState(namespace); err != nil {
+				log.Println("Failed to export pool state", err)
+			}
+		}
+		time.Sleep(interval)
+	}
+}
+
+func ExportPoolState(namespace string) error {
+	crdobject, _, err := fetchAzurePipelinesPool(namespace)
+	if err != nil {
+		return err
+	}
+
+	snapshot, err := collectPoolState(crdobject, namespace)
+	if err != nil {
+		return err
+	}
+	for _, state := range snapshot.Pools {
+		poolActiveAgents.WithLabelValues(state.Name).Set(float64(state.ActiveAgents))
+		poolStandbyPods.WithLabelValues(state.Name).Set(float64(state.StandbyPods))
+	}
+
+	data, _ := json.MarshalIndent(snapshot, "", "  ")
+	return writePoolStateConfigMap(namespace, string(data))
+}
+
+func collectPoolState(crdobject *v1alpha1.AzurePipelinesPool, namespace string) (PoolStateSnapshot, error) {
+	snapshot := PoolStateSnapshot{UpdatedAt: time.Now().UTC()}
+	podClient := CreateClientSet().clientset.CoreV1().Pods(namespace)
+	failovers := countFailovers()
+
+	for i := range crdobject.Spec.AgentPools {
+		pool := &crdobject.Spec.AgentPools[i]
+		hint := getWarmPoolScaleHint(pool.PoolName)
+		state := PoolState{Name: pool.PoolName, WarmPoolTarget: warmPoolTarget(pool, hint), PendingJobs: hint, Failovers: failovers[pool.PoolName]}
+
+		standby, err := podClient.List(metav1.ListOptions{LabelSelector: standbyLabel + "=" + pool.PoolName})
+		if err != nil {
+			return snapshot, err
+		}
+		state.StandbyPods = len(standby.Items)
+
+		active, err := podClient.List(metav1.ListOptions{LabelSelector: agentPoolLabel + "=" + pool.PoolName})
+		if err != nil {
+			return snapshot, err
+		}
+		state.ActiveAgents = len(active.Items)
+		observeStartupLatencies(pool.PoolName, active.Items)
+		observeProvisioningOutcomes(pool.PoolName, active.Items)
+		state.StartupLatencySeconds = toSeconds(startupLatency(pool.PoolName))
+
+		snapshot.Pools = append(snapshot.Pools, state)
+	}
+	return snapshot, nil
+}
+
+func writePoolStateConfigMap(namespace string, state string) error {
+	configMapClient := CreateClientSet().clientset.CoreV1().ConfigMaps(namespace)
+
+	configMap, err := configMapClient.Get(poolStateConfigMap, metav1.GetOptions{})
+	if errors.IsNotFound(err) {
+		configMap = &v1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      poolStateConfigMap,
+				Namespace: namespace,
+				Labels:    map[string]string{"app": "poolprovider-pool-state"},
+			},
+			Data: map[string]string{poolStateKey: state},
+		}
+		_, err = configMapClient.Create(configMap)
+		return err
+	} else if err != nil {
+		return err
+	}
+
+	configMap.Data = map[string]string{poolStateKey: state}
+	_, err = configMapClient.Update(configMap)
+	return err
+}
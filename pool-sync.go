@@ -0,0 +1,240 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	v1alpha1 "github.com/microsoft/poolprovider-for-k8s/pkg/apis/dev/v1alpha1"
+	"github.com/microsoft/poolprovider-for-k8s/pkg/azuredevops"
+	"github.com/microsoft/poolprovider-for-k8s/pkg/storage"
+)
+
+// The description, auto-provision and auto-update flags and capabilities of every pool with an
+// Azure DevOps pool id are synced both ways every POOL_SYNC_INTERVAL_SECONDS. The values of the
+// last sync are kept under "poolsync:<pool>": a field changed on one side only is copied to the
+// other side, a field changed differently on both sides is a conflict, which is logged and won by
+// the side POOL_SYNC_PREFER names, "provider" (default) or "azuredevops".
+const (
+	poolSyncKeyPrefix         = "poolsync:"
+	poolSyncPreferAzureDevOps = "azuredevops"
+	descriptionProperty       = "poolprovider.description"
+	capabilitiesProperty      = "poolprovider.capabilities"
+	azureDevOpsStringType     = "System.String"
+	poolMetadataDescription   = "description"
+	poolMetadataAutoProvision = "autoProvision"
+	poolMetadataAutoUpdate    = "autoUpdate"
+	poolMetadataCapabilities  = "capabilities"
+)
+
+type azureDevOpsPool struct {
+	Id            int32                          `json:"id,omitempty"`
+	AutoProvision *bool                          `json:"autoProvision,omitempty"`
+	AutoUpdate    *bool                          `json:"autoUpdate,omitempty"`
+	Properties    map[string]azureDevOpsProperty `json:"properties,omitempty"`
+}
+
+type azureDevOpsProperty struct {
+	Type  string `json:"$type"`
+	Value string `json:"$value"`
+}
+
+func RunPoolSync(namespace string) {
+	seconds, _ := strconv.Atoi(os.Getenv("POOL_SYNC_INTERVAL_SECONDS"))
+	if seconds <= 0 {
+		return
+	}
+
+	config := azuredevops.ConfigFromEnvironment()
+	if !config.IsConfigured() {
+		log.Println("Pool sync needs the Azure DevOps connection to be configured")
+		return
+	}
+	client := newAzureDevOpsClient(config)
+	preferLocal := os.Getenv("POOL_SYNC_PREFER") != poolSyncPreferAzureDevOps
+
+	for {
+		if IsLeader() {
+			if err := syncPools(client, namespace, preferLocal); err != nil {
+				log.Println("Pool sync failed", err)
+			}
+		}
+		time.Sleep(time.Duration(seconds) * time.Second)
+	}
+}
+
+func syncPools(client *azuredevops.Client, namespace string, preferLocal bool) error {
+	crdobject, poolclient, err := fetchAzurePipelinesPool(namespace)
+	if err != nil {
+		return err
+	}
+
+	synced := map[string]map[string]string{}
+	changed := false
+	for i := range crdobject.Spec.AgentPools {
+		pool := &crdobject.Spec.AgentPools[i]
+		if pool.AzureDevOpsPoolId == 0 {
+			continue
+		}
+
+		path := "distributedtask/pools/" + strconv.Itoa(int(pool.AzureDevOpsPoolId))
+		var remote azureDevOpsPool
+		if err := client.Get(path, &remote); err != nil {
+			log.Println("Failed to read Azure DevOps pool of "+pool.PoolName, err)
+			continue
+		}
+
+		local := localPoolMetadata(pool)
+		remoteMetadata := remotePoolMetadata(&remote)
+		merged, conflicts := mergePoolMetadata(lastSyncedPoolMetadata(pool.PoolName), local, remoteMetadata, preferLocal)
+		for _, field := range conflicts {
+			log.Println("Pool sync conflict on " + field + " of pool " + pool.PoolName + ": provider has \"" +
+				local[field] + "\", Azure DevOps has \"" + remoteMetadata[field] + "\", keeping \"" + merged[field] + "\"")
+		}
+
+		if !equalMetadata(merged, remoteMetadata) {
+			if err := client.Send(http.MethodPatch, path, remotePoolUpdate(merged), nil); err != nil {
+				log.Println("Failed to update Azure DevOps pool of "+pool.PoolName, err)
+				continue
+			}
+		}
+		if !equalMetadata(merged, local) {
+			applyPoolMetadata(pool, merged)
+			changed = true
+		}
+		synced[pool.PoolName] = merged
+	}
+
+	if changed {
+		if _, err := poolclient.Update(crdobject); err != nil {
+			return err
+		}
+	}
+	for poolName, metadata := range synced {
+		data, _ := json.Marshal(metadata)
+		if err := GetStorage().Set(poolSyncKeyPrefix+poolName, string(data)); err != nil {
+			log.Println("Failed to store the synced metadata of pool "+poolName, err)
+		}
+	}
+	return nil
+}
+
+func lastSyncedPoolMetadata(poolName string) map[string]string {
+	metadata := map[string]string{}
+	value, err := GetStorage().Get(poolSyncKeyPrefix + poolName)
+	if err != nil {
+		if !errors.Is(err, storage.ErrNotFound) {
+			log.Println("Failed to read the synced metadata of pool "+poolName, err)
+		}
+		return metadata
+	}
+	json.Unmarshal([]byte(value), &metadata)
+	return metadata
+}
+
+// Merges the fields both sides changed since the last sync. Returns the merged fields and the
+// fields changed differently on both sides.
+func mergePoolMetadata(base, local, remote map[string]string, preferLocal bool) (map[string]string, []string) {
+	merged := map[string]string{}
+	var conflicts []string
+	for _, field := range []string{poolMetadataDescription, poolMetadataAutoProvision, poolMetadataAutoUpdate, poolMetadataCapabilities} {
+		localChanged := local[field] != base[field]
+		remoteChanged := remote[field] != base[field]
+		switch {
+		case local[field] == remote[field] || !remoteChanged:
+			merged[field] = local[field]
+		case !localChanged:
+			merged[field] = remote[field]
+		default:
+			conflicts = append(conflicts, field)
+			if preferLocal {
+				merged[field] = local[field]
+			} else {
+				merged[field] = remote[field]
+			}
+		}
+	}
+	return merged, conflicts
+}
+
+func equalMetadata(a, b map[string]string) bool {
+	for field, value := range a {
+		if b[field] != value {
+			return false
+		}
+	}
+	return true
+}
+
+func localPoolMetadata(pool *v1alpha1.AgentPoolSpec) map[string]string {
+	return map[string]string{
+		poolMetadataDescription:   pool.Description,
+		poolMetadataAutoProvision: formatOptionalBool(pool.AutoProvision),
+		poolMetadataAutoUpdate:    formatOptionalBool(pool.AutoUpdate),
+		poolMetadataCapabilities:  joinCapabilities(pool.Capabilities),
+	}
+}
+
+func remotePoolMetadata(pool *azureDevOpsPool) map[string]string {
+	return map[string]string{
+		poolMetadataDescription:   pool.Properties[descriptionProperty].Value,
+		poolMetadataAutoProvision: formatOptionalBool(pool.AutoProvision),
+		poolMetadataAutoUpdate:    formatOptionalBool(pool.AutoUpdate),
+		poolMetadataCapabilities:  joinCapabilities(strings.Split(pool.Properties[capabilitiesProperty].Value, ",")),
+	}
+}
+
+func applyPoolMetadata(pool *v1alpha1.AgentPoolSpec, metadata map[string]string) {
+	pool.Description = metadata[poolMetadataDescription]
+	pool.AutoProvision = parseOptionalBool(metadata[poolMetadataAutoProvision])
+	pool.AutoUpdate = parseOptionalBool(metadata[poolMetadataAutoUpdate])
+	pool.Capabilities = nil
+	if capabilities := metadata[poolMetadataCapabilities]; capabilities != "" {
+		pool.Capabilities = strings.Split(capabilities, ",")
+	}
+}
+
+// Flags which are not set are left alone in Azure DevOps, they cannot be unset there.
+func remotePoolUpdate(metadata map[string]string) azureDevOpsPool {
+	return azureDevOpsPool{
+		AutoProvision: parseOptionalBool(metadata[poolMetadataAutoProvision]),
+		AutoUpdate:    parseOptionalBool(metadata[poolMetadataAutoUpdate]),
+		Properties: map[string]azureDevOpsProperty{
+			descriptionProperty:  {Type: azureDevOpsStringType, Value: metadata[poolMetadataDescription]},
+			capabilitiesProperty: {Type: azureDevOpsStringType, Value: metadata[poolMetadataCapabilities]},
+		},
+	}
+}
+
+// Capabilities are compared as a set.
+func joinCapabilities(capabilities []string) string {
+	var trimmed []string
+	for _, capability := range capabilities {
+		if capability = strings.TrimSpace(capability); capability != "" {
+			trimmed = append(trimmed, capability)
+		}
+	}
+	sort.Strings(trimmed)
+	return strings.Join(trimmed, ",")
+}
+
+func formatOptionalBool(value *bool) string {
+	if value == nil {
+		return ""
+	}
+	return strconv.FormatBool(*value)
+}
+
+func parseOptionalBool(value string) *bool {
+	parsed, err := strconv.ParseBool(value)
+	if err != nil {
+		return nil
+	}
+	return &parsed
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"os"
+	"testing"
+
+	v1alpha1 "github.com/microsoft/poolprovider-for-k8s/pkg/apis/dev/v1alpha1"
+)
+
+func TestPoolNamespaceShouldMapPoolIdsWithNamePrefix(t *testing.T) {
+	crdobject := &v1alpha1.AzurePipelinesPool{Spec: v1alpha1.AzurePipelinesPoolSpec{
+		AgentPools: []v1alpha1.AgentPoolSpec{
+			{PoolName: "linux"},
+			{PoolName: "gpu", Namespace: "gpu-agents", AzureDevOpsPoolId: 7},
+			{PoolName: "canary", AzureDevOpsPoolId: 12},
+		},
+	}}
+
+	if namespace := poolNamespace(crdobject, &crdobject.Spec.AgentPools[2], "azuredevops"); namespace != "azuredevops" {
+		t.Errorf("Expected the webserver namespace without a name prefix. Got %s", namespace)
+	}
+
+	crdobject.Spec.NamespaceTemplate = &v1alpha1.NamespaceTemplate{NamePrefix: "ado-pool-"}
+	expected := map[string]string{"linux": "azuredevops", "gpu": "gpu-agents", "canary": "ado-pool-12"}
+	for i := range crdobject.Spec.AgentPools {
+		pool := &crdobject.Spec.AgentPools[i]
+		if namespace := poolNamespace(crdobject, pool, "azuredevops"); namespace != expected[pool.PoolName] {
+			t.Errorf("Expected namespace %s for pool %s. Got %s", expected[pool.PoolName], pool.PoolName, namespace)
+		}
+	}
+}
+
+func TestAgentNamespacesShouldIncludeProvisionedPoolNamespaces(t *testing.T) {
+	os.Setenv("STORAGE_BACKEND", "memory")
+	defer os.Unsetenv("STORAGE_BACKEND")
+	os.Setenv("FALLBACK_NAMESPACE", "fallback")
+	defer os.Unsetenv("FALLBACK_NAMESPACE")
+
+	GetStorage().Set(poolNamespaceKeyPrefix+"ado-pool-12", "canary")
+	GetStorage().Set(poolNamespaceKeyPrefix+"azuredevops", "linux")
+	defer GetStorage().Delete(poolNamespaceKeyPrefix + "ado-pool-12")
+	defer GetStorage().Delete(poolNamespaceKeyPrefix + "azuredevops")
+
+	namespaces := agentNamespaces("azuredevops")
+	if len(namespaces) != 3 || namespaces[0] != "azuredevops" || namespaces[1] != "fallback" || namespaces[2] != "ado-pool-12" {
+		t.Errorf("Expected the namespace, the fallback and the pool namespace once. Got %v", namespaces)
+	}
+}
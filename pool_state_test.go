@@ -0,0 +1,36 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestExportPoolStateShouldWriteConfigMap(t *testing.T) {
+	SetupCustomResource()
+	cs := CreateClientSet()
+	podClient := cs.clientset.CoreV1().Pods(testnamespace)
+	podClient.Create(&v1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "standby", Labels: map[string]string{standbyLabel: "linux"}}})
+	podClient.Create(&v1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "agent", Labels: map[string]string{agentIdLabel: "1", agentPoolLabel: "linux"}}})
+
+	if err := ExportPoolState(testnamespace); err != nil {
+		t.Fatalf("Export failed: (%v)", err)
+	}
+
+	configMap, err := cs.clientset.CoreV1().ConfigMaps(testnamespace).Get(poolStateConfigMap, metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("Pool state ConfigMap not created: (%v)", err)
+	}
+
+	var snapshot PoolStateSnapshot
+	json.Unmarshal([]byte(configMap.Data[poolStateKey]), &snapshot)
+	if len(snapshot.Pools) != 1 || snapshot.Pools[0].StandbyPods != 1 || snapshot.Pools[0].ActiveAgents != 1 {
+		t.Errorf("Unexpected pool state %v", snapshot)
+	}
+
+	if err := ExportPoolState(testnamespace); err != nil {
+		t.Errorf("Updating the pool state failed: (%v)", err)
+	}
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"testing"
+
+	v1alpha1 "github.com/microsoft/poolprovider-for-k8s/pkg/apis/dev/v1alpha1"
+)
+
+func TestMergePoolMetadataShouldCopyOneSidedChanges(t *testing.T) {
+	base := map[string]string{poolMetadataDescription: "Linux builds", poolMetadataAutoProvision: "true"}
+	local := map[string]string{poolMetadataDescription: "Linux and container builds", poolMetadataAutoProvision: "true"}
+	remote := map[string]string{poolMetadataDescription: "Linux builds", poolMetadataAutoProvision: "false"}
+
+	merged, conflicts := mergePoolMetadata(base, local, remote, true)
+
+	if len(conflicts) != 0 {
+		t.Errorf("Expected no conflicts. Got %v", conflicts)
+	}
+	if merged[poolMetadataDescription] != "Linux and container builds" || merged[poolMetadataAutoProvision] != "false" {
+		t.Errorf("Expected the changes of both sides. Got %v", merged)
+	}
+}
+
+func TestMergePoolMetadataShouldResolveConflictsByPreference(t *testing.T) {
+	base := map[string]string{poolMetadataDescription: "Linux builds"}
+	local := map[string]string{poolMetadataDescription: "Provider"}
+	remote := map[string]string{poolMetadataDescription: "Azure DevOps"}
+
+	merged, conflicts := mergePoolMetadata(base, local, remote, true)
+	if len(conflicts) != 1 || conflicts[0] != poolMetadataDescription || merged[poolMetadataDescription] != "Provider" {
+		t.Errorf("Expected the provider to win the conflict. Got %v %v", merged, conflicts)
+	}
+
+	merged, _ = mergePoolMetadata(base, local, remote, false)
+	if merged[poolMetadataDescription] != "Azure DevOps" {
+		t.Errorf("Expected Azure DevOps to win the conflict. Got %v", merged)
+	}
+}
+
+func TestPoolMetadataShouldRoundTrip(t *testing.T) {
+	enabled := true
+	pool := &v1alpha1.AgentPoolSpec{Description: "Linux builds", AutoProvision: &enabled, Capabilities: []string{"node=18", "docker"}}
+
+	remote := remotePoolUpdate(localPoolMetadata(pool))
+	metadata := remotePoolMetadata(&remote)
+	if metadata[poolMetadataCapabilities] != "docker,node=18" || metadata[poolMetadataAutoUpdate] != "" {
+		t.Errorf("Unexpected metadata %v", metadata)
+	}
+
+	var applied v1alpha1.AgentPoolSpec
+	applyPoolMetadata(&applied, metadata)
+	if applied.Description != "Linux builds" || applied.AutoProvision == nil || !*applied.AutoProvision || applied.AutoUpdate != nil || len(applied.Capabilities) != 2 {
+		t.Errorf("Unexpected pool %+v", applied)
+	}
+}
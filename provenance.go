@@ -0,0 +1,144 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+
+	v1alpha1 "github.com/microsoft/poolprovider-for-k8s/pkg/apis/dev/v1alpha1"
+	"github.com/microsoft/poolprovider-for-k8s/version"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// Every agent pod carries its provenance in annotations: the version of the provider, a hash of the
+// pod template of its pool, the generation of the AzurePipelinesPool it was created from and a
+// digest of the job context of the request. They are signed with VSTS_SECRET together with the
+// agent id, so GET /admin/verify-pod?namespace=<namespace>&name=<pod> can prove which configuration
+// produced the build environment of a job. Standby pods are stamped when they are created and
+// signed again for the request which claims them.
+const (
+	providerVersionAnnotation     = "poolprovider/provider-version"
+	templateHashAnnotation        = "poolprovider/template-hash"
+	configRevisionAnnotation      = "poolprovider/config-revision"
+	requestDigestAnnotation       = "poolprovider/request-digest"
+	provenanceSignatureAnnotation = "poolprovider/provenance-signature"
+)
+
+type PodProvenance struct {
+	ProviderVersion string
+	TemplateHash    string
+	ConfigRevision  string
+	RequestDigest   string `json:",omitempty"`
+}
+
+type PodVerification struct {
+	Namespace  string
+	Pod        string
+	AgentId    string `json:",omitempty"`
+	Provenance PodProvenance
+	Verified   bool
+	Reason     string `json:",omitempty"`
+}
+
+// Returns the provenance of a pod created from the pool for the request. Standby pods have no
+// request yet.
+func newPodProvenance(crdobject *v1alpha1.AzurePipelinesPool, pool *v1alpha1.AgentPoolSpec, request *AgentRequest) PodProvenance {
+	provenance := PodProvenance{ProviderVersion: version.Version}
+	if pool != nil {
+		template, _ := json.Marshal(pool.PoolSpec)
+		provenance.TemplateHash = sha256Hex(template)
+	}
+	if crdobject != nil {
+		provenance.ConfigRevision = strconv.FormatInt(crdobject.Generation, 10)
+	}
+	if request != nil {
+		provenance.RequestDigest = requestDigest(*request)
+	}
+	return provenance
+}
+
+func requestDigest(request AgentRequest) string {
+	data, _ := json.Marshal(newJobContext(request))
+	return sha256Hex(data)
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func (p PodProvenance) signedMessage(agentId string) string {
+	return strings.Join([]string{agentId, p.ProviderVersion, p.TemplateHash, p.ConfigRevision, p.RequestDigest}, "\n")
+}
+
+// Writes the provenance to the annotations of the pod and signs it for the agent. The signature is
+// left out without VSTS_SECRET.
+func stampProvenance(pod *v1.Pod, agentId string, provenance PodProvenance) {
+	if pod.ObjectMeta.Annotations == nil {
+		pod.ObjectMeta.Annotations = map[string]string{}
+	}
+	pod.Annotations[providerVersionAnnotation] = provenance.ProviderVersion
+	pod.Annotations[templateHashAnnotation] = provenance.TemplateHash
+	pod.Annotations[configRevisionAnnotation] = provenance.ConfigRevision
+	pod.Annotations[requestDigestAnnotation] = provenance.RequestDigest
+	delete(pod.Annotations, provenanceSignatureAnnotation)
+	if signature := ComputeHash(provenance.signedMessage(agentId)); signature != "" {
+		pod.Annotations[provenanceSignatureAnnotation] = signature
+	}
+}
+
+func podProvenance(pod *v1.Pod) PodProvenance {
+	return PodProvenance{
+		ProviderVersion: pod.Annotations[providerVersionAnnotation],
+		TemplateHash:    pod.Annotations[templateHashAnnotation],
+		ConfigRevision:  pod.Annotations[configRevisionAnnotation],
+		RequestDigest:   pod.Annotations[requestDigestAnnotation],
+	}
+}
+
+// Checks the provenance annotations of the pod against their signature.
+func verifyPodProvenance(pod *v1.Pod) PodVerification {
+	verification := PodVerification{
+		Namespace:  pod.GetNamespace(),
+		Pod:        pod.GetName(),
+		AgentId:    pod.Labels[agentIdLabel],
+		Provenance: podProvenance(pod),
+	}
+	signature := pod.Annotations[provenanceSignatureAnnotation]
+	switch {
+	case signature == "":
+		verification.Reason = "The pod has no signed provenance"
+	case !ValidateHash(verification.Provenance.signedMessage(verification.AgentId), signature):
+		verification.Reason = "The provenance signature does not match the annotations and agent id of the pod"
+	default:
+		verification.Verified = true
+	}
+	return verification
+}
+
+// Returns the verified provenance of an agent pod.
+func VerifyPodHandler(resp http.ResponseWriter, req *http.Request) {
+	if !isReadRequestValid(resp, req) {
+		return
+	}
+
+	namespace, name := req.URL.Query().Get("namespace"), req.URL.Query().Get("name")
+	if namespace == "" {
+		namespace = podnamespace
+	}
+	if name == "" {
+		writeJsonResponse(resp, http.StatusBadRequest, GetError(InvalidRequestError))
+		return
+	}
+
+	pod, err := CreateClientSet().clientset.CoreV1().Pods(namespace).Get(name, metav1.GetOptions{})
+	if err != nil {
+		writeJsonResponse(resp, http.StatusNotFound, GetError(err.Error()))
+		return
+	}
+	writeJsonResponse(resp, http.StatusOK, verifyPodProvenance(pod))
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"os"
+	"testing"
+
+	v1alpha1 "github.com/microsoft/poolprovider-for-k8s/pkg/apis/dev/v1alpha1"
+	"github.com/microsoft/poolprovider-for-k8s/version"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestStampProvenanceShouldBeVerifiable(t *testing.T) {
+	os.Setenv("VSTS_SECRET", "sharedsecret1234")
+	defer os.Unsetenv("VSTS_SECRET")
+
+	crdobject := &v1alpha1.AzurePipelinesPool{ObjectMeta: metav1.ObjectMeta{Generation: 3}}
+	pool := &v1alpha1.AgentPoolSpec{PoolName: "linux", PoolSpec: &v1.PodSpec{Containers: []v1.Container{{Name: "vsts-agent", Image: "agent"}}}}
+	request := AgentRequest{AgentId: "7", JobId: "j", AuthenticationToken: "secret"}
+	pod := &v1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "azure-pipelines-agent-7", Labels: GenerateLabelsForPod("7")}}
+
+	stampProvenance(pod, "7", newPodProvenance(crdobject, pool, &request))
+	verification := verifyPodProvenance(pod)
+	if !verification.Verified || verification.Provenance.ConfigRevision != "3" || verification.Provenance.ProviderVersion != version.Version {
+		t.Errorf("Expected the provenance to be verified. Got %+v", verification)
+	}
+
+	request.AuthenticationToken = "rotated"
+	if requestDigest(request) != verification.Provenance.RequestDigest {
+		t.Errorf("Expected credentials to be left out of the request digest")
+	}
+
+	pod.Annotations[configRevisionAnnotation] = "4"
+	if verification := verifyPodProvenance(pod); verification.Verified {
+		t.Errorf("Expected a changed annotation to fail the verification")
+	}
+}
+
+func TestVerifyPodProvenanceShouldRejectAnotherAgent(t *testing.T) {
+	os.Setenv("VSTS_SECRET", "sharedsecret1234")
+	defer os.Unsetenv("VSTS_SECRET")
+
+	pod := &v1.Pod{ObjectMeta: metav1.ObjectMeta{Labels: GenerateLabelsForPod("7")}}
+	stampProvenance(pod, "8", newPodProvenance(nil, nil, nil))
+	if verification := verifyPodProvenance(pod); verification.Verified {
+		t.Errorf("Expected the signature of another agent to be rejected")
+	}
+
+	delete(pod.Annotations, provenanceSignatureAnnotation)
+	if verification := verifyPodProvenance(pod); verification.Verified || verification.Reason == "" {
+		t.Errorf("Expected an unsigned pod to be reported. Got %+v", verification)
+	}
+}
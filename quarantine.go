@@ -0,0 +1,256 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// When the last QUARANTINE_THRESHOLD provisioning attempts of a pool with an agent image, 3 by
+// default, all failed for the same reason, the pool and image are quarantined: acquire requests
+// for them are rejected and no standby pods are created for them, so a broken image or template
+// does not cause a retry storm. An attempt fails when the agent pod cannot be created or its
+// containers cannot start, e.g. the image cannot be pulled, and succeeds when the pod becomes
+// ready. The recent failures are kept under "attempts:<pool>|<image>", the quarantine under
+// "quarantine:<pool>|<image>" until an operator lifts it with
+// POST /admin/quarantine?pool=<pool>&image=<image>.
+const (
+	attemptsKeyPrefix          = "attempts:"
+	quarantineKeyPrefix        = "quarantine:"
+	defaultQuarantineThreshold = 3
+	podCreationFailedReason    = "PodCreationFailed"
+)
+
+var podStartFailureReasons = map[string]bool{
+	"ErrImagePull":               true,
+	"ImagePullBackOff":           true,
+	"InvalidImageName":           true,
+	"CreateContainerConfigError": true,
+	"CreateContainerError":       true,
+	"CrashLoopBackOff":           true,
+}
+
+type QuarantineRecord struct {
+	Pool   string
+	Image  string
+	Reason string
+	Since  time.Time
+}
+
+// Pods whose outcome was recorded, so each attempt is only counted once
+var provisioningOutcomes = struct {
+	sync.Mutex
+	observed map[types.UID]bool
+}{observed: map[types.UID]bool{}}
+
+func quarantineKey(poolName string, image string) string {
+	return poolName + "|" + image
+}
+
+func quarantineThreshold() int {
+	return getEnvInt("QUARANTINE_THRESHOLD", defaultQuarantineThreshold)
+}
+
+func agentImage(pod *v1.Pod) string {
+	if pod == nil || len(pod.Spec.Containers) == 0 {
+		return ""
+	}
+	return pod.Spec.Containers[0].Image
+}
+
+func getQuarantine(poolName string, image string) (QuarantineRecord, bool) {
+	var record QuarantineRecord
+	value, err := GetStorage().Get(quarantineKeyPrefix + quarantineKey(poolName, image))
+	if err != nil || value == "" || json.Unmarshal([]byte(value), &record) != nil {
+		return record, false
+	}
+	return record, true
+}
+
+func quarantineError(record QuarantineRecord) error {
+	return errors.New("Agent pool " + record.Pool + " is quarantined for image " + record.Image +
+		", its last provisioning attempts failed with " + record.Reason)
+}
+
+// Returns the reason the pod creation failed with, e.g. "Forbidden" for a rejection by an
+// admission webhook.
+func podCreationFailure(err error) string {
+	if reason := k8serrors.ReasonForError(err); reason != "" {
+		return string(reason)
+	}
+	return podCreationFailedReason
+}
+
+// Returns why the agent pod failed to start and true, or an empty string and true when it became
+// ready. Pods still starting have no outcome yet.
+func podProvisioningOutcome(pod *v1.Pod) (string, bool) {
+	for _, status := range pod.Status.ContainerStatuses {
+		if status.State.Waiting != nil && podStartFailureReasons[status.State.Waiting.Reason] {
+			return status.State.Waiting.Reason, true
+		}
+	}
+	for _, condition := range pod.Status.Conditions {
+		if condition.Type == v1.PodReady && condition.Status == v1.ConditionTrue {
+			return "", true
+		}
+	}
+	return "", false
+}
+
+// Records the outcome of every agent pod of the pool which was not seen before.
+func observeProvisioningOutcomes(poolName string, pods []v1.Pod) {
+	for i := range pods {
+		pod := &pods[i]
+		failure, done := podProvisioningOutcome(pod)
+		if !done {
+			continue
+		}
+
+		provisioningOutcomes.Lock()
+		seen := provisioningOutcomes.observed[pod.UID]
+		if !seen {
+			if len(provisioningOutcomes.observed) >= maxObservedPods {
+				provisioningOutcomes.observed = map[types.UID]bool{}
+			}
+			provisioningOutcomes.observed[pod.UID] = true
+		}
+		provisioningOutcomes.Unlock()
+
+		if !seen {
+			recordProvisioningAttempt(poolName, agentImage(pod), failure, time.Now().UTC())
+		}
+	}
+}
+
+// Records a provisioning attempt, failure is empty when it succeeded. Quarantines the pool and
+// image when the attempt completes a run of failures with the same reason.
+func recordProvisioningAttempt(poolName string, image string, failure string, now time.Time) {
+	store := GetStorage()
+	key := attemptsKeyPrefix + quarantineKey(poolName, image)
+
+	var failures []string
+	if value, err := store.Get(key); err == nil && value != "" {
+		json.Unmarshal([]byte(value), &failures)
+	}
+	if failure == "" {
+		if len(failures) > 0 {
+			store.Delete(key)
+		}
+		return
+	}
+
+	failures, quarantine := appendFailure(failures, failure, quarantineThreshold())
+	data, _ := json.Marshal(failures)
+	if err := store.Set(key, string(data)); err != nil {
+		log.Println("Failed to record the provisioning attempt of pool "+poolName, err)
+	}
+	if quarantine {
+		quarantinePool(poolName, image, failure, now)
+	}
+}
+
+// Keeps the last threshold failures and tells whether all of them have the same reason.
+func appendFailure(failures []string, failure string, threshold int) ([]string, bool) {
+	failures = append(failures, failure)
+	if len(failures) > threshold {
+		failures = failures[len(failures)-threshold:]
+	}
+	if len(failures) < threshold {
+		return failures, false
+	}
+	for _, previous := range failures {
+		if previous != failure {
+			return failures, false
+		}
+	}
+	return failures, true
+}
+
+func quarantinePool(poolName string, image string, reason string, now time.Time) {
+	record := QuarantineRecord{Pool: poolName, Image: image, Reason: reason, Since: now}
+	data, _ := json.Marshal(record)
+	first, err := GetStorage().SetIfAbsent(quarantineKeyPrefix+quarantineKey(poolName, image), string(data))
+	if err != nil {
+		log.Println("Failed to quarantine pool "+poolName, err)
+		return
+	}
+	if first {
+		Notify(Notification{Event: "PoolQuarantined", Pool: poolName, Message: quarantineError(record).Error() +
+			", new agents are rejected until the quarantine is lifted"})
+	}
+}
+
+func listQuarantines() ([]QuarantineRecord, error) {
+	values, err := GetStorage().List(quarantineKeyPrefix)
+	if err != nil {
+		return nil, err
+	}
+	records := []QuarantineRecord{}
+	for _, value := range values {
+		var record QuarantineRecord
+		if json.Unmarshal([]byte(value), &record) == nil {
+			records = append(records, record)
+		}
+	}
+	sort.Slice(records, func(i, j int) bool { return records[i].Since.Before(records[j].Since) })
+	return records, nil
+}
+
+// Lists the quarantines on GET and lifts the quarantine of a pool and image on POST.
+func QuarantineHandler(resp http.ResponseWriter, req *http.Request) {
+	if req.Method == http.MethodGet {
+		if !isReadRequestValid(resp, req) {
+			return
+		}
+		records, err := listQuarantines()
+		if err != nil {
+			writeJsonResponse(resp, http.StatusInternalServerError, GetError(err.Error()))
+			return
+		}
+		writeJsonResponse(resp, http.StatusOK, records)
+		return
+	}
+
+	if req.Method != http.MethodPost {
+		writeJsonResponse(resp, http.StatusMethodNotAllowed, GetError(InvalidRequestError))
+		return
+	}
+	if !isRequestHmacValid(req) {
+		writeJsonResponse(resp, http.StatusForbidden, GetError(NoValidSignatureError))
+		return
+	}
+
+	poolName, image := req.URL.Query().Get("pool"), req.URL.Query().Get("image")
+	record, ok := getQuarantine(poolName, image)
+	if !ok {
+		writeJsonResponse(resp, http.StatusNotFound, GetError(UnknownQuarantineError))
+		return
+	}
+	store := GetStorage()
+	if err := store.Delete(quarantineKeyPrefix + quarantineKey(poolName, image)); err != nil {
+		writeJsonResponse(resp, http.StatusInternalServerError, GetError(err.Error()))
+		return
+	}
+	store.Delete(attemptsKeyPrefix + quarantineKey(poolName, image))
+
+	principal := adminPrincipal(req)
+	RecordAuditEntry(AuditEntry{
+		Category:  AuditCategoryConfig,
+		Principal: principal,
+		Action:    "unquarantine",
+		Target:    "pool/" + poolName + "/image/" + image,
+		Reason:    record.Reason,
+	})
+	Notify(Notification{Event: "PoolUnquarantined", Pool: poolName, Message: "Quarantine of agent pool " + poolName +
+		" for image " + image + " lifted by " + principal + " after " + strconv.Itoa(int(time.Since(record.Since).Minutes())) + " minutes"})
+	writeJsonResponse(resp, http.StatusOK, record)
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"errors"
+	"testing"
+
+	v1 "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+func TestAppendFailureShouldQuarantineOnlyARunOfTheSameReason(t *testing.T) {
+	failures, quarantine := appendFailure(nil, "ErrImagePull", 3)
+	failures, quarantine = appendFailure(failures, "Forbidden", 3)
+	failures, quarantine = appendFailure(failures, "ErrImagePull", 3)
+	if quarantine {
+		t.Errorf("Expected mixed reasons not to quarantine. Got %v", failures)
+	}
+
+	failures, quarantine = appendFailure(failures, "ErrImagePull", 3)
+	if quarantine {
+		t.Errorf("Expected an interrupted run not to quarantine. Got %v", failures)
+	}
+	failures, quarantine = appendFailure(failures, "ErrImagePull", 3)
+	if !quarantine || len(failures) != 3 {
+		t.Errorf("Expected three failures in a row to quarantine. Got %v", failures)
+	}
+}
+
+func TestPodProvisioningOutcomeShouldTellFailedReadyAndStartingPods(t *testing.T) {
+	failed := &v1.Pod{Status: v1.PodStatus{ContainerStatuses: []v1.ContainerStatus{{
+		State: v1.ContainerState{Waiting: &v1.ContainerStateWaiting{Reason: "ImagePullBackOff"}},
+	}}}}
+	if reason, done := podProvisioningOutcome(failed); !done || reason != "ImagePullBackOff" {
+		t.Errorf("Expected the pull failure. Got %q %v", reason, done)
+	}
+
+	ready := &v1.Pod{Status: v1.PodStatus{Conditions: []v1.PodCondition{{Type: v1.PodReady, Status: v1.ConditionTrue}}}}
+	if reason, done := podProvisioningOutcome(ready); !done || reason != "" {
+		t.Errorf("Expected a success. Got %q %v", reason, done)
+	}
+
+	starting := &v1.Pod{Status: v1.PodStatus{ContainerStatuses: []v1.ContainerStatus{{
+		State: v1.ContainerState{Waiting: &v1.ContainerStateWaiting{Reason: "ContainerCreating"}},
+	}}}}
+	if _, done := podProvisioningOutcome(starting); done {
+		t.Errorf("Expected no outcome for a starting pod")
+	}
+}
+
+func TestPodCreationFailureShouldUseTheApiReason(t *testing.T) {
+	if reason := podCreationFailure(k8serrors.NewForbidden(schema.GroupResource{Resource: "pods"}, "agent", errors.New("denied"))); reason != "Forbidden" {
+		t.Errorf("Expected Forbidden. Got %s", reason)
+	}
+	if reason := podCreationFailure(errors.New("connection refused")); reason != podCreationFailedReason {
+		t.Errorf("Expected %s. Got %s", podCreationFailedReason, reason)
+	}
+}
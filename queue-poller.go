@@ -0,0 +1,79 @@
+package main
+
+import (
+	"log"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/microsoft/poolprovider-for-k8s/pkg/azuredevops"
+)
+
+type jobRequestList struct {
+	Value []struct {
+		RequestId  int64  `json:"requestId"`
+		AssignTime string `json:"assignTime"`
+		FinishTime string `json:"finishTime"`
+	} `json:"value"`
+}
+
+// Polls the Azure DevOps queue of every pool which has a warm pool and an Azure DevOps pool id, and
+// hands the number of waiting jobs to the warm pool controller. Polling is off unless
+// QUEUE_POLL_INTERVAL_SECONDS is set and the Azure DevOps connection is configured.
+func RunQueuePoller(namespace string) {
+	seconds, _ := strconv.Atoi(os.Getenv("QUEUE_POLL_INTERVAL_SECONDS"))
+	if seconds <= 0 {
+		return
+	}
+
+	config := azuredevops.ConfigFromEnvironment()
+	if !config.IsConfigured() {
+		log.Println("Queue polling needs the Azure DevOps connection to be configured")
+		return
+	}
+	client := newAzureDevOpsClient(config)
+
+	for {
+		pollQueues(client, namespace)
+		time.Sleep(time.Duration(seconds) * time.Second)
+	}
+}
+
+func pollQueues(client *azuredevops.Client, namespace string) {
+	crdobject, _, err := fetchAzurePipelinesPool(namespace)
+	if err != nil {
+		log.Println("Queue poller could not fetch the pool configuration", err)
+		return
+	}
+
+	for _, pool := range crdobject.Spec.AgentPools {
+		// The scale hint is only read by the replica managing the warm pool
+		if pool.AzureDevOpsPoolId == 0 || !isWarmPoolEnabled(&pool) || !ownsPool(pool.PoolName) {
+			continue
+		}
+
+		pending, err := countPendingJobs(client, pool.AzureDevOpsPoolId)
+		if err != nil {
+			// Keep the previous hint, the warm pool should not shrink because of a failed poll
+			log.Println("Failed to poll the queue of pool "+pool.PoolName, err)
+			continue
+		}
+		SetWarmPoolScaleHint(pool.PoolName, pending)
+	}
+}
+
+// Returns the number of job requests of the pool which are neither assigned to an agent nor finished.
+func countPendingJobs(client *azuredevops.Client, poolId int32) (int, error) {
+	var requests jobRequestList
+	if err := client.Get("distributedtask/pools/"+strconv.Itoa(int(poolId))+"/jobrequests", &requests); err != nil {
+		return 0, err
+	}
+
+	pending := 0
+	for _, request := range requests.Value {
+		if request.AssignTime == "" && request.FinishTime == "" {
+			pending++
+		}
+	}
+	return pending, nil
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Signed requests are counted per tenant, the Azure DevOps account sending them, in fixed windows.
+// Going over the soft limit is only logged and counted in a metric; going over the hard limit
+// rejects the request with 429. Limits are read from RATE_LIMIT_SOFT, RATE_LIMIT_HARD and
+// RATE_LIMIT_WINDOW_SECONDS, and can be set per tenant in RATE_LIMIT_TENANTS as
+// "account=soft/hard,account2=soft/hard". A limit of 0 is no limit.
+//
+// Independently, every endpoint but the probes and the metrics counts the requests per client in
+// the same windows, and rejects requests over RATE_LIMIT_CLIENT with 429, 0 (no limit) by default.
+// The client is the address the connection comes from; behind an ingress, RATE_LIMIT_CLIENT_HEADER
+// names the header the ingress puts the address of the client into, e.g. X-Forwarded-For, of which
+// the last address is used, as that is the one the ingress added.
+const (
+	defaultTenant = "default"
+	// Windows of this many tenants or clients are kept before expired ones are dropped
+	maxRateLimitWindows = 10000
+)
+
+var clientRateLimitExempt = map[string]bool{"/healthz": true, "/readyz": true, "/metrics": true}
+
+type rateLimits struct {
+	Soft int
+	Hard int
+}
+
+type tenantWindow struct {
+	start time.Time
+	count int
+}
+
+type rateLimiter struct {
+	mu       sync.Mutex
+	window   time.Duration
+	defaults rateLimits
+	tenants  map[string]rateLimits
+	usage    map[string]*tenantWindow
+}
+
+var requestRateLimiter = newRateLimiterFromEnvironment()
+
+var clientRateLimiter = newRateLimiter(time.Duration(getEnvInt("RATE_LIMIT_WINDOW_SECONDS", 60))*time.Second, rateLimits{Hard: getEnvInt("RATE_LIMIT_CLIENT", 0)}, nil)
+
+func newRateLimiterFromEnvironment() *rateLimiter {
+	defaults := rateLimits{Soft: getEnvInt("RATE_LIMIT_SOFT", 0), Hard: getEnvInt("RATE_LIMIT_HARD", 0)}
+	window := time.Duration(getEnvInt("RATE_LIMIT_WINDOW_SECONDS", 60)) * time.Second
+	return newRateLimiter(window, defaults, parseTenantLimits(os.Getenv("RATE_LIMIT_TENANTS")))
+}
+
+func newRateLimiter(window time.Duration, defaults rateLimits, tenants map[string]rateLimits) *rateLimiter {
+	return &rateLimiter{window: window, defaults: defaults, tenants: tenants, usage: map[string]*tenantWindow{}}
+}
+
+func parseTenantLimits(value string) map[string]rateLimits {
+	tenants := map[string]rateLimits{}
+	for _, entry := range strings.Split(value, ",") {
+		parts := strings.SplitN(strings.TrimSpace(entry), "=", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		limits := strings.SplitN(parts[1], "/", 2)
+		soft, _ := strconv.Atoi(limits[0])
+		hard := 0
+		if len(limits) == 2 {
+			hard, _ = strconv.Atoi(limits[1])
+		}
+		tenants[parts[0]] = rateLimits{Soft: soft, Hard: hard}
+	}
+	return tenants
+}
+
+func (r *rateLimiter) limitsFor(tenant string) rateLimits {
+	if limits, ok := r.tenants[tenant]; ok {
+		return limits
+	}
+	return r.defaults
+}
+
+// Counts a request of the tenant and returns its limits, the requests made in the current window
+// including this one, and when the window resets.
+func (r *rateLimiter) take(tenant string, now time.Time) (rateLimits, int, time.Time) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	usage, ok := r.usage[tenant]
+	if !ok || now.Sub(usage.start) >= r.window {
+		if !ok && len(r.usage) >= maxRateLimitWindows {
+			r.dropExpiredWindows(now)
+		}
+		usage = &tenantWindow{start: now}
+		r.usage[tenant] = usage
+	}
+	usage.count++
+	return r.limitsFor(tenant), usage.count, usage.start.Add(r.window)
+}
+
+// Returns the same as take without counting a request.
+func (r *rateLimiter) peek(tenant string, now time.Time) (rateLimits, int, time.Time) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	usage, ok := r.usage[tenant]
+	if !ok || now.Sub(usage.start) >= r.window {
+		return r.limitsFor(tenant), 0, now.Add(r.window)
+	}
+	return r.limitsFor(tenant), usage.count, usage.start.Add(r.window)
+}
+
+func (r *rateLimiter) dropExpiredWindows(now time.Time) {
+	for key, usage := range r.usage {
+		if now.Sub(usage.start) >= r.window {
+			delete(r.usage, key)
+		}
+	}
+}
+
+// Wraps a handler with the per tenant rate limits and adds the X-RateLimit headers to its responses.
+// Only requests with a valid signature are counted, as the account of an unsigned body is whatever
+// the sender claims; the others get the headers of the default tenant and are rejected by the handler.
+// Tenants without limits get an X-RateLimit-Limit of 0.
+func withRateLimit(limiter *rateLimiter, handler http.HandlerFunc) http.HandlerFunc {
+	return func(resp http.ResponseWriter, req *http.Request) {
+		signed := isRequestHmacValid(req)
+		tenant := defaultTenant
+		if signed {
+			tenant = requestTenant(req)
+		}
+
+		var limits rateLimits
+		var count int
+		var reset time.Time
+		if signed {
+			limits, count, reset = limiter.take(tenant, time.Now())
+		} else {
+			limits, count, reset = limiter.peek(tenant, time.Now())
+		}
+
+		limit := limits.Hard
+		if limit == 0 {
+			limit = limits.Soft
+		}
+		resp.Header().Set("X-RateLimit-Limit", strconv.Itoa(limit))
+		resp.Header().Set("X-RateLimit-Reset", strconv.FormatInt(reset.Unix(), 10))
+		if limit == 0 {
+			handler(resp, req)
+			return
+		}
+
+		remaining := limit - count
+		if remaining < 0 {
+			remaining = 0
+		}
+		resp.Header().Set("X-RateLimit-Remaining", strconv.Itoa(remaining))
+
+		if !signed {
+			handler(resp, req)
+			return
+		}
+		if limits.Hard > 0 && count > limits.Hard {
+			log.Println("Hard rate limit exceeded for tenant " + tenant)
+			rateLimitExceeded.WithLabelValues(tenant, "hard").Inc()
+			resp.Header().Set("Retry-After", strconv.Itoa(int(time.Until(reset).Seconds())+1))
+			writeJsonResponse(resp, http.StatusTooManyRequests, GetError(RateLimitExceededError))
+			return
+		}
+		if limits.Soft > 0 && count > limits.Soft {
+			log.Println("Soft rate limit exceeded for tenant " + tenant)
+			rateLimitExceeded.WithLabelValues(tenant, "soft").Inc()
+		}
+		handler(resp, req)
+	}
+}
+
+// The tenant is the AccountId of the request body, which the signature of the body vouches for. The
+// body is put back for the handler.
+func requestTenant(req *http.Request) string {
+	if req.Body == nil {
+		return defaultTenant
+	}
+	requestBody, _ := ioutil.ReadAll(req.Body)
+	req.Body = ioutil.NopCloser(bytes.NewBuffer(requestBody))
+
+	var request struct{ AccountId string }
+	if json.Unmarshal(requestBody, &request) != nil || request.AccountId == "" {
+		return defaultTenant
+	}
+	return request.AccountId
+}
+
+// Wraps the server with the per client rate limit. Only going over the limit is logged, once per
+// window, as floods would otherwise flood the log too.
+func withClientRateLimit(limiter *rateLimiter, clientHeader string, handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		if limiter.defaults.Hard == 0 || clientRateLimitExempt[req.URL.Path] {
+			handler.ServeHTTP(resp, req)
+			return
+		}
+		client := requestClient(req, clientHeader)
+		limits, count, reset := limiter.take(client, time.Now())
+		if count > limits.Hard {
+			if count == limits.Hard+1 {
+				log.Println("Rate limit exceeded for client " + client)
+			}
+			clientRateLimitExceeded.Inc()
+			resp.Header().Set("Retry-After", strconv.Itoa(int(time.Until(reset).Seconds())+1))
+			writeJsonResponse(resp, http.StatusTooManyRequests, GetError(RateLimitExceededError))
+			return
+		}
+		handler.ServeHTTP(resp, req)
+	})
+}
+
+// The client is the last address of the header when set, the remote address of the connection otherwise.
+func requestClient(req *http.Request, clientHeader string) string {
+	if clientHeader != "" {
+		if value := req.Header.Get(clientHeader); value != "" {
+			addresses := strings.Split(value, ",")
+			return strings.TrimSpace(addresses[len(addresses)-1])
+		}
+	}
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return req.RemoteAddr
+	}
+	return host
+}
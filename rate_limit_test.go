@@ -0,0 +1,126 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestRateLimitShouldRejectOverHardLimit(t *testing.T) {
+	limiter := newRateLimiter(time.Minute, rateLimits{Soft: 1, Hard: 2}, parseTenantLimits("big=10/20"))
+	handler := withRateLimit(limiter, func(resp http.ResponseWriter, req *http.Request) {
+		resp.WriteHeader(http.StatusCreated)
+	})
+
+	var codes []int
+	for i := 0; i < 3; i++ {
+		req := signedRateLimitRequest(`{"AgentId":"1","AccountId":"small"}`)
+		resp := httptest.NewRecorder()
+		handler(resp, req)
+		codes = append(codes, resp.Code)
+
+		if resp.Header().Get("X-RateLimit-Limit") != "2" {
+			t.Errorf("Expected limit header 2. Got %s", resp.Header().Get("X-RateLimit-Limit"))
+		}
+	}
+
+	if codes[0] != http.StatusCreated || codes[1] != http.StatusCreated || codes[2] != http.StatusTooManyRequests {
+		t.Errorf("Unexpected status codes %v", codes)
+	}
+
+	req := signedRateLimitRequest(`{"AgentId":"1","AccountId":"big"}`)
+	resp := httptest.NewRecorder()
+	handler(resp, req)
+	if resp.Code != http.StatusCreated || resp.Header().Get("X-RateLimit-Remaining") != "19" {
+		t.Errorf("Tenant limits must be applied per tenant. Got %d %s", resp.Code, resp.Header().Get("X-RateLimit-Remaining"))
+	}
+}
+
+func signedRateLimitRequest(body string) *http.Request {
+	os.Setenv("VSTS_SECRET", "sharedsecret1234")
+	req, _ := http.NewRequest("POST", "/acquire", bytes.NewBuffer([]byte(body)))
+	req.Header.Add(signatureHeader, ComputeHash(body))
+	return req
+}
+
+func TestRateLimitShouldPassThroughWithoutLimits(t *testing.T) {
+	limiter := newRateLimiter(time.Minute, rateLimits{}, nil)
+	handler := withRateLimit(limiter, func(resp http.ResponseWriter, req *http.Request) {})
+
+	resp := httptest.NewRecorder()
+	handler(resp, signedRateLimitRequest(`{}`))
+	if resp.Header().Get("X-RateLimit-Limit") != "0" || resp.Header().Get("X-RateLimit-Reset") == "" {
+		t.Errorf("Expected a limit of 0 without limits. Got %v", resp.Header())
+	}
+}
+
+func TestRateLimitShouldNotCountUnsignedRequests(t *testing.T) {
+	limiter := newRateLimiter(time.Minute, rateLimits{Hard: 1}, nil)
+	handler := withRateLimit(limiter, func(resp http.ResponseWriter, req *http.Request) {
+		resp.WriteHeader(http.StatusForbidden)
+	})
+
+	// Unsigned requests naming the account must not use up its limit
+	for i := 0; i < 3; i++ {
+		req, _ := http.NewRequest("POST", "/acquire", bytes.NewBuffer([]byte(`{"AccountId":"victim"}`)))
+		resp := httptest.NewRecorder()
+		handler(resp, req)
+		if resp.Code != http.StatusForbidden || resp.Header().Get("X-RateLimit-Remaining") != "1" {
+			t.Errorf("Expected the unsigned request to reach the handler with the headers. Got %d %v", resp.Code, resp.Header())
+		}
+	}
+
+	resp := httptest.NewRecorder()
+	handler(resp, signedRateLimitRequest(`{"AccountId":"victim"}`))
+	if resp.Code != http.StatusForbidden || resp.Header().Get("X-RateLimit-Remaining") != "0" {
+		t.Errorf("Expected the first signed request of the account to pass. Got %d %v", resp.Code, resp.Header())
+	}
+}
+
+func TestClientRateLimitShouldLimitEachClient(t *testing.T) {
+	limiter := newRateLimiter(time.Minute, rateLimits{Hard: 1}, nil)
+	handler := withClientRateLimit(limiter, "X-Forwarded-For", http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {}))
+	request := func(path string, remoteAddr string, forwardedFor string) int {
+		req := httptest.NewRequest("GET", path, nil)
+		req.RemoteAddr = remoteAddr
+		if forwardedFor != "" {
+			req.Header.Set("X-Forwarded-For", forwardedFor)
+		}
+		resp := httptest.NewRecorder()
+		handler.ServeHTTP(resp, req)
+		return resp.Code
+	}
+
+	if code := request("/pools", "10.0.0.1:1234", ""); code != http.StatusOK {
+		t.Errorf("Expected the first request passed. Got %d", code)
+	}
+	if code := request("/pools", "10.0.0.1:5678", ""); code != http.StatusTooManyRequests {
+		t.Errorf("Expected the second request of the client rejected. Got %d", code)
+	}
+	if code := request("/healthz", "10.0.0.1:5678", ""); code != http.StatusOK {
+		t.Errorf("Expected the probes never limited. Got %d", code)
+	}
+	// The ingress adds the address of the client last, the first may be made up by the client
+	if code := request("/pools", "10.0.0.1:1234", "10.0.0.1, 192.168.1.7"); code != http.StatusOK {
+		t.Errorf("Expected clients behind the ingress told apart. Got %d", code)
+	}
+	if code := request("/pools", "10.0.0.1:1234", "192.168.1.9, 192.168.1.7"); code != http.StatusTooManyRequests {
+		t.Errorf("Expected the address added by the ingress used. Got %d", code)
+	}
+}
+
+func TestRateLimiterShouldDropExpiredWindows(t *testing.T) {
+	limiter := newRateLimiter(time.Minute, rateLimits{Hard: 1}, nil)
+	now := time.Date(2026, 10, 15, 12, 0, 0, 0, time.UTC)
+	for i := 0; i < maxRateLimitWindows; i++ {
+		limiter.take(strconv.Itoa(i), now)
+	}
+	limiter.take("late", now.Add(2*time.Minute))
+	if len(limiter.usage) != 1 {
+		t.Errorf("Expected only the window of the new client kept. Got %d", len(limiter.usage))
+	}
+}
@@ -0,0 +1,291 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/microsoft/poolprovider-for-k8s/pkg/azuredevops"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// The reconciliation report compares the agents the provider keeps state for, the agent pods and
+// the agents registered in the Azure DevOps pools, and lists where they disagree. Agents of
+// acquire requests still in flight are left out, as are pods younger than
+// RECONCILE_GRACE_SECONDS, 10 minutes by default, whose agent may not have registered yet. The
+// Azure DevOps side is only compared for pools with an Azure DevOps pool id when the connection
+// is configured. With ?fix=true the remediations which cannot break a running job are applied.
+const (
+	DiscrepancyUntrackedPod      = "untracked-pod"
+	DiscrepancyMissingPod        = "missing-pod"
+	DiscrepancyAgentWithoutPod   = "agent-without-pod"
+	DiscrepancyUnregisteredPod   = "unregistered-pod"
+	ReconcileRestoreState        = "restore-state"
+	ReconcileForgetState         = "forget-state"
+	ReconcileDeletePod           = "delete-pod"
+	ReconcileRemoveAgent         = "remove-agent"
+	defaultReconcileGrace        = 600
+	azureDevOpsAgentOfflineState = "offline"
+)
+
+type Discrepancy struct {
+	AgentId   string
+	Kind      string
+	Pool      string `json:",omitempty"`
+	Namespace string `json:",omitempty"`
+	PodName   string `json:",omitempty"`
+	Action    string
+	// Safe actions are applied by ?fix=true, the others are left to an operator
+	Safe     bool
+	Fixed    bool   `json:",omitempty"`
+	FixError string `json:",omitempty"`
+	poolId   int32
+}
+
+type ReconcileReport struct {
+	GeneratedAt time.Time
+	// Pools whose Azure DevOps agents were compared
+	CheckedPools  []string
+	Discrepancies []Discrepancy
+}
+
+type inventoryPod struct {
+	Name      string
+	Namespace string
+	Pool      string
+	Created   time.Time
+}
+
+type registeredAgent struct {
+	Pool   string
+	PoolId int32
+	Status string
+}
+
+type agentInventory struct {
+	State    map[string]bool
+	InFlight map[string]bool
+	Pods     map[string]inventoryPod
+	Agents   map[string]registeredAgent
+	// Pools whose registered agents could be listed
+	CheckedPools map[string]bool
+}
+
+type azureDevOpsAgentList struct {
+	Value []struct {
+		Id     int    `json:"id"`
+		Status string `json:"status"`
+	} `json:"value"`
+}
+
+// Returns the report, applying the safe remediations when fix=true.
+func ReconcileHandler(resp http.ResponseWriter, req *http.Request) {
+	if !isReadRequestValid(resp, req) {
+		return
+	}
+
+	var client *azuredevops.Client
+	if config := azuredevops.ConfigFromEnvironment(); config.IsConfigured() {
+		client = newAzureDevOpsClient(config)
+	}
+
+	report, err := buildReconcileReport(client, podnamespace)
+	if err != nil {
+		writeJsonResponse(resp, http.StatusInternalServerError, GetError(err.Error()))
+		return
+	}
+	if req.URL.Query().Get("fix") == "true" {
+		principal := adminPrincipal(req)
+		for i := range report.Discrepancies {
+			applyRemediation(client, &report.Discrepancies[i], principal)
+		}
+	}
+	writeJsonResponse(resp, http.StatusOK, report)
+}
+
+func buildReconcileReport(client *azuredevops.Client, namespace string) (ReconcileReport, error) {
+	inventory, err := collectInventory(client, namespace)
+	if err != nil {
+		return ReconcileReport{}, err
+	}
+
+	report := ReconcileReport{GeneratedAt: time.Now().UTC(), CheckedPools: []string{}}
+	for pool := range inventory.CheckedPools {
+		report.CheckedPools = append(report.CheckedPools, pool)
+	}
+	sort.Strings(report.CheckedPools)
+
+	grace := time.Duration(getEnvInt("RECONCILE_GRACE_SECONDS", defaultReconcileGrace)) * time.Second
+	report.Discrepancies = reconcileInventory(inventory, report.GeneratedAt, grace)
+	return report, nil
+}
+
+func collectInventory(client *azuredevops.Client, namespace string) (agentInventory, error) {
+	inventory := agentInventory{
+		State:        map[string]bool{},
+		InFlight:     map[string]bool{},
+		Pods:         map[string]inventoryPod{},
+		Agents:       map[string]registeredAgent{},
+		CheckedPools: map[string]bool{},
+	}
+
+	records, err := GetStorage().List(dedupeKeyPrefix)
+	if err != nil {
+		return inventory, err
+	}
+	for key := range records {
+		inventory.State[strings.TrimPrefix(key, dedupeKeyPrefix)] = true
+	}
+	entries, err := GetStorage().List(journalKeyPrefix)
+	if err != nil {
+		return inventory, err
+	}
+	for key := range entries {
+		inventory.InFlight[strings.TrimPrefix(key, journalKeyPrefix)] = true
+	}
+
+	cs := CreateClientSet()
+	namespaces := agentNamespaces(namespace)
+	for _, ns := range namespaces {
+		pods, err := cs.clientset.CoreV1().Pods(ns).List(metav1.ListOptions{LabelSelector: agentIdLabel})
+		if err != nil {
+			return inventory, err
+		}
+		for _, pod := range pods.Items {
+			inventory.Pods[pod.Labels[agentIdLabel]] = inventoryPod{
+				Name:      pod.GetName(),
+				Namespace: ns,
+				Pool:      pod.Labels[agentPoolLabel],
+				Created:   pod.GetCreationTimestamp().Time,
+			}
+		}
+	}
+
+	if client == nil {
+		return inventory, nil
+	}
+	crdobject, _, err := fetchAzurePipelinesPool(namespace)
+	if err != nil {
+		return inventory, err
+	}
+	for _, pool := range crdobject.Spec.AgentPools {
+		if pool.AzureDevOpsPoolId == 0 {
+			continue
+		}
+		var agents azureDevOpsAgentList
+		if err := client.Get(azureDevOpsAgentsPath(pool.AzureDevOpsPoolId), &agents); err != nil {
+			log.Println("Failed to list the Azure DevOps agents of pool "+pool.PoolName, err)
+			continue
+		}
+		inventory.CheckedPools[pool.PoolName] = true
+		for _, agent := range agents.Value {
+			inventory.Agents[strconv.Itoa(agent.Id)] = registeredAgent{Pool: pool.PoolName, PoolId: pool.AzureDevOpsPoolId, Status: agent.Status}
+		}
+	}
+	return inventory, nil
+}
+
+func azureDevOpsAgentsPath(poolId int32) string {
+	return "distributedtask/pools/" + strconv.Itoa(int(poolId)) + "/agents"
+}
+
+// Compares the three sides agent by agent. The discrepancies are sorted by agent.
+func reconcileInventory(inventory agentInventory, now time.Time, grace time.Duration) []Discrepancy {
+	agentIds := map[string]bool{}
+	for agentId := range inventory.State {
+		agentIds[agentId] = true
+	}
+	for agentId := range inventory.Pods {
+		agentIds[agentId] = true
+	}
+	for agentId := range inventory.Agents {
+		agentIds[agentId] = true
+	}
+
+	discrepancies := []Discrepancy{}
+	for agentId := range agentIds {
+		if inventory.InFlight[agentId] {
+			continue
+		}
+		pod, hasPod := inventory.Pods[agentId]
+		agent, registered := inventory.Agents[agentId]
+		hasState := inventory.State[agentId]
+		settled := hasPod && now.Sub(pod.Created) >= grace
+		checked := hasPod && inventory.CheckedPools[pod.Pool]
+
+		discrepancy := Discrepancy{AgentId: agentId, Pool: pod.Pool, Namespace: pod.Namespace, PodName: pod.Name}
+		switch {
+		case hasPod && registered && !hasState:
+			// The pod runs a registered agent, only the state of the provider got lost
+			discrepancy.Kind, discrepancy.Action, discrepancy.Safe = DiscrepancyUntrackedPod, ReconcileRestoreState, true
+		case hasPod && !registered && checked && settled:
+			kind := DiscrepancyUnregisteredPod
+			if !hasState {
+				kind = DiscrepancyUntrackedPod
+			}
+			// No agent can run a job on the pod any more
+			discrepancy.Kind, discrepancy.Action, discrepancy.Safe = kind, ReconcileDeletePod, true
+		case hasPod && !hasState && !checked && settled:
+			// Without Azure DevOps to ask, the pod may still run a job
+			discrepancy.Kind, discrepancy.Action = DiscrepancyUntrackedPod, ReconcileDeletePod
+		case !hasPod && registered:
+			// Only an offline agent can be removed without failing a job
+			discrepancy.Kind, discrepancy.Action, discrepancy.Safe = DiscrepancyAgentWithoutPod, ReconcileRemoveAgent, agent.Status == azureDevOpsAgentOfflineState
+			discrepancy.Pool, discrepancy.poolId = agent.Pool, agent.PoolId
+		case !hasPod && hasState:
+			discrepancy.Kind, discrepancy.Action, discrepancy.Safe = DiscrepancyMissingPod, ReconcileForgetState, true
+		default:
+			continue
+		}
+		discrepancies = append(discrepancies, discrepancy)
+	}
+
+	sort.Slice(discrepancies, func(i, j int) bool { return discrepancies[i].AgentId < discrepancies[j].AgentId })
+	return discrepancies
+}
+
+// Applies the action of a safe discrepancy and records it in the audit log.
+func applyRemediation(client *azuredevops.Client, discrepancy *Discrepancy, principal string) {
+	if !discrepancy.Safe {
+		return
+	}
+
+	var err error
+	switch discrepancy.Action {
+	case ReconcileRestoreState:
+		StoreAcquireResult(discrepancy.AgentId, AgentProvisionResponse{Accepted: true, ResponseType: "Success"})
+	case ReconcileForgetState:
+		ForgetAcquireRequest(discrepancy.AgentId)
+	case ReconcileDeletePod:
+		deleteAgentResources(discrepancy.AgentId, discrepancy.Namespace, "")
+		ForgetAcquireRequest(discrepancy.AgentId)
+	case ReconcileRemoveAgent:
+		err = removeRegisteredAgent(client, discrepancy)
+	}
+
+	if err != nil {
+		log.Println("Failed to "+discrepancy.Action+" for agent "+discrepancy.AgentId, err)
+		discrepancy.FixError = err.Error()
+		return
+	}
+	discrepancy.Fixed = true
+	log.Println("Reconciliation applied " + discrepancy.Action + " for agent " + discrepancy.AgentId)
+	RecordAuditEntry(AuditEntry{
+		Category:  AuditCategoryConfig,
+		Principal: principal,
+		Action:    "reconcile-" + discrepancy.Action,
+		Target:    "agent/" + discrepancy.AgentId,
+		Reason:    discrepancy.Kind,
+	})
+}
+
+func removeRegisteredAgent(client *azuredevops.Client, discrepancy *Discrepancy) error {
+	if client == nil {
+		return errors.New("Azure DevOps connection is not configured")
+	}
+	return client.Send(http.MethodDelete, azureDevOpsAgentsPath(discrepancy.poolId)+"/"+discrepancy.AgentId, nil, nil)
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestReconcileInventoryShouldReportEachKindOfDiscrepancy(t *testing.T) {
+	now := time.Now()
+	old := now.Add(-time.Hour)
+	inventory := agentInventory{
+		State:    map[string]bool{"1": true, "3": true, "5": true, "6": true},
+		InFlight: map[string]bool{"6": true},
+		Pods: map[string]inventoryPod{
+			"1": {Name: "agent-1", Namespace: "azuredevops", Pool: "linux", Created: old},
+			"2": {Name: "agent-2", Namespace: "azuredevops", Pool: "linux", Created: old},
+			"3": {Name: "agent-3", Namespace: "azuredevops", Pool: "linux", Created: old},
+		},
+		Agents: map[string]registeredAgent{
+			"1": {Pool: "linux", PoolId: 10, Status: "online"},
+			"2": {Pool: "linux", PoolId: 10, Status: "online"},
+			"4": {Pool: "linux", PoolId: 10, Status: "offline"},
+		},
+		CheckedPools: map[string]bool{"linux": true},
+	}
+
+	discrepancies := reconcileInventory(inventory, now, 10*time.Minute)
+
+	expected := []Discrepancy{
+		{AgentId: "2", Kind: DiscrepancyUntrackedPod, Action: ReconcileRestoreState, Safe: true},
+		{AgentId: "3", Kind: DiscrepancyUnregisteredPod, Action: ReconcileDeletePod, Safe: true},
+		{AgentId: "4", Kind: DiscrepancyAgentWithoutPod, Action: ReconcileRemoveAgent, Safe: true},
+		{AgentId: "5", Kind: DiscrepancyMissingPod, Action: ReconcileForgetState, Safe: true},
+	}
+	if len(discrepancies) != len(expected) {
+		t.Fatalf("Expected %d discrepancies. Got %+v", len(expected), discrepancies)
+	}
+	for i, discrepancy := range discrepancies {
+		if discrepancy.AgentId != expected[i].AgentId || discrepancy.Kind != expected[i].Kind ||
+			discrepancy.Action != expected[i].Action || discrepancy.Safe != expected[i].Safe {
+			t.Errorf("Expected %+v. Got %+v", expected[i], discrepancy)
+		}
+	}
+	if discrepancies[2].poolId != 10 {
+		t.Errorf("Expected the Azure DevOps pool of the agent to be kept. Got %d", discrepancies[2].poolId)
+	}
+}
+
+func TestReconcileInventoryShouldNotRemoveOnlineAgents(t *testing.T) {
+	inventory := agentInventory{
+		Agents:       map[string]registeredAgent{"4": {Pool: "linux", PoolId: 10, Status: "online"}},
+		CheckedPools: map[string]bool{"linux": true},
+	}
+
+	discrepancies := reconcileInventory(inventory, time.Now(), time.Minute)
+
+	if len(discrepancies) != 1 || discrepancies[0].Action != ReconcileRemoveAgent || discrepancies[0].Safe {
+		t.Errorf("Expected removing an online agent to be left to an operator. Got %+v", discrepancies)
+	}
+}
+
+func TestReconcileInventoryShouldWaitForYoungPods(t *testing.T) {
+	now := time.Now()
+	inventory := agentInventory{
+		State:        map[string]bool{"1": true},
+		Pods:         map[string]inventoryPod{"1": {Name: "agent-1", Pool: "linux", Created: now.Add(-time.Minute)}},
+		CheckedPools: map[string]bool{"linux": true},
+	}
+
+	if discrepancies := reconcileInventory(inventory, now, 10*time.Minute); len(discrepancies) != 0 {
+		t.Errorf("Expected a pod within the grace period to be left alone. Got %+v", discrepancies)
+	}
+}
+
+func TestReconcileInventoryShouldNotDeleteUntrackedPodsOfUncheckedPools(t *testing.T) {
+	now := time.Now()
+	inventory := agentInventory{
+		Pods: map[string]inventoryPod{"1": {Name: "agent-1", Pool: "windows", Created: now.Add(-time.Hour)}},
+	}
+
+	discrepancies := reconcileInventory(inventory, now, 10*time.Minute)
+
+	if len(discrepancies) != 1 || discrepancies[0].Kind != DiscrepancyUntrackedPod || discrepancies[0].Safe {
+		t.Errorf("Expected an untracked pod which is not safe to delete. Got %+v", discrepancies)
+	}
+}
+
+func TestCountDiscrepanciesShouldResetKindsWithoutDiscrepancies(t *testing.T) {
+	counts := countDiscrepancies([]Discrepancy{
+		{AgentId: "1", Kind: DiscrepancyMissingPod},
+		{AgentId: "2", Kind: DiscrepancyMissingPod},
+		{AgentId: "3", Kind: DiscrepancyUntrackedPod},
+	})
+
+	if counts[DiscrepancyMissingPod] != 2 || counts[DiscrepancyUntrackedPod] != 1 {
+		t.Errorf("Expected the discrepancies counted by kind. Got %v", counts)
+	}
+	if count, ok := counts[DiscrepancyAgentWithoutPod]; !ok || count != 0 {
+		t.Errorf("Expected kinds without discrepancies to be counted as zero. Got %v", counts)
+	}
+}
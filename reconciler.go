@@ -0,0 +1,78 @@
+package main
+
+import (
+	"log"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/microsoft/poolprovider-for-k8s/pkg/azuredevops"
+)
+
+// With RECONCILE_INTERVAL_SECONDS the leader builds the reconciliation report at that interval and
+// applies the safe remediations on its own: pods without a usable agent are deleted, state of
+// pods which are gone is forgotten, lost state of running agents is restored and offline agents
+// without a pod are removed. The others stay in the report for an operator. The discrepancies
+// found by kind are exported as metrics, so drift can be alerted on. Agent pods are created per
+// acquire request of Azure DevOps, so there is no desired count of agents to re-create; the warm
+// pool controller keeps the standby pods at their count.
+const reconcilerPrincipal = "reconciler"
+
+var reconcileDiscrepancyKinds = []string{DiscrepancyUntrackedPod, DiscrepancyMissingPod, DiscrepancyAgentWithoutPod, DiscrepancyUnregisteredPod}
+
+func RunReconciler(namespace string) {
+	seconds, _ := strconv.Atoi(os.Getenv("RECONCILE_INTERVAL_SECONDS"))
+	if seconds <= 0 {
+		return
+	}
+
+	for {
+		if IsLeader() {
+			var client *azuredevops.Client
+			if config := azuredevops.ConfigFromEnvironment(); config.IsConfigured() {
+				client = newAzureDevOpsClient(config)
+			}
+			if err := reconcileOnce(client, namespace); err != nil {
+				log.Println("Reconciliation failed", err)
+			}
+		}
+		time.Sleep(time.Duration(seconds) * time.Second)
+	}
+}
+
+func reconcileOnce(client *azuredevops.Client, namespace string) error {
+	report, err := buildReconcileReport(client, namespace)
+	if err != nil {
+		return err
+	}
+
+	for kind, count := range countDiscrepancies(report.Discrepancies) {
+		reconcileDiscrepancies.WithLabelValues(kind).Set(float64(count))
+	}
+	for i := range report.Discrepancies {
+		discrepancy := &report.Discrepancies[i]
+		log.Println("Reconciliation found " + discrepancy.Kind + " for agent " + discrepancy.AgentId + " in pool " + discrepancy.Pool)
+		if !discrepancy.Safe {
+			continue
+		}
+		applyRemediation(client, discrepancy, reconcilerPrincipal)
+		result := "fixed"
+		if !discrepancy.Fixed {
+			result = "failed"
+		}
+		reconcileRemediations.WithLabelValues(discrepancy.Action, result).Inc()
+	}
+	return nil
+}
+
+// Counts the discrepancies by kind, kinds without any are counted as zero so their gauge is reset.
+func countDiscrepancies(discrepancies []Discrepancy) map[string]int {
+	counts := map[string]int{}
+	for _, kind := range reconcileDiscrepancyKinds {
+		counts[kind] = 0
+	}
+	for _, discrepancy := range discrepancies {
+		counts[discrepancy.Kind]++
+	}
+	return counts
+}
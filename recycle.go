@@ -0,0 +1,283 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	v1alpha1 "github.com/microsoft/poolprovider-for-k8s/pkg/apis/dev/v1alpha1"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// The recycle window replaces long-lived agent pods in batches. Idle standby pods are deleted and
+// the warm pool controller starts fresh ones; the next batch only starts once the replacements are
+// running, so the pool never loses more than MaxParallel pods at once.
+var (
+	recycleCheckInterval = 30 * time.Second
+	recycleBatchTimeout  = 10 * time.Minute
+	recyclePollInterval  = 5 * time.Second
+)
+
+var recycleState = struct {
+	sync.Mutex
+	running       bool
+	lastTriggered time.Time
+}{}
+
+// Starts a recycle pass whenever the schedule of the custom resource matches. Only the leader
+// recycles, so replicas do not delete the same pods twice.
+func RunRecycleScheduler(namespace string) {
+	for {
+		if IsLeader() {
+			checkRecycleWindow(namespace, time.Now().UTC())
+		}
+		time.Sleep(recycleCheckInterval)
+	}
+}
+
+func checkRecycleWindow(namespace string, now time.Time) {
+	crdobject, _, err := fetchAzurePipelinesPool(namespace)
+	if err != nil || crdobject.Spec.Recycle == nil {
+		return
+	}
+
+	window := *crdobject.Spec.Recycle
+	schedule, err := parseCronSchedule(window.Schedule)
+	if err != nil {
+		log.Println("Invalid recycle schedule "+window.Schedule, err)
+		return
+	}
+
+	minute := now.Truncate(time.Minute)
+	if !schedule.matches(minute) {
+		return
+	}
+
+	recycleState.Lock()
+	if recycleState.running || recycleState.lastTriggered.Equal(minute) {
+		recycleState.Unlock()
+		return
+	}
+	recycleState.running = true
+	recycleState.lastTriggered = minute
+	recycleState.Unlock()
+
+	go func() {
+		defer func() {
+			recycleState.Lock()
+			recycleState.running = false
+			recycleState.Unlock()
+		}()
+		RecycleAgents(namespace, window)
+	}()
+}
+
+// Recycles the agent pods older than the maximum age of the window, a batch at a time. Returns the
+// number of recycled pods.
+func RecycleAgents(namespace string, window v1alpha1.RecycleWindow) int {
+	parallel := int(window.MaxParallel)
+	if parallel <= 0 {
+		parallel = 1
+	}
+	maxAge := time.Duration(window.MaxAgeHours) * time.Hour
+	started := time.Now()
+	recycled := 0
+
+	cs := CreateClientSet()
+	podClient := cs.clientset.CoreV1().Pods(namespace)
+
+	log.Println("Recycle window started for agent pods older than " + maxAge.String())
+	for IsLeader() {
+		pods, err := podClient.List(metav1.ListOptions{})
+		if err != nil {
+			log.Println("Recycle window could not list the agent pods", err)
+			break
+		}
+
+		// Pods started during the window are never candidates, so the pass ends
+		idle, busy := selectRecycleCandidates(pods.Items, started.Add(-maxAge))
+		if len(idle) == 0 {
+			if busy > 0 {
+				log.Println(strconv.Itoa(busy) + " agent pods past the maximum age are running jobs, they are removed on release")
+			}
+			break
+		}
+
+		if len(idle) > parallel {
+			idle = idle[:parallel]
+		}
+		for _, pod := range idle {
+			log.Println("Recycling agent pod " + pod.GetName())
+			if err := podClient.Delete(pod.GetName(), &metav1.DeleteOptions{}); err != nil {
+				log.Println("Failed to recycle agent pod "+pod.GetName(), err)
+				continue
+			}
+			recycled++
+			agentsRecycled.Inc()
+			agentPodsDeleted.WithLabelValues("recycle").Inc()
+		}
+
+		if err := ReconcileWarmPools(namespace); err != nil {
+			log.Println("Warm pool reconcile failed during recycle", err)
+		}
+		if !waitForStandbyPods(namespace) {
+			log.Println("Replacement standby pods did not get ready, stopping the recycle window")
+			break
+		}
+	}
+
+	log.Println("Recycle window finished, " + strconv.Itoa(recycled) + " agent pods recycled")
+	return recycled
+}
+
+// Splits the agent pods created before the cutoff into idle standby pods, oldest first, and the
+// number of pods which are assigned to an agent and so running a job.
+func selectRecycleCandidates(pods []v1.Pod, cutoff time.Time) ([]v1.Pod, int) {
+	var idle []v1.Pod
+	busy := 0
+
+	for _, pod := range pods {
+		if pod.GetDeletionTimestamp() != nil || !pod.GetCreationTimestamp().Time.Before(cutoff) {
+			continue
+		}
+		labels := pod.GetLabels()
+		if labels[agentIdLabel] != "" {
+			busy++
+		} else if labels[standbyLabel] != "" {
+			idle = append(idle, pod)
+		}
+	}
+
+	sort.SliceStable(idle, func(i, j int) bool {
+		return idle[i].GetCreationTimestamp().Time.Before(idle[j].GetCreationTimestamp().Time)
+	})
+	return idle, busy
+}
+
+// Waits until every standby pod is running, or the batch timeout passes.
+func waitForStandbyPods(namespace string) bool {
+	podClient := CreateClientSet().clientset.CoreV1().Pods(namespace)
+	deadline := time.Now().Add(recycleBatchTimeout)
+
+	for time.Now().Before(deadline) {
+		pods, err := podClient.List(metav1.ListOptions{LabelSelector: standbyLabel})
+		if err == nil && allPodsRunning(pods.Items) {
+			return true
+		}
+		time.Sleep(recyclePollInterval)
+	}
+	return false
+}
+
+func allPodsRunning(pods []v1.Pod) bool {
+	for _, pod := range pods {
+		if pod.GetDeletionTimestamp() == nil && pod.Status.Phase != v1.PodRunning {
+			return false
+		}
+	}
+	return true
+}
+
+// A parsed cron expression with the five fields minute, hour, day of month, month and day of week.
+// Fields accept '*', numbers, ranges "a-b", lists "a,b" and steps "*/n" or "a-b/n".
+type cronSchedule struct {
+	minutes     map[int]bool
+	hours       map[int]bool
+	daysOfMonth map[int]bool
+	months      map[int]bool
+	daysOfWeek  map[int]bool
+	// Like cron, a job runs when either day field matches if both are restricted
+	anyDayOfMonth bool
+	anyDayOfWeek  bool
+}
+
+func parseCronSchedule(expression string) (*cronSchedule, error) {
+	fields := strings.Fields(expression)
+	if len(fields) != 5 {
+		return nil, errors.New("Cron schedule needs 5 fields, got " + strconv.Itoa(len(fields)))
+	}
+
+	schedule := &cronSchedule{anyDayOfMonth: fields[2] == "*", anyDayOfWeek: fields[4] == "*"}
+	var err error
+	if schedule.minutes, err = parseCronField(fields[0], 0, 59); err != nil {
+		return nil, err
+	}
+	if schedule.hours, err = parseCronField(fields[1], 0, 23); err != nil {
+		return nil, err
+	}
+	if schedule.daysOfMonth, err = parseCronField(fields[2], 1, 31); err != nil {
+		return nil, err
+	}
+	if schedule.months, err = parseCronField(fields[3], 1, 12); err != nil {
+		return nil, err
+	}
+	if schedule.daysOfWeek, err = parseCronField(fields[4], 0, 7); err != nil {
+		return nil, err
+	}
+	// Sunday is both 0 and 7
+	if schedule.daysOfWeek[7] {
+		schedule.daysOfWeek[0] = true
+	}
+	return schedule, nil
+}
+
+func parseCronField(field string, min int, max int) (map[int]bool, error) {
+	values := map[int]bool{}
+	for _, part := range strings.Split(field, ",") {
+		step := 1
+		stepped := false
+		if i := strings.Index(part, "/"); i >= 0 {
+			stepped = true
+			var err error
+			if step, err = strconv.Atoi(part[i+1:]); err != nil || step <= 0 {
+				return nil, errors.New("Invalid step in cron field " + field)
+			}
+			part = part[:i]
+		}
+
+		low, high := min, max
+		if part != "*" {
+			bounds := strings.SplitN(part, "-", 2)
+			var err error
+			if low, err = strconv.Atoi(bounds[0]); err != nil {
+				return nil, errors.New("Invalid cron field " + field)
+			}
+			// "a/n" steps from a to the end of the range
+			high = low
+			if stepped {
+				high = max
+			}
+			if len(bounds) == 2 {
+				if high, err = strconv.Atoi(bounds[1]); err != nil {
+					return nil, errors.New("Invalid cron field " + field)
+				}
+			}
+		}
+		if low < min || high > max || low > high {
+			return nil, errors.New("Cron field " + field + " is out of range")
+		}
+
+		for value := low; value <= high; value += step {
+			values[value] = true
+		}
+	}
+	return values, nil
+}
+
+func (s *cronSchedule) matches(t time.Time) bool {
+	if !s.minutes[t.Minute()] || !s.hours[t.Hour()] || !s.months[int(t.Month())] {
+		return false
+	}
+
+	dayOfMonth := s.daysOfMonth[t.Day()]
+	dayOfWeek := s.daysOfWeek[int(t.Weekday())]
+	if !s.anyDayOfMonth && !s.anyDayOfWeek {
+		return dayOfMonth || dayOfWeek
+	}
+	return dayOfMonth && dayOfWeek
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestCronScheduleShouldMatchConfiguredTimes(t *testing.T) {
+	schedule, err := parseCronSchedule("30 2 * * 0")
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+
+	sunday := time.Date(2020, 3, 1, 2, 30, 0, 0, time.UTC)
+	if !schedule.matches(sunday) {
+		t.Errorf("Expected Sunday 02:30 to match")
+	}
+	if schedule.matches(sunday.Add(time.Minute)) || schedule.matches(sunday.Add(24*time.Hour)) {
+		t.Errorf("Expected only Sunday 02:30 to match")
+	}
+
+	steps, _ := parseCronSchedule("*/15 1-3 * * 1-5")
+	if !steps.matches(time.Date(2020, 3, 2, 3, 45, 0, 0, time.UTC)) || steps.matches(time.Date(2020, 3, 2, 3, 50, 0, 0, time.UTC)) {
+		t.Errorf("Unexpected step and range matching")
+	}
+}
+
+func TestCronScheduleShouldRejectInvalidExpressions(t *testing.T) {
+	for _, expression := range []string{"* * * *", "60 * * * *", "a * * * *", "*/0 * * * *", "5-1 * * * *"} {
+		if _, err := parseCronSchedule(expression); err == nil {
+			t.Errorf("Expected %q to be rejected", expression)
+		}
+	}
+}
+
+func TestRecycleCandidatesShouldSkipBusyAndYoungPods(t *testing.T) {
+	now := time.Now()
+	pod := func(name string, age time.Duration, labels map[string]string) v1.Pod {
+		return v1.Pod{ObjectMeta: metav1.ObjectMeta{Name: name, Labels: labels, CreationTimestamp: metav1.Time{Time: now.Add(-age)}}}
+	}
+	pods := []v1.Pod{
+		pod("standby-old", 30*time.Hour, map[string]string{standbyLabel: "linux"}),
+		pod("standby-oldest", 50*time.Hour, map[string]string{standbyLabel: "linux"}),
+		pod("standby-young", time.Hour, map[string]string{standbyLabel: "linux"}),
+		pod("agent-old", 30*time.Hour, map[string]string{agentIdLabel: "1"}),
+		pod("webserver", 30*time.Hour, map[string]string{"app": "azurepipelinespool-operator"}),
+	}
+
+	idle, busy := selectRecycleCandidates(pods, now.Add(-24*time.Hour))
+	if len(idle) != 2 || idle[0].GetName() != "standby-oldest" || idle[1].GetName() != "standby-old" {
+		t.Errorf("Expected the old standby pods, oldest first. Got %v", idle)
+	}
+	if busy != 1 {
+		t.Errorf("Expected one busy pod. Got %v", busy)
+	}
+}
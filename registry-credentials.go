@@ -0,0 +1,280 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+
+	v1alpha1 "github.com/microsoft/poolprovider-for-k8s/pkg/apis/dev/v1alpha1"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// Agents of pools with registry credentials get credentials issued for their job only, instead of
+// a long-lived registry secret. They are written to a docker config secret next to the agent
+// secret, "<agent secret>-registry", which the agent container mounts and finds through
+// DOCKER_CONFIG. The secret is optional, so standby pods start before their job is known. On
+// release the credentials are revoked where the issuer supports it and the secret is deleted.
+const (
+	RegistryProviderAcr        = "acr"
+	RegistryProviderHelper     = "helper"
+	registrySecretTail         = "-registry"
+	registryVolume             = "registry-credentials"
+	registryMountPath          = "/var/run/secrets/registry"
+	registryAgentLabel         = "RegistryCredentialsFor"
+	registriesAnnotation       = "poolprovider/registries"
+	dockerConfigEnvVariable    = "DOCKER_CONFIG"
+	acrTokenUsername           = "00000000-0000-0000-0000-000000000000"
+	defaultIdentityEndpoint    = "http://169.254.169.254/metadata/identity/oauth2/token"
+	azureManagementResource    = "https://management.azure.com/"
+	registryCredentialsTimeout = 10 * time.Second
+)
+
+type registryCredential struct {
+	Username string
+	Password string
+}
+
+type registryCredentialIssuer interface {
+	Issue(server string, agentId string, poolName string) (registryCredential, error)
+	Revoke(server string, agentId string) error
+}
+
+var registryHttpClient = newOutboundClient(registryCredentialsTimeout)
+
+var registryIssuers = map[string]registryCredentialIssuer{
+	RegistryProviderAcr:    &acrIssuer{identityEndpoint: defaultIdentityEndpoint, scheme: "https"},
+	RegistryProviderHelper: &helperIssuer{},
+}
+
+// acrIssuer exchanges an AAD token of the managed identity of the provider, AZURE_CLIENT_ID when
+// it has several, for an ACR refresh token. Refresh tokens cannot be revoked, they expire after
+// three hours.
+type acrIssuer struct {
+	identityEndpoint string
+	scheme           string
+}
+
+func (a *acrIssuer) Issue(server string, agentId string, poolName string) (registryCredential, error) {
+	query := url.Values{"api-version": {"2018-02-01"}, "resource": {azureManagementResource}}
+	if clientId := os.Getenv("AZURE_CLIENT_ID"); clientId != "" {
+		query.Set("client_id", clientId)
+	}
+	req, _ := http.NewRequest(http.MethodGet, a.identityEndpoint+"?"+query.Encode(), nil)
+	req.Header.Set("Metadata", "true")
+
+	var identity struct {
+		AccessToken string `json:"access_token"`
+	}
+	if err := doRegistryRequest(req, &identity); err != nil {
+		return registryCredential{}, err
+	}
+
+	form := url.Values{"grant_type": {"access_token"}, "service": {server}, "access_token": {identity.AccessToken}}
+	req, _ = http.NewRequest(http.MethodPost, a.scheme+"://"+server+"/oauth2/exchange", bytes.NewBufferString(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	var exchange struct {
+		RefreshToken string `json:"refresh_token"`
+	}
+	if err := doRegistryRequest(req, &exchange); err != nil {
+		return registryCredential{}, err
+	}
+	return registryCredential{Username: acrTokenUsername, Password: exchange.RefreshToken}, nil
+}
+
+func (a *acrIssuer) Revoke(server string, agentId string) error {
+	return nil
+}
+
+// helperIssuer asks a credential helper service for the credentials. It gets a POST of
+// {"Server", "AgentId", "Pool"} and answers {"Username", "Password"}; on release it
+// gets a DELETE of {"Server", "AgentId"}.
+type helperIssuer struct {
+	url string
+}
+
+type helperRequest struct {
+	Server  string
+	AgentId string
+	Pool    string `json:",omitempty"`
+}
+
+func (h *helperIssuer) helperUrl() (string, error) {
+	if h.url != "" {
+		return h.url, nil
+	}
+	if helperUrl := os.Getenv("REGISTRY_CREDENTIAL_HELPER_URL"); helperUrl != "" {
+		return helperUrl, nil
+	}
+	return "", errors.New("REGISTRY_CREDENTIAL_HELPER_URL is not set")
+}
+
+func (h *helperIssuer) Issue(server string, agentId string, poolName string) (registryCredential, error) {
+	var credential registryCredential
+	err := h.send(http.MethodPost, helperRequest{Server: server, AgentId: agentId, Pool: poolName}, &credential)
+	return credential, err
+}
+
+func (h *helperIssuer) Revoke(server string, agentId string) error {
+	return h.send(http.MethodDelete, helperRequest{Server: server, AgentId: agentId}, nil)
+}
+
+func (h *helperIssuer) send(method string, body helperRequest, result interface{}) error {
+	helperUrl, err := h.helperUrl()
+	if err != nil {
+		return err
+	}
+	data, _ := json.Marshal(body)
+	req, _ := http.NewRequest(method, helperUrl, bytes.NewReader(data))
+	req.Header.Set("Content-Type", "application/json")
+	return doRegistryRequest(req, result)
+}
+
+func doRegistryRequest(req *http.Request, result interface{}) error {
+	resp, err := registryHttpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	data, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("%s %s returned %s", req.Method, req.URL.Host+req.URL.Path, resp.Status)
+	}
+	if result != nil {
+		return json.Unmarshal(data, result)
+	}
+	return nil
+}
+
+func registrySecretName(agentSecretName string) string {
+	return agentSecretName + registrySecretTail
+}
+
+// Mounts the docker config of the job into the agent container.
+func addRegistryCredentialsVolume(pod *v1.Pod, pool *v1alpha1.AgentPoolSpec, agentSecretName string) {
+	if pod == nil || pool == nil || len(pool.RegistryCredentials) == 0 || len(pod.Spec.Containers) == 0 {
+		return
+	}
+
+	optional := true
+	pod.Spec.Volumes = append(pod.Spec.Volumes, v1.Volume{
+		Name: registryVolume,
+		VolumeSource: v1.VolumeSource{Secret: &v1.SecretVolumeSource{
+			SecretName: registrySecretName(agentSecretName),
+			Items:      []v1.KeyToPath{{Key: v1.DockerConfigJsonKey, Path: "config.json"}},
+			Optional:   &optional,
+		}},
+	})
+
+	container := &pod.Spec.Containers[0]
+	container.VolumeMounts = append(container.VolumeMounts, v1.VolumeMount{Name: registryVolume, MountPath: registryMountPath, ReadOnly: true})
+	container.Env = append(container.Env, v1.EnvVar{Name: dockerConfigEnvVariable, Value: registryMountPath})
+}
+
+// Issues the credentials of the job and stores them in the docker config secret. Registries whose
+// credentials cannot be issued are left out and returned as warnings, the job may not need them.
+func provisionRegistryCredentials(cs *k8s, agentId string, pool *v1alpha1.AgentPoolSpec, agentSecretName string, owner *v1.Pod, namespace string) []string {
+	if pool == nil || len(pool.RegistryCredentials) == 0 {
+		return nil
+	}
+
+	credentials, issued, warnings := issueRegistryCredentials(pool, agentId)
+	if len(issued) == 0 {
+		return warnings
+	}
+
+	registries, _ := json.Marshal(issued)
+	secret := &v1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        registrySecretName(agentSecretName),
+			Namespace:   namespace,
+			Labels:      map[string]string{registryAgentLabel: agentId},
+			Annotations: map[string]string{registriesAnnotation: string(registries)},
+		},
+		Type: v1.SecretTypeDockerConfigJson,
+		Data: map[string][]byte{v1.DockerConfigJsonKey: dockerConfig(credentials)},
+	}
+	if owner != nil {
+		AddOwnerRefToObject(secret, AsOwner(owner))
+	}
+	if _, err := cs.clientset.CoreV1().Secrets(namespace).Create(secret); err != nil {
+		log.Println("Failed to create the registry credentials of agent "+agentId, err)
+		revokeIssuedCredentials(issued, agentId)
+		return append(warnings, "Registry credentials not provided: "+err.Error())
+	}
+	return warnings
+}
+
+func issueRegistryCredentials(pool *v1alpha1.AgentPoolSpec, agentId string) (map[string]registryCredential, []v1alpha1.RegistryCredentialSpec, []string) {
+	credentials := map[string]registryCredential{}
+	var issued []v1alpha1.RegistryCredentialSpec
+	var warnings []string
+	for _, registry := range pool.RegistryCredentials {
+		issuer, ok := registryIssuers[registry.Provider]
+		if !ok {
+			warnings = append(warnings, "Unknown registry credential provider "+registry.Provider+" for "+registry.Server)
+			continue
+		}
+		credential, err := issuer.Issue(registry.Server, agentId, pool.PoolName)
+		if err != nil {
+			log.Println("Failed to issue credentials for registry "+registry.Server, err)
+			warnings = append(warnings, "No credentials for registry "+registry.Server+": "+err.Error())
+			continue
+		}
+		credentials[registry.Server] = credential
+		issued = append(issued, registry)
+	}
+	return credentials, issued, warnings
+}
+
+func dockerConfig(credentials map[string]registryCredential) []byte {
+	type auth struct {
+		Auth string `json:"auth"`
+	}
+	auths := map[string]auth{}
+	for server, credential := range credentials {
+		auths[server] = auth{Auth: base64.StdEncoding.EncodeToString([]byte(credential.Username + ":" + credential.Password))}
+	}
+	data, _ := json.Marshal(map[string]interface{}{"auths": auths})
+	return data
+}
+
+// Revokes the registry credentials of the agent and deletes their secret.
+func revokeRegistryCredentials(cs *k8s, agentId string, namespace string) {
+	secretClient := cs.clientset.CoreV1().Secrets(namespace)
+	secrets, err := secretClient.List(metav1.ListOptions{LabelSelector: registryAgentLabel + "=" + agentId})
+	if err != nil {
+		log.Println("Failed to list the registry credentials of agent "+agentId, err)
+		return
+	}
+
+	for _, secret := range secrets.Items {
+		var issued []v1alpha1.RegistryCredentialSpec
+		json.Unmarshal([]byte(secret.GetAnnotations()[registriesAnnotation]), &issued)
+		revokeIssuedCredentials(issued, agentId)
+
+		if err := secretClient.Delete(secret.GetName(), &metav1.DeleteOptions{}); err != nil {
+			log.Println("Failed to delete registry credentials "+secret.GetName(), err)
+		}
+	}
+}
+
+func revokeIssuedCredentials(issued []v1alpha1.RegistryCredentialSpec, agentId string) {
+	for _, registry := range issued {
+		if issuer, ok := registryIssuers[registry.Provider]; ok {
+			if err := issuer.Revoke(registry.Server, agentId); err != nil {
+				log.Println("Failed to revoke credentials for registry "+registry.Server, err)
+			}
+		}
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	v1alpha1 "github.com/microsoft/poolprovider-for-k8s/pkg/apis/dev/v1alpha1"
+	v1 "k8s.io/api/core/v1"
+)
+
+func TestAcrIssuerShouldExchangeTheIdentityToken(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/identity":
+			if r.Header.Get("Metadata") != "true" {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			w.Write([]byte(`{"access_token":"aad-token"}`))
+		case "/oauth2/exchange":
+			r.ParseForm()
+			if r.Form.Get("access_token") != "aad-token" || r.Form.Get("grant_type") != "access_token" {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			w.Write([]byte(`{"refresh_token":"acr-token"}`))
+		}
+	}))
+	defer server.Close()
+
+	issuer := &acrIssuer{identityEndpoint: server.URL + "/identity", scheme: "http"}
+	credential, err := issuer.Issue(strings.TrimPrefix(server.URL, "http://"), "agent-1", "linux")
+
+	if err != nil || credential.Username != acrTokenUsername || credential.Password != "acr-token" {
+		t.Errorf("Expected the ACR refresh token. Got %+v (%v)", credential, err)
+	}
+}
+
+func TestHelperIssuerShouldIssueAndRevoke(t *testing.T) {
+	var revoked helperRequest
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var request helperRequest
+		json.NewDecoder(r.Body).Decode(&request)
+		if r.Method == http.MethodDelete {
+			revoked = request
+			return
+		}
+		w.Write([]byte(`{"Username":"AWS","Password":"ecr-` + request.AgentId + `"}`))
+	}))
+	defer server.Close()
+
+	issuer := &helperIssuer{url: server.URL}
+	credential, err := issuer.Issue("123.dkr.ecr.eu-west-1.amazonaws.com", "agent-1", "linux")
+	if err != nil || credential.Password != "ecr-agent-1" {
+		t.Errorf("Expected the helper credential. Got %+v (%v)", credential, err)
+	}
+
+	if err := issuer.Revoke("123.dkr.ecr.eu-west-1.amazonaws.com", "agent-1"); err != nil || revoked.AgentId != "agent-1" {
+		t.Errorf("Expected the credential to be revoked. Got %+v (%v)", revoked, err)
+	}
+}
+
+func TestDockerConfigShouldEncodeTheCredentials(t *testing.T) {
+	data := dockerConfig(map[string]registryCredential{"contoso.azurecr.io": {Username: "user", Password: "secret"}})
+
+	var config struct {
+		Auths map[string]struct{ Auth string }
+	}
+	json.Unmarshal(data, &config)
+	if auth, _ := base64.StdEncoding.DecodeString(config.Auths["contoso.azurecr.io"].Auth); string(auth) != "user:secret" {
+		t.Errorf("Unexpected docker config %s", data)
+	}
+}
+
+func TestAddRegistryCredentialsVolumeShouldMountTheDockerConfig(t *testing.T) {
+	pool := &v1alpha1.AgentPoolSpec{RegistryCredentials: []v1alpha1.RegistryCredentialSpec{{Server: "contoso.azurecr.io", Provider: RegistryProviderAcr}}}
+	pod := &v1.Pod{Spec: v1.PodSpec{Containers: []v1.Container{{Name: "vsts-agent"}}}}
+
+	addRegistryCredentialsVolume(pod, pool, "agent-secret")
+
+	if len(pod.Spec.Volumes) != 1 || pod.Spec.Volumes[0].Secret.SecretName != "agent-secret-registry" || !*pod.Spec.Volumes[0].Secret.Optional {
+		t.Errorf("Expected an optional registry secret volume. Got %+v", pod.Spec.Volumes)
+	}
+	container := pod.Spec.Containers[0]
+	if len(container.Env) != 1 || container.Env[0].Name != dockerConfigEnvVariable || container.Env[0].Value != registryMountPath {
+		t.Errorf("Expected DOCKER_CONFIG to point at the mount. Got %+v", container.Env)
+	}
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/microsoft/poolprovider-for-k8s/pkg/storage"
+)
+
+// Requests are timed by the route pattern they matched, e.g. "/admin/quarantine", so paths sent
+// to the fallback service all count as "/" and cannot blow up the number of series.
+func withRequestMetrics(mux *http.ServeMux) http.Handler {
+	return http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		_, pattern := mux.Handler(req)
+		recorder := &statusRecorder{ResponseWriter: resp, status: http.StatusOK}
+		started := time.Now()
+		mux.ServeHTTP(recorder, req)
+		httpRequestSeconds.WithLabelValues(pattern, req.Method, strconv.Itoa(recorder.status)).Observe(time.Since(started).Seconds())
+	})
+}
+
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+// Acquire requests stream their progress, so flushing is passed on.
+func (r *statusRecorder) Flush() {
+	if flusher, ok := r.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// instrumentedStorage counts the failed operations of the storage. Missing keys are an answer,
+// not a failure.
+type instrumentedStorage struct {
+	next storage.Storage
+}
+
+func (s *instrumentedStorage) Get(key string) (string, error) {
+	value, err := s.next.Get(key)
+	if err != nil && !errors.Is(err, storage.ErrNotFound) {
+		storageErrors.WithLabelValues("get").Inc()
+	}
+	return value, err
+}
+
+func (s *instrumentedStorage) Set(key string, value string) error {
+	return s.count("set", s.next.Set(key, value))
+}
+
+func (s *instrumentedStorage) SetIfAbsent(key string, value string) (bool, error) {
+	set, err := s.next.SetIfAbsent(key, value)
+	return set, s.count("setifabsent", err)
+}
+
+func (s *instrumentedStorage) CompareAndSwap(key string, old string, new string) (bool, error) {
+	swapped, err := s.next.CompareAndSwap(key, old, new)
+	return swapped, s.count("compareandswap", err)
+}
+
+func (s *instrumentedStorage) Delete(key string) error {
+	return s.count("delete", s.next.Delete(key))
+}
+
+func (s *instrumentedStorage) List(prefix string) (map[string]string, error) {
+	values, err := s.next.List(prefix)
+	return values, s.count("list", err)
+}
+
+func (s *instrumentedStorage) count(operation string, err error) error {
+	if err != nil {
+		storageErrors.WithLabelValues(operation).Inc()
+	}
+	return err
+}
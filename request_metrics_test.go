@@ -0,0 +1,56 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/microsoft/poolprovider-for-k8s/pkg/storage"
+)
+
+func TestRequestMetricsShouldPassTheResponseThrough(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/status", func(resp http.ResponseWriter, req *http.Request) {
+		resp.WriteHeader(http.StatusTeapot)
+		resp.(http.Flusher).Flush()
+	})
+
+	recorder := httptest.NewRecorder()
+	withRequestMetrics(mux).ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/status?agentId=1", nil))
+	if recorder.Code != http.StatusTeapot || !recorder.Flushed {
+		t.Errorf("Expected the status and flush to be passed on. Got %d %v", recorder.Code, recorder.Flushed)
+	}
+}
+
+func TestStatusRecorderShouldDefaultToOK(t *testing.T) {
+	recorder := &statusRecorder{ResponseWriter: httptest.NewRecorder(), status: http.StatusOK}
+	recorder.Write([]byte("ok"))
+	if recorder.status != http.StatusOK {
+		t.Errorf("Expected 200. Got %d", recorder.status)
+	}
+}
+
+type failingStorage struct {
+	storage.Storage
+}
+
+func (failingStorage) Set(key string, value string) error {
+	return errors.New("unavailable")
+}
+
+func TestInstrumentedStorageShouldReturnTheResultsOfTheStorage(t *testing.T) {
+	memory := storage.NewMemoryStorage(0)
+	store := &instrumentedStorage{next: memory}
+	store.Set("journal:1", "a")
+
+	if value, err := store.Get("journal:1"); err != nil || value != "a" {
+		t.Errorf("Expected a. Got %s (%v)", value, err)
+	}
+	if _, err := store.Get("journal:2"); err != storage.ErrNotFound {
+		t.Errorf("Expected ErrNotFound. Got %v", err)
+	}
+	if err := (&instrumentedStorage{next: failingStorage{memory}}).Set("journal:1", "b"); err == nil {
+		t.Errorf("Expected the error of the storage")
+	}
+}
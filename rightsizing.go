@@ -0,0 +1,313 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/microsoft/poolprovider-for-k8s/pkg/storage"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// The leader samples the CPU and memory usage of the agent containers from metrics-server every
+// RIGHTSIZING_INTERVAL_SECONDS and keeps the peak of every agent pod under "usage:<pod uid>",
+// together with the requests of the container and the pipeline definition the pod ran for, for
+// RIGHTSIZING_RETENTION_DAYS. GET /stats/rightsizing recommends requests per pool and definition:
+// the highest peak plus RIGHTSIZING_HEADROOM_PERCENT. A definition is over-provisioned when it has
+// RIGHTSIZING_MIN_SAMPLES pods and the recommendation is below its requests. With
+// RIGHTSIZING_AUTO_APPLY=true the agent containers of over-provisioned definitions get the
+// recommended requests; requests are only ever lowered, limits are left alone.
+const (
+	usageKeyPrefix              = "usage:"
+	definitionAnnotation        = "poolprovider/definition"
+	rightsizedAnnotation        = "poolprovider/rightsized"
+	podMetricsPath              = "/apis/metrics.k8s.io/v1beta1/namespaces/"
+	defaultRightsizingHeadroom  = 20
+	defaultRightsizingSamples   = 5
+	defaultRightsizingRetention = 14 * 24 * time.Hour
+	cpuRoundingMillis           = 10
+	memoryRoundingBytes         = 1 << 20
+)
+
+var rightsizingInterval = time.Minute
+
+type UsageSample struct {
+	Pool               string
+	Definition         string
+	Pod                string
+	PeakCpuMillis      int64
+	PeakMemoryBytes    int64
+	RequestCpuMillis   int64
+	RequestMemoryBytes int64
+	SampledAt          time.Time
+}
+
+type RightsizingRecommendation struct {
+	Pool                   string
+	Definition             string
+	Samples                int
+	PeakCpuMillis          int64
+	PeakMemoryBytes        int64
+	RequestCpuMillis       int64
+	RequestMemoryBytes     int64
+	RecommendedCpuMillis   int64
+	RecommendedMemoryBytes int64
+	OverProvisioned        bool
+}
+
+// The subset of the PodMetricsList of metrics.k8s.io read here
+type podMetricsList struct {
+	Items []struct {
+		Metadata struct {
+			Name string `json:"name"`
+		} `json:"metadata"`
+		Containers []struct {
+			Name  string            `json:"name"`
+			Usage map[string]string `json:"usage"`
+		} `json:"containers"`
+	} `json:"items"`
+}
+
+// Peaks sampled by this replica, so the storage is only written when a peak grows
+var usagePeaks = struct {
+	sync.Mutex
+	pods map[types.UID]UsageSample
+}{pods: map[types.UID]UsageSample{}}
+
+func RunRightsizingCollector(namespace string) {
+	interval := time.Duration(getEnvInt("RIGHTSIZING_INTERVAL_SECONDS", int(rightsizingInterval/time.Second))) * time.Second
+	for {
+		if IsLeader() {
+			for _, ns := range agentNamespaces(namespace) {
+				if err := sampleAgentUsage(ns, time.Now().UTC()); err != nil {
+					log.Println("Sampling the agent usage in namespace "+ns+" failed", err)
+				}
+			}
+		}
+		time.Sleep(interval)
+	}
+}
+
+// Records the usage of the agent pods of the namespace where it exceeds their peak so far.
+func sampleAgentUsage(namespace string, now time.Time) error {
+	cs := CreateClientSet()
+	pods, err := cs.clientset.CoreV1().Pods(namespace).List(metav1.ListOptions{LabelSelector: agentIdLabel})
+	if err != nil {
+		return err
+	}
+	data, err := cs.clientset.CoreV1().RESTClient().Get().AbsPath(podMetricsPath+namespace+"/pods").Param("labelSelector", agentIdLabel).DoRaw()
+	if err != nil {
+		return err
+	}
+	var metrics podMetricsList
+	if err := json.Unmarshal(data, &metrics); err != nil {
+		return err
+	}
+
+	podsByName := map[string]*v1.Pod{}
+	for i := range pods.Items {
+		podsByName[pods.Items[i].GetName()] = &pods.Items[i]
+	}
+	store := GetStorage()
+	for _, item := range metrics.Items {
+		pod := podsByName[item.Metadata.Name]
+		if pod == nil || len(pod.Spec.Containers) == 0 {
+			continue
+		}
+		for _, container := range item.Containers {
+			if container.Name != pod.Spec.Containers[0].Name {
+				continue
+			}
+			cpu, _ := resource.ParseQuantity(container.Usage["cpu"])
+			memory, _ := resource.ParseQuantity(container.Usage["memory"])
+			sample, grew := updateUsagePeak(store, pod, cpu.MilliValue(), memory.Value(), now)
+			if grew {
+				data, _ := json.Marshal(sample)
+				if err := store.Set(usageKeyPrefix+string(pod.GetUID()), string(data)); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// Returns the peak usage of the pod including the given usage, and whether it grew.
+func updateUsagePeak(store storage.Storage, pod *v1.Pod, cpuMillis int64, memoryBytes int64, now time.Time) (UsageSample, bool) {
+	usagePeaks.Lock()
+	defer usagePeaks.Unlock()
+
+	sample, ok := usagePeaks.pods[pod.GetUID()]
+	if !ok {
+		if value, err := store.Get(usageKeyPrefix + string(pod.GetUID())); err == nil {
+			ok = json.Unmarshal([]byte(value), &sample) == nil
+		}
+	}
+	if !ok {
+		requests := pod.Spec.Containers[0].Resources.Requests
+		sample = UsageSample{
+			Pool:               pod.GetLabels()[agentPoolLabel],
+			Definition:         pod.GetAnnotations()[definitionAnnotation],
+			Pod:                pod.GetName(),
+			RequestCpuMillis:   requests.Cpu().MilliValue(),
+			RequestMemoryBytes: requests.Memory().Value(),
+		}
+	}
+
+	grew := !ok
+	if cpuMillis > sample.PeakCpuMillis {
+		sample.PeakCpuMillis, grew = cpuMillis, true
+	}
+	if memoryBytes > sample.PeakMemoryBytes {
+		sample.PeakMemoryBytes, grew = memoryBytes, true
+	}
+	if grew {
+		sample.SampledAt = now
+	}
+	if !ok && len(usagePeaks.pods) >= maxObservedPods {
+		usagePeaks.pods = map[types.UID]UsageSample{}
+	}
+	usagePeaks.pods[pod.GetUID()] = sample
+	return sample, grew
+}
+
+// Groups the samples by pool and definition and recommends requests for each group.
+func recommendRequests(samples []UsageSample, headroomPercent int, minSamples int) []RightsizingRecommendation {
+	groups := map[string]*RightsizingRecommendation{}
+	for _, sample := range samples {
+		key := sample.Pool + "|" + sample.Definition
+		recommendation, ok := groups[key]
+		if !ok {
+			recommendation = &RightsizingRecommendation{Pool: sample.Pool, Definition: sample.Definition}
+			groups[key] = recommendation
+		}
+		recommendation.Samples++
+		recommendation.PeakCpuMillis = maxInt64(recommendation.PeakCpuMillis, sample.PeakCpuMillis)
+		recommendation.PeakMemoryBytes = maxInt64(recommendation.PeakMemoryBytes, sample.PeakMemoryBytes)
+		recommendation.RequestCpuMillis = maxInt64(recommendation.RequestCpuMillis, sample.RequestCpuMillis)
+		recommendation.RequestMemoryBytes = maxInt64(recommendation.RequestMemoryBytes, sample.RequestMemoryBytes)
+	}
+
+	recommendations := []RightsizingRecommendation{}
+	for _, recommendation := range groups {
+		recommendation.RecommendedCpuMillis = roundUp(recommendation.PeakCpuMillis*int64(100+headroomPercent)/100, cpuRoundingMillis)
+		recommendation.RecommendedMemoryBytes = roundUp(recommendation.PeakMemoryBytes*int64(100+headroomPercent)/100, memoryRoundingBytes)
+		recommendation.OverProvisioned = recommendation.Samples >= minSamples &&
+			(recommendation.RecommendedCpuMillis < recommendation.RequestCpuMillis || recommendation.RecommendedMemoryBytes < recommendation.RequestMemoryBytes)
+		recommendations = append(recommendations, *recommendation)
+	}
+	sort.Slice(recommendations, func(i, j int) bool {
+		if recommendations[i].Pool != recommendations[j].Pool {
+			return recommendations[i].Pool < recommendations[j].Pool
+		}
+		return recommendations[i].Definition < recommendations[j].Definition
+	})
+	return recommendations
+}
+
+func maxInt64(a int64, b int64) int64 {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+func roundUp(value int64, step int64) int64 {
+	return (value + step - 1) / step * step
+}
+
+func rightsizingRecommendations() ([]RightsizingRecommendation, error) {
+	values, err := GetStorage().List(usageKeyPrefix)
+	if err != nil {
+		return nil, err
+	}
+	samples := []UsageSample{}
+	for _, value := range values {
+		var sample UsageSample
+		if json.Unmarshal([]byte(value), &sample) == nil && sample.Definition != "" {
+			samples = append(samples, sample)
+		}
+	}
+	return recommendRequests(samples, getEnvInt("RIGHTSIZING_HEADROOM_PERCENT", defaultRightsizingHeadroom),
+		getEnvInt("RIGHTSIZING_MIN_SAMPLES", defaultRightsizingSamples)), nil
+}
+
+func isRightsizingAutoApplied() bool {
+	return os.Getenv("RIGHTSIZING_AUTO_APPLY") == "true"
+}
+
+// Lowers the requests of the agent container to the recommendation of its definition when the
+// definition is over-provisioned. Returns whether the pod was changed.
+func applyRightsizing(pod *v1.Pod, recommendation RightsizingRecommendation) bool {
+	if !recommendation.OverProvisioned || len(pod.Spec.Containers) == 0 || pod.Spec.Containers[0].Resources.Requests == nil {
+		return false
+	}
+	requests := pod.Spec.Containers[0].Resources.Requests
+	changed := false
+	if cpu := requests.Cpu().MilliValue(); recommendation.RecommendedCpuMillis > 0 && recommendation.RecommendedCpuMillis < cpu {
+		requests[v1.ResourceCPU] = *resource.NewMilliQuantity(recommendation.RecommendedCpuMillis, resource.DecimalSI)
+		changed = true
+	}
+	if memory := requests.Memory().Value(); recommendation.RecommendedMemoryBytes > 0 && recommendation.RecommendedMemoryBytes < memory {
+		requests[v1.ResourceMemory] = *resource.NewQuantity(recommendation.RecommendedMemoryBytes, resource.BinarySI)
+		changed = true
+	}
+	if changed {
+		if pod.Annotations == nil {
+			pod.Annotations = map[string]string{}
+		}
+		pod.Annotations[rightsizedAnnotation] = "cpu=" + strconv.FormatInt(recommendation.RecommendedCpuMillis, 10) + "m,memory=" +
+			strconv.FormatInt(recommendation.RecommendedMemoryBytes, 10)
+	}
+	return changed
+}
+
+// Records the pipeline definition the agent pod runs for, so its usage is attributed to it.
+func annotateDefinition(pod *v1.Pod, definition string) {
+	if definition == "" {
+		return
+	}
+	if pod.Annotations == nil {
+		pod.Annotations = map[string]string{}
+	}
+	pod.Annotations[definitionAnnotation] = definition
+}
+
+// Returns the recommendation for the pool and definition of the request.
+func findRightsizingRecommendation(poolName string, definition string) (RightsizingRecommendation, bool) {
+	if definition == "" {
+		return RightsizingRecommendation{}, false
+	}
+	recommendations, err := rightsizingRecommendations()
+	if err != nil {
+		log.Println("Failed to read the usage samples", err)
+		return RightsizingRecommendation{}, false
+	}
+	for _, recommendation := range recommendations {
+		if recommendation.Pool == poolName && recommendation.Definition == definition {
+			return recommendation, true
+		}
+	}
+	return RightsizingRecommendation{}, false
+}
+
+// Returns the requests recommended for every pool and pipeline definition with samples.
+func RightsizingHandler(resp http.ResponseWriter, req *http.Request) {
+	if !isReadRequestValid(resp, req) {
+		return
+	}
+	recommendations, err := rightsizingRecommendations()
+	if err != nil {
+		writeJsonResponse(resp, http.StatusInternalServerError, GetError(err.Error()))
+		return
+	}
+	writeJsonResponse(resp, http.StatusOK, recommendations)
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/microsoft/poolprovider-for-k8s/pkg/storage"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestRecommendRequestsShouldAddHeadroomToThePeak(t *testing.T) {
+	samples := []UsageSample{
+		{Pool: "linux", Definition: "web", PeakCpuMillis: 400, PeakMemoryBytes: 900 << 20, RequestCpuMillis: 2000, RequestMemoryBytes: 4 << 30},
+		{Pool: "linux", Definition: "web", PeakCpuMillis: 500, PeakMemoryBytes: 1000 << 20, RequestCpuMillis: 2000, RequestMemoryBytes: 4 << 30},
+		{Pool: "linux", Definition: "api", PeakCpuMillis: 1900, PeakMemoryBytes: 3 << 30, RequestCpuMillis: 2000, RequestMemoryBytes: 4 << 30},
+	}
+
+	recommendations := recommendRequests(samples, 20, 2)
+	if len(recommendations) != 2 || recommendations[0].Definition != "api" || recommendations[1].Definition != "web" {
+		t.Fatalf("Expected a recommendation per definition. Got %v", recommendations)
+	}
+	web := recommendations[1]
+	if web.Samples != 2 || web.RecommendedCpuMillis != 600 || web.RecommendedMemoryBytes != 1200<<20 || !web.OverProvisioned {
+		t.Errorf("Expected the web peaks plus 20 percent. Got %+v", web)
+	}
+	if recommendations[0].OverProvisioned {
+		t.Errorf("Expected a single sample not to be enough. Got %+v", recommendations[0])
+	}
+}
+
+func TestApplyRightsizingShouldOnlyLowerRequests(t *testing.T) {
+	pod := &v1.Pod{Spec: v1.PodSpec{Containers: []v1.Container{{Name: "vsts-agent", Resources: v1.ResourceRequirements{
+		Requests: v1.ResourceList{v1.ResourceCPU: resource.MustParse("2"), v1.ResourceMemory: resource.MustParse("1Gi")},
+	}}}}}
+
+	recommendation := RightsizingRecommendation{RecommendedCpuMillis: 600, RecommendedMemoryBytes: 2 << 30, OverProvisioned: true}
+	if !applyRightsizing(pod, recommendation) {
+		t.Fatalf("Expected the cpu request lowered")
+	}
+	requests := pod.Spec.Containers[0].Resources.Requests
+	if requests.Cpu().MilliValue() != 600 || requests.Memory().Value() != 1<<30 {
+		t.Errorf("Expected only the cpu request lowered. Got %v", requests)
+	}
+	if pod.Annotations[rightsizedAnnotation] == "" {
+		t.Errorf("Expected the pod marked as right-sized")
+	}
+
+	if applyRightsizing(pod, RightsizingRecommendation{RecommendedCpuMillis: 100}) {
+		t.Errorf("Expected definitions which are not over-provisioned to be left alone")
+	}
+}
+
+func TestUpdateUsagePeakShouldKeepTheHighestUsage(t *testing.T) {
+	store := storage.NewMemoryStorage(0)
+	pod := &v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "agent-1", UID: "uid-usage-1", Labels: map[string]string{agentPoolLabel: "linux"},
+			Annotations: map[string]string{definitionAnnotation: "web"}},
+		Spec: v1.PodSpec{Containers: []v1.Container{{Name: "vsts-agent"}}},
+	}
+	now := time.Date(2026, 10, 15, 12, 0, 0, 0, time.UTC)
+
+	if sample, grew := updateUsagePeak(store, pod, 300, 100<<20, now); !grew || sample.Definition != "web" || sample.Pool != "linux" {
+		t.Errorf("Expected the first sample recorded. Got %+v", sample)
+	}
+	if _, grew := updateUsagePeak(store, pod, 200, 50<<20, now.Add(time.Minute)); grew {
+		t.Errorf("Expected a lower usage not to be recorded")
+	}
+	if sample, grew := updateUsagePeak(store, pod, 250, 200<<20, now.Add(2*time.Minute)); !grew || sample.PeakCpuMillis != 300 || sample.PeakMemoryBytes != 200<<20 {
+		t.Errorf("Expected the memory peak raised. Got %+v", sample)
+	}
+}
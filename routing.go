@@ -0,0 +1,169 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"sort"
+	"strings"
+
+	v1alpha1 "github.com/microsoft/poolprovider-for-k8s/pkg/apis/dev/v1alpha1"
+)
+
+const branchRefPrefix = "refs/heads/"
+
+// Languages hinted by the tool demands of a job. Demands of other tools hint at a language of the
+// same name, e.g. "ruby".
+var demandLanguages = map[string]string{
+	"node":         "node",
+	"node.js":      "node",
+	"npm":          "node",
+	"yarn":         "node",
+	"java":         "java",
+	"jdk":          "java",
+	"maven":        "java",
+	"gradle":       "java",
+	"ant":          "java",
+	"dotnet":       "dotnet",
+	"msbuild":      "dotnet",
+	"visualstudio": "dotnet",
+	"vstest":       "dotnet",
+	"python":       "python",
+	"pip":          "python",
+	"go":           "go",
+	"golang":       "go",
+	"cargo":        "rust",
+	"rust":         "rust",
+}
+
+// Returns the name of the agent pool the request should be provisioned in. The routing rules of the
+// custom resource are evaluated in order and the first rule matching the source branch, repository
+// and language hints of the job wins, so that low-risk branches can be pointed at canary pools and
+// builds of a language at a pool with its SDKs and caches. Without a matching rule the AgentSpec
+// sent by Azure DevOps is used as the pool name.
+func ResolveAgentPoolName(cr *v1alpha1.AzurePipelinesPool, request AgentRequest) string {
+	if rule := matchingRoutingRule(cr, request); rule != nil {
+		log.Println(describeRoutedJob(rule, request) + " routed to agent pool " + rule.PoolName)
+		return rule.PoolName
+	}
+
+	return request.AgentSpec
+}
+
+// Returns an error if the routing rule matching the request names an agent pool which is not
+// configured. FetchAgentPool falls back to the first pool for unknown names, which would silently
+// provision a misrouted job in the wrong pool.
+func validateRoutedPool(cr *v1alpha1.AzurePipelinesPool, request AgentRequest, pool *v1alpha1.AgentPoolSpec) error {
+	rule := matchingRoutingRule(cr, request)
+	if rule == nil || pool == nil || pool.PoolName == rule.PoolName {
+		return nil
+	}
+	return errors.New(UnknownRoutingPoolError + " " + rule.PoolName)
+}
+
+// Returns the first routing rule matching the request, or nil.
+func matchingRoutingRule(cr *v1alpha1.AzurePipelinesPool, request AgentRequest) *v1alpha1.RoutingRule {
+	if cr == nil {
+		return nil
+	}
+	languages := languageHints(request.Demands)
+	for i := range cr.Spec.RoutingRules {
+		if matchRoutingRule(&cr.Spec.RoutingRules[i], request, languages) {
+			return &cr.Spec.RoutingRules[i]
+		}
+	}
+	return nil
+}
+
+// A rule without conditions matches no job.
+func matchRoutingRule(rule *v1alpha1.RoutingRule, request AgentRequest, languages []string) bool {
+	if rule.Branch == "" && rule.Repository == "" && len(rule.Languages) == 0 {
+		return false
+	}
+	if rule.Branch != "" && (request.SourceBranch == "" || !matchBranch(rule.Branch, request.SourceBranch)) {
+		return false
+	}
+	if rule.Repository != "" && (request.Repository == "" || !matchName(strings.ToLower(rule.Repository), strings.ToLower(request.Repository))) {
+		return false
+	}
+	if len(rule.Languages) > 0 && !matchLanguages(rule.Languages, languages) {
+		return false
+	}
+	return true
+}
+
+func matchLanguages(ruleLanguages []string, languages []string) bool {
+	for _, ruleLanguage := range ruleLanguages {
+		for _, language := range languages {
+			if strings.EqualFold(ruleLanguage, language) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Returns the languages the demands hint at, sorted.
+func languageHints(demands []string) []string {
+	seen := map[string]bool{}
+	languages := []string{}
+	for _, demand := range demands {
+		name := v1alpha1.DemandName(demand)
+		if language, ok := demandLanguages[name]; ok {
+			name = language
+		}
+		if name != "" && !seen[name] {
+			seen[name] = true
+			languages = append(languages, name)
+		}
+	}
+	sort.Strings(languages)
+	return languages
+}
+
+// Describes the properties of the request the rule matched, e.g. "Source branch refs/heads/main".
+func describeRoutedJob(rule *v1alpha1.RoutingRule, request AgentRequest) string {
+	parts := []string{}
+	if rule.Branch != "" {
+		parts = append(parts, "source branch "+request.SourceBranch)
+	}
+	if rule.Repository != "" {
+		parts = append(parts, "repository "+request.Repository)
+	}
+	if len(rule.Languages) > 0 {
+		parts = append(parts, "languages "+strings.Join(languageHints(request.Demands), ", "))
+	}
+	description := strings.Join(parts, ", ")
+	return strings.ToUpper(description[:1]) + description[1:]
+}
+
+// Describes the conditions of the rule, e.g. "feature/*" or "repository web-*, languages node".
+func describeRoutingRule(rule *v1alpha1.RoutingRule) string {
+	parts := []string{}
+	if rule.Branch != "" {
+		parts = append(parts, rule.Branch)
+	}
+	if rule.Repository != "" {
+		parts = append(parts, "repository "+rule.Repository)
+	}
+	if len(rule.Languages) > 0 {
+		parts = append(parts, "languages "+strings.Join(rule.Languages, ", "))
+	}
+	return strings.Join(parts, ", ")
+}
+
+// A pattern ending in '*' matches every branch starting with the text before it, any other pattern
+// has to match the branch exactly. The refs/heads/ prefix is ignored on both sides.
+func matchBranch(pattern string, branch string) bool {
+	return matchName(strings.TrimPrefix(pattern, branchRefPrefix), strings.TrimPrefix(branch, branchRefPrefix))
+}
+
+func matchName(pattern string, name string) bool {
+	if pattern == "" {
+		return false
+	}
+
+	if strings.HasSuffix(pattern, "*") {
+		return strings.HasPrefix(name, strings.TrimSuffix(pattern, "*"))
+	}
+	return pattern == name
+}
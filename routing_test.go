@@ -0,0 +1,123 @@
+package main
+
+import (
+	"testing"
+
+	v1alpha1 "github.com/microsoft/poolprovider-for-k8s/pkg/apis/dev/v1alpha1"
+)
+
+func getRoutingTestResource() *v1alpha1.AzurePipelinesPool {
+	return &v1alpha1.AzurePipelinesPool{
+		Spec: v1alpha1.AzurePipelinesPoolSpec{
+			AgentPools: []v1alpha1.AgentPoolSpec{
+				{PoolName: "linux"},
+				{PoolName: "canary"},
+			},
+			RoutingRules: []v1alpha1.RoutingRule{
+				{Branch: "refs/heads/feature/*", PoolName: "canary"},
+				{Branch: "main", PoolName: "linux"},
+			},
+		},
+	}
+}
+
+func TestResolveAgentPoolNameShouldRouteMatchingBranch(t *testing.T) {
+	var agentrequest AgentRequest
+	agentrequest.AgentSpec = "linux"
+	agentrequest.SourceBranch = "refs/heads/feature/new-image"
+
+	poolName := ResolveAgentPoolName(getRoutingTestResource(), agentrequest)
+	if poolName != "canary" {
+		t.Errorf("Expected canary pool. Got %s", poolName)
+	}
+}
+
+func TestResolveAgentPoolNameShouldMatchExactBranch(t *testing.T) {
+	var agentrequest AgentRequest
+	agentrequest.AgentSpec = "canary"
+	agentrequest.SourceBranch = "refs/heads/main"
+
+	poolName := ResolveAgentPoolName(getRoutingTestResource(), agentrequest)
+	if poolName != "linux" {
+		t.Errorf("Expected linux pool. Got %s", poolName)
+	}
+}
+
+func TestResolveAgentPoolNameShouldFallBackToAgentSpec(t *testing.T) {
+	var agentrequest AgentRequest
+	agentrequest.AgentSpec = "linux"
+	agentrequest.SourceBranch = "refs/heads/mainline"
+
+	poolName := ResolveAgentPoolName(getRoutingTestResource(), agentrequest)
+	if poolName != "linux" {
+		t.Errorf("Expected linux pool. Got %s", poolName)
+	}
+}
+
+func TestFetchAgentPoolShouldDefaultToFirstPool(t *testing.T) {
+	pool := v1alpha1.FetchAgentPool(getRoutingTestResource(), "unknown")
+	if pool == nil || pool.PoolName != "linux" {
+		t.Errorf("Expected first agent pool to be returned")
+	}
+}
+
+func TestResolveAgentPoolNameShouldRouteByRepositoryAndLanguage(t *testing.T) {
+	cr := getRoutingTestResource()
+	cr.Spec.RoutingRules = append([]v1alpha1.RoutingRule{
+		{Repository: "Web-*", Languages: []string{"node"}, PoolName: "node"},
+		{Languages: []string{"java"}, PoolName: "java"},
+	}, cr.Spec.RoutingRules...)
+
+	var agentrequest AgentRequest
+	agentrequest.AgentSpec = "linux"
+	agentrequest.Repository = "web-shop"
+	agentrequest.Demands = []string{"npm", "Agent.OS -equals Linux"}
+	if poolName := ResolveAgentPoolName(cr, agentrequest); poolName != "node" {
+		t.Errorf("Expected node pool. Got %s", poolName)
+	}
+
+	agentrequest.Repository = "backend"
+	agentrequest.Demands = []string{"maven"}
+	if poolName := ResolveAgentPoolName(cr, agentrequest); poolName != "java" {
+		t.Errorf("Expected java pool. Got %s", poolName)
+	}
+
+	agentrequest.Demands = []string{"npm"}
+	if poolName := ResolveAgentPoolName(cr, agentrequest); poolName != "linux" {
+		t.Errorf("Expected the generic pool. Got %s", poolName)
+	}
+}
+
+func TestLanguageHintsShouldMapToolDemands(t *testing.T) {
+	languages := languageHints([]string{"maven", "java -equals 11", "ruby", "yarn"})
+	if len(languages) != 3 || languages[0] != "java" || languages[1] != "node" || languages[2] != "ruby" {
+		t.Errorf("Expected java, node and ruby. Got %v", languages)
+	}
+}
+
+func TestValidateRoutedPoolShouldRejectUnknownPool(t *testing.T) {
+	cr := getRoutingTestResource()
+	cr.Spec.RoutingRules = append([]v1alpha1.RoutingRule{{Branch: "release/*", PoolName: "missing"}}, cr.Spec.RoutingRules...)
+
+	var agentrequest AgentRequest
+	agentrequest.AgentSpec = "linux"
+	agentrequest.SourceBranch = "refs/heads/release/1.0"
+
+	poolName := ResolveAgentPoolName(cr, agentrequest)
+	if err := validateRoutedPool(cr, agentrequest, v1alpha1.FetchAgentPool(cr, poolName)); err == nil {
+		t.Errorf("Job routed to an unknown pool was not rejected")
+	}
+
+	agentrequest.SourceBranch = "refs/heads/main"
+	poolName = ResolveAgentPoolName(cr, agentrequest)
+	if err := validateRoutedPool(cr, agentrequest, v1alpha1.FetchAgentPool(cr, poolName)); err != nil {
+		t.Errorf("Job routed to a configured pool was rejected: %v", err)
+	}
+
+	agentrequest.SourceBranch = ""
+	agentrequest.AgentSpec = "unknown"
+	poolName = ResolveAgentPoolName(cr, agentrequest)
+	if err := validateRoutedPool(cr, agentrequest, v1alpha1.FetchAgentPool(cr, poolName)); err != nil {
+		t.Errorf("Job without a routing rule was rejected: %v", err)
+	}
+}
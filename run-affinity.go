@@ -0,0 +1,111 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"regexp"
+	"sort"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// Agents of the later stages of a pipeline run prefer the node the earlier stages ran on, where the
+// build caches and pulled images are still warm. Agent pods are labelled with the run id; when one
+// is released its node is kept in the storage under "runaffinity:<run id>" for later stages.
+const (
+	runIdLabel            = "PipelineRun"
+	runAffinityKeyPrefix  = "runaffinity:"
+	runAffinityWeight     = 100
+	hostnameTopologyLabel = "kubernetes.io/hostname"
+)
+
+var runAffinityTimeout = 24 * time.Hour
+
+var validLabelValue = regexp.MustCompile("^[A-Za-z0-9]([-A-Za-z0-9_.]{0,61}[A-Za-z0-9])?$")
+
+type runAffinity struct {
+	Node      string
+	UpdatedAt time.Time
+}
+
+func isValidRunId(runId string) bool {
+	return runId != "" && validLabelValue.MatchString(runId)
+}
+
+// Returns the node earlier stages of the run used, or an empty string. Running agents of the run
+// are asked first, then the node recorded when an agent of the run was released.
+func preferredNodeForRun(runId string, namespace string) string {
+	if !isValidRunId(runId) {
+		return ""
+	}
+
+	pods, err := CreateClientSet().clientset.CoreV1().Pods(namespace).List(metav1.ListOptions{LabelSelector: runIdLabel + "=" + runId})
+	if err == nil {
+		for _, pod := range pods.Items {
+			if pod.Spec.NodeName != "" {
+				return pod.Spec.NodeName
+			}
+		}
+	}
+
+	value, err := GetStorage().Get(runAffinityKeyPrefix + runId)
+	if err != nil {
+		return ""
+	}
+	var affinity runAffinity
+	if json.Unmarshal([]byte(value), &affinity) != nil || time.Since(affinity.UpdatedAt) > runAffinityTimeout {
+		GetStorage().Delete(runAffinityKeyPrefix + runId)
+		return ""
+	}
+	return affinity.Node
+}
+
+// Remembers the node of a released agent pod for the later stages of its run.
+func recordRunAffinity(pod *v1.Pod) {
+	runId := pod.GetLabels()[runIdLabel]
+	if runId == "" || pod.Spec.NodeName == "" {
+		return
+	}
+
+	data, _ := json.Marshal(runAffinity{Node: pod.Spec.NodeName, UpdatedAt: time.Now().UTC()})
+	if err := GetStorage().Set(runAffinityKeyPrefix+runId, string(data)); err != nil {
+		log.Println("Failed to record the node of run "+runId, err)
+	}
+}
+
+// Adds a preferred, not required, node affinity, so a busy or drained node does not keep the agent
+// from being scheduled elsewhere.
+func addRunNodeAffinity(pod *v1.Pod, node string) {
+	if node == "" {
+		return
+	}
+	if pod.Spec.Affinity == nil {
+		pod.Spec.Affinity = &v1.Affinity{}
+	}
+	if pod.Spec.Affinity.NodeAffinity == nil {
+		pod.Spec.Affinity.NodeAffinity = &v1.NodeAffinity{}
+	}
+
+	nodeAffinity := pod.Spec.Affinity.NodeAffinity
+	nodeAffinity.PreferredDuringSchedulingIgnoredDuringExecution = append(nodeAffinity.PreferredDuringSchedulingIgnoredDuringExecution,
+		v1.PreferredSchedulingTerm{
+			Weight: runAffinityWeight,
+			Preference: v1.NodeSelectorTerm{MatchExpressions: []v1.NodeSelectorRequirement{{
+				Key:      hostnameTopologyLabel,
+				Operator: v1.NodeSelectorOpIn,
+				Values:   []string{node},
+			}}},
+		})
+}
+
+// Orders standby pods so the ones on the preferred node are claimed first.
+func sortByPreferredNode(pods []v1.Pod, node string) {
+	if node == "" {
+		return
+	}
+	sort.SliceStable(pods, func(i, j int) bool {
+		return pods[i].Spec.NodeName == node && pods[j].Spec.NodeName != node
+	})
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"testing"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestRunNodeAffinityShouldPreferNode(t *testing.T) {
+	pod := &v1.Pod{}
+	addRunNodeAffinity(pod, "node-2")
+
+	terms := pod.Spec.Affinity.NodeAffinity.PreferredDuringSchedulingIgnoredDuringExecution
+	if len(terms) != 1 || terms[0].Preference.MatchExpressions[0].Values[0] != "node-2" {
+		t.Errorf("Expected a preference for node-2. Got %v", terms)
+	}
+	if pod.Spec.Affinity.NodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution != nil {
+		t.Errorf("The node must only be preferred")
+	}
+}
+
+func TestSortByPreferredNodeShouldPutPreferredNodeFirst(t *testing.T) {
+	pods := []v1.Pod{
+		{ObjectMeta: metav1.ObjectMeta{Name: "a"}, Spec: v1.PodSpec{NodeName: "node-1"}},
+		{ObjectMeta: metav1.ObjectMeta{Name: "b"}, Spec: v1.PodSpec{NodeName: "node-2"}},
+		{ObjectMeta: metav1.ObjectMeta{Name: "c"}, Spec: v1.PodSpec{NodeName: "node-1"}},
+	}
+
+	sortByPreferredNode(pods, "node-2")
+	if pods[0].GetName() != "b" || pods[1].GetName() != "a" || pods[2].GetName() != "c" {
+		t.Errorf("Unexpected order %v %v %v", pods[0].GetName(), pods[1].GetName(), pods[2].GetName())
+	}
+}
+
+func TestRunIdShouldBeValidLabelValue(t *testing.T) {
+	if !isValidRunId("20431") || isValidRunId("") || isValidRunId("run 1") {
+		t.Errorf("Unexpected run id validation")
+	}
+}
+
+func TestReleasedAgentNodeShouldBePreferredForRun(t *testing.T) {
+	SetupCustomResource()
+	recordRunAffinity(&v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Labels: map[string]string{runIdLabel: "42"}},
+		Spec:       v1.PodSpec{NodeName: "node-3"},
+	})
+
+	if node := preferredNodeForRun("42", testnamespace); node != "node-3" {
+		t.Errorf("Expected node-3. Got %s", node)
+	}
+	if node := preferredNodeForRun("43", testnamespace); node != "" {
+		t.Errorf("Expected no node for another run. Got %s", node)
+	}
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+
+	v1alpha1 "github.com/microsoft/poolprovider-for-k8s/pkg/apis/dev/v1alpha1"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// Jobs no agent of the provider can run are rejected on acquire, before they wait in the creation
+// queue, instead of failing later when the agent lacks a demand or its pod never schedules.
+// Without the pool resource the job is let through, CreatePod reports that problem.
+func validateSatisfiability(agentRequest AgentRequest, namespace string) error {
+	crdobject, _, err := fetchAzurePipelinesPool(namespace)
+	if err != nil {
+		return nil
+	}
+	pool := v1alpha1.FetchAgentPool(crdobject, ResolveAgentPoolName(crdobject, agentRequest))
+	if pool == nil {
+		return nil
+	}
+
+	agentOS, ok := v1alpha1.ResolveAgentOS(pool, agentRequest.OS)
+	if !ok {
+		return unsupportedOSError(agentOS)
+	}
+	if unmatched := v1alpha1.UnmatchedDemands(pool, agentRequest.Demands); len(unmatched) > 0 {
+		return errors.New("No agent of pool " + pool.PoolName + " satisfies the demands: " + strings.Join(unmatched, ", "))
+	}
+	return checkPodFitsNodes(CreateClientSet(), v1alpha1.RenderAgentPodForOS(pool, agentRequest.Demands, agentOS))
+}
+
+// Fails when none of the nodes the pod may run on has the allocatable cpu and memory the pod requests.
+func checkPodFitsNodes(cs *k8s, pod *v1.Pod) error {
+	if pod == nil {
+		return nil
+	}
+	cpu, memory := podRequests(pod)
+	if cpu == 0 && memory == 0 {
+		return nil
+	}
+
+	// Listing nodes needs cluster wide permissions, without them the scheduler has to tell
+	nodes, err := cs.clientset.CoreV1().Nodes().List(metav1.ListOptions{LabelSelector: nodeSelectorString(pod.Spec.NodeSelector)})
+	if err != nil {
+		log.Println("Could not list nodes", err)
+		return nil
+	}
+	// Without a matching node the cluster autoscaler may still add one
+	if len(nodes.Items) == 0 {
+		return nil
+	}
+	for _, node := range nodes.Items {
+		if toleratesNodeTaints(pod, &node) && nodeFits(&node, cpu, memory) {
+			return nil
+		}
+	}
+	return fmt.Errorf("No node the agent pod tolerates has the %dm cpu and %d bytes of memory it requests", cpu, memory)
+}
+
+// Reports whether the tolerations of the pod let it run on the node, e.g. on tainted spot
+// instances. PreferNoSchedule taints only make the scheduler avoid the node.
+func toleratesNodeTaints(pod *v1.Pod, node *v1.Node) bool {
+	for i := range node.Spec.Taints {
+		taint := &node.Spec.Taints[i]
+		if taint.Effect == v1.TaintEffectPreferNoSchedule {
+			continue
+		}
+		tolerated := false
+		for j := range pod.Spec.Tolerations {
+			tolerated = tolerated || pod.Spec.Tolerations[j].ToleratesTaint(taint)
+		}
+		if !tolerated {
+			return false
+		}
+	}
+	return true
+}
+
+// Returns the milli cpu and memory bytes the containers of the pod request. A container with only
+// a limit requests its limit.
+func podRequests(pod *v1.Pod) (int64, int64) {
+	var cpu, memory int64
+	for _, container := range pod.Spec.Containers {
+		requests := container.Resources.Requests
+		limits := container.Resources.Limits
+		if quantity, ok := requests[v1.ResourceCPU]; ok {
+			cpu += quantity.MilliValue()
+		} else if quantity, ok := limits[v1.ResourceCPU]; ok {
+			cpu += quantity.MilliValue()
+		}
+		if quantity, ok := requests[v1.ResourceMemory]; ok {
+			memory += quantity.Value()
+		} else if quantity, ok := limits[v1.ResourceMemory]; ok {
+			memory += quantity.Value()
+		}
+	}
+	return cpu, memory
+}
+
+func nodeFits(node *v1.Node, cpu int64, memory int64) bool {
+	allocatable := node.Status.Allocatable
+	return allocatable.Cpu().MilliValue() >= cpu && allocatable.Memory().Value() >= memory
+}
+
+func nodeSelectorString(selector map[string]string) string {
+	terms := make([]string, 0, len(selector))
+	for key, value := range selector {
+		terms = append(terms, key+"="+value)
+	}
+	sort.Strings(terms)
+	return strings.Join(terms, ",")
+}
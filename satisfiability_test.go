@@ -0,0 +1,56 @@
+package main
+
+import (
+	"testing"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+)
+
+func TestPodRequestsShouldFallBackToLimits(t *testing.T) {
+	pod := &v1.Pod{Spec: v1.PodSpec{Containers: []v1.Container{
+		{Resources: v1.ResourceRequirements{Requests: v1.ResourceList{v1.ResourceCPU: resource.MustParse("500m"), v1.ResourceMemory: resource.MustParse("1Gi")}}},
+		{Resources: v1.ResourceRequirements{Limits: v1.ResourceList{v1.ResourceCPU: resource.MustParse("2")}}},
+	}}}
+
+	cpu, memory := podRequests(pod)
+	if cpu != 2500 || memory != 1<<30 {
+		t.Errorf("Expected 2500m cpu and 1Gi memory. Got %dm and %d", cpu, memory)
+	}
+}
+
+func TestNodeFitsShouldCompareAllocatable(t *testing.T) {
+	node := &v1.Node{Status: v1.NodeStatus{Allocatable: v1.ResourceList{v1.ResourceCPU: resource.MustParse("4"), v1.ResourceMemory: resource.MustParse("8Gi")}}}
+
+	if !nodeFits(node, 4000, 8<<30) {
+		t.Errorf("Expected the pod to fit")
+	}
+	if nodeFits(node, 8000, 1<<30) {
+		t.Errorf("Expected the pod not to fit")
+	}
+}
+
+func TestNodeSelectorStringShouldBeSorted(t *testing.T) {
+	if selector := nodeSelectorString(map[string]string{"kubernetes.io/os": "linux", "agentpool": "build"}); selector != "agentpool=build,kubernetes.io/os=linux" {
+		t.Errorf("Unexpected selector %s", selector)
+	}
+}
+
+func TestToleratesNodeTaintsShouldKeepPodsOffSpotNodes(t *testing.T) {
+	spot := &v1.Node{Spec: v1.NodeSpec{Taints: []v1.Taint{
+		{Key: "kubernetes.azure.com/scalesetpriority", Value: "spot", Effect: v1.TaintEffectNoSchedule},
+		{Key: "node.kubernetes.io/memory-pressure", Effect: v1.TaintEffectPreferNoSchedule},
+	}}}
+	pod := &v1.Pod{}
+
+	if toleratesNodeTaints(pod, spot) {
+		t.Errorf("Expected a pod without tolerations kept off the spot node")
+	}
+	pod.Spec.Tolerations = []v1.Toleration{{Key: "kubernetes.azure.com/scalesetpriority", Operator: v1.TolerationOpEqual, Value: "spot", Effect: v1.TaintEffectNoSchedule}}
+	if !toleratesNodeTaints(pod, spot) {
+		t.Errorf("Expected a pod tolerating spot instances to run on the spot node")
+	}
+	if !toleratesNodeTaints(&v1.Pod{}, &v1.Node{}) {
+		t.Errorf("Expected any pod to run on an untainted node")
+	}
+}
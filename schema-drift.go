@@ -0,0 +1,144 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Fields of the acquire and release payloads the provider does not know are a sign of a change of
+// the Azure DevOps contract. Each one is logged the first time a replica sees it and counted, and
+// GET /admin/compatibility reports the fields seen by the replica. With STRICT_PAYLOAD_SCHEMA=true
+// requests with unknown fields are rejected with 400 instead of being served without them, e.g.
+// in a staging environment. Settings maps of the agent configuration are free-form and not checked.
+const maxUnknownPayloadFields = 100
+
+type UnknownPayloadField struct {
+	Endpoint  string
+	Field     string
+	Count     int64
+	FirstSeen time.Time
+	LastSeen  time.Time
+}
+
+type CompatibilityReport struct {
+	Strict        bool
+	Replica       string
+	UnknownFields []UnknownPayloadField
+}
+
+var schemaDrift = struct {
+	sync.Mutex
+	fields map[string]*UnknownPayloadField
+}{fields: map[string]*UnknownPayloadField{}}
+
+func isStrictPayloadSchema() bool {
+	return strings.EqualFold(os.Getenv("STRICT_PAYLOAD_SCHEMA"), "true")
+}
+
+// Decodes the payload into v, recording its unknown fields. Payloads which are no valid JSON leave
+// v empty, the callers check the fields they need. Returns an error for unknown fields in strict
+// mode only.
+func decodePayload(endpoint string, data []byte, v interface{}) error {
+	json.Unmarshal(data, v)
+	unknown := unknownJsonFields(data, reflect.TypeOf(v), "")
+	if len(unknown) == 0 {
+		return nil
+	}
+	recordUnknownFields(endpoint, unknown, time.Now().UTC())
+	if isStrictPayloadSchema() {
+		return errors.New(UnknownFieldsError + " " + strings.Join(unknown, ", "))
+	}
+	return nil
+}
+
+// Returns the fields of the JSON object which the type has no field for, as dotted paths, sorted.
+// Names match case-insensitively, like encoding/json does.
+func unknownJsonFields(data []byte, t reflect.Type, prefix string) []string {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	var object map[string]json.RawMessage
+	if t.Kind() != reflect.Struct || json.Unmarshal(data, &object) != nil {
+		return nil
+	}
+
+	fields := map[string]reflect.Type{}
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		name := strings.Split(field.Tag.Get("json"), ",")[0]
+		if name == "-" || field.PkgPath != "" {
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+		fields[strings.ToLower(name)] = field.Type
+	}
+
+	unknown := []string{}
+	for name, value := range object {
+		fieldType, ok := fields[strings.ToLower(name)]
+		if !ok {
+			unknown = append(unknown, prefix+name)
+			continue
+		}
+		unknown = append(unknown, unknownJsonFields(value, fieldType, prefix+name+".")...)
+	}
+	sort.Strings(unknown)
+	return unknown
+}
+
+func recordUnknownFields(endpoint string, unknown []string, now time.Time) {
+	schemaDrift.Lock()
+	defer schemaDrift.Unlock()
+	for _, field := range unknown {
+		key := endpoint + " " + field
+		if record, ok := schemaDrift.fields[key]; ok {
+			record.Count++
+			record.LastSeen = now
+			continue
+		}
+		log.Println("Schema drift: " + endpoint + " payload has the unknown field " + field)
+		if len(schemaDrift.fields) >= maxUnknownPayloadFields {
+			continue
+		}
+		schemaDrift.fields[key] = &UnknownPayloadField{Endpoint: endpoint, Field: field, Count: 1, FirstSeen: now, LastSeen: now}
+	}
+}
+
+func unknownPayloadFields() []UnknownPayloadField {
+	schemaDrift.Lock()
+	defer schemaDrift.Unlock()
+	fields := []UnknownPayloadField{}
+	for _, record := range schemaDrift.fields {
+		fields = append(fields, *record)
+	}
+	sort.Slice(fields, func(i, j int) bool {
+		if fields[i].Endpoint != fields[j].Endpoint {
+			return fields[i].Endpoint < fields[j].Endpoint
+		}
+		return fields[i].Field < fields[j].Field
+	})
+	return fields
+}
+
+// Returns the unknown payload fields seen by this replica.
+func CompatibilityHandler(resp http.ResponseWriter, req *http.Request) {
+	if !isReadRequestValid(resp, req) {
+		return
+	}
+	replica, _ := os.Hostname()
+	writeJsonResponse(resp, http.StatusOK, CompatibilityReport{
+		Strict:        isStrictPayloadSchema(),
+		Replica:       replica,
+		UnknownFields: unknownPayloadFields(),
+	})
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestUnknownJsonFieldsShouldFindNestedFields(t *testing.T) {
+	payload := []byte(`{"agentId":"1","ORCHESTRATIONID":"x","agentConfiguration":{"agentVersion":"3","agentSettings":{"new":"1"},"agentCredentials":{"scheme":"x","expiry":1}},"traceParent":"y"}`)
+
+	unknown := unknownJsonFields(payload, reflect.TypeOf(&AgentRequest{}), "")
+	expected := []string{"ORCHESTRATIONID", "agentConfiguration.agentCredentials.expiry", "traceParent"}
+	if !reflect.DeepEqual(unknown, expected) {
+		t.Errorf("Expected %v. Got %v", expected, unknown)
+	}
+}
+
+func TestDecodePayloadShouldRejectUnknownFieldsInStrictMode(t *testing.T) {
+	var request ReleaseAgentRequest
+	if err := decodePayload("release", []byte(`{"agentId":"1","reason":"canceled"}`), &request); err != nil || request.AgentId != "1" {
+		t.Errorf("Expected unknown fields to be accepted. Got %v (%v)", request, err)
+	}
+
+	os.Setenv("STRICT_PAYLOAD_SCHEMA", "true")
+	defer os.Unsetenv("STRICT_PAYLOAD_SCHEMA")
+	if err := decodePayload("release", []byte(`{"agentId":"1","reason":"canceled"}`), &request); err == nil || !strings.HasSuffix(err.Error(), " reason") {
+		t.Errorf("Expected the unknown field to be rejected. Got %v", err)
+	}
+	if err := decodePayload("release", []byte(`{"agentId":"1"}`), &request); err != nil {
+		t.Errorf("Expected a known payload to be accepted. Got %v", err)
+	}
+
+	var seen *UnknownPayloadField
+	for _, field := range unknownPayloadFields() {
+		if field.Endpoint == "release" && field.Field == "reason" {
+			seen = &field
+		}
+	}
+	if seen == nil || seen.Count < 2 || seen.LastSeen.Before(seen.FirstSeen) || time.Since(seen.FirstSeen) > time.Minute {
+		t.Errorf("Expected the unknown field in the compatibility report. Got %v", seen)
+	}
+}
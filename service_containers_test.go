@@ -0,0 +1,53 @@
+package main
+
+import (
+	"testing"
+
+	v1alpha1 "github.com/microsoft/poolprovider-for-k8s/pkg/apis/dev/v1alpha1"
+	v1 "k8s.io/api/core/v1"
+)
+
+func TestServiceDemandsShouldAddServiceContainers(t *testing.T) {
+	pool := &v1alpha1.AgentPoolSpec{
+		PoolName: "linux",
+		PoolSpec: &v1.PodSpec{Containers: []v1.Container{{Name: "agent", Image: "agent"}}},
+	}
+
+	pod := v1alpha1.RenderAgentPod(pool, []string{"service:redis", "service:postgres=15", "docker"})
+
+	containers := pod.Spec.Containers
+	if len(containers) != 3 || containers[1].Name != "service-postgres" || containers[2].Name != "service-redis" {
+		t.Fatalf("Expected postgres and redis next to the agent. Got %v", containers)
+	}
+	if containers[1].Image != "postgres:15" || containers[2].Image != "redis:7" {
+		t.Errorf("Expected the demanded and the default tag. Got %s and %s", containers[1].Image, containers[2].Image)
+	}
+	if probe := containers[1].ReadinessProbe; probe == nil || probe.TCPSocket == nil || probe.TCPSocket.Port.IntVal != 5432 {
+		t.Errorf("Expected a readiness probe on the port. Got %v", probe)
+	}
+	ports := map[string]string{}
+	for _, env := range containers[0].Env {
+		ports[env.Name] = env.Value
+	}
+	if ports["SERVICE_POSTGRES_PORT"] != "5432" || ports["SERVICE_REDIS_PORT"] != "6379" {
+		t.Errorf("Expected the ports in the agent environment. Got %v", containers[0].Env)
+	}
+	if pool.PoolSpec.Containers[0].Env != nil {
+		t.Errorf("Expected the pool to be left untouched")
+	}
+}
+
+func TestUnmatchedDemandsShouldRejectServicesOutsideTheCatalog(t *testing.T) {
+	unmatched := v1alpha1.UnmatchedDemands(nil, []string{"service:postgres=15", "service:oracle", "service:redis=bad tag!", "docker"})
+	if len(unmatched) != 2 || unmatched[0] != "service:oracle" || unmatched[1] != "service:redis=bad tag!" {
+		t.Errorf("Expected the unknown service and the invalid tag. Got %v", unmatched)
+	}
+
+	pool := &v1alpha1.AgentPoolSpec{Capabilities: []string{"docker"}}
+	if unmatched := v1alpha1.UnmatchedDemands(pool, []string{"service:mysql", "docker"}); len(unmatched) != 0 {
+		t.Errorf("Expected catalog services to be met by any pool. Got %v", unmatched)
+	}
+	if !v1alpha1.HasServiceDemands([]string{"service:mysql"}) || v1alpha1.HasServiceDemands([]string{"docker"}) {
+		t.Errorf("Expected only service demands to count")
+	}
+}
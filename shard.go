@@ -0,0 +1,97 @@
+package main
+
+import (
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// With POOL_SHARDING=true the per-pool background work, the warm pools and the budget checks, is
+// spread over the webserver replicas instead of falling on one. Every replica renews its
+// membership under "shard:<replica>" in the storage, the same way the leader renews its lease, and
+// the pools are assigned to the live replicas by consistent hashing, so a replica joining or
+// leaving only moves the pools of its share. Work spanning all pools, like the storage compaction,
+// the reconciliation and the recycle windows, stays with the leader. Acquire and release requests
+// are served by whichever replica receives them, their state is shared through the storage.
+const (
+	shardKeyPrefix        = "shard:"
+	shardHeartbeatTimeout = 3 * leaseDuration
+)
+
+var shardHeartbeatInterval = leaseRetryPeriod * 2
+
+var shardState = struct {
+	sync.Mutex
+	identity string
+	members  []string
+}{}
+
+func isShardingEnabled() bool {
+	return strings.EqualFold(os.Getenv("POOL_SHARDING"), "true")
+}
+
+// Returns whether this replica does the background work of the pool. Without sharding, or before
+// the members are known, the leader does the work of every pool.
+func ownsPool(poolName string) bool {
+	if !isShardingEnabled() {
+		return IsLeader()
+	}
+	shardState.Lock()
+	identity, members := shardState.identity, shardState.members
+	shardState.Unlock()
+	if len(members) == 0 {
+		return IsLeader()
+	}
+	return ComputeConsistentHash(members, poolName) == identity
+}
+
+// Renews the membership of this replica and refreshes the members until the process exits.
+func RunShardMembership() {
+	if !isShardingEnabled() {
+		return
+	}
+
+	identity, _ := os.Hostname()
+	shardState.Lock()
+	shardState.identity = identity
+	shardState.Unlock()
+
+	for {
+		now := time.Now().UTC()
+		store := GetStorage()
+		if err := store.Set(shardKeyPrefix+identity, now.Format(time.RFC3339)); err != nil {
+			log.Println("Failed to renew the shard membership", err)
+		} else if heartbeats, err := store.List(shardKeyPrefix); err != nil {
+			log.Println("Failed to list the shard members", err)
+		} else {
+			setShardMembers(liveShardMembers(heartbeats, now, shardHeartbeatTimeout))
+		}
+		time.Sleep(shardHeartbeatInterval)
+	}
+}
+
+func setShardMembers(members []string) {
+	shardState.Lock()
+	defer shardState.Unlock()
+	if strings.Join(members, ",") != strings.Join(shardState.members, ",") {
+		log.Println("Pools are sharded across the replicas " + strings.Join(members, ", "))
+	}
+	shardState.members = members
+}
+
+// Returns the replicas whose last heartbeat is within the timeout, sorted.
+func liveShardMembers(heartbeats map[string]string, now time.Time, timeout time.Duration) []string {
+	members := []string{}
+	for key, value := range heartbeats {
+		renewed, err := time.Parse(time.RFC3339, value)
+		if err != nil || now.Sub(renewed) > timeout {
+			continue
+		}
+		members = append(members, strings.TrimPrefix(key, shardKeyPrefix))
+	}
+	sort.Strings(members)
+	return members
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"os"
+	"testing"
+	"time"
+)
+
+func TestLiveShardMembersShouldDropStaleReplicas(t *testing.T) {
+	now := time.Now().UTC()
+	members := liveShardMembers(map[string]string{
+		shardKeyPrefix + "webserver-b": now.Add(-5 * time.Second).Format(time.RFC3339),
+		shardKeyPrefix + "webserver-a": now.Format(time.RFC3339),
+		shardKeyPrefix + "webserver-c": now.Add(-time.Hour).Format(time.RFC3339),
+		shardKeyPrefix + "webserver-d": "garbage",
+	}, now, time.Minute)
+
+	if len(members) != 2 || members[0] != "webserver-a" || members[1] != "webserver-b" {
+		t.Errorf("Expected the live replicas, sorted. Got %v", members)
+	}
+}
+
+func TestOwnsPoolShouldSplitPoolsAcrossMembers(t *testing.T) {
+	os.Setenv("POOL_SHARDING", "true")
+	defer os.Unsetenv("POOL_SHARDING")
+	defer setShardMembers(nil)
+
+	owners := map[string]int{}
+	setShardMembers([]string{"webserver-a", "webserver-b"})
+	for _, identity := range []string{"webserver-a", "webserver-b"} {
+		shardState.Lock()
+		shardState.identity = identity
+		shardState.Unlock()
+		for _, pool := range []string{"linux", "windows", "gpu", "arm64", "canary", "large"} {
+			if ownsPool(pool) {
+				owners[pool]++
+			}
+		}
+	}
+
+	if len(owners) != 6 {
+		t.Errorf("Expected every pool to have an owner. Got %v", owners)
+	}
+	for pool, count := range owners {
+		if count != 1 {
+			t.Errorf("Expected pool %s to have one owner. Got %d", pool, count)
+		}
+	}
+}
+
+func TestOwnsPoolShouldFallToTheLeaderWithoutSharding(t *testing.T) {
+	if ownsPool("linux") {
+		t.Errorf("Expected replicas other than the leader to own no pool")
+	}
+	setLeadership(true)
+	defer setLeadership(false)
+	if !ownsPool("linux") {
+		t.Errorf("Expected the leader to own every pool")
+	}
+}
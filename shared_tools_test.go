@@ -0,0 +1,46 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	v1alpha1 "github.com/microsoft/poolprovider-for-k8s/pkg/apis/dev/v1alpha1"
+	v1 "k8s.io/api/core/v1"
+)
+
+func TestSharedToolsShouldBeMountedReadOnly(t *testing.T) {
+	pool := &v1alpha1.AgentPoolSpec{
+		PoolName:    "slim",
+		PoolSpec:    &v1.PodSpec{Containers: []v1.Container{{Name: "agent", Image: "agent-slim"}}},
+		SharedTools: &v1alpha1.SharedToolsSpec{Image: "tools:1", SourcePath: "/opt/tools", MountPath: "/opt/tools"},
+	}
+
+	pod := v1alpha1.RenderAgentPod(pool, nil)
+	if len(pod.Spec.Volumes) != 1 || pod.Spec.Volumes[0].HostPath == nil {
+		t.Fatalf("Expected a host path volume. Got %v", pod.Spec.Volumes)
+	}
+	if path := pod.Spec.Volumes[0].HostPath.Path; !strings.HasPrefix(path, v1alpha1.SharedToolsRoot+"/slim/") {
+		t.Errorf("Unexpected host path %s", path)
+	}
+
+	mounts := pod.Spec.Containers[0].VolumeMounts
+	mount := mounts[len(mounts)-1]
+	if mount.Name != pod.Spec.Volumes[0].Name || !mount.ReadOnly || mount.MountPath != "/opt/tools" {
+		t.Errorf("Expected a read-only mount. Got %v", mounts)
+	}
+}
+
+func TestSharedToolsHostPathShouldChangeWithImage(t *testing.T) {
+	if v1alpha1.SharedToolsHostPath("slim", "tools:1") == v1alpha1.SharedToolsHostPath("slim", "tools:2") {
+		t.Errorf("Expected every tools image to get its own directory")
+	}
+}
+
+func TestSharedToolsShouldNotChangePoolsWithoutThem(t *testing.T) {
+	pool := &v1alpha1.AgentPoolSpec{PoolSpec: &v1.PodSpec{Containers: []v1.Container{{Name: "agent"}}}}
+
+	pod := v1alpha1.RenderAgentPod(pool, nil)
+	if len(pod.Spec.Volumes) != 0 {
+		t.Errorf("Expected no shared tools volume. Got %v", pod.Spec.Volumes)
+	}
+}
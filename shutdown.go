@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+// On SIGTERM, e.g. during a rolling update, the webserver shuts down in phases, each bounded by its
+// own timeout, so pod creations are not cut off halfway:
+//
+//  1. intake: acquire requests are answered with 503, which Azure DevOps retries, and readiness
+//     fails, for SHUTDOWN_INTAKE_SECONDS (5) while the replica is taken out of the Service. The
+//     leader gives up its lease right away, so another replica takes over the background work.
+//  2. creations: the listeners are closed and the requests in flight, with their pod creations,
+//     and the async operations being processed get SHUTDOWN_TIMEOUT_SECONDS (15) to finish.
+//  3. operations: the async operations this replica has not finished are queued again within
+//     SHUTDOWN_OPERATIONS_SECONDS (5) and their leases released, so another replica takes them over.
+//
+// The defaults add up to less than the termination grace period of 30 seconds of the webserver
+// pod. A phase which times out is logged and the next one runs anyway. All other state is written
+// to the storage as requests go, and metrics are scraped, so there is nothing else to flush or to
+// close; creations still running at the end are finished or rolled back by the journal recovery of
+// the next start.
+const (
+	defaultShutdownIntake     = 5 * time.Second
+	defaultShutdownTimeout    = 15 * time.Second
+	defaultShutdownOperations = 5 * time.Second
+)
+
+type shutdownPhase struct {
+	name    string
+	timeout time.Duration
+	run     func(ctx context.Context) error
+}
+
+func serveUntilTerminated(server *http.Server) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, os.Interrupt)
+
+	errs := make(chan error, 1)
+	go func() {
+		if server.TLSConfig != nil {
+			errs <- server.ListenAndServeTLS("", "")
+		} else {
+			errs <- server.ListenAndServe()
+		}
+	}()
+
+	select {
+	case err := <-errs:
+		newFieldLogger().Error(err)
+		os.Exit(1)
+	case received := <-signals:
+		log.Println("Received " + received.String() + ", shutting down")
+	}
+
+	runShutdownPhases(shutdownPhases(server))
+}
+
+func shutdownPhases(server *http.Server) []shutdownPhase {
+	intake := time.Duration(getEnvInt("SHUTDOWN_INTAKE_SECONDS", int(defaultShutdownIntake/time.Second))) * time.Second
+	timeout := time.Duration(getEnvInt("SHUTDOWN_TIMEOUT_SECONDS", int(defaultShutdownTimeout/time.Second))) * time.Second
+	operations := time.Duration(getEnvInt("SHUTDOWN_OPERATIONS_SECONDS", int(defaultShutdownOperations/time.Second))) * time.Second
+
+	return []shutdownPhase{
+		{name: "intake", timeout: intake, run: func(ctx context.Context) error {
+			setDraining()
+			standDown(intake + timeout + operations)
+			<-ctx.Done()
+			return nil
+		}},
+		{name: "creations", timeout: timeout, run: func(ctx context.Context) error {
+			return drainServer(ctx, server)
+		}},
+		{name: "operations", timeout: operations, run: func(ctx context.Context) error {
+			handedBack, err := handBackOperations(ctx)
+			log.Println("Handed back " + strconv.Itoa(handedBack) + " unfinished async operations")
+			return err
+		}},
+	}
+}
+
+// Runs the phases in order, each until its timeout.
+func runShutdownPhases(phases []shutdownPhase) {
+	for _, phase := range phases {
+		started := time.Now()
+		ctx, cancel := context.WithTimeout(context.Background(), phase.timeout)
+		err := phase.run(ctx)
+		cancel()
+		elapsed := time.Since(started).Round(time.Millisecond).String()
+		if err != nil {
+			log.Println("Shutdown phase "+phase.name+" did not finish after "+elapsed+", going on", err)
+			continue
+		}
+		log.Println("Shutdown phase " + phase.name + " finished in " + elapsed)
+	}
+}
+
+// Closes the listeners and waits for the requests in flight and the async operations being
+// processed until the context is done.
+func drainServer(ctx context.Context, server *http.Server) error {
+	if err := server.Shutdown(ctx); err != nil {
+		return err
+	}
+	return waitForOperations(ctx)
+}
+
+// Answers acquire requests with 503 once the webserver is shutting down, Azure DevOps retries them
+// and the Service sends the retries to another replica.
+func withShutdownIntake(handler http.HandlerFunc) http.HandlerFunc {
+	return func(resp http.ResponseWriter, req *http.Request) {
+		if isDraining() {
+			resp.Header().Set("Retry-After", "1")
+			writeJsonResponse(resp, http.StatusServiceUnavailable, AgentProvisionResponse{ResponseType: "fail", ErrorMessage: ServerBusyError})
+			return
+		}
+		handler(resp, req)
+	}
+}
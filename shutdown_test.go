@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestDrainServerShouldWaitForRequestsInFlight(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Expected a listener. Got %v", err)
+	}
+	started := make(chan bool)
+	finished := make(chan bool, 1)
+	server := &http.Server{Handler: http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		started <- true
+		time.Sleep(100 * time.Millisecond)
+		finished <- true
+	})}
+	go server.Serve(listener)
+
+	go http.Get("http://" + listener.Addr().String())
+	<-started
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := drainServer(ctx, server); err != nil {
+		t.Errorf("Expected the server to drain. Got %v", err)
+	}
+	select {
+	case <-finished:
+	default:
+		t.Errorf("Expected the request in flight to finish before the shutdown returned")
+	}
+	if _, err := http.Get("http://" + listener.Addr().String()); err == nil {
+		t.Errorf("Expected new connections to be refused")
+	}
+}
+
+func TestDrainServerShouldGiveUpAtTheTimeout(t *testing.T) {
+	listener, _ := net.Listen("tcp", "127.0.0.1:0")
+	started := make(chan bool)
+	server := &http.Server{Handler: http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		started <- true
+		time.Sleep(time.Second)
+	})}
+	go server.Serve(listener)
+
+	go http.Get("http://" + listener.Addr().String())
+	<-started
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := drainServer(ctx, server); err == nil {
+		t.Errorf("Expected the drain to time out")
+	}
+}
+
+func TestDrainServerShouldWaitForRunningOperations(t *testing.T) {
+	listener, _ := net.Listen("tcp", "127.0.0.1:0")
+	server := &http.Server{Handler: http.NotFoundHandler()}
+	go server.Serve(listener)
+
+	atomic.AddInt32(&runningOperations, 1)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	err := drainServer(ctx, server)
+	atomic.AddInt32(&runningOperations, -1)
+	if err != context.DeadlineExceeded {
+		t.Errorf("Expected the drain to wait for the running operation. Got %v", err)
+	}
+}
+
+func TestRunShutdownPhasesShouldGoOnAfterAPhaseTimedOut(t *testing.T) {
+	var ran []string
+	runShutdownPhases([]shutdownPhase{
+		{name: "slow", timeout: 10 * time.Millisecond, run: func(ctx context.Context) error {
+			ran = append(ran, "slow")
+			<-ctx.Done()
+			return ctx.Err()
+		}},
+		{name: "failing", timeout: time.Second, run: func(ctx context.Context) error {
+			ran = append(ran, "failing")
+			return errors.New("storage unavailable")
+		}},
+		{name: "last", timeout: time.Second, run: func(ctx context.Context) error {
+			ran = append(ran, "last")
+			return nil
+		}},
+	})
+	if len(ran) != 3 || ran[2] != "last" {
+		t.Errorf("Expected every phase to run in order. Got %v", ran)
+	}
+}
+
+func TestShutdownIntakeShouldRejectAcquiresWhileDraining(t *testing.T) {
+	handler := withShutdownIntake(func(resp http.ResponseWriter, req *http.Request) {
+		resp.WriteHeader(http.StatusCreated)
+	})
+
+	resp := httptest.NewRecorder()
+	handler(resp, httptest.NewRequest("POST", "/acquire", nil))
+	if resp.Code != http.StatusCreated {
+		t.Errorf("Expected acquires handled before the shutdown. Got %d", resp.Code)
+	}
+
+	setDraining()
+	defer atomic.StoreInt32(&serverDraining, 0)
+	resp = httptest.NewRecorder()
+	handler(resp, httptest.NewRequest("POST", "/acquire", nil))
+	if resp.Code != http.StatusServiceUnavailable || resp.Header().Get("Retry-After") == "" {
+		t.Errorf("Expected 503 with Retry-After while draining. Got %d", resp.Code)
+	}
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sort"
+	"time"
+
+	v1alpha1 "github.com/microsoft/poolprovider-for-k8s/pkg/apis/dev/v1alpha1"
+	"github.com/microsoft/poolprovider-for-k8s/pkg/storage"
+	v1 "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// GET /admin/snapshot exports the state of the provider, every storage entry and the metadata and
+// status of the agent pods, so an incident can be reproduced locally. POSTing the snapshot to a
+// webserver running with IS_TESTENVIRONMENT "true" restores it into its storage and the fake
+// Kubernetes client; other webservers refuse the restore. Pod specs are left out, their
+// environment may hold credentials. Snapshots of busy installs are larger than the body limit of
+// the other requests, the restore takes up to MAX_SNAPSHOT_BODY_BYTES, 64 MiB by default.
+const defaultMaxSnapshotBody = 64 << 20
+
+type StateSnapshot struct {
+	TakenAt  time.Time
+	Instance string
+	Entries  map[string]string
+	Pods     []PodSnapshot
+}
+
+type SnapshotRestoreResult struct {
+	Entries int
+	Pods    int
+}
+
+type PodSnapshot struct {
+	Metadata metav1.ObjectMeta
+	NodeName string `json:",omitempty"`
+	Status   v1.PodStatus
+}
+
+func maxSnapshotBody() int64 {
+	return int64(getEnvInt("MAX_SNAPSHOT_BODY_BYTES", defaultMaxSnapshotBody))
+}
+
+func takeStateSnapshot(cs *k8s, store storage.Storage, namespaces []string, now time.Time) (StateSnapshot, error) {
+	hostname, _ := os.Hostname()
+	snapshot := StateSnapshot{TakenAt: now, Instance: hostname, Pods: []PodSnapshot{}}
+
+	entries, err := store.List("")
+	if err != nil {
+		return snapshot, err
+	}
+	snapshot.Entries = entries
+
+	for _, namespace := range namespaces {
+		pods, err := cs.clientset.CoreV1().Pods(namespace).List(metav1.ListOptions{LabelSelector: agentIdLabel})
+		if err != nil {
+			return snapshot, err
+		}
+		snapshot.Pods = append(snapshot.Pods, snapshotPods(pods.Items)...)
+	}
+	return snapshot, nil
+}
+
+func snapshotPods(pods []v1.Pod) []PodSnapshot {
+	snapshots := []PodSnapshot{}
+	for _, pod := range pods {
+		metadata := pod.ObjectMeta
+		metadata.ManagedFields = nil
+		snapshots = append(snapshots, PodSnapshot{Metadata: metadata, NodeName: pod.Spec.NodeName, Status: pod.Status})
+	}
+	sort.Slice(snapshots, func(i, j int) bool { return snapshots[i].Metadata.Name < snapshots[j].Metadata.Name })
+	return snapshots
+}
+
+// Writes the entries and recreates the pods, replacing what is there. The pods get a placeholder
+// container, the spec was not exported.
+func restoreStateSnapshot(clientset kubernetes.Interface, store storage.Storage, snapshot StateSnapshot) error {
+	for key, value := range snapshot.Entries {
+		if err := store.Set(key, value); err != nil {
+			return err
+		}
+	}
+
+	for _, podSnapshot := range snapshot.Pods {
+		pod := restoredPod(podSnapshot)
+		pods := clientset.CoreV1().Pods(pod.GetNamespace())
+		if err := pods.Delete(pod.GetName(), &metav1.DeleteOptions{}); err != nil && !k8serrors.IsNotFound(err) {
+			return err
+		}
+		if _, err := pods.Create(pod); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func restoredPod(podSnapshot PodSnapshot) *v1.Pod {
+	metadata := podSnapshot.Metadata
+	metadata.ResourceVersion = ""
+	metadata.UID = ""
+	return &v1.Pod{
+		ObjectMeta: metadata,
+		Spec: v1.PodSpec{
+			NodeName:   podSnapshot.NodeName,
+			Containers: []v1.Container{{Name: "vsts-agent", Image: "restored"}},
+		},
+		Status: podSnapshot.Status,
+	}
+}
+
+func SnapshotHandler(resp http.ResponseWriter, req *http.Request) {
+	if req.Method == http.MethodGet {
+		if !isReadRequestValid(resp, req) {
+			return
+		}
+		snapshot, err := takeStateSnapshot(CreateClientSet(), GetStorage(), permissionNamespaces(), time.Now().UTC())
+		if err != nil {
+			writeJsonResponse(resp, http.StatusInternalServerError, GetError(err.Error()))
+			return
+		}
+		writeJsonResponse(resp, http.StatusOK, snapshot)
+		return
+	}
+
+	if req.Method != http.MethodPost {
+		writeJsonResponse(resp, http.StatusMethodNotAllowed, GetError(InvalidRequestError))
+		return
+	}
+	if !isRequestHmacValid(req) {
+		writeJsonResponse(resp, http.StatusForbidden, GetError(NoValidSignatureError))
+		return
+	}
+	if !v1alpha1.IsTestingEnv() {
+		writeJsonResponse(resp, http.StatusForbidden, GetError(SnapshotRestoreError))
+		return
+	}
+
+	var snapshot StateSnapshot
+	body, _ := ioutil.ReadAll(req.Body)
+	if err := json.Unmarshal(body, &snapshot); err != nil {
+		writeJsonResponse(resp, http.StatusBadRequest, GetError(err.Error()))
+		return
+	}
+	if err := restoreStateSnapshot(CreateClientSet().clientset, GetStorage(), snapshot); err != nil {
+		writeJsonResponse(resp, http.StatusInternalServerError, GetError(err.Error()))
+		return
+	}
+	writeJsonResponse(resp, http.StatusOK, SnapshotRestoreResult{Entries: len(snapshot.Entries), Pods: len(snapshot.Pods)})
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/microsoft/poolprovider-for-k8s/pkg/storage"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestSnapshotPodsShouldKeepMetadataAndStatusOnly(t *testing.T) {
+	pods := []v1.Pod{{
+		ObjectMeta: metav1.ObjectMeta{Name: "agent-b", Labels: map[string]string{agentIdLabel: "2"}},
+		Spec:       v1.PodSpec{NodeName: "node-1", Containers: []v1.Container{{Name: "vsts-agent", Env: []v1.EnvVar{{Name: "TOKEN", Value: "secret"}}}}},
+		Status:     v1.PodStatus{Phase: v1.PodRunning},
+	}, {
+		ObjectMeta: metav1.ObjectMeta{Name: "agent-a"},
+	}}
+
+	snapshots := snapshotPods(pods)
+	if len(snapshots) != 2 || snapshots[0].Metadata.Name != "agent-a" {
+		t.Fatalf("Expected the pods sorted by name. Got %v", snapshots)
+	}
+	if snapshots[1].NodeName != "node-1" || snapshots[1].Status.Phase != v1.PodRunning {
+		t.Errorf("Expected the node and status. Got %+v", snapshots[1])
+	}
+	if data, _ := json.Marshal(snapshots); strings.Contains(string(data), "secret") {
+		t.Errorf("Expected the pod spec to be left out. Got %s", data)
+	}
+}
+
+func TestRestoreStateSnapshotShouldWriteEntriesAndPods(t *testing.T) {
+	clientset := fake.NewSimpleClientset()
+	store := storage.NewMemoryStorage(0)
+	snapshot := StateSnapshot{
+		Entries: map[string]string{"dedupe:1": "{}"},
+		Pods: []PodSnapshot{{
+			Metadata: metav1.ObjectMeta{Name: "agent-a", Namespace: "azuredevops", Labels: map[string]string{agentIdLabel: "1"}},
+			Status:   v1.PodStatus{Phase: v1.PodRunning},
+		}},
+	}
+
+	if err := restoreStateSnapshot(clientset, store, snapshot); err != nil {
+		t.Fatalf("Expected the restore to succeed. Got %v", err)
+	}
+	if value, err := store.Get("dedupe:1"); err != nil || value != "{}" {
+		t.Errorf("Expected the entry to be restored. Got %s (%v)", value, err)
+	}
+	pod, err := clientset.CoreV1().Pods("azuredevops").Get("agent-a", metav1.GetOptions{})
+	if err != nil || pod.Status.Phase != v1.PodRunning || pod.Labels[agentIdLabel] != "1" {
+		t.Errorf("Expected the pod to be restored. Got %v (%v)", pod, err)
+	}
+}
+
+func TestSnapshotRestoreShouldTakeBodiesOverTheRequestLimit(t *testing.T) {
+	os.Setenv("IS_TESTENVIRONMENT", "true")
+	os.Setenv("VSTS_SECRET", "sharedsecret1234")
+	os.Setenv("STORAGE_BACKEND", "memory")
+	defer os.Unsetenv("STORAGE_BACKEND")
+	defer GetStorage().Delete("snapshot:large")
+
+	snapshot := StateSnapshot{Entries: map[string]string{"snapshot:large": strings.Repeat("x", 2*defaultMaxRequestBody)}}
+	body, _ := json.Marshal(snapshot)
+	handler := withBodyLimit(defaultMaxRequestBody, map[string]int64{"/admin/snapshot": maxSnapshotBody()}, http.HandlerFunc(SnapshotHandler))
+
+	req := httptest.NewRequest(http.MethodPost, "/admin/snapshot", bytes.NewReader(body))
+	req.Header.Add(signatureHeader, ComputeHash(string(body)))
+	resp := httptest.NewRecorder()
+	handler.ServeHTTP(resp, req)
+	if resp.Code != http.StatusOK {
+		t.Fatalf("Expected the snapshot of %d bytes restored. Got %d %s", len(body), resp.Code, resp.Body.String())
+	}
+	if value, _ := GetStorage().Get("snapshot:large"); len(value) != 2*defaultMaxRequestBody {
+		t.Errorf("Expected the large entry restored. Got %d bytes", len(value))
+	}
+
+	// Other paths keep the request limit
+	req = httptest.NewRequest(http.MethodPost, "/acquire", bytes.NewReader(body))
+	resp = httptest.NewRecorder()
+	handler.ServeHTTP(resp, req)
+	if resp.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("Expected 413 for other paths. Got %d", resp.Code)
+	}
+}
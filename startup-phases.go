@@ -0,0 +1,128 @@
+package main
+
+import (
+	"log"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// The time an agent pod takes to become ready is split into the phases it goes through, taken from
+// the pod conditions, the container statuses and the kubelet events of the pod. The pod is queued
+// from creation until it is scheduled, then scheduled until the kubelet starts pulling the image
+// (volumes, sandbox), in image pull until the image is pulled, in container start until the
+// containers run, and in agent registration until the agent registered and the pod is ready.
+// Without pull events, e.g. when the events expired, the pull phases are left out and the
+// container start phase begins when the pod is scheduled.
+const (
+	startupPhaseQueued       = "queued"
+	startupPhaseScheduled    = "scheduled"
+	startupPhaseImagePull    = "image_pull"
+	startupPhaseStart        = "container_start"
+	startupPhaseRegistration = "agent_registration"
+	pullingEventReason       = "Pulling"
+	pulledEventReason        = "Pulled"
+)
+
+type startupPhase struct {
+	Name     string
+	Duration time.Duration
+}
+
+func observeStartupPhases(poolName string, pod *v1.Pod) {
+	for _, phase := range podStartupPhases(pod, podEvents(pod)) {
+		agentStartupPhaseSeconds.WithLabelValues(poolName, phase.Name).Observe(phase.Duration.Seconds())
+	}
+}
+
+func podEvents(pod *v1.Pod) []v1.Event {
+	events, err := CreateClientSet().clientset.CoreV1().Events(pod.Namespace).List(metav1.ListOptions{FieldSelector: "involvedObject.uid=" + string(pod.UID)})
+	if err != nil {
+		log.Println("Failed to list the events of pod "+pod.Name, err)
+		return nil
+	}
+
+	var podEvents []v1.Event
+	for _, event := range events.Items {
+		if event.InvolvedObject.UID == pod.UID {
+			podEvents = append(podEvents, event)
+		}
+	}
+	return podEvents
+}
+
+// Returns the phases of a ready pod in order. Phases whose boundaries are unknown are left out.
+func podStartupPhases(pod *v1.Pod, events []v1.Event) []startupPhase {
+	created := pod.CreationTimestamp.Time
+	scheduled := conditionTransition(pod, v1.PodScheduled)
+	ready := conditionTransition(pod, v1.PodReady)
+	if created.IsZero() || scheduled.IsZero() || ready.IsZero() {
+		return nil
+	}
+
+	var pullStarted, pulled time.Time
+	for _, event := range events {
+		switch event.Reason {
+		case pullingEventReason:
+			if pullStarted.IsZero() || event.FirstTimestamp.Time.Before(pullStarted) {
+				pullStarted = event.FirstTimestamp.Time
+			}
+		case pulledEventReason:
+			if event.LastTimestamp.Time.After(pulled) {
+				pulled = event.LastTimestamp.Time
+			}
+		}
+	}
+	// An image already present on the node is reported pulled without pulling it.
+	if pullStarted.IsZero() && !pulled.IsZero() {
+		pullStarted = pulled
+	}
+
+	started := containersStarted(pod)
+	if started.IsZero() {
+		return nil
+	}
+
+	phases := []startupPhase{{startupPhaseQueued, scheduled.Sub(created)}}
+	startBegins := scheduled
+	if !pulled.IsZero() {
+		phases = append(phases,
+			startupPhase{startupPhaseScheduled, pullStarted.Sub(scheduled)},
+			startupPhase{startupPhaseImagePull, pulled.Sub(pullStarted)})
+		startBegins = pulled
+	}
+	phases = append(phases,
+		startupPhase{startupPhaseStart, started.Sub(startBegins)},
+		startupPhase{startupPhaseRegistration, ready.Sub(started)})
+
+	for i := range phases {
+		if phases[i].Duration < 0 {
+			phases[i].Duration = 0
+		}
+	}
+	return phases
+}
+
+func conditionTransition(pod *v1.Pod, conditionType v1.PodConditionType) time.Time {
+	for _, condition := range pod.Status.Conditions {
+		if condition.Type == conditionType && condition.Status == v1.ConditionTrue {
+			return condition.LastTransitionTime.Time
+		}
+	}
+	return time.Time{}
+}
+
+// Returns when the last container of the pod started running, which is when all of them run.
+func containersStarted(pod *v1.Pod) time.Time {
+	var started time.Time
+	for _, status := range pod.Status.ContainerStatuses {
+		if status.State.Running == nil {
+			return time.Time{}
+		}
+		if status.State.Running.StartedAt.Time.After(started) {
+			started = status.State.Running.StartedAt.Time
+		}
+	}
+	return started
+}
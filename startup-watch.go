@@ -0,0 +1,196 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/microsoft/poolprovider-for-k8s/pkg/azuredevops"
+	v1 "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// A created agent pod says nothing about whether its agent registered with Azure DevOps. The leader
+// follows every agent pod it created or handed out from the warm pool from pending through running
+// to ready, and, when the Azure DevOps connection is configured and the pool has an
+// AzureDevOpsPoolId, until Azure DevOps reports the agent online. The state is kept under
+// "startup:<agentId>" in the storage and shown by the status API. Agents whose image cannot be
+// pulled, whose container keeps crashing or which do not get there within
+// STARTUP_TIMEOUT_SECONDS (600) are marked failed and a notification is sent. The agents are
+// checked every STARTUP_WATCH_INTERVAL_SECONDS (5), and their state is kept for
+// STARTUP_RETENTION_HOURS (24).
+const (
+	startupKeyPrefix        = "startup:"
+	defaultStartupTimeout   = 10 * time.Minute
+	defaultStartupRetention = 24 * time.Hour
+
+	StartupStatePending = "pending"
+	StartupStateRunning = "running"
+	StartupStateReady   = "ready"
+	StartupStateOnline  = "online"
+	StartupStateFailed  = "failed"
+)
+
+var startupWatchInterval = 5 * time.Second
+
+// Waiting reasons of a container which will not start without someone fixing the pool
+var startupFailureReasons = map[string]bool{
+	"ErrImagePull":               true,
+	"ImagePullBackOff":           true,
+	"InvalidImageName":           true,
+	"CrashLoopBackOff":           true,
+	"CreateContainerConfigError": true,
+}
+
+type AgentStartupRecord struct {
+	AgentId   string
+	Pool      string
+	Pod       string
+	Namespace string
+	State     string
+	Reason    string `json:",omitempty"`
+	CreatedAt time.Time
+	UpdatedAt time.Time
+}
+
+func saveAgentStartup(record AgentStartupRecord) {
+	data, _ := json.Marshal(record)
+	if err := GetStorage().Set(startupKeyPrefix+record.AgentId, string(data)); err != nil {
+		log.Println("Failed to store the startup of agent "+record.AgentId, err)
+	}
+}
+
+func getAgentStartup(agentId string) (AgentStartupRecord, bool) {
+	var record AgentStartupRecord
+	value, err := GetStorage().Get(startupKeyPrefix + agentId)
+	if err != nil || json.Unmarshal([]byte(value), &record) != nil {
+		return record, false
+	}
+	return record, true
+}
+
+func forgetAgentStartup(agentId string) {
+	GetStorage().Delete(startupKeyPrefix + agentId)
+}
+
+// Starts following the agent pod until its agent is online.
+func watchAgentStartup(agentId string, pool string, pod string, namespace string) {
+	now := time.Now().UTC()
+	saveAgentStartup(AgentStartupRecord{AgentId: agentId, Pool: pool, Pod: pod, Namespace: namespace, State: StartupStatePending, CreatedAt: now, UpdatedAt: now})
+}
+
+// Returns the state the pod shows, with the reason when it failed.
+func podStartupState(pod *v1.Pod) (string, string) {
+	if pod.Status.Phase == v1.PodFailed || pod.Status.Phase == v1.PodSucceeded {
+		return StartupStateFailed, "The agent pod " + string(pod.Status.Phase) + " " + pod.Status.Reason
+	}
+	for _, status := range pod.Status.ContainerStatuses {
+		if waiting := status.State.Waiting; waiting != nil && startupFailureReasons[waiting.Reason] {
+			return StartupStateFailed, "Container " + status.Name + " is in " + waiting.Reason + ": " + waiting.Message
+		}
+	}
+	if isPodConditionTrue(pod, v1.PodReady) {
+		return StartupStateReady, ""
+	}
+	if pod.Status.Phase == v1.PodRunning {
+		return StartupStateRunning, ""
+	}
+	return StartupStatePending, ""
+}
+
+// Returns whether the state is the last one the agent gets to. Ready is, unless Azure DevOps can be
+// asked whether the agent is online.
+func isStartupFinished(state string, checksOnline bool) bool {
+	return state == StartupStateFailed || state == StartupStateOnline || (state == StartupStateReady && !checksOnline)
+}
+
+func RunAgentStartupWatch(namespace string) {
+	interval := time.Duration(getEnvInt("STARTUP_WATCH_INTERVAL_SECONDS", int(startupWatchInterval/time.Second))) * time.Second
+	for {
+		if IsLeader() {
+			var client *azuredevops.Client
+			if config := azuredevops.ConfigFromEnvironment(); config.IsConfigured() {
+				client = newAzureDevOpsClient(config)
+			}
+			if err := watchAgentStartups(client, namespace, time.Now().UTC()); err != nil {
+				log.Println("Watching the agent startups failed", err)
+			}
+		}
+		time.Sleep(interval)
+	}
+}
+
+func watchAgentStartups(client *azuredevops.Client, namespace string, now time.Time) error {
+	entries, err := GetStorage().List(startupKeyPrefix)
+	if err != nil {
+		return err
+	}
+
+	// The Azure DevOps pools the agents can be looked up in
+	poolIds := map[string]int32{}
+	if client != nil {
+		crdobject, _, err := fetchAzurePipelinesPool(namespace)
+		if err != nil {
+			return err
+		}
+		for _, pool := range crdobject.Spec.AgentPools {
+			poolIds[pool.PoolName] = pool.AzureDevOpsPoolId
+		}
+	}
+
+	timeout := time.Duration(getEnvInt("STARTUP_TIMEOUT_SECONDS", int(defaultStartupTimeout/time.Second))) * time.Second
+	for _, value := range entries {
+		var record AgentStartupRecord
+		if json.Unmarshal([]byte(value), &record) != nil || isStartupFinished(record.State, poolIds[record.Pool] != 0) {
+			continue
+		}
+		state, reason := observeAgentStartup(client, poolIds[record.Pool], &record)
+		if !isStartupFinished(state, poolIds[record.Pool] != 0) && now.Sub(record.CreatedAt) > timeout {
+			state, reason = StartupStateFailed, "The agent did not come online within "+strconv.Itoa(int(timeout/time.Second))+" seconds, it is "+state
+		}
+		if state == record.State {
+			continue
+		}
+
+		log.Println("Agent " + record.AgentId + " of pool " + record.Pool + " is " + state + " " + reason)
+		record.State, record.Reason, record.UpdatedAt = state, reason, now
+		saveAgentStartup(record)
+		if state == StartupStateFailed {
+			Notify(Notification{Event: "agent-startup-failed", Pool: record.Pool, Message: "Agent " + record.AgentId + " in pod " + record.Pod + " did not start: " + reason})
+		}
+	}
+	return nil
+}
+
+// Returns the state the agent of the record is in, asking Azure DevOps once its pod is ready.
+func observeAgentStartup(client *azuredevops.Client, poolId int32, record *AgentStartupRecord) (string, string) {
+	cs, _, err := agentClientSet(record.AgentId)
+	if err != nil {
+		return record.State, ""
+	}
+	pod, err := cs.clientset.CoreV1().Pods(record.Namespace).Get(record.Pod, metav1.GetOptions{})
+	if k8serrors.IsNotFound(err) {
+		return StartupStateFailed, "The agent pod is gone"
+	} else if err != nil {
+		log.Println("Failed to get the pod of agent "+record.AgentId, err)
+		return record.State, ""
+	}
+
+	state, reason := podStartupState(pod)
+	if state != StartupStateReady || client == nil || poolId == 0 {
+		return state, reason
+	}
+	var agent struct {
+		Status string `json:"status"`
+	}
+	if err := client.Get(azureDevOpsAgentsPath(poolId)+"/"+record.AgentId, &agent); err != nil {
+		log.Println("Failed to get the Azure DevOps status of agent "+record.AgentId, err)
+		return state, ""
+	}
+	if agent.Status == "online" {
+		return StartupStateOnline, ""
+	}
+	return state, ""
+}
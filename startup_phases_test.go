@@ -0,0 +1,66 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func startedPod(created time.Time) *v1.Pod {
+	pod := &v1.Pod{ObjectMeta: metav1.ObjectMeta{UID: "phases-1", CreationTimestamp: metav1.Time{Time: created}}}
+	pod.Status.Conditions = []v1.PodCondition{
+		{Type: v1.PodScheduled, Status: v1.ConditionTrue, LastTransitionTime: metav1.Time{Time: created.Add(5 * time.Second)}},
+		{Type: v1.PodReady, Status: v1.ConditionTrue, LastTransitionTime: metav1.Time{Time: created.Add(60 * time.Second)}},
+	}
+	pod.Status.ContainerStatuses = []v1.ContainerStatus{{
+		State: v1.ContainerState{Running: &v1.ContainerStateRunning{StartedAt: metav1.Time{Time: created.Add(40 * time.Second)}}},
+	}}
+	return pod
+}
+
+func TestPodStartupPhasesShouldSplitTheStartupLatency(t *testing.T) {
+	created := time.Date(2020, 3, 1, 10, 0, 0, 0, time.UTC)
+	events := []v1.Event{
+		{Reason: "Pulling", FirstTimestamp: metav1.Time{Time: created.Add(7 * time.Second)}, LastTimestamp: metav1.Time{Time: created.Add(7 * time.Second)}},
+		{Reason: "Pulled", FirstTimestamp: metav1.Time{Time: created.Add(37 * time.Second)}, LastTimestamp: metav1.Time{Time: created.Add(37 * time.Second)}},
+	}
+
+	phases := podStartupPhases(startedPod(created), events)
+
+	expected := []startupPhase{
+		{startupPhaseQueued, 5 * time.Second},
+		{startupPhaseScheduled, 2 * time.Second},
+		{startupPhaseImagePull, 30 * time.Second},
+		{startupPhaseStart, 3 * time.Second},
+		{startupPhaseRegistration, 20 * time.Second},
+	}
+	if len(phases) != len(expected) {
+		t.Fatalf("Expected %d phases. Got %v", len(expected), phases)
+	}
+	for i := range expected {
+		if phases[i] != expected[i] {
+			t.Errorf("Expected %v. Got %v", expected[i], phases[i])
+		}
+	}
+}
+
+func TestPodStartupPhasesShouldLeaveOutThePullWithoutEvents(t *testing.T) {
+	created := time.Date(2020, 3, 1, 10, 0, 0, 0, time.UTC)
+
+	phases := podStartupPhases(startedPod(created), nil)
+
+	if len(phases) != 3 || phases[1].Name != startupPhaseStart || phases[1].Duration != 35*time.Second {
+		t.Errorf("Expected the container start to begin at scheduling. Got %v", phases)
+	}
+}
+
+func TestPodStartupPhasesShouldSkipPodsNotRunning(t *testing.T) {
+	pod := startedPod(time.Now())
+	pod.Status.ContainerStatuses[0].State.Running = nil
+
+	if phases := podStartupPhases(pod, nil); phases != nil {
+		t.Errorf("Expected no phases. Got %v", phases)
+	}
+}
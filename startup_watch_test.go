@@ -0,0 +1,54 @@
+package main
+
+import (
+	"os"
+	"strings"
+	"testing"
+
+	v1 "k8s.io/api/core/v1"
+)
+
+func TestPodStartupStateShouldFollowThePod(t *testing.T) {
+	pod := &v1.Pod{Status: v1.PodStatus{Phase: v1.PodPending}}
+	if state, _ := podStartupState(pod); state != StartupStatePending {
+		t.Errorf("Expected a pending pod pending. Got %s", state)
+	}
+	pod.Status.Phase = v1.PodRunning
+	if state, _ := podStartupState(pod); state != StartupStateRunning {
+		t.Errorf("Expected a running pod running. Got %s", state)
+	}
+	pod.Status.Conditions = []v1.PodCondition{{Type: v1.PodReady, Status: v1.ConditionTrue}}
+	if state, _ := podStartupState(pod); state != StartupStateReady {
+		t.Errorf("Expected a ready pod ready. Got %s", state)
+	}
+
+	pulling := &v1.Pod{Status: v1.PodStatus{Phase: v1.PodPending, ContainerStatuses: []v1.ContainerStatus{
+		{Name: "vsts-agent", State: v1.ContainerState{Waiting: &v1.ContainerStateWaiting{Reason: "ImagePullBackOff", Message: "not found"}}},
+	}}}
+	if state, reason := podStartupState(pulling); state != StartupStateFailed || !strings.Contains(reason, "ImagePullBackOff") {
+		t.Errorf("Expected an image which cannot be pulled to fail the startup. Got %s %s", state, reason)
+	}
+}
+
+func TestStartupShouldOnlyFinishOnlineWhenAzureDevOpsIsAsked(t *testing.T) {
+	if isStartupFinished(StartupStateReady, true) {
+		t.Errorf("Expected a ready agent to be followed until it is online")
+	}
+	if !isStartupFinished(StartupStateReady, false) || !isStartupFinished(StartupStateOnline, true) || !isStartupFinished(StartupStateFailed, true) {
+		t.Errorf("Expected ready without Azure DevOps, online and failed to finish the startup")
+	}
+}
+
+func TestAgentStartupShouldBeForgottenOnRelease(t *testing.T) {
+	os.Setenv("STORAGE_BACKEND", "memory")
+	defer os.Unsetenv("STORAGE_BACKEND")
+
+	watchAgentStartup("startup-1", "linux", "agent-startup", "azuredevops")
+	if record, ok := getAgentStartup("startup-1"); !ok || record.State != StartupStatePending || record.Pod != "agent-startup" {
+		t.Errorf("Expected the startup followed from pending. Got %+v", record)
+	}
+	forgetAgentStartup("startup-1")
+	if _, ok := getAgentStartup("startup-1"); ok {
+		t.Errorf("Expected the startup forgotten")
+	}
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"net/http"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// Read-only endpoints used by internal tools through pkg/client. Like the build pod endpoint they
+// are signed with the shared secret over the empty request body.
+
+type AgentStatus struct {
+	AgentId   string
+	Found     bool
+	Namespace string `json:",omitempty"`
+	PodName   string `json:",omitempty"`
+	Phase     string `json:",omitempty"`
+	Ready     bool
+	// How far the agent got since its pod was created, until it is online in Azure DevOps
+	Startup *AgentStartupRecord `json:",omitempty"`
+}
+
+type ProviderStats struct {
+	CreationsWaiting         int
+	CreationConcurrencyLimit int
+	CreationLatencySeconds   int
+	IsLeader                 bool
+}
+
+// Returns the state of the agent pod of the agentId query parameter.
+func AgentStatusHandler(resp http.ResponseWriter, req *http.Request) {
+	if !isReadRequestValid(resp, req) {
+		return
+	}
+
+	agentId := req.URL.Query().Get("agentId")
+	if agentId == "" {
+		writeJsonResponse(resp, http.StatusBadRequest, GetError(NoAgentIdError))
+		return
+	}
+
+	status, err := getAgentStatus(CreateClientSet(), agentId, podnamespace)
+	if err != nil {
+		writeJsonResponse(resp, http.StatusInternalServerError, GetError(err.Error()))
+		return
+	}
+	writeJsonResponse(resp, http.StatusOK, status)
+}
+
+// Returns the current state of every pool, as published by the pool state exporter.
+func PoolsHandler(resp http.ResponseWriter, req *http.Request) {
+	if !isReadRequestValid(resp, req) {
+		return
+	}
+
+	crdobject, _, err := fetchAzurePipelinesPool(podnamespace)
+	if err != nil {
+		writeJsonResponse(resp, http.StatusInternalServerError, GetError(err.Error()))
+		return
+	}
+
+	// Only the pools of the requested page are looked up
+	start, end, next, err := requestedPage(req, len(crdobject.Spec.AgentPools))
+	if err != nil {
+		writeJsonResponse(resp, http.StatusBadRequest, GetError(err.Error()))
+		return
+	}
+	page := *crdobject
+	page.Spec.AgentPools = crdobject.Spec.AgentPools[start:end]
+
+	snapshot, err := collectPoolState(&page, podnamespace)
+	if err != nil {
+		writeJsonResponse(resp, http.StatusInternalServerError, GetError(err.Error()))
+		return
+	}
+	snapshot.Continue = next
+	writeJsonResponse(resp, http.StatusOK, snapshot)
+}
+
+// Returns the load of the pod creation queue of this replica.
+func StatsHandler(resp http.ResponseWriter, req *http.Request) {
+	if !isReadRequestValid(resp, req) {
+		return
+	}
+
+	waiting, limit := podCreationThrottle.QueueState()
+	writeJsonResponse(resp, http.StatusOK, ProviderStats{
+		CreationsWaiting:         waiting,
+		CreationConcurrencyLimit: limit,
+		CreationLatencySeconds:   toSeconds(creationLatency()),
+		IsLeader:                 IsLeader(),
+	})
+}
+
+func isReadRequestValid(resp http.ResponseWriter, req *http.Request) bool {
+	if req.Method != http.MethodGet {
+		writeJsonResponse(resp, http.StatusMethodNotAllowed, GetError(InvalidRequestError))
+		return false
+	}
+	if !isRequestHmacValid(req) {
+		writeJsonResponse(resp, http.StatusForbidden, GetError(NoValidSignatureError))
+		return false
+	}
+	return true
+}
+
+func getAgentStatus(cs *k8s, agentId string, namespace string) (AgentStatus, error) {
+	status := AgentStatus{AgentId: agentId}
+
+	namespaces := agentNamespaces(namespace)
+
+	for _, ns := range namespaces {
+		pods, err := cs.clientset.CoreV1().Pods(ns).List(metav1.ListOptions{LabelSelector: agentIdLabel + "=" + agentId})
+		if err != nil {
+			return status, err
+		}
+		if len(pods.Items) == 0 {
+			continue
+		}
+
+		pod := &pods.Items[0]
+		status.Found = true
+		status.Namespace = ns
+		status.PodName = pod.GetName()
+		status.Phase = string(pod.Status.Phase)
+		status.Ready = isPodConditionTrue(pod, v1.PodReady)
+		if startup, ok := getAgentStartup(agentId); ok {
+			status.Startup = &startup
+		}
+		return status, nil
+	}
+	return status, nil
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestStatsHandlerShouldReportCreationQueue(t *testing.T) {
+	os.Setenv("VSTS_SECRET", "sharedsecret1234")
+	req := httptest.NewRequest("GET", "/stats", nil)
+	req.Header.Add("X-Azure-Signature", ComputeHash(""))
+
+	resp := httptest.NewRecorder()
+	StatsHandler(resp, req)
+
+	var stats ProviderStats
+	json.Unmarshal(resp.Body.Bytes(), &stats)
+	if resp.Code != http.StatusOK || stats.CreationConcurrencyLimit == 0 {
+		t.Errorf("Expected the creation queue stats. Got %d %s", resp.Code, resp.Body.String())
+	}
+}
+
+func TestStatusHandlerShouldRequireAgentId(t *testing.T) {
+	os.Setenv("VSTS_SECRET", "sharedsecret1234")
+	req := httptest.NewRequest("GET", "/status", nil)
+	req.Header.Add("X-Azure-Signature", ComputeHash(""))
+
+	resp := httptest.NewRecorder()
+	AgentStatusHandler(resp, req)
+
+	if resp.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400. Got %d", resp.Code)
+	}
+}
+
+func TestAgentStatusShouldReportPodPhase(t *testing.T) {
+	SetupCustomResource()
+	cs := CreateClientSet()
+	cs.clientset.CoreV1().Pods(testnamespace).Create(&v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "agent-7", Labels: map[string]string{agentIdLabel: "7"}},
+		Status:     v1.PodStatus{Phase: v1.PodRunning},
+	})
+
+	status, err := getAgentStatus(cs, "7", testnamespace)
+	if err != nil || !status.Found || status.PodName != "agent-7" || status.Phase != "Running" {
+		t.Errorf("Unexpected status %v, %v", status, err)
+	}
+
+	status, _ = getAgentStatus(cs, "8", testnamespace)
+	if status.Found {
+		t.Errorf("Expected agent 8 not to be found")
+	}
+}
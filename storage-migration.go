@@ -0,0 +1,268 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+
+	"github.com/microsoft/poolprovider-for-k8s/pkg/storage"
+)
+
+// STORAGE_MIGRATION_TARGET moves the state to another backend without draining the pools. While it
+// names a backend other than STORAGE_BACKEND every write goes to both, and reads and claims are
+// served by the source. GET /admin/storage/migration compares the two backends, POST with
+// action=backfill copies the entries written before the migration started, action=cutover serves
+// reads and claims from the target once both hold the same entries and action=rollback goes back
+// to the source. Writes keep going to both backends after the cutover, until STORAGE_BACKEND is
+// set to the target and STORAGE_MIGRATION_TARGET is removed. The cutover is kept in the memory of
+// the replica, a migration involving the memory backend runs on a single replica anyway.
+const (
+	storageMigrationBackfill = "backfill"
+	storageMigrationCutover  = "cutover"
+	storageMigrationRollback = "rollback"
+)
+
+type StorageMigrationReport struct {
+	Source     string
+	Target     string
+	CutOver    bool
+	Consistent bool
+	Entries    int
+	// Missing are the keys of the source the target does not have, Different the keys with another
+	// value and Extra the keys only the target has.
+	Missing   []string
+	Different []string
+	Extra     []string
+	Copied    int `json:",omitempty"`
+}
+
+var storageMigration = struct {
+	sync.Mutex
+	cutOver bool
+}{}
+
+// Returns the backend the state is migrated to, or an empty string when there is no migration.
+func storageMigrationTarget() string {
+	target := os.Getenv("STORAGE_MIGRATION_TARGET")
+	if target == "" || storageBackendName(target) == storageBackendName(os.Getenv("STORAGE_BACKEND")) {
+		return ""
+	}
+	return storageBackendName(target)
+}
+
+func isStorageCutOver() bool {
+	storageMigration.Lock()
+	defer storageMigration.Unlock()
+	return storageMigration.cutOver
+}
+
+func setStorageCutOver(cutOver bool) {
+	storageMigration.Lock()
+	defer storageMigration.Unlock()
+	storageMigration.cutOver = cutOver
+}
+
+// migratingStorage writes to the source and the target. The primary backend, the source until the
+// cutover, answers reads and claims, writes to the other one are best effort and only logged.
+type migratingStorage struct {
+	source  storage.Storage
+	target  storage.Storage
+	cutOver bool
+}
+
+func (s *migratingStorage) backends() (storage.Storage, storage.Storage) {
+	if s.cutOver {
+		return s.target, s.source
+	}
+	return s.source, s.target
+}
+
+func (s *migratingStorage) Get(key string) (string, error) {
+	primary, _ := s.backends()
+	return primary.Get(key)
+}
+
+func (s *migratingStorage) Set(key string, value string) error {
+	primary, secondary := s.backends()
+	if err := primary.Set(key, value); err != nil {
+		return err
+	}
+	mirrorStorageWrite("set", key, secondary.Set(key, value))
+	return nil
+}
+
+func (s *migratingStorage) SetIfAbsent(key string, value string) (bool, error) {
+	primary, secondary := s.backends()
+	set, err := primary.SetIfAbsent(key, value)
+	if set && err == nil {
+		mirrorStorageWrite("setifabsent", key, secondary.Set(key, value))
+	}
+	return set, err
+}
+
+func (s *migratingStorage) CompareAndSwap(key string, old string, new string) (bool, error) {
+	primary, secondary := s.backends()
+	swapped, err := primary.CompareAndSwap(key, old, new)
+	if swapped && err == nil {
+		mirrorStorageWrite("compareandswap", key, secondary.Set(key, new))
+	}
+	return swapped, err
+}
+
+func (s *migratingStorage) Delete(key string) error {
+	primary, secondary := s.backends()
+	if err := primary.Delete(key); err != nil {
+		return err
+	}
+	mirrorStorageWrite("delete", key, secondary.Delete(key))
+	return nil
+}
+
+func (s *migratingStorage) List(prefix string) (map[string]string, error) {
+	primary, _ := s.backends()
+	return primary.List(prefix)
+}
+
+func mirrorStorageWrite(operation string, key string, err error) {
+	if err != nil {
+		log.Println("Failed to mirror the "+operation+" of storage entry "+key+" to the other backend", err)
+		storageMigrationErrors.WithLabelValues(operation).Inc()
+	}
+}
+
+// Compares the entries of the primary backend with the other one.
+func compareStorageEntries(primary map[string]string, secondary map[string]string) StorageMigrationReport {
+	report := StorageMigrationReport{Entries: len(primary), Missing: []string{}, Different: []string{}, Extra: []string{}}
+	for key, value := range primary {
+		if other, ok := secondary[key]; !ok {
+			report.Missing = append(report.Missing, key)
+		} else if other != value {
+			report.Different = append(report.Different, key)
+		}
+	}
+	for key := range secondary {
+		if _, ok := primary[key]; !ok {
+			report.Extra = append(report.Extra, key)
+		}
+	}
+	sort.Strings(report.Missing)
+	sort.Strings(report.Different)
+	sort.Strings(report.Extra)
+	report.Consistent = len(report.Missing)+len(report.Different)+len(report.Extra) == 0
+	return report
+}
+
+func checkStorageMigration(s *migratingStorage) (StorageMigrationReport, error) {
+	primary, secondary := s.backends()
+	primaryEntries, err := primary.List("")
+	if err != nil {
+		return StorageMigrationReport{}, err
+	}
+	secondaryEntries, err := secondary.List("")
+	if err != nil {
+		return StorageMigrationReport{}, err
+	}
+	report := compareStorageEntries(primaryEntries, secondaryEntries)
+	report.CutOver = s.cutOver
+	return report, nil
+}
+
+// Makes the other backend hold the entries of the primary one and returns the report from before.
+func backfillStorageMigration(s *migratingStorage) (StorageMigrationReport, error) {
+	report, err := checkStorageMigration(s)
+	if err != nil {
+		return report, err
+	}
+	primary, secondary := s.backends()
+	for _, key := range append(append([]string{}, report.Missing...), report.Different...) {
+		value, err := primary.Get(key)
+		if err != nil {
+			// Deleted since the comparison
+			continue
+		}
+		if err := secondary.Set(key, value); err != nil {
+			return report, err
+		}
+		report.Copied++
+	}
+	for _, key := range report.Extra {
+		if err := secondary.Delete(key); err != nil {
+			return report, err
+		}
+		report.Copied++
+	}
+	return report, nil
+}
+
+func StorageMigrationHandler(resp http.ResponseWriter, req *http.Request) {
+	targetName := storageMigrationTarget()
+	if targetName == "" {
+		writeJsonResponse(resp, http.StatusNotFound, GetError(NoStorageMigrationError))
+		return
+	}
+	sourceName := storageBackendName(os.Getenv("STORAGE_BACKEND"))
+	migration := &migratingStorage{source: storageBackend(sourceName), target: storageBackend(targetName), cutOver: isStorageCutOver()}
+
+	if req.Method == http.MethodGet {
+		if !isReadRequestValid(resp, req) {
+			return
+		}
+		report, err := checkStorageMigration(migration)
+		if err != nil {
+			writeJsonResponse(resp, http.StatusInternalServerError, GetError(err.Error()))
+			return
+		}
+		report.Source, report.Target = sourceName, targetName
+		writeJsonResponse(resp, http.StatusOK, report)
+		return
+	}
+
+	if req.Method != http.MethodPost {
+		writeJsonResponse(resp, http.StatusMethodNotAllowed, GetError(InvalidRequestError))
+		return
+	}
+	if !isRequestHmacValid(req) {
+		writeJsonResponse(resp, http.StatusForbidden, GetError(NoValidSignatureError))
+		return
+	}
+
+	var report StorageMigrationReport
+	var err error
+	action := req.URL.Query().Get("action")
+	switch action {
+	case storageMigrationBackfill:
+		report, err = backfillStorageMigration(migration)
+	case storageMigrationCutover:
+		if report, err = checkStorageMigration(migration); err == nil && !report.Consistent {
+			writeJsonResponse(resp, http.StatusConflict, GetError(StorageMigrationError))
+			return
+		}
+		if err == nil {
+			setStorageCutOver(true)
+			report.CutOver = true
+		}
+	case storageMigrationRollback:
+		setStorageCutOver(false)
+		migration.cutOver = false
+		report, err = checkStorageMigration(migration)
+	default:
+		writeJsonResponse(resp, http.StatusBadRequest, GetError(InvalidRequestError))
+		return
+	}
+	if err != nil {
+		writeJsonResponse(resp, http.StatusInternalServerError, GetError(err.Error()))
+		return
+	}
+
+	log.Println("Storage migration from " + sourceName + " to " + targetName + ": " + action)
+	RecordAuditEntry(AuditEntry{
+		Category:  AuditCategoryConfig,
+		Principal: adminPrincipal(req),
+		Action:    "storage-migration-" + action,
+		Target:    "storage/" + sourceName + "/" + targetName,
+	})
+	report.Source, report.Target = sourceName, targetName
+	writeJsonResponse(resp, http.StatusOK, report)
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/microsoft/poolprovider-for-k8s/pkg/storage"
+)
+
+// STORAGE_BACKEND "memory" keeps the state in the memory of the webserver instead of ConfigMaps,
+// for a single replica which can lose its state on restart, e.g. in small clusters or tests. With
+// STORAGE_TTL_SECONDS its entries expire that long after they were last written, on top of the
+// retention of the storage compaction.
+const (
+	storageBackendMemory    = "memory"
+	storageBackendConfigMap = "configmap"
+)
+
+var memoryStorage = struct {
+	sync.Once
+	storage *storage.MemoryStorage
+}{}
+
+// Returns the storage used to persist the provider state. State is kept in ConfigMaps in the
+// namespace of the webserver so it outlives the process.
+func GetStorage() storage.Storage {
+	source := storageBackend(storageBackendName(os.Getenv("STORAGE_BACKEND")))
+	if target := storageMigrationTarget(); target != "" {
+		return &instrumentedStorage{next: &migratingStorage{source: source, target: storageBackend(target), cutOver: isStorageCutOver()}}
+	}
+	return &instrumentedStorage{next: source}
+}
+
+// Returns the name of the backend, ConfigMaps unless memory is asked for.
+func storageBackendName(name string) string {
+	if strings.EqualFold(name, storageBackendMemory) {
+		return storageBackendMemory
+	}
+	return storageBackendConfigMap
+}
+
+func storageBackend(name string) storage.Storage {
+	if name == storageBackendMemory {
+		memoryStorage.Do(func() {
+			memoryStorage.storage = storage.NewMemoryStorage(time.Duration(getEnvInt("STORAGE_TTL_SECONDS", 0)) * time.Second)
+		})
+		return memoryStorage.storage
+	}
+
+	cs := CreateClientSet()
+	return storage.NewConfigMapStorage(cs.clientset, podnamespace)
+}
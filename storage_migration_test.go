@@ -0,0 +1,61 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/microsoft/poolprovider-for-k8s/pkg/storage"
+)
+
+func TestMigratingStorageShouldWriteToBothBackends(t *testing.T) {
+	source, target := storage.NewMemoryStorage(0), storage.NewMemoryStorage(0)
+	source.Set("journal:1", "old")
+	migration := &migratingStorage{source: source, target: target}
+
+	migration.Set("journal:2", "new")
+	if set, _ := migration.SetIfAbsent("dedupe:3", "claimed"); !set {
+		t.Errorf("Expected the claim to be taken")
+	}
+	if value, _ := target.Get("journal:2"); value != "new" {
+		t.Errorf("Expected the write mirrored to the target. Got %s", value)
+	}
+	if value, _ := target.Get("dedupe:3"); value != "claimed" {
+		t.Errorf("Expected the claim mirrored to the target. Got %s", value)
+	}
+	if value, err := migration.Get("journal:1"); err != nil || value != "old" {
+		t.Errorf("Expected reads served by the source. Got %s (%v)", value, err)
+	}
+
+	migration.Delete("journal:2")
+	if _, err := target.Get("journal:2"); err == nil {
+		t.Errorf("Expected the delete mirrored to the target")
+	}
+}
+
+func TestStorageMigrationShouldBackfillBeforeCutover(t *testing.T) {
+	source, target := storage.NewMemoryStorage(0), storage.NewMemoryStorage(0)
+	source.Set("journal:1", "a")
+	source.Set("journal:2", "b")
+	target.Set("journal:2", "stale")
+	target.Set("journal:3", "gone")
+	migration := &migratingStorage{source: source, target: target}
+
+	report, _ := checkStorageMigration(migration)
+	if report.Consistent || !reflect.DeepEqual(report.Missing, []string{"journal:1"}) ||
+		!reflect.DeepEqual(report.Different, []string{"journal:2"}) || !reflect.DeepEqual(report.Extra, []string{"journal:3"}) {
+		t.Errorf("Unexpected report %v", report)
+	}
+
+	if report, err := backfillStorageMigration(migration); err != nil || report.Copied != 3 {
+		t.Errorf("Expected three entries fixed. Got %v (%v)", report, err)
+	}
+	if report, _ := checkStorageMigration(migration); !report.Consistent || report.Entries != 2 {
+		t.Errorf("Expected consistent backends after the backfill. Got %v", report)
+	}
+
+	migration.cutOver = true
+	target.Set("journal:4", "only in target")
+	if value, err := migration.Get("journal:4"); err != nil || value != "only in target" {
+		t.Errorf("Expected reads served by the target after the cutover. Got %s (%v)", value, err)
+	}
+}
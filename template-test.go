@@ -0,0 +1,72 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+
+	v1alpha1 "github.com/microsoft/poolprovider-for-k8s/pkg/apis/dev/v1alpha1"
+	v1 "k8s.io/api/core/v1"
+)
+
+type TemplateTestRequest struct {
+	Template v1alpha1.AgentPoolSpec
+	Demands  []string
+	// LintRules default to the lint rules of the custom resource
+	LintRules []v1alpha1.PodLintRule
+}
+
+type TemplateTestResponse struct {
+	Manifest   *v1.Pod
+	Violations []LintViolation `json:",omitempty"`
+	Errors     []string        `json:",omitempty"`
+	Valid      bool
+}
+
+// Renders the agent pod a job with the given demands would get from the template and validates it,
+// without creating anything.
+func TemplateTestHandler(resp http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		writeJsonResponse(resp, http.StatusMethodNotAllowed, GetError(InvalidRequestError))
+		return
+	}
+	if !isRequestHmacValid(req) {
+		writeJsonResponse(resp, http.StatusForbidden, GetError(NoValidSignatureError))
+		return
+	}
+
+	var testRequest TemplateTestRequest
+	requestBody, _ := ioutil.ReadAll(req.Body)
+	if err := json.Unmarshal(requestBody, &testRequest); err != nil {
+		writeJsonResponse(resp, http.StatusBadRequest, GetError(err.Error()))
+		return
+	}
+
+	if testRequest.LintRules == nil {
+		if crdobject, _, err := fetchAzurePipelinesPool(podnamespace); err == nil {
+			testRequest.LintRules = crdobject.Spec.PodLintRules
+		}
+	}
+
+	writeJsonResponse(resp, http.StatusOK, testTemplate(testRequest))
+}
+
+func testTemplate(testRequest TemplateTestRequest) TemplateTestResponse {
+	var response TemplateTestResponse
+
+	if testRequest.Template.PoolSpec == nil || len(testRequest.Template.PoolSpec.Containers) == 0 {
+		response.Errors = append(response.Errors, "The template has no pod spec with an agent container")
+		return response
+	}
+
+	response.Manifest = v1alpha1.RenderAgentPod(&testRequest.Template, testRequest.Demands)
+	for _, container := range response.Manifest.Spec.Containers {
+		if container.Image == "" {
+			response.Errors = append(response.Errors, "Container "+container.Name+" has no image")
+		}
+	}
+
+	response.Violations = checkPodLintRules(response.Manifest, testRequest.LintRules)
+	response.Valid = len(response.Errors) == 0 && !IsBlockingViolation(response.Violations)
+	return response
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"testing"
+
+	v1alpha1 "github.com/microsoft/poolprovider-for-k8s/pkg/apis/dev/v1alpha1"
+	corev1 "k8s.io/api/core/v1"
+)
+
+func TestTestTemplateShouldRenderAndValidate(t *testing.T) {
+	testRequest := TemplateTestRequest{
+		Template: v1alpha1.AgentPoolSpec{
+			PoolName:   "linux",
+			PoolSpec:   &corev1.PodSpec{Containers: []corev1.Container{{Name: "vsts-agent", Image: "prebansa/myagent:latest"}}},
+			ImageRules: []v1alpha1.ImageRule{{Demands: []string{"jdk=17"}, Image: "prebansa/myagent-jdk17:v1"}},
+		},
+		Demands:   []string{"jdk=17"},
+		LintRules: []v1alpha1.PodLintRule{{Rule: LintRuleNoLatestTag, Action: LintActionBlock}},
+	}
+
+	response := testTemplate(testRequest)
+	if !response.Valid || response.Manifest.Spec.Containers[0].Image != "prebansa/myagent-jdk17:v1" {
+		t.Errorf("Expected a valid manifest with the jdk image. Got %v", response)
+	}
+
+	testRequest.Demands = nil
+	if response := testTemplate(testRequest); response.Valid || len(response.Violations) != 1 {
+		t.Errorf("Expected the latest tag to be rejected. Got %v", response)
+	}
+
+	if response := testTemplate(TemplateTestRequest{}); response.Valid || len(response.Errors) == 0 {
+		t.Errorf("Expected an empty template to be invalid")
+	}
+}
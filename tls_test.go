@@ -0,0 +1,73 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestServerTLSConfigShouldServePlainHttpWithoutCertificate(t *testing.T) {
+	config, err := serverTLSConfig("", "", "")
+	if config != nil || err != nil {
+		t.Errorf("Expected plain HTTP without a certificate. Got %v (%v)", config, err)
+	}
+}
+
+func TestServerTLSConfigShouldRejectPartialConfiguration(t *testing.T) {
+	if _, err := serverTLSConfig("server.crt", "", ""); err == nil {
+		t.Errorf("Expected a certificate without key to be rejected")
+	}
+	if _, err := serverTLSConfig("", "", "ca.crt"); err == nil {
+		t.Errorf("Expected a client CA without certificate to be rejected")
+	}
+}
+
+func TestServerTLSConfigShouldRequireClientCertificates(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "tls")
+	defer os.RemoveAll(dir)
+	certFile, keyFile := writeTestCertificate(t, dir)
+
+	config, err := serverTLSConfig(certFile, keyFile, "")
+	if err != nil || len(config.Certificates) != 1 || config.ClientAuth != tls.NoClientCert {
+		t.Fatalf("Expected HTTPS without client certificates. Got %v (%v)", config, err)
+	}
+
+	config, err = serverTLSConfig(certFile, keyFile, certFile)
+	if err != nil || config.ClientAuth != tls.RequireAndVerifyClientCert || config.ClientCAs == nil {
+		t.Errorf("Expected client certificates to be required. Got %v (%v)", config, err)
+	}
+
+	if _, err := serverTLSConfig(certFile, keyFile, keyFile); err == nil {
+		t.Errorf("Expected a client CA file without certificates to be rejected")
+	}
+}
+
+func writeTestCertificate(t *testing.T, dir string) (string, string) {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		NotBefore:             time.Now(),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("Failed to create the test certificate: %v", err)
+	}
+	keyDer, _ := x509.MarshalECPrivateKey(key)
+
+	certFile, keyFile := filepath.Join(dir, "server.crt"), filepath.Join(dir, "server.key")
+	ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600)
+	return certFile, keyFile
+}
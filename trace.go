@@ -0,0 +1,65 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"regexp"
+	"strings"
+
+	v1 "k8s.io/api/core/v1"
+)
+
+// The W3C trace context of the acquire request is handed to the agent pod, so telemetry of the
+// pipeline tasks can be joined to the provisioning trace. The pod gets a traceparent whose parent
+// is the provisioning span, in the TRACEPARENT and TRACESTATE variables used by OpenTelemetry.
+// Standby pods are already running when they are claimed, they find it in the job context.
+const (
+	traceParentHeader      = "traceparent"
+	traceStateHeader       = "tracestate"
+	traceParentEnvVariable = "TRACEPARENT"
+	traceStateEnvVariable  = "TRACESTATE"
+)
+
+var traceParentFormat = regexp.MustCompile("^([0-9a-f]{2})-([0-9a-f]{32})-([0-9a-f]{16})-([0-9a-f]{2})$")
+
+// Returns the trace context of the provisioning span. It continues the trace of the request when
+// it carries a valid traceparent, and starts a new sampled trace otherwise.
+func traceContextFromRequest(req *http.Request) (string, string) {
+	traceId, flags, ok := parseTraceParent(req.Header.Get(traceParentHeader))
+	if !ok {
+		return "00-" + randomHex(16) + "-" + randomHex(8) + "-01", ""
+	}
+	return "00-" + traceId + "-" + randomHex(8) + "-" + flags, req.Header.Get(traceStateHeader)
+}
+
+// Returns the trace id and flags of a version 00 traceparent.
+func parseTraceParent(value string) (string, string, bool) {
+	match := traceParentFormat.FindStringSubmatch(strings.TrimSpace(value))
+	if match == nil || match[1] == "ff" {
+		return "", "", false
+	}
+	if match[2] == strings.Repeat("0", 32) || match[3] == strings.Repeat("0", 16) {
+		return "", "", false
+	}
+	return match[2], match[4], true
+}
+
+func randomHex(bytes int) string {
+	data := make([]byte, bytes)
+	rand.Read(data)
+	return hex.EncodeToString(data)
+}
+
+func addTraceContextEnvironmentVariables(pod *v1.Pod, traceParent string, traceState string) {
+	if traceParent == "" {
+		return
+	}
+	for i := range pod.Spec.Containers {
+		container := &pod.Spec.Containers[i]
+		container.Env = append(container.Env, v1.EnvVar{Name: traceParentEnvVariable, Value: traceParent})
+		if traceState != "" {
+			container.Env = append(container.Env, v1.EnvVar{Name: traceStateEnvVariable, Value: traceState})
+		}
+	}
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	v1 "k8s.io/api/core/v1"
+)
+
+func TestTraceContextShouldContinueIncomingTrace(t *testing.T) {
+	req := httptest.NewRequest("POST", "/acquire", nil)
+	req.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	req.Header.Set("tracestate", "congo=t61rcWkgMzE")
+
+	traceParent, traceState := traceContextFromRequest(req)
+	if !strings.HasPrefix(traceParent, "00-4bf92f3577b34da6a3ce929d0e0e4736-") || !strings.HasSuffix(traceParent, "-01") {
+		t.Errorf("Expected the trace to be continued. Got %s", traceParent)
+	}
+	if strings.Contains(traceParent, "00f067aa0ba902b7") {
+		t.Errorf("Expected a new span id. Got %s", traceParent)
+	}
+	if traceState != "congo=t61rcWkgMzE" {
+		t.Errorf("Expected the trace state to be kept. Got %s", traceState)
+	}
+}
+
+func TestTraceContextShouldStartTraceForInvalidHeaders(t *testing.T) {
+	for _, header := range []string{"", "00-00000000000000000000000000000000-00f067aa0ba902b7-01", "ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", "garbage"} {
+		req := httptest.NewRequest("POST", "/acquire", nil)
+		req.Header.Set("traceparent", header)
+
+		traceParent, _ := traceContextFromRequest(req)
+		if _, _, ok := parseTraceParent(traceParent); !ok || strings.Contains(traceParent, "00f067aa0ba902b7") {
+			t.Errorf("Expected a new trace for %q. Got %s", header, traceParent)
+		}
+	}
+}
+
+func TestTraceContextShouldBeAddedToAgentContainers(t *testing.T) {
+	pod := &v1.Pod{Spec: v1.PodSpec{Containers: []v1.Container{{Name: "agent"}}}}
+	addTraceContextEnvironmentVariables(pod, "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", "")
+
+	env := pod.Spec.Containers[0].Env
+	if len(env) != 1 || env[0].Name != traceParentEnvVariable {
+		t.Errorf("Unexpected environment %v", env)
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"log"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// When standby pods of a pool cannot be created or fail to start, e.g. under node pressure or
+// during a registry outage, the warm pool controller stops replenishing the pool for a while,
+// doubling the pause with every failed round up to WARM_POOL_BACKOFF_MAX_SECONDS, 15 minutes by
+// default. Surplus and finished standby pods are still removed meanwhile. A single notification
+// is sent once a pool failed warmPoolAlertThreshold rounds in a row, and another one when a
+// standby pod of the pool runs again.
+const (
+	defaultWarmPoolBackoffMax = 15 * time.Minute
+	warmPoolAlertThreshold    = 3
+)
+
+type replenishBackoff struct {
+	failures int
+	retryAt  time.Time
+	alerted  bool
+}
+
+var warmPoolBackoff = struct {
+	sync.Mutex
+	pools map[string]*replenishBackoff
+}{pools: map[string]*replenishBackoff{}}
+
+// Returns whether standby pods of the pool must not be created yet.
+func isReplenishmentPaused(poolName string, now time.Time) bool {
+	warmPoolBackoff.Lock()
+	defer warmPoolBackoff.Unlock()
+	backoff, ok := warmPoolBackoff.pools[poolName]
+	return ok && now.Before(backoff.retryAt)
+}
+
+// Records a failed replenishment round of the pool and pauses the replenishment.
+func recordReplenishFailure(poolName string, reason string, now time.Time) {
+	warmPoolBackoff.Lock()
+	backoff, ok := warmPoolBackoff.pools[poolName]
+	if !ok {
+		backoff = &replenishBackoff{}
+		warmPoolBackoff.pools[poolName] = backoff
+	}
+	backoff.failures++
+	delay := replenishBackoffDelay(backoff.failures, time.Duration(getEnvInt("WARM_POOL_BACKOFF_MAX_SECONDS", int(defaultWarmPoolBackoffMax/time.Second)))*time.Second)
+	backoff.retryAt = now.Add(delay)
+	alert := backoff.failures >= warmPoolAlertThreshold && !backoff.alerted
+	backoff.alerted = backoff.alerted || alert
+	failures := backoff.failures
+	warmPoolBackoff.Unlock()
+
+	warmPoolBackoffSeconds.WithLabelValues(poolName).Set(delay.Seconds())
+	log.Println("Pausing the warm pool of pool " + poolName + " for " + delay.String() + " after " + strconv.Itoa(failures) + " failed rounds")
+	if alert {
+		Notify(Notification{Event: "WarmPoolBackoff", Pool: poolName, Message: "Standby pods of agent pool " + poolName +
+			" failed " + strconv.Itoa(failures) + " times in a row, replenishment is backing off. Last error: " + reason})
+	}
+}
+
+// Ends the backoff of the pool once its standby pods run again.
+func recordReplenishSuccess(poolName string) {
+	warmPoolBackoff.Lock()
+	backoff, ok := warmPoolBackoff.pools[poolName]
+	delete(warmPoolBackoff.pools, poolName)
+	warmPoolBackoff.Unlock()
+	if !ok {
+		return
+	}
+
+	warmPoolBackoffSeconds.WithLabelValues(poolName).Set(0)
+	log.Println("Warm pool of pool " + poolName + " recovered after " + strconv.Itoa(backoff.failures) + " failed rounds")
+	if backoff.alerted {
+		Notify(Notification{Event: "WarmPoolRecovered", Pool: poolName, Message: "Standby pods of agent pool " + poolName + " are running again"})
+	}
+}
+
+// The pause after the given number of failed rounds, starting at the controller interval.
+func replenishBackoffDelay(failures int, max time.Duration) time.Duration {
+	delay := warmPoolInterval
+	for i := 1; i < failures && delay < max; i++ {
+		delay *= 2
+	}
+	if delay > max {
+		delay = max
+	}
+	return delay
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"log"
+	"strconv"
+	"sync"
+	"time"
+
+	v1alpha1 "github.com/microsoft/poolprovider-for-k8s/pkg/apis/dev/v1alpha1"
+	v1 "k8s.io/api/core/v1"
+)
+
+// The queue poller and the warm pool controller scale the standby pods of a pool with the jobs
+// waiting in its Azure DevOps queue, between WarmPoolSize and MaxWarmPoolSize. Scaling up is
+// immediate. Scaling down waits until the target has stayed lower for ScaleDownCooldownSeconds of
+// the pool, so a lull between the stages of a run does not remove the pods the next stage needs.
+// Standby pods never take a pool with MaxAgents beyond it, they only fill the remaining capacity.
+type warmPoolScale struct {
+	target   int
+	raisedAt time.Time
+}
+
+var warmPoolScales = struct {
+	sync.Mutex
+	pools map[string]*warmPoolScale
+}{pools: map[string]*warmPoolScale{}}
+
+// Returns the target after the cooldown: a higher desired target applies at once, a lower one once
+// the last raise is older than the cooldown.
+func cooledWarmPoolTarget(poolName string, desired int, cooldown time.Duration, now time.Time) int {
+	warmPoolScales.Lock()
+	defer warmPoolScales.Unlock()
+
+	scale, ok := warmPoolScales.pools[poolName]
+	if !ok {
+		warmPoolScales.pools[poolName] = &warmPoolScale{target: desired, raisedAt: now}
+		return desired
+	}
+	if desired > scale.target {
+		log.Println("Scaling the warm pool of pool " + poolName + " up to " + strconv.Itoa(desired) + " standby pods")
+		scale.target, scale.raisedAt = desired, now
+	} else if desired < scale.target && now.Sub(scale.raisedAt) >= cooldown {
+		log.Println("Scaling the warm pool of pool " + poolName + " down to " + strconv.Itoa(desired) + " standby pods")
+		scale.target = desired
+	} else if desired == scale.target {
+		// The pods are still needed, the cooldown starts over once the demand drops
+		scale.raisedAt = now
+	}
+	return scale.target
+}
+
+// Caps the target at the capacity MaxAgents leaves next to the active agent pods of the pool.
+func capWarmPoolTarget(pool *v1alpha1.AgentPoolSpec, target int, activeAgents int) int {
+	if pool.MaxAgents <= 0 {
+		return target
+	}
+	if free := int(pool.MaxAgents) - activeAgents; target > free {
+		if free < 0 {
+			return 0
+		}
+		return free
+	}
+	return target
+}
+
+// Returns the standby pods the pool should have now.
+// The agent pods are counted in the namespace and the cluster of the pool.
+func scaledWarmPoolTarget(pool *v1alpha1.AgentPoolSpec, namespace string, now time.Time) int {
+	cooldown := time.Duration(pool.ScaleDownCooldownSeconds) * time.Second
+	target := cooledWarmPoolTarget(pool.PoolName, warmPoolTarget(pool, getWarmPoolScaleHint(pool.PoolName)), cooldown, now)
+	if pool.MaxAgents > 0 {
+		target = capWarmPoolTarget(pool, target, countActiveAgents(listPoolPods(pool, namespace)))
+	}
+	warmPoolTargetPods.WithLabelValues(pool.PoolName).Set(float64(target))
+	return target
+}
+
+func countActiveAgents(pods []v1.Pod) int {
+	active := 0
+	for i := range pods {
+		if pods[i].Status.Phase != v1.PodSucceeded && pods[i].Status.Phase != v1.PodFailed && pods[i].GetDeletionTimestamp() == nil {
+			active++
+		}
+	}
+	return active
+}
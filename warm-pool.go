@@ -0,0 +1,295 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	v1alpha1 "github.com/microsoft/poolprovider-for-k8s/pkg/apis/dev/v1alpha1"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/rest"
+)
+
+// Standby pods are started from the pool spec before any acquire request arrives. They mount the
+// agent secret as an optional volume, so the agent waits until the secret is created when a request
+// claims the pod. The standby label holds the pool name and is swapped for the AgentId label on claim.
+const (
+	standbyLabel      = "StandbyPool"
+	standbyPodPrefix  = "azure-pipelines-standby-"
+	standbySecretTail = "-creds"
+)
+
+var warmPoolInterval = 30 * time.Second
+
+// Pending jobs per pool as last reported by the Azure DevOps queue poller
+var warmPoolHints = struct {
+	sync.Mutex
+	pending map[string]int
+}{pending: map[string]int{}}
+
+// Records the number of jobs waiting for an agent of the given pool, so the warm pool can grow
+// ahead of the acquire requests.
+func SetWarmPoolScaleHint(poolName string, pendingJobs int) {
+	warmPoolHints.Lock()
+	defer warmPoolHints.Unlock()
+	warmPoolHints.pending[poolName] = pendingJobs
+}
+
+func getWarmPoolScaleHint(poolName string) int {
+	warmPoolHints.Lock()
+	defer warmPoolHints.Unlock()
+	return warmPoolHints.pending[poolName]
+}
+
+func isWarmPoolEnabled(pool *v1alpha1.AgentPoolSpec) bool {
+	return pool.WarmPoolSize > 0 || pool.MaxWarmPoolSize > 0
+}
+
+// Returns the number of standby pods the pool should have. Scale hints only apply when the pool
+// allows growing beyond its warm pool size.
+func warmPoolTarget(pool *v1alpha1.AgentPoolSpec, hint int) int {
+	target := int(pool.WarmPoolSize) + hint
+	limit := int(pool.WarmPoolSize)
+	if int(pool.MaxWarmPoolSize) > limit {
+		limit = int(pool.MaxWarmPoolSize)
+	}
+	if target > limit {
+		target = limit
+	}
+	return target
+}
+
+// Keeps the warm pools at their target size until the process exits.
+func RunWarmPoolController(namespace string) {
+	for {
+		if err := ReconcileWarmPools(namespace); err != nil {
+			log.Println("Warm pool reconcile failed", err)
+		}
+		time.Sleep(warmPoolInterval)
+	}
+}
+
+// Creates missing standby pods and removes surplus ones for every pool of the custom resource.
+func ReconcileWarmPools(namespace string) error {
+	crdobject, crdclient, err := fetchAzurePipelinesPool(namespace)
+	if err != nil {
+		return err
+	}
+
+	cs := CreateClientSet()
+	podClient := cs.clientset.CoreV1().Pods(namespace)
+
+	for i := range crdobject.Spec.AgentPools {
+		pool := &crdobject.Spec.AgentPools[i]
+		// Only one replica manages the standby pods of a pool, the leader or the owner of its shard
+		if !ownsPool(pool.PoolName) {
+			continue
+		}
+		// Standby pods only run in the cluster and the namespace of the webserver, CreatePod does not
+		// hand them out to pools running elsewhere
+		if pool.Cluster != "" || poolNamespace(crdobject, pool, namespace) != namespace {
+			continue
+		}
+		// Standby pods are kept as they are while the kill switch is engaged
+		if _, stopped := engagedKillSwitch(pool.PoolName); stopped {
+			continue
+		}
+		target := scaledWarmPoolTarget(pool, namespace, time.Now())
+
+		pods, err := podClient.List(metav1.ListOptions{LabelSelector: standbyLabel + "=" + pool.PoolName})
+		if err != nil {
+			return err
+		}
+
+		var live []v1.Pod
+		failure, running := "", false
+		for _, pod := range pods.Items {
+			if pod.Status.Phase == v1.PodFailed || pod.Status.Phase == v1.PodSucceeded {
+				log.Println("Removing finished standby pod " + pod.GetName())
+				podClient.Delete(pod.GetName(), &metav1.DeleteOptions{})
+				if pod.Status.Phase == v1.PodFailed {
+					failure = "Standby pod " + pod.GetName() + " failed: " + pod.Status.Reason + " " + pod.Status.Message
+				}
+			} else {
+				live = append(live, pod)
+				running = running || pod.Status.Phase == v1.PodRunning
+			}
+		}
+
+		now := time.Now()
+		for n := len(live); n < target && !isReplenishmentPaused(pool.PoolName, now); n++ {
+			// The requests of the pool go first, the next round adds the rest
+			if waitForApiBudget(pool.PoolName, apiOperationCreate, 0) != nil {
+				break
+			}
+			if err := createStandbyPod(cs, crdclient, crdobject, pool.PoolName, namespace); err != nil {
+				log.Println("Failed to create standby pod for pool "+pool.PoolName, err)
+				failure = err.Error()
+				break
+			}
+		}
+		if failure != "" {
+			recordReplenishFailure(pool.PoolName, failure, now)
+		} else if running {
+			recordReplenishSuccess(pool.PoolName)
+		}
+
+		for n := len(live); n > target; n-- {
+			if waitForApiBudget(pool.PoolName, apiOperationDelete, 0) != nil {
+				break
+			}
+			name := live[n-1].GetName()
+			log.Println("Removing surplus standby pod " + name)
+			podClient.Delete(name, &metav1.DeleteOptions{})
+		}
+	}
+	return nil
+}
+
+func createStandbyPod(cs *k8s, crdclient v1alpha1.AzurePipelinesPoolInterface, crdobject *v1alpha1.AzurePipelinesPool, poolName string, namespace string) error {
+	pool := v1alpha1.FetchAgentPool(crdobject, poolName)
+	pod := crdclient.AddNewPodForOS(crdobject, poolName, v1alpha1.PoolOS(pool), map[string]string{standbyLabel: poolName})
+	if pod == nil {
+		return errors.New("No pod spec found for pool " + poolName)
+	}
+
+	if record, quarantined := getQuarantine(poolName, agentImage(pod)); quarantined {
+		return quarantineError(record)
+	}
+	v1alpha1.AddSharedTools(pod, pool)
+	v1alpha1.AddMeshAnnotations(pod, pool)
+
+	if IsBlockingViolation(LintPod(pod, crdobject.Spec.PodLintRules)) {
+		return errors.New("Standby pod rejected by pod lint rules")
+	}
+	if err := constrainWindowsBuild(cs, pod, pool); err != nil {
+		return err
+	}
+
+	pod.ObjectMeta.GenerateName = ""
+	pod.ObjectMeta.Name = standbyPodPrefix + randomSuffix()
+
+	podClient := cs.clientset.CoreV1().Pods(namespace)
+	webserverpod, err := podClient.List(metav1.ListOptions{LabelSelector: "app=azurepipelinespool-operator"})
+	if err == nil && len(webserverpod.Items) > 0 {
+		AddOwnerRefToObject(pod, AsOwner(&webserverpod.Items[0]))
+	}
+
+	optional := true
+	volume := getSecretVolume(standbySecretName(pod.GetName()))
+	volume.VolumeSource.Secret.Optional = &optional
+	pod.Spec.Volumes = append(pod.Spec.Volumes, *volume)
+	addRegistryCredentialsVolume(pod, pool, standbySecretName(pod.GetName()))
+	addKubeconfigVolume(pod, pool, standbySecretName(pod.GetName()))
+	addDiagnosticsEnvironmentVariables(pod, v1alpha1.DiagnosticsMode(pool, nil))
+	addEphemeralEnvironmentVariable(pod, pool)
+	addJobContextEnvironmentVariable(pod)
+	addIdentityToken(pod, namespace)
+	addArtifactCacheEnvironmentVariable(pod, namespace)
+	stampProvenance(pod, "", newPodProvenance(crdobject, pool, nil))
+
+	_, err = podClient.Create(pod)
+	if err == nil {
+		log.Println("Standby pod " + pod.GetName() + " created for pool " + poolName)
+	}
+	return err
+}
+
+// Claims a running standby pod of the pool for the agent request and creates the secret it waits
+// for. Relabelling goes through an update, so two replicas cannot claim the same pod.
+func acquireStandbyPod(agentRequest AgentRequest, namespace string, pool *v1alpha1.AgentPoolSpec) (AgentProvisionResponse, bool) {
+	var response AgentProvisionResponse
+	cs := CreateClientSet()
+	podClient := cs.clientset.CoreV1().Pods(namespace)
+
+	pods, err := podClient.List(metav1.ListOptions{LabelSelector: standbyLabel + "=" + pool.PoolName})
+	if err != nil {
+		log.Println("Failed to list standby pods", err)
+		return response, false
+	}
+	sortByPreferredNode(pods.Items, preferredNodeForRun(agentRequest.RunId, namespace))
+
+	for i := range pods.Items {
+		pod := &pods.Items[i]
+		if pod.Status.Phase != v1.PodRunning {
+			continue
+		}
+
+		delete(pod.Labels, standbyLabel)
+		pod.Labels[agentIdLabel] = agentRequest.AgentId
+		pod.Labels[agentPoolLabel] = pool.PoolName
+		if isValidRunId(agentRequest.RunId) {
+			pod.Labels[runIdLabel] = agentRequest.RunId
+		}
+		annotateDefinition(pod, agentRequest.Definition)
+		provenance := podProvenance(pod)
+		provenance.RequestDigest = requestDigest(agentRequest)
+		stampProvenance(pod, agentRequest.AgentId, provenance)
+		claimed, err := podClient.Update(pod)
+		if err != nil {
+			log.Println("Standby pod "+pod.GetName()+" could not be claimed", err)
+			continue
+		}
+
+		var owner *v1.Pod
+		webserverpod, err := podClient.List(metav1.ListOptions{LabelSelector: "app=azurepipelinespool-operator"})
+		if err == nil && len(webserverpod.Items) > 0 {
+			owner = &webserverpod.Items[0]
+		}
+		if _, err := createNamedSecret(cs, agentRequest, owner, standbySecretName(claimed.GetName()), namespace); err != nil {
+			// The pod would wait for the secret forever, a new agent pod is created instead
+			log.Println("Failed to create the secret of standby pod "+claimed.GetName(), err)
+			podClient.Delete(claimed.GetName(), &metav1.DeleteOptions{})
+			return response, false
+		}
+		response.Warnings = append(response.Warnings, provisionRegistryCredentials(cs, agentRequest.AgentId, pool, standbySecretName(claimed.GetName()), owner, namespace)...)
+		response.Warnings = append(response.Warnings, provisionKubeconfig(cs, agentRequest.AgentId, pool, standbySecretName(claimed.GetName()), owner, namespace)...)
+		RecordJournalStep(agentRequest, namespace, "", JournalStepPodCreated, claimed.GetName())
+		watchAgentStartup(agentRequest.AgentId, pool.PoolName, claimed.GetName(), namespace)
+		log.Println("Standby pod " + claimed.GetName() + " claimed by agent " + agentRequest.AgentId)
+
+		if pool.PublishDNS {
+			if err := createAgentService(cs, claimed, agentRequest.AgentId, namespace); err != nil {
+				response.Warnings = append(response.Warnings, "Agent DNS name not published: "+err.Error())
+			}
+		}
+
+		response.Namespace = namespace
+		response.Accepted = true
+		response.ResponseType = "Success"
+		return response, true
+	}
+	return response, false
+}
+
+func standbySecretName(podName string) string {
+	return podName + standbySecretTail
+}
+
+func randomSuffix() string {
+	b := make([]byte, 5)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func fetchAzurePipelinesPool(namespace string) (*v1alpha1.AzurePipelinesPool, v1alpha1.AzurePipelinesPoolInterface, error) {
+	config, err := rest.InClusterConfig()
+	if err != nil && !v1alpha1.IsTestingEnv() {
+		return nil, nil, err
+	}
+	crdclient, err := v1alpha1.NewClient(config)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	poolclient := crdclient.AzurePipelinesPool(namespace)
+	crdobject, err := poolclient.Get("azurepipelinespool-operator")
+	if err != nil {
+		return nil, nil, err
+	}
+	return crdobject, poolclient, nil
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	v1alpha1 "github.com/microsoft/poolprovider-for-k8s/pkg/apis/dev/v1alpha1"
+	"github.com/microsoft/poolprovider-for-k8s/pkg/azuredevops"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestWarmPoolTargetShouldApplyHintsUpToMaximum(t *testing.T) {
+	pool := &v1alpha1.AgentPoolSpec{WarmPoolSize: 2}
+	if target := warmPoolTarget(pool, 5); target != 2 {
+		t.Errorf("Hints must be ignored without a maximum. Got %d", target)
+	}
+
+	pool.MaxWarmPoolSize = 4
+	if target := warmPoolTarget(pool, 1); target != 3 {
+		t.Errorf("Expected target 3. Got %d", target)
+	}
+	if target := warmPoolTarget(pool, 10); target != 4 {
+		t.Errorf("Expected target capped at 4. Got %d", target)
+	}
+}
+
+func TestAcquireStandbyPodShouldClaimRunningPod(t *testing.T) {
+	SetupCustomResource()
+	cs := CreateClientSet()
+	podClient := cs.clientset.CoreV1().Pods(testnamespace)
+
+	pod := &v1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "azure-pipelines-standby-1", Labels: map[string]string{standbyLabel: "linux"}}}
+	pod.Status.Phase = v1.PodRunning
+	podClient.Create(pod)
+
+	var agentrequest AgentRequest
+	agentrequest.AgentId = "1"
+	response, ok := acquireStandbyPod(agentrequest, testnamespace, &v1alpha1.AgentPoolSpec{PoolName: "linux", WarmPoolSize: 1})
+	if !ok || !response.Accepted {
+		t.Fatalf("Expected the standby pod to be claimed")
+	}
+
+	pods, _ := podClient.List(metav1.ListOptions{LabelSelector: agentIdLabel + "=1"})
+	if len(pods.Items) != 1 || pods.Items[0].Labels[standbyLabel] != "" {
+		t.Errorf("Claimed pod must be labelled with the agent id only")
+	}
+
+	secret, err := cs.clientset.CoreV1().Secrets(testnamespace).Get(standbySecretName("azure-pipelines-standby-1"), metav1.GetOptions{})
+	if err != nil || secret.Labels[agentIdLabel] != "1" {
+		t.Errorf("Expected the agent secret of the standby pod to be created")
+	}
+
+	if _, ok := acquireStandbyPod(agentrequest, testnamespace, &v1alpha1.AgentPoolSpec{PoolName: "linux", WarmPoolSize: 1}); ok {
+		t.Errorf("A standby pod must only be claimed once")
+	}
+}
+
+func TestCountPendingJobsShouldSkipAssignedRequests(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"count":3,"value":[{"requestId":1},{"requestId":2,"assignTime":"2020-01-01T00:00:00Z"},{"requestId":3}]}`))
+	}))
+	defer server.Close()
+
+	client := azuredevops.NewClient(azuredevops.Config{ServerUrl: server.URL, Token: "pat", Timeout: time.Second})
+	pending, err := countPendingJobs(client, 7)
+	if err != nil || pending != 2 {
+		t.Errorf("Expected 2 pending jobs. Got %d (%v)", pending, err)
+	}
+}
+
+func TestReplenishBackoffDelayShouldDoubleUpToMaximum(t *testing.T) {
+	if delay := replenishBackoffDelay(1, time.Hour); delay != warmPoolInterval {
+		t.Errorf("Expected the first pause to be the controller interval. Got %v", delay)
+	}
+	if delay := replenishBackoffDelay(3, time.Hour); delay != 4*warmPoolInterval {
+		t.Errorf("Expected the pause doubled per failed round. Got %v", delay)
+	}
+	if delay := replenishBackoffDelay(30, 10*time.Minute); delay != 10*time.Minute {
+		t.Errorf("Expected the pause capped at the maximum. Got %v", delay)
+	}
+}
+
+func TestReplenishmentShouldPauseAfterFailuresUntilPodsRun(t *testing.T) {
+	now := time.Now()
+	recordReplenishFailure("backoff", "ImagePullBackOff", now)
+	recordReplenishFailure("backoff", "ImagePullBackOff", now)
+
+	if !isReplenishmentPaused("backoff", now.Add(warmPoolInterval)) {
+		t.Errorf("Expected the replenishment to be paused after two failed rounds")
+	}
+	if isReplenishmentPaused("backoff", now.Add(2*warmPoolInterval)) {
+		t.Errorf("Expected the replenishment to resume after the pause")
+	}
+
+	recordReplenishSuccess("backoff")
+	if isReplenishmentPaused("backoff", now) {
+		t.Errorf("Expected running standby pods to end the backoff")
+	}
+}
+
+func TestWarmPoolTargetShouldScaleDownAfterCooldown(t *testing.T) {
+	now := time.Now()
+	cooledWarmPoolTarget("cooldown", 1, 5*time.Minute, now)
+	if target := cooledWarmPoolTarget("cooldown", 4, 5*time.Minute, now.Add(time.Minute)); target != 4 {
+		t.Errorf("Expected the warm pool to scale up at once. Got %d", target)
+	}
+	if target := cooledWarmPoolTarget("cooldown", 1, 5*time.Minute, now.Add(3*time.Minute)); target != 4 {
+		t.Errorf("Expected the warm pool to keep its size during the cooldown. Got %d", target)
+	}
+	if target := cooledWarmPoolTarget("cooldown", 2, 5*time.Minute, now.Add(6*time.Minute)); target != 2 {
+		t.Errorf("Expected the warm pool to scale down after the cooldown. Got %d", target)
+	}
+}
+
+func TestCapWarmPoolTargetShouldLeaveRoomForAgents(t *testing.T) {
+	pool := &v1alpha1.AgentPoolSpec{}
+	if target := capWarmPoolTarget(pool, 3, 10); target != 3 {
+		t.Errorf("Expected no cap without MaxAgents. Got %d", target)
+	}
+
+	pool.MaxAgents = 5
+	if target := capWarmPoolTarget(pool, 3, 3); target != 2 {
+		t.Errorf("Expected target capped at 2. Got %d", target)
+	}
+	if target := capWarmPoolTarget(pool, 3, 7); target != 0 {
+		t.Errorf("Expected no standby pods at MaxAgents. Got %d", target)
+	}
+}
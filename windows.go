@@ -0,0 +1,95 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"strings"
+
+	v1alpha1 "github.com/microsoft/poolprovider-for-k8s/pkg/apis/dev/v1alpha1"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// Windows containers only run on nodes with the same OS build as their base image. Agent pods
+// selecting Windows nodes are pinned to nodes of the build their image was made for.
+const (
+	osLabel           = "kubernetes.io/os"
+	betaOsLabel       = "beta.kubernetes.io/os"
+	windowsBuildLabel = "node.kubernetes.io/windows-build"
+)
+
+// Windows releases by the names used in image tags, e.g. servercore:ltsc2019 or agent:v1-1909
+var windowsReleaseBuilds = map[string]string{
+	"ltsc2019": "10.0.17763",
+	"1809":     "10.0.17763",
+	"1903":     "10.0.18362",
+	"1909":     "10.0.18363",
+	"2004":     "10.0.19041",
+	"20h2":     "10.0.19042",
+	"ltsc2022": "10.0.20348",
+}
+
+func unsupportedOSError(os string) error {
+	return errors.New(UnsupportedOSError + " " + os)
+}
+
+func isWindowsPod(pod *v1.Pod) bool {
+	return pod.Spec.NodeSelector[osLabel] == "windows" || pod.Spec.NodeSelector[betaOsLabel] == "windows"
+}
+
+// Returns the Windows build of the image from the release named in its tag, or an empty string.
+func windowsBuildForImage(image string) string {
+	name := image
+	if i := strings.LastIndex(image, "/"); i >= 0 {
+		name = image[i+1:]
+	}
+	i := strings.LastIndex(name, ":")
+	if i < 0 {
+		return ""
+	}
+
+	tag := strings.ToLower(name[i+1:])
+	for _, part := range strings.FieldsFunc(tag, func(r rune) bool { return r == '-' || r == '_' }) {
+		if build, ok := windowsReleaseBuilds[part]; ok {
+			return build
+		}
+	}
+	return ""
+}
+
+// Adds a node selector on the Windows build of the agent image and checks that a node with that
+// build exists, so the pod fails here instead of staying unschedulable or crashing on start.
+func constrainWindowsBuild(cs *k8s, pod *v1.Pod, pool *v1alpha1.AgentPoolSpec) error {
+	if pod == nil || !isWindowsPod(pod) || len(pod.Spec.Containers) == 0 {
+		return nil
+	}
+	if pod.Spec.NodeSelector[windowsBuildLabel] != "" {
+		return nil
+	}
+
+	image := pod.Spec.Containers[0].Image
+	build := ""
+	if pool != nil {
+		build = pool.WindowsBuild
+	}
+	if build == "" {
+		build = windowsBuildForImage(image)
+	}
+	if build == "" {
+		log.Println("Could not tell the Windows build of image " + image + ", the pod is not pinned to a build")
+		return nil
+	}
+
+	pod.Spec.NodeSelector[windowsBuildLabel] = build
+
+	// Listing nodes needs cluster wide permissions, without them the selector alone has to do
+	nodes, err := cs.clientset.CoreV1().Nodes().List(metav1.ListOptions{LabelSelector: windowsBuildLabel + "=" + build})
+	if err != nil {
+		log.Println("Could not list Windows nodes", err)
+		return nil
+	}
+	if len(nodes.Items) == 0 {
+		return errors.New("No Windows node with build " + build + " found for image " + image)
+	}
+	return nil
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"testing"
+
+	v1alpha1 "github.com/microsoft/poolprovider-for-k8s/pkg/apis/dev/v1alpha1"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestWindowsBuildForImage(t *testing.T) {
+	tests := map[string]string{
+		"mcr.microsoft.com/windows/servercore:ltsc2019": "10.0.17763",
+		"contoso.azurecr.io/agent:v5-1909":              "10.0.18363",
+		"contoso.azurecr.io/agent:v5":                   "",
+		"contoso.azurecr.io:5000/agent":                 "",
+	}
+	for image, expected := range tests {
+		if build := windowsBuildForImage(image); build != expected {
+			t.Errorf("Expected build %q for %s. Got %q", expected, image, build)
+		}
+	}
+}
+
+func TestConstrainWindowsBuildShouldRejectMissingBuild(t *testing.T) {
+	SetupCustomResource()
+	cs := CreateClientSet()
+	pod := &v1.Pod{Spec: v1.PodSpec{
+		NodeSelector: map[string]string{osLabel: "windows"},
+		Containers:   []v1.Container{{Image: "contoso.azurecr.io/agent:ltsc2019"}},
+	}}
+
+	if err := constrainWindowsBuild(cs, pod, &v1alpha1.AgentPoolSpec{}); err == nil {
+		t.Errorf("Expected an error without a node of the build")
+	}
+	if pod.Spec.NodeSelector[windowsBuildLabel] != "10.0.17763" {
+		t.Errorf("Expected the pod to be pinned to the build")
+	}
+
+	node := &v1.Node{ObjectMeta: metav1.ObjectMeta{Name: "win", Labels: map[string]string{windowsBuildLabel: "10.0.17763"}}}
+	cs.clientset.CoreV1().Nodes().Create(node)
+	delete(pod.Spec.NodeSelector, windowsBuildLabel)
+	if err := constrainWindowsBuild(cs, pod, &v1alpha1.AgentPoolSpec{}); err != nil {
+		t.Errorf("Expected the pod to be accepted. Got %v", err)
+	}
+}
+
+func TestResolveAgentOSShouldPickTheTemplateOfTheRequestedOS(t *testing.T) {
+	linux := &v1alpha1.AgentPoolSpec{PoolName: "linux"}
+	windows := &v1alpha1.AgentPoolSpec{PoolName: "windows", OS: "Windows"}
+	both := &v1alpha1.AgentPoolSpec{PoolName: "both", WindowsSpec: &v1.PodSpec{}}
+
+	tests := []struct {
+		pool      *v1alpha1.AgentPoolSpec
+		requested string
+		os        string
+		ok        bool
+	}{
+		{linux, "", v1alpha1.OSLinux, true},
+		{linux, "windows", v1alpha1.OSWindows, false},
+		{windows, "", v1alpha1.OSWindows, true},
+		{windows, "linux", v1alpha1.OSLinux, false},
+		{both, "Windows", v1alpha1.OSWindows, true},
+		{both, "linux", v1alpha1.OSLinux, true},
+		{both, "macos", "macos", false},
+	}
+	for _, test := range tests {
+		if os, ok := v1alpha1.ResolveAgentOS(test.pool, test.requested); os != test.os || ok != test.ok {
+			t.Errorf("Expected %s %v for %q on pool %s. Got %s %v", test.os, test.ok, test.requested, test.pool.PoolName, os, ok)
+		}
+	}
+}
+
+func TestRenderAgentPodForOSShouldPinThePodToItsOS(t *testing.T) {
+	pool := &v1alpha1.AgentPoolSpec{
+		PoolSpec:    &v1.PodSpec{Containers: []v1.Container{{Name: "vsts-agent", Image: "contoso.azurecr.io/agent:ubuntu"}}},
+		WindowsSpec: &v1.PodSpec{Containers: []v1.Container{{Name: "vsts-agent", Image: "contoso.azurecr.io/agent:ltsc2019", Command: []string{"powershell", "C:\\azp\\start.ps1"}}}},
+	}
+
+	pod := v1alpha1.RenderAgentPodForOS(pool, nil, v1alpha1.OSWindows)
+	container := pod.Spec.Containers[0]
+	if pod.Spec.NodeSelector[osLabel] != "windows" || container.Image != "contoso.azurecr.io/agent:ltsc2019" || container.Command[0] != "powershell" {
+		t.Errorf("Expected the Windows template on Windows nodes. Got %v %s %v", pod.Spec.NodeSelector, container.Image, container.Command)
+	}
+	if container.VolumeMounts[0].MountPath != "C:\\azurepipelines\\agent" {
+		t.Errorf("Expected the credentials mounted on the C: drive. Got %s", container.VolumeMounts[0].MountPath)
+	}
+	if pod := v1alpha1.RenderAgentPodForOS(pool, nil, v1alpha1.OSLinux); pod.Spec.NodeSelector[osLabel] != "linux" || pod.Spec.Containers[0].Image != "contoso.azurecr.io/agent:ubuntu" {
+		t.Errorf("Expected the Linux template on Linux nodes. Got %v", pod.Spec)
+	}
+
+	pool.WindowsSpec = nil
+	if pod := v1alpha1.RenderAgentPodForOS(pool, nil, v1alpha1.OSLinux); pod.Spec.NodeSelector != nil {
+		t.Errorf("Expected the node selector of pools without an OS left alone. Got %v", pod.Spec.NodeSelector)
+	}
+}